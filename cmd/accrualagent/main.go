@@ -0,0 +1,12 @@
+// Агент расчета начислений, запускаемый отдельно от HTTP API накопительной системы лояльности
+package main
+
+import (
+	"github.com/pinbrain/gophermart/internal/app"
+)
+
+func main() {
+	if err := app.RunAgent(); err != nil {
+		panic(err)
+	}
+}
@@ -0,0 +1,30 @@
+// Имитация системы расчета начислений для локальной разработки
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/pinbrain/gophermart/internal/accrualmock"
+)
+
+func main() {
+	address := flag.String("a", ":8081", "Адрес запуска сервера")
+	cfg := accrualmock.Config{}
+	flag.DurationVar(&cfg.Delay, "delay", 0, "Задержка ответа")
+	flag.DurationVar(&cfg.StageDuration, "stage-duration", 2*time.Second, "Время, которое заказ проводит в каждом из статусов REGISTERED и PROCESSING")
+	flag.IntVar(&cfg.RateLimit, "rate-limit", 0, "Количество запросов в минуту, после которого сервер отвечает 429 (0 - без ограничения)")
+	flag.Float64Var(&cfg.UnregisteredRate, "unregistered-rate", 0, "Доля заказов, не зарегистрированных в системе (0..1)")
+	flag.Float64Var(&cfg.InvalidRate, "invalid-rate", 0.1, "Доля заказов, завершающихся статусом INVALID (0..1)")
+	flag.Float64Var(&cfg.ErrorRate, "error-rate", 0, "Доля запросов, завершающихся ответом 500 (0..1)")
+	flag.Float64Var(&cfg.MinAccrual, "min-accrual", 100, "Минимальное начисление по заказу")
+	flag.Float64Var(&cfg.MaxAccrual, "max-accrual", 1000, "Максимальное начисление по заказу")
+	flag.Parse()
+
+	log.Printf("accrual mock is listening on %s", *address)
+	if err := http.ListenAndServe(*address, accrualmock.NewServer(cfg).Handler()); err != nil {
+		log.Fatal(err)
+	}
+}
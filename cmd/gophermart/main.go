@@ -1,10 +1,18 @@
 package main
 
 import (
+	"os"
+
 	"github.com/pinbrain/gophermart/internal/app"
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if err := app.RunMigrate(os.Args[2:]); err != nil {
+			panic(err)
+		}
+		return
+	}
 	if err := app.Run(); err != nil {
 		panic(err)
 	}
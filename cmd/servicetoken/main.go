@@ -0,0 +1,26 @@
+// Утилита выпуска сервисных JWT для доступа к внутреннему API
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/pinbrain/gophermart/internal/utils"
+)
+
+func main() {
+	key := flag.String("key", os.Getenv("SERVICE_JWT_KEY"), "Ключ подписи сервисных JWT")
+	subject := flag.String("sub", "", "Имя сервиса, которому выпускается токен")
+	scopes := flag.String("scopes", "", "Области доступа через запятую, например accruals:write,agent:read")
+	ttl := flag.Duration("ttl", 0, "Срок действия токена (0 - бессрочный)")
+	flag.Parse()
+
+	token, err := utils.BuildServiceJWTString(*key, *subject, strings.Split(*scopes, ","), *ttl)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	fmt.Println(token)
+}
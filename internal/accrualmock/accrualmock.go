@@ -0,0 +1,205 @@
+// Package accrualmock реализует API системы расчета начислений для локальной разработки:
+// заказы проходят статусы REGISTERED -> PROCESSING -> PROCESSED/INVALID, а задержки ответов,
+// ошибки и ограничение частоты запросов задаются конфигурацией.
+package accrualmock
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/pinbrain/gophermart/internal/model"
+)
+
+// Окно, в котором считаются запросы для ограничения частоты
+const rateLimitWindow = time.Minute
+
+type Config struct {
+	// Задержка ответа
+	Delay time.Duration
+	// Время, которое заказ проводит в каждом из статусов REGISTERED и PROCESSING
+	StageDuration time.Duration
+	// Количество запросов в минуту, после которого отвечаем 429, 0 - без ограничения
+	RateLimit int
+	// Доля заказов, не зарегистрированных в системе (0..1), на них отвечаем 204
+	UnregisteredRate float64
+	// Доля зарегистрированных заказов, завершающихся статусом INVALID (0..1)
+	InvalidRate float64
+	// Доля запросов, завершающихся ответом 500 (0..1)
+	ErrorRate float64
+	// Границы случайного начисления по обработанному заказу
+	MinAccrual float64
+	MaxAccrual float64
+}
+
+// Ответ на запрос статуса заказа, начисление передается только для обработанных заказов
+type orderRes struct {
+	Order   string                   `json:"order"`
+	Status  model.OrderAccrualStatus `json:"status"`
+	Accrual *model.Money             `json:"accrual,omitempty"`
+}
+
+// Судьба заказа определяется при первом запросе его статуса
+type order struct {
+	registered bool
+	seenAt     time.Time
+	final      model.OrderAccrualStatus
+	accrual    model.Money
+}
+
+type Server struct {
+	cfg Config
+
+	mu       sync.Mutex
+	orders   map[string]*order
+	windowAt time.Time
+	requests int
+}
+
+func NewServer(cfg Config) *Server {
+	if cfg.MaxAccrual < cfg.MinAccrual {
+		cfg.MaxAccrual = cfg.MinAccrual
+	}
+	return &Server{
+		cfg:    cfg,
+		orders: make(map[string]*order),
+	}
+}
+
+// Handler возвращает обработчик API: GET /api/orders/{number} - статус одного заказа,
+// POST /api/orders/batch с JSON-массивом номеров или GET /api/orders/batch?order=... - статусы
+// нескольких заказов
+func (s *Server) Handler() http.Handler {
+	r := chi.NewRouter()
+	r.Use(s.simulate)
+	r.Get("/api/orders/batch", s.getBatch)
+	r.Post("/api/orders/batch", s.postBatch)
+	r.Get("/api/orders/{number}", s.getOrder)
+	return r
+}
+
+// simulate добавляет задержку, ограничивает частоту запросов и с заданной вероятностью отвечает ошибкой
+func (s *Server) simulate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.cfg.Delay > 0 {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-time.After(s.cfg.Delay):
+			}
+		}
+		if retryAfter, limited := s.limit(); limited {
+			w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter.Seconds())+1))
+			http.Error(w, fmt.Sprintf("No more than %d requests per minute allowed", s.cfg.RateLimit), http.StatusTooManyRequests)
+			return
+		}
+		if rand.Float64() < s.cfg.ErrorRate {
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// limit учитывает запрос в текущем окне и возвращает время до конца окна, если лимит исчерпан
+func (s *Server) limit() (time.Duration, bool) {
+	if s.cfg.RateLimit <= 0 {
+		return 0, false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(s.windowAt) >= rateLimitWindow {
+		s.windowAt = now
+		s.requests = 0
+	}
+	s.requests++
+	if s.requests > s.cfg.RateLimit {
+		return s.windowAt.Add(rateLimitWindow).Sub(now), true
+	}
+	return 0, false
+}
+
+// status возвращает текущий статус заказа, nil - заказ не зарегистрирован
+func (s *Server) status(number string) *orderRes {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	o, ok := s.orders[number]
+	if !ok {
+		o = &order{
+			registered: rand.Float64() >= s.cfg.UnregisteredRate,
+			seenAt:     time.Now(),
+			final:      model.OrderAccProcessed,
+		}
+		if rand.Float64() < s.cfg.InvalidRate {
+			o.final = model.OrderAccInvalid
+		} else {
+			o.accrual = model.MoneyFromFloat(s.cfg.MinAccrual + rand.Float64()*(s.cfg.MaxAccrual-s.cfg.MinAccrual))
+		}
+		s.orders[number] = o
+	}
+	if !o.registered {
+		return nil
+	}
+
+	res := &orderRes{Order: number}
+	switch elapsed := time.Since(o.seenAt); {
+	case elapsed < s.cfg.StageDuration:
+		res.Status = model.OrderAccRegistered
+	case elapsed < 2*s.cfg.StageDuration:
+		res.Status = model.OrderAccProcessing
+	default:
+		res.Status = o.final
+		if o.final == model.OrderAccProcessed {
+			accrual := o.accrual
+			res.Accrual = &accrual
+		}
+	}
+	return res
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	}
+}
+
+func (s *Server) getOrder(w http.ResponseWriter, r *http.Request) {
+	res := s.status(chi.URLParam(r, "number"))
+	if res == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	writeJSON(w, res)
+}
+
+func (s *Server) batch(w http.ResponseWriter, numbers []string) {
+	results := make([]orderRes, 0, len(numbers))
+	for _, number := range numbers {
+		if res := s.status(number); res != nil {
+			results = append(results, *res)
+		}
+	}
+	writeJSON(w, results)
+}
+
+func (s *Server) getBatch(w http.ResponseWriter, r *http.Request) {
+	s.batch(w, r.URL.Query()["order"])
+}
+
+func (s *Server) postBatch(w http.ResponseWriter, r *http.Request) {
+	var numbers []string
+	if err := json.NewDecoder(r.Body).Decode(&numbers); err != nil {
+		http.Error(w, "Неверный формат запроса", http.StatusBadRequest)
+		return
+	}
+	s.batch(w, numbers)
+}
@@ -2,199 +2,836 @@ package agent
 
 import (
 	"context"
-	"encoding/json"
+	crand "crypto/rand"
+	"encoding/hex"
 	"errors"
-	"fmt"
-	"io"
-	"net/http"
+	"math/rand"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/pinbrain/gophermart/internal/appctx"
+	"github.com/pinbrain/gophermart/internal/faults"
+	"github.com/pinbrain/gophermart/internal/instance"
 	"github.com/pinbrain/gophermart/internal/logger"
 	"github.com/pinbrain/gophermart/internal/model"
+	"github.com/pinbrain/gophermart/internal/ratelimit"
+	"github.com/sirupsen/logrus"
 )
 
 const (
-	// Интервал проверки наличия необработанных заказов
-	checkInterval = 10 * time.Second
-	// Количество горутин, отправляющих запросы в accrual
-	workerCount = 5
+	// Интервалы проверки наличия необработанных заказов по умолчанию
+	defaultNewPollInterval        = time.Second
+	defaultProcessingPollInterval = 10 * time.Second
+	// Время, после которого заказ, переданный воркеру, считается потерянным, по умолчанию
+	defaultInFlightTimeout = time.Minute
+	// Количество горутин, отправляющих запросы в accrual, по умолчанию
+	defaultWorkerCount = 5
+	// Интервал поиска заказов, которые слишком долго не удается обработать, по умолчанию
+	defaultExpireCheckInterval = time.Minute
+	// Количество попыток запроса статуса заказа и задержки между ними по умолчанию
+	defaultFetchAttempts     = 3
+	defaultFetchRetryBackoff = 500 * time.Millisecond
+	defaultFetchMaxBackoff   = 10 * time.Second
+	// Пауза в запросах после срабатывания автоматического выключателя по умолчанию
+	defaultCircuitCooldown = 30 * time.Second
+	// Время ожидания ответа системы начислений на один запрос по умолчанию
+	defaultRequestTimeout = 10 * time.Second
+	// Ключ ограничения частоты запросов, общего для всех воркеров
+	requestLimiterKey = "accrual"
+	// Время на сохранение уже полученных статусов заказов при остановке агента по умолчанию
+	defaultDrainTimeout = 3 * time.Second
+	// Причина перевода в INVALID заказов, которые слишком долго не удается обработать
+	expiredOrderReason = "accrual processing timed out"
+	// Задержка перед повторной подпиской на уведомления о новых заказах после потери соединения
+	listenRetryInterval = 5 * time.Second
+	// Причина перевода в STALLED заказов, статус которых не удается получить из системы начислений
+	stalledOrderReason = "accrual status fetch failed too many times"
+	// Причина возврата в NEW заказов, слишком долго остающихся в статусе PROCESSING
+	stuckOrderReason = "accrual processing stuck, requeued"
 )
 
 var ErrReqLimit = errors.New("too many requests")
 
 type Storage interface {
-	GetOrdersToProcess(ctx context.Context) ([]model.Order, error)
-	UpdateOrderStatus(ctx context.Context, orderID int, status model.OrderStatus, accrual float64) error
+	ClaimOrdersToProcess(
+		ctx context.Context, status model.OrderStatus, afterID, limit int, claimedBy string, inFlightAfter, polledBefore time.Time,
+	) ([]model.Order, error)
+	GetOrdersToProcess(
+		ctx context.Context, status model.OrderStatus, afterID, limit int, polledBefore time.Time,
+	) ([]model.Order, error)
+	ExtendOrderClaims(ctx context.Context, claimedBy string, orderIDs []int) error
+	ReleaseOrderClaims(ctx context.Context, claimedBy string, orderIDs []int) error
+	FailOrderFetch(ctx context.Context, orderID, maxFailures int, reason string) (bool, error)
+	SaveRateLimitEnd(ctx context.Context, until time.Time) error
+	GetRateLimitEnd(ctx context.Context) (time.Time, error)
+	UpdateOrderStatus(ctx context.Context, orderID int, status model.OrderStatus, accrual model.Money) (model.Money, error)
+	CountOrdersToProcess(ctx context.Context) (*model.OrderBacklog, error)
+	ExpireOrders(ctx context.Context, olderThan time.Time, reason string) (int, error)
+	RequeueStuckOrders(ctx context.Context, stuckBefore time.Time, reason string) (int, error)
+	ListenNewOrders(ctx context.Context, fn func()) error
+}
+
+// OrderEventPublisher получает события изменения статусов заказов
+type OrderEventPublisher interface {
+	PublishOrderStatus(event model.OrderStatusEvent)
+}
+
+type AccrualAgentCfg struct {
+	// Адрес системы начислений, в которую отправляются заказы, не подходящие ни под один из Providers
+	AccrualURL string
+	// Дополнительные системы начислений, выбираемые по самому длинному совпавшему префиксу номера заказа
+	Providers []ProviderRoute
+	// Интервал опроса новых заказов
+	NewPollInterval time.Duration
+	// Забирать новые заказы по уведомлению из БД сразу после загрузки. Опрос с интервалом
+	// NewPollInterval при этом остается на случай потери уведомлений.
+	ListenNewOrders bool
+	// Интервал опроса заказов, уже принятых в обработку системой начислений
+	ProcessingPollInterval time.Duration
+	// Возраст заказа, после которого агент перестает его обрабатывать, 0 - без ограничения
+	OrderMaxAge time.Duration
+	// Время, на которое заказ закрепляется за агентом. Пока заказ обрабатывается, закрепление
+	// продлевается, а если агент перестал его продлевать, например, упал, заказ отправляется повторно.
+	InFlightTimeout time.Duration
+	// Идентификатор экземпляра агента, за которым закрепляются заказы. По умолчанию генерируется.
+	InstanceID string
+	// Количество горутин, отправляющих запросы в accrual
+	WorkerCount int
+	// Если больше WorkerCount, количество горутин меняется от WorkerCount до MaxWorkerCount
+	// в зависимости от количества заказов к обработке и времени ответа системы начислений
+	MaxWorkerCount int
+	// Время, после которого заказ, остающийся в статусе PROCESSING, возвращается в NEW, 0 - не возвращается
+	StuckOrderAge time.Duration
+	// Интервал поиска заказов старше OrderMaxAge и заказов, остающихся в PROCESSING дольше StuckOrderAge
+	ExpireCheckInterval time.Duration
+	// Количество попыток запроса статуса заказа, после которого заказ возвращается в очередь до следующего
+	// опроса. Ответ 429 попыткой не считается.
+	FetchAttempts int
+	// Задержка перед второй попыткой, далее удваивается с каждой попыткой до FetchMaxBackoff
+	FetchRetryBackoff time.Duration
+	FetchMaxBackoff   time.Duration
+	// Количество опросов подряд, в которых не удалось получить статус заказа, после которого заказ
+	// переводится в STALLED, 0 - без ограничения
+	MaxFetchFailures int
+	// Количество неудачных запросов в систему начислений подряд, после которого запросы прекращаются
+	// на время CircuitCooldown, 0 - запросы не прекращаются
+	CircuitFailures int
+	CircuitCooldown time.Duration
+	// Время ожидания ответа системы начислений на один запрос. Запрос, не уложившийся в него,
+	// считается неудачным и повторяется как при ошибке.
+	RequestTimeout time.Duration
+	// Время, в течение которого при остановке агента сохраняются уже полученные статусы заказов
+	DrainTimeout time.Duration
+	// Средняя частота запросов всех воркеров в систему начислений в секунду и количество запросов,
+	// которые можно выполнить подряд. 0 - частота ограничивается только ответами 429.
+	RequestRPS   float64
+	RequestBurst int
+	// Путь пакетного запроса статусов заказов в системе начислений AccrualURL. Если задан, агент
+	// запрашивает статусы пачками до BatchSize заказов у систем, реализующих BatchAccrualProvider.
+	BatchPath   string
+	BatchFormat BatchFormat
+	BatchSize   int
+	// Общее для всех экземпляров ограничение запросов после ответа 429, nil - каждый экземпляр
+	// узнает об ограничении самостоятельно
+	SharedRateLimit RateLimitStore
+	// Учетные данные запросов в систему начислений AccrualURL
+	Auth AccrualAuth
+	// Режим проверки: агент запрашивает статусы заказов и пишет в лог изменения, которые внес бы,
+	// но не меняет заказы в БД, не закрепляет их за собой и не сохраняет ограничение запросов.
+	// Позволяет проверить новую систему начислений на рабочих данных параллельно с основным агентом.
+	DryRun bool
+	// Искусственные сбои запросов в accrual, nil - без сбоев
+	Faults *faults.Injector
+	// Получатель событий изменения статусов заказов, nil - события не публикуются
+	Events OrderEventPublisher
 }
 
 type AccrualAgent struct {
-	storage    Storage
-	accrualURL string
+	storage   Storage
+	providers *providerRouter
+	events    OrderEventPublisher
+	breaker   *circuitBreaker
+	metrics   *agentMetrics
+
+	pollIntervals       map[model.OrderStatus]time.Duration
+	orderMaxAge         time.Duration
+	inFlightTimeout     time.Duration
+	workerCount         int
+	maxWorkerCount      int
+	expireCheckInterval time.Duration
+	stuckOrderAge       time.Duration
+	fetchAttempts       int
+	fetchRetryBackoff   time.Duration
+	fetchMaxBackoff     time.Duration
+	requestTimeout      time.Duration
+	drainTimeout        time.Duration
+	maxFetchFailures    int
+	listenNewOrders     bool
+	batchMode           bool
+	dryRun              bool
+	// Сколько заказов забирается из БД за один запрос и помещается в очередь воркеров
+	claimLimit int
+	instanceID string
 
 	ctx       context.Context
 	ctxCancel context.CancelFunc
-	ordersCh  chan model.Order
+	queue     *orderQueue
+	newOrders chan struct{}
 	wg        sync.WaitGroup
+	running   atomic.Bool
+	pool      workerPool
+	// Количество заказов, забранных из БД с последнего пересчета количества воркеров
+	claimed atomic.Int64
+	latency latencyAverage
+	// Заказы, закрепленные за агентом и еще не обработанные
+	claims claimSet
+	// Время последнего успешного ответа системы начислений в наносекундах Unix, 0 - ответов не было
+	lastContactAt atomic.Int64
+	// Контекст сохранения результатов запросов, при остановке агента отменяется после drainTimeout
+	drainCtx    context.Context
+	drainCancel context.CancelFunc
 
 	rateLimit        sync.RWMutex
 	rateLimitEndTime time.Time
+	sharedRateLimit  RateLimitStore
+	// Ограничение частоты запросов в систему начислений, nil - без ограничения
+	requestLimiter ratelimit.Limiter
+
+	backlogMu sync.Mutex
+	backlog   model.OrderBacklog
+	backlogAt time.Time
 }
 
-func NewAccrualAgent(storage Storage, accrualURL string) *AccrualAgent {
+func NewAccrualAgent(storage Storage, cfg AccrualAgentCfg) *AccrualAgent {
+	if cfg.NewPollInterval <= 0 {
+		cfg.NewPollInterval = defaultNewPollInterval
+	}
+	if cfg.ProcessingPollInterval <= 0 {
+		cfg.ProcessingPollInterval = defaultProcessingPollInterval
+	}
+	if cfg.InFlightTimeout <= 0 {
+		cfg.InFlightTimeout = defaultInFlightTimeout
+	}
+	if cfg.InstanceID == "" {
+		cfg.InstanceID = instance.NewID()
+	}
+	if cfg.WorkerCount <= 0 {
+		cfg.WorkerCount = defaultWorkerCount
+	}
+	if cfg.ExpireCheckInterval <= 0 {
+		cfg.ExpireCheckInterval = defaultExpireCheckInterval
+	}
+	if cfg.FetchAttempts <= 0 {
+		cfg.FetchAttempts = defaultFetchAttempts
+	}
+	if cfg.FetchRetryBackoff <= 0 {
+		cfg.FetchRetryBackoff = defaultFetchRetryBackoff
+	}
+	if cfg.FetchMaxBackoff < cfg.FetchRetryBackoff {
+		cfg.FetchMaxBackoff = defaultFetchMaxBackoff
+	}
+	if cfg.CircuitCooldown <= 0 {
+		cfg.CircuitCooldown = defaultCircuitCooldown
+	}
+	if cfg.RequestTimeout <= 0 {
+		cfg.RequestTimeout = defaultRequestTimeout
+	}
+	if cfg.DrainTimeout <= 0 {
+		cfg.DrainTimeout = defaultDrainTimeout
+	}
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = defaultBatchSize
+	}
+	var provider AccrualProvider = NewHTTPProvider(cfg.AccrualURL, cfg.Faults, cfg.Auth)
+	if cfg.BatchPath != "" {
+		provider = NewHTTPBatchProvider(cfg.AccrualURL, cfg.Faults, cfg.Auth, cfg.BatchPath, cfg.BatchFormat)
+	}
+	// Пакетный режим включается, если пакетные запросы поддерживает хотя бы одна система начислений
+	_, batchMode := provider.(BatchAccrualProvider)
+	for _, r := range cfg.Providers {
+		if _, ok := r.Provider.(BatchAccrualProvider); ok {
+			batchMode = true
+		}
+	}
+	if cfg.MaxWorkerCount < cfg.WorkerCount {
+		cfg.MaxWorkerCount = cfg.WorkerCount
+	}
+	claimLimit := cfg.MaxWorkerCount
+	if batchMode {
+		claimLimit = cfg.BatchSize
+	}
+	if cfg.DryRun {
+		cfg.SharedRateLimit = nil
+	}
+	var requestLimiter ratelimit.Limiter
+	if cfg.RequestRPS > 0 {
+		requestLimiter = ratelimit.NewTokenBucketLimiter(cfg.RequestRPS, max(cfg.RequestBurst, 1))
+	}
 	return &AccrualAgent{
-		storage:    storage,
-		accrualURL: accrualURL,
+		storage:   storage,
+		providers: newProviderRouter(provider, cfg.Providers),
+		metrics:   newAgentMetrics(),
+		events:    cfg.Events,
+		breaker:   newCircuitBreaker(cfg.CircuitFailures, cfg.CircuitCooldown),
+
+		pollIntervals: map[model.OrderStatus]time.Duration{
+			model.OrderNew:        cfg.NewPollInterval,
+			model.OrderProcessing: cfg.ProcessingPollInterval,
+		},
+		orderMaxAge:         cfg.OrderMaxAge,
+		inFlightTimeout:     cfg.InFlightTimeout,
+		instanceID:          cfg.InstanceID,
+		workerCount:         cfg.WorkerCount,
+		maxWorkerCount:      cfg.MaxWorkerCount,
+		expireCheckInterval: cfg.ExpireCheckInterval,
+		stuckOrderAge:       cfg.StuckOrderAge,
+		fetchAttempts:       cfg.FetchAttempts,
+		fetchRetryBackoff:   cfg.FetchRetryBackoff,
+		fetchMaxBackoff:     cfg.FetchMaxBackoff,
+		requestTimeout:      cfg.RequestTimeout,
+		drainTimeout:        cfg.DrainTimeout,
+		maxFetchFailures:    cfg.MaxFetchFailures,
+		listenNewOrders:     cfg.ListenNewOrders,
+		batchMode:           batchMode,
+		dryRun:              cfg.DryRun,
+		claimLimit:          claimLimit,
 
 		wg:               sync.WaitGroup{},
 		rateLimit:        sync.RWMutex{},
 		rateLimitEndTime: time.Time{},
+		sharedRateLimit:  cfg.SharedRateLimit,
+		requestLimiter:   requestLimiter,
+	}
+}
+
+// callAccrual выполняет запрос в систему начислений с ограничением времени requestTimeout, если
+// запросы не прекращены автоматическим выключателем, и сообщает ему результат запроса
+func (aa *AccrualAgent) callAccrual(ctx context.Context, request func(ctx context.Context) error) error {
+	if err := aa.waitRequestSlot(ctx); err != nil {
+		return err
+	}
+	if !aa.breaker.allow() {
+		return ErrCircuitOpen
+	}
+	reqCtx, cancel := context.WithTimeout(ctx, aa.requestTimeout)
+	defer cancel()
+	start := time.Now()
+	err := request(reqCtx)
+	aa.metrics.requestDuration.Observe(time.Since(start).Seconds())
+	aa.latency.observe(time.Since(start))
+	var rateLimitErr *RateLimitError
+	if errors.As(err, &rateLimitErr) {
+		aa.setRateLimit(ctx, rateLimitErr.RetryAfter)
+	}
+	if err == nil {
+		aa.lastContactAt.Store(time.Now().UnixNano())
+	}
+	switch {
+	case err == nil || errors.Is(err, ErrReqLimit):
+		// Ответ 429 означает, что система начислений доступна
+		aa.breaker.success()
+	case ctx.Err() == nil:
+		aa.breaker.failure()
+	}
+	return err
+}
+
+// waitRequestSlot ждет, пока ограничение частоты запросов разрешит очередной запрос в систему начислений
+func (aa *AccrualAgent) waitRequestSlot(ctx context.Context) error {
+	if aa.requestLimiter == nil {
+		return nil
+	}
+	for {
+		res, err := aa.requestLimiter.Allow(ctx, requestLimiterKey)
+		if err != nil {
+			return err
+		}
+		if res.Allowed {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(res.RetryAfter):
+		}
+	}
+}
+
+// newProcessingID возвращает случайный идентификатор попытки обработки заказа. Идентификатор пишется
+// в лог агента, передается в систему начислений в заголовке HeaderProcessingID и сохраняется в истории
+// статусов заказа.
+func newProcessingID() string {
+	id := make([]byte, 8)
+	if _, err := crand.Read(id); err != nil {
+		return ""
 	}
+	return hex.EncodeToString(id)
 }
 
+// fetchOrderStatus запрашивает статус заказа в системе начислений, обслуживающей номер заказа
 func (aa *AccrualAgent) fetchOrderStatus(ctx context.Context, orderNum string) (*model.AccrualResultRes, error) {
-	req, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("%s/api/orders/%s", aa.accrualURL, orderNum), nil)
-	if err != nil {
-		return nil, err
+	provider := aa.providers.route(orderNum)
+	var result *model.AccrualResultRes
+	err := aa.callAccrual(ctx, func(ctx context.Context) (err error) {
+		result, err = provider.FetchOrderStatus(ctx, orderNum)
+		return err
+	})
+	return result, err
+}
+
+// setRateLimit приостанавливает запросы в систему начислений на время retryAfter
+func (aa *AccrualAgent) setRateLimit(ctx context.Context, retryAfter time.Duration) {
+	rateLimitEndTime := time.Now().Add(retryAfter)
+	aa.rateLimit.Lock()
+	aa.rateLimitEndTime = rateLimitEndTime
+	aa.rateLimit.Unlock()
+	aa.metrics.rateLimited.Inc()
+	if aa.dryRun {
+		return
 	}
 
-	res, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return nil, err
+	// Сохраняем ограничение, чтобы после перезапуска агент не начал сразу отправлять запросы
+	if err := aa.storage.SaveRateLimitEnd(ctx, rateLimitEndTime); err != nil {
+		logger.Log.WithError(err).Error("failed to persist accrual rate limit")
+	}
+	if aa.sharedRateLimit != nil {
+		if err := aa.sharedRateLimit.SetRateLimitEnd(ctx, rateLimitEndTime); err != nil {
+			logger.Log.WithError(err).Error("failed to share accrual rate limit")
+		}
+	}
+}
+
+// fetchBackoff возвращает задержку перед повтором запроса после attempts неудачных попыток. Задержка
+// растет экспоненциально до fetchMaxBackoff, а ее случайная половина разносит повторы воркеров во времени,
+// чтобы после сбоя системы начислений они не отправляли запросы одновременно.
+func (aa *AccrualAgent) fetchBackoff(attempts int) time.Duration {
+	delay := aa.fetchRetryBackoff
+	for i := 1; i < attempts && delay < aa.fetchMaxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > aa.fetchMaxBackoff {
+		delay = aa.fetchMaxBackoff
 	}
-	defer res.Body.Close()
+	half := delay / 2
+	return half + time.Duration(rand.Int63n(int64(delay-half)+1))
+}
 
-	if res.StatusCode == http.StatusTooManyRequests {
-		retryAfter := res.Header.Get("Retry-After")
-		retryAfterDuration, err := time.ParseDuration(retryAfter + "s")
+// waitForAccrual дожидается окончания ограничения частоты запросов в систему начислений.
+// Возвращает false, если агент остановлен во время ожидания.
+func (aa *AccrualAgent) waitForAccrual(workerLogger *logrus.Entry) bool {
+	aa.rateLimit.RLock()
+	rateLimitEndTime := aa.rateLimitEndTime
+	aa.rateLimit.RUnlock()
+	if aa.sharedRateLimit != nil {
+		// Ограничение могло быть получено другим экземпляром
+		sharedEndTime, err := aa.sharedRateLimit.GetRateLimitEnd(aa.ctx)
 		if err != nil {
-			return nil, err
+			workerLogger.WithError(err).Error("failed to get shared accrual rate limit")
+		} else if sharedEndTime.After(rateLimitEndTime) {
+			rateLimitEndTime = sharedEndTime
 		}
+	}
+	sleepDuration := time.Until(rateLimitEndTime)
+	if sleepDuration <= 0 {
+		return true
+	}
+	workerLogger.Debugf("Rate limited, sleeping for %s", sleepDuration)
+	// Пока горутина ждет таймаут может прийти сигнал о завершении работы, на который нужно среагировать
+	select {
+	case <-aa.ctx.Done():
+		workerLogger.Debug("Worker stopped from sleeping state")
+		return false
+	case <-time.After(sleepDuration):
+		return true
+	}
+}
 
-		aa.rateLimit.Lock()
-		aa.rateLimitEndTime = time.Now().Add(retryAfterDuration)
-		aa.rateLimit.Unlock()
+// fetchWithRetry выполняет запрос fetch в систему начислений и повторяет его: после ответа 429
+// и во время паузы автоматического выключателя - не расходуя попытки, после прочих ошибок - до
+// fetchAttempts раз с задержкой fetchBackoff. Возвращает ошибку последней попытки или ошибку
+// контекста, если агент остановлен.
+func (aa *AccrualAgent) fetchWithRetry(workerLogger *logrus.Entry, fetch func() error) error {
+	attempts := 0
+	for {
+		if !aa.waitForAccrual(workerLogger) {
+			return aa.ctx.Err()
+		}
+		err := fetch()
+		if err == nil {
+			return nil
+		}
+		if errors.Is(err, ErrReqLimit) {
+			workerLogger.Info("Accrual service request limit reached")
+			continue
+		}
+		var delay time.Duration
+		if errors.Is(err, ErrCircuitOpen) {
+			// Попытки не расходуются, пока система начислений недоступна
+			delay = aa.breaker.retryAfter()
+		} else {
+			attempts++
+			if attempts >= aa.fetchAttempts {
+				return err
+			}
+			delay = aa.fetchBackoff(attempts)
+			workerLogger.WithError(err).Warnf("error fetching order status, retrying in %s", delay)
+		}
+		select {
+		case <-aa.ctx.Done():
+			workerLogger.Debug("Worker stopped while waiting to retry")
+			return aa.ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+}
 
-		return nil, ErrReqLimit
+// failOrderFetch снимает отметку о взятии заказа в обработку, чтобы заказ был отправлен повторно
+// при следующем опросе, или останавливает его обработку после maxFetchFailures неудачных опросов
+func (aa *AccrualAgent) failOrderFetch(workerLogger *logrus.Entry, order model.Order, processingID string) {
+	defer aa.claims.remove(order.ID)
+	aa.metrics.fetched.WithLabelValues(fetchResultFailed).Inc()
+	if aa.dryRun {
+		workerLogger.WithField("orderNum", order.Number).Info("Dry run: skipped recording order fetch failure")
+		return
 	}
+	ctx := appctx.CtxWithProcessingID(aa.drainCtx, processingID)
+	stalled, err := aa.storage.FailOrderFetch(ctx, order.ID, aa.maxFetchFailures, stalledOrderReason)
+	if err != nil {
+		workerLogger.WithError(err).Error("error recording order fetch failure")
+		return
+	}
+	if stalled {
+		aa.metrics.transitions.WithLabelValues(string(order.Status), string(model.OrderStalled)).Inc()
+		workerLogger.Warnf("order #%s is stalled after %d failed fetches", order.Number, aa.maxFetchFailures)
+		if aa.events != nil {
+			aa.events.PublishOrderStatus(model.OrderStatusEvent{
+				UserID:    order.UserID,
+				Number:    order.Number,
+				Status:    model.OrderStalled,
+				UpdatedAt: time.Now(),
+			})
+		}
+	}
+}
 
-	if res.StatusCode == http.StatusNoContent {
-		logger.Log.WithField("orderNum", orderNum).Infoln("Order is not registered in accrual system")
-		return &model.AccrualResultRes{
-			Order:  orderNum,
-			Status: model.OrderAccInvalid,
-		}, nil
+// applyResult сохраняет полученный от системы начислений статус заказа и уведомляет пользователя
+func (aa *AccrualAgent) applyResult(
+	workerLogger *logrus.Entry, order model.Order, result *model.AccrualResultRes, processingID string,
+) {
+	defer aa.claims.remove(order.ID)
+	aa.metrics.fetched.WithLabelValues(fetchResultSuccess).Inc()
+	if aa.dryRun {
+		// Начисление записывается без учета коэффициента уровня пользователя
+		workerLogger.WithFields(logrus.Fields{
+			"orderNum":   order.Number,
+			"fromStatus": order.Status,
+			"toStatus":   result.Status.OrderStatus(),
+			"accrual":    result.Accrual,
+			"changed":    result.Status.OrderStatus() != order.Status,
+		}).Info("Dry run: skipped order status update")
+		return
 	}
+	ctx := appctx.CtxWithProcessingID(aa.drainCtx, processingID)
+	credited, err := aa.storage.UpdateOrderStatus(ctx, order.ID, result.Status.OrderStatus(), result.Accrual)
+	if err != nil {
+		workerLogger.WithError(err).Error("error updating order process status")
+		return
+	}
+	if result.Status.OrderStatus() != order.Status {
+		aa.metrics.transitions.WithLabelValues(string(order.Status), string(result.Status.OrderStatus())).Inc()
+	}
+	if aa.events != nil && result.Status.OrderStatus() != order.Status {
+		aa.events.PublishOrderStatus(model.OrderStatusEvent{
+			UserID:    order.UserID,
+			Number:    order.Number,
+			Status:    result.Status.OrderStatus(),
+			Accrual:   credited,
+			UpdatedAt: time.Now(),
+		})
+	}
+}
 
-	if res.StatusCode != http.StatusOK {
-		body, err := io.ReadAll(res.Body)
+// processOrder запрашивает статус заказа в системе начислений и сохраняет его
+func (aa *AccrualAgent) processOrder(workerLogger *logrus.Entry, order model.Order) {
+	processingID := newProcessingID()
+	workerLogger = workerLogger.WithField("processingID", processingID)
+	ctx := appctx.CtxWithProcessingID(aa.ctx, processingID)
+	workerLogger.Debugf("going to process order #%s", order.Number)
+	var result *model.AccrualResultRes
+	err := aa.fetchWithRetry(workerLogger, func() (err error) {
+		workerLogger.Debugf("fetching order #%s", order.Number)
+		result, err = aa.fetchOrderStatus(ctx, order.Number)
+		return err
+	})
+	if err != nil {
+		// Агент остановлен, закрепление заказа снимается при остановке
+		if aa.ctx.Err() != nil {
+			return
+		}
+		workerLogger.WithError(err).Error("error fetching order status")
+		aa.failOrderFetch(workerLogger, order, processingID)
+		return
+	}
+	aa.applyResult(workerLogger, order, result, processingID)
+}
+
+func (aa *AccrualAgent) worker(ctx context.Context, id int, queue *orderQueue) {
+	workerLogger := logger.Log.WithField("workerID", id)
+	for {
+		order, ok := queue.pop(ctx)
+		if !ok {
+			workerLogger.Debug("Worker stopped")
+			return
+		}
+		aa.metrics.queued.Dec()
+		aa.processOrder(workerLogger, order)
+	}
+}
+
+// dispatchOrder передает заказ воркерам, дожидаясь освободившегося места в очереди
+func (aa *AccrualAgent) dispatchOrder(queue *orderQueue, order model.Order) error {
+	// Увеличиваем до отправки, чтобы воркер не уменьшил значение раньше
+	aa.metrics.queued.Inc()
+	if err := queue.push(aa.ctx, order); err != nil {
+		aa.metrics.queued.Dec()
+		return err
+	}
+	return nil
+}
+
+// claimOrders забирает из БД заказы в указанном статусе пачками по claimLimit и передает их воркерам.
+// Заказы забираются в порядке загрузки: id выдается по порядку при создании заказа, поэтому каждый заказ
+// забирается за проход не более одного раза, даже если воркер успел вернуть его в очередь. Забранный
+// заказ закрепляется за экземпляром агента на inFlightTimeout, heartbeatClaims продлевает закрепление,
+// пока заказ не обработан. Закрепление снимается при сохранении результата, а заказов, не обработанных
+// к остановке агента, - в StopAgent. Если агент завершился аварийно, закрепление истекает и заказ
+// забирает другой экземпляр.
+func (aa *AccrualAgent) claimOrders(status model.OrderStatus, queue *orderQueue) error {
+	// Заказы, уже зарегистрированные системой начислений, остаются в статусе NEW и опрашиваются
+	// не чаще заказов в обработке
+	polledBefore := time.Now()
+	if status == model.OrderNew {
+		polledBefore = polledBefore.Add(-aa.pollIntervals[model.OrderProcessing])
+	}
+	afterID := 0
+	for {
+		orders, err := aa.fetchOrdersToProcess(status, afterID, polledBefore)
 		if err != nil {
-			body = []byte("failed to read response body")
+			return err
+		}
+		aa.claimed.Add(int64(len(orders)))
+		for _, order := range orders {
+			if err = aa.dispatchOrder(queue, order); err != nil {
+				return err
+			}
+			afterID = order.ID
+		}
+		if len(orders) < aa.claimLimit {
+			return nil
 		}
-		return nil, fmt.Errorf("error response from accrual service with status code %d: %s", res.StatusCode, body)
 	}
+}
 
-	var result model.AccrualResultRes
-	if err := json.NewDecoder(res.Body).Decode(&result); err != nil {
+// fetchOrdersToProcess закрепляет за агентом и возвращает очередную пачку заказов для claimOrders.
+// В режиме проверки заказы только читаются, чтобы не мешать основному агенту их обрабатывать.
+func (aa *AccrualAgent) fetchOrdersToProcess(
+	status model.OrderStatus, afterID int, polledBefore time.Time,
+) ([]model.Order, error) {
+	if aa.dryRun {
+		return aa.storage.GetOrdersToProcess(aa.ctx, status, afterID, aa.claimLimit, polledBefore)
+	}
+	orders, err := aa.storage.ClaimOrdersToProcess(
+		aa.ctx, status, afterID, aa.claimLimit, aa.instanceID, time.Now().Add(-aa.inFlightTimeout), polledBefore,
+	)
+	if err != nil {
 		return nil, err
 	}
-	return &result, nil
+	for _, order := range orders {
+		aa.claims.add(order.ID)
+	}
+	return orders, nil
 }
 
-func (aa *AccrualAgent) worker(id int, ordersCh <-chan model.Order) {
-	workerLogger := logger.Log.WithField("workerID", id)
+// processOrders с заданным интервалом, а также по сигналу из wake, отправляет воркерам заказы
+// в указанном статусе. wake может быть nil.
+func (aa *AccrualAgent) processOrders(
+	status model.OrderStatus, interval time.Duration, wake <-chan struct{}, queue *orderQueue,
+) {
+	defer aa.wg.Done()
 	for {
 		select {
 		case <-aa.ctx.Done():
-			workerLogger.Debug("Worker stopped")
+			logger.Log.Debug("Process order stopped")
+			return
+		case <-time.After(interval):
+		case <-wake:
+		}
+		err := aa.claimOrders(status, queue)
+		if aa.ctx.Err() != nil {
+			logger.Log.Debug("Process order stopped (while adding orders to chanel)")
 			return
-		case order, ok := <-ordersCh:
-			if !ok {
-				return
+		}
+		if err != nil {
+			logger.Log.WithError(err).Error("failed to get orders to process from storage")
+		}
+	}
+}
+
+// listenOrderNotifications будит опрос новых заказов по уведомлению из БД, не дожидаясь очередного
+// интервала. Уведомления, пришедшие до начала опроса, объединяются в один. После потери соединения
+// подписка восстанавливается через listenRetryInterval.
+func (aa *AccrualAgent) listenOrderNotifications() {
+	defer aa.wg.Done()
+	for {
+		err := aa.storage.ListenNewOrders(aa.ctx, func() {
+			select {
+			case aa.newOrders <- struct{}{}:
+			default:
 			}
-			workerLogger.Debugf("going to process order #%s", order.Number)
-			for {
-				aa.rateLimit.RLock()
-				sleepDuration := time.Until(aa.rateLimitEndTime)
-				aa.rateLimit.RUnlock()
-
-				if sleepDuration > 0 {
-					workerLogger.Debugf("Rate limited, sleeping for %s", sleepDuration)
-					// Пока горутина ждет таймаут может прийти сигнал о завершении работы, на который нужно среагировать
-					select {
-					case <-aa.ctx.Done():
-						workerLogger.Debug("Worker stopped from sleeping state")
-						return
-					case <-time.After(sleepDuration):
-					}
-				}
-				workerLogger.Debugf("fetching order #%s", order.Number)
-				result, err := aa.fetchOrderStatus(aa.ctx, order.Number)
-				if err != nil {
-					if errors.Is(err, ErrReqLimit) {
-						workerLogger.Info("Accrual service request limit reached")
-						continue
-					} else {
-						workerLogger.WithError(err).Error("error fetching order status")
-						break
-					}
-				}
-				orderStatus := model.OrderProcessing
-				switch result.Status {
-				case model.OrderAccProcessed:
-					orderStatus = model.OrderProcessed
-				case model.OrderAccInvalid:
-					orderStatus = model.OrderInvalid
-				}
-				if err := aa.storage.UpdateOrderStatus(aa.ctx, order.ID, orderStatus, result.Accrual); err != nil {
-					workerLogger.WithError(err).Error("error updating order process status")
-				}
-				break
+		})
+		if aa.ctx.Err() != nil {
+			logger.Log.Debug("New orders listener stopped")
+			return
+		}
+		logger.Log.WithError(err).Error("new orders listener failed")
+		select {
+		case <-aa.ctx.Done():
+			logger.Log.Debug("New orders listener stopped")
+			return
+		case <-time.After(listenRetryInterval):
+		}
+	}
+}
+
+// recoverInFlightOrders при запуске агента сразу, не дожидаясь интервала опроса, отправляет воркерам
+// необработанные заказы, в том числе заказы, обработка которых была прервана, например, из-за
+// остановки сервиса
+func (aa *AccrualAgent) recoverInFlightOrders(queue *orderQueue) {
+	defer aa.wg.Done()
+	for _, status := range []model.OrderStatus{model.OrderNew, model.OrderProcessing} {
+		if err := aa.claimOrders(status, queue); err != nil {
+			if aa.ctx.Err() == nil {
+				logger.Log.WithError(err).Error("failed to get in-flight orders from storage")
 			}
+			return
 		}
 	}
 }
 
-func (aa *AccrualAgent) processOrders(ordersCh chan<- model.Order) {
+// expireOrders периодически отказывается от обработки заказов старше orderMaxAge,
+// чтобы заказы, о которых система начислений так и не узнала, не опрашивались бесконечно
+func (aa *AccrualAgent) expireOrders() {
 	defer aa.wg.Done()
 	for {
 		select {
 		case <-aa.ctx.Done():
-			logger.Log.Debug("Process order stopped")
+			logger.Log.Debug("Expire orders stopped")
 			return
-		case <-time.After(checkInterval):
-			orders, err := aa.storage.GetOrdersToProcess(aa.ctx)
+		case <-time.After(aa.expireCheckInterval):
+			expired, err := aa.storage.ExpireOrders(aa.ctx, time.Now().Add(-aa.orderMaxAge), expiredOrderReason)
 			if err != nil {
-				logger.Log.WithError(err).Error("failed to get orders to process from storage")
+				logger.Log.WithError(err).Error("failed to expire stale orders")
 				continue
 			}
-			for _, order := range orders {
-				select {
-				case <-aa.ctx.Done():
-					logger.Log.Debug("Process order stopped (while adding orders to chanel)")
-					return
-				case ordersCh <- order:
-				}
+			if expired > 0 {
+				logger.Log.WithField("count", expired).Warn("Stale orders marked as invalid")
 			}
 		}
 	}
 }
 
+// requeueStuckOrders периодически возвращает в NEW заказы, статус PROCESSING которых не меняется
+// дольше stuckOrderAge, чтобы они снова обрабатывались как только что загруженные
+func (aa *AccrualAgent) requeueStuckOrders() {
+	defer aa.wg.Done()
+	for {
+		select {
+		case <-aa.ctx.Done():
+			logger.Log.Debug("Requeue stuck orders stopped")
+			return
+		case <-time.After(aa.expireCheckInterval):
+			requeued, err := aa.storage.RequeueStuckOrders(aa.ctx, time.Now().Add(-aa.stuckOrderAge), stuckOrderReason)
+			if err != nil {
+				logger.Log.WithError(err).Error("failed to requeue stuck orders")
+				continue
+			}
+			aa.metrics.stuck.Set(float64(requeued))
+			aa.metrics.requeued.Add(float64(requeued))
+			if requeued > 0 {
+				logger.Log.WithField("count", requeued).Warn("Orders stuck in processing requeued")
+			}
+		}
+	}
+}
+
+// loadRateLimit восстанавливает ограничение запросов, сохраненное до перезапуска агента
+func (aa *AccrualAgent) loadRateLimit() {
+	rateLimitEndTime, err := aa.storage.GetRateLimitEnd(aa.ctx)
+	if err != nil {
+		logger.Log.WithError(err).Error("failed to load persisted accrual rate limit")
+		return
+	}
+	if time.Now().Before(rateLimitEndTime) {
+		logger.Log.WithField("until", rateLimitEndTime).Info("Accrual rate limit is still active")
+		aa.rateLimit.Lock()
+		aa.rateLimitEndTime = rateLimitEndTime
+		aa.rateLimit.Unlock()
+	}
+}
+
 func (aa *AccrualAgent) StartAgent() {
 	aa.ctx, aa.ctxCancel = context.WithCancel(context.Background())
+	aa.drainCtx, aa.drainCancel = context.WithCancel(context.Background())
+	aa.running.Store(true)
+
+	if aa.dryRun {
+		logger.Log.Warn("Accrual agent is running in dry-run mode, orders are not updated")
+	} else {
+		aa.loadRateLimit()
+	}
 
-	aa.ordersCh = make(chan model.Order, workerCount)
+	aa.queue = newOrderQueue(aa.claimLimit)
 
-	for i := 0; i < workerCount; i++ {
+	aa.pool = workerPool{}
+	for i := 0; i < aa.workerCount; i++ {
+		aa.addWorker()
+	}
+	if aa.maxWorkerCount > aa.workerCount {
 		aa.wg.Add(1)
-		go func(id int) {
-			defer aa.wg.Done()
-			aa.worker(id, aa.ordersCh)
-		}(i)
+		go aa.scaleWorkers()
 	}
 
 	aa.wg.Add(1)
-	go aa.processOrders(aa.ordersCh)
+	go aa.recoverInFlightOrders(aa.queue)
+
+	aa.wg.Add(1)
+	go aa.heartbeatClaims()
+
+	aa.newOrders = make(chan struct{}, 1)
+	if aa.listenNewOrders {
+		aa.wg.Add(1)
+		go aa.listenOrderNotifications()
+	}
+
+	for status, interval := range aa.pollIntervals {
+		var wake <-chan struct{}
+		if status == model.OrderNew && aa.listenNewOrders {
+			wake = aa.newOrders
+		}
+		aa.wg.Add(1)
+		go aa.processOrders(status, interval, wake, aa.queue)
+	}
+
+	if aa.orderMaxAge > 0 && !aa.dryRun {
+		aa.wg.Add(1)
+		go aa.expireOrders()
+	}
+
+	if aa.stuckOrderAge > 0 && !aa.dryRun {
+		aa.wg.Add(1)
+		go aa.requeueStuckOrders()
+	}
 }
 
 func (aa *AccrualAgent) StopAgent() {
@@ -204,7 +841,24 @@ func (aa *AccrualAgent) StopAgent() {
 		return
 	}
 	logger.Log.Debug("Stopping accrual agent workers...")
+	// Опрос заказов и новые запросы в систему начислений прекращаются сразу, а результаты уже
+	// полученных ответов сохраняются в течение drainTimeout. Очередь не закрывается: воркеры
+	// перестают забирать из нее заказы по отмене контекста, поэтому отправка в закрытый канал
+	// невозможна. Закрепление оставшихся в очереди заказов снимается, чтобы их сразу забрали другие экземпляры.
 	aa.ctxCancel()
-	close(aa.ordersCh)
-	aa.wg.Wait()
+	done := make(chan struct{})
+	go func() {
+		aa.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(aa.drainTimeout):
+		logger.Log.Warn("Accrual agent drain timed out, aborting in-flight order updates")
+		aa.drainCancel()
+		<-done
+	}
+	aa.releaseClaims()
+	aa.drainCancel()
+	aa.running.Store(false)
 }
@@ -0,0 +1,701 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"regexp"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pinbrain/gophermart/internal/faults"
+	"github.com/pinbrain/gophermart/internal/logger"
+	"github.com/pinbrain/gophermart/internal/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var errAccrualDown = errors.New("accrual service is down")
+
+type expireCall struct {
+	olderThan time.Time
+	reason    string
+}
+
+type claimCall struct {
+	status       model.OrderStatus
+	afterID      int
+	limit        int
+	polledBefore time.Time
+}
+
+// agentStorage - leaseStorage, который записывает обращения агента к хранилищу
+type agentStorage struct {
+	*leaseStorage
+
+	callsMu sync.Mutex
+	claims  []claimCall
+	expires []expireCall
+	// Сохраненное ограничение запросов в систему начислений
+	rateLimitEnd time.Time
+	rateLimits   []time.Time
+
+	// Сохранение статуса заказа занимает updateDelay, о его начале сообщается в updating
+	updateDelay time.Duration
+	updating    chan struct{}
+}
+
+func newAgentStorage(orders ...model.Order) *agentStorage {
+	return &agentStorage{leaseStorage: newLeaseStorage(orders...)}
+}
+
+func (st *agentStorage) ClaimOrdersToProcess(
+	ctx context.Context, status model.OrderStatus, afterID, limit int, claimedBy string, inFlightAfter, polledBefore time.Time,
+) ([]model.Order, error) {
+	st.callsMu.Lock()
+	st.claims = append(st.claims, claimCall{status: status, afterID: afterID, limit: limit, polledBefore: polledBefore})
+	st.callsMu.Unlock()
+	return st.leaseStorage.ClaimOrdersToProcess(ctx, status, afterID, limit, claimedBy, inFlightAfter, polledBefore)
+}
+
+// GetOrdersToProcess возвращает заказы, не закрепляя их, как GetOrdersToProcess в БД
+func (st *agentStorage) GetOrdersToProcess(
+	_ context.Context, status model.OrderStatus, afterID, limit int, _ time.Time,
+) ([]model.Order, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	var orders []model.Order
+	for _, o := range st.orders {
+		if len(orders) < limit && o.order.Status == status && o.order.ID > afterID {
+			orders = append(orders, o.order)
+		}
+	}
+	return orders, nil
+}
+
+func (st *agentStorage) UpdateOrderStatus(
+	ctx context.Context, orderID int, status model.OrderStatus, accrual model.Money,
+) (model.Money, error) {
+	if st.updating != nil {
+		select {
+		case st.updating <- struct{}{}:
+		default:
+		}
+	}
+	select {
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	case <-time.After(st.updateDelay):
+	}
+	return st.leaseStorage.UpdateOrderStatus(ctx, orderID, status, accrual)
+}
+
+func (st *agentStorage) ExpireOrders(_ context.Context, olderThan time.Time, reason string) (int, error) {
+	st.callsMu.Lock()
+	defer st.callsMu.Unlock()
+	st.expires = append(st.expires, expireCall{olderThan: olderThan, reason: reason})
+	return 0, nil
+}
+
+func (st *agentStorage) expireCalls() []expireCall {
+	st.callsMu.Lock()
+	defer st.callsMu.Unlock()
+	return append([]expireCall(nil), st.expires...)
+}
+
+func (st *agentStorage) SaveRateLimitEnd(_ context.Context, until time.Time) error {
+	st.callsMu.Lock()
+	defer st.callsMu.Unlock()
+	st.rateLimitEnd = until
+	st.rateLimits = append(st.rateLimits, until)
+	return nil
+}
+
+func (st *agentStorage) GetRateLimitEnd(context.Context) (time.Time, error) {
+	st.callsMu.Lock()
+	defer st.callsMu.Unlock()
+	return st.rateLimitEnd, nil
+}
+
+func (st *agentStorage) savedRateLimits() []time.Time {
+	st.callsMu.Lock()
+	defer st.callsMu.Unlock()
+	return append([]time.Time(nil), st.rateLimits...)
+}
+
+// claimCalls возвращает обращения за заказами в статусе status
+func (st *agentStorage) claimCalls(status model.OrderStatus) []claimCall {
+	st.callsMu.Lock()
+	defer st.callsMu.Unlock()
+	var calls []claimCall
+	for _, c := range st.claims {
+		if c.status == status {
+			calls = append(calls, c)
+		}
+	}
+	return calls
+}
+
+// claimPasses возвращает первые обращения каждого прохода по заказам в статусе status
+func (st *agentStorage) claimPasses(status model.OrderStatus) []claimCall {
+	var passes []claimCall
+	for _, c := range st.claimCalls(status) {
+		if c.afterID == 0 {
+			passes = append(passes, c)
+		}
+	}
+	return passes
+}
+
+func TestFetchBackoff(t *testing.T) {
+	aa := NewAccrualAgent(newLeaseStorage(), AccrualAgentCfg{
+		FetchRetryBackoff: 100 * time.Millisecond,
+		FetchMaxBackoff:   time.Second,
+	})
+	tests := []struct {
+		name     string
+		attempts int
+		// Задержка без случайной части: фактическая задержка лежит в [want/2, want]
+		want time.Duration
+	}{
+		{name: "Первый повтор", attempts: 1, want: 100 * time.Millisecond},
+		{name: "Второй повтор", attempts: 2, want: 200 * time.Millisecond},
+		{name: "Четвертый повтор", attempts: 4, want: 800 * time.Millisecond},
+		{name: "Задержка ограничена сверху", attempts: 5, want: time.Second},
+		{name: "Много попыток не переполняют задержку", attempts: 100, want: time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for i := 0; i < 100; i++ {
+				delay := aa.fetchBackoff(tt.attempts)
+				assert.GreaterOrEqual(t, delay, tt.want/2)
+				assert.LessOrEqual(t, delay, tt.want)
+			}
+		})
+	}
+}
+
+func TestFetchWithRetry(t *testing.T) {
+	tests := []struct {
+		name string
+		// Результаты запросов по порядку, после них запросы успешны
+		results   []error
+		wantCalls int
+		wantErr   error
+	}{
+		{
+			name:      "Успешный запрос",
+			wantCalls: 1,
+		},
+		{
+			name:      "Успех после ошибки",
+			results:   []error{errAccrualDown},
+			wantCalls: 2,
+		},
+		{
+			name:      "Попытки исчерпаны",
+			results:   []error{errAccrualDown, errAccrualDown, errAccrualDown, errAccrualDown},
+			wantCalls: 3,
+			wantErr:   errAccrualDown,
+		},
+		{
+			name:      "Ответ 429 не расходует попытки",
+			results:   []error{ErrReqLimit, ErrReqLimit, ErrReqLimit, ErrReqLimit},
+			wantCalls: 5,
+		},
+		{
+			name:      "Пауза автоматического выключателя не расходует попытки",
+			results:   []error{ErrCircuitOpen, ErrCircuitOpen, ErrCircuitOpen, ErrCircuitOpen},
+			wantCalls: 5,
+		},
+		{
+			name:      "Попытки считаются только по ошибкам запроса",
+			results:   []error{errAccrualDown, ErrReqLimit, ErrCircuitOpen, errAccrualDown, ErrReqLimit},
+			wantCalls: 6,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			aa := NewAccrualAgent(newLeaseStorage(), AccrualAgentCfg{
+				FetchAttempts:     3,
+				FetchRetryBackoff: time.Millisecond,
+				FetchMaxBackoff:   time.Millisecond,
+			})
+			aa.ctx = context.Background()
+
+			calls := 0
+			err := aa.fetchWithRetry(logger.Log.WithField("test", t.Name()), func() error {
+				calls++
+				if calls <= len(tt.results) {
+					return tt.results[calls-1]
+				}
+				return nil
+			})
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, tt.wantCalls, calls)
+		})
+	}
+}
+
+func TestFetchWithRetryStopped(t *testing.T) {
+	aa := NewAccrualAgent(newLeaseStorage(), AccrualAgentCfg{
+		FetchAttempts:     3,
+		FetchRetryBackoff: time.Hour,
+		FetchMaxBackoff:   time.Hour,
+	})
+	var cancel context.CancelFunc
+	aa.ctx, cancel = context.WithCancel(context.Background())
+
+	calls := 0
+	done := make(chan error)
+	go func() {
+		done <- aa.fetchWithRetry(logger.Log.WithField("test", t.Name()), func() error {
+			calls++
+			return errAccrualDown
+		})
+	}()
+	cancel()
+	select {
+	case err := <-done:
+		require.ErrorIs(t, err, context.Canceled)
+		assert.Equal(t, 1, calls)
+	case <-time.After(time.Second):
+		t.Fatal("fetchWithRetry did not stop while waiting to retry")
+	}
+}
+
+func TestWaitRequestSlot(t *testing.T) {
+	tests := []struct {
+		name  string
+		rps   float64
+		burst int
+		// Запросы подряд и минимальное время, за которое они должны быть разрешены
+		requests int
+		wantWait time.Duration
+	}{
+		{name: "Без ограничения", requests: 20},
+		{name: "Запросы в пределах burst", rps: 10, burst: 5, requests: 5},
+		{name: "Запросы сверх burst ждут пополнения", rps: 20, burst: 2, requests: 4, wantWait: 100 * time.Millisecond},
+		{name: "Нулевой burst разрешает один запрос", rps: 20, requests: 2, wantWait: 50 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			aa := NewAccrualAgent(newLeaseStorage(), AccrualAgentCfg{RequestRPS: tt.rps, RequestBurst: tt.burst})
+			start := time.Now()
+			for i := 0; i < tt.requests; i++ {
+				require.NoError(t, aa.waitRequestSlot(context.Background()))
+			}
+			elapsed := time.Since(start)
+			// Небольшой запас на округление времени пополнения
+			assert.GreaterOrEqual(t, elapsed, tt.wantWait-5*time.Millisecond)
+			assert.Less(t, elapsed, tt.wantWait+time.Second)
+		})
+	}
+}
+
+func TestWaitRequestSlotCanceled(t *testing.T) {
+	aa := NewAccrualAgent(newLeaseStorage(), AccrualAgentCfg{RequestRPS: 0.1, RequestBurst: 1})
+	require.NoError(t, aa.waitRequestSlot(context.Background()))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, aa.waitRequestSlot(ctx), context.DeadlineExceeded)
+}
+
+func TestAgentInstanceID(t *testing.T) {
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		hostname = "gophermart"
+	}
+	order := model.Order{ID: 1, UserID: 1, Number: "12345678903", Status: model.OrderNew}
+	st := newLeaseStorage(order)
+	aa := newLeaseAgent(st, newAccrualServer(t, true).URL, "", time.Hour)
+	other := newLeaseAgent(st, newAccrualServer(t, true).URL, "", time.Hour)
+
+	// Идентификатор по умолчанию различает экземпляры, запущенные на одном хосте
+	assert.Regexp(t, "^"+regexp.QuoteMeta(hostname)+"-[0-9a-f]{8}$", aa.instanceID)
+	assert.NotEqual(t, aa.instanceID, other.instanceID)
+
+	aa.StartAgent()
+	defer aa.StopAgent()
+	require.Eventually(t, func() bool {
+		return st.get(order.ID).claimedBy == aa.instanceID
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestFetchOrderStatusFaults(t *testing.T) {
+	tests := []struct {
+		name           string
+		faults         faults.Config
+		requestTimeout time.Duration
+		wantErr        error
+		wantRequests   int32
+		wantMinTime    time.Duration
+	}{
+		{
+			name:         "Без сбоев",
+			wantRequests: 1,
+		},
+		{
+			name:    "Искусственная ошибка не доходит до системы начислений",
+			faults:  faults.Config{ErrorRate: 1},
+			wantErr: faults.ErrInjected,
+		},
+		{
+			name:         "Искусственная задержка",
+			faults:       faults.Config{LatencyRate: 1, Latency: 50 * time.Millisecond},
+			wantRequests: 1,
+			wantMinTime:  50 * time.Millisecond,
+		},
+		{
+			name:           "Задержка ограничена временем ожидания ответа",
+			faults:         faults.Config{LatencyRate: 1, Latency: time.Hour},
+			requestTimeout: 20 * time.Millisecond,
+			wantErr:        context.DeadlineExceeded,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var requests atomic.Int32
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+				requests.Add(1)
+				w.Header().Set("Content-Type", "application/json")
+				_, _ = w.Write([]byte(`{"order": "12345678903", "status": "PROCESSED", "accrual": 100}`))
+			}))
+			t.Cleanup(server.Close)
+			aa := NewAccrualAgent(newLeaseStorage(), AccrualAgentCfg{
+				AccrualURL:      server.URL,
+				Faults:          faults.NewInjector(tt.faults),
+				RequestTimeout:  tt.requestTimeout,
+				CircuitFailures: 1,
+			})
+
+			start := time.Now()
+			result, err := aa.fetchOrderStatus(context.Background(), "12345678903")
+			assert.GreaterOrEqual(t, time.Since(start), tt.wantMinTime)
+			assert.Equal(t, tt.wantRequests, requests.Load())
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
+				// Искусственные сбои проверяют реакцию агента так же, как настоящие
+				assert.Equal(t, circuitOpen, aa.breaker.current())
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, model.OrderAccProcessed, result.Status)
+		})
+	}
+}
+
+func TestPollIntervalsByStatus(t *testing.T) {
+	st := newAgentStorage(
+		model.Order{ID: 1, UserID: 1, Number: "12345678903", Status: model.OrderNew},
+		model.Order{ID: 2, UserID: 1, Number: "6485485820226", Status: model.OrderProcessing},
+	)
+	aa := NewAccrualAgent(st, AccrualAgentCfg{
+		AccrualURL:             newAccrualServer(t, true).URL,
+		WorkerCount:            1,
+		NewPollInterval:        20 * time.Millisecond,
+		ProcessingPollInterval: time.Hour,
+		DrainTimeout:           100 * time.Millisecond,
+	})
+	aa.StartAgent()
+	time.Sleep(200 * time.Millisecond)
+	aa.StopAgent()
+	now := time.Now()
+
+	// Новые заказы опрашиваются часто, заказы в обработке - только при запуске
+	newCalls := st.claimCalls(model.OrderNew)
+	assert.GreaterOrEqual(t, len(st.claimPasses(model.OrderNew)), 5)
+	require.Len(t, st.claimPasses(model.OrderProcessing), 1)
+
+	// Новые заказы, уже зарегистрированные системой начислений, опрашиваются не чаще заказов в обработке
+	for _, c := range newCalls {
+		assert.WithinDuration(t, now.Add(-time.Hour), c.polledBefore, time.Second)
+	}
+	assert.WithinDuration(t, now, st.claimPasses(model.OrderProcessing)[0].polledBefore, time.Second)
+}
+
+func TestExpireOrders(t *testing.T) {
+	tests := []struct {
+		name        string
+		orderMaxAge time.Duration
+		dryRun      bool
+		wantExpire  bool
+	}{
+		{name: "Заказы старше максимального возраста", orderMaxAge: time.Hour, wantExpire: true},
+		{name: "Без ограничения возраста", orderMaxAge: 0},
+		{name: "В режиме проверки заказы не меняются", orderMaxAge: time.Hour, dryRun: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			st := newAgentStorage()
+			aa := NewAccrualAgent(st, AccrualAgentCfg{
+				AccrualURL:          newAccrualServer(t, true).URL,
+				OrderMaxAge:         tt.orderMaxAge,
+				ExpireCheckInterval: 20 * time.Millisecond,
+				DryRun:              tt.dryRun,
+			})
+			aa.StartAgent()
+			time.Sleep(100 * time.Millisecond)
+			aa.StopAgent()
+
+			calls := st.expireCalls()
+			if !tt.wantExpire {
+				assert.Empty(t, calls)
+				return
+			}
+			require.NotEmpty(t, calls)
+			for _, c := range calls {
+				assert.WithinDuration(t, time.Now().Add(-tt.orderMaxAge), c.olderThan, time.Second)
+				assert.Equal(t, expiredOrderReason, c.reason)
+			}
+		})
+	}
+}
+
+func TestSaveRateLimit(t *testing.T) {
+	tests := []struct {
+		name      string
+		dryRun    bool
+		wantSaved bool
+	}{
+		{name: "Ограничение сохраняется в хранилище", wantSaved: true},
+		{name: "В режиме проверки ограничение не сохраняется", dryRun: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+				w.Header().Set("Retry-After", "60")
+				w.WriteHeader(http.StatusTooManyRequests)
+			}))
+			t.Cleanup(server.Close)
+			st := newAgentStorage()
+			aa := NewAccrualAgent(st, AccrualAgentCfg{AccrualURL: server.URL, DryRun: tt.dryRun})
+
+			_, err := aa.fetchOrderStatus(context.Background(), "12345678903")
+			require.ErrorIs(t, err, ErrReqLimit)
+			wantEnd := time.Now().Add(time.Minute)
+			assert.WithinDuration(t, wantEnd, aa.rateLimitEndTime, time.Second)
+
+			saved := st.savedRateLimits()
+			if !tt.wantSaved {
+				assert.Empty(t, saved)
+				return
+			}
+			require.Len(t, saved, 1)
+			assert.WithinDuration(t, wantEnd, saved[0], time.Second)
+		})
+	}
+}
+
+func TestLoadRateLimit(t *testing.T) {
+	const rateLimit = 200 * time.Millisecond
+	var firstRequest atomic.Int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		firstRequest.CompareAndSwap(0, time.Now().UnixNano())
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"order": "12345678903", "status": "PROCESSED", "accrual": 100}`))
+	}))
+	t.Cleanup(server.Close)
+
+	// Ограничение сохранено до перезапуска агента
+	st := newAgentStorage(model.Order{ID: 1, UserID: 1, Number: "12345678903", Status: model.OrderNew})
+	rateLimitEnd := time.Now().Add(rateLimit)
+	st.rateLimitEnd = rateLimitEnd
+	aa := newLeaseAgent(st, server.URL, "first", time.Hour)
+	aa.StartAgent()
+	defer aa.StopAgent()
+
+	require.Eventually(t, func() bool {
+		return st.get(1).order.Status == model.OrderProcessed
+	}, time.Second, 10*time.Millisecond)
+	assert.False(t, time.Unix(0, firstRequest.Load()).Before(rateLimitEnd), "запрос отправлен до окончания ограничения")
+}
+
+func TestClaimOrdersInPages(t *testing.T) {
+	var orders []model.Order
+	for id := 1; id <= 5; id++ {
+		orders = append(orders, model.Order{ID: id, UserID: 1, Number: fmt.Sprint(id), Status: model.OrderNew})
+	}
+	st := newAgentStorage(orders...)
+	aa := NewAccrualAgent(st, AccrualAgentCfg{InstanceID: "first", WorkerCount: 2})
+	aa.ctx = context.Background()
+	queue := newOrderQueue(len(orders))
+
+	require.NoError(t, aa.claimOrders(model.OrderNew, queue))
+
+	// Заказы забираются пачками по claimLimit, каждая следующая начинается после последнего забранного
+	var afterIDs []int
+	for _, c := range st.claimCalls(model.OrderNew) {
+		assert.Equal(t, 2, c.limit)
+		afterIDs = append(afterIDs, c.afterID)
+	}
+	assert.Equal(t, []int{0, 2, 4}, afterIDs)
+	for _, want := range orders {
+		order, ok := queue.tryPop()
+		require.True(t, ok)
+		assert.Equal(t, want.ID, order.ID)
+	}
+	assert.ElementsMatch(t, []int{1, 2, 3, 4, 5}, aa.claims.list())
+}
+
+func TestClaimOrdersStoppedOnFullQueue(t *testing.T) {
+	st := newAgentStorage(
+		model.Order{ID: 1, UserID: 1, Number: "12345678903", Status: model.OrderNew},
+		model.Order{ID: 2, UserID: 1, Number: "6485485820226", Status: model.OrderNew},
+	)
+	aa := NewAccrualAgent(st, AccrualAgentCfg{InstanceID: "first", WorkerCount: 2})
+	var cancel context.CancelFunc
+	aa.ctx, cancel = context.WithCancel(context.Background())
+	// Очередь на один заказ: второй заказ ждет, пока воркер заберет первый
+	queue := newOrderQueue(1)
+
+	done := make(chan error)
+	go func() {
+		done <- aa.claimOrders(model.OrderNew, queue)
+	}()
+	require.Eventually(t, func() bool { return queue.len() == 1 }, time.Second, 10*time.Millisecond)
+	cancel()
+	select {
+	case err := <-done:
+		assert.ErrorIs(t, err, context.Canceled)
+	case <-time.After(time.Second):
+		t.Fatal("claimOrders did not stop on a full queue")
+	}
+}
+
+func TestBatchMode(t *testing.T) {
+	tests := []struct {
+		name       string
+		format     BatchFormat
+		wantMethod string
+	}{
+		{name: "Номера заказов в теле JSON", format: BatchFormatJSON, wantMethod: http.MethodPost},
+		{name: "Номера заказов в параметрах запроса", format: BatchFormatQuery, wantMethod: http.MethodGet},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			var requested []string
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				assert.Equal(t, "/api/orders/batch", r.URL.Path)
+				assert.Equal(t, tt.wantMethod, r.Method)
+				var orderNums []string
+				if r.Method == http.MethodPost {
+					assert.NoError(t, json.NewDecoder(r.Body).Decode(&orderNums))
+				} else {
+					orderNums = r.URL.Query()["order"]
+				}
+				mu.Lock()
+				requested = append(requested, orderNums...)
+				mu.Unlock()
+
+				// Система начислений не знает о заказе 3
+				var results []model.AccrualResultRes
+				for _, num := range orderNums {
+					if num != "3" {
+						results = append(results, model.AccrualResultRes{Order: num, Status: model.OrderAccProcessed})
+					}
+				}
+				w.Header().Set("Content-Type", "application/json")
+				assert.NoError(t, json.NewEncoder(w).Encode(results))
+			}))
+			t.Cleanup(server.Close)
+
+			st := newAgentStorage(
+				model.Order{ID: 1, UserID: 1, Number: "1", Status: model.OrderNew},
+				model.Order{ID: 2, UserID: 1, Number: "2", Status: model.OrderNew},
+				model.Order{ID: 3, UserID: 1, Number: "3", Status: model.OrderNew},
+			)
+			aa := NewAccrualAgent(st, AccrualAgentCfg{
+				AccrualURL:             server.URL,
+				BatchPath:              "/api/orders/batch",
+				BatchFormat:            tt.format,
+				BatchSize:              10,
+				WorkerCount:            1,
+				NewPollInterval:        time.Hour,
+				ProcessingPollInterval: time.Hour,
+			})
+			require.True(t, aa.batchMode)
+			aa.StartAgent()
+			defer aa.StopAgent()
+
+			require.Eventually(t, func() bool {
+				return st.get(1).order.Status == model.OrderProcessed &&
+					st.get(2).order.Status == model.OrderProcessed &&
+					st.get(3).order.Status == model.OrderInvalid
+			}, time.Second, 10*time.Millisecond)
+			mu.Lock()
+			defer mu.Unlock()
+			assert.ElementsMatch(t, []string{"1", "2", "3"}, requested)
+		})
+	}
+}
+
+func TestStopAgentDrainsUpdates(t *testing.T) {
+	st := newAgentStorage(model.Order{ID: 1, UserID: 1, Number: "12345678903", Status: model.OrderNew})
+	st.updateDelay = 100 * time.Millisecond
+	st.updating = make(chan struct{}, 1)
+	aa := NewAccrualAgent(st, AccrualAgentCfg{
+		AccrualURL:             newAccrualServer(t, false).URL,
+		InstanceID:             "first",
+		WorkerCount:            1,
+		NewPollInterval:        time.Hour,
+		ProcessingPollInterval: time.Hour,
+		DrainTimeout:           time.Second,
+	})
+	aa.StartAgent()
+	select {
+	case <-st.updating:
+	case <-time.After(time.Second):
+		t.Fatal("order status was not fetched")
+	}
+
+	// Статус, уже полученный от системы начислений, сохраняется после остановки агента
+	start := time.Now()
+	aa.StopAgent()
+	assert.Less(t, time.Since(start), aa.drainTimeout)
+	processed := st.get(1)
+	assert.Equal(t, model.OrderProcessed, processed.order.Status)
+	assert.Equal(t, model.Money(10000), processed.order.Accrual)
+	assert.Empty(t, aa.claims.list())
+}
+
+func TestDryRun(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		requests.Add(1)
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"order": "12345678903", "status": "PROCESSED", "accrual": 100}`))
+	}))
+	t.Cleanup(server.Close)
+	st := newAgentStorage(model.Order{ID: 1, UserID: 1, Number: "12345678903", Status: model.OrderNew})
+	st.updating = make(chan struct{}, 1)
+	aa := NewAccrualAgent(st, AccrualAgentCfg{
+		AccrualURL:             server.URL,
+		WorkerCount:            1,
+		NewPollInterval:        20 * time.Millisecond,
+		ProcessingPollInterval: time.Hour,
+		DryRun:                 true,
+	})
+	aa.StartAgent()
+	require.Eventually(t, func() bool { return requests.Load() >= 2 }, time.Second, 10*time.Millisecond)
+	aa.StopAgent()
+
+	// Статус запрашивается, но заказ не закрепляется за агентом и не меняется
+	order := st.get(1)
+	assert.Equal(t, model.OrderNew, order.order.Status)
+	assert.Empty(t, order.claimedBy)
+	assert.Empty(t, st.claimCalls(model.OrderNew))
+	assert.Empty(t, st.updating)
+}
@@ -0,0 +1,53 @@
+package agent
+
+import (
+	"net/http"
+	"net/textproto"
+	"strings"
+)
+
+const (
+	// Заголовок учетных данных по умолчанию
+	defaultAuthHeader = "Authorization"
+	// Чем заменяется ключ в тексте, попадающем в лог
+	redactedKey = "[REDACTED]"
+)
+
+// AccrualAuth - учетные данные запросов в систему начислений. В заголовке Authorization ключ передается
+// как Bearer-токен, в остальных заголовках - как есть. Пустой Key - запросы без учетных данных.
+type AccrualAuth struct {
+	Header string
+	Key    string
+}
+
+// apply добавляет учетные данные в заголовок запроса
+func (a AccrualAuth) apply(req *http.Request) {
+	if a.Key == "" {
+		return
+	}
+	header := a.Header
+	if header == "" {
+		header = defaultAuthHeader
+	}
+	if textproto.CanonicalMIMEHeaderKey(header) == defaultAuthHeader {
+		req.Header.Set(header, "Bearer "+a.Key)
+		return
+	}
+	req.Header.Set(header, a.Key)
+}
+
+// redact скрывает ключ в тексте, например, в теле ответа системы начислений, перед записью в лог
+func (a AccrualAuth) redact(s string) string {
+	if a.Key == "" {
+		return s
+	}
+	return strings.ReplaceAll(s, a.Key, redactedKey)
+}
+
+// String скрывает ключ, если учетные данные целиком попадут в лог
+func (a AccrualAuth) String() string {
+	if a.Key == "" {
+		return "none"
+	}
+	return a.Header + ": " + redactedKey
+}
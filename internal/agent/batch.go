@@ -0,0 +1,126 @@
+package agent
+
+import (
+	"context"
+
+	"github.com/pinbrain/gophermart/internal/appctx"
+	"github.com/pinbrain/gophermart/internal/logger"
+	"github.com/pinbrain/gophermart/internal/model"
+	"github.com/sirupsen/logrus"
+)
+
+// Количество заказов в пакетном запросе по умолчанию
+const defaultBatchSize = 50
+
+// BatchFormat - формат пакетного запроса статусов заказов. В ответ на запрос любого формата система
+// начислений возвращает JSON-массив результатов в формате одиночного запроса. Заказы, отсутствующие
+// в ответе, считаются не зарегистрированными в системе начислений.
+type BatchFormat string
+
+const (
+	// POST с JSON-массивом номеров заказов в теле
+	BatchFormatJSON BatchFormat = "json"
+	// GET с номерами заказов в повторяющемся параметре order
+	BatchFormatQuery BatchFormat = "query"
+)
+
+// IsValid проверяет, что формат пакетного запроса поддерживается
+func (f BatchFormat) IsValid() bool {
+	return f == BatchFormatJSON || f == BatchFormatQuery
+}
+
+// fetchBatchStatus запрашивает статусы нескольких заказов одним запросом в систему начислений
+func (aa *AccrualAgent) fetchBatchStatus(
+	ctx context.Context, provider BatchAccrualProvider, orderNums []string,
+) (map[string]model.AccrualResultRes, error) {
+	var results map[string]model.AccrualResultRes
+	err := aa.callAccrual(ctx, func(ctx context.Context) (err error) {
+		results, err = provider.FetchOrdersStatus(ctx, orderNums)
+		return err
+	})
+	return results, err
+}
+
+// processBatch запрашивает статусы заказов одной системы начислений одним запросом и сохраняет
+// каждый результат
+func (aa *AccrualAgent) processBatch(workerLogger *logrus.Entry, provider BatchAccrualProvider, batch []model.Order) {
+	orderNums := make([]string, 0, len(batch))
+	for _, order := range batch {
+		orderNums = append(orderNums, order.Number)
+	}
+	// Один идентификатор на все заказы пачки, так как они запрашиваются одним запросом
+	processingID := newProcessingID()
+	workerLogger = workerLogger.WithField("processingID", processingID)
+	ctx := appctx.CtxWithProcessingID(aa.ctx, processingID)
+	workerLogger.Debugf("fetching %d orders in batch", len(batch))
+	var results map[string]model.AccrualResultRes
+	err := aa.fetchWithRetry(workerLogger, func() (err error) {
+		results, err = aa.fetchBatchStatus(ctx, provider, orderNums)
+		return err
+	})
+	if err != nil {
+		if aa.ctx.Err() != nil {
+			return
+		}
+		workerLogger.WithError(err).Error("error fetching orders batch status")
+		for _, order := range batch {
+			aa.failOrderFetch(workerLogger, order, processingID)
+		}
+		return
+	}
+	for _, order := range batch {
+		result, ok := results[order.Number]
+		if !ok {
+			workerLogger.WithField("orderNum", order.Number).Infoln("Order is not registered in accrual system")
+			result = model.AccrualResultRes{Order: order.Number, Status: model.OrderAccInvalid}
+		}
+		aa.applyResult(workerLogger, order, &result, processingID)
+	}
+}
+
+// batchWorker обрабатывает заказы пачками: к первому полученному заказу добавляет заказы, уже
+// ожидающие в очереди, и запрашивает их статусы пакетными запросами по системам начислений.
+// Заказы систем, не поддерживающих пакетные запросы, обрабатываются по одному.
+func (aa *AccrualAgent) batchWorker(ctx context.Context, id int, queue *orderQueue) {
+	workerLogger := logger.Log.WithField("workerID", id)
+	for {
+		order, ok := queue.pop(ctx)
+		if !ok {
+			workerLogger.Debug("Worker stopped")
+			return
+		}
+		aa.metrics.queued.Dec()
+		batch := []model.Order{order}
+		for len(batch) < aa.claimLimit {
+			order, ok := queue.tryPop()
+			if !ok {
+				break
+			}
+			aa.metrics.queued.Dec()
+			batch = append(batch, order)
+		}
+
+		var providers []AccrualProvider
+		batches := make(map[AccrualProvider][]model.Order)
+		for _, order := range batch {
+			provider := aa.providers.route(order.Number)
+			if _, ok := batches[provider]; !ok {
+				providers = append(providers, provider)
+			}
+			batches[provider] = append(batches[provider], order)
+		}
+		for _, provider := range providers {
+			if aa.ctx.Err() != nil {
+				return
+			}
+			batchProvider, ok := provider.(BatchAccrualProvider)
+			if !ok {
+				for _, order := range batches[provider] {
+					aa.processOrder(workerLogger, order)
+				}
+				continue
+			}
+			aa.processBatch(workerLogger, batchProvider, batches[provider])
+		}
+	}
+}
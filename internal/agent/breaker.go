@@ -0,0 +1,126 @@
+package agent
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/pinbrain/gophermart/internal/logger"
+)
+
+// Через это время воркер повторно проверяет, не закрылся ли автомат, пока выполняется пробный запрос
+const halfOpenRetryInterval = time.Second
+
+var ErrCircuitOpen = errors.New("accrual service circuit breaker is open")
+
+// circuitState - состояние автоматического выключателя запросов в систему начислений
+type circuitState int
+
+const (
+	// Запросы выполняются
+	circuitClosed circuitState = iota
+	// Выполняется один пробный запрос, остальные ждут его результата
+	circuitHalfOpen
+	// Запросы не выполняются до окончания паузы
+	circuitOpen
+)
+
+func (s circuitState) String() string {
+	switch s {
+	case circuitHalfOpen:
+		return "half-open"
+	case circuitOpen:
+		return "open"
+	}
+	return "closed"
+}
+
+// circuitBreaker прекращает запросы в систему начислений после threshold неудачных запросов подряд
+// на время cooldown. После паузы выполняется один пробный запрос: успешный возобновляет запросы,
+// неудачный продлевает паузу. При нулевом threshold запросы не прекращаются.
+type circuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	mu       sync.Mutex
+	state    circuitState
+	failures int
+	openedAt time.Time
+}
+
+func newCircuitBreaker(threshold int, cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{threshold: threshold, cooldown: cooldown}
+}
+
+// allow сообщает, можно ли выполнить запрос. По окончании паузы разрешает один пробный запрос.
+func (cb *circuitBreaker) allow() bool {
+	if cb.threshold <= 0 {
+		return true
+	}
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	switch cb.state {
+	case circuitOpen:
+		if time.Now().Before(cb.openedAt.Add(cb.cooldown)) {
+			return false
+		}
+		cb.state = circuitHalfOpen
+		logger.Log.Info("Accrual circuit breaker is half-open, sending probe request")
+		return true
+	case circuitHalfOpen:
+		return false
+	}
+	return true
+}
+
+// retryAfter возвращает время, через которое запрос может быть разрешен
+func (cb *circuitBreaker) retryAfter() time.Duration {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	switch cb.state {
+	case circuitOpen:
+		return time.Until(cb.openedAt.Add(cb.cooldown))
+	case circuitHalfOpen:
+		return halfOpenRetryInterval
+	}
+	return 0
+}
+
+// success записывает успешный запрос
+func (cb *circuitBreaker) success() {
+	if cb.threshold <= 0 {
+		return
+	}
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	if cb.state != circuitClosed {
+		logger.Log.Info("Accrual circuit breaker closed")
+	}
+	cb.state = circuitClosed
+	cb.failures = 0
+}
+
+// failure записывает неудачный запрос
+func (cb *circuitBreaker) failure() {
+	if cb.threshold <= 0 {
+		return
+	}
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	cb.failures++
+	if cb.state == circuitHalfOpen || (cb.state == circuitClosed && cb.failures >= cb.threshold) {
+		cb.state = circuitOpen
+		cb.openedAt = time.Now()
+		logger.Log.WithField("failures", cb.failures).Warnf("Accrual circuit breaker opened for %s", cb.cooldown)
+	}
+}
+
+func (cb *circuitBreaker) current() circuitState {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	return cb.state
+}
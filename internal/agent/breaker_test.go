@@ -0,0 +1,181 @@
+package agent
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Пауза автоматического выключателя в тестах: окончание паузы имитируется сдвигом openedAt
+const testCircuitCooldown = time.Minute
+
+// Действия с автоматическим выключателем в тестах
+const (
+	breakerFailure  = "failure"
+	breakerSuccess  = "success"
+	breakerAllow    = "allow"
+	breakerCooldown = "cooldown"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	tests := []struct {
+		name      string
+		threshold int
+		events    []string
+		wantState circuitState
+		// Разрешен ли следующий запрос
+		wantAllow bool
+	}{
+		{
+			name:      "Ошибок меньше порога",
+			threshold: 3,
+			events:    []string{breakerFailure, breakerFailure},
+			wantState: circuitClosed,
+			wantAllow: true,
+		},
+		{
+			name:      "Порог ошибок подряд",
+			threshold: 3,
+			events:    []string{breakerFailure, breakerFailure, breakerFailure},
+			wantState: circuitOpen,
+			wantAllow: false,
+		},
+		{
+			name:      "Успешный запрос сбрасывает счетчик ошибок",
+			threshold: 3,
+			events:    []string{breakerFailure, breakerFailure, breakerSuccess, breakerFailure, breakerFailure},
+			wantState: circuitClosed,
+			wantAllow: true,
+		},
+		{
+			name:      "Без порога запросы не прекращаются",
+			threshold: 0,
+			events:    []string{breakerFailure, breakerFailure, breakerFailure, breakerFailure},
+			wantState: circuitClosed,
+			wantAllow: true,
+		},
+		{
+			name:      "После паузы выполняется один пробный запрос",
+			threshold: 2,
+			events:    []string{breakerFailure, breakerFailure, breakerCooldown, breakerAllow},
+			wantState: circuitHalfOpen,
+			wantAllow: false,
+		},
+		{
+			name:      "Успешный пробный запрос возобновляет запросы",
+			threshold: 2,
+			events:    []string{breakerFailure, breakerFailure, breakerCooldown, breakerAllow, breakerSuccess},
+			wantState: circuitClosed,
+			wantAllow: true,
+		},
+		{
+			name:      "Неудачный пробный запрос продлевает паузу",
+			threshold: 2,
+			events:    []string{breakerFailure, breakerFailure, breakerCooldown, breakerAllow, breakerFailure},
+			wantState: circuitOpen,
+			wantAllow: false,
+		},
+		{
+			name:      "После возобновления снова нужен порог ошибок",
+			threshold: 2,
+			events: []string{
+				breakerFailure, breakerFailure, breakerCooldown, breakerAllow, breakerSuccess, breakerFailure,
+			},
+			wantState: circuitClosed,
+			wantAllow: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cb := newCircuitBreaker(tt.threshold, testCircuitCooldown)
+			for _, event := range tt.events {
+				switch event {
+				case breakerFailure:
+					cb.failure()
+				case breakerSuccess:
+					cb.success()
+				case breakerAllow:
+					require.True(t, cb.allow())
+				case breakerCooldown:
+					cb.mu.Lock()
+					cb.openedAt = cb.openedAt.Add(-testCircuitCooldown)
+					cb.mu.Unlock()
+				}
+			}
+			assert.Equal(t, tt.wantState, cb.current())
+			assert.Equal(t, tt.wantAllow, cb.allow())
+		})
+	}
+}
+
+func TestCircuitBreakerRetryAfter(t *testing.T) {
+	cb := newCircuitBreaker(1, testCircuitCooldown)
+	assert.Zero(t, cb.retryAfter())
+
+	cb.failure()
+	retryAfter := cb.retryAfter()
+	assert.Greater(t, retryAfter, time.Duration(0))
+	assert.LessOrEqual(t, retryAfter, testCircuitCooldown)
+
+	cb.mu.Lock()
+	cb.openedAt = cb.openedAt.Add(-testCircuitCooldown)
+	cb.mu.Unlock()
+	require.True(t, cb.allow())
+	assert.Equal(t, halfOpenRetryInterval, cb.retryAfter())
+}
+
+func TestCallAccrualCircuitBreaker(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		// Запросы, дошедшие до системы начислений из пяти
+		wantRequests int32
+		wantState    circuitState
+	}{
+		{
+			name:         "Ошибки системы начислений прекращают запросы",
+			status:       http.StatusInternalServerError,
+			wantRequests: 3,
+			wantState:    circuitOpen,
+		},
+		{
+			name:         "Ответ 429 не считается ошибкой",
+			status:       http.StatusTooManyRequests,
+			wantRequests: 5,
+			wantState:    circuitClosed,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var requests atomic.Int32
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+				requests.Add(1)
+				w.Header().Set("Retry-After", "0")
+				w.WriteHeader(tt.status)
+			}))
+			t.Cleanup(server.Close)
+			aa := NewAccrualAgent(newLeaseStorage(), AccrualAgentCfg{
+				AccrualURL:      server.URL,
+				CircuitFailures: 3,
+				CircuitCooldown: testCircuitCooldown,
+				DryRun:          true,
+			})
+
+			for i := 0; i < 5; i++ {
+				_, err := aa.fetchOrderStatus(context.Background(), "12345678903")
+				require.Error(t, err)
+				if int32(i) >= tt.wantRequests {
+					assert.ErrorIs(t, err, ErrCircuitOpen)
+				}
+			}
+			assert.Equal(t, tt.wantRequests, requests.Load())
+			assert.Equal(t, tt.wantState, aa.breaker.current())
+		})
+	}
+}
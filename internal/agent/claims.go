@@ -0,0 +1,86 @@
+package agent
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/pinbrain/gophermart/internal/logger"
+)
+
+// claimSet хранит id заказов, закрепленных за агентом и еще не обработанных
+type claimSet struct {
+	mu  sync.Mutex
+	ids map[int]struct{}
+}
+
+func (cs *claimSet) add(id int) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if cs.ids == nil {
+		cs.ids = make(map[int]struct{})
+	}
+	cs.ids[id] = struct{}{}
+}
+
+func (cs *claimSet) remove(id int) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	delete(cs.ids, id)
+}
+
+func (cs *claimSet) list() []int {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	ids := make([]int, 0, len(cs.ids))
+	for id := range cs.ids {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// clear удаляет все заказы и возвращает их id
+func (cs *claimSet) clear() []int {
+	ids := cs.list()
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	cs.ids = nil
+	return ids
+}
+
+// heartbeatClaims продлевает закрепление заказов, которые агент забрал, но еще не обработал, три раза
+// за время закрепления, чтобы одна неудачная попытка не приводила к повторной отправке заказа
+func (aa *AccrualAgent) heartbeatClaims() {
+	defer aa.wg.Done()
+	for {
+		select {
+		case <-aa.ctx.Done():
+			logger.Log.Debug("Order claims heartbeat stopped")
+			return
+		case <-time.After(aa.inFlightTimeout / 3):
+			ids := aa.claims.list()
+			if len(ids) == 0 {
+				continue
+			}
+			err := aa.storage.ExtendOrderClaims(aa.ctx, aa.instanceID, ids)
+			if err != nil && aa.ctx.Err() == nil {
+				logger.Log.WithError(err).Error("failed to extend order claims")
+			}
+		}
+	}
+}
+
+// releaseClaims при остановке агента снимает закрепление необработанных заказов
+func (aa *AccrualAgent) releaseClaims() {
+	ids := aa.claims.clear()
+	if len(ids) == 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), aa.drainTimeout)
+	defer cancel()
+	if err := aa.storage.ReleaseOrderClaims(ctx, aa.instanceID, ids); err != nil {
+		logger.Log.WithError(err).Error("failed to release order claims")
+		return
+	}
+	logger.Log.WithField("count", len(ids)).Debug("Released unprocessed order claims")
+}
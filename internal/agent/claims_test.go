@@ -0,0 +1,286 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pinbrain/gophermart/internal/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Время закрепления заказа в тестах: heartbeat продлевает его каждые leaseTimeout/3
+const leaseTimeout = 150 * time.Millisecond
+
+type leasedOrder struct {
+	order     model.Order
+	claimedBy string
+	// Время взятия заказа в обработку или последнего продления закрепления, как processing_started_at
+	claimedAt time.Time
+}
+
+// leaseStorage хранит заказы в памяти и закрепляет их так же, как ClaimOrdersToProcess в БД: заказ
+// забирается, если он не закреплен или его закрепление не продлевалось после inFlightAfter
+type leaseStorage struct {
+	mu     sync.Mutex
+	orders []*leasedOrder
+	// Экземпляры, забиравшие заказ, по id заказа
+	claimedBy map[int][]string
+
+	// Продление закреплений завершается ошибкой, как при потере соединения с БД
+	failExtend bool
+	// UpdateOrderStatus ждет отмены контекста
+	blockUpdate bool
+}
+
+func newLeaseStorage(orders ...model.Order) *leaseStorage {
+	st := &leaseStorage{claimedBy: make(map[int][]string)}
+	for _, order := range orders {
+		st.orders = append(st.orders, &leasedOrder{order: order})
+	}
+	return st
+}
+
+func (st *leaseStorage) get(orderID int) leasedOrder {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	for _, o := range st.orders {
+		if o.order.ID == orderID {
+			return *o
+		}
+	}
+	return leasedOrder{}
+}
+
+func (st *leaseStorage) claimers(orderID int) []string {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return append([]string(nil), st.claimedBy[orderID]...)
+}
+
+func (st *leaseStorage) ClaimOrdersToProcess(
+	_ context.Context, status model.OrderStatus, afterID, limit int, claimedBy string, inFlightAfter, _ time.Time,
+) ([]model.Order, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	var claimed []model.Order
+	for _, o := range st.orders {
+		if len(claimed) == limit {
+			break
+		}
+		if o.order.Status != status || o.order.ID <= afterID || o.claimedAt.After(inFlightAfter) {
+			continue
+		}
+		o.claimedBy, o.claimedAt = claimedBy, time.Now()
+		st.claimedBy[o.order.ID] = append(st.claimedBy[o.order.ID], claimedBy)
+		claimed = append(claimed, o.order)
+	}
+	return claimed, nil
+}
+
+func (st *leaseStorage) GetOrdersToProcess(
+	context.Context, model.OrderStatus, int, int, time.Time,
+) ([]model.Order, error) {
+	return nil, nil
+}
+
+func (st *leaseStorage) ExtendOrderClaims(_ context.Context, claimedBy string, orderIDs []int) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.failExtend {
+		return fmt.Errorf("connection lost")
+	}
+	for _, o := range st.orders {
+		for _, id := range orderIDs {
+			if o.order.ID == id && o.claimedBy == claimedBy && !o.claimedAt.IsZero() {
+				o.claimedAt = time.Now()
+			}
+		}
+	}
+	return nil
+}
+
+func (st *leaseStorage) ReleaseOrderClaims(_ context.Context, claimedBy string, orderIDs []int) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	for _, o := range st.orders {
+		for _, id := range orderIDs {
+			if o.order.ID == id && o.claimedBy == claimedBy {
+				o.claimedBy, o.claimedAt = "", time.Time{}
+			}
+		}
+	}
+	return nil
+}
+
+func (st *leaseStorage) UpdateOrderStatus(
+	ctx context.Context, orderID int, status model.OrderStatus, accrual model.Money,
+) (model.Money, error) {
+	if st.blockUpdate {
+		<-ctx.Done()
+		return 0, ctx.Err()
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	for _, o := range st.orders {
+		if o.order.ID == orderID {
+			o.order.Status, o.order.Accrual = status, accrual
+			o.claimedBy, o.claimedAt = "", time.Time{}
+		}
+	}
+	return accrual, nil
+}
+
+func (st *leaseStorage) FailOrderFetch(context.Context, int, int, string) (bool, error) {
+	return false, nil
+}
+
+func (st *leaseStorage) SaveRateLimitEnd(context.Context, time.Time) error {
+	return nil
+}
+
+func (st *leaseStorage) GetRateLimitEnd(context.Context) (time.Time, error) {
+	return time.Time{}, nil
+}
+
+func (st *leaseStorage) CountOrdersToProcess(context.Context) (*model.OrderBacklog, error) {
+	return &model.OrderBacklog{}, nil
+}
+
+func (st *leaseStorage) ExpireOrders(context.Context, time.Time, string) (int, error) {
+	return 0, nil
+}
+
+func (st *leaseStorage) RequeueStuckOrders(context.Context, time.Time, string) (int, error) {
+	return 0, nil
+}
+
+func (st *leaseStorage) ListenNewOrders(ctx context.Context, _ func()) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+// newAccrualServer возвращает систему начислений, которая отвечает PROCESSED или, если hang
+// установлен, не отвечает до отмены запроса
+func newAccrualServer(t *testing.T, hang bool) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if hang {
+			<-r.Context().Done()
+			return
+		}
+		orderNum := strings.TrimPrefix(r.URL.Path, "/api/orders/")
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"order": %q, "status": "PROCESSED", "accrual": 100}`, orderNum)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func newLeaseAgent(st Storage, accrualURL, instanceID string, pollInterval time.Duration) *AccrualAgent {
+	return NewAccrualAgent(st, AccrualAgentCfg{
+		AccrualURL:             accrualURL,
+		InstanceID:             instanceID,
+		WorkerCount:            1,
+		InFlightTimeout:        leaseTimeout,
+		NewPollInterval:        pollInterval,
+		ProcessingPollInterval: time.Hour,
+		DrainTimeout:           100 * time.Millisecond,
+	})
+}
+
+func TestOrderClaimLease(t *testing.T) {
+	tests := []struct {
+		name string
+		// Продление закреплений первого экземпляра завершается ошибкой
+		failExtend bool
+		// Остановить первый экземпляр после проверки, что второй не забрал заказ
+		stopFirst bool
+		// Второй экземпляр забирает заказ
+		wantReclaimed bool
+	}{
+		{
+			name:          "Живое закрепление не забирает другой экземпляр",
+			wantReclaimed: false,
+		},
+		{
+			name:          "Истекшее закрепление забирает другой экземпляр",
+			failExtend:    true,
+			wantReclaimed: true,
+		},
+		{
+			name:          "Снятое при остановке закрепление забирает другой экземпляр",
+			stopFirst:     true,
+			wantReclaimed: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			order := model.Order{ID: 1, UserID: 1, Number: "12345678903", Status: model.OrderNew}
+			st := newLeaseStorage(order)
+			st.failExtend = tt.failExtend
+
+			// Первый экземпляр забирает заказ при запуске и не получает ответа системы начислений
+			first := newLeaseAgent(st, newAccrualServer(t, true).URL, "first", time.Hour)
+			first.StartAgent()
+			defer first.StopAgent()
+			require.Eventually(t, func() bool {
+				return st.get(order.ID).claimedBy == "first"
+			}, time.Second, 10*time.Millisecond)
+
+			second := newLeaseAgent(st, newAccrualServer(t, false).URL, "second", 20*time.Millisecond)
+			second.StartAgent()
+			defer second.StopAgent()
+
+			if !tt.failExtend {
+				// За это время закрепление без продления истекло бы несколько раз
+				time.Sleep(4 * leaseTimeout)
+				assert.Equal(t, []string{"first"}, st.claimers(order.ID))
+				assert.Equal(t, "first", st.get(order.ID).claimedBy)
+			}
+			if tt.stopFirst {
+				first.StopAgent()
+			}
+
+			if !tt.wantReclaimed {
+				return
+			}
+			require.Eventually(t, func() bool {
+				return st.get(order.ID).order.Status == model.OrderProcessed
+			}, 2*time.Second, 10*time.Millisecond)
+			assert.Equal(t, []string{"first", "second"}, st.claimers(order.ID))
+		})
+	}
+}
+
+func TestStopAgentReleasesClaims(t *testing.T) {
+	// Первый заказ обрабатывает единственный воркер, второй ждет в очереди
+	orders := []model.Order{
+		{ID: 1, UserID: 1, Number: "12345678903", Status: model.OrderNew},
+		{ID: 2, UserID: 1, Number: "6485485820226", Status: model.OrderNew},
+	}
+	st := newLeaseStorage(orders...)
+	// Сохранение результата первого заказа не завершается до отмены по drainTimeout
+	st.blockUpdate = true
+
+	aa := newLeaseAgent(st, newAccrualServer(t, false).URL, "first", time.Hour)
+	aa.StartAgent()
+	require.Eventually(t, func() bool {
+		return st.get(2).claimedBy == "first"
+	}, time.Second, 10*time.Millisecond)
+
+	start := time.Now()
+	aa.StopAgent()
+	assert.GreaterOrEqual(t, time.Since(start), aa.drainTimeout)
+
+	// Закрепление заказа, до которого не дошла очередь, снято, и его сразу может забрать другой экземпляр
+	released := st.get(2)
+	assert.Empty(t, released.claimedBy)
+	assert.True(t, released.claimedAt.IsZero())
+	assert.Empty(t, aa.claims.list())
+}
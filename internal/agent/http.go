@@ -0,0 +1,183 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/pinbrain/gophermart/internal/appctx"
+	"github.com/pinbrain/gophermart/internal/faults"
+	"github.com/pinbrain/gophermart/internal/logger"
+	"github.com/pinbrain/gophermart/internal/model"
+	"github.com/sirupsen/logrus"
+)
+
+// HeaderProcessingID - заголовок запроса в систему начислений с идентификатором попытки обработки заказа
+const HeaderProcessingID = "X-Processing-Id"
+
+// setProcessingID передает в заголовке запроса идентификатор попытки обработки заказа из контекста
+func setProcessingID(req *http.Request) {
+	if processingID := appctx.GetProcessingID(req.Context()); processingID != "" {
+		req.Header.Set(HeaderProcessingID, processingID)
+	}
+}
+
+// HTTPProvider запрашивает статусы заказов через HTTP API системы расчета начислений
+type HTTPProvider struct {
+	baseURL string
+	faults  *faults.Injector
+	auth    AccrualAuth
+}
+
+// NewHTTPProvider создает провайдер для системы начислений по адресу baseURL, добавляющий в запросы
+// учетные данные auth. Injector задает искусственные сбои запросов, nil - без сбоев.
+func NewHTTPProvider(baseURL string, injector *faults.Injector, auth AccrualAuth) *HTTPProvider {
+	return &HTTPProvider{baseURL: baseURL, faults: injector, auth: auth}
+}
+
+// rateLimitError возвращает ошибку ограничения частоты запросов со временем из заголовка Retry-After
+func rateLimitError(retryAfter string) error {
+	retryAfterDuration, err := time.ParseDuration(retryAfter + "s")
+	if err != nil {
+		return err
+	}
+	return &RateLimitError{RetryAfter: retryAfterDuration}
+}
+
+// errorResponse возвращает ошибку с телом ответа, в котором скрыт ключ auth на случай, если система
+// начислений повторяет в ответе заголовки запроса
+func errorResponse(res *http.Response, auth AccrualAuth) error {
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		body = []byte("failed to read response body")
+	}
+	return fmt.Errorf("error response from accrual service with status code %d: %s", res.StatusCode, auth.redact(string(body)))
+}
+
+func (hp *HTTPProvider) FetchOrderStatus(ctx context.Context, orderNum string) (*model.AccrualResultRes, error) {
+	if err := hp.faults.Inject(ctx); err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("%s/api/orders/%s", hp.baseURL, orderNum), nil)
+	if err != nil {
+		return nil, err
+	}
+	setProcessingID(req)
+	hp.auth.apply(req)
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusTooManyRequests {
+		return nil, rateLimitError(res.Header.Get("Retry-After"))
+	}
+
+	if res.StatusCode == http.StatusNoContent {
+		logger.Log.WithFields(logrus.Fields{
+			"orderNum":     orderNum,
+			"processingID": appctx.GetProcessingID(ctx),
+		}).Infoln("Order is not registered in accrual system")
+		return &model.AccrualResultRes{
+			Order:  orderNum,
+			Status: model.OrderAccInvalid,
+		}, nil
+	}
+
+	if res.StatusCode != http.StatusOK {
+		return nil, errorResponse(res, hp.auth)
+	}
+
+	var result model.AccrualResultRes
+	if err := json.NewDecoder(res.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// HTTPBatchProvider дополнительно запрашивает статусы нескольких заказов одним запросом по пути batchPath
+type HTTPBatchProvider struct {
+	*HTTPProvider
+	batchPath   string
+	batchFormat BatchFormat
+}
+
+func NewHTTPBatchProvider(
+	baseURL string, injector *faults.Injector, auth AccrualAuth, batchPath string, batchFormat BatchFormat,
+) *HTTPBatchProvider {
+	if batchFormat == "" {
+		batchFormat = BatchFormatJSON
+	}
+	return &HTTPBatchProvider{
+		HTTPProvider: NewHTTPProvider(baseURL, injector, auth),
+		batchPath:    batchPath,
+		batchFormat:  batchFormat,
+	}
+}
+
+func (hp *HTTPBatchProvider) newBatchRequest(ctx context.Context, orderNums []string) (*http.Request, error) {
+	endpoint := hp.baseURL + hp.batchPath
+	if hp.batchFormat == BatchFormatQuery {
+		query := url.Values{"order": orderNums}
+		return http.NewRequestWithContext(ctx, http.MethodGet, endpoint+"?"+query.Encode(), nil)
+	}
+	body, err := json.Marshal(orderNums)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return req, nil
+}
+
+func (hp *HTTPBatchProvider) FetchOrdersStatus(
+	ctx context.Context, orderNums []string,
+) (map[string]model.AccrualResultRes, error) {
+	if err := hp.faults.Inject(ctx); err != nil {
+		return nil, err
+	}
+
+	req, err := hp.newBatchRequest(ctx, orderNums)
+	if err != nil {
+		return nil, err
+	}
+	setProcessingID(req)
+	hp.auth.apply(req)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusTooManyRequests {
+		return nil, rateLimitError(res.Header.Get("Retry-After"))
+	}
+
+	results := make(map[string]model.AccrualResultRes, len(orderNums))
+	if res.StatusCode == http.StatusNoContent {
+		return results, nil
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, errorResponse(res, hp.auth)
+	}
+
+	var list []model.AccrualResultRes
+	if err := json.NewDecoder(res.Body).Decode(&list); err != nil {
+		return nil, err
+	}
+	for _, result := range list {
+		results[result.Order] = result
+	}
+	return results, nil
+}
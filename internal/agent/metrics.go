@@ -0,0 +1,168 @@
+package agent
+
+import (
+	"context"
+	"time"
+
+	"github.com/pinbrain/gophermart/internal/logger"
+	"github.com/pinbrain/gophermart/internal/model"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// Время, в течение которого используется ранее посчитанный размер очереди заказов
+	backlogCacheTTL = 5 * time.Second
+	// Результаты запроса статуса заказа в метрике gophermart_agent_orders_fetched_total
+	fetchResultSuccess = "success"
+	fetchResultFailed  = "failed"
+)
+
+// agentMetrics - метрики работы агента, обновляемые воркерами
+type agentMetrics struct {
+	fetched         *prometheus.CounterVec
+	transitions     *prometheus.CounterVec
+	requestDuration prometheus.Histogram
+	rateLimited     prometheus.Counter
+	queued          prometheus.Gauge
+	stuck           prometheus.Gauge
+	requeued        prometheus.Counter
+}
+
+func newAgentMetrics() *agentMetrics {
+	return &agentMetrics{
+		fetched: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "gophermart_agent_orders_fetched_total",
+			Help: "Количество запросов статуса заказа в системе начислений: success - статус получен, failed - попытки исчерпаны",
+		}, []string{"result"}),
+		transitions: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "gophermart_agent_status_transitions_total",
+			Help: "Количество изменений статусов заказов агентом",
+		}, []string{"from", "to"}),
+		requestDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "gophermart_agent_accrual_request_duration_seconds",
+			Help:    "Время выполнения запросов в систему начислений",
+			Buckets: prometheus.DefBuckets,
+		}),
+		rateLimited: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "gophermart_agent_rate_limited_total",
+			Help: "Количество ответов 429 от системы начислений",
+		}),
+		queued: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "gophermart_agent_queue_orders",
+			Help: "Количество заказов, забранных из БД и ожидающих свободного воркера",
+		}),
+		stuck: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "gophermart_agent_stuck_orders",
+			Help: "Количество заказов, найденных при последней проверке в статусе PROCESSING дольше допустимого",
+		}),
+		requeued: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "gophermart_agent_stuck_orders_requeued_total",
+			Help: "Количество заказов, возвращенных в NEW после слишком долгого нахождения в статусе PROCESSING",
+		}),
+	}
+}
+
+// Backlog возвращает количество заказов, ожидающих обработки. Значение кэшируется на
+// backlogCacheTTL, чтобы частые запросы метрик и статуса не нагружали БД.
+func (aa *AccrualAgent) Backlog(ctx context.Context) (*model.OrderBacklog, error) {
+	aa.backlogMu.Lock()
+	defer aa.backlogMu.Unlock()
+
+	if time.Since(aa.backlogAt) < backlogCacheTTL {
+		backlog := aa.backlog
+		return &backlog, nil
+	}
+	backlog, err := aa.storage.CountOrdersToProcess(ctx)
+	if err != nil {
+		return nil, err
+	}
+	aa.backlog = *backlog
+	aa.backlogAt = time.Now()
+	return backlog, nil
+}
+
+// Status возвращает текущее состояние агента
+func (aa *AccrualAgent) Status(ctx context.Context) (*model.AgentStatus, error) {
+	backlog, err := aa.Backlog(ctx)
+	if err != nil {
+		return nil, err
+	}
+	status := &model.AgentStatus{
+		Running: aa.running.Load(),
+		Backlog: *backlog,
+		Circuit: aa.breaker.current().String(),
+	}
+	if status.Running {
+		status.Workers = aa.workers()
+	}
+	if lastContact := aa.lastContactAt.Load(); lastContact > 0 {
+		lastContactAt := time.Unix(0, lastContact)
+		status.LastContactAt = &lastContactAt
+	}
+	aa.rateLimit.RLock()
+	rateLimitEndTime := aa.rateLimitEndTime
+	aa.rateLimit.RUnlock()
+	if time.Now().Before(rateLimitEndTime) {
+		status.RateLimitedUntil = &rateLimitEndTime
+	}
+	return status, nil
+}
+
+func (aa *AccrualAgent) backlogGauge(status model.OrderStatus, value func(model.OrderBacklog) int) prometheus.GaugeFunc {
+	return prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name:        "gophermart_agent_backlog_orders",
+		Help:        "Количество заказов, ожидающих расчета начислений",
+		ConstLabels: prometheus.Labels{"status": string(status)},
+	}, func() float64 {
+		backlog, err := aa.Backlog(context.Background())
+		if err != nil {
+			logger.Log.WithError(err).Error("failed to get orders backlog for metrics")
+			return 0
+		}
+		return float64(value(*backlog))
+	})
+}
+
+// RegisterMetrics регистрирует метрики агента
+func (aa *AccrualAgent) RegisterMetrics(reg prometheus.Registerer) error {
+	collectors := []prometheus.Collector{
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "gophermart_agent_circuit_state",
+			Help: "Состояние автоматического выключателя запросов в систему начислений: 0 - закрыт, 1 - пробный запрос, 2 - открыт",
+		}, func() float64 {
+			return float64(aa.breaker.current())
+		}),
+		aa.backlogGauge(model.OrderNew, func(b model.OrderBacklog) int { return b.New }),
+		aa.backlogGauge(model.OrderProcessing, func(b model.OrderBacklog) int { return b.Processing }),
+		aa.backlogGauge(model.OrderStalled, func(b model.OrderBacklog) int { return b.Stalled }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "gophermart_agent_oldest_order_age_seconds",
+			Help: "Возраст самого старого заказа, ожидающего расчета начислений",
+		}, func() float64 {
+			backlog, err := aa.Backlog(context.Background())
+			if err != nil || backlog.OldestAt == nil {
+				return 0
+			}
+			return time.Since(*backlog.OldestAt).Seconds()
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "gophermart_agent_workers",
+			Help: "Количество запущенных воркеров агента",
+		}, func() float64 {
+			return float64(aa.workers())
+		}),
+		aa.metrics.fetched,
+		aa.metrics.transitions,
+		aa.metrics.requestDuration,
+		aa.metrics.rateLimited,
+		aa.metrics.queued,
+		aa.metrics.stuck,
+		aa.metrics.requeued,
+	}
+	for _, c := range collectors {
+		if err := reg.Register(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pinbrain/gophermart/internal/model"
+)
+
+// AccrualProvider - система расчета начислений, у которой агент запрашивает статусы заказов
+type AccrualProvider interface {
+	FetchOrderStatus(ctx context.Context, orderNum string) (*model.AccrualResultRes, error)
+}
+
+// BatchAccrualProvider - система расчета начислений, возвращающая статусы нескольких заказов одним
+// запросом. Заказы, отсутствующие в результате, считаются не зарегистрированными в системе.
+type BatchAccrualProvider interface {
+	AccrualProvider
+	FetchOrdersStatus(ctx context.Context, orderNums []string) (map[string]model.AccrualResultRes, error)
+}
+
+// RateLimitError возвращается провайдером, если система начислений ограничила частоту запросов.
+// Агент приостанавливает запросы ко всем системам на время RetryAfter.
+type RateLimitError struct {
+	RetryAfter time.Duration
+}
+
+func (e *RateLimitError) Error() string {
+	return fmt.Sprintf("%s, retry after %s", ErrReqLimit, e.RetryAfter)
+}
+
+func (e *RateLimitError) Unwrap() error {
+	return ErrReqLimit
+}
+
+// ProviderRoute направляет в Provider заказы, номера которых начинаются с Prefix
+type ProviderRoute struct {
+	Prefix   string
+	Provider AccrualProvider
+}
+
+// providerRouter выбирает систему начислений по самому длинному совпавшему префиксу номера заказа,
+// заказы без совпадений отправляются в fallback
+type providerRouter struct {
+	routes   []ProviderRoute
+	fallback AccrualProvider
+}
+
+func newProviderRouter(fallback AccrualProvider, routes []ProviderRoute) *providerRouter {
+	sorted := make([]ProviderRoute, len(routes))
+	copy(sorted, routes)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return len(sorted[i].Prefix) > len(sorted[j].Prefix)
+	})
+	return &providerRouter{routes: sorted, fallback: fallback}
+}
+
+func (pr *providerRouter) route(orderNum string) AccrualProvider {
+	for _, r := range pr.routes {
+		if strings.HasPrefix(orderNum, r.Prefix) {
+			return r.Provider
+		}
+	}
+	return pr.fallback
+}
+
+// ParseProviderAddresses разбирает адреса систем начислений в формате префикс1=адрес1,префикс2=адрес2
+func ParseProviderAddresses(s string) (map[string]string, error) {
+	addresses := make(map[string]string)
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		prefix, address, ok := strings.Cut(pair, "=")
+		if !ok || prefix == "" || address == "" {
+			return nil, fmt.Errorf("invalid accrual provider %q: expected prefix=address", pair)
+		}
+		if _, exists := addresses[prefix]; exists {
+			return nil, fmt.Errorf("duplicate accrual provider prefix %q", prefix)
+		}
+		addresses[prefix] = address
+	}
+	return addresses, nil
+}
@@ -0,0 +1,82 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/pinbrain/gophermart/internal/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newNamedAccrualServer возвращает систему начислений, которая начисляет accrual по любому заказу
+func newNamedAccrualServer(t *testing.T, accrual int) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"order": "1", "status": "PROCESSED", "accrual": %d}`, accrual)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestProviderRouting(t *testing.T) {
+	// Начисление в ответе показывает, какая система начислений получила запрос
+	aa := NewAccrualAgent(newLeaseStorage(), AccrualAgentCfg{
+		AccrualURL: newNamedAccrualServer(t, 1).URL,
+		Providers: []ProviderRoute{
+			{Prefix: "4", Provider: NewHTTPProvider(newNamedAccrualServer(t, 2).URL, nil, AccrualAuth{})},
+			{Prefix: "42", Provider: NewHTTPProvider(newNamedAccrualServer(t, 3).URL, nil, AccrualAuth{})},
+		},
+	})
+	tests := []struct {
+		name     string
+		orderNum string
+		want     model.Money
+	}{
+		{name: "Без совпадений - основная система", orderNum: "12345678903", want: 100},
+		{name: "Совпал префикс", orderNum: "4111111111111111", want: 200},
+		{name: "Выбирается самый длинный префикс", orderNum: "4242424242424242", want: 300},
+		{name: "Префикс совпадает только с начала номера", orderNum: "1424", want: 100},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := aa.fetchOrderStatus(context.Background(), tt.orderNum)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, result.Accrual)
+		})
+	}
+}
+
+func TestParseProviderAddresses(t *testing.T) {
+	tests := []struct {
+		name    string
+		s       string
+		want    map[string]string
+		wantErr bool
+	}{
+		{name: "Пустая строка", s: "", want: map[string]string{}},
+		{
+			name: "Несколько систем",
+			s:    "4=http://visa:8080, 5=http://mastercard:8080,",
+			want: map[string]string{"4": "http://visa:8080", "5": "http://mastercard:8080"},
+		},
+		{name: "Без адреса", s: "4=", wantErr: true},
+		{name: "Без префикса", s: "=http://visa:8080", wantErr: true},
+		{name: "Без разделителя", s: "http://visa:8080", wantErr: true},
+		{name: "Повторный префикс", s: "4=http://a,4=http://b", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseProviderAddresses(tt.s)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
@@ -0,0 +1,74 @@
+package agent
+
+import (
+	"context"
+
+	"github.com/pinbrain/gophermart/internal/model"
+)
+
+// orderQueue - очередь заказов, переданных воркерам. Новые заказы выдаются раньше заказов, уже
+// принятых в обработку системой начислений, чтобы пользователи быстрее получали результат по свежим
+// загрузкам, даже если в обработке накопилось много заказов.
+type orderQueue struct {
+	fresh   chan model.Order
+	pending chan model.Order
+}
+
+func newOrderQueue(size int) *orderQueue {
+	return &orderQueue{
+		fresh:   make(chan model.Order, size),
+		pending: make(chan model.Order, size),
+	}
+}
+
+// push помещает заказ в очередь, дожидаясь освободившегося места
+func (q *orderQueue) push(ctx context.Context, order model.Order) error {
+	ch := q.pending
+	if order.Status == model.OrderNew {
+		ch = q.fresh
+	}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case ch <- order:
+		return nil
+	}
+}
+
+// tryPop возвращает заказ, если он есть в очереди, не дожидаясь новых
+func (q *orderQueue) tryPop() (model.Order, bool) {
+	select {
+	case order := <-q.fresh:
+		return order, true
+	default:
+	}
+	select {
+	case order := <-q.pending:
+		return order, true
+	default:
+		return model.Order{}, false
+	}
+}
+
+// pop дожидается заказа из очереди. Возвращает false, если контекст завершен.
+func (q *orderQueue) pop(ctx context.Context) (model.Order, bool) {
+	if ctx.Err() != nil {
+		return model.Order{}, false
+	}
+	if order, ok := q.tryPop(); ok {
+		return order, true
+	}
+	select {
+	case <-ctx.Done():
+		return model.Order{}, false
+	case order := <-q.fresh:
+		return order, true
+	case order := <-q.pending:
+		return order, true
+	}
+}
+
+// len возвращает количество заказов в очереди
+func (q *orderQueue) len() int {
+	return len(q.fresh) + len(q.pending)
+}
@@ -0,0 +1,63 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const rateLimitKey = "gophermart:agent:rate_limit_until"
+
+// RateLimitStore хранит момент окончания ограничения запросов к системе начислений,
+// общий для всех экземпляров агента
+type RateLimitStore interface {
+	SetRateLimitEnd(ctx context.Context, until time.Time) error
+	GetRateLimitEnd(ctx context.Context) (time.Time, error)
+}
+
+// Скрипт сохраняет момент окончания ограничения, только если он позже уже сохраненного,
+// чтобы экземпляр с устаревшим ответом 429 не сократил общее ограничение
+var setRateLimitScript = redis.NewScript(`
+local current = redis.call('GET', KEYS[1])
+if current and tonumber(current) >= tonumber(ARGV[1]) then
+	return 0
+end
+redis.call('SET', KEYS[1], ARGV[1], 'PX', ARGV[2])
+return 1
+`)
+
+// RedisRateLimitStore хранит ограничение запросов к системе начислений в Redis, ответ 429,
+// полученный одним экземпляром, приостанавливает запросы всех экземпляров
+type RedisRateLimitStore struct {
+	client *redis.Client
+}
+
+func NewRedisRateLimitStore(client *redis.Client) *RedisRateLimitStore {
+	return &RedisRateLimitStore{client: client}
+}
+
+func (rs *RedisRateLimitStore) SetRateLimitEnd(ctx context.Context, until time.Time) error {
+	ttl := time.Until(until)
+	if ttl <= 0 {
+		return nil
+	}
+	err := setRateLimitScript.Run(ctx, rs.client, []string{rateLimitKey}, until.UnixMilli(), ttl.Milliseconds()).Err()
+	if err != nil {
+		return fmt.Errorf("failed to save shared rate limit end: %w", err)
+	}
+	return nil
+}
+
+func (rs *RedisRateLimitStore) GetRateLimitEnd(ctx context.Context) (time.Time, error) {
+	until, err := rs.client.Get(ctx, rateLimitKey).Int64()
+	if errors.Is(err, redis.Nil) {
+		return time.Time{}, nil
+	}
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to get shared rate limit end: %w", err)
+	}
+	return time.UnixMilli(until), nil
+}
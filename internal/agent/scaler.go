@@ -0,0 +1,132 @@
+package agent
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/pinbrain/gophermart/internal/logger"
+)
+
+const (
+	// Интервал пересчета количества воркеров
+	scaleInterval = 5 * time.Second
+	// Вес нового замера в скользящем среднем времени запроса в систему начислений
+	latencyWeight = 0.2
+)
+
+// latencyAverage - экспоненциальное скользящее среднее времени запроса в систему начислений
+type latencyAverage struct {
+	mu    sync.Mutex
+	value time.Duration
+}
+
+func (la *latencyAverage) observe(d time.Duration) {
+	la.mu.Lock()
+	defer la.mu.Unlock()
+	if la.value == 0 {
+		la.value = d
+		return
+	}
+	la.value = time.Duration(latencyWeight*float64(d) + (1-latencyWeight)*float64(la.value))
+}
+
+func (la *latencyAverage) get() time.Duration {
+	la.mu.Lock()
+	defer la.mu.Unlock()
+	return la.value
+}
+
+// workerPool хранит функции остановки запущенных воркеров
+type workerPool struct {
+	mu      sync.Mutex
+	cancels []context.CancelFunc
+	nextID  int
+}
+
+// addWorker запускает воркер, который завершится при остановке агента или при уменьшении пула
+func (aa *AccrualAgent) addWorker() {
+	worker := aa.worker
+	if aa.batchMode {
+		worker = aa.batchWorker
+	}
+
+	aa.pool.mu.Lock()
+	defer aa.pool.mu.Unlock()
+	ctx, cancel := context.WithCancel(aa.ctx)
+	aa.pool.cancels = append(aa.pool.cancels, cancel)
+	id := aa.pool.nextID
+	aa.pool.nextID++
+
+	aa.wg.Add(1)
+	go func() {
+		defer aa.wg.Done()
+		worker(ctx, id, aa.queue)
+	}()
+}
+
+// removeWorker останавливает последний запущенный воркер. Воркер завершает обработку текущего заказа.
+func (aa *AccrualAgent) removeWorker() {
+	aa.pool.mu.Lock()
+	defer aa.pool.mu.Unlock()
+	last := len(aa.pool.cancels) - 1
+	aa.pool.cancels[last]()
+	aa.pool.cancels = aa.pool.cancels[:last]
+}
+
+// workers возвращает количество запущенных воркеров
+func (aa *AccrualAgent) workers() int {
+	aa.pool.mu.Lock()
+	defer aa.pool.mu.Unlock()
+	return len(aa.pool.cancels)
+}
+
+// desiredWorkers оценивает, сколько воркеров нужно, чтобы за interval отправить запросы по claimed
+// забранным из БД и queued ожидающим в очереди заказам при среднем времени запроса latency
+func (aa *AccrualAgent) desiredWorkers(claimed, queued int, latency, interval time.Duration) int {
+	requests := float64(claimed + queued)
+	if aa.batchMode {
+		requests = math.Ceil(requests / float64(aa.claimLimit))
+	}
+	desired := int(math.Ceil(requests * float64(latency) / float64(interval)))
+	return min(max(desired, aa.workerCount), aa.maxWorkerCount)
+}
+
+// scaleWorkers периодически меняет количество воркеров от workerCount до maxWorkerCount по количеству
+// забранных из БД заказов и среднему времени запроса в систему начислений. Пул растет сразу до нужного
+// размера, а уменьшается на один воркер за интервал, чтобы не останавливать воркеры при кратких паузах.
+// Пока запросы ограничены ответом 429 или автоматическим выключателем, пул не растет.
+func (aa *AccrualAgent) scaleWorkers() {
+	defer aa.wg.Done()
+	for {
+		select {
+		case <-aa.ctx.Done():
+			logger.Log.Debug("Worker scaler stopped")
+			return
+		case <-time.After(scaleInterval):
+			current := aa.workers()
+			desired := aa.desiredWorkers(
+				int(aa.claimed.Swap(0)), aa.queue.len(), aa.latency.get(), scaleInterval,
+			)
+
+			aa.rateLimit.RLock()
+			rateLimited := time.Now().Before(aa.rateLimitEndTime)
+			aa.rateLimit.RUnlock()
+			if rateLimited || aa.breaker.current() != circuitClosed {
+				desired = min(desired, current)
+			}
+
+			switch {
+			case desired > current:
+				logger.Log.WithField("workers", desired).Info("Scaling accrual workers up")
+				for i := current; i < desired; i++ {
+					aa.addWorker()
+				}
+			case desired < current:
+				logger.Log.WithField("workers", current-1).Debug("Scaling accrual workers down")
+				aa.removeWorker()
+			}
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package agent
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/pinbrain/gophermart/internal/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDesiredWorkers(t *testing.T) {
+	tests := []struct {
+		name      string
+		batchPath string
+		claimed   int
+		queued    int
+		latency   time.Duration
+		want      int
+	}{
+		{name: "Нет заказов", want: 2},
+		{name: "Нет замеров времени запроса", claimed: 100, want: 2},
+		{name: "Заказы успевают обработать минимальным пулом", claimed: 10, latency: time.Second, want: 2},
+		{name: "Пул растет по количеству заказов", claimed: 30, latency: time.Second, want: 6},
+		{name: "Учитываются заказы в очереди", claimed: 20, queued: 10, latency: time.Second, want: 6},
+		{name: "Пул растет по времени запроса", claimed: 10, latency: 2500 * time.Millisecond, want: 5},
+		{name: "Пул ограничен сверху", claimed: 100, latency: time.Second, want: 10},
+		{
+			name: "В пакетном режиме считаются запросы, а не заказы", batchPath: "/api/orders/batch",
+			claimed: 300, latency: time.Second, want: 6,
+		},
+		{
+			name: "Неполная пачка считается запросом", batchPath: "/api/orders/batch",
+			claimed: 31, latency: 10 * time.Second, want: 8,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			aa := NewAccrualAgent(newLeaseStorage(), AccrualAgentCfg{
+				WorkerCount:    2,
+				MaxWorkerCount: 10,
+				BatchPath:      tt.batchPath,
+				BatchSize:      10,
+			})
+			assert.Equal(t, tt.want, aa.desiredWorkers(tt.claimed, tt.queued, tt.latency, 5*time.Second))
+		})
+	}
+}
+
+func TestLatencyAverage(t *testing.T) {
+	var la latencyAverage
+	assert.Zero(t, la.get())
+
+	// Первый замер становится средним, следующие учитываются с весом latencyWeight
+	la.observe(time.Second)
+	assert.Equal(t, time.Second, la.get())
+	la.observe(2 * time.Second)
+	assert.Equal(t, 1200*time.Millisecond, la.get())
+	la.observe(200 * time.Millisecond)
+	assert.Equal(t, 1000*time.Millisecond, la.get())
+}
+
+func TestWorkerPool(t *testing.T) {
+	aa := NewAccrualAgent(newLeaseStorage(), AccrualAgentCfg{WorkerCount: 1, MaxWorkerCount: 3})
+	var cancel context.CancelFunc
+	aa.ctx, cancel = context.WithCancel(context.Background())
+	aa.queue = newOrderQueue(1)
+
+	for i := 0; i < 3; i++ {
+		aa.addWorker()
+	}
+	assert.Equal(t, 3, aa.workers())
+	aa.removeWorker()
+	assert.Equal(t, 2, aa.workers())
+
+	cancel()
+	done := make(chan struct{})
+	go func() {
+		aa.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("workers did not stop")
+	}
+}
+
+func TestOrderQueue(t *testing.T) {
+	ctx := context.Background()
+	q := newOrderQueue(2)
+	processing := model.Order{ID: 1, Status: model.OrderProcessing}
+	fresh := model.Order{ID: 2, Status: model.OrderNew}
+	require.NoError(t, q.push(ctx, processing))
+	require.NoError(t, q.push(ctx, fresh))
+	assert.Equal(t, 2, q.len())
+
+	// Новые заказы выдаются раньше заказов в обработке
+	order, ok := q.pop(ctx)
+	require.True(t, ok)
+	assert.Equal(t, fresh.ID, order.ID)
+	order, ok = q.tryPop()
+	require.True(t, ok)
+	assert.Equal(t, processing.ID, order.ID)
+	assert.Zero(t, q.len())
+
+	_, ok = q.tryPop()
+	assert.False(t, ok)
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	_, ok = q.pop(canceled)
+	assert.False(t, ok)
+}
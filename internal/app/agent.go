@@ -0,0 +1,124 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+
+	"github.com/pinbrain/gophermart/internal/agent"
+	"github.com/pinbrain/gophermart/internal/config"
+	"github.com/pinbrain/gophermart/internal/logger"
+	"github.com/pinbrain/gophermart/internal/metrics"
+	"github.com/pinbrain/gophermart/internal/storage"
+	"golang.org/x/sync/errgroup"
+)
+
+// RunAgent запускает агент расчета начислений отдельно от HTTP API. Агент работает с той же БД,
+// что и сервис, поэтому количество экземпляров агента можно менять независимо от сервиса.
+func RunAgent() error {
+	// корневой контекст приложения
+	rootCtx, cancelCtx := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancelCtx()
+
+	g, ctx := errgroup.WithContext(rootCtx)
+
+	context.AfterFunc(ctx, func() {
+		ctx, cancelCtx := context.WithTimeout(context.Background(), timeoutShutdown)
+		defer cancelCtx()
+
+		<-ctx.Done()
+		log.Fatal("failed to gracefully shutdown the accrual agent")
+	})
+
+	agentConf, err := config.InitAgentConfig()
+	if err != nil {
+		return err
+	}
+
+	if err = logger.Initialize(agentConf.LogLevel, agentConf.InstanceID); err != nil {
+		return err
+	}
+	if err = metrics.Initialize(agentConf.InstanceID); err != nil {
+		return err
+	}
+
+	storage, err := storage.NewStorage(ctx, storage.StorageCfg{
+		DSN:            agentConf.DSN,
+		ReadDSN:        agentConf.ReadDSN,
+		Pool:           newPoolCfg(agentConf.DBPool),
+		SkipMigrations: !agentConf.DBAutoMigrate,
+	})
+	if err != nil {
+		return err
+	}
+	defer storage.Close()
+
+	accrualAuth := agent.AccrualAuth{Header: agentConf.AccrualAPIKeyHeader, Key: agentConf.AccrualAPIKey}
+	accrualProviders, err := newAccrualProviders(agentConf.AccrualProviders, nil, accrualAuth, "", "")
+	if err != nil {
+		return err
+	}
+
+	accrualAgent := agent.NewAccrualAgent(newServiceStorage(storage), agent.AccrualAgentCfg{
+		AccrualURL:             agentConf.AccrualAddress,
+		Providers:              accrualProviders,
+		Auth:                   accrualAuth,
+		DryRun:                 agentConf.AccrualDryRun,
+		NewPollInterval:        agentConf.AccrualNewPollInterval,
+		ProcessingPollInterval: agentConf.AccrualProcessingPollInterval,
+		ListenNewOrders:        listenNewOrders(agentConf.DSN, agentConf.AccrualListenNewOrders),
+		OrderMaxAge:            agentConf.AccrualOrderMaxAge,
+		WorkerCount:            agentConf.AccrualWorkerCount,
+		InstanceID:             agentConf.InstanceID,
+		MaxFetchFailures:       agentConf.AccrualMaxFetchFailures,
+	})
+	if err = accrualAgent.RegisterMetrics(metrics.Registerer); err != nil {
+		return err
+	}
+	accrualAgent.StartAgent()
+	logger.Log.Info("Accrual agent started")
+
+	var metricsSrv *http.Server
+	if agentConf.MetricsAddress != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", metrics.Handler())
+		metricsSrv = &http.Server{
+			Addr:    agentConf.MetricsAddress,
+			Handler: mux,
+		}
+		g.Go(func() error {
+			if err := metricsSrv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				return fmt.Errorf("metrics server has failed: %w", err)
+			}
+			return nil
+		})
+	}
+
+	g.Go(func() error {
+		defer logger.Log.Info("Accrual agent has been shutdown")
+		<-ctx.Done()
+		logger.Log.Info("Gracefully shutting down accrual agent...")
+
+		if metricsSrv != nil {
+			shutdownTimeoutCtx, cancelShutdownTimeoutCtx := context.WithTimeout(context.Background(), timeoutServerShutdown)
+			defer cancelShutdownTimeoutCtx()
+			if err := metricsSrv.Shutdown(shutdownTimeoutCtx); err != nil {
+				logger.Log.Errorf("an error occurred during metrics server shutdown: %v", err)
+			}
+		}
+
+		accrualAgent.StopAgent()
+		logger.Log.Info("Accrual agent stopped")
+
+		storage.Close()
+		logger.Log.Info("Storage closed")
+
+		return nil
+	})
+
+	return g.Wait()
+}
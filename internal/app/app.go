@@ -8,13 +8,33 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"time"
 
 	"github.com/pinbrain/gophermart/internal/agent"
+	"github.com/pinbrain/gophermart/internal/broker"
 	"github.com/pinbrain/gophermart/internal/config"
+	"github.com/pinbrain/gophermart/internal/events"
+	"github.com/pinbrain/gophermart/internal/faults"
 	"github.com/pinbrain/gophermart/internal/handlers"
 	"github.com/pinbrain/gophermart/internal/logger"
+	"github.com/pinbrain/gophermart/internal/loginalert"
+	"github.com/pinbrain/gophermart/internal/loyalty"
+	"github.com/pinbrain/gophermart/internal/mailer"
+	"github.com/pinbrain/gophermart/internal/metrics"
+	"github.com/pinbrain/gophermart/internal/middleware"
+	"github.com/pinbrain/gophermart/internal/model"
+	"github.com/pinbrain/gophermart/internal/nonce"
+	"github.com/pinbrain/gophermart/internal/oidc"
+	"github.com/pinbrain/gophermart/internal/outbox"
+	"github.com/pinbrain/gophermart/internal/passwordpolicy"
+	"github.com/pinbrain/gophermart/internal/projector"
+	"github.com/pinbrain/gophermart/internal/ratelimit"
+	"github.com/pinbrain/gophermart/internal/session"
 	"github.com/pinbrain/gophermart/internal/storage"
+	"github.com/pinbrain/gophermart/internal/utils"
+	"github.com/pinbrain/gophermart/internal/webhook"
+	"github.com/redis/go-redis/v9"
 	"github.com/sirupsen/logrus"
 	"golang.org/x/sync/errgroup"
 )
@@ -24,6 +44,61 @@ const (
 	timeoutShutdown       = time.Second * 10
 )
 
+// newUserLimiter создает ограничитель частоты запросов пользователя. Если задан клиент Redis,
+// счетчики общие для всех экземпляров сервиса, иначе хранятся в памяти процесса.
+func newUserLimiter(redisClient *redis.Client, name string, limit int, window time.Duration) ratelimit.Limiter {
+	if limit <= 0 {
+		return nil
+	}
+	if redisClient != nil {
+		return ratelimit.NewRedisLimiter(redisClient, "gophermart:ratelimit:"+name, limit, window)
+	}
+	return ratelimit.NewMemoryLimiter(limit, window)
+}
+
+// newTokenBucketLimiter создает ограничитель частоты запросов token bucket. Как и в newUserLimiter,
+// при заданном клиенте Redis корзины общие для всех экземпляров сервиса.
+func newTokenBucketLimiter(redisClient *redis.Client, name string, rps float64, burst int) ratelimit.Limiter {
+	if rps <= 0 {
+		return nil
+	}
+	if redisClient != nil {
+		return ratelimit.NewRedisTokenBucketLimiter(redisClient, "gophermart:ratelimit:"+name, rps, burst)
+	}
+	return ratelimit.NewTokenBucketLimiter(rps, burst)
+}
+
+func newPoolCfg(cfg config.DBPoolConf) storage.PoolCfg {
+	return storage.PoolCfg{
+		MaxConns:          int32(cfg.MaxConns),
+		MinConns:          int32(cfg.MinConns),
+		MaxConnLifetime:   cfg.MaxConnLifetime,
+		MaxConnIdleTime:   cfg.MaxConnIdleTime,
+		HealthCheckPeriod: cfg.HealthCheckPeriod,
+	}
+}
+
+// newAccrualProviders создает HTTP-провайдеры дополнительных систем начислений из адресов в формате
+// префикс1=адрес1,префикс2=адрес2 с общими учетными данными auth. При заданном batchPath провайдеры
+// запрашивают статусы пачками.
+func newAccrualProviders(
+	addresses string, injector *faults.Injector, auth agent.AccrualAuth, batchPath string, batchFormat agent.BatchFormat,
+) ([]agent.ProviderRoute, error) {
+	parsed, err := agent.ParseProviderAddresses(addresses)
+	if err != nil {
+		return nil, err
+	}
+	routes := make([]agent.ProviderRoute, 0, len(parsed))
+	for prefix, address := range parsed {
+		var provider agent.AccrualProvider = agent.NewHTTPProvider(address, injector, auth)
+		if batchPath != "" {
+			provider = agent.NewHTTPBatchProvider(address, injector, auth, batchPath, batchFormat)
+		}
+		routes = append(routes, agent.ProviderRoute{Prefix: prefix, Provider: provider})
+	}
+	return routes, nil
+}
+
 func Run() error {
 	// корневой контекст приложения
 	rootCtx, cancelCtx := signal.NotifyContext(context.Background(), os.Interrupt)
@@ -47,20 +122,346 @@ func Run() error {
 		return err
 	}
 
-	if err = logger.Initialize(serverConf.LogLevel); err != nil {
+	if err = logger.Initialize(serverConf.LogLevel, serverConf.InstanceID); err != nil {
+		return err
+	}
+	if err = metrics.Initialize(serverConf.InstanceID); err != nil {
+		return err
+	}
+	if err = configureJWT(serverConf); err != nil {
+		return err
+	}
+	if err = utils.ConfigurePasswordHashing(serverConf.PasswordHashAlgorithm); err != nil {
+		return err
+	}
+	cookieSameSite, err := middleware.ParseSameSite(serverConf.CookieSameSite)
+	if err != nil {
+		return err
+	}
+	err = middleware.ConfigureCookies(middleware.CookieCfg{
+		Secure:   serverConf.CookieSecure,
+		SameSite: cookieSameSite,
+		Domain:   serverConf.CookieDomain,
+		MaxAge:   serverConf.CookieMaxAge,
+	})
+	if err != nil {
 		return err
 	}
 
-	storage, err := storage.NewStorage(ctx, storage.StorageCfg{DSN: serverConf.DSN})
+	var loyaltyTiers *loyalty.Tiers
+	if serverConf.LoyaltyTiers {
+		loyaltyTiers, err = loyalty.NewTiers(loyalty.DefaultLevels(
+			model.MoneyFromFloat(serverConf.LoyaltySilverThreshold),
+			model.MoneyFromFloat(serverConf.LoyaltyGoldThreshold),
+			serverConf.LoyaltySilverMultiplier,
+			serverConf.LoyaltyGoldMultiplier,
+		))
+		if err != nil {
+			return err
+		}
+	}
+
+	storage, err := storage.NewStorage(ctx, storage.StorageCfg{
+		DSN:                  serverConf.DSN,
+		ReadDSN:              serverConf.ReadDSN,
+		SkipMigrations:       !serverConf.DBAutoMigrate,
+		Pool:                 newPoolCfg(serverConf.DBPool),
+		EventSourcedBalance:  serverConf.EventSourcedBalance,
+		MinWithdrawSum:       model.MoneyFromFloat(serverConf.MinWithdrawSum),
+		WithdrawCancelWindow: serverConf.WithdrawCancelWindow,
+		WithdrawLimits: storage.WithdrawLimits{
+			DailyCount:   serverConf.WithdrawDailyCountLimit,
+			DailySum:     model.MoneyFromFloat(serverConf.WithdrawDailySumLimit),
+			MonthlyCount: serverConf.WithdrawMonthlyCountLimit,
+			MonthlySum:   model.MoneyFromFloat(serverConf.WithdrawMonthlySumLimit),
+		},
+		LoyaltyTiers: loyaltyTiers,
+	})
 	if err != nil {
 		return err
 	}
 	defer storage.Close()
+	// Хранилище с операциями сервисного слоя для агента и обработчиков
+	svcStorage := newServiceStorage(storage)
+
+	balanceProjector := projector.NewBalanceProjector(storage)
+	if serverConf.ReplayBalances {
+		if err = balanceProjector.Replay(ctx); err != nil {
+			return err
+		}
+		logger.Log.Info("Balances replayed from events")
+	}
+	if serverConf.EventSourcedBalance {
+		balanceProjector.Start()
+	}
+
+	balanceSnapshotter := projector.NewBalanceSnapshotter(
+		storage, serverConf.BalanceSnapshotInterval, serverConf.BalanceEventsRetention,
+	)
+	if serverConf.BalanceSnapshotInterval > 0 {
+		balanceSnapshotter.Start()
+	}
+
+	webhookDispatcher := webhook.NewDispatcher(storage, webhook.DispatcherCfg{
+		PollInterval:         serverConf.WebhookPollInterval,
+		MaxAttempts:          serverConf.WebhookMaxAttempts,
+		AllowPrivateNetworks: serverConf.WebhookAllowPrivateNetworks,
+	})
+	webhookDispatcher.Start()
+
+	outboxPublishers := []outbox.Publisher{webhookDispatcher}
+	var brokerPublisher *broker.NATSPublisher
+	if serverConf.BrokerURL != "" {
+		brokerPublisher, err = broker.NewNATSPublisher(serverConf.BrokerURL, serverConf.BrokerTopic)
+		if err != nil {
+			return fmt.Errorf("failed to create broker publisher: %w", err)
+		}
+		outboxPublishers = append(outboxPublishers, brokerPublisher)
+	}
+	outboxRelay := outbox.NewRelay(storage, serverConf.OutboxPollInterval, outboxPublishers...)
+	outboxRelay.Start()
+
+	var faultInjector *faults.Injector
+	if serverConf.FaultInjection {
+		faultInjector = faults.NewInjector(faults.Config{
+			LatencyRate: serverConf.FaultLatencyRate,
+			Latency:     serverConf.FaultLatency,
+			ErrorRate:   serverConf.FaultErrorRate,
+		})
+		logger.Log.Warn("Fault injection is enabled")
+	}
+
+	userEvents := events.NewHub()
+
+	holdReleaser := projector.NewHoldReleaser(storage, userEvents, serverConf.HoldReleaseInterval)
+	if serverConf.HoldTTL > 0 {
+		holdReleaser.Start()
+	}
+
+	orderArchiver := projector.NewOrderArchiver(storage, serverConf.OrderArchiveAge, serverConf.OrderArchiveInterval)
+	if serverConf.OrderArchiveAge > 0 {
+		orderArchiver.Start()
+	}
+
+	var redisClient *redis.Client
+	if serverConf.RedisURL != "" {
+		redisOpts, err := redis.ParseURL(serverConf.RedisURL)
+		if err != nil {
+			return fmt.Errorf("failed to parse redis url: %w", err)
+		}
+		redisClient = redis.NewClient(redisOpts)
+		defer redisClient.Close()
+	}
+
+	var sharedRateLimit agent.RateLimitStore
+	if serverConf.AccrualSharedRateLimit {
+		sharedRateLimit = agent.NewRedisRateLimitStore(redisClient)
+	}
+
+	accrualAuth := agent.AccrualAuth{Header: serverConf.AccrualAPIKeyHeader, Key: serverConf.AccrualAPIKey}
+	accrualProviders, err := newAccrualProviders(
+		serverConf.AccrualProviders, faultInjector, accrualAuth,
+		serverConf.AccrualBatchPath, agent.BatchFormat(serverConf.AccrualBatchFormat),
+	)
+	if err != nil {
+		return err
+	}
+
+	accrualAgent := agent.NewAccrualAgent(svcStorage, agent.AccrualAgentCfg{
+		AccrualURL:             serverConf.AccrualAddress,
+		Providers:              accrualProviders,
+		Auth:                   accrualAuth,
+		DryRun:                 serverConf.AccrualDryRun,
+		NewPollInterval:        serverConf.AccrualNewPollInterval,
+		ProcessingPollInterval: serverConf.AccrualProcessingPollInterval,
+		ListenNewOrders:        listenNewOrders(serverConf.DSN, serverConf.AccrualListenNewOrders),
+		OrderMaxAge:            serverConf.AccrualOrderMaxAge,
+		InFlightTimeout:        serverConf.AccrualInFlightTimeout,
+		InstanceID:             serverConf.InstanceID,
+		WorkerCount:            serverConf.AccrualWorkerCount,
+		MaxWorkerCount:         serverConf.AccrualMaxWorkerCount,
+		ExpireCheckInterval:    serverConf.AccrualExpireCheckInterval,
+		StuckOrderAge:          serverConf.AccrualStuckOrderAge,
+		FetchAttempts:          serverConf.AccrualFetchAttempts,
+		FetchRetryBackoff:      serverConf.AccrualFetchRetryBackoff,
+		FetchMaxBackoff:        serverConf.AccrualFetchMaxBackoff,
+		MaxFetchFailures:       serverConf.AccrualMaxFetchFailures,
+		CircuitFailures:        serverConf.AccrualCircuitFailures,
+		CircuitCooldown:        serverConf.AccrualCircuitCooldown,
+		RequestTimeout:         serverConf.AccrualRequestTimeout,
+		DrainTimeout:           serverConf.AccrualDrainTimeout,
+		RequestRPS:             serverConf.AccrualRPS,
+		RequestBurst:           serverConf.AccrualBurst,
+		BatchPath:              serverConf.AccrualBatchPath,
+		BatchFormat:            agent.BatchFormat(serverConf.AccrualBatchFormat),
+		BatchSize:              serverConf.AccrualBatchSize,
+		SharedRateLimit:        sharedRateLimit,
+		Faults:                 faultInjector,
+		Events:                 userEvents,
+	})
+	if err = accrualAgent.RegisterMetrics(metrics.Registerer); err != nil {
+		return err
+	}
+	if serverConf.AccrualAgentEnabled {
+		accrualAgent.StartAgent()
+	}
+
+	var loadShedder *middleware.LoadShedder
+	if serverConf.LoadShedMaxInFlight > 0 || serverConf.LoadShedMaxP99 > 0 {
+		loadShedder = middleware.NewLoadShedder(middleware.LoadShedderCfg{
+			MaxInFlight: serverConf.LoadShedMaxInFlight,
+			MaxP99:      serverConf.LoadShedMaxP99,
+			RetryAfter:  serverConf.LoadShedRetryAfter,
+		})
+	}
+
+	var compressor *middleware.Compressor
+	if serverConf.GzipContentTypes != "" {
+		compressor, err = middleware.NewCompressor(middleware.CompressorCfg{
+			MinSize:      serverConf.GzipMinSize,
+			Level:        serverConf.GzipLevel,
+			ContentTypes: strings.Split(serverConf.GzipContentTypes, ","),
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	var requiredClasses []string
+	if serverConf.PasswordRequiredClasses != "" {
+		for _, class := range strings.Split(serverConf.PasswordRequiredClasses, ",") {
+			requiredClasses = append(requiredClasses, strings.TrimSpace(class))
+		}
+	}
+	passwordPolicy, err := passwordpolicy.New(passwordpolicy.Cfg{
+		MinLength:       serverConf.PasswordMinLength,
+		RequiredClasses: requiredClasses,
+		DenyCommon:      serverConf.PasswordDenyCommon,
+	})
+	if err != nil {
+		return err
+	}
+
+	userAuth := middleware.UserAuthCfg{
+		Revocations:   storage,
+		TokenVersions: storage,
+		SessionTTL:    serverConf.SessionTTL,
+	}
+	switch serverConf.SessionBackend {
+	case config.SessionBackendMemory:
+		userAuth.Sessions = session.NewMemoryStore()
+	case config.SessionBackendPostgres:
+		userAuth.Sessions = storage
+	case config.SessionBackendRedis:
+		userAuth.Sessions = session.NewRedisStore(redisClient)
+	}
+
+	var userMailer handlers.Mailer = mailer.NewLogMailer()
+	if serverConf.SMTPAddr != "" {
+		userMailer, err = mailer.NewSMTPMailer(mailer.SMTPCfg{
+			Addr:     serverConf.SMTPAddr,
+			From:     serverConf.SMTPFrom,
+			User:     serverConf.SMTPUser,
+			Password: serverConf.SMTPPassword,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	oauthCfg := handlers.OAuthCfg{SuccessURL: serverConf.OIDCSuccessURL, LinkByEmail: serverConf.OIDCLinkByEmail}
+	if serverConf.OIDCIssuer != "" {
+		oauthCfg.Provider, err = oidc.NewProvider(ctx, oidc.Cfg{
+			Issuer:       serverConf.OIDCIssuer,
+			ClientID:     serverConf.OIDCClientID,
+			ClientSecret: serverConf.OIDCClientSecret,
+			RedirectURL:  serverConf.OIDCRedirectURL,
+			Scopes:       strings.Split(serverConf.OIDCScopes, ","),
+			AllowHTTP:    serverConf.OIDCAllowHTTP,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	var privilegedIPs *middleware.IPAllowlist
+	if serverConf.PrivilegedAllowedCIDRs != "" {
+		privilegedIPs, err = middleware.NewIPAllowlist(middleware.IPAllowlistCfg{
+			Allowed:        strings.Split(serverConf.PrivilegedAllowedCIDRs, ","),
+			TrustedProxies: strings.Split(serverConf.TrustedProxies, ","),
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	suspiciousLogin := handlers.SuspiciousLoginCfg{
+		Enabled:             serverConf.SuspiciousLoginDetection,
+		RequireVerification: serverConf.SuspiciousLoginVerification,
+	}
+	if serverConf.SuspiciousLoginWebhookURL != "" {
+		suspiciousLogin.Notifier = loginalert.NewWebhook(serverConf.SuspiciousLoginWebhookURL)
+	}
+
+	// Лимит в фиксированном окне задается явно, иначе загрузка заказов ограничивается token bucket
+	orderLimiter := newUserLimiter(redisClient, "orders", serverConf.OrderRateLimit, serverConf.RateLimitWindow)
+	if orderLimiter == nil {
+		orderLimiter = newTokenBucketLimiter(
+			redisClient, "order-uploads", serverConf.OrderUploadRateLimitRPS, serverConf.OrderUploadRateLimitBurst,
+		)
+	}
 
-	accrualAgent := agent.NewAccrualAgent(storage, serverConf.AccrualAddress)
-	accrualAgent.StartAgent()
+	signedRequests := middleware.SignedRequestsCfg{Window: serverConf.ServiceSignatureWindow}
+	// Формат проверен при загрузке конфигурации
+	signedRequests.Keys, _ = middleware.ParseAPIKeys(serverConf.ServiceAPIKeys)
+	if redisClient != nil {
+		signedRequests.Nonces = nonce.NewRedisStore(redisClient)
+	} else {
+		signedRequests.Nonces = nonce.NewMemoryStore()
+	}
 
-	router := handlers.NewRouter(storage)
+	router := handlers.NewRouter(svcStorage, handlers.RouterCfg{
+		ServiceAuth: middleware.ServiceAuthCfg{
+			Token:  serverConf.ServiceToken,
+			JWTKey: serverConf.ServiceJWTKey,
+			Signed: signedRequests,
+		},
+		PrivilegedIPs:        privilegedIPs,
+		AuthLimiter:          newTokenBucketLimiter(redisClient, "auth", serverConf.AuthRateLimitRPS, serverConf.AuthRateLimitBurst),
+		OrderLimiter:         orderLimiter,
+		WithdrawLimiter:      newUserLimiter(redisClient, "withdrawals", serverConf.WithdrawRateLimit, serverConf.RateLimitWindow),
+		Faults:               faultInjector,
+		LoadShedder:          loadShedder,
+		UserAuth:             userAuth,
+		PasswordPolicy:       passwordPolicy,
+		CSRFProtection:       serverConf.CSRFProtection,
+		AuthAudit:            storage,
+		SuspiciousLogin:      suspiciousLogin,
+		MinWithdrawSum:       model.MoneyFromFloat(serverConf.MinWithdrawSum),
+		OrderMaxRetries:      serverConf.OrderMaxRetries,
+		WithdrawCancelWindow: serverConf.WithdrawCancelWindow,
+		HoldTTL:              serverConf.HoldTTL,
+		Currency: handlers.CurrencyCfg{
+			Code:        serverConf.Currency,
+			DefaultRate: serverConf.CurrencyRate,
+		},
+		LoyaltyTiers: loyaltyTiers,
+		StepUp: handlers.StepUpCfg{
+			WithdrawThreshold: model.MoneyFromFloat(serverConf.StepUpWithdrawThreshold),
+			TTL:               serverConf.StepUpTTL,
+		},
+		LoginLockout: handlers.LoginLockoutCfg{
+			MaxFailures: serverConf.LoginMaxFailures,
+			Duration:    serverConf.LoginLockoutDuration,
+		},
+		OAuth:                oauthCfg,
+		Mailer:               userMailer,
+		EmailVerificationURL: serverConf.EmailVerificationURL,
+		Compressor:           compressor,
+		Events:               userEvents,
+		Agent:                accrualAgent,
+		Metrics:              metrics.Handler(),
+	})
 	logger.Log.WithFields(logrus.Fields{
 		"addr":    serverConf.ServerAddress,
 		"log_lvl": serverConf.LogLevel,
@@ -94,6 +495,9 @@ func Run() error {
 		<-ctx.Done()
 		logger.Log.Info("Gracefully shutting down service...")
 
+		// Потоки событий не завершаются сами, закрываем их до остановки сервера
+		userEvents.Close()
+
 		shutdownTimeoutCtx, cancelShutdownTimeoutCtx := context.WithTimeout(context.Background(), timeoutServerShutdown)
 		defer cancelShutdownTimeoutCtx()
 		if err := srv.Shutdown(shutdownTimeoutCtx); err != nil {
@@ -101,8 +505,39 @@ func Run() error {
 		}
 		logger.Log.Info("HTTP server stopped")
 
-		accrualAgent.StopAgent()
-		logger.Log.Info("Accrual agent stopped")
+		if serverConf.AccrualAgentEnabled {
+			accrualAgent.StopAgent()
+			logger.Log.Info("Accrual agent stopped")
+		}
+
+		outboxRelay.Stop()
+		logger.Log.Info("Outbox relay stopped")
+		if brokerPublisher != nil {
+			brokerPublisher.Close()
+		}
+
+		webhookDispatcher.Stop()
+		logger.Log.Info("Webhook dispatcher stopped")
+
+		if serverConf.EventSourcedBalance {
+			balanceProjector.Stop()
+			logger.Log.Info("Balance projector stopped")
+		}
+
+		if serverConf.BalanceSnapshotInterval > 0 {
+			balanceSnapshotter.Stop()
+			logger.Log.Info("Balance snapshotter stopped")
+		}
+
+		if serverConf.HoldTTL > 0 {
+			holdReleaser.Stop()
+			logger.Log.Info("Hold releaser stopped")
+		}
+
+		if serverConf.OrderArchiveAge > 0 {
+			orderArchiver.Stop()
+			logger.Log.Info("Order archiver stopped")
+		}
 
 		storage.Close()
 		logger.Log.Info("Storage closed")
@@ -116,3 +551,34 @@ func Run() error {
 
 	return nil
 }
+
+// configureJWT задает ключи и сроки действия JWT пользователей из конфигурации
+func configureJWT(serverConf config.ServerConf) error {
+	jwtCfg := utils.JWTCfg{
+		TTL:        serverConf.JWTTTL,
+		RefreshTTL: serverConf.RefreshTokenTTL,
+	}
+	if serverConf.JWTPrivateKeyFile != "" {
+		pemData, err := os.ReadFile(serverConf.JWTPrivateKeyFile)
+		if err != nil {
+			return fmt.Errorf("failed to read jwt private key: %w", err)
+		}
+		key, err := utils.ParseJWTPrivateKey(serverConf.JWTPrivateKeyID, pemData)
+		if err != nil {
+			return err
+		}
+		// Асимметричный ключ подписывает новые токены, ключи HMAC остаются для проверки выпущенных ранее
+		jwtCfg.Keys = append(jwtCfg.Keys, key)
+	}
+	if serverConf.JWTKeys != "" {
+		keys, err := utils.ParseJWTKeys(serverConf.JWTKeys)
+		if err != nil {
+			return err
+		}
+		jwtCfg.Keys = append(jwtCfg.Keys, keys...)
+	} else if serverConf.JWTPrivateKeyFile == "" {
+		logger.Log.Warn("JWT keys are not configured, using insecure default key")
+		jwtCfg.Keys = []utils.JWTKey{utils.DefaultJWTKey()}
+	}
+	return utils.ConfigureJWT(jwtCfg)
+}
@@ -0,0 +1,21 @@
+package app
+
+import (
+	"errors"
+	"flag"
+
+	"github.com/pinbrain/gophermart/internal/config"
+	"github.com/pinbrain/gophermart/internal/storage"
+)
+
+// RunMigrate выполняет команду управления миграциями БД: gophermart migrate up|down|status|version
+func RunMigrate(args []string) error {
+	migrateConf, err := config.InitMigrateConfig(args)
+	if errors.Is(err, flag.ErrHelp) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return storage.Migrate(migrateConf.DSN, migrateConf.Command)
+}
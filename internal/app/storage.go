@@ -0,0 +1,31 @@
+package app
+
+import (
+	"github.com/pinbrain/gophermart/internal/logger"
+	"github.com/pinbrain/gophermart/internal/service"
+	"github.com/pinbrain/gophermart/internal/storage"
+)
+
+// serviceStorage дополняет хранилище операциями сервисного слоя, которые выполняют несколько
+// изменений хранилища в одной транзакции
+type serviceStorage struct {
+	*storage.DBStorage
+	*service.Orders
+}
+
+func newServiceStorage(st *storage.DBStorage) serviceStorage {
+	return serviceStorage{DBStorage: st, Orders: service.NewOrders(st)}
+}
+
+// listenNewOrders возвращает, подписываться ли агенту на уведомления о новых заказах. Уведомления
+// отправляет только PostgreSQL, с другими СУБД агент забирает новые заказы опросом.
+func listenNewOrders(dsn string, enabled bool) bool {
+	if !enabled {
+		return false
+	}
+	if driver, err := storage.DriverFromDSN(dsn); err == nil && driver != storage.DriverPostgres {
+		logger.Log.WithField("driver", driver).Info("New orders notifications are not supported, polling only")
+		return false
+	}
+	return true
+}
@@ -1,16 +1,29 @@
 package appctx
 
-import "context"
+import (
+	"context"
+	"time"
+)
 
 type ctxKey string
 
 type CtxUser struct {
 	ID    int
 	Login string
+	// Идентификатор серверной сессии, пустой при аутентификации по JWT
+	SessionID string
+	// До какого момента пользователь подтвердил вход повторным вводом пароля
+	ElevatedUntil time.Time
+}
+
+// Elevated сообщает, подтвердил ли пользователь вход повторным вводом пароля
+func (u *CtxUser) Elevated() bool {
+	return time.Now().Before(u.ElevatedUntil)
 }
 
 const (
-	userCtxKey ctxKey = "user"
+	userCtxKey         ctxKey = "user"
+	processingIDCtxKey ctxKey = "processingID"
 )
 
 func CtxWithUser(ctx context.Context, user *CtxUser) context.Context {
@@ -25,3 +38,14 @@ func GetCtxUser(ctx context.Context) *CtxUser {
 	}
 	return user
 }
+
+// CtxWithProcessingID добавляет в контекст идентификатор попытки обработки заказа агентом начислений
+func CtxWithProcessingID(ctx context.Context, processingID string) context.Context {
+	return context.WithValue(ctx, processingIDCtxKey, processingID)
+}
+
+// GetProcessingID возвращает идентификатор попытки обработки заказа, пустой, если его нет в контексте
+func GetProcessingID(ctx context.Context) string {
+	processingID, _ := ctx.Value(processingIDCtxKey).(string)
+	return processingID
+}
@@ -0,0 +1,191 @@
+package broker
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pinbrain/gophermart/internal/model"
+)
+
+const (
+	defaultNATSPort = "4222"
+	// Таймаут подключения и подтверждения публикации, если в контексте нет своего
+	natsTimeout = 10 * time.Second
+)
+
+var ErrInvalidNATSURL = errors.New("invalid nats url, expected nats://[user:password@]host[:port]")
+
+// ParseNATSURL проверяет адрес NATS и дополняет его портом по умолчанию
+func ParseNATSURL(rawURL string) (*url.URL, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Scheme != "nats" || u.Hostname() == "" {
+		return nil, ErrInvalidNATSURL
+	}
+	if u.Port() == "" {
+		u.Host = net.JoinHostPort(u.Hostname(), defaultNATSPort)
+	}
+	return u, nil
+}
+
+// IsValidSubject проверяет, что тема состоит из непустых частей, разделенных точками,
+// и не содержит пробелов и символов подстановки
+func IsValidSubject(subject string) bool {
+	if subject == "" || strings.ContainsAny(subject, " \t\r\n*>") {
+		return false
+	}
+	for _, token := range strings.Split(subject, ".") {
+		if token == "" {
+			return false
+		}
+	}
+	return true
+}
+
+// NATSPublisher публикует события outbox в NATS в тему "<topic>.<тип события>". Публикация
+// считается выполненной после подтверждения сервером (PONG на PING после сообщения), поэтому
+// при сбое событие публикуется повторно. Получатели отбрасывают повторы по ID сообщения.
+type NATSPublisher struct {
+	url   *url.URL
+	topic string
+
+	mu     sync.Mutex
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func NewNATSPublisher(rawURL, topic string) (*NATSPublisher, error) {
+	u, err := ParseNATSURL(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if !IsValidSubject(topic) {
+		return nil, fmt.Errorf("invalid nats topic %q", topic)
+	}
+	return &NATSPublisher{url: u, topic: topic}, nil
+}
+
+// Publish отправляет событие в NATS. При ошибке соединение закрывается и устанавливается заново
+// при следующей публикации.
+func (p *NATSPublisher) Publish(ctx context.Context, event model.OutboxEvent) error {
+	body, err := json.Marshal(model.BrokerMessage{
+		ID:        event.ID,
+		Event:     event.Event,
+		UserID:    event.UserID,
+		CreatedAt: event.CreatedAt,
+		Data:      event.Payload,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to encode broker message: %w", err)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err = p.publish(ctx, p.topic+"."+string(event.Event), body); err != nil {
+		p.closeConn()
+		return err
+	}
+	return nil
+}
+
+func (p *NATSPublisher) publish(ctx context.Context, subject string, body []byte) error {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(natsTimeout)
+	}
+	if p.conn == nil {
+		if err := p.connect(ctx, deadline); err != nil {
+			return err
+		}
+	}
+	if err := p.conn.SetDeadline(deadline); err != nil {
+		return fmt.Errorf("failed to set nats deadline: %w", err)
+	}
+	msg := fmt.Sprintf("PUB %s %d\r\n%s\r\nPING\r\n", subject, len(body), body)
+	if _, err := p.conn.Write([]byte(msg)); err != nil {
+		return fmt.Errorf("failed to publish to nats: %w", err)
+	}
+	return p.waitPong()
+}
+
+// connect подключается к серверу и отправляет параметры соединения. Ответ PONG на PING после
+// CONNECT подтверждает, что сервер принял параметры, в том числе логин и пароль.
+func (p *NATSPublisher) connect(ctx context.Context, deadline time.Time) error {
+	dialer := net.Dialer{Deadline: deadline}
+	conn, err := dialer.DialContext(ctx, "tcp", p.url.Host)
+	if err != nil {
+		return fmt.Errorf("failed to connect to nats: %w", err)
+	}
+	p.conn = conn
+	p.reader = bufio.NewReader(conn)
+	if err = conn.SetDeadline(deadline); err != nil {
+		return fmt.Errorf("failed to set nats deadline: %w", err)
+	}
+
+	line, err := p.reader.ReadString('\n')
+	if err != nil {
+		return fmt.Errorf("failed to read nats server info: %w", err)
+	}
+	if !strings.HasPrefix(line, "INFO ") {
+		return fmt.Errorf("unexpected nats server greeting: %q", strings.TrimSpace(line))
+	}
+
+	options := map[string]any{"verbose": false, "pedantic": false, "name": "gophermart", "lang": "go"}
+	if p.url.User != nil {
+		options["user"] = p.url.User.Username()
+		if password, ok := p.url.User.Password(); ok {
+			options["pass"] = password
+		}
+	}
+	connect, err := json.Marshal(options)
+	if err != nil {
+		return fmt.Errorf("failed to encode nats connect options: %w", err)
+	}
+	if _, err = conn.Write([]byte("CONNECT " + string(connect) + "\r\nPING\r\n")); err != nil {
+		return fmt.Errorf("failed to send nats connect: %w", err)
+	}
+	return p.waitPong()
+}
+
+// waitPong читает ответы сервера до PONG. На PING сервера отвечает PONG, ошибку сервера возвращает.
+func (p *NATSPublisher) waitPong() error {
+	for {
+		line, err := p.reader.ReadString('\n')
+		if err != nil {
+			return fmt.Errorf("failed to read nats response: %w", err)
+		}
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "PONG":
+			return nil
+		case line == "PING":
+			if _, err = p.conn.Write([]byte("PONG\r\n")); err != nil {
+				return fmt.Errorf("failed to reply to nats ping: %w", err)
+			}
+		case strings.HasPrefix(line, "-ERR"):
+			return fmt.Errorf("nats server error: %s", strings.TrimSpace(strings.TrimPrefix(line, "-ERR")))
+		}
+	}
+}
+
+func (p *NATSPublisher) closeConn() {
+	if p.conn != nil {
+		p.conn.Close()
+		p.conn = nil
+		p.reader = nil
+	}
+}
+
+// Close закрывает соединение с NATS
+func (p *NATSPublisher) Close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closeConn()
+}
@@ -0,0 +1,135 @@
+package config
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/caarlos0/env/v11"
+	"github.com/joho/godotenv"
+	"github.com/pinbrain/gophermart/internal/agent"
+	"github.com/pinbrain/gophermart/internal/instance"
+)
+
+// AgentConf - конфигурация отдельно запускаемого агента расчета начислений. Имена переменных
+// окружения и флагов совпадают с ServerConf, чтобы сервис и агент можно было запускать с общим .env.
+type AgentConf struct {
+	AccrualAddress string `env:"ACCRUAL_SYSTEM_ADDRESS"`
+	DSN            string `env:"DATABASE_URI"`
+	ReadDSN        string `env:"DATABASE_READ_URI"`
+	DBAutoMigrate  bool   `env:"DB_AUTO_MIGRATE"`
+	DBPool         DBPoolConf
+	LogLevel       string `env:"LOG_LEVEL"`
+	InstanceID     string `env:"INSTANCE_ID"`
+	// Адрес HTTP-сервера с метриками агента, пустой - метрики не отдаются
+	MetricsAddress string `env:"AGENT_METRICS_ADDRESS"`
+	// Дополнительные системы начислений в формате префикс1=адрес1,префикс2=адрес2
+	AccrualProviders string `env:"ACCRUAL_PROVIDERS"`
+	// Ключ API запросов в систему начислений и заголовок, в котором он передается
+	AccrualAPIKey       string `env:"ACCRUAL_API_KEY"`
+	AccrualAPIKeyHeader string `env:"ACCRUAL_API_KEY_HEADER"`
+	// Режим проверки системы начислений без изменения заказов
+	AccrualDryRun bool `env:"ACCRUAL_DRY_RUN"`
+
+	AccrualWorkerCount            int           `env:"ACCRUAL_WORKER_COUNT"`
+	AccrualNewPollInterval        time.Duration `env:"ACCRUAL_NEW_POLL_INTERVAL"`
+	AccrualProcessingPollInterval time.Duration `env:"ACCRUAL_PROCESSING_POLL_INTERVAL"`
+	AccrualListenNewOrders        bool          `env:"ACCRUAL_LISTEN_NEW_ORDERS"`
+	AccrualOrderMaxAge            time.Duration `env:"ACCRUAL_ORDER_MAX_AGE"`
+	AccrualMaxFetchFailures       int           `env:"ACCRUAL_MAX_FETCH_FAILURES"`
+}
+
+func validateAgentConf(cfg AgentConf) error {
+	invalidParams := []string{}
+
+	if cfg.AccrualAddress == "" {
+		invalidParams = append(invalidParams, "accrual address")
+	} else {
+		if err := validateBaseURL(cfg.AccrualAddress); err != nil {
+			invalidParams = append(invalidParams, "accrual address")
+		}
+	}
+	if cfg.DSN == "" {
+		invalidParams = append(invalidParams, "database uri")
+	}
+	invalidParams = append(invalidParams, validateDBPoolConf(cfg.DBPool)...)
+	if cfg.AccrualAPIKey != "" && !isValidHeaderName(cfg.AccrualAPIKeyHeader) {
+		invalidParams = append(invalidParams, "accrual api key header")
+	}
+	if addresses, err := agent.ParseProviderAddresses(cfg.AccrualProviders); err != nil {
+		invalidParams = append(invalidParams, "accrual providers")
+	} else {
+		for _, address := range addresses {
+			if err := validateBaseURL(address); err != nil {
+				invalidParams = append(invalidParams, "accrual providers")
+				break
+			}
+		}
+	}
+	if cfg.AccrualWorkerCount < 1 {
+		invalidParams = append(invalidParams, "accrual worker count")
+	}
+	if cfg.AccrualNewPollInterval <= 0 {
+		invalidParams = append(invalidParams, "accrual new poll interval")
+	}
+	if cfg.AccrualProcessingPollInterval <= 0 {
+		invalidParams = append(invalidParams, "accrual processing poll interval")
+	}
+	if cfg.AccrualOrderMaxAge < 0 {
+		invalidParams = append(invalidParams, "accrual order max age")
+	}
+	if cfg.AccrualMaxFetchFailures < 0 {
+		invalidParams = append(invalidParams, "accrual max fetch failures")
+	}
+
+	if len(invalidParams) > 0 {
+		return fmt.Errorf("invalid config params: %s", strings.Join(invalidParams, "; "))
+	}
+	return nil
+}
+
+func loadAgentFlags(cfg *AgentConf) {
+	flag.StringVar(&cfg.LogLevel, "l", "info", "Уровень логирования")
+	flag.StringVar(&cfg.InstanceID, "instance-id", "", "Идентификатор экземпляра агента (по умолчанию <hostname>-<случайный суффикс>)")
+	flag.StringVar(&cfg.DSN, "d", "", "Строка с адресом подключения к БД: postgres://..., mysql://... или sqlite://путь_к_файлу")
+	flag.StringVar(&cfg.ReadDSN, "read-database-uri", "", "Строка с адресом подключения к реплике БД для запросов на чтение (PostgreSQL или MySQL)")
+	flag.BoolVar(&cfg.DBAutoMigrate, "db-auto-migrate", true, "Применять новые миграции БД при запуске (false - схемой управляет команда gophermart migrate)")
+	loadDBPoolFlags(&cfg.DBPool)
+	flag.StringVar(&cfg.AccrualAddress, "r", "", "Адрес системы расчёта начислений")
+	flag.StringVar(&cfg.AccrualProviders, "accrual-providers", "", "Дополнительные системы начислений, выбираемые по префиксу номера заказа, в формате префикс1=адрес1,префикс2=адрес2")
+	flag.StringVar(&cfg.AccrualAPIKey, "accrual-api-key", "", "Ключ API или токен запросов в систему начислений (пустой - запросы без учетных данных)")
+	flag.StringVar(&cfg.AccrualAPIKeyHeader, "accrual-api-key-header", "Authorization", "Заголовок с ключом API системы начислений; в Authorization ключ передается как Bearer-токен")
+	flag.BoolVar(&cfg.AccrualDryRun, "accrual-dry-run", false, "Режим проверки: агент запрашивает статусы заказов и пишет в лог изменения, не меняя заказы в БД")
+	flag.StringVar(&cfg.MetricsAddress, "metrics-address", "", "Адрес HTTP-сервера с метриками агента (пустой - метрики не отдаются)")
+	flag.IntVar(&cfg.AccrualWorkerCount, "accrual-worker-count", 5, "Количество воркеров агента, параллельно отправляющих запросы в систему начислений")
+	flag.DurationVar(&cfg.AccrualNewPollInterval, "accrual-new-poll-interval", time.Second, "Интервал опроса системы начислений по новым заказам")
+	flag.DurationVar(&cfg.AccrualProcessingPollInterval, "accrual-processing-poll-interval", 10*time.Second, "Интервал опроса системы начислений по заказам в обработке")
+	flag.BoolVar(&cfg.AccrualListenNewOrders, "accrual-listen-new-orders", true, "Отправлять новые заказы в систему начислений сразу по уведомлению из БД (LISTEN/NOTIFY)")
+	flag.DurationVar(&cfg.AccrualOrderMaxAge, "accrual-order-max-age", 0, "Возраст необработанного заказа, после которого он помечается как INVALID (0 - без ограничения)")
+	flag.IntVar(&cfg.AccrualMaxFetchFailures, "accrual-max-fetch-failures", 10, "Количество опросов подряд без ответа системы начислений по заказу, после которого заказ переводится в STALLED (0 - без ограничения)")
+	flag.Parse()
+}
+
+// InitAgentConfig загружает конфигурацию агента из флагов, файла .env и переменных окружения
+func InitAgentConfig() (AgentConf, error) {
+	agentConf := AgentConf{}
+
+	loadAgentFlags(&agentConf)
+	if err := godotenv.Load(); err != nil {
+		fmt.Println("Env file not found")
+	}
+	if err := env.Parse(&agentConf); err != nil {
+		return agentConf, err
+	}
+
+	if agentConf.InstanceID == "" {
+		agentConf.InstanceID = instance.NewID()
+	}
+
+	if err := validateAgentConf(agentConf); err != nil {
+		return agentConf, err
+	}
+
+	return agentConf, nil
+}
@@ -1,20 +1,188 @@
 package config
 
 import (
+	"compress/gzip"
 	"flag"
 	"fmt"
+	"net/http"
 	"net/url"
 	"strings"
+	"time"
 
 	"github.com/caarlos0/env/v11"
 	"github.com/joho/godotenv"
+	"github.com/pinbrain/gophermart/internal/agent"
+	"github.com/pinbrain/gophermart/internal/broker"
+	"github.com/pinbrain/gophermart/internal/instance"
+	"github.com/pinbrain/gophermart/internal/middleware"
+	"github.com/pinbrain/gophermart/internal/utils"
+)
+
+// Хранилища серверных сессий
+const (
+	SessionBackendNone     = ""
+	SessionBackendMemory   = "memory"
+	SessionBackendPostgres = "postgres"
+	SessionBackendRedis    = "redis"
 )
 
 type ServerConf struct {
 	ServerAddress  string `env:"RUN_ADDRESS"`
 	AccrualAddress string `env:"ACCRUAL_SYSTEM_ADDRESS"`
 	DSN            string `env:"DATABASE_URI"`
+	ReadDSN        string `env:"DATABASE_READ_URI"`
+	DBAutoMigrate  bool   `env:"DB_AUTO_MIGRATE"`
 	LogLevel       string `env:"LOG_LEVEL"`
+	InstanceID     string `env:"INSTANCE_ID"`
+	ServiceToken   string `env:"SERVICE_TOKEN"`
+	ServiceJWTKey  string `env:"SERVICE_JWT_KEY"`
+	// Ключи API для подписанных запросов к внутреннему API в формате id1:secret1,id2:secret2
+	ServiceAPIKeys         string        `env:"SERVICE_API_KEYS"`
+	ServiceSignatureWindow time.Duration `env:"SERVICE_SIGNATURE_WINDOW"`
+
+	DBPool DBPoolConf
+
+	PrivilegedAllowedCIDRs string `env:"PRIVILEGED_ALLOWED_CIDRS"`
+	TrustedProxies         string `env:"TRUSTED_PROXIES"`
+
+	JWTKeys           string        `env:"JWT_KEYS"`
+	JWTPrivateKeyFile string        `env:"JWT_PRIVATE_KEY_FILE"`
+	JWTPrivateKeyID   string        `env:"JWT_PRIVATE_KEY_ID"`
+	JWTTTL            time.Duration `env:"JWT_TTL"`
+	RefreshTokenTTL   time.Duration `env:"REFRESH_TOKEN_TTL"`
+
+	PasswordHashAlgorithm string `env:"PASSWORD_HASH_ALGORITHM"`
+
+	CookieSecure   bool          `env:"COOKIE_SECURE"`
+	CookieSameSite string        `env:"COOKIE_SAMESITE"`
+	CookieDomain   string        `env:"COOKIE_DOMAIN"`
+	CookieMaxAge   time.Duration `env:"COOKIE_MAX_AGE"`
+	CSRFProtection bool          `env:"CSRF_PROTECTION"`
+
+	SessionBackend string        `env:"SESSION_BACKEND"`
+	SessionTTL     time.Duration `env:"SESSION_TTL"`
+
+	PasswordMinLength       int    `env:"PASSWORD_MIN_LENGTH"`
+	PasswordRequiredClasses string `env:"PASSWORD_REQUIRED_CLASSES"`
+	PasswordDenyCommon      bool   `env:"PASSWORD_DENY_COMMON"`
+
+	SMTPAddr             string `env:"SMTP_ADDR"`
+	SMTPFrom             string `env:"SMTP_FROM"`
+	SMTPUser             string `env:"SMTP_USER"`
+	SMTPPassword         string `env:"SMTP_PASSWORD"`
+	EmailVerificationURL string `env:"EMAIL_VERIFICATION_URL"`
+
+	OIDCIssuer       string `env:"OIDC_ISSUER"`
+	OIDCClientID     string `env:"OIDC_CLIENT_ID"`
+	OIDCClientSecret string `env:"OIDC_CLIENT_SECRET"`
+	OIDCRedirectURL  string `env:"OIDC_REDIRECT_URL"`
+	OIDCScopes       string `env:"OIDC_SCOPES"`
+	OIDCSuccessURL   string `env:"OIDC_SUCCESS_URL"`
+	// Разрешить провайдера по http, только для разработки
+	OIDCAllowHTTP bool `env:"OIDC_ALLOW_HTTP"`
+	// Привязывать учетную запись провайдера к пользователю с тем же подтвержденным email
+	OIDCLinkByEmail bool `env:"OIDC_LINK_BY_EMAIL"`
+
+	StepUpWithdrawThreshold float64       `env:"STEP_UP_WITHDRAW_THRESHOLD"`
+	StepUpTTL               time.Duration `env:"STEP_UP_TTL"`
+
+	MinWithdrawSum       float64       `env:"MIN_WITHDRAW_SUM"`
+	WithdrawCancelWindow time.Duration `env:"WITHDRAW_CANCEL_WINDOW"`
+
+	HoldTTL             time.Duration `env:"HOLD_TTL"`
+	HoldReleaseInterval time.Duration `env:"HOLD_RELEASE_INTERVAL"`
+
+	OrderMaxRetries int `env:"ORDER_MAX_RETRIES"`
+
+	OrderArchiveAge      time.Duration `env:"ORDER_ARCHIVE_AGE"`
+	OrderArchiveInterval time.Duration `env:"ORDER_ARCHIVE_INTERVAL"`
+
+	WithdrawDailyCountLimit   int     `env:"WITHDRAW_DAILY_COUNT_LIMIT"`
+	WithdrawDailySumLimit     float64 `env:"WITHDRAW_DAILY_SUM_LIMIT"`
+	WithdrawMonthlyCountLimit int     `env:"WITHDRAW_MONTHLY_COUNT_LIMIT"`
+	WithdrawMonthlySumLimit   float64 `env:"WITHDRAW_MONTHLY_SUM_LIMIT"`
+
+	Currency     string  `env:"CURRENCY"`
+	CurrencyRate float64 `env:"CURRENCY_RATE"`
+
+	LoyaltyTiers            bool    `env:"LOYALTY_TIERS"`
+	LoyaltySilverThreshold  float64 `env:"LOYALTY_SILVER_THRESHOLD"`
+	LoyaltyGoldThreshold    float64 `env:"LOYALTY_GOLD_THRESHOLD"`
+	LoyaltySilverMultiplier float64 `env:"LOYALTY_SILVER_MULTIPLIER"`
+	LoyaltyGoldMultiplier   float64 `env:"LOYALTY_GOLD_MULTIPLIER"`
+
+	SuspiciousLoginDetection    bool   `env:"SUSPICIOUS_LOGIN_DETECTION"`
+	SuspiciousLoginWebhookURL   string `env:"SUSPICIOUS_LOGIN_WEBHOOK_URL"`
+	SuspiciousLoginVerification bool   `env:"SUSPICIOUS_LOGIN_VERIFICATION"`
+
+	LoginMaxFailures     int           `env:"LOGIN_MAX_FAILURES"`
+	LoginLockoutDuration time.Duration `env:"LOGIN_LOCKOUT_DURATION"`
+
+	AccrualNewPollInterval        time.Duration `env:"ACCRUAL_NEW_POLL_INTERVAL"`
+	AccrualProcessingPollInterval time.Duration `env:"ACCRUAL_PROCESSING_POLL_INTERVAL"`
+	AccrualListenNewOrders        bool          `env:"ACCRUAL_LISTEN_NEW_ORDERS"`
+	AccrualOrderMaxAge            time.Duration `env:"ACCRUAL_ORDER_MAX_AGE"`
+	AccrualInFlightTimeout        time.Duration `env:"ACCRUAL_IN_FLIGHT_TIMEOUT"`
+	AccrualWorkerCount            int           `env:"ACCRUAL_WORKER_COUNT"`
+	AccrualMaxWorkerCount         int           `env:"ACCRUAL_MAX_WORKER_COUNT"`
+	AccrualExpireCheckInterval    time.Duration `env:"ACCRUAL_EXPIRE_CHECK_INTERVAL"`
+	AccrualStuckOrderAge          time.Duration `env:"ACCRUAL_STUCK_ORDER_AGE"`
+	AccrualFetchAttempts          int           `env:"ACCRUAL_FETCH_ATTEMPTS"`
+	AccrualFetchRetryBackoff      time.Duration `env:"ACCRUAL_FETCH_RETRY_BACKOFF"`
+	AccrualFetchMaxBackoff        time.Duration `env:"ACCRUAL_FETCH_MAX_BACKOFF"`
+	AccrualMaxFetchFailures       int           `env:"ACCRUAL_MAX_FETCH_FAILURES"`
+	AccrualCircuitFailures        int           `env:"ACCRUAL_CIRCUIT_FAILURES"`
+	AccrualCircuitCooldown        time.Duration `env:"ACCRUAL_CIRCUIT_COOLDOWN"`
+	AccrualRequestTimeout         time.Duration `env:"ACCRUAL_REQUEST_TIMEOUT"`
+	AccrualDrainTimeout           time.Duration `env:"ACCRUAL_DRAIN_TIMEOUT"`
+	AccrualRPS                    float64       `env:"ACCRUAL_RPS"`
+	AccrualBurst                  int           `env:"ACCRUAL_BURST"`
+	AccrualBatchPath              string        `env:"ACCRUAL_BATCH_PATH"`
+	AccrualSharedRateLimit        bool          `env:"ACCRUAL_SHARED_RATE_LIMIT"`
+	AccrualProviders              string        `env:"ACCRUAL_PROVIDERS"`
+	AccrualAPIKey                 string        `env:"ACCRUAL_API_KEY"`
+	AccrualAPIKeyHeader           string        `env:"ACCRUAL_API_KEY_HEADER"`
+	AccrualDryRun                 bool          `env:"ACCRUAL_DRY_RUN"`
+	AccrualAgentEnabled           bool          `env:"ACCRUAL_AGENT_ENABLED"`
+	AccrualBatchFormat            string        `env:"ACCRUAL_BATCH_FORMAT"`
+	AccrualBatchSize              int           `env:"ACCRUAL_BATCH_SIZE"`
+
+	EventSourcedBalance bool `env:"EVENT_SOURCED_BALANCE"`
+	ReplayBalances      bool `env:"REPLAY_BALANCES"`
+
+	BalanceSnapshotInterval time.Duration `env:"BALANCE_SNAPSHOT_INTERVAL"`
+	BalanceEventsRetention  time.Duration `env:"BALANCE_EVENTS_RETENTION"`
+
+	WebhookPollInterval         time.Duration `env:"WEBHOOK_POLL_INTERVAL"`
+	WebhookMaxAttempts          int           `env:"WEBHOOK_MAX_ATTEMPTS"`
+	WebhookAllowPrivateNetworks bool          `env:"WEBHOOK_ALLOW_PRIVATE_NETWORKS"`
+
+	OutboxPollInterval time.Duration `env:"OUTBOX_POLL_INTERVAL"`
+	BrokerURL          string        `env:"BROKER_URL"`
+	BrokerTopic        string        `env:"BROKER_TOPIC"`
+
+	RedisURL          string        `env:"REDIS_URL"`
+	OrderRateLimit    int           `env:"ORDER_RATE_LIMIT"`
+	WithdrawRateLimit int           `env:"WITHDRAW_RATE_LIMIT"`
+	RateLimitWindow   time.Duration `env:"RATE_LIMIT_WINDOW"`
+	// Ограничения token bucket: средняя частота запросов в секунду и допустимый всплеск
+	AuthRateLimitRPS          float64 `env:"AUTH_RATE_LIMIT_RPS"`
+	AuthRateLimitBurst        int     `env:"AUTH_RATE_LIMIT_BURST"`
+	OrderUploadRateLimitRPS   float64 `env:"ORDER_UPLOAD_RATE_LIMIT_RPS"`
+	OrderUploadRateLimitBurst int     `env:"ORDER_UPLOAD_RATE_LIMIT_BURST"`
+
+	FaultInjection   bool          `env:"FAULT_INJECTION"`
+	FaultLatencyRate float64       `env:"FAULT_LATENCY_RATE"`
+	FaultLatency     time.Duration `env:"FAULT_LATENCY"`
+	FaultErrorRate   float64       `env:"FAULT_ERROR_RATE"`
+
+	LoadShedMaxInFlight int64         `env:"LOAD_SHED_MAX_IN_FLIGHT"`
+	LoadShedMaxP99      time.Duration `env:"LOAD_SHED_MAX_P99"`
+	LoadShedRetryAfter  time.Duration `env:"LOAD_SHED_RETRY_AFTER"`
+
+	GzipMinSize      int    `env:"GZIP_MIN_SIZE"`
+	GzipLevel        int    `env:"GZIP_LEVEL"`
+	GzipContentTypes string `env:"GZIP_CONTENT_TYPES"`
 }
 
 func validateConf(cfg ServerConf) error {
@@ -30,6 +198,260 @@ func validateConf(cfg ServerConf) error {
 	if cfg.DSN == "" {
 		invalidParams = append(invalidParams, "database uri")
 	}
+	invalidParams = append(invalidParams, validateDBPoolConf(cfg.DBPool)...)
+	if cfg.AccrualAPIKey != "" && !isValidHeaderName(cfg.AccrualAPIKeyHeader) {
+		invalidParams = append(invalidParams, "accrual api key header")
+	}
+	if addresses, err := agent.ParseProviderAddresses(cfg.AccrualProviders); err != nil {
+		invalidParams = append(invalidParams, "accrual providers")
+	} else {
+		for _, address := range addresses {
+			if err := validateBaseURL(address); err != nil {
+				invalidParams = append(invalidParams, "accrual providers")
+				break
+			}
+		}
+	}
+	if _, err := middleware.ParsePrefixes(strings.Split(cfg.PrivilegedAllowedCIDRs, ",")); err != nil {
+		invalidParams = append(invalidParams, "privileged allowed cidrs")
+	}
+	if _, err := middleware.ParsePrefixes(strings.Split(cfg.TrustedProxies, ",")); err != nil {
+		invalidParams = append(invalidParams, "trusted proxies")
+	}
+	if _, err := middleware.ParseAPIKeys(cfg.ServiceAPIKeys); err != nil {
+		invalidParams = append(invalidParams, "service api keys")
+	}
+	if cfg.ServiceSignatureWindow <= 0 {
+		invalidParams = append(invalidParams, "service signature window")
+	}
+	if cfg.JWTKeys != "" {
+		if _, err := utils.ParseJWTKeys(cfg.JWTKeys); err != nil {
+			invalidParams = append(invalidParams, "jwt keys")
+		}
+	}
+	if cfg.JWTPrivateKeyFile != "" && cfg.JWTPrivateKeyID == "" {
+		invalidParams = append(invalidParams, "jwt private key id")
+	}
+	if cfg.JWTTTL <= 0 {
+		invalidParams = append(invalidParams, "jwt ttl")
+	}
+	if cfg.RefreshTokenTTL <= 0 {
+		invalidParams = append(invalidParams, "refresh token ttl")
+	}
+	if cfg.PasswordHashAlgorithm != utils.PasswordHashBcrypt && cfg.PasswordHashAlgorithm != utils.PasswordHashArgon2id {
+		invalidParams = append(invalidParams, "password hash algorithm")
+	}
+	if sameSite, err := middleware.ParseSameSite(cfg.CookieSameSite); err != nil {
+		invalidParams = append(invalidParams, "cookie samesite")
+	} else if sameSite == http.SameSiteNoneMode && !cfg.CookieSecure {
+		invalidParams = append(invalidParams, "cookie samesite (none requires secure cookies)")
+	}
+	if cfg.CookieMaxAge < 0 {
+		invalidParams = append(invalidParams, "cookie max age")
+	}
+	switch cfg.SessionBackend {
+	case SessionBackendNone, SessionBackendMemory, SessionBackendPostgres:
+	case SessionBackendRedis:
+		if cfg.RedisURL == "" {
+			invalidParams = append(invalidParams, "session backend (redis url is not set)")
+		}
+	default:
+		invalidParams = append(invalidParams, "session backend")
+	}
+	if cfg.SessionTTL <= 0 {
+		invalidParams = append(invalidParams, "session ttl")
+	}
+	if cfg.PasswordMinLength < 0 {
+		invalidParams = append(invalidParams, "password min length")
+	}
+	if cfg.SMTPAddr != "" && cfg.SMTPFrom == "" {
+		invalidParams = append(invalidParams, "smtp from")
+	}
+	if cfg.EmailVerificationURL != "" {
+		if err := validateBaseURL(cfg.EmailVerificationURL); err != nil {
+			invalidParams = append(invalidParams, "email verification url")
+		}
+	}
+	if cfg.OIDCIssuer != "" {
+		if err := validateBaseURL(cfg.OIDCIssuer); err != nil ||
+			(!strings.HasPrefix(cfg.OIDCIssuer, "https://") && !cfg.OIDCAllowHTTP) {
+			invalidParams = append(invalidParams, "oidc issuer")
+		}
+		if cfg.OIDCClientID == "" {
+			invalidParams = append(invalidParams, "oidc client id")
+		}
+		if err := validateBaseURL(cfg.OIDCRedirectURL); err != nil {
+			invalidParams = append(invalidParams, "oidc redirect url")
+		}
+	}
+	if cfg.StepUpWithdrawThreshold < 0 {
+		invalidParams = append(invalidParams, "step-up withdraw threshold")
+	}
+	if cfg.StepUpWithdrawThreshold > 0 && cfg.StepUpTTL <= 0 {
+		invalidParams = append(invalidParams, "step-up ttl")
+	}
+	if cfg.MinWithdrawSum < 0 {
+		invalidParams = append(invalidParams, "min withdraw sum")
+	}
+	if cfg.WithdrawCancelWindow < 0 {
+		invalidParams = append(invalidParams, "withdraw cancel window")
+	}
+	if cfg.HoldTTL < 0 {
+		invalidParams = append(invalidParams, "hold ttl")
+	}
+	if cfg.HoldTTL > 0 && cfg.HoldReleaseInterval <= 0 {
+		invalidParams = append(invalidParams, "hold release interval")
+	}
+	if cfg.OrderMaxRetries < 0 {
+		invalidParams = append(invalidParams, "order max retries")
+	}
+	if cfg.OrderArchiveAge < 0 {
+		invalidParams = append(invalidParams, "order archive age")
+	}
+	if cfg.OrderArchiveAge > 0 && cfg.OrderArchiveInterval <= 0 {
+		invalidParams = append(invalidParams, "order archive interval")
+	}
+	if cfg.WithdrawDailyCountLimit < 0 {
+		invalidParams = append(invalidParams, "withdraw daily count limit")
+	}
+	if cfg.WithdrawDailySumLimit < 0 {
+		invalidParams = append(invalidParams, "withdraw daily sum limit")
+	}
+	if cfg.WithdrawMonthlyCountLimit < 0 {
+		invalidParams = append(invalidParams, "withdraw monthly count limit")
+	}
+	if cfg.WithdrawMonthlySumLimit < 0 {
+		invalidParams = append(invalidParams, "withdraw monthly sum limit")
+	}
+	if cfg.Currency != "" && (len(cfg.Currency) != 3 || strings.ToUpper(cfg.Currency) != cfg.Currency) {
+		invalidParams = append(invalidParams, "currency")
+	}
+	if cfg.CurrencyRate <= 0 {
+		invalidParams = append(invalidParams, "currency rate")
+	}
+	if cfg.LoyaltyTiers {
+		if cfg.LoyaltySilverThreshold <= 0 {
+			invalidParams = append(invalidParams, "loyalty silver threshold")
+		}
+		if cfg.LoyaltyGoldThreshold <= cfg.LoyaltySilverThreshold {
+			invalidParams = append(invalidParams, "loyalty gold threshold")
+		}
+		if cfg.LoyaltySilverMultiplier < 1 {
+			invalidParams = append(invalidParams, "loyalty silver multiplier")
+		}
+		if cfg.LoyaltyGoldMultiplier < cfg.LoyaltySilverMultiplier {
+			invalidParams = append(invalidParams, "loyalty gold multiplier")
+		}
+	}
+	if cfg.SuspiciousLoginWebhookURL != "" {
+		if err := validateBaseURL(cfg.SuspiciousLoginWebhookURL); err != nil {
+			invalidParams = append(invalidParams, "suspicious login webhook url")
+		}
+	}
+	if cfg.LoginMaxFailures < 0 {
+		invalidParams = append(invalidParams, "login max failures")
+	}
+	if cfg.LoginMaxFailures > 0 && cfg.LoginLockoutDuration <= 0 {
+		invalidParams = append(invalidParams, "login lockout duration")
+	}
+	if cfg.AccrualNewPollInterval <= 0 {
+		invalidParams = append(invalidParams, "accrual new poll interval")
+	}
+	if cfg.AccrualProcessingPollInterval <= 0 {
+		invalidParams = append(invalidParams, "accrual processing poll interval")
+	}
+	if cfg.AccrualWorkerCount < 1 {
+		invalidParams = append(invalidParams, "accrual worker count")
+	}
+	if cfg.AccrualMaxWorkerCount != 0 && cfg.AccrualMaxWorkerCount < cfg.AccrualWorkerCount {
+		invalidParams = append(invalidParams, "accrual max worker count")
+	}
+	if cfg.AccrualStuckOrderAge < 0 {
+		invalidParams = append(invalidParams, "accrual stuck order age")
+	}
+	if (cfg.AccrualOrderMaxAge > 0 || cfg.AccrualStuckOrderAge > 0) && cfg.AccrualExpireCheckInterval <= 0 {
+		invalidParams = append(invalidParams, "accrual expire check interval")
+	}
+	if cfg.AccrualFetchAttempts < 1 {
+		invalidParams = append(invalidParams, "accrual fetch attempts")
+	}
+	if cfg.AccrualFetchAttempts > 1 && cfg.AccrualFetchRetryBackoff <= 0 {
+		invalidParams = append(invalidParams, "accrual fetch retry backoff")
+	}
+	if cfg.AccrualFetchAttempts > 1 && cfg.AccrualFetchMaxBackoff < cfg.AccrualFetchRetryBackoff {
+		invalidParams = append(invalidParams, "accrual fetch max backoff")
+	}
+	if cfg.AccrualMaxFetchFailures < 0 {
+		invalidParams = append(invalidParams, "accrual max fetch failures")
+	}
+	if cfg.AccrualCircuitFailures < 0 {
+		invalidParams = append(invalidParams, "accrual circuit failures")
+	}
+	if cfg.AccrualCircuitFailures > 0 && cfg.AccrualCircuitCooldown <= 0 {
+		invalidParams = append(invalidParams, "accrual circuit cooldown")
+	}
+	if cfg.AccrualRequestTimeout <= 0 {
+		invalidParams = append(invalidParams, "accrual request timeout")
+	}
+	if cfg.AccrualDrainTimeout <= 0 {
+		invalidParams = append(invalidParams, "accrual drain timeout")
+	}
+	if cfg.AccrualRPS < 0 || (cfg.AccrualRPS > 0 && cfg.AccrualBurst < 1) {
+		invalidParams = append(invalidParams, "accrual rate limit")
+	}
+	if cfg.AccrualSharedRateLimit && cfg.RedisURL == "" {
+		invalidParams = append(invalidParams, "accrual shared rate limit (redis url is not set)")
+	}
+	if cfg.AccrualBatchPath != "" {
+		if !strings.HasPrefix(cfg.AccrualBatchPath, "/") {
+			invalidParams = append(invalidParams, "accrual batch path")
+		}
+		if !agent.BatchFormat(cfg.AccrualBatchFormat).IsValid() {
+			invalidParams = append(invalidParams, "accrual batch format")
+		}
+		if cfg.AccrualBatchSize < 1 {
+			invalidParams = append(invalidParams, "accrual batch size")
+		}
+	}
+	if cfg.WebhookPollInterval <= 0 {
+		invalidParams = append(invalidParams, "webhook poll interval")
+	}
+	if cfg.WebhookMaxAttempts < 1 {
+		invalidParams = append(invalidParams, "webhook max attempts")
+	}
+	if cfg.OutboxPollInterval <= 0 {
+		invalidParams = append(invalidParams, "outbox poll interval")
+	}
+	if cfg.BrokerURL != "" {
+		if _, err := broker.ParseNATSURL(cfg.BrokerURL); err != nil {
+			invalidParams = append(invalidParams, "broker url")
+		}
+		if !broker.IsValidSubject(cfg.BrokerTopic) {
+			invalidParams = append(invalidParams, "broker topic")
+		}
+	}
+	if cfg.RateLimitWindow <= 0 {
+		invalidParams = append(invalidParams, "rate limit window")
+	}
+	if cfg.AuthRateLimitRPS < 0 || (cfg.AuthRateLimitRPS > 0 && cfg.AuthRateLimitBurst < 1) {
+		invalidParams = append(invalidParams, "auth rate limit")
+	}
+	if cfg.OrderUploadRateLimitRPS < 0 || (cfg.OrderUploadRateLimitRPS > 0 && cfg.OrderUploadRateLimitBurst < 1) {
+		invalidParams = append(invalidParams, "order upload rate limit")
+	}
+	if cfg.FaultLatencyRate < 0 || cfg.FaultLatencyRate > 1 {
+		invalidParams = append(invalidParams, "fault latency rate")
+	}
+	if cfg.FaultErrorRate < 0 || cfg.FaultErrorRate > 1 {
+		invalidParams = append(invalidParams, "fault error rate")
+	}
+
+	if cfg.GzipMinSize < 0 {
+		invalidParams = append(invalidParams, "gzip min size")
+	}
+	if cfg.GzipLevel < gzip.HuffmanOnly || cfg.GzipLevel > gzip.BestCompression {
+		invalidParams = append(invalidParams, "gzip level")
+	}
 
 	if len(invalidParams) > 0 {
 		return fmt.Errorf("invalid config params: %s", strings.Join(invalidParams, "; "))
@@ -40,8 +462,128 @@ func validateConf(cfg ServerConf) error {
 func loadFlags(cfg *ServerConf) error {
 	flag.StringVar(&cfg.ServerAddress, "a", ":8080", "Адрес запуска HTTP-сервера")
 	flag.StringVar(&cfg.LogLevel, "l", "info", "Уровень логирования")
-	flag.StringVar(&cfg.DSN, "d", "", "Строка с адресом подключения к БД")
+	flag.StringVar(&cfg.InstanceID, "instance-id", "", "Идентификатор экземпляра сервиса (по умолчанию <hostname>-<случайный суффикс>)")
+	flag.StringVar(&cfg.DSN, "d", "", "Строка с адресом подключения к БД: postgres://..., mysql://... или sqlite://путь_к_файлу")
+	flag.StringVar(&cfg.ReadDSN, "read-database-uri", "", "Строка с адресом подключения к реплике БД для запросов на чтение (PostgreSQL или MySQL)")
+	flag.BoolVar(&cfg.DBAutoMigrate, "db-auto-migrate", true, "Применять новые миграции БД при запуске (false - схемой управляет команда gophermart migrate)")
+	loadDBPoolFlags(&cfg.DBPool)
 	flag.StringVar(&cfg.AccrualAddress, "r", "", "Адрес системы расчёта начислений")
+	flag.StringVar(&cfg.AccrualProviders, "accrual-providers", "", "Дополнительные системы начислений, выбираемые по префиксу номера заказа, в формате префикс1=адрес1,префикс2=адрес2")
+	flag.StringVar(&cfg.AccrualAPIKey, "accrual-api-key", "", "Ключ API или токен запросов в систему начислений (пустой - запросы без учетных данных)")
+	flag.StringVar(&cfg.AccrualAPIKeyHeader, "accrual-api-key-header", "Authorization", "Заголовок с ключом API системы начислений; в Authorization ключ передается как Bearer-токен")
+	flag.BoolVar(&cfg.AccrualDryRun, "accrual-dry-run", false, "Режим проверки: агент запрашивает статусы заказов и пишет в лог изменения, не меняя заказы в БД")
+	flag.StringVar(&cfg.ServiceToken, "service-token", "", "Токен доступа ко всему внутреннему API")
+	flag.StringVar(&cfg.ServiceJWTKey, "service-jwt-key", "", "Ключ подписи сервисных JWT для внутреннего API (без него и токена API отключено)")
+	flag.StringVar(&cfg.ServiceAPIKeys, "service-api-keys", "", "Ключи API для подписанных запросов к внутреннему API вида id1:secret1,id2:secret2")
+	flag.DurationVar(&cfg.ServiceSignatureWindow, "service-signature-window", 5*time.Minute, "Допустимое расхождение времени подписи запроса и времени сервера")
+	flag.StringVar(&cfg.PrivilegedAllowedCIDRs, "privileged-allowed-cidrs", "", "Подсети через запятую, из которых доступны внутреннее API и метрики (пустой - любые)")
+	flag.StringVar(&cfg.TrustedProxies, "trusted-proxies", "", "Подсети доверенных прокси через запятую, от которых принимается X-Forwarded-For")
+	flag.StringVar(&cfg.JWTKeys, "jwt-keys", "", "Ключи подписи JWT пользователей вида kid1:secret1,kid2:secret2, первым подписываются новые токены")
+	flag.StringVar(&cfg.JWTPrivateKeyFile, "jwt-private-key-file", "", "Файл с закрытым ключом RSA или Ed25519 в формате PEM для подписи JWT пользователей (RS256/EdDSA)")
+	flag.StringVar(&cfg.JWTPrivateKeyID, "jwt-private-key-id", "", "Идентификатор (kid) закрытого ключа подписи JWT")
+	flag.DurationVar(&cfg.JWTTTL, "jwt-ttl", 15*time.Minute, "Срок действия JWT пользователя")
+	flag.DurationVar(&cfg.RefreshTokenTTL, "refresh-token-ttl", 30*24*time.Hour, "Срок действия токена обновления сессии")
+	flag.StringVar(&cfg.PasswordHashAlgorithm, "password-hash-algorithm", utils.PasswordHashBcrypt, "Алгоритм хэширования паролей (bcrypt или argon2id)")
+	flag.BoolVar(&cfg.CookieSecure, "cookie-secure", false, "Передавать cookie с токенами только по HTTPS")
+	flag.StringVar(&cfg.CookieSameSite, "cookie-samesite", "", "Атрибут SameSite cookie с токенами: lax, strict или none (пустой - не передается)")
+	flag.StringVar(&cfg.CookieDomain, "cookie-domain", "", "Домен cookie с токенами, например .example.com (пустой - только текущий хост)")
+	flag.DurationVar(&cfg.CookieMaxAge, "cookie-max-age", 0, "Время жизни cookie с JWT (0 - до закрытия браузера)")
+	flag.BoolVar(&cfg.CSRFProtection, "csrf-protection", false, "Проверять CSRF-токен в изменяющих запросах с аутентификацией по cookie")
+	flag.StringVar(&cfg.SessionBackend, "session-backend", SessionBackendNone, "Хранилище серверных сессий: memory, postgres или redis (пустое - сессии не используются, аутентификация по JWT)")
+	flag.DurationVar(&cfg.SessionTTL, "session-ttl", 24*time.Hour, "Срок действия серверной сессии")
+	flag.IntVar(&cfg.PasswordMinLength, "password-min-length", 0, "Минимальная длина пароля")
+	flag.StringVar(&cfg.PasswordRequiredClasses, "password-required-classes", "", "Обязательные классы символов пароля через запятую: lower, upper, digit, special")
+	flag.BoolVar(&cfg.PasswordDenyCommon, "password-deny-common", false, "Запретить распространенные пароли")
+	flag.StringVar(&cfg.SMTPAddr, "smtp-addr", "", "Адрес SMTP-сервера вида host:port (пустой - письма пишутся в лог)")
+	flag.StringVar(&cfg.SMTPFrom, "smtp-from", "", "Адрес отправителя писем")
+	flag.StringVar(&cfg.SMTPUser, "smtp-user", "", "Пользователь SMTP-сервера (пустой - без аутентификации)")
+	flag.StringVar(&cfg.SMTPPassword, "smtp-password", "", "Пароль пользователя SMTP-сервера")
+	flag.StringVar(&cfg.EmailVerificationURL, "email-verification-url", "", "Адрес страницы подтверждения email, к нему добавляется параметр token (пустой - в письме только токен)")
+	flag.StringVar(&cfg.OIDCIssuer, "oidc-issuer", "", "Издатель (issuer) провайдера OpenID Connect (пустой - вход через провайдера отключен)")
+	flag.StringVar(&cfg.OIDCClientID, "oidc-client-id", "", "Идентификатор клиента у провайдера OpenID Connect")
+	flag.StringVar(&cfg.OIDCClientSecret, "oidc-client-secret", "", "Секрет клиента у провайдера OpenID Connect")
+	flag.StringVar(&cfg.OIDCRedirectURL, "oidc-redirect-url", "", "Адрес обработчика /api/user/oauth/callback, зарегистрированный у провайдера")
+	flag.StringVar(&cfg.OIDCScopes, "oidc-scopes", "openid,email,profile", "Запрашиваемые у провайдера scope через запятую")
+	flag.StringVar(&cfg.OIDCSuccessURL, "oidc-success-url", "", "Адрес, на который перенаправляется пользователь после входа через провайдера (пустой - токены в теле ответа)")
+	flag.BoolVar(&cfg.OIDCAllowHTTP, "oidc-allow-http", false, "Разрешить провайдера OpenID Connect по http (только для разработки)")
+	flag.BoolVar(&cfg.OIDCLinkByEmail, "oidc-link-by-email", false, "Привязывать учетную запись провайдера к пользователю с тем же подтвержденным email (только для доверенного провайдера)")
+	flag.Float64Var(&cfg.StepUpWithdrawThreshold, "step-up-withdraw-threshold", 0, "Сумма списания, выше которой требуется недавнее подтверждение пароля (0 - не требуется)")
+	flag.DurationVar(&cfg.StepUpTTL, "step-up-ttl", 5*time.Minute, "Сколько действует подтверждение пароля")
+	flag.Float64Var(&cfg.MinWithdrawSum, "min-withdraw-sum", 0, "Минимальная сумма одного списания баллов (0 - без ограничения)")
+	flag.DurationVar(&cfg.WithdrawCancelWindow, "withdraw-cancel-window", 0, "Время, в течение которого пользователь может отменить списание (0 - списания завершаются сразу)")
+	flag.DurationVar(&cfg.HoldTTL, "hold-ttl", 30*time.Minute, "Срок резерва баллов, после которого он снимается автоматически (0 - резервирование недоступно)")
+	flag.DurationVar(&cfg.HoldReleaseInterval, "hold-release-interval", time.Minute, "Интервал снятия истекших резервов баллов")
+	flag.IntVar(&cfg.OrderMaxRetries, "order-max-retries", 3, "Сколько раз пользователь может отправить заказ INVALID на повторную обработку (0 - повтор недоступен)")
+	flag.DurationVar(&cfg.OrderArchiveAge, "order-archive-age", 0, "Время после обработки заказа, по истечении которого он переносится в архив (0 - заказы не архивируются)")
+	flag.DurationVar(&cfg.OrderArchiveInterval, "order-archive-interval", time.Hour, "Интервал переноса обработанных заказов в архив")
+	flag.IntVar(&cfg.WithdrawDailyCountLimit, "withdraw-daily-count-limit", 0, "Количество списаний пользователя за 24 часа (0 - без ограничения)")
+	flag.Float64Var(&cfg.WithdrawDailySumLimit, "withdraw-daily-sum-limit", 0, "Сумма списаний пользователя за 24 часа (0 - без ограничения)")
+	flag.IntVar(&cfg.WithdrawMonthlyCountLimit, "withdraw-monthly-count-limit", 0, "Количество списаний пользователя за календарный месяц (0 - без ограничения)")
+	flag.Float64Var(&cfg.WithdrawMonthlySumLimit, "withdraw-monthly-sum-limit", 0, "Сумма списаний пользователя за календарный месяц (0 - без ограничения)")
+	flag.StringVar(&cfg.Currency, "currency", "", "Код валюты, в которую пересчитываются баланс и списания (пусто - не пересчитываются)")
+	flag.Float64Var(&cfg.CurrencyRate, "currency-rate", 1, "Стоимость балла в валюте, пока в БД нет ни одного курса")
+	flag.BoolVar(&cfg.LoyaltyTiers, "loyalty-tiers", false, "Повышать начисления пользователям уровней SILVER и GOLD программы лояльности")
+	flag.Float64Var(&cfg.LoyaltySilverThreshold, "loyalty-silver-threshold", 1000, "Сумма начислений за все время, начиная с которой действует уровень SILVER")
+	flag.Float64Var(&cfg.LoyaltyGoldThreshold, "loyalty-gold-threshold", 5000, "Сумма начислений за все время, начиная с которой действует уровень GOLD")
+	flag.Float64Var(&cfg.LoyaltySilverMultiplier, "loyalty-silver-multiplier", 1.05, "Коэффициент начислений уровня SILVER")
+	flag.Float64Var(&cfg.LoyaltyGoldMultiplier, "loyalty-gold-multiplier", 1.1, "Коэффициент начислений уровня GOLD")
+	flag.BoolVar(&cfg.SuspiciousLoginDetection, "suspicious-login-detection", false, "Отслеживать входы с новых устройств и из новых подсетей")
+	flag.StringVar(&cfg.SuspiciousLoginWebhookURL, "suspicious-login-webhook-url", "", "Адрес, на который отправляются уведомления о подозрительных входах (пустой - только лог и письмо)")
+	flag.BoolVar(&cfg.SuspiciousLoginVerification, "suspicious-login-verification", false, "Требовать подтверждения входа с нового устройства кодом из письма")
+	flag.IntVar(&cfg.LoginMaxFailures, "login-max-failures", 0, "Количество неудачных попыток входа подряд, после которого вход блокируется (0 - не блокируется)")
+	flag.DurationVar(&cfg.LoginLockoutDuration, "login-lockout-duration", 15*time.Minute, "Длительность блокировки входа")
+	flag.DurationVar(&cfg.AccrualNewPollInterval, "accrual-new-poll-interval", time.Second, "Интервал опроса системы начислений по новым заказам")
+	flag.DurationVar(&cfg.AccrualProcessingPollInterval, "accrual-processing-poll-interval", 10*time.Second, "Интервал опроса системы начислений по заказам в обработке")
+	flag.BoolVar(&cfg.AccrualListenNewOrders, "accrual-listen-new-orders", true, "Отправлять новые заказы в систему начислений сразу по уведомлению из БД (LISTEN/NOTIFY)")
+	flag.DurationVar(&cfg.AccrualInFlightTimeout, "accrual-in-flight-timeout", time.Minute, "Время, на которое заказ закрепляется за агентом; закрепление продлевается, пока заказ обрабатывается")
+	flag.DurationVar(&cfg.AccrualOrderMaxAge, "accrual-order-max-age", 0, "Возраст необработанного заказа, после которого он помечается как INVALID (0 - без ограничения)")
+	flag.BoolVar(&cfg.AccrualAgentEnabled, "accrual-agent-enabled", true, "Запускать агент расчета начислений в процессе сервиса (false - агент запускается отдельно, cmd/accrualagent)")
+	flag.IntVar(&cfg.AccrualWorkerCount, "accrual-worker-count", 5, "Количество воркеров агента, параллельно отправляющих запросы в систему начислений")
+	flag.IntVar(&cfg.AccrualMaxWorkerCount, "accrual-max-worker-count", 0, "Максимальное количество воркеров агента при росте очереди заказов (0 - количество воркеров не меняется)")
+	flag.DurationVar(&cfg.AccrualExpireCheckInterval, "accrual-expire-check-interval", time.Minute, "Интервал поиска заказов старше accrual-order-max-age и заказов, зависших в PROCESSING")
+	flag.DurationVar(&cfg.AccrualStuckOrderAge, "accrual-stuck-order-age", 30*time.Minute, "Время без изменений статуса PROCESSING, после которого заказ возвращается в NEW (0 - не возвращается)")
+	flag.IntVar(&cfg.AccrualFetchAttempts, "accrual-fetch-attempts", 3, "Количество попыток запроса статуса заказа в системе начислений до возврата заказа в очередь (1 - без повторов)")
+	flag.DurationVar(&cfg.AccrualFetchRetryBackoff, "accrual-fetch-retry-backoff", 500*time.Millisecond, "Задержка перед повтором запроса статуса заказа, удваивается с каждой попыткой")
+	flag.DurationVar(&cfg.AccrualFetchMaxBackoff, "accrual-fetch-max-backoff", 10*time.Second, "Максимальная задержка перед повтором запроса статуса заказа")
+	flag.IntVar(&cfg.AccrualCircuitFailures, "accrual-circuit-failures", 5, "Количество неудачных запросов в систему начислений подряд, после которого запросы приостанавливаются (0 - не приостанавливаются)")
+	flag.DurationVar(&cfg.AccrualCircuitCooldown, "accrual-circuit-cooldown", 30*time.Second, "Пауза в запросах в систему начислений после серии неудачных запросов")
+	flag.DurationVar(&cfg.AccrualDrainTimeout, "accrual-drain-timeout", 3*time.Second, "Время, в течение которого при остановке сервиса сохраняются уже полученные статусы заказов")
+	flag.Float64Var(&cfg.AccrualRPS, "accrual-rps", 0, "Средняя частота запросов агента в систему начислений в секунду (0 - без ограничения)")
+	flag.IntVar(&cfg.AccrualBurst, "accrual-burst", 1, "Количество запросов в систему начислений, которые можно выполнить подряд при ограничении частоты")
+	flag.DurationVar(&cfg.AccrualRequestTimeout, "accrual-request-timeout", 10*time.Second, "Время ожидания ответа системы начислений на один запрос, после которого запрос повторяется")
+	flag.BoolVar(&cfg.AccrualSharedRateLimit, "accrual-shared-rate-limit", false, "Хранить ограничение запросов к системе начислений после ответа 429 в Redis, общим для всех экземпляров")
+	flag.StringVar(&cfg.AccrualBatchPath, "accrual-batch-path", "", "Путь пакетного запроса статусов заказов в системе начислений (пустой - статус каждого заказа запрашивается отдельно)")
+	flag.StringVar(&cfg.AccrualBatchFormat, "accrual-batch-format", "json", "Формат пакетного запроса: json (POST с массивом номеров) или query (GET с параметрами order)")
+	flag.IntVar(&cfg.AccrualBatchSize, "accrual-batch-size", 50, "Максимальное количество заказов в пакетном запросе")
+	flag.IntVar(&cfg.AccrualMaxFetchFailures, "accrual-max-fetch-failures", 10, "Количество опросов подряд без ответа системы начислений по заказу, после которого заказ переводится в STALLED (0 - без ограничения)")
+	flag.BoolVar(&cfg.EventSourcedBalance, "event-sourced-balance", false, "Изменять баланс только через журнал событий")
+	flag.BoolVar(&cfg.ReplayBalances, "replay-balances", false, "Пересчитать балансы по журналу событий при запуске")
+	flag.DurationVar(&cfg.BalanceSnapshotInterval, "balance-snapshot-interval", 0, "Интервал снимков балансов (0 - снимки отключены)")
+	flag.DurationVar(&cfg.BalanceEventsRetention, "balance-events-retention", 30*24*time.Hour, "Возраст событий баланса, после которого они переносятся в архив")
+	flag.DurationVar(&cfg.WebhookPollInterval, "webhook-poll-interval", 5*time.Second, "Интервал проверки очереди доставки событий на webhooks")
+	flag.IntVar(&cfg.WebhookMaxAttempts, "webhook-max-attempts", 10, "Количество попыток доставки события на webhook")
+	flag.BoolVar(&cfg.WebhookAllowPrivateNetworks, "webhook-allow-private-networks", false, "Разрешить отправку событий на адреса локальной и частных сетей")
+	flag.DurationVar(&cfg.OutboxPollInterval, "outbox-poll-interval", time.Second, "Интервал проверки неопубликованных событий outbox")
+	flag.StringVar(&cfg.BrokerURL, "broker-url", "", "Адрес NATS, в который публикуются события заказов и списаний, например nats://localhost:4222 (пустой - события не публикуются)")
+	flag.StringVar(&cfg.BrokerTopic, "broker-topic", "gophermart", "Префикс темы (subject) NATS, к которому добавляется тип события")
+	flag.StringVar(&cfg.RedisURL, "redis-url", "", "Адрес Redis для общих счетчиков лимитов (пустой - счетчики в памяти)")
+	flag.IntVar(&cfg.OrderRateLimit, "order-rate-limit", 0, "Лимит загрузок заказов пользователем в окне (0 - без ограничений)")
+	flag.IntVar(&cfg.WithdrawRateLimit, "withdraw-rate-limit", 0, "Лимит списаний пользователем в окне (0 - без ограничений)")
+	flag.DurationVar(&cfg.RateLimitWindow, "rate-limit-window", time.Minute, "Окно ограничения частоты запросов пользователя")
+	flag.Float64Var(&cfg.AuthRateLimitRPS, "auth-rate-limit-rps", 1, "Средняя частота запросов регистрации и входа с одного IP в секунду (0 - без ограничений)")
+	flag.IntVar(&cfg.AuthRateLimitBurst, "auth-rate-limit-burst", 10, "Допустимый всплеск запросов регистрации и входа с одного IP")
+	flag.Float64Var(&cfg.OrderUploadRateLimitRPS, "order-upload-rate-limit-rps", 2, "Средняя частота загрузки заказов пользователем в секунду, если не задан order-rate-limit (0 - без ограничений)")
+	flag.IntVar(&cfg.OrderUploadRateLimitBurst, "order-upload-rate-limit-burst", 20, "Допустимый всплеск загрузок заказов пользователем")
+	flag.BoolVar(&cfg.FaultInjection, "fault-injection", false, "Вносить искусственные сбои в обработку запросов и работу агента")
+	flag.Float64Var(&cfg.FaultLatencyRate, "fault-latency-rate", 0, "Доля запросов с искусственной задержкой (0..1)")
+	flag.DurationVar(&cfg.FaultLatency, "fault-latency", time.Second, "Величина искусственной задержки")
+	flag.Float64Var(&cfg.FaultErrorRate, "fault-error-rate", 0, "Доля запросов, завершающихся искусственной ошибкой (0..1)")
+	flag.Int64Var(&cfg.LoadShedMaxInFlight, "load-shed-max-in-flight", 0, "Количество одновременных запросов, при превышении которого отбрасываются списочные запросы (0 - не ограничено)")
+	flag.DurationVar(&cfg.LoadShedMaxP99, "load-shed-max-p99", 0, "p99 времени ответа, при превышении которого отбрасываются списочные запросы (0 - не ограничено)")
+	flag.DurationVar(&cfg.LoadShedRetryAfter, "load-shed-retry-after", 5*time.Second, "Через сколько повторить отброшенный запрос")
+	flag.IntVar(&cfg.GzipMinSize, "gzip-min-size", 1024, "Минимальный размер ответа в байтах, начиная с которого он сжимается")
+	flag.IntVar(&cfg.GzipLevel, "gzip-level", gzip.DefaultCompression, "Уровень сжатия gzip (от -2 до 9, -1 - по умолчанию)")
+	flag.StringVar(&cfg.GzipContentTypes, "gzip-content-types", "application/json,text/plain,text/html", "Сжимаемые типы содержимого через запятую (пустой - сжатие отключено)")
 	flag.Parse()
 
 	return nil
@@ -65,6 +607,19 @@ func validateBaseURL(baseURL string) error {
 	return err
 }
 
+// isValidHeaderName проверяет, что имя заголовка HTTP не пустое и состоит из допустимых символов
+func isValidHeaderName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, c := range name {
+		if c > 0x7e || c <= ' ' || strings.ContainsRune(`"(),/:;<=>?@[\]{}`, c) {
+			return false
+		}
+	}
+	return true
+}
+
 func InitConfig() (ServerConf, error) {
 	serverConf := ServerConf{}
 
@@ -75,6 +630,10 @@ func InitConfig() (ServerConf, error) {
 		return serverConf, err
 	}
 
+	if serverConf.InstanceID == "" {
+		serverConf.InstanceID = instance.NewID()
+	}
+
 	if err := validateConf(serverConf); err != nil {
 		return serverConf, err
 	}
@@ -0,0 +1,44 @@
+package config
+
+import (
+	"flag"
+	"time"
+)
+
+// DBPoolConf - параметры пула соединений с БД. Нулевые значения оставляют значения по умолчанию драйвера
+// или заданные в DSN (pool_max_conns и др.). MinConns и HealthCheckPeriod поддерживает только PostgreSQL.
+type DBPoolConf struct {
+	MaxConns          int           `env:"DB_MAX_CONNS"`
+	MinConns          int           `env:"DB_MIN_CONNS"`
+	MaxConnLifetime   time.Duration `env:"DB_MAX_CONN_LIFETIME"`
+	MaxConnIdleTime   time.Duration `env:"DB_MAX_CONN_IDLE_TIME"`
+	HealthCheckPeriod time.Duration `env:"DB_HEALTH_CHECK_PERIOD"`
+}
+
+func validateDBPoolConf(cfg DBPoolConf) []string {
+	invalidParams := []string{}
+	if cfg.MaxConns < 0 {
+		invalidParams = append(invalidParams, "db max conns")
+	}
+	if cfg.MinConns < 0 || (cfg.MaxConns > 0 && cfg.MinConns > cfg.MaxConns) {
+		invalidParams = append(invalidParams, "db min conns")
+	}
+	if cfg.MaxConnLifetime < 0 {
+		invalidParams = append(invalidParams, "db max conn lifetime")
+	}
+	if cfg.MaxConnIdleTime < 0 {
+		invalidParams = append(invalidParams, "db max conn idle time")
+	}
+	if cfg.HealthCheckPeriod < 0 {
+		invalidParams = append(invalidParams, "db health check period")
+	}
+	return invalidParams
+}
+
+func loadDBPoolFlags(cfg *DBPoolConf) {
+	flag.IntVar(&cfg.MaxConns, "db-max-conns", 0, "Максимальное количество соединений с БД (0 - по умолчанию драйвера)")
+	flag.IntVar(&cfg.MinConns, "db-min-conns", 0, "Количество соединений с БД, которые пул держит открытыми (только PostgreSQL)")
+	flag.DurationVar(&cfg.MaxConnLifetime, "db-max-conn-lifetime", 0, "Время, после которого соединение с БД закрывается и открывается заново (0 - по умолчанию драйвера)")
+	flag.DurationVar(&cfg.MaxConnIdleTime, "db-max-conn-idle-time", 0, "Время простоя, после которого соединение с БД закрывается (0 - по умолчанию драйвера)")
+	flag.DurationVar(&cfg.HealthCheckPeriod, "db-health-check-period", 0, "Интервал проверки простаивающих соединений с БД (только PostgreSQL, 0 - по умолчанию pgx)")
+}
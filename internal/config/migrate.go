@@ -0,0 +1,54 @@
+package config
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+
+	"github.com/caarlos0/env/v11"
+	"github.com/joho/godotenv"
+	"github.com/pinbrain/gophermart/internal/storage"
+)
+
+// MigrateConf - конфигурация команды управления миграциями gophermart migrate
+type MigrateConf struct {
+	DSN string `env:"DATABASE_URI"`
+	// Команда: up, down, status или version
+	Command string
+}
+
+// InitMigrateConfig загружает конфигурацию команды migrate из ее аргументов, файла .env и переменных
+// окружения. Первый аргумент без флага - команда.
+func InitMigrateConfig(args []string) (MigrateConf, error) {
+	migrateConf := MigrateConf{}
+
+	flags := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	flags.StringVar(&migrateConf.DSN, "d", "", "Строка с адресом подключения к БД: postgres://..., mysql://... или sqlite://путь_к_файлу")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: gophermart migrate [-d dsn] up|down|status|version")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return migrateConf, err
+	}
+	if err := godotenv.Load(); err != nil {
+		fmt.Println("Env file not found")
+	}
+	if err := env.Parse(&migrateConf); err != nil {
+		return migrateConf, err
+	}
+	migrateConf.Command = flags.Arg(0)
+
+	invalidParams := []string{}
+	if migrateConf.DSN == "" {
+		invalidParams = append(invalidParams, "database uri")
+	}
+	if !storage.IsValidMigrateCommand(migrateConf.Command) || flags.NArg() > 1 {
+		invalidParams = append(invalidParams, "migrate command")
+	}
+	if len(invalidParams) > 0 {
+		return migrateConf, fmt.Errorf("invalid config params: %s", strings.Join(invalidParams, "; "))
+	}
+
+	return migrateConf, nil
+}
@@ -0,0 +1,97 @@
+package events
+
+import (
+	"sync"
+
+	"github.com/pinbrain/gophermart/internal/logger"
+	"github.com/pinbrain/gophermart/internal/model"
+)
+
+// Размер буфера событий подписчика. Если подписчик не успевает их читать, новые события отбрасываются.
+const subscriberBuffer = 16
+
+// Hub рассылает события пользователей подписчикам в пределах одного экземпляра сервиса
+type Hub struct {
+	mu     sync.RWMutex
+	subs   map[int]map[chan model.UserEvent]struct{}
+	closed bool
+}
+
+func NewHub() *Hub {
+	return &Hub{subs: make(map[int]map[chan model.UserEvent]struct{})}
+}
+
+// Subscribe подписывает на события пользователя userID. Возвращает канал событий и функцию отписки,
+// которую нужно вызвать по окончании чтения.
+func (h *Hub) Subscribe(userID int) (<-chan model.UserEvent, func()) {
+	ch := make(chan model.UserEvent, subscriberBuffer)
+
+	h.mu.Lock()
+	if h.closed {
+		h.mu.Unlock()
+		close(ch)
+		return ch, func() {}
+	}
+	if h.subs[userID] == nil {
+		h.subs[userID] = make(map[chan model.UserEvent]struct{})
+	}
+	h.subs[userID][ch] = struct{}{}
+	h.mu.Unlock()
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			h.mu.Lock()
+			defer h.mu.Unlock()
+			delete(h.subs[userID], ch)
+			if len(h.subs[userID]) == 0 {
+				delete(h.subs, userID)
+			}
+		})
+	}
+}
+
+// PublishOrderStatus отправляет событие изменения статуса заказа подписчикам владельца заказа.
+// Начисление по обработанному заказу дополнительно публикуется как изменение баланса.
+func (h *Hub) PublishOrderStatus(event model.OrderStatusEvent) {
+	h.publish(model.UserEvent{UserID: event.UserID, Type: model.UserEventOrderStatus, Order: &event})
+	if event.Status == model.OrderProcessed && event.Accrual > 0 {
+		h.PublishBalanceChange(event.UserID, model.BalanceChangeEvent{
+			Type:      model.BalanceEventAccrual,
+			Number:    event.Number,
+			Amount:    event.Accrual,
+			CreatedAt: event.UpdatedAt,
+		})
+	}
+}
+
+// PublishBalanceChange отправляет событие изменения баланса подписчикам пользователя userID
+func (h *Hub) PublishBalanceChange(userID int, event model.BalanceChangeEvent) {
+	h.publish(model.UserEvent{UserID: userID, Type: model.UserEventBalance, Balance: &event})
+}
+
+func (h *Hub) publish(event model.UserEvent) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	for ch := range h.subs[event.UserID] {
+		select {
+		case ch <- event:
+		default:
+			logger.Log.WithField("user_id", event.UserID).Warn("User event subscriber is too slow, event dropped")
+		}
+	}
+}
+
+// Close закрывает каналы всех подписчиков, чтобы открытые потоки событий завершились
+// до остановки HTTP-сервера. Подписка после закрытия сразу получает закрытый канал.
+func (h *Hub) Close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.closed = true
+	for userID, subs := range h.subs {
+		for ch := range subs {
+			close(ch)
+		}
+		delete(h.subs, userID)
+	}
+}
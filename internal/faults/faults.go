@@ -0,0 +1,47 @@
+package faults
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"time"
+)
+
+var ErrInjected = errors.New("injected fault")
+
+type Config struct {
+	// Доля запросов, которым добавляется задержка (0..1)
+	LatencyRate float64
+	// Величина добавляемой задержки
+	Latency time.Duration
+	// Доля запросов, завершающихся ошибкой (0..1)
+	ErrorRate float64
+}
+
+// Injector вносит искусственные задержки и ошибки для проверки устойчивости клиентов и агента.
+// Методы безопасно вызывать у nil, в этом случае сбои не вносятся.
+type Injector struct {
+	cfg Config
+}
+
+func NewInjector(cfg Config) *Injector {
+	return &Injector{cfg: cfg}
+}
+
+// Inject с заданной вероятностью добавляет задержку и возвращает ErrInjected
+func (i *Injector) Inject(ctx context.Context) error {
+	if i == nil {
+		return nil
+	}
+	if i.cfg.Latency > 0 && rand.Float64() < i.cfg.LatencyRate {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(i.cfg.Latency):
+		}
+	}
+	if rand.Float64() < i.cfg.ErrorRate {
+		return ErrInjected
+	}
+	return nil
+}
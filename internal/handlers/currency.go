@@ -0,0 +1,116 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pinbrain/gophermart/internal/logger"
+	"github.com/pinbrain/gophermart/internal/model"
+)
+
+// CurrencyCfg - валюта, в которой вместе с баллами показываются суммы баланса и списаний
+type CurrencyCfg struct {
+	// Код валюты ISO 4217, пустая строка отключает пересчет
+	Code string
+	// Курс, который действует, пока для валюты нет ни одного курса в БД
+	DefaultRate float64
+}
+
+// Enabled сообщает, нужно ли пересчитывать суммы в валюту
+func (cfg CurrencyCfg) Enabled() bool {
+	return cfg.Code != "" && cfg.DefaultRate > 0
+}
+
+// currencyRates - история курсов валюты, по которой выбирается курс на момент операции
+type currencyRates struct {
+	currency    string
+	defaultRate float64
+	// Курсы в порядке начала действия
+	rates []model.CurrencyRate
+}
+
+func (h *UserHandler) loadCurrencyRates(ctx context.Context) (*currencyRates, error) {
+	rates, err := h.storage.GetCurrencyRates(ctx, h.currency.Code)
+	if err != nil {
+		return nil, err
+	}
+	return &currencyRates{currency: h.currency.Code, defaultRate: h.currency.DefaultRate, rates: rates}, nil
+}
+
+// at возвращает курс, действовавший в момент t. До появления первого курса действует курс по умолчанию.
+func (cr *currencyRates) at(t time.Time) float64 {
+	i := sort.Search(len(cr.rates), func(i int) bool {
+		return cr.rates[i].EffectiveFrom.After(t)
+	})
+	if i == 0 {
+		return cr.defaultRate
+	}
+	return cr.rates[i-1].Rate
+}
+
+func (cr *currencyRates) convert(sum model.Money, t time.Time) *model.ConvertedAmount {
+	rate := cr.at(t)
+	return &model.ConvertedAmount{Currency: cr.currency, Rate: rate, Amount: sum.Mul(rate)}
+}
+
+func (cr *currencyRates) convertBalance(balance model.Balance, t time.Time) *model.ConvertedBalance {
+	rate := cr.at(t)
+	return &model.ConvertedBalance{
+		Currency:  cr.currency,
+		Rate:      rate,
+		Current:   balance.Current.Mul(rate),
+		Withdrawn: balance.Withdrawn.Mul(rate),
+	}
+}
+
+func isValidCurrencyCode(code string) bool {
+	if len(code) != 3 {
+		return false
+	}
+	for _, c := range code {
+		if c < 'A' || c > 'Z' {
+			return false
+		}
+	}
+	return true
+}
+
+// SetCurrencyRate устанавливает курс пересчета баллов в валюту. Если effective_from не указан,
+// курс начинает действовать сразу.
+func (h *InternalHandler) SetCurrencyRate(w http.ResponseWriter, r *http.Request) {
+	contentType := r.Header.Get("Content-Type")
+	if !strings.Contains(contentType, "application/json") {
+		http.Error(w, "Некорректный Content-Type", http.StatusBadRequest)
+		return
+	}
+
+	var rate model.CurrencyRate
+	dec := json.NewDecoder(r.Body)
+	if err := dec.Decode(&rate); err != nil {
+		logger.Log.WithError(err).Debug("failed to decode currency rate req body")
+		http.Error(w, "Некорректный формат запроса", http.StatusBadRequest)
+		return
+	}
+	if !isValidCurrencyCode(rate.Currency) {
+		http.Error(w, "Некорректный код валюты", http.StatusBadRequest)
+		return
+	}
+	if rate.Rate <= 0 {
+		http.Error(w, "Некорректный курс", http.StatusBadRequest)
+		return
+	}
+	if rate.EffectiveFrom.IsZero() {
+		rate.EffectiveFrom = time.Now()
+	}
+
+	if err := h.storage.SetCurrencyRate(r.Context(), rate); err != nil {
+		logger.Log.WithError(err).Error("failed to save currency rate")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,201 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pinbrain/gophermart/internal/appctx"
+	"github.com/pinbrain/gophermart/internal/logger"
+	"github.com/pinbrain/gophermart/internal/model"
+	"github.com/pinbrain/gophermart/internal/websocket"
+)
+
+// Интервал отправки комментария, не дающего прокси закрыть неактивное соединение
+const sseKeepAliveInterval = 30 * time.Second
+
+// Интервал отправки ping в канал WebSocket
+const wsPingInterval = 30 * time.Second
+
+// UserEvents рассылает события изменения заказов и баланса подписанным пользователям
+type UserEvents interface {
+	Subscribe(userID int) (<-chan model.UserEvent, func())
+	PublishOrderStatus(event model.OrderStatusEvent)
+	PublishBalanceChange(userID int, event model.BalanceChangeEvent)
+}
+
+// publishBalanceChange сообщает подписчикам пользователя об изменении баланса, если уведомления подключены
+func (h *UserHandler) publishBalanceChange(userID int, eventType model.BalanceEventType, number string, amount model.Money) {
+	if h.events == nil {
+		return
+	}
+	h.events.PublishBalanceChange(userID, model.BalanceChangeEvent{
+		Type:      eventType,
+		Number:    number,
+		Amount:    amount,
+		CreatedAt: time.Now(),
+	})
+}
+
+// OrderEvents передает клиенту события изменения статусов его заказов в формате Server-Sent Events
+func (h *UserHandler) OrderEvents(w http.ResponseWriter, r *http.Request) {
+	user := appctx.GetCtxUser(r.Context())
+	events, unsubscribe := h.events.Subscribe(user.ID)
+	defer unsubscribe()
+
+	rc := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	if err := rc.Flush(); err != nil {
+		logger.Log.WithError(err).Error("failed to start order events stream")
+		return
+	}
+
+	keepAlive := time.NewTicker(sseKeepAliveInterval)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepAlive.C:
+			if _, err := io.WriteString(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+		case event, ok := <-events:
+			// Канал закрывается при остановке сервиса
+			if !ok {
+				return
+			}
+			if event.Type != model.UserEventOrderStatus {
+				continue
+			}
+			data, err := json.Marshal(event.Order)
+			if err != nil {
+				logger.Log.WithError(err).Error("Error in encoding order event to json")
+				continue
+			}
+			if _, err = fmt.Fprintf(w, "event: order_status\ndata: %s\n\n", data); err != nil {
+				return
+			}
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+// wsTopics - типы событий, на которые подписано соединение WebSocket
+type wsTopics struct {
+	mu     sync.Mutex
+	topics map[model.UserEventType]bool
+}
+
+func (t *wsTopics) apply(cmd model.WSCommand) error {
+	var subscribe bool
+	switch cmd.Action {
+	case "subscribe":
+		subscribe = true
+	case "unsubscribe":
+	default:
+		return fmt.Errorf("неизвестное действие %q", cmd.Action)
+	}
+	for _, topic := range cmd.Topics {
+		if topic != model.UserEventOrderStatus && topic != model.UserEventBalance {
+			return fmt.Errorf("неизвестный тип событий %q", topic)
+		}
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, topic := range cmd.Topics {
+		t.topics[topic] = subscribe
+	}
+	return nil
+}
+
+func (t *wsTopics) has(topic model.UserEventType) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.topics[topic]
+}
+
+// WebSocket открывает канал уведомлений об изменениях заказов и баланса пользователя.
+// Сразу после подключения соединение подписано на все типы событий, клиент меняет подписку
+// командами {"action": "subscribe" | "unsubscribe", "topics": ["order_status", "balance"]}.
+func (h *UserHandler) WebSocket(w http.ResponseWriter, r *http.Request) {
+	user := appctx.GetCtxUser(r.Context())
+	// Подписка оформляется до подключения, чтобы не потерять события, случившиеся сразу после него
+	events, unsubscribe := h.events.Subscribe(user.ID)
+	defer unsubscribe()
+
+	conn, err := websocket.Upgrade(w, r)
+	if err != nil {
+		if !errors.Is(err, websocket.ErrBadHandshake) {
+			logger.Log.WithError(err).Error("failed to upgrade connection to websocket")
+		}
+		return
+	}
+	defer conn.Close(websocket.CloseNormal, "")
+
+	topics := &wsTopics{topics: map[model.UserEventType]bool{
+		model.UserEventOrderStatus: true,
+		model.UserEventBalance:     true,
+	}}
+	// Команды клиента читаются в отдельной горутине, завершение чтения означает закрытие соединения
+	readDone := make(chan struct{})
+	go func() {
+		defer close(readDone)
+		for {
+			message, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			var cmd model.WSCommand
+			if err = json.Unmarshal(message, &cmd); err != nil {
+				err = errors.New("некорректный формат команды")
+			} else {
+				err = topics.apply(cmd)
+			}
+			if err != nil {
+				reply, _ := json.Marshal(map[string]string{"error": err.Error()})
+				if err = conn.WriteText(reply); err != nil {
+					return
+				}
+			}
+		}
+	}()
+
+	ping := time.NewTicker(wsPingInterval)
+	defer ping.Stop()
+	for {
+		select {
+		case <-readDone:
+			return
+		case <-ping.C:
+			if err := conn.Ping(); err != nil {
+				return
+			}
+		case event, ok := <-events:
+			if !ok {
+				conn.Close(websocket.CloseGoingAway, "server is shutting down")
+				return
+			}
+			if !topics.has(event.Type) {
+				continue
+			}
+			data, err := json.Marshal(event)
+			if err != nil {
+				logger.Log.WithError(err).Error("Error in encoding user event to json")
+				continue
+			}
+			if err = conn.WriteText(data); err != nil {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/pinbrain/gophermart/internal/appctx"
+	"github.com/pinbrain/gophermart/internal/logger"
+	"github.com/pinbrain/gophermart/internal/model"
+	"github.com/pinbrain/gophermart/internal/storage"
+	"github.com/pinbrain/gophermart/internal/utils"
+)
+
+// HoldBalance резервирует баллы пользователя в счет заказа, например при оформлении покупки в магазине.
+// Резерв списывается через POST /balance/capture после завершения покупки или возвращается на баланс
+// через POST /balance/release. Не списанный вовремя резерв снимается автоматически.
+func (h *UserHandler) HoldBalance(w http.ResponseWriter, r *http.Request) {
+	contentType := r.Header.Get("Content-Type")
+	if !strings.Contains(contentType, "application/json") {
+		http.Error(w, "Некорректный Content-Type", http.StatusBadRequest)
+		return
+	}
+
+	var req model.HoldReq
+	dec := json.NewDecoder(r.Body)
+	if err := dec.Decode(&req); err != nil {
+		logger.Log.WithError(err).Debug("failed to decode hold req body")
+		http.Error(w, "Некорректный формат запроса", http.StatusBadRequest)
+		return
+	}
+	if req.Number == "" || !utils.IsValidOrderNum(req.Number) {
+		http.Error(w, "Некорректный номер заказа", http.StatusUnprocessableEntity)
+		return
+	}
+	if req.Sum <= 0 {
+		http.Error(w, "Некорректная сумма для резервирования", http.StatusBadRequest)
+		return
+	}
+	if req.Sum < h.minWithdrawSum {
+		http.Error(w, "Сумма меньше минимальной суммы списания ("+h.minWithdrawSum.String()+")", http.StatusUnprocessableEntity)
+		return
+	}
+
+	user := appctx.GetCtxUser(r.Context())
+	if h.stepUp.Enabled() && req.Sum > h.stepUp.WithdrawThreshold && !user.Elevated() {
+		http.Error(w, "Для резервирования этой суммы подтвердите пароль (POST /api/user/reauth)", http.StatusForbidden)
+		return
+	}
+	hold, err := h.storage.HoldBalance(r.Context(), user.ID, req.Number, req.Sum, h.holdTTL)
+	if err != nil {
+		switch {
+		case errors.Is(err, storage.ErrWithdrawBelowMin):
+			http.Error(w, "Сумма меньше минимальной суммы списания", http.StatusUnprocessableEntity)
+		case errors.Is(err, storage.ErrWithdrawLimit):
+			logger.Log.WithError(err).Debug()
+			http.Error(w, "Превышен лимит списаний за сутки или месяц", http.StatusTooManyRequests)
+		case errors.Is(err, storage.ErrInsufficientFunds):
+			logger.Log.WithError(err).Debug()
+			http.Error(w, "Недостаточно средств на счету", http.StatusPaymentRequired)
+		case errors.Is(err, storage.ErrOrderNumUsed):
+			logger.Log.WithError(err).Debug()
+			http.Error(w, "Номер заказа уже был использован", http.StatusConflict)
+		default:
+			logger.Log.WithError(err).Error("failed to hold balance")
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+		}
+		return
+	}
+	h.publishBalanceChange(user.ID, model.BalanceEventHold, hold.Number, -hold.Sum)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	enc := json.NewEncoder(w)
+	if err = enc.Encode(hold); err != nil {
+		logger.Log.WithError(err).Error("Error in encoding hold response to json")
+	}
+}
+
+// CaptureHold списывает зарезервированные баллы после завершения покупки. Текущий баланс
+// уменьшился еще при резервировании, поэтому уведомление об изменении баланса не отправляется.
+func (h *UserHandler) CaptureHold(w http.ResponseWriter, r *http.Request) {
+	h.resolveHold(w, r, h.storage.CaptureHold, nil)
+}
+
+// ReleaseHold снимает резерв и возвращает баллы на баланс пользователя
+func (h *UserHandler) ReleaseHold(w http.ResponseWriter, r *http.Request) {
+	h.resolveHold(w, r, h.storage.ReleaseHold, func(userID int, hold *model.Hold) {
+		h.publishBalanceChange(userID, model.BalanceEventHoldRelease, hold.Number, hold.Sum)
+	})
+}
+
+// resolveHold разбирает запрос на списание или снятие резерва, выполняет действие и отдает резерв.
+// onResolved, если задан, вызывается после успешного выполнения действия.
+func (h *UserHandler) resolveHold(
+	w http.ResponseWriter,
+	r *http.Request,
+	action func(ctx context.Context, userID, holdID int) (*model.Hold, error),
+	onResolved func(userID int, hold *model.Hold),
+) {
+	contentType := r.Header.Get("Content-Type")
+	if !strings.Contains(contentType, "application/json") {
+		http.Error(w, "Некорректный Content-Type", http.StatusBadRequest)
+		return
+	}
+
+	var req model.HoldActionReq
+	dec := json.NewDecoder(r.Body)
+	if err := dec.Decode(&req); err != nil || req.ID <= 0 {
+		http.Error(w, "Некорректный id резерва", http.StatusBadRequest)
+		return
+	}
+
+	user := appctx.GetCtxUser(r.Context())
+	hold, err := action(r.Context(), user.ID, req.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, storage.ErrNoHold):
+			http.Error(w, "Резерв не найден", http.StatusNotFound)
+		case errors.Is(err, storage.ErrHoldNotActive):
+			http.Error(w, "Резерв уже списан, снят или истек", http.StatusConflict)
+		case errors.Is(err, storage.ErrOrderNumUsed):
+			logger.Log.WithError(err).Debug()
+			http.Error(w, "Номер заказа уже был использован", http.StatusConflict)
+		default:
+			logger.Log.WithError(err).Error("failed to resolve balance hold")
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+		}
+		return
+	}
+	if onResolved != nil {
+		onResolved(user.ID, hold)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	if err = enc.Encode(hold); err != nil {
+		logger.Log.WithError(err).Error("Error in encoding hold response to json")
+	}
+}
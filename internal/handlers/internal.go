@@ -0,0 +1,132 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/pinbrain/gophermart/internal/logger"
+	"github.com/pinbrain/gophermart/internal/model"
+	"github.com/pinbrain/gophermart/internal/storage"
+)
+
+type InternalHandler struct {
+	storage Storage
+	agent   AccrualAgent
+	events  UserEvents
+}
+
+type AccrualAgent interface {
+	Status(ctx context.Context) (*model.AgentStatus, error)
+}
+
+func newInternalHandler(storage Storage, agent AccrualAgent, events UserEvents) InternalHandler {
+	return InternalHandler{storage: storage, agent: agent, events: events}
+}
+
+// PushAccrual принимает результат расчета начислений напрямую от системы начислений,
+// не дожидаясь очередного опроса агентом
+func (h *InternalHandler) PushAccrual(w http.ResponseWriter, r *http.Request) {
+	contentType := r.Header.Get("Content-Type")
+	if !strings.Contains(contentType, "application/json") {
+		http.Error(w, "Некорректный Content-Type", http.StatusBadRequest)
+		return
+	}
+
+	var accrual model.AccrualResultRes
+	dec := json.NewDecoder(r.Body)
+	if err := dec.Decode(&accrual); err != nil {
+		logger.Log.WithError(err).Debug("failed to decode push accrual req body")
+		http.Error(w, "Некорректный формат запроса", http.StatusBadRequest)
+		return
+	}
+	if accrual.Order == "" || !accrual.Status.IsValid() || accrual.Accrual < 0 {
+		http.Error(w, "Некорректные данные начисления", http.StatusBadRequest)
+		return
+	}
+
+	order, err := h.storage.GetOrderByNum(r.Context(), accrual.Order)
+	if err != nil {
+		if errors.Is(err, storage.ErrNoOrder) {
+			http.Error(w, "Заказ не найден", http.StatusNotFound)
+			return
+		}
+		logger.Log.WithError(err).Error("failed to get order for accrual push")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	// Повторная доставка результата по уже обработанному заказу не должна менять баланс
+	if order.Status.IsFinal() {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	credited, err := h.storage.UpdateOrderStatus(r.Context(), order.ID, accrual.Status.OrderStatus(), accrual.Accrual)
+	if err != nil {
+		logger.Log.WithError(err).Error("failed to apply pushed accrual")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if h.events != nil && accrual.Status.OrderStatus() != order.Status {
+		h.events.PublishOrderStatus(model.OrderStatusEvent{
+			UserID:    order.UserID,
+			Number:    order.Number,
+			Status:    accrual.Status.OrderStatus(),
+			Accrual:   credited,
+			UpdatedAt: time.Now(),
+		})
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// UnlockUser снимает блокировку входа пользователя после неудачных попыток
+func (h *InternalHandler) UnlockUser(w http.ResponseWriter, r *http.Request) {
+	login := chi.URLParam(r, "login")
+	if err := h.storage.UnlockUser(r.Context(), login); err != nil {
+		if errors.Is(err, storage.ErrNoUser) {
+			http.Error(w, "Пользователь не найден", http.StatusNotFound)
+			return
+		}
+		logger.Log.WithError(err).Error("failed to unlock user")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// RequeueOrder возвращает в очередь обработки заказ, остановленный после неудачных запросов
+// к системе начислений
+func (h *InternalHandler) RequeueOrder(w http.ResponseWriter, r *http.Request) {
+	if err := h.storage.RequeueOrder(r.Context(), chi.URLParam(r, "number")); err != nil {
+		switch {
+		case errors.Is(err, storage.ErrNoOrder):
+			http.Error(w, "Заказ не найден", http.StatusNotFound)
+		case errors.Is(err, storage.ErrOrderNotStalled):
+			http.Error(w, "Вернуть в обработку можно только заказ в статусе STALLED", http.StatusConflict)
+		default:
+			logger.Log.WithError(err).Error("failed to requeue order")
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+		}
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (h *InternalHandler) GetAgentStatus(w http.ResponseWriter, r *http.Request) {
+	status, err := h.agent.Status(r.Context())
+	if err != nil {
+		logger.Log.WithError(err).Error("failed to get accrual agent status")
+		http.Error(w, "Не удалось получить состояние агента", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	if err = enc.Encode(status); err != nil {
+		logger.Log.WithError(err).Error("Error in encoding agent status response to json")
+	}
+}
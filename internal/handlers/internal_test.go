@@ -0,0 +1,647 @@
+package handlers
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/pinbrain/gophermart/internal/handlers/mocks"
+	"github.com/pinbrain/gophermart/internal/middleware"
+	"github.com/pinbrain/gophermart/internal/model"
+	"github.com/pinbrain/gophermart/internal/nonce"
+	"github.com/pinbrain/gophermart/internal/storage"
+	"github.com/pinbrain/gophermart/internal/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPushAccrual(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockStorage := mocks.NewMockStorage(ctrl)
+	router := NewRouter(mockStorage, RouterCfg{ServiceAuth: middleware.ServiceAuthCfg{Token: "service_token"}})
+
+	type want struct {
+		statusCode int
+	}
+	type request struct {
+		body  string
+		token string
+	}
+	type storageRes struct {
+		order     *model.Order
+		getErr    error
+		update    bool
+		updateErr error
+	}
+
+	tests := []struct {
+		name       string
+		request    request
+		want       want
+		storageRes *storageRes
+	}{
+		{
+			name: "Успешный запрос",
+			request: request{
+				body:  `{"order":"9278923470","status":"PROCESSED","accrual":500}`,
+				token: "service_token",
+			},
+			want: want{
+				statusCode: http.StatusOK,
+			},
+			storageRes: &storageRes{
+				order:  &model.Order{ID: 1, Number: "9278923470", Status: model.OrderNew},
+				update: true,
+			},
+		},
+		{
+			name: "Заказ уже обработан",
+			request: request{
+				body:  `{"order":"9278923470","status":"PROCESSED","accrual":500}`,
+				token: "service_token",
+			},
+			want: want{
+				statusCode: http.StatusOK,
+			},
+			storageRes: &storageRes{
+				order:  &model.Order{ID: 1, Number: "9278923470", Status: model.OrderProcessed},
+				update: false,
+			},
+		},
+		{
+			name: "Заказ не найден",
+			request: request{
+				body:  `{"order":"9278923470","status":"PROCESSED","accrual":500}`,
+				token: "service_token",
+			},
+			want: want{
+				statusCode: http.StatusNotFound,
+			},
+			storageRes: &storageRes{
+				getErr: storage.ErrNoOrder,
+			},
+		},
+		{
+			name: "Некорректный статус",
+			request: request{
+				body:  `{"order":"9278923470","status":"UNKNOWN","accrual":500}`,
+				token: "service_token",
+			},
+			want: want{
+				statusCode: http.StatusBadRequest,
+			},
+			storageRes: nil,
+		},
+		{
+			name: "Неверный токен",
+			request: request{
+				body:  `{"order":"9278923470","status":"PROCESSED","accrual":500}`,
+				token: "wrong_token",
+			},
+			want: want{
+				statusCode: http.StatusUnauthorized,
+			},
+			storageRes: nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/api/internal/accruals", strings.NewReader(tt.request.body))
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("Authorization", "Bearer "+tt.request.token)
+			w := httptest.NewRecorder()
+
+			if tt.storageRes != nil {
+				mockStorage.EXPECT().
+					GetOrderByNum(gomock.Any(), "9278923470").
+					Return(tt.storageRes.order, tt.storageRes.getErr).
+					Times(1)
+			} else {
+				mockStorage.EXPECT().GetOrderByNum(gomock.Any(), gomock.Any()).Times(0)
+			}
+			if tt.storageRes != nil && tt.storageRes.update {
+				mockStorage.EXPECT().
+					UpdateOrderStatus(gomock.Any(), tt.storageRes.order.ID, model.OrderProcessed, model.MoneyFromFloat(500)).
+					Return(model.MoneyFromFloat(500), tt.storageRes.updateErr).
+					Times(1)
+			} else {
+				mockStorage.EXPECT().UpdateOrderStatus(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Times(0)
+			}
+
+			router.ServeHTTP(w, req)
+
+			resp := w.Result()
+			defer resp.Body.Close()
+
+			assert.Equal(t, tt.want.statusCode, resp.StatusCode)
+		})
+	}
+}
+
+func TestGetAgentStatus(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockStorage := mocks.NewMockStorage(ctrl)
+	mockAgent := mocks.NewMockAccrualAgent(ctrl)
+	router := NewRouter(mockStorage, RouterCfg{
+		ServiceAuth: middleware.ServiceAuthCfg{Token: "service_token", JWTKey: "service_jwt_key"},
+		Agent:       mockAgent,
+	})
+
+	agentReadJWT, err := utils.BuildServiceJWTString("service_jwt_key", "monitoring", []string{utils.ScopeAgentRead}, time.Hour)
+	require.NoError(t, err)
+	accrualsWriteJWT, err := utils.BuildServiceJWTString("service_jwt_key", "accrual", []string{utils.ScopeAccrualsWrite}, time.Hour)
+	require.NoError(t, err)
+	userJWT, err := utils.BuildJWTSting(model.User{ID: 1, Login: "testuser"})
+	require.NoError(t, err)
+	lastContactAt := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	rateLimitedUntil := lastContactAt.Add(time.Minute)
+
+	type want struct {
+		statusCode int
+		body       string
+	}
+	type agentRes struct {
+		status *model.AgentStatus
+		err    error
+	}
+
+	tests := []struct {
+		name     string
+		token    string
+		want     want
+		agentRes *agentRes
+	}{
+		{
+			name:  "Успешный запрос",
+			token: "service_token",
+			want: want{
+				statusCode: http.StatusOK,
+				body: `{"running":true,"workers":5,"backlog":{"new":3,"processing":7,"stalled":0},` +
+					`"last_contact_at":"2024-03-01T12:00:00Z","rate_limited_until":"2024-03-01T12:01:00Z","circuit":"closed"}`,
+			},
+			agentRes: &agentRes{
+				status: &model.AgentStatus{
+					Running:          true,
+					Workers:          5,
+					Backlog:          model.OrderBacklog{New: 3, Processing: 7},
+					LastContactAt:    &lastContactAt,
+					RateLimitedUntil: &rateLimitedUntil,
+					Circuit:          "closed",
+				},
+			},
+		},
+		{
+			name:  "Сервисный JWT с нужной областью доступа",
+			token: agentReadJWT,
+			want: want{
+				statusCode: http.StatusOK,
+				body:       `{"running":false,"workers":0,"backlog":{"new":0,"processing":1,"stalled":0},"circuit":"closed"}`,
+			},
+			agentRes: &agentRes{
+				status: &model.AgentStatus{Backlog: model.OrderBacklog{New: 0, Processing: 1}, Circuit: "closed"},
+			},
+		},
+		{
+			name:  "Сервисный JWT без нужной области доступа",
+			token: accrualsWriteJWT,
+			want: want{
+				statusCode: http.StatusForbidden,
+			},
+			agentRes: nil,
+		},
+		{
+			name:  "JWT пользователя",
+			token: userJWT,
+			want: want{
+				statusCode: http.StatusUnauthorized,
+			},
+			agentRes: nil,
+		},
+		{
+			name:  "Неверный токен",
+			token: "wrong_token",
+			want: want{
+				statusCode: http.StatusUnauthorized,
+			},
+			agentRes: nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/api/internal/agent/status", nil)
+			req.Header.Set("Authorization", "Bearer "+tt.token)
+			w := httptest.NewRecorder()
+
+			if tt.agentRes != nil {
+				mockAgent.EXPECT().
+					Status(gomock.Any()).
+					Return(tt.agentRes.status, tt.agentRes.err).
+					Times(1)
+			} else {
+				mockAgent.EXPECT().Status(gomock.Any()).Times(0)
+			}
+
+			router.ServeHTTP(w, req)
+
+			resp := w.Result()
+			defer resp.Body.Close()
+
+			assert.Equal(t, tt.want.statusCode, resp.StatusCode)
+
+			if tt.want.body != "" {
+				resBody, readErr := io.ReadAll(resp.Body)
+				require.NoError(t, readErr)
+				assert.JSONEq(t, tt.want.body, string(resBody))
+			}
+		})
+	}
+}
+
+func TestUnlockUser(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockStorage := mocks.NewMockStorage(ctrl)
+	router := NewRouter(mockStorage, RouterCfg{ServiceAuth: middleware.ServiceAuthCfg{JWTKey: "service_jwt_key"}})
+
+	usersWriteJWT, err := utils.BuildServiceJWTString("service_jwt_key", "admin", []string{utils.ScopeUsersWrite}, time.Hour)
+	require.NoError(t, err)
+	agentReadJWT, err := utils.BuildServiceJWTString("service_jwt_key", "monitoring", []string{utils.ScopeAgentRead}, time.Hour)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name       string
+		token      string
+		storageErr error
+		callStore  bool
+		statusCode int
+	}{
+		{
+			name:       "Успешный запрос",
+			token:      usersWriteJWT,
+			callStore:  true,
+			statusCode: http.StatusOK,
+		},
+		{
+			name:       "Пользователь не найден",
+			token:      usersWriteJWT,
+			storageErr: storage.ErrNoUser,
+			callStore:  true,
+			statusCode: http.StatusNotFound,
+		},
+		{
+			name:       "Нет области доступа",
+			token:      agentReadJWT,
+			callStore:  false,
+			statusCode: http.StatusForbidden,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.callStore {
+				mockStorage.EXPECT().UnlockUser(gomock.Any(), "testuser").Return(tt.storageErr).Times(1)
+			} else {
+				mockStorage.EXPECT().UnlockUser(gomock.Any(), gomock.Any()).Times(0)
+			}
+
+			req := httptest.NewRequest(http.MethodPost, "/api/internal/users/testuser/unlock", nil)
+			req.Header.Set("Authorization", "Bearer "+tt.token)
+			w := httptest.NewRecorder()
+
+			router.ServeHTTP(w, req)
+
+			resp := w.Result()
+			defer resp.Body.Close()
+
+			assert.Equal(t, tt.statusCode, resp.StatusCode)
+		})
+	}
+}
+
+func TestRequeueOrder(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockStorage := mocks.NewMockStorage(ctrl)
+	router := NewRouter(mockStorage, RouterCfg{ServiceAuth: middleware.ServiceAuthCfg{JWTKey: "service_jwt_key"}})
+
+	ordersWriteJWT, err := utils.BuildServiceJWTString("service_jwt_key", "admin", []string{utils.ScopeOrdersWrite}, time.Hour)
+	require.NoError(t, err)
+	usersWriteJWT, err := utils.BuildServiceJWTString("service_jwt_key", "admin", []string{utils.ScopeUsersWrite}, time.Hour)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name       string
+		token      string
+		storageErr error
+		callStore  bool
+		statusCode int
+	}{
+		{
+			name:       "Заказ возвращен в обработку",
+			token:      ordersWriteJWT,
+			callStore:  true,
+			statusCode: http.StatusOK,
+		},
+		{
+			name:       "Заказ не найден",
+			token:      ordersWriteJWT,
+			storageErr: storage.ErrNoOrder,
+			callStore:  true,
+			statusCode: http.StatusNotFound,
+		},
+		{
+			name:       "Заказ не в статусе STALLED",
+			token:      ordersWriteJWT,
+			storageErr: storage.ErrOrderNotStalled,
+			callStore:  true,
+			statusCode: http.StatusConflict,
+		},
+		{
+			name:       "Ошибка хранилища",
+			token:      ordersWriteJWT,
+			storageErr: errors.New("db error"),
+			callStore:  true,
+			statusCode: http.StatusInternalServerError,
+		},
+		{
+			name:       "Нет области доступа",
+			token:      usersWriteJWT,
+			callStore:  false,
+			statusCode: http.StatusForbidden,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.callStore {
+				mockStorage.EXPECT().RequeueOrder(gomock.Any(), "12345678903").Return(tt.storageErr).Times(1)
+			} else {
+				mockStorage.EXPECT().RequeueOrder(gomock.Any(), gomock.Any()).Times(0)
+			}
+
+			req := httptest.NewRequest(http.MethodPost, "/api/internal/orders/12345678903/requeue", nil)
+			req.Header.Set("Authorization", "Bearer "+tt.token)
+			w := httptest.NewRecorder()
+
+			router.ServeHTTP(w, req)
+
+			resp := w.Result()
+			defer resp.Body.Close()
+
+			assert.Equal(t, tt.statusCode, resp.StatusCode)
+		})
+	}
+}
+
+func TestSetCurrencyRate(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockStorage := mocks.NewMockStorage(ctrl)
+	router := NewRouter(mockStorage, RouterCfg{ServiceAuth: middleware.ServiceAuthCfg{JWTKey: "service_jwt_key"}})
+
+	ratesWriteJWT, err := utils.BuildServiceJWTString("service_jwt_key", "admin", []string{utils.ScopeRatesWrite}, time.Hour)
+	require.NoError(t, err)
+	usersWriteJWT, err := utils.BuildServiceJWTString("service_jwt_key", "admin", []string{utils.ScopeUsersWrite}, time.Hour)
+	require.NoError(t, err)
+
+	effectiveFrom := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name       string
+		token      string
+		body       string
+		wantRate   *model.CurrencyRate
+		statusCode int
+	}{
+		{
+			name:       "Курс с датой начала действия",
+			token:      ratesWriteJWT,
+			body:       `{"currency":"RUB","rate":1.5,"effective_from":"2024-06-01T00:00:00Z"}`,
+			wantRate:   &model.CurrencyRate{Currency: "RUB", Rate: 1.5, EffectiveFrom: effectiveFrom},
+			statusCode: http.StatusOK,
+		},
+		{
+			name:       "Некорректный код валюты",
+			token:      ratesWriteJWT,
+			body:       `{"currency":"rub","rate":1.5}`,
+			statusCode: http.StatusBadRequest,
+		},
+		{
+			name:       "Некорректный курс",
+			token:      ratesWriteJWT,
+			body:       `{"currency":"RUB","rate":0}`,
+			statusCode: http.StatusBadRequest,
+		},
+		{
+			name:       "Нет области доступа",
+			token:      usersWriteJWT,
+			body:       `{"currency":"RUB","rate":1.5}`,
+			statusCode: http.StatusForbidden,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.wantRate != nil {
+				mockStorage.EXPECT().SetCurrencyRate(gomock.Any(), *tt.wantRate).Return(nil).Times(1)
+			}
+
+			req := httptest.NewRequest(http.MethodPost, "/api/internal/currency-rates", strings.NewReader(tt.body))
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("Authorization", "Bearer "+tt.token)
+			w := httptest.NewRecorder()
+
+			router.ServeHTTP(w, req)
+
+			resp := w.Result()
+			defer resp.Body.Close()
+
+			assert.Equal(t, tt.statusCode, resp.StatusCode)
+		})
+	}
+}
+
+func TestInternalIPAllowlist(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockStorage := mocks.NewMockStorage(ctrl)
+	allowlist, err := middleware.NewIPAllowlist(middleware.IPAllowlistCfg{
+		Allowed:        []string{"10.0.0.0/8", "127.0.0.1"},
+		TrustedProxies: []string{"192.168.0.10"},
+	})
+	require.NoError(t, err)
+	router := NewRouter(mockStorage, RouterCfg{
+		ServiceAuth:   middleware.ServiceAuthCfg{Token: "service_token"},
+		PrivilegedIPs: allowlist,
+	})
+
+	tests := []struct {
+		name         string
+		remoteAddr   string
+		forwardedFor string
+		statusCode   int
+	}{
+		{
+			name:       "Адрес из разрешенной подсети",
+			remoteAddr: "10.1.2.3:5000",
+			statusCode: http.StatusOK,
+		},
+		{
+			name:       "Адрес вне разрешенных подсетей",
+			remoteAddr: "203.0.113.5:5000",
+			statusCode: http.StatusForbidden,
+		},
+		{
+			name:         "X-Forwarded-For от недоверенного клиента игнорируется",
+			remoteAddr:   "203.0.113.5:5000",
+			forwardedFor: "10.1.2.3",
+			statusCode:   http.StatusForbidden,
+		},
+		{
+			name:         "Клиент за доверенным прокси",
+			remoteAddr:   "192.168.0.10:5000",
+			forwardedFor: "203.0.113.5, 127.0.0.1",
+			statusCode:   http.StatusOK,
+		},
+		{
+			name:         "Подмена адреса клиентом за доверенным прокси",
+			remoteAddr:   "192.168.0.10:5000",
+			forwardedFor: "10.1.2.3, 203.0.113.5",
+			statusCode:   http.StatusForbidden,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.statusCode == http.StatusOK {
+				mockStorage.EXPECT().UnlockUser(gomock.Any(), "testuser").Return(nil).Times(1)
+			}
+
+			req := httptest.NewRequest(http.MethodPost, "/api/internal/users/testuser/unlock", nil)
+			req.RemoteAddr = tt.remoteAddr
+			if tt.forwardedFor != "" {
+				req.Header.Set("X-Forwarded-For", tt.forwardedFor)
+			}
+			req.Header.Set("Authorization", "Bearer service_token")
+			w := httptest.NewRecorder()
+
+			router.ServeHTTP(w, req)
+
+			resp := w.Result()
+			defer resp.Body.Close()
+
+			assert.Equal(t, tt.statusCode, resp.StatusCode)
+		})
+	}
+}
+
+func TestSignedServiceRequest(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockStorage := mocks.NewMockStorage(ctrl)
+	router := NewRouter(mockStorage, RouterCfg{ServiceAuth: middleware.ServiceAuthCfg{
+		Signed: middleware.SignedRequestsCfg{
+			Keys:   map[string]string{"merchant": "merchant_secret"},
+			Window: 5 * time.Minute,
+			Nonces: nonce.NewMemoryStore(),
+		},
+	}})
+
+	const path = "/api/internal/users/testuser/unlock"
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	expired := strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10)
+
+	tests := []struct {
+		name       string
+		apiKey     string
+		timestamp  string
+		nonce      string
+		signWith   string
+		callStore  bool
+		statusCode int
+	}{
+		{
+			name:       "Успешный запрос",
+			apiKey:     "merchant",
+			timestamp:  now,
+			nonce:      "nonce-1",
+			signWith:   "merchant_secret",
+			callStore:  true,
+			statusCode: http.StatusOK,
+		},
+		{
+			name:       "Повтор запроса",
+			apiKey:     "merchant",
+			timestamp:  now,
+			nonce:      "nonce-1",
+			signWith:   "merchant_secret",
+			statusCode: http.StatusUnauthorized,
+		},
+		{
+			name:       "Неверная подпись",
+			apiKey:     "merchant",
+			timestamp:  now,
+			nonce:      "nonce-2",
+			signWith:   "wrong_secret",
+			statusCode: http.StatusUnauthorized,
+		},
+		{
+			name:       "Устаревшая подпись",
+			apiKey:     "merchant",
+			timestamp:  expired,
+			nonce:      "nonce-3",
+			signWith:   "merchant_secret",
+			statusCode: http.StatusUnauthorized,
+		},
+		{
+			name:       "Неизвестный ключ",
+			apiKey:     "unknown",
+			timestamp:  now,
+			nonce:      "nonce-4",
+			signWith:   "merchant_secret",
+			statusCode: http.StatusUnauthorized,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.callStore {
+				mockStorage.EXPECT().UnlockUser(gomock.Any(), "testuser").Return(nil).Times(1)
+			} else {
+				mockStorage.EXPECT().UnlockUser(gomock.Any(), gomock.Any()).Times(0)
+			}
+
+			req := httptest.NewRequest(http.MethodPost, path, nil)
+			req.Header.Set(middleware.APIKeyHeader, tt.apiKey)
+			req.Header.Set(middleware.TimestampHeader, tt.timestamp)
+			req.Header.Set(middleware.NonceHeader, tt.nonce)
+			req.Header.Set(middleware.SignatureHeader,
+				middleware.RequestSignature(tt.signWith, http.MethodPost, path, tt.timestamp, tt.nonce, nil))
+			w := httptest.NewRecorder()
+
+			router.ServeHTTP(w, req)
+
+			resp := w.Result()
+			defer resp.Body.Close()
+
+			assert.Equal(t, tt.statusCode, resp.StatusCode)
+		})
+	}
+}
@@ -0,0 +1,23 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/pinbrain/gophermart/internal/logger"
+	"github.com/pinbrain/gophermart/internal/utils"
+)
+
+// Как долго другие сервисы могут кэшировать набор ключей. Новый ключ подписи нужно публиковать
+// заранее, добавив его в конец списка ключей, чтобы кэши успели обновиться до ротации.
+const jwksMaxAge = "300"
+
+// GetJWKS отдает открытые ключи, которыми другие сервисы проверяют JWT пользователей
+func GetJWKS(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age="+jwksMaxAge)
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(utils.PublicJWKS()); err != nil {
+		logger.Log.WithError(err).Error("Error in encoding jwks response to json")
+	}
+}
@@ -0,0 +1,208 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"strings"
+	"time"
+
+	"github.com/pinbrain/gophermart/internal/logger"
+	"github.com/pinbrain/gophermart/internal/model"
+	"github.com/pinbrain/gophermart/internal/storage"
+	"github.com/pinbrain/gophermart/internal/utils"
+	"github.com/sirupsen/logrus"
+)
+
+// Срок действия кода подтверждения входа с нового устройства
+const loginVerificationTTL = 15 * time.Minute
+
+// LoginNotifier уведомляет внешние системы о подозрительных входах
+type LoginNotifier interface {
+	NotifySuspiciousLogin(ctx context.Context, event model.SuspiciousLoginEvent) error
+}
+
+type SuspiciousLoginCfg struct {
+	// Отслеживать устройства и подсети, из которых входят пользователи
+	Enabled bool
+	// Дополнительное уведомление о подозрительных входах, nil - только запись в лог и письмо пользователю
+	Notifier LoginNotifier
+	// Требовать подтверждения входа с нового устройства кодом из письма. Действует только
+	// для пользователей с подтвержденным email, остальным приходит лишь уведомление.
+	RequireVerification bool
+}
+
+// newLoginDevice описывает устройство клиента. Подсеть берется /24 для IPv4 и /48 для IPv6:
+// адрес внутри подсети провайдера меняется часто, а смена подсети говорит о смене места.
+func newLoginDevice(ip, userAgent string) model.LoginDevice {
+	device := model.LoginDevice{IP: ip, UserAgent: userAgent, Network: ip}
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return device
+	}
+	addr = addr.Unmap()
+	bits := 48
+	if addr.Is4() {
+		bits = 24
+	}
+	if prefix, err := addr.Prefix(bits); err == nil {
+		device.Network = prefix.String()
+	}
+	return device
+}
+
+// checkSuspiciousLogin сравнивает устройство с устройствами прошлых входов пользователя и при входе
+// с нового устройства или из новой подсети уведомляет о нем. Если требуется подтверждение входа,
+// отправляет код на email и сам отвечает клиенту, в этом случае возвращает true.
+func (h *UserHandler) checkSuspiciousLogin(w http.ResponseWriter, r *http.Request, user model.User) bool {
+	ctx := r.Context()
+	device := newLoginDevice(clientIP(r), r.UserAgent())
+	check, err := h.storage.CheckLoginDevice(ctx, user.ID, device)
+	if err != nil {
+		// Недоступность проверки не должна блокировать вход
+		logger.Log.WithError(err).Error("failed to check login device")
+		return false
+	}
+	if check.Suspicious() {
+		h.notifySuspiciousLogin(ctx, user, device, check)
+
+		email := h.verifiedEmail(ctx, user.ID)
+		if email != "" && h.suspiciousLogin.RequireVerification {
+			h.sendLoginVerification(w, r, user.ID, email, device)
+			return true
+		}
+		if email != "" {
+			body := fmt.Sprintf(
+				"Выполнен вход в учетную запись %s с нового устройства или из новой сети.\nIP: %s\nУстройство: %s\n"+
+					"Если это были не вы, смените пароль и завершите остальные сессии.",
+				user.Login, device.IP, device.UserAgent,
+			)
+			if err = h.mailer.Send(ctx, email, "Вход с нового устройства", body); err != nil {
+				logger.Log.WithError(err).Error("failed to send suspicious login email")
+			}
+		}
+	}
+	if err = h.storage.RememberLoginDevice(ctx, user.ID, device); err != nil {
+		logger.Log.WithError(err).Error("failed to remember login device")
+	}
+	return false
+}
+
+func (h *UserHandler) notifySuspiciousLogin(
+	ctx context.Context, user model.User, device model.LoginDevice, check model.LoginDeviceCheck,
+) {
+	event := model.SuspiciousLoginEvent{
+		UserID:     user.ID,
+		Login:      user.Login,
+		IP:         device.IP,
+		UserAgent:  device.UserAgent,
+		NewDevice:  check.NewDevice,
+		NewNetwork: check.NewNetwork,
+		CreatedAt:  time.Now(),
+	}
+	logger.Log.WithFields(logrus.Fields{
+		"user_id":     event.UserID,
+		"ip":          event.IP,
+		"user_agent":  event.UserAgent,
+		"new_device":  event.NewDevice,
+		"new_network": event.NewNetwork,
+	}).Warn("Suspicious login")
+	if h.suspiciousLogin.Notifier == nil {
+		return
+	}
+	if err := h.suspiciousLogin.Notifier.NotifySuspiciousLogin(ctx, event); err != nil {
+		logger.Log.WithError(err).Error("failed to notify about suspicious login")
+	}
+}
+
+// verifiedEmail возвращает подтвержденный email пользователя или пустую строку,
+// если его нет или письма не отправляются
+func (h *UserHandler) verifiedEmail(ctx context.Context, userID int) string {
+	if h.mailer == nil {
+		return ""
+	}
+	dbUser, err := h.storage.GetUserByID(ctx, userID)
+	if err != nil {
+		logger.Log.WithError(err).Error("failed to get user email")
+		return ""
+	}
+	if !dbUser.EmailVerified {
+		return ""
+	}
+	return dbUser.Email
+}
+
+// sendLoginVerification отправляет на email код подтверждения входа. Вход без подтверждения
+// не выполняется, поэтому ошибки отправки возвращаются клиенту.
+func (h *UserHandler) sendLoginVerification(
+	w http.ResponseWriter, r *http.Request, userID int, email string, device model.LoginDevice,
+) {
+	token, tokenHash, err := utils.GenerateVerificationToken()
+	if err != nil {
+		logger.Log.WithError(err).Error("failed to send login verification")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	err = h.storage.CreateLoginVerification(r.Context(), userID, device, tokenHash, time.Now().Add(loginVerificationTTL))
+	if err != nil {
+		logger.Log.WithError(err).Error("failed to send login verification")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	body := fmt.Sprintf(
+		"Для входа с нового устройства (IP %s) введите код: %s\nКод действителен %s. "+
+			"Если это были не вы, смените пароль.",
+		device.IP, token, loginVerificationTTL,
+	)
+	if err = h.mailer.Send(r.Context(), email, "Подтверждение входа", body); err != nil {
+		logger.Log.WithError(err).Error("failed to send login verification")
+		http.Error(w, "Не удалось отправить письмо", http.StatusBadGateway)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	enc := json.NewEncoder(w)
+	if err = enc.Encode(model.LoginVerificationRes{VerificationRequired: true}); err != nil {
+		logger.Log.WithError(err).Error("Error in encoding login verification response to json")
+	}
+}
+
+// ConfirmLogin завершает вход с нового устройства по коду из письма
+func (h *UserHandler) ConfirmLogin(w http.ResponseWriter, r *http.Request) {
+	contentType := r.Header.Get("Content-Type")
+	if !strings.Contains(contentType, "application/json") {
+		http.Error(w, "Некорректный Content-Type", http.StatusBadRequest)
+		return
+	}
+	var req model.LoginConfirmReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Token == "" {
+		http.Error(w, "Не передан код подтверждения", http.StatusBadRequest)
+		return
+	}
+
+	user, device, err := h.storage.ConfirmLoginVerification(r.Context(), utils.HashVerificationToken(req.Token))
+	if err != nil {
+		if errors.Is(err, storage.ErrInvalidLoginVerification) {
+			http.Error(w, "Код подтверждения недействителен или истек", http.StatusUnauthorized)
+			return
+		}
+		logger.Log.WithError(err).Error("failed to confirm login")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if err = h.storage.RememberLoginDevice(r.Context(), user.ID, newLoginDevice(device.IP, device.UserAgent)); err != nil {
+		logger.Log.WithError(err).Error("failed to remember login device")
+	}
+	authRes, err := h.issueTokens(r, *user)
+	if err != nil {
+		logger.Log.WithError(err).Error("failed to confirm login")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	h.recordAuthEvent(r, user.ID, model.AuthEventLogin)
+	h.writeAuthRes(w, authRes)
+}
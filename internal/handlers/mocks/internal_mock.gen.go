@@ -0,0 +1,51 @@
+// Code generated by MockGen. DO NOT EDIT.
+// Source: internal/handlers/internal.go
+
+// Package mocks is a generated GoMock package.
+package mocks
+
+import (
+	context "context"
+	reflect "reflect"
+
+	gomock "github.com/golang/mock/gomock"
+	model "github.com/pinbrain/gophermart/internal/model"
+)
+
+// MockAccrualAgent is a mock of AccrualAgent interface.
+type MockAccrualAgent struct {
+	ctrl     *gomock.Controller
+	recorder *MockAccrualAgentMockRecorder
+}
+
+// MockAccrualAgentMockRecorder is the mock recorder for MockAccrualAgent.
+type MockAccrualAgentMockRecorder struct {
+	mock *MockAccrualAgent
+}
+
+// NewMockAccrualAgent creates a new mock instance.
+func NewMockAccrualAgent(ctrl *gomock.Controller) *MockAccrualAgent {
+	mock := &MockAccrualAgent{ctrl: ctrl}
+	mock.recorder = &MockAccrualAgentMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use.
+func (m *MockAccrualAgent) EXPECT() *MockAccrualAgentMockRecorder {
+	return m.recorder
+}
+
+// Status mocks base method.
+func (m *MockAccrualAgent) Status(ctx context.Context) (*model.AgentStatus, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Status", ctx)
+	ret0, _ := ret[0].(*model.AgentStatus)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Status indicates an expected call of Status.
+func (mr *MockAccrualAgentMockRecorder) Status(ctx interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Status", reflect.TypeOf((*MockAccrualAgent)(nil).Status), ctx)
+}
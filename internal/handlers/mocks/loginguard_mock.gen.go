@@ -0,0 +1,50 @@
+// Code generated by MockGen. DO NOT EDIT.
+// Source: internal/handlers/loginguard.go
+
+// Package mocks is a generated GoMock package.
+package mocks
+
+import (
+	context "context"
+	reflect "reflect"
+
+	gomock "github.com/golang/mock/gomock"
+	model "github.com/pinbrain/gophermart/internal/model"
+)
+
+// MockLoginNotifier is a mock of LoginNotifier interface.
+type MockLoginNotifier struct {
+	ctrl     *gomock.Controller
+	recorder *MockLoginNotifierMockRecorder
+}
+
+// MockLoginNotifierMockRecorder is the mock recorder for MockLoginNotifier.
+type MockLoginNotifierMockRecorder struct {
+	mock *MockLoginNotifier
+}
+
+// NewMockLoginNotifier creates a new mock instance.
+func NewMockLoginNotifier(ctrl *gomock.Controller) *MockLoginNotifier {
+	mock := &MockLoginNotifier{ctrl: ctrl}
+	mock.recorder = &MockLoginNotifierMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use.
+func (m *MockLoginNotifier) EXPECT() *MockLoginNotifierMockRecorder {
+	return m.recorder
+}
+
+// NotifySuspiciousLogin mocks base method.
+func (m *MockLoginNotifier) NotifySuspiciousLogin(ctx context.Context, event model.SuspiciousLoginEvent) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "NotifySuspiciousLogin", ctx, event)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// NotifySuspiciousLogin indicates an expected call of NotifySuspiciousLogin.
+func (mr *MockLoginNotifierMockRecorder) NotifySuspiciousLogin(ctx, event interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "NotifySuspiciousLogin", reflect.TypeOf((*MockLoginNotifier)(nil).NotifySuspiciousLogin), ctx, event)
+}
@@ -7,11 +7,101 @@ package mocks
 import (
 	context "context"
 	reflect "reflect"
+	time "time"
 
 	gomock "github.com/golang/mock/gomock"
 	model "github.com/pinbrain/gophermart/internal/model"
 )
 
+// MockAuthAuditLog is a mock of AuthAuditLog interface.
+type MockAuthAuditLog struct {
+	ctrl     *gomock.Controller
+	recorder *MockAuthAuditLogMockRecorder
+}
+
+// MockAuthAuditLogMockRecorder is the mock recorder for MockAuthAuditLog.
+type MockAuthAuditLogMockRecorder struct {
+	mock *MockAuthAuditLog
+}
+
+// NewMockAuthAuditLog creates a new mock instance.
+func NewMockAuthAuditLog(ctrl *gomock.Controller) *MockAuthAuditLog {
+	mock := &MockAuthAuditLog{ctrl: ctrl}
+	mock.recorder = &MockAuthAuditLogMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use.
+func (m *MockAuthAuditLog) EXPECT() *MockAuthAuditLogMockRecorder {
+	return m.recorder
+}
+
+// GetAuthEvents mocks base method.
+func (m *MockAuthAuditLog) GetAuthEvents(ctx context.Context, userID, limit int) ([]model.AuthEvent, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetAuthEvents", ctx, userID, limit)
+	ret0, _ := ret[0].([]model.AuthEvent)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetAuthEvents indicates an expected call of GetAuthEvents.
+func (mr *MockAuthAuditLogMockRecorder) GetAuthEvents(ctx, userID, limit interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetAuthEvents", reflect.TypeOf((*MockAuthAuditLog)(nil).GetAuthEvents), ctx, userID, limit)
+}
+
+// RecordAuthEvent mocks base method.
+func (m *MockAuthAuditLog) RecordAuthEvent(ctx context.Context, event model.AuthEvent) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "RecordAuthEvent", ctx, event)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// RecordAuthEvent indicates an expected call of RecordAuthEvent.
+func (mr *MockAuthAuditLogMockRecorder) RecordAuthEvent(ctx, event interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RecordAuthEvent", reflect.TypeOf((*MockAuthAuditLog)(nil).RecordAuthEvent), ctx, event)
+}
+
+// MockMailer is a mock of Mailer interface.
+type MockMailer struct {
+	ctrl     *gomock.Controller
+	recorder *MockMailerMockRecorder
+}
+
+// MockMailerMockRecorder is the mock recorder for MockMailer.
+type MockMailerMockRecorder struct {
+	mock *MockMailer
+}
+
+// NewMockMailer creates a new mock instance.
+func NewMockMailer(ctrl *gomock.Controller) *MockMailer {
+	mock := &MockMailer{ctrl: ctrl}
+	mock.recorder = &MockMailerMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use.
+func (m *MockMailer) EXPECT() *MockMailerMockRecorder {
+	return m.recorder
+}
+
+// Send mocks base method.
+func (m *MockMailer) Send(ctx context.Context, to, subject, body string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Send", ctx, to, subject, body)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Send indicates an expected call of Send.
+func (mr *MockMailerMockRecorder) Send(ctx, to, subject, body interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Send", reflect.TypeOf((*MockMailer)(nil).Send), ctx, to, subject, body)
+}
+
 // MockStorage is a mock of Storage interface.
 type MockStorage struct {
 	ctrl     *gomock.Controller
@@ -35,6 +125,80 @@ func (m *MockStorage) EXPECT() *MockStorageMockRecorder {
 	return m.recorder
 }
 
+// CancelOrder mocks base method.
+func (m *MockStorage) CancelOrder(ctx context.Context, userID int, orderNum string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "CancelOrder", ctx, userID, orderNum)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// CancelOrder indicates an expected call of CancelOrder.
+func (mr *MockStorageMockRecorder) CancelOrder(ctx, userID, orderNum interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CancelOrder", reflect.TypeOf((*MockStorage)(nil).CancelOrder), ctx, userID, orderNum)
+}
+
+// CancelWithdrawal mocks base method.
+func (m *MockStorage) CancelWithdrawal(ctx context.Context, userID, withdrawalID int) (*model.Withdrawn, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "CancelWithdrawal", ctx, userID, withdrawalID)
+	ret0, _ := ret[0].(*model.Withdrawn)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// CancelWithdrawal indicates an expected call of CancelWithdrawal.
+func (mr *MockStorageMockRecorder) CancelWithdrawal(ctx, userID, withdrawalID interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CancelWithdrawal", reflect.TypeOf((*MockStorage)(nil).CancelWithdrawal), ctx, userID, withdrawalID)
+}
+
+// CaptureHold mocks base method.
+func (m *MockStorage) CaptureHold(ctx context.Context, userID, holdID int) (*model.Hold, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "CaptureHold", ctx, userID, holdID)
+	ret0, _ := ret[0].(*model.Hold)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// CaptureHold indicates an expected call of CaptureHold.
+func (mr *MockStorageMockRecorder) CaptureHold(ctx, userID, holdID interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CaptureHold", reflect.TypeOf((*MockStorage)(nil).CaptureHold), ctx, userID, holdID)
+}
+
+// ChangePassword mocks base method.
+func (m *MockStorage) ChangePassword(ctx context.Context, userID int, passwordHash string) (int, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ChangePassword", ctx, userID, passwordHash)
+	ret0, _ := ret[0].(int)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// ChangePassword indicates an expected call of ChangePassword.
+func (mr *MockStorageMockRecorder) ChangePassword(ctx, userID, passwordHash interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ChangePassword", reflect.TypeOf((*MockStorage)(nil).ChangePassword), ctx, userID, passwordHash)
+}
+
+// CheckLoginDevice mocks base method.
+func (m *MockStorage) CheckLoginDevice(ctx context.Context, userID int, device model.LoginDevice) (model.LoginDeviceCheck, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "CheckLoginDevice", ctx, userID, device)
+	ret0, _ := ret[0].(model.LoginDeviceCheck)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// CheckLoginDevice indicates an expected call of CheckLoginDevice.
+func (mr *MockStorageMockRecorder) CheckLoginDevice(ctx, userID, device interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CheckLoginDevice", reflect.TypeOf((*MockStorage)(nil).CheckLoginDevice), ctx, userID, device)
+}
+
 // Close mocks base method.
 func (m *MockStorage) Close() {
 	m.ctrl.T.Helper()
@@ -47,11 +211,99 @@ func (mr *MockStorageMockRecorder) Close() *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Close", reflect.TypeOf((*MockStorage)(nil).Close))
 }
 
+// ConfirmEmail mocks base method.
+func (m *MockStorage) ConfirmEmail(ctx context.Context, tokenHash string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ConfirmEmail", ctx, tokenHash)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// ConfirmEmail indicates an expected call of ConfirmEmail.
+func (mr *MockStorageMockRecorder) ConfirmEmail(ctx, tokenHash interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ConfirmEmail", reflect.TypeOf((*MockStorage)(nil).ConfirmEmail), ctx, tokenHash)
+}
+
+// ConfirmLoginVerification mocks base method.
+func (m *MockStorage) ConfirmLoginVerification(ctx context.Context, tokenHash string) (*model.User, *model.LoginDevice, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ConfirmLoginVerification", ctx, tokenHash)
+	ret0, _ := ret[0].(*model.User)
+	ret1, _ := ret[1].(*model.LoginDevice)
+	ret2, _ := ret[2].(error)
+	return ret0, ret1, ret2
+}
+
+// ConfirmLoginVerification indicates an expected call of ConfirmLoginVerification.
+func (mr *MockStorageMockRecorder) ConfirmLoginVerification(ctx, tokenHash interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ConfirmLoginVerification", reflect.TypeOf((*MockStorage)(nil).ConfirmLoginVerification), ctx, tokenHash)
+}
+
+// CountArchivedOrders mocks base method.
+func (m *MockStorage) CountArchivedOrders(ctx context.Context, userID int) (int, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "CountArchivedOrders", ctx, userID)
+	ret0, _ := ret[0].(int)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// CountArchivedOrders indicates an expected call of CountArchivedOrders.
+func (mr *MockStorageMockRecorder) CountArchivedOrders(ctx, userID interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CountArchivedOrders", reflect.TypeOf((*MockStorage)(nil).CountArchivedOrders), ctx, userID)
+}
+
+// CountUserWithdrawals mocks base method.
+func (m *MockStorage) CountUserWithdrawals(ctx context.Context, userID int, query model.WithdrawalsQuery) (int, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "CountUserWithdrawals", ctx, userID, query)
+	ret0, _ := ret[0].(int)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// CountUserWithdrawals indicates an expected call of CountUserWithdrawals.
+func (mr *MockStorageMockRecorder) CountUserWithdrawals(ctx, userID, query interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CountUserWithdrawals", reflect.TypeOf((*MockStorage)(nil).CountUserWithdrawals), ctx, userID, query)
+}
+
+// CreateEmailVerification mocks base method.
+func (m *MockStorage) CreateEmailVerification(ctx context.Context, userID int, email, tokenHash string, expiresAt time.Time) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "CreateEmailVerification", ctx, userID, email, tokenHash, expiresAt)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// CreateEmailVerification indicates an expected call of CreateEmailVerification.
+func (mr *MockStorageMockRecorder) CreateEmailVerification(ctx, userID, email, tokenHash, expiresAt interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CreateEmailVerification", reflect.TypeOf((*MockStorage)(nil).CreateEmailVerification), ctx, userID, email, tokenHash, expiresAt)
+}
+
+// CreateLoginVerification mocks base method.
+func (m *MockStorage) CreateLoginVerification(ctx context.Context, userID int, device model.LoginDevice, tokenHash string, expiresAt time.Time) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "CreateLoginVerification", ctx, userID, device, tokenHash, expiresAt)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// CreateLoginVerification indicates an expected call of CreateLoginVerification.
+func (mr *MockStorageMockRecorder) CreateLoginVerification(ctx, userID, device, tokenHash, expiresAt interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CreateLoginVerification", reflect.TypeOf((*MockStorage)(nil).CreateLoginVerification), ctx, userID, device, tokenHash, expiresAt)
+}
+
 // CreateOrder mocks base method.
-func (m *MockStorage) CreateOrder(ctx context.Context, userID int, orderNum string) (int, error) {
+func (m *MockStorage) CreateOrder(ctx context.Context, userID int, orderNum string) (*model.Order, error) {
 	m.ctrl.T.Helper()
 	ret := m.ctrl.Call(m, "CreateOrder", ctx, userID, orderNum)
-	ret0, _ := ret[0].(int)
+	ret0, _ := ret[0].(*model.Order)
 	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
@@ -62,19 +314,212 @@ func (mr *MockStorageMockRecorder) CreateOrder(ctx, userID, orderNum interface{}
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CreateOrder", reflect.TypeOf((*MockStorage)(nil).CreateOrder), ctx, userID, orderNum)
 }
 
+// CreateOrders mocks base method.
+func (m *MockStorage) CreateOrders(ctx context.Context, userID int, orderNums []string) (map[string]string, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "CreateOrders", ctx, userID, orderNums)
+	ret0, _ := ret[0].(map[string]string)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// CreateOrders indicates an expected call of CreateOrders.
+func (mr *MockStorageMockRecorder) CreateOrders(ctx, userID, orderNums interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CreateOrders", reflect.TypeOf((*MockStorage)(nil).CreateOrders), ctx, userID, orderNums)
+}
+
+// CreateRefreshToken mocks base method.
+func (m *MockStorage) CreateRefreshToken(ctx context.Context, userID int, tokenHash string, expiresAt time.Time) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "CreateRefreshToken", ctx, userID, tokenHash, expiresAt)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// CreateRefreshToken indicates an expected call of CreateRefreshToken.
+func (mr *MockStorageMockRecorder) CreateRefreshToken(ctx, userID, tokenHash, expiresAt interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CreateRefreshToken", reflect.TypeOf((*MockStorage)(nil).CreateRefreshToken), ctx, userID, tokenHash, expiresAt)
+}
+
 // CreateUser mocks base method.
-func (m *MockStorage) CreateUser(ctx context.Context, login, password string) (int, error) {
+func (m *MockStorage) CreateUser(ctx context.Context, login, password, email string) (int, error) {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "CreateUser", ctx, login, password)
+	ret := m.ctrl.Call(m, "CreateUser", ctx, login, password, email)
 	ret0, _ := ret[0].(int)
 	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
 
 // CreateUser indicates an expected call of CreateUser.
-func (mr *MockStorageMockRecorder) CreateUser(ctx, login, password interface{}) *gomock.Call {
+func (mr *MockStorageMockRecorder) CreateUser(ctx, login, password, email interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CreateUser", reflect.TypeOf((*MockStorage)(nil).CreateUser), ctx, login, password, email)
+}
+
+// CreateWebhook mocks base method.
+func (m *MockStorage) CreateWebhook(ctx context.Context, userID int, url string, events []model.WebhookEventType, secret string) (*model.Webhook, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "CreateWebhook", ctx, userID, url, events, secret)
+	ret0, _ := ret[0].(*model.Webhook)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// CreateWebhook indicates an expected call of CreateWebhook.
+func (mr *MockStorageMockRecorder) CreateWebhook(ctx, userID, url, events, secret interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CreateWebhook", reflect.TypeOf((*MockStorage)(nil).CreateWebhook), ctx, userID, url, events, secret)
+}
+
+// DeleteWebhook mocks base method.
+func (m *MockStorage) DeleteWebhook(ctx context.Context, userID, webhookID int) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "DeleteWebhook", ctx, userID, webhookID)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// DeleteWebhook indicates an expected call of DeleteWebhook.
+func (mr *MockStorageMockRecorder) DeleteWebhook(ctx, userID, webhookID interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DeleteWebhook", reflect.TypeOf((*MockStorage)(nil).DeleteWebhook), ctx, userID, webhookID)
+}
+
+// GetArchivedOrders mocks base method.
+func (m *MockStorage) GetArchivedOrders(ctx context.Context, userID, limit, offset int) ([]model.Order, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetArchivedOrders", ctx, userID, limit, offset)
+	ret0, _ := ret[0].([]model.Order)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetArchivedOrders indicates an expected call of GetArchivedOrders.
+func (mr *MockStorageMockRecorder) GetArchivedOrders(ctx, userID, limit, offset interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CreateUser", reflect.TypeOf((*MockStorage)(nil).CreateUser), ctx, login, password)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetArchivedOrders", reflect.TypeOf((*MockStorage)(nil).GetArchivedOrders), ctx, userID, limit, offset)
+}
+
+// GetBalanceHistory mocks base method.
+func (m *MockStorage) GetBalanceHistory(ctx context.Context, userID int) ([]model.BalanceHistoryEntry, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetBalanceHistory", ctx, userID)
+	ret0, _ := ret[0].([]model.BalanceHistoryEntry)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetBalanceHistory indicates an expected call of GetBalanceHistory.
+func (mr *MockStorageMockRecorder) GetBalanceHistory(ctx, userID interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetBalanceHistory", reflect.TypeOf((*MockStorage)(nil).GetBalanceHistory), ctx, userID)
+}
+
+// GetCurrencyRates mocks base method.
+func (m *MockStorage) GetCurrencyRates(ctx context.Context, currency string) ([]model.CurrencyRate, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetCurrencyRates", ctx, currency)
+	ret0, _ := ret[0].([]model.CurrencyRate)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetCurrencyRates indicates an expected call of GetCurrencyRates.
+func (mr *MockStorageMockRecorder) GetCurrencyRates(ctx, currency interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetCurrencyRates", reflect.TypeOf((*MockStorage)(nil).GetCurrencyRates), ctx, currency)
+}
+
+// GetLifetimeAccrual mocks base method.
+func (m *MockStorage) GetLifetimeAccrual(ctx context.Context, userID int) (model.Money, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetLifetimeAccrual", ctx, userID)
+	ret0, _ := ret[0].(model.Money)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetLifetimeAccrual indicates an expected call of GetLifetimeAccrual.
+func (mr *MockStorageMockRecorder) GetLifetimeAccrual(ctx, userID interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetLifetimeAccrual", reflect.TypeOf((*MockStorage)(nil).GetLifetimeAccrual), ctx, userID)
+}
+
+// GetMonthlyStats mocks base method.
+func (m *MockStorage) GetMonthlyStats(ctx context.Context, userID int, since time.Time) ([]model.MonthlyStats, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetMonthlyStats", ctx, userID, since)
+	ret0, _ := ret[0].([]model.MonthlyStats)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetMonthlyStats indicates an expected call of GetMonthlyStats.
+func (mr *MockStorageMockRecorder) GetMonthlyStats(ctx, userID, since interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetMonthlyStats", reflect.TypeOf((*MockStorage)(nil).GetMonthlyStats), ctx, userID, since)
+}
+
+// GetOrderByNum mocks base method.
+func (m *MockStorage) GetOrderByNum(ctx context.Context, orderNum string) (*model.Order, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetOrderByNum", ctx, orderNum)
+	ret0, _ := ret[0].(*model.Order)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetOrderByNum indicates an expected call of GetOrderByNum.
+func (mr *MockStorageMockRecorder) GetOrderByNum(ctx, orderNum interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetOrderByNum", reflect.TypeOf((*MockStorage)(nil).GetOrderByNum), ctx, orderNum)
+}
+
+// GetOrderStatusHistory mocks base method.
+func (m *MockStorage) GetOrderStatusHistory(ctx context.Context, orderID int) ([]model.OrderStatusChange, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetOrderStatusHistory", ctx, orderID)
+	ret0, _ := ret[0].([]model.OrderStatusChange)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetOrderStatusHistory indicates an expected call of GetOrderStatusHistory.
+func (mr *MockStorageMockRecorder) GetOrderStatusHistory(ctx, orderID interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetOrderStatusHistory", reflect.TypeOf((*MockStorage)(nil).GetOrderStatusHistory), ctx, orderID)
+}
+
+// GetStatement mocks base method.
+func (m *MockStorage) GetStatement(ctx context.Context, userID int, from, to time.Time) (*model.Statement, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetStatement", ctx, userID, from, to)
+	ret0, _ := ret[0].(*model.Statement)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetStatement indicates an expected call of GetStatement.
+func (mr *MockStorageMockRecorder) GetStatement(ctx, userID, from, to interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetStatement", reflect.TypeOf((*MockStorage)(nil).GetStatement), ctx, userID, from, to)
+}
+
+// GetTransfers mocks base method.
+func (m *MockStorage) GetTransfers(ctx context.Context, userID int) ([]model.Transfer, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetTransfers", ctx, userID)
+	ret0, _ := ret[0].([]model.Transfer)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetTransfers indicates an expected call of GetTransfers.
+func (mr *MockStorageMockRecorder) GetTransfers(ctx, userID interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetTransfers", reflect.TypeOf((*MockStorage)(nil).GetTransfers), ctx, userID)
 }
 
 // GetUserBalance mocks base method.
@@ -92,6 +537,36 @@ func (mr *MockStorageMockRecorder) GetUserBalance(ctx, userID interface{}) *gomo
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetUserBalance", reflect.TypeOf((*MockStorage)(nil).GetUserBalance), ctx, userID)
 }
 
+// GetUserBalanceAt mocks base method.
+func (m *MockStorage) GetUserBalanceAt(ctx context.Context, userID int, at time.Time) (*model.Balance, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetUserBalanceAt", ctx, userID, at)
+	ret0, _ := ret[0].(*model.Balance)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetUserBalanceAt indicates an expected call of GetUserBalanceAt.
+func (mr *MockStorageMockRecorder) GetUserBalanceAt(ctx, userID, at interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetUserBalanceAt", reflect.TypeOf((*MockStorage)(nil).GetUserBalanceAt), ctx, userID, at)
+}
+
+// GetUserByID mocks base method.
+func (m *MockStorage) GetUserByID(ctx context.Context, userID int) (*model.User, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetUserByID", ctx, userID)
+	ret0, _ := ret[0].(*model.User)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetUserByID indicates an expected call of GetUserByID.
+func (mr *MockStorageMockRecorder) GetUserByID(ctx, userID interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetUserByID", reflect.TypeOf((*MockStorage)(nil).GetUserByID), ctx, userID)
+}
+
 // GetUserByLogin mocks base method.
 func (m *MockStorage) GetUserByLogin(ctx context.Context, login string) (*model.User, error) {
 	m.ctrl.T.Helper()
@@ -107,46 +582,292 @@ func (mr *MockStorageMockRecorder) GetUserByLogin(ctx, login interface{}) *gomoc
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetUserByLogin", reflect.TypeOf((*MockStorage)(nil).GetUserByLogin), ctx, login)
 }
 
-// GetUserOrders mocks base method.
-func (m *MockStorage) GetUserOrders(ctx context.Context, userID int) ([]model.Order, error) {
+// GetUserOrdersSummary mocks base method.
+func (m *MockStorage) GetUserOrdersSummary(ctx context.Context, userID int, query model.OrdersQuery) (*model.OrdersSummary, error) {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "GetUserOrders", ctx, userID)
-	ret0, _ := ret[0].([]model.Order)
+	ret := m.ctrl.Call(m, "GetUserOrdersSummary", ctx, userID, query)
+	ret0, _ := ret[0].(*model.OrdersSummary)
 	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
 
-// GetUserOrders indicates an expected call of GetUserOrders.
-func (mr *MockStorageMockRecorder) GetUserOrders(ctx, userID interface{}) *gomock.Call {
+// GetUserOrdersSummary indicates an expected call of GetUserOrdersSummary.
+func (mr *MockStorageMockRecorder) GetUserOrdersSummary(ctx, userID, query interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetUserOrders", reflect.TypeOf((*MockStorage)(nil).GetUserOrders), ctx, userID)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetUserOrdersSummary", reflect.TypeOf((*MockStorage)(nil).GetUserOrdersSummary), ctx, userID, query)
+}
+
+// GetWebhooks mocks base method.
+func (m *MockStorage) GetWebhooks(ctx context.Context, userID int) ([]model.Webhook, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetWebhooks", ctx, userID)
+	ret0, _ := ret[0].([]model.Webhook)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetWebhooks indicates an expected call of GetWebhooks.
+func (mr *MockStorageMockRecorder) GetWebhooks(ctx, userID interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetWebhooks", reflect.TypeOf((*MockStorage)(nil).GetWebhooks), ctx, userID)
 }
 
 // GetWithdrawals mocks base method.
-func (m *MockStorage) GetWithdrawals(ctx context.Context, userID int) ([]model.Withdrawn, error) {
+func (m *MockStorage) GetWithdrawals(ctx context.Context, userID int, query model.WithdrawalsQuery) ([]model.Withdrawn, error) {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "GetWithdrawals", ctx, userID)
+	ret := m.ctrl.Call(m, "GetWithdrawals", ctx, userID, query)
 	ret0, _ := ret[0].([]model.Withdrawn)
 	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
 
 // GetWithdrawals indicates an expected call of GetWithdrawals.
-func (mr *MockStorageMockRecorder) GetWithdrawals(ctx, userID interface{}) *gomock.Call {
+func (mr *MockStorageMockRecorder) GetWithdrawals(ctx, userID, query interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetWithdrawals", reflect.TypeOf((*MockStorage)(nil).GetWithdrawals), ctx, userID, query)
+}
+
+// HoldBalance mocks base method.
+func (m *MockStorage) HoldBalance(ctx context.Context, userID int, order string, sum model.Money, ttl time.Duration) (*model.Hold, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "HoldBalance", ctx, userID, order, sum, ttl)
+	ret0, _ := ret[0].(*model.Hold)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// HoldBalance indicates an expected call of HoldBalance.
+func (mr *MockStorageMockRecorder) HoldBalance(ctx, userID, order, sum, ttl interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "HoldBalance", reflect.TypeOf((*MockStorage)(nil).HoldBalance), ctx, userID, order, sum, ttl)
+}
+
+// LoginWithIdentity mocks base method.
+func (m *MockStorage) LoginWithIdentity(ctx context.Context, identity model.ExternalIdentity, linkByEmail bool) (*model.User, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "LoginWithIdentity", ctx, identity, linkByEmail)
+	ret0, _ := ret[0].(*model.User)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// LoginWithIdentity indicates an expected call of LoginWithIdentity.
+func (mr *MockStorageMockRecorder) LoginWithIdentity(ctx, identity, linkByEmail interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "LoginWithIdentity", reflect.TypeOf((*MockStorage)(nil).LoginWithIdentity), ctx, identity, linkByEmail)
+}
+
+// RegisterFailedLogin mocks base method.
+func (m *MockStorage) RegisterFailedLogin(ctx context.Context, userID, maxFailures int, lockFor time.Duration) (time.Time, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "RegisterFailedLogin", ctx, userID, maxFailures, lockFor)
+	ret0, _ := ret[0].(time.Time)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// RegisterFailedLogin indicates an expected call of RegisterFailedLogin.
+func (mr *MockStorageMockRecorder) RegisterFailedLogin(ctx, userID, maxFailures, lockFor interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RegisterFailedLogin", reflect.TypeOf((*MockStorage)(nil).RegisterFailedLogin), ctx, userID, maxFailures, lockFor)
+}
+
+// ReleaseHold mocks base method.
+func (m *MockStorage) ReleaseHold(ctx context.Context, userID, holdID int) (*model.Hold, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ReleaseHold", ctx, userID, holdID)
+	ret0, _ := ret[0].(*model.Hold)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// ReleaseHold indicates an expected call of ReleaseHold.
+func (mr *MockStorageMockRecorder) ReleaseHold(ctx, userID, holdID interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ReleaseHold", reflect.TypeOf((*MockStorage)(nil).ReleaseHold), ctx, userID, holdID)
+}
+
+// RememberLoginDevice mocks base method.
+func (m *MockStorage) RememberLoginDevice(ctx context.Context, userID int, device model.LoginDevice) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "RememberLoginDevice", ctx, userID, device)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// RememberLoginDevice indicates an expected call of RememberLoginDevice.
+func (mr *MockStorageMockRecorder) RememberLoginDevice(ctx, userID, device interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RememberLoginDevice", reflect.TypeOf((*MockStorage)(nil).RememberLoginDevice), ctx, userID, device)
+}
+
+// RequeueOrder mocks base method.
+func (m *MockStorage) RequeueOrder(ctx context.Context, orderNum string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "RequeueOrder", ctx, orderNum)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// RequeueOrder indicates an expected call of RequeueOrder.
+func (mr *MockStorageMockRecorder) RequeueOrder(ctx, orderNum interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RequeueOrder", reflect.TypeOf((*MockStorage)(nil).RequeueOrder), ctx, orderNum)
+}
+
+// ResetFailedLogins mocks base method.
+func (m *MockStorage) ResetFailedLogins(ctx context.Context, userID int) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ResetFailedLogins", ctx, userID)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// ResetFailedLogins indicates an expected call of ResetFailedLogins.
+func (mr *MockStorageMockRecorder) ResetFailedLogins(ctx, userID interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ResetFailedLogins", reflect.TypeOf((*MockStorage)(nil).ResetFailedLogins), ctx, userID)
+}
+
+// RetryOrder mocks base method.
+func (m *MockStorage) RetryOrder(ctx context.Context, userID int, orderNum string, maxRetries int) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "RetryOrder", ctx, userID, orderNum, maxRetries)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// RetryOrder indicates an expected call of RetryOrder.
+func (mr *MockStorageMockRecorder) RetryOrder(ctx, userID, orderNum, maxRetries interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RetryOrder", reflect.TypeOf((*MockStorage)(nil).RetryOrder), ctx, userID, orderNum, maxRetries)
+}
+
+// RevokeRefreshToken mocks base method.
+func (m *MockStorage) RevokeRefreshToken(ctx context.Context, tokenHash string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "RevokeRefreshToken", ctx, tokenHash)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// RevokeRefreshToken indicates an expected call of RevokeRefreshToken.
+func (mr *MockStorageMockRecorder) RevokeRefreshToken(ctx, tokenHash interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RevokeRefreshToken", reflect.TypeOf((*MockStorage)(nil).RevokeRefreshToken), ctx, tokenHash)
+}
+
+// RotateRefreshToken mocks base method.
+func (m *MockStorage) RotateRefreshToken(ctx context.Context, oldHash, newHash string, expiresAt time.Time) (*model.User, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "RotateRefreshToken", ctx, oldHash, newHash, expiresAt)
+	ret0, _ := ret[0].(*model.User)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// RotateRefreshToken indicates an expected call of RotateRefreshToken.
+func (mr *MockStorageMockRecorder) RotateRefreshToken(ctx, oldHash, newHash, expiresAt interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RotateRefreshToken", reflect.TypeOf((*MockStorage)(nil).RotateRefreshToken), ctx, oldHash, newHash, expiresAt)
+}
+
+// SetCurrencyRate mocks base method.
+func (m *MockStorage) SetCurrencyRate(ctx context.Context, rate model.CurrencyRate) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "SetCurrencyRate", ctx, rate)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// SetCurrencyRate indicates an expected call of SetCurrencyRate.
+func (mr *MockStorageMockRecorder) SetCurrencyRate(ctx, rate interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetCurrencyRate", reflect.TypeOf((*MockStorage)(nil).SetCurrencyRate), ctx, rate)
+}
+
+// StreamUserOrders mocks base method.
+func (m *MockStorage) StreamUserOrders(ctx context.Context, userID int, query model.OrdersQuery, fn func(model.Order) error) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "StreamUserOrders", ctx, userID, query, fn)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// StreamUserOrders indicates an expected call of StreamUserOrders.
+func (mr *MockStorageMockRecorder) StreamUserOrders(ctx, userID, query, fn interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "StreamUserOrders", reflect.TypeOf((*MockStorage)(nil).StreamUserOrders), ctx, userID, query, fn)
+}
+
+// Transfer mocks base method.
+func (m *MockStorage) Transfer(ctx context.Context, fromUserID int, toLogin string, sum model.Money) (*model.Transfer, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Transfer", ctx, fromUserID, toLogin, sum)
+	ret0, _ := ret[0].(*model.Transfer)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Transfer indicates an expected call of Transfer.
+func (mr *MockStorageMockRecorder) Transfer(ctx, fromUserID, toLogin, sum interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Transfer", reflect.TypeOf((*MockStorage)(nil).Transfer), ctx, fromUserID, toLogin, sum)
+}
+
+// UnlockUser mocks base method.
+func (m *MockStorage) UnlockUser(ctx context.Context, login string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "UnlockUser", ctx, login)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// UnlockUser indicates an expected call of UnlockUser.
+func (mr *MockStorageMockRecorder) UnlockUser(ctx, login interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "UnlockUser", reflect.TypeOf((*MockStorage)(nil).UnlockUser), ctx, login)
+}
+
+// UpdateOrderStatus mocks base method.
+func (m *MockStorage) UpdateOrderStatus(ctx context.Context, orderID int, status model.OrderStatus, accrual model.Money) (model.Money, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "UpdateOrderStatus", ctx, orderID, status, accrual)
+	ret0, _ := ret[0].(model.Money)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// UpdateOrderStatus indicates an expected call of UpdateOrderStatus.
+func (mr *MockStorageMockRecorder) UpdateOrderStatus(ctx, orderID, status, accrual interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "UpdateOrderStatus", reflect.TypeOf((*MockStorage)(nil).UpdateOrderStatus), ctx, orderID, status, accrual)
+}
+
+// UpdatePasswordHash mocks base method.
+func (m *MockStorage) UpdatePasswordHash(ctx context.Context, userID int, passwordHash string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "UpdatePasswordHash", ctx, userID, passwordHash)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// UpdatePasswordHash indicates an expected call of UpdatePasswordHash.
+func (mr *MockStorageMockRecorder) UpdatePasswordHash(ctx, userID, passwordHash interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetWithdrawals", reflect.TypeOf((*MockStorage)(nil).GetWithdrawals), ctx, userID)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "UpdatePasswordHash", reflect.TypeOf((*MockStorage)(nil).UpdatePasswordHash), ctx, userID, passwordHash)
 }
 
 // Withdraw mocks base method.
-func (m *MockStorage) Withdraw(ctx context.Context, userID int, sum float64, order string) error {
+func (m *MockStorage) Withdraw(ctx context.Context, userID int, sum model.Money, order, idempotencyKey string) error {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "Withdraw", ctx, userID, sum, order)
+	ret := m.ctrl.Call(m, "Withdraw", ctx, userID, sum, order, idempotencyKey)
 	ret0, _ := ret[0].(error)
 	return ret0
 }
 
 // Withdraw indicates an expected call of Withdraw.
-func (mr *MockStorageMockRecorder) Withdraw(ctx, userID, sum, order interface{}) *gomock.Call {
+func (mr *MockStorageMockRecorder) Withdraw(ctx, userID, sum, order, idempotencyKey interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Withdraw", reflect.TypeOf((*MockStorage)(nil).Withdraw), ctx, userID, sum, order)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Withdraw", reflect.TypeOf((*MockStorage)(nil).Withdraw), ctx, userID, sum, order, idempotencyKey)
 }
@@ -0,0 +1,109 @@
+package handlers
+
+import (
+	"context"
+	"crypto/subtle"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pinbrain/gophermart/internal/logger"
+	"github.com/pinbrain/gophermart/internal/middleware"
+	"github.com/pinbrain/gophermart/internal/model"
+	"github.com/pinbrain/gophermart/internal/utils"
+)
+
+// Время, за которое пользователь должен вернуться от провайдера
+const oauthStateTTL = 10 * time.Minute
+
+// IdentityProvider - внешний провайдер OpenID Connect
+type IdentityProvider interface {
+	AuthCodeURL(state, nonce, codeVerifier string) string
+	Exchange(ctx context.Context, code, codeVerifier, nonce string) (*model.ExternalIdentity, error)
+}
+
+type OAuthCfg struct {
+	// Провайдер, nil - вход через провайдера отключен
+	Provider IdentityProvider
+	// Адрес, на который перенаправляется пользователь после входа. Пустой - токены отдаются
+	// в теле ответа, как при входе по паролю.
+	SuccessURL string
+	// Привязывать учетную запись провайдера к существующему пользователю с тем же подтвержденным email.
+	// Включается только для провайдера, который сам проверяет email, иначе учетная запись у провайдера
+	// с чужим email дает вход в аккаунт владельца email.
+	LinkByEmail bool
+}
+
+// OAuthLogin перенаправляет пользователя на страницу входа провайдера. Параметры state, nonce
+// и PKCE-верификатор сохраняются в cookie и проверяются при возврате пользователя.
+func (h *UserHandler) OAuthLogin(w http.ResponseWriter, r *http.Request) {
+	values := make([]string, 0, 3)
+	for i := 0; i < 3; i++ {
+		value, _, err := utils.GenerateVerificationToken()
+		if err != nil {
+			logger.Log.WithError(err).Error("failed to start oauth login")
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		values = append(values, value)
+	}
+	state, nonce, codeVerifier := values[0], values[1], values[2]
+	middleware.SetOAuthCookie(w, strings.Join(values, "."), oauthStateTTL)
+
+	http.Redirect(w, r, h.oauth.Provider.AuthCodeURL(state, nonce, codeVerifier), http.StatusFound)
+}
+
+// OAuthCallback завершает вход через провайдера: обменивает код на учетную запись пользователя,
+// находит или создает локального пользователя и выдает ему токены
+func (h *UserHandler) OAuthCallback(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if providerErr := query.Get("error"); providerErr != "" {
+		logger.Log.WithField("error", providerErr).Debug("oauth login is rejected by provider")
+		http.Error(w, "Вход отклонен провайдером", http.StatusUnauthorized)
+		return
+	}
+
+	cookie, err := r.Cookie(middleware.OAuthCookieName)
+	if err != nil {
+		http.Error(w, "Вход не был начат или истек", http.StatusBadRequest)
+		return
+	}
+	middleware.DeleteOAuthCookie(w)
+	values := strings.Split(cookie.Value, ".")
+	state := query.Get("state")
+	if len(values) != 3 || state == "" || subtle.ConstantTimeCompare([]byte(values[0]), []byte(state)) != 1 {
+		http.Error(w, "Некорректный параметр state", http.StatusBadRequest)
+		return
+	}
+	code := query.Get("code")
+	if code == "" {
+		http.Error(w, "Не передан код авторизации", http.StatusBadRequest)
+		return
+	}
+
+	identity, err := h.oauth.Provider.Exchange(r.Context(), code, values[2], values[1])
+	if err != nil {
+		logger.Log.WithError(err).Error("failed to exchange oauth code")
+		http.Error(w, "Не удалось выполнить вход через провайдера", http.StatusUnauthorized)
+		return
+	}
+	user, err := h.storage.LoginWithIdentity(r.Context(), *identity, h.oauth.LinkByEmail)
+	if err != nil {
+		logger.Log.WithError(err).Error("failed to login user with external identity")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	authRes, err := h.issueTokens(r, *user)
+	if err != nil {
+		logger.Log.WithError(err).Error("failed to login user with external identity")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	h.recordAuthEvent(r, user.ID, model.AuthEventLogin)
+	if h.oauth.SuccessURL != "" {
+		h.setAuthCookies(w, authRes)
+		http.Redirect(w, r, h.oauth.SuccessURL, http.StatusFound)
+		return
+	}
+	h.writeAuthRes(w, authRes)
+}
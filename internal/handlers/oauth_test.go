@@ -0,0 +1,147 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/golang/mock/gomock"
+	"github.com/pinbrain/gophermart/internal/handlers/mocks"
+	"github.com/pinbrain/gophermart/internal/middleware"
+	"github.com/pinbrain/gophermart/internal/model"
+	"github.com/pinbrain/gophermart/internal/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOAuthLogin(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockStorage := mocks.NewMockStorage(ctrl)
+	mockProvider := mocks.NewMockIdentityProvider(ctrl)
+
+	// startLogin начинает вход и возвращает cookie состояния и переданные провайдеру state и nonce
+	startLogin := func(router http.Handler) (*http.Cookie, string, string) {
+		var state, nonce string
+		mockProvider.EXPECT().
+			AuthCodeURL(gomock.Any(), gomock.Any(), gomock.Any()).
+			DoAndReturn(func(s, n, _ string) string {
+				state, nonce = s, n
+				return "https://idp.example.com/authorize?state=" + s
+			}).
+			Times(1)
+
+		req := httptest.NewRequest(http.MethodGet, "/api/user/oauth/login", nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		resp := w.Result()
+		defer resp.Body.Close()
+
+		require.Equal(t, http.StatusFound, resp.StatusCode)
+		assert.Equal(t, "https://idp.example.com/authorize?state="+state, resp.Header.Get("Location"))
+		var stateCookie *http.Cookie
+		for _, cookie := range resp.Cookies() {
+			if cookie.Name == middleware.OAuthCookieName {
+				stateCookie = cookie
+			}
+		}
+		require.NotNil(t, stateCookie)
+		return stateCookie, state, nonce
+	}
+
+	identity := &model.ExternalIdentity{
+		Issuer:        "https://idp.example.com",
+		Subject:       "42",
+		Email:         "user@example.com",
+		EmailVerified: true,
+	}
+
+	tests := []struct {
+		name        string
+		withCookie  bool
+		state       func(state string) string
+		exchangeErr error
+		linkByEmail bool
+		wantStatus  int
+	}{
+		{
+			name:       "Успешный вход",
+			withCookie: true,
+			state:      func(state string) string { return state },
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:        "Вход с привязкой по email",
+			withCookie:  true,
+			state:       func(state string) string { return state },
+			linkByEmail: true,
+			wantStatus:  http.StatusOK,
+		},
+		{
+			name:       "Вход не был начат",
+			withCookie: false,
+			state:      func(state string) string { return state },
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "Подмена state",
+			withCookie: true,
+			state:      func(string) string { return "forged" },
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:        "Провайдер не принял код",
+			withCookie:  true,
+			state:       func(state string) string { return state },
+			exchangeErr: errors.New("invalid_grant"),
+			wantStatus:  http.StatusUnauthorized,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			router := NewRouter(mockStorage, RouterCfg{
+				OAuth: OAuthCfg{Provider: mockProvider, LinkByEmail: tt.linkByEmail},
+			})
+			stateCookie, state, nonce := startLogin(router)
+
+			if tt.withCookie && tt.state(state) == state {
+				mockProvider.EXPECT().
+					Exchange(gomock.Any(), "auth_code", gomock.Any(), nonce).
+					Return(identity, tt.exchangeErr).
+					Times(1)
+			}
+			if tt.wantStatus == http.StatusOK {
+				mockStorage.EXPECT().
+					LoginWithIdentity(gomock.Any(), *identity, tt.linkByEmail).
+					Return(&model.User{ID: 7, Login: "user"}, nil).
+					Times(1)
+				mockStorage.EXPECT().CreateRefreshToken(gomock.Any(), 7, gomock.Any(), gomock.Any()).Return(nil).Times(1)
+			}
+
+			req := httptest.NewRequest(http.MethodGet,
+				"/api/user/oauth/callback?code=auth_code&state="+tt.state(state), nil)
+			if tt.withCookie {
+				req.AddCookie(stateCookie)
+			}
+			w := httptest.NewRecorder()
+
+			router.ServeHTTP(w, req)
+
+			resp := w.Result()
+			defer resp.Body.Close()
+
+			assert.Equal(t, tt.wantStatus, resp.StatusCode)
+			if tt.wantStatus == http.StatusOK {
+				var authRes model.AuthRes
+				require.NoError(t, json.NewDecoder(resp.Body).Decode(&authRes))
+				claims, err := utils.GetJWTClaims(authRes.Token)
+				require.NoError(t, err)
+				assert.Equal(t, 7, claims.UserID)
+			}
+		})
+	}
+}
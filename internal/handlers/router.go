@@ -1,28 +1,212 @@
 package handlers
 
 import (
+	"net/http"
+	"time"
+
 	"github.com/go-chi/chi/v5"
+	"github.com/pinbrain/gophermart/internal/faults"
+	"github.com/pinbrain/gophermart/internal/loyalty"
 	"github.com/pinbrain/gophermart/internal/middleware"
+	"github.com/pinbrain/gophermart/internal/model"
+	"github.com/pinbrain/gophermart/internal/passwordpolicy"
+	"github.com/pinbrain/gophermart/internal/ratelimit"
+	"github.com/pinbrain/gophermart/internal/utils"
 )
 
-func NewRouter(storage Storage) chi.Router {
+type RouterCfg struct {
+	// Авторизация сервисов во внутреннем API, без нее внутреннее API не подключается
+	ServiceAuth middleware.ServiceAuthCfg
+	// Подсети, из которых доступны привилегированные маршруты (внутреннее API, метрики), nil - любые
+	PrivilegedIPs *middleware.IPAllowlist
+	// Ограничение частоты запросов регистрации и входа с одного IP, nil - без ограничений
+	AuthLimiter ratelimit.Limiter
+	// Ограничения частоты загрузки заказов и списаний для пользователя, nil - без ограничений
+	OrderLimiter    ratelimit.Limiter
+	WithdrawLimiter ratelimit.Limiter
+	// Искусственные сбои обработки запросов, nil - без сбоев
+	Faults *faults.Injector
+	// Отбрасывание низкоприоритетных запросов при перегрузке, nil - запросы не отбрасываются
+	LoadShedder *middleware.LoadShedder
+	// Аутентификация пользователей: JWT со списком отозванных токенов или серверные сессии
+	UserAuth middleware.UserAuthCfg
+	// Политика стойкости паролей, nil - допускается любой непустой пароль
+	PasswordPolicy *passwordpolicy.Policy
+	// Повторное подтверждение пароля перед крупными списаниями
+	StepUp StepUpCfg
+	// Минимальная сумма одного списания
+	MinWithdrawSum model.Money
+	// Время, в течение которого пользователь может отменить списание, 0 - отмена недоступна
+	WithdrawCancelWindow time.Duration
+	// Срок резерва баллов, после которого он снимается автоматически, 0 - резервирование недоступно
+	HoldTTL time.Duration
+	// Сколько раз пользователь может отправить заказ INVALID на повторную обработку, 0 - повтор недоступен
+	OrderMaxRetries int
+	// Проверка CSRF-токена в изменяющих запросах пользователя с аутентификацией по cookie
+	CSRFProtection bool
+	// Журнал событий аутентификации, nil - события не записываются
+	AuthAudit AuthAuditLog
+	// Обнаружение входов с новых устройств и из новых подсетей
+	SuspiciousLogin SuspiciousLoginCfg
+	// Блокировка входа после неудачных попыток
+	LoginLockout LoginLockoutCfg
+	// Отправка писем пользователям
+	Mailer Mailer
+	// Адрес страницы подтверждения email, к которому добавляется параметр token
+	EmailVerificationURL string
+	// Вход через внешнего провайдера OpenID Connect
+	OAuth OAuthCfg
+	// Сжатие ответов, nil - ответы не сжимаются
+	Compressor *middleware.Compressor
+	// События пользователей для потока GET /api/user/orders/events и канала /api/user/ws,
+	// nil - уведомления не подключаются
+	Events UserEvents
+	// Валюта, в которую пересчитываются баланс и списания
+	Currency CurrencyCfg
+	// Уровни программы лояльности, nil - уровни не подключаются
+	LoyaltyTiers *loyalty.Tiers
+	// Агент расчета начислений, состояние которого отдает внутреннее API
+	Agent AccrualAgent
+	// Обработчик метрик Prometheus, nil - метрики не публикуются
+	Metrics http.Handler
+}
+
+type LoginLockoutCfg struct {
+	// Количество неудачных попыток входа подряд, после которого вход блокируется (0 - не блокируется)
+	MaxFailures int
+	// Длительность блокировки
+	Duration time.Duration
+}
+
+// Enabled сообщает, включена ли блокировка входа
+func (cfg LoginLockoutCfg) Enabled() bool {
+	return cfg.MaxFailures > 0 && cfg.Duration > 0
+}
+
+type StepUpCfg struct {
+	// Сумма списания, выше которой требуется недавнее подтверждение пароля (0 - не требуется)
+	WithdrawThreshold model.Money
+	// Сколько действует подтверждение пароля
+	TTL time.Duration
+}
+
+// Enabled сообщает, требуется ли подтверждение пароля перед крупными списаниями
+func (cfg StepUpCfg) Enabled() bool {
+	return cfg.WithdrawThreshold > 0 && cfg.TTL > 0
+}
+
+func NewRouter(storage Storage, cfg RouterCfg) chi.Router {
 	r := chi.NewRouter()
 	r.Use(middleware.HTTPRequestLogger)
+	r.Use(cfg.LoadShedder.Track)
+	r.Use(middleware.FaultInjection(cfg.Faults))
+	r.Use(cfg.Compressor.Handler)
+
+	userHandler := newUserHandler(storage, cfg)
 
-	userHandler := newUserHandler(storage)
+	r.Get("/.well-known/jwks.json", GetJWKS)
 
 	r.Route("/api/user", func(r chi.Router) {
-		r.Post("/register", userHandler.RegisterUser)
-		r.Post("/login", userHandler.Login)
+		r.With(middleware.RateLimitIP(cfg.AuthLimiter)).Post("/register", userHandler.RegisterUser)
+		r.With(middleware.RateLimitIP(cfg.AuthLimiter)).Post("/login", userHandler.Login)
+		r.Post("/logout", userHandler.Logout)
+		if cfg.OAuth.Provider != nil {
+			r.Get("/oauth/login", userHandler.OAuthLogin)
+			r.Get("/oauth/callback", userHandler.OAuthCallback)
+		}
+		if cfg.Mailer != nil {
+			r.Post("/email/verify/confirm", userHandler.ConfirmEmail)
+		}
+		if cfg.Mailer != nil && cfg.SuspiciousLogin.Enabled && cfg.SuspiciousLogin.RequireVerification {
+			r.With(middleware.RateLimitIP(cfg.AuthLimiter)).Post("/login/confirm", userHandler.ConfirmLogin)
+		}
+		// Токены обновления нужны только при аутентификации по JWT
+		if cfg.UserAuth.Sessions == nil {
+			r.Post("/token/refresh", userHandler.RefreshToken)
+		}
 		r.Group(func(r chi.Router) {
-			r.Use(middleware.RequireUser)
-			r.Post("/orders", userHandler.CreateNewOrder)
-			r.Get("/orders", userHandler.GetOrders)
+			r.Use(middleware.RequireUser(cfg.UserAuth))
+			r.Use(middleware.RequireCSRFToken(cfg.CSRFProtection))
+			if cfg.CSRFProtection {
+				r.Get("/csrf", userHandler.GetCSRFToken)
+			}
+			if cfg.UserAuth.Sessions != nil {
+				r.Post("/logout/all", userHandler.LogoutAll)
+				r.Get("/sessions", userHandler.GetSessions)
+				r.Delete("/sessions/{id}", userHandler.DeleteSession)
+			}
+			r.Get("/", userHandler.GetProfile)
+			r.Post("/password", userHandler.ChangePassword)
+			if cfg.Mailer != nil {
+				r.Post("/email/verify/send", userHandler.SendEmailVerification)
+			}
+			if cfg.AuthAudit != nil {
+				r.Get("/security-events", userHandler.GetSecurityEvents)
+			}
+			if cfg.StepUp.Enabled() {
+				r.Post("/reauth", userHandler.Reauth)
+			}
+			r.With(middleware.RateLimitUser(cfg.OrderLimiter)).Post("/orders", userHandler.CreateNewOrder)
+			r.With(middleware.RateLimitUser(cfg.OrderLimiter)).Post("/orders/batch", userHandler.CreateOrdersBatch)
+			r.With(cfg.LoadShedder.Shed).Get("/orders", userHandler.GetOrders)
+			r.With(cfg.LoadShedder.Shed).Get("/orders/archive", userHandler.GetArchivedOrders)
+			if cfg.Events != nil {
+				r.Get("/orders/events", userHandler.OrderEvents)
+				r.Get("/ws", userHandler.WebSocket)
+			}
+			r.Get("/orders/{number}", userHandler.GetOrder)
+			r.Delete("/orders/{number}", userHandler.CancelOrder)
+			if cfg.OrderMaxRetries > 0 {
+				r.With(middleware.RateLimitUser(cfg.OrderLimiter)).Post("/orders/{number}/retry", userHandler.RetryOrder)
+			}
 			r.Get("/balance", userHandler.GetBalance)
-			r.Post("/balance/withdraw", userHandler.Withdraw)
-			r.Get("/withdrawals", userHandler.GetWithdraws)
+			r.Get("/balance/history", userHandler.GetBalanceHistory)
+			if cfg.LoyaltyTiers != nil {
+				r.Get("/tier", userHandler.GetTier)
+			}
+			r.With(middleware.RateLimitUser(cfg.WithdrawLimiter)).Post("/balance/transfer", userHandler.Transfer)
+			r.Get("/balance/transfers", userHandler.GetTransfers)
+			r.Get("/statement", userHandler.GetStatement)
+			r.With(cfg.LoadShedder.Shed).Get("/stats", userHandler.GetStats)
+			r.With(middleware.RateLimitUser(cfg.WithdrawLimiter)).Post("/balance/withdraw", userHandler.Withdraw)
+			if cfg.HoldTTL > 0 {
+				r.With(middleware.RateLimitUser(cfg.WithdrawLimiter)).Post("/balance/hold", userHandler.HoldBalance)
+				r.Post("/balance/capture", userHandler.CaptureHold)
+				r.Post("/balance/release", userHandler.ReleaseHold)
+			}
+			r.With(cfg.LoadShedder.Shed).Get("/withdrawals", userHandler.GetWithdraws)
+			if cfg.WithdrawCancelWindow > 0 {
+				r.Delete("/withdrawals/{id}", userHandler.CancelWithdrawal)
+			}
+			r.Post("/webhooks", userHandler.CreateWebhook)
+			r.Get("/webhooks", userHandler.GetWebhooks)
+			r.Delete("/webhooks/{id}", userHandler.DeleteWebhook)
 		})
 	})
 
+	if cfg.ServiceAuth.Enabled() {
+		internalHandler := newInternalHandler(storage, cfg.Agent, cfg.Events)
+
+		r.Route("/api/internal", func(r chi.Router) {
+			r.Use(cfg.PrivilegedIPs.Handler)
+			r.With(middleware.RequireServiceScope(cfg.ServiceAuth, utils.ScopeAccrualsWrite)).
+				Post("/accruals", internalHandler.PushAccrual)
+			r.With(middleware.RequireServiceScope(cfg.ServiceAuth, utils.ScopeUsersWrite)).
+				Post("/users/{login}/unlock", internalHandler.UnlockUser)
+			r.With(middleware.RequireServiceScope(cfg.ServiceAuth, utils.ScopeRatesWrite)).
+				Post("/currency-rates", internalHandler.SetCurrencyRate)
+			r.With(middleware.RequireServiceScope(cfg.ServiceAuth, utils.ScopeOrdersWrite)).
+				Post("/orders/{number}/requeue", internalHandler.RequeueOrder)
+			if cfg.Agent != nil {
+				r.With(middleware.RequireServiceScope(cfg.ServiceAuth, utils.ScopeAgentRead)).
+					Get("/agent/status", internalHandler.GetAgentStatus)
+			}
+		})
+	}
+
+	if cfg.Metrics != nil {
+		r.With(cfg.PrivilegedIPs.Handler).Handle("/metrics", cfg.Metrics)
+	}
+
 	return r
 }
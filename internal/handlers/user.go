@@ -1,38 +1,154 @@
 package handlers
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"hash/fnv"
 	"io"
+	"net"
 	"net/http"
+	"net/mail"
+	"net/url"
+	"slices"
+	"strconv"
 	"strings"
+	"time"
 
+	"github.com/go-chi/chi/v5"
 	"github.com/pinbrain/gophermart/internal/appctx"
 	"github.com/pinbrain/gophermart/internal/logger"
+	"github.com/pinbrain/gophermart/internal/loyalty"
 	"github.com/pinbrain/gophermart/internal/middleware"
 	"github.com/pinbrain/gophermart/internal/model"
+	"github.com/pinbrain/gophermart/internal/passwordpolicy"
+	"github.com/pinbrain/gophermart/internal/session"
+	"github.com/pinbrain/gophermart/internal/statement"
 	"github.com/pinbrain/gophermart/internal/storage"
 	"github.com/pinbrain/gophermart/internal/utils"
 )
 
 type UserHandler struct {
-	storage Storage
+	storage        Storage
+	userAuth       middleware.UserAuthCfg
+	passwordPolicy *passwordpolicy.Policy
+	loginLockout   LoginLockoutCfg
+	stepUp         StepUpCfg
+	minWithdrawSum model.Money
+	// Срок резерва баллов
+	holdTTL time.Duration
+	// Сколько раз пользователь может отправить заказ INVALID на повторную обработку
+	orderMaxRetries int
+	mailer          Mailer
+	authAudit       AuthAuditLog
+	// Обнаружение входов с новых устройств
+	suspiciousLogin SuspiciousLoginCfg
+	oauth           OAuthCfg
+	events          UserEvents
+	currency        CurrencyCfg
+	loyaltyTiers    *loyalty.Tiers
+	// Адрес страницы подтверждения email, к которому добавляется токен
+	emailVerificationURL string
+}
+
+// Срок действия ссылки подтверждения email
+const emailVerificationTTL = 24 * time.Hour
+
+// Сколько последних событий аутентификации отдается пользователю
+const securityEventsLimit = 100
+
+// AuthAuditLog - журнал событий аутентификации пользователей
+type AuthAuditLog interface {
+	RecordAuthEvent(ctx context.Context, event model.AuthEvent) error
+	GetAuthEvents(ctx context.Context, userID, limit int) ([]model.AuthEvent, error)
+}
+
+// Mailer отправляет письма пользователям
+type Mailer interface {
+	Send(ctx context.Context, to, subject, body string) error
 }
 
 type Storage interface {
-	CreateUser(ctx context.Context, login, password string) (int, error)
+	CreateUser(ctx context.Context, login, password, email string) (int, error)
+	GetUserByID(ctx context.Context, userID int) (*model.User, error)
 	GetUserByLogin(ctx context.Context, login string) (*model.User, error)
-	CreateOrder(ctx context.Context, userID int, orderNum string) (int, error)
-	GetUserOrders(ctx context.Context, userID int) ([]model.Order, error)
+	CreateEmailVerification(ctx context.Context, userID int, email, tokenHash string, expiresAt time.Time) error
+	ConfirmEmail(ctx context.Context, tokenHash string) error
+	UpdatePasswordHash(ctx context.Context, userID int, passwordHash string) error
+	ChangePassword(ctx context.Context, userID int, passwordHash string) (int, error)
+	RegisterFailedLogin(ctx context.Context, userID, maxFailures int, lockFor time.Duration) (time.Time, error)
+	ResetFailedLogins(ctx context.Context, userID int) error
+	UnlockUser(ctx context.Context, login string) error
+	CreateOrder(ctx context.Context, userID int, orderNum string) (*model.Order, error)
+	CreateOrders(ctx context.Context, userID int, orderNums []string) (map[string]string, error)
+	CancelOrder(ctx context.Context, userID int, orderNum string) error
+	RetryOrder(ctx context.Context, userID int, orderNum string, maxRetries int) error
+	RequeueOrder(ctx context.Context, orderNum string) error
+	GetUserOrdersSummary(ctx context.Context, userID int, query model.OrdersQuery) (*model.OrdersSummary, error)
+	StreamUserOrders(ctx context.Context, userID int, query model.OrdersQuery, fn func(model.Order) error) error
+	CountArchivedOrders(ctx context.Context, userID int) (int, error)
+	GetArchivedOrders(ctx context.Context, userID, limit, offset int) ([]model.Order, error)
 	GetUserBalance(ctx context.Context, userID int) (*model.Balance, error)
-	Withdraw(ctx context.Context, userID int, sum float64, order string) error
-	GetWithdrawals(ctx context.Context, userID int) ([]model.Withdrawn, error)
+	GetUserBalanceAt(ctx context.Context, userID int, at time.Time) (*model.Balance, error)
+	GetBalanceHistory(ctx context.Context, userID int) ([]model.BalanceHistoryEntry, error)
+	GetStatement(ctx context.Context, userID int, from, to time.Time) (*model.Statement, error)
+	GetMonthlyStats(ctx context.Context, userID int, since time.Time) ([]model.MonthlyStats, error)
+	Withdraw(ctx context.Context, userID int, sum model.Money, order, idempotencyKey string) error
+	CancelWithdrawal(ctx context.Context, userID, withdrawalID int) (*model.Withdrawn, error)
+	HoldBalance(ctx context.Context, userID int, order string, sum model.Money, ttl time.Duration) (*model.Hold, error)
+	CaptureHold(ctx context.Context, userID, holdID int) (*model.Hold, error)
+	ReleaseHold(ctx context.Context, userID, holdID int) (*model.Hold, error)
+	CountUserWithdrawals(ctx context.Context, userID int, query model.WithdrawalsQuery) (int, error)
+	GetWithdrawals(ctx context.Context, userID int, query model.WithdrawalsQuery) ([]model.Withdrawn, error)
+	Transfer(ctx context.Context, fromUserID int, toLogin string, sum model.Money) (*model.Transfer, error)
+	SetCurrencyRate(ctx context.Context, rate model.CurrencyRate) error
+	GetCurrencyRates(ctx context.Context, currency string) ([]model.CurrencyRate, error)
+	GetTransfers(ctx context.Context, userID int) ([]model.Transfer, error)
+	CreateWebhook(
+		ctx context.Context, userID int, url string, events []model.WebhookEventType, secret string,
+	) (*model.Webhook, error)
+	GetWebhooks(ctx context.Context, userID int) ([]model.Webhook, error)
+	DeleteWebhook(ctx context.Context, userID, webhookID int) error
+	GetOrderByNum(ctx context.Context, orderNum string) (*model.Order, error)
+	GetOrderStatusHistory(ctx context.Context, orderID int) ([]model.OrderStatusChange, error)
+	UpdateOrderStatus(ctx context.Context, orderID int, status model.OrderStatus, accrual model.Money) (model.Money, error)
+	GetLifetimeAccrual(ctx context.Context, userID int) (model.Money, error)
+	CreateRefreshToken(ctx context.Context, userID int, tokenHash string, expiresAt time.Time) error
+	RotateRefreshToken(ctx context.Context, oldHash, newHash string, expiresAt time.Time) (*model.User, error)
+	RevokeRefreshToken(ctx context.Context, tokenHash string) error
+	LoginWithIdentity(ctx context.Context, identity model.ExternalIdentity, linkByEmail bool) (*model.User, error)
+	CheckLoginDevice(ctx context.Context, userID int, device model.LoginDevice) (model.LoginDeviceCheck, error)
+	RememberLoginDevice(ctx context.Context, userID int, device model.LoginDevice) error
+	CreateLoginVerification(
+		ctx context.Context, userID int, device model.LoginDevice, tokenHash string, expiresAt time.Time,
+	) error
+	ConfirmLoginVerification(ctx context.Context, tokenHash string) (*model.User, *model.LoginDevice, error)
 	Close()
 }
 
-func newUserHandler(storage Storage) UserHandler {
-	return UserHandler{storage: storage}
+func newUserHandler(storage Storage, cfg RouterCfg) UserHandler {
+	return UserHandler{
+		storage:         storage,
+		userAuth:        cfg.UserAuth,
+		passwordPolicy:  cfg.PasswordPolicy,
+		loginLockout:    cfg.LoginLockout,
+		stepUp:          cfg.StepUp,
+		minWithdrawSum:  cfg.MinWithdrawSum,
+		holdTTL:         cfg.HoldTTL,
+		orderMaxRetries: cfg.OrderMaxRetries,
+		mailer:          cfg.Mailer,
+		authAudit:       cfg.AuthAudit,
+
+		suspiciousLogin: cfg.SuspiciousLogin,
+		oauth:           cfg.OAuth,
+		events:          cfg.Events,
+		currency:        cfg.Currency,
+		loyaltyTiers:    cfg.LoyaltyTiers,
+
+		emailVerificationURL: cfg.EmailVerificationURL,
+	}
 }
 
 func (h *UserHandler) RegisterUser(w http.ResponseWriter, r *http.Request) {
@@ -53,27 +169,38 @@ func (h *UserHandler) RegisterUser(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Не все обязательные поля заполнены", http.StatusBadRequest)
 		return
 	}
+	if user.Email != "" && !isValidEmail(user.Email) {
+		http.Error(w, "Некорректный email", http.StatusBadRequest)
+		return
+	}
+	if violations := h.passwordPolicy.Validate(user.Password); len(violations) > 0 {
+		writePasswordViolations(w, violations)
+		return
+	}
 
-	userID, err := h.storage.CreateUser(r.Context(), user.Login, user.Password)
+	userID, err := h.storage.CreateUser(r.Context(), user.Login, user.Password, user.Email)
 	if err != nil {
 		if errors.Is(err, storage.ErrLoginTaken) {
 			w.WriteHeader(http.StatusConflict)
 			return
 		}
+		if errors.Is(err, storage.ErrEmailTaken) {
+			http.Error(w, "Email уже используется", http.StatusConflict)
+			return
+		}
 		logger.Log.WithError(err).Error("failed to register new user")
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
 	user.ID = userID
-	jwtString, err := utils.BuildJWTSting(user)
+	h.recordAuthEvent(r, userID, model.AuthEventRegister)
+	authRes, err := h.issueTokens(r, user)
 	if err != nil {
 		logger.Log.WithError(err).Error("failed to register new user")
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
-	middleware.SetJWTCookie(w, jwtString)
-
-	w.WriteHeader(200)
+	h.writeAuthRes(w, authRes)
 }
 
 func (h *UserHandler) Login(w http.ResponseWriter, r *http.Request) {
@@ -106,151 +233,1405 @@ func (h *UserHandler) Login(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
+	if h.loginLockout.Enabled() && dbUser.LockedUntil.After(time.Now()) {
+		writeAccountLocked(w, dbUser.LockedUntil)
+		return
+	}
 	if isPwdOk := utils.ComparePwdAndHash(reqUser.Password, dbUser.PasswordHash); !isPwdOk {
+		h.recordAuthEvent(r, dbUser.ID, model.AuthEventLoginFailed)
+		if h.loginLockout.Enabled() {
+			lockedUntil, err := h.storage.RegisterFailedLogin(
+				r.Context(), dbUser.ID, h.loginLockout.MaxFailures, h.loginLockout.Duration,
+			)
+			if err != nil {
+				logger.Log.WithError(err).Error("failed to register failed login")
+			} else if !lockedUntil.IsZero() {
+				writeAccountLocked(w, lockedUntil)
+				return
+			}
+		}
 		w.WriteHeader(http.StatusUnauthorized)
 		return
 	}
-	jwtString, err := utils.BuildJWTSting(*dbUser)
+	if h.loginLockout.Enabled() {
+		if err = h.storage.ResetFailedLogins(r.Context(), dbUser.ID); err != nil {
+			logger.Log.WithError(err).Error("failed to reset failed logins")
+		}
+	}
+	if utils.PasswordHashNeedsUpgrade(dbUser.PasswordHash) {
+		h.upgradePasswordHash(r.Context(), dbUser.ID, reqUser.Password)
+	}
+	if h.suspiciousLogin.Enabled && h.checkSuspiciousLogin(w, r, *dbUser) {
+		return
+	}
+	authRes, err := h.issueTokens(r, *dbUser)
 	if err != nil {
 		logger.Log.WithError(err).Error("failed to login user")
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
-	middleware.SetJWTCookie(w, jwtString)
-
-	w.WriteHeader(200)
+	h.recordAuthEvent(r, dbUser.ID, model.AuthEventLogin)
+	h.writeAuthRes(w, authRes)
 }
 
-func (h *UserHandler) CreateNewOrder(w http.ResponseWriter, r *http.Request) {
-	contentType := r.Header.Get("Content-Type")
-	if !strings.Contains(contentType, "text/plain") {
-		http.Error(w, "Некорректный Content-Type", http.StatusBadRequest)
+// RefreshToken обновляет сессию по токену обновления: старый токен отзывается,
+// пользователю выдается новая пара токенов
+func (h *UserHandler) RefreshToken(w http.ResponseWriter, r *http.Request) {
+	refreshToken := readRefreshToken(r)
+	if refreshToken == "" {
+		http.Error(w, "Не передан токен обновления", http.StatusBadRequest)
 		return
 	}
-	body, err := io.ReadAll(r.Body)
+
+	newRefreshToken, newHash, err := utils.GenerateRefreshToken()
 	if err != nil {
-		logger.Log.WithError(err).Error("failed to read request order num")
-		http.Error(w, "Не удалось прочитать номер заказа запросе", http.StatusInternalServerError)
+		logger.Log.WithError(err).Error("failed to refresh user token")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
-	orderNum := string(body)
-	if !utils.IsValidOrderNum(orderNum) {
-		http.Error(w, "Некорректный номер заказа", http.StatusUnprocessableEntity)
+	user, err := h.storage.RotateRefreshToken(
+		r.Context(), utils.HashRefreshToken(refreshToken), newHash, time.Now().Add(utils.RefreshTokenTTL()),
+	)
+	if err != nil {
+		if errors.Is(err, storage.ErrInvalidRefreshToken) {
+			middleware.DeleteRefreshCookie(w)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		logger.Log.WithError(err).Error("failed to refresh user token")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
-	user := appctx.GetCtxUser(r.Context())
-	_, err = h.storage.CreateOrder(r.Context(), user.ID, orderNum)
+	jwtString, err := utils.BuildJWTSting(*user)
 	if err != nil {
-		if errors.Is(err, storage.ErrOrderNumUsed) {
-			logger.Log.WithError(err).Debug()
-			w.WriteHeader(http.StatusConflict)
-			return
+		logger.Log.WithError(err).Error("failed to refresh user token")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	h.recordAuthEvent(r, user.ID, model.AuthEventTokenRefresh)
+	h.writeAuthRes(w, &model.AuthRes{Token: jwtString, RefreshToken: newRefreshToken})
+}
+
+// Logout завершает сессию пользователя: удаляет серверную сессию или отзывает JWT и токен
+// обновления, после чего удаляет cookie с токенами
+func (h *UserHandler) Logout(w http.ResponseWriter, r *http.Request) {
+	token, _, ok := middleware.UserToken(r, h.userAuth.CookieName())
+	// Пользователь нужен только для журнала событий, выход без действующего токена не ошибка
+	var userID int
+	if h.userAuth.Sessions != nil {
+		if ok && token != "" {
+			if h.authAudit != nil {
+				if s, err := h.userAuth.Sessions.GetSession(r.Context(), token); err == nil {
+					userID = s.UserID
+				}
+			}
+			if err := h.userAuth.Sessions.DeleteSession(r.Context(), token); err != nil {
+				logger.Log.WithError(err).Error("failed to delete user session")
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+				return
+			}
 		}
-		if errors.Is(err, storage.ErrOrderNumCreated) {
-			w.WriteHeader(http.StatusOK)
+		middleware.DeleteSessionCookie(w)
+		h.recordAuthEvent(r, userID, model.AuthEventLogout)
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	if ok && token != "" {
+		// Невалидный или истекший токен отзывать не нужно
+		if claims, err := utils.GetJWTClaims(token); err == nil {
+			userID = claims.UserID
+			if h.userAuth.Revocations != nil && claims.ID != "" && claims.ExpiresAt != nil {
+				if err = h.userAuth.Revocations.RevokeToken(r.Context(), claims.ID, claims.ExpiresAt.Time); err != nil {
+					logger.Log.WithError(err).Error("failed to revoke jwt")
+					http.Error(w, "Internal server error", http.StatusInternalServerError)
+					return
+				}
+			}
+		}
+	}
+	if refreshToken := readRefreshToken(r); refreshToken != "" {
+		if err := h.storage.RevokeRefreshToken(r.Context(), utils.HashRefreshToken(refreshToken)); err != nil {
+			logger.Log.WithError(err).Error("failed to revoke refresh token")
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
 			return
 		}
-		logger.Log.WithError(err).Error("failed to create new order")
+	}
+	middleware.DeleteJWTCookie(w)
+	middleware.DeleteRefreshCookie(w)
+	h.recordAuthEvent(r, userID, model.AuthEventLogout)
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// LogoutAll завершает все серверные сессии пользователя, в том числе на других устройствах
+func (h *UserHandler) LogoutAll(w http.ResponseWriter, r *http.Request) {
+	user := appctx.GetCtxUser(r.Context())
+	if err := h.userAuth.Sessions.DeleteUserSessions(r.Context(), user.ID); err != nil {
+		logger.Log.WithError(err).Error("failed to delete user sessions")
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
-	w.WriteHeader(http.StatusAccepted)
+	middleware.DeleteSessionCookie(w)
+	h.recordAuthEvent(r, user.ID, model.AuthEventLogoutAll)
+
+	w.WriteHeader(http.StatusOK)
 }
 
-func (h *UserHandler) GetOrders(w http.ResponseWriter, r *http.Request) {
+// Reauth подтверждает вход пользователя повторным вводом пароля. При аутентификации по JWT
+// выдается новый токен с признаком подтверждения, при серверных сессиях признак сохраняется в сессии.
+func (h *UserHandler) Reauth(w http.ResponseWriter, r *http.Request) {
+	contentType := r.Header.Get("Content-Type")
+	if !strings.Contains(contentType, "application/json") {
+		http.Error(w, "Некорректный Content-Type", http.StatusBadRequest)
+		return
+	}
+	var req model.ReauthReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Password == "" {
+		http.Error(w, "Не передан пароль", http.StatusBadRequest)
+		return
+	}
+
 	user := appctx.GetCtxUser(r.Context())
-	orders, err := h.storage.GetUserOrders(r.Context(), user.ID)
+	dbUser, err := h.storage.GetUserByLogin(r.Context(), user.Login)
 	if err != nil {
-		logger.Log.WithError(err).Error("failed to read user orders")
-		http.Error(w, "Не удалось получить заказы", http.StatusInternalServerError)
+		if errors.Is(err, storage.ErrNoUser) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		logger.Log.WithError(err).Error("failed to reauthenticate user")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if !utils.ComparePwdAndHash(req.Password, dbUser.PasswordHash) {
+		w.WriteHeader(http.StatusUnauthorized)
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	if len(orders) == 0 {
-		w.WriteHeader(http.StatusNoContent)
+	res := model.ReauthRes{ElevatedUntil: time.Now().Add(h.stepUp.TTL)}
+	if h.userAuth.Sessions != nil {
+		err = h.userAuth.Sessions.ElevateSession(r.Context(), user.SessionID, res.ElevatedUntil)
+	} else {
+		res.Token, err = utils.BuildElevatedJWTString(*dbUser, res.ElevatedUntil)
+	}
+	if err != nil {
+		logger.Log.WithError(err).Error("failed to reauthenticate user")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
+	if res.Token != "" {
+		middleware.SetJWTCookie(w, res.Token)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
 	enc := json.NewEncoder(w)
-	if err = enc.Encode(orders); err != nil {
-		logger.Log.WithError(err).Error("Error in encoding user orders response to json")
+	if err = enc.Encode(res); err != nil {
+		logger.Log.WithError(err).Error("Error in encoding reauth response to json")
 	}
 }
 
-func (h *UserHandler) GetBalance(w http.ResponseWriter, r *http.Request) {
+// GetProfile возвращает данные текущего пользователя
+func (h *UserHandler) GetProfile(w http.ResponseWriter, r *http.Request) {
 	user := appctx.GetCtxUser(r.Context())
-	balance, err := h.storage.GetUserBalance(r.Context(), user.ID)
+	dbUser, err := h.storage.GetUserByID(r.Context(), user.ID)
 	if err != nil {
-		logger.Log.WithError(err).Error("failed to read user balance")
-		http.Error(w, "Не удалось получить баланс пользователя", http.StatusInternalServerError)
+		if errors.Is(err, storage.ErrNoUser) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		logger.Log.WithError(err).Error("failed to get user profile")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	enc := json.NewEncoder(w)
-	if err = enc.Encode(balance); err != nil {
-		logger.Log.WithError(err).Error("Error in encoding user balance response to json")
+	err = enc.Encode(model.UserProfile{
+		Login:         dbUser.Login,
+		Email:         dbUser.Email,
+		EmailVerified: dbUser.EmailVerified,
+		Role:          dbUser.Role,
+		RegisteredAt:  dbUser.CreatedAt,
+	})
+	if err != nil {
+		logger.Log.WithError(err).Error("Error in encoding user profile response to json")
 	}
 }
 
-func (h *UserHandler) Withdraw(w http.ResponseWriter, r *http.Request) {
+// ChangePassword меняет пароль пользователя. Все выданные ранее JWT, токены обновления и серверные
+// сессии перестают действовать, текущему клиенту выдаются новые токены.
+func (h *UserHandler) ChangePassword(w http.ResponseWriter, r *http.Request) {
 	contentType := r.Header.Get("Content-Type")
 	if !strings.Contains(contentType, "application/json") {
 		http.Error(w, "Некорректный Content-Type", http.StatusBadRequest)
 		return
 	}
+	var req model.ChangePasswordReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.CurrentPassword == "" || req.NewPassword == "" {
+		http.Error(w, "Не все обязательные поля заполнены", http.StatusBadRequest)
+		return
+	}
+	if violations := h.passwordPolicy.Validate(req.NewPassword); len(violations) > 0 {
+		writePasswordViolations(w, violations)
+		return
+	}
 
-	var reqWithdraw model.Withdrawn
-	dec := json.NewDecoder(r.Body)
-	if err := dec.Decode(&reqWithdraw); err != nil {
-		logger.Log.WithError(err).Error("failed to decode withdraw req body")
+	user := appctx.GetCtxUser(r.Context())
+	dbUser, err := h.storage.GetUserByLogin(r.Context(), user.Login)
+	if err != nil {
+		if errors.Is(err, storage.ErrNoUser) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		logger.Log.WithError(err).Error("failed to change user password")
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
+	if !utils.ComparePwdAndHash(req.CurrentPassword, dbUser.PasswordHash) {
+		http.Error(w, "Неверный текущий пароль", http.StatusForbidden)
+		return
+	}
 
-	if reqWithdraw.Number == "" || !utils.IsValidOrderNum(reqWithdraw.Number) {
-		http.Error(w, "Некорректный номер заказа", http.StatusUnprocessableEntity)
+	pwdHash, err := utils.GeneratePasswordHash(req.NewPassword)
+	if err != nil {
+		logger.Log.WithError(err).Error("failed to change user password")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
-	if reqWithdraw.Sum <= 0 {
-		http.Error(w, "Некорректная сумма для списания", http.StatusBadRequest)
+	if dbUser.TokenVersion, err = h.storage.ChangePassword(r.Context(), dbUser.ID, pwdHash); err != nil {
+		logger.Log.WithError(err).Error("failed to change user password")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if h.userAuth.Sessions != nil {
+		if err = h.userAuth.Sessions.DeleteUserSessions(r.Context(), dbUser.ID); err != nil {
+			logger.Log.WithError(err).Error("failed to delete user sessions")
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+	}
+	h.recordAuthEvent(r, dbUser.ID, model.AuthEventPasswordChange)
+
+	authRes, err := h.issueTokens(r, *dbUser)
+	if err != nil {
+		logger.Log.WithError(err).Error("failed to change user password")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
+	h.writeAuthRes(w, authRes)
+}
 
+// GetSecurityEvents возвращает последние события аутентификации пользователя
+func (h *UserHandler) GetSecurityEvents(w http.ResponseWriter, r *http.Request) {
 	user := appctx.GetCtxUser(r.Context())
-	err := h.storage.Withdraw(r.Context(), user.ID, reqWithdraw.Sum, reqWithdraw.Number)
+	events, err := h.authAudit.GetAuthEvents(r.Context(), user.ID, securityEventsLimit)
 	if err != nil {
-		if errors.Is(err, storage.ErrInsufficientFunds) {
-			logger.Log.WithError(err).Debug()
-			http.Error(w, "Недостаточно средств на счету", http.StatusPaymentRequired)
-			return
-		}
-		if errors.Is(err, storage.ErrOrderNumUsed) {
-			logger.Log.WithError(err).Debug()
-			http.Error(w, "Номер заказа уже был использован", http.StatusConflict)
+		logger.Log.WithError(err).Error("failed to get user auth events")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	if err = enc.Encode(events); err != nil {
+		logger.Log.WithError(err).Error("Error in encoding user auth events response to json")
+	}
+}
+
+// recordAuthEvent записывает событие аутентификации пользователя в журнал. Ошибка записи
+// не прерывает обработку запроса.
+func (h *UserHandler) recordAuthEvent(r *http.Request, userID int, eventType string) {
+	if h.authAudit == nil || userID == 0 {
+		return
+	}
+	err := h.authAudit.RecordAuthEvent(r.Context(), model.AuthEvent{
+		UserID:    userID,
+		Type:      eventType,
+		IP:        clientIP(r),
+		UserAgent: r.UserAgent(),
+		CreatedAt: time.Now(),
+	})
+	if err != nil {
+		logger.Log.WithError(err).Error("failed to record auth event")
+	}
+}
+
+// GetCSRFToken выдает новый CSRF-токен в cookie и в теле ответа
+func (h *UserHandler) GetCSRFToken(w http.ResponseWriter, _ *http.Request) {
+	token, err := middleware.NewCSRFToken()
+	if err != nil {
+		logger.Log.WithError(err).Error("failed to issue csrf token")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	middleware.SetCSRFCookie(w, token)
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	if err = enc.Encode(model.CSRFTokenRes{Token: token}); err != nil {
+		logger.Log.WithError(err).Error("Error in encoding csrf token response to json")
+	}
+}
+
+// GetSessions возвращает действующие сессии пользователя, текущая сессия отмечается признаком current
+func (h *UserHandler) GetSessions(w http.ResponseWriter, r *http.Request) {
+	user := appctx.GetCtxUser(r.Context())
+	sessions, err := h.userAuth.Sessions.ListUserSessions(r.Context(), user.ID)
+	if err != nil {
+		logger.Log.WithError(err).Error("failed to get user sessions")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	currentID := session.HashID(user.SessionID)
+	for i := range sessions {
+		sessions[i].Current = sessions[i].PublicID == currentID
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	if err = enc.Encode(sessions); err != nil {
+		logger.Log.WithError(err).Error("Error in encoding user sessions response to json")
+	}
+}
+
+// DeleteSession завершает одну из сессий пользователя по ее публичному идентификатору
+func (h *UserHandler) DeleteSession(w http.ResponseWriter, r *http.Request) {
+	user := appctx.GetCtxUser(r.Context())
+	publicID := chi.URLParam(r, "id")
+	if err := h.userAuth.Sessions.DeleteUserSession(r.Context(), user.ID, publicID); err != nil {
+		if errors.Is(err, session.ErrNoSession) {
+			http.Error(w, "Сессия не найдена", http.StatusNotFound)
 			return
 		}
-		logger.Log.WithError(err).Error("failed to withdraw")
+		logger.Log.WithError(err).Error("failed to delete user session")
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
+	if publicID == session.HashID(user.SessionID) {
+		middleware.DeleteSessionCookie(w)
+	}
+
 	w.WriteHeader(http.StatusOK)
 }
 
-func (h *UserHandler) GetWithdraws(w http.ResponseWriter, r *http.Request) {
-	user := appctx.GetCtxUser(r.Context())
-	withdrawals, err := h.storage.GetWithdrawals(r.Context(), user.ID)
+// upgradePasswordHash перехэширует пароль текущим алгоритмом. Ошибка не мешает входу пользователя,
+// попытка будет повторена при следующем входе.
+func (h *UserHandler) upgradePasswordHash(ctx context.Context, userID int, password string) {
+	passwordHash, err := utils.GeneratePasswordHash(password)
 	if err != nil {
-		logger.Log.WithError(err).Error("failed to read user withdrawals")
-		http.Error(w, "Не удалось получить информацию о выводе средств", http.StatusInternalServerError)
+		logger.Log.WithError(err).Error("failed to upgrade user password hash")
+		return
+	}
+	if err = h.storage.UpdatePasswordHash(ctx, userID, passwordHash); err != nil {
+		logger.Log.WithError(err).Error("failed to upgrade user password hash")
+	}
+}
+
+// issueTokens создает серверную сессию пользователя или, если сессии не используются,
+// выпускает короткоживущий JWT и сохраняет новый токен обновления
+func (h *UserHandler) issueTokens(r *http.Request, user model.User) (*model.AuthRes, error) {
+	if h.userAuth.Sessions != nil {
+		sessionID, err := session.NewID()
+		if err != nil {
+			return nil, err
+		}
+		now := time.Now()
+		err = h.userAuth.Sessions.CreateSession(r.Context(), model.Session{
+			ID:         sessionID,
+			UserID:     user.ID,
+			Login:      user.Login,
+			IP:         clientIP(r),
+			UserAgent:  r.UserAgent(),
+			CreatedAt:  now,
+			LastSeenAt: now,
+			ExpiresAt:  now.Add(h.userAuth.SessionTTL),
+		})
+		if err != nil {
+			return nil, err
+		}
+		return &model.AuthRes{Token: sessionID}, nil
+	}
+
+	jwtString, err := utils.BuildJWTSting(user)
+	if err != nil {
+		return nil, err
+	}
+	refreshToken, refreshHash, err := utils.GenerateRefreshToken()
+	if err != nil {
+		return nil, err
+	}
+	if err = h.storage.CreateRefreshToken(r.Context(), user.ID, refreshHash, time.Now().Add(utils.RefreshTokenTTL())); err != nil {
+		return nil, err
+	}
+	return &model.AuthRes{Token: jwtString, RefreshToken: refreshToken}, nil
+}
+
+// writeAuthRes отдает токены пользователя в cookie и в теле ответа, чтобы клиенты без
+// поддержки cookie могли передавать их явно
+func (h *UserHandler) writeAuthRes(w http.ResponseWriter, authRes *model.AuthRes) {
+	h.setAuthCookies(w, authRes)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(authRes); err != nil {
+		logger.Log.WithError(err).Error("Error in encoding auth response to json")
+	}
+}
+
+// setAuthCookies сохраняет токены пользователя в cookie
+func (h *UserHandler) setAuthCookies(w http.ResponseWriter, authRes *model.AuthRes) {
+	if h.userAuth.Sessions != nil {
+		middleware.SetSessionCookie(w, authRes.Token, h.userAuth.SessionTTL)
 		return
 	}
+	middleware.SetJWTCookie(w, authRes.Token)
+	middleware.SetRefreshCookie(w, authRes.RefreshToken, utils.RefreshTokenTTL())
+}
+
+// clientIP возвращает адрес клиента без порта
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
 
+// writeAccountLocked отвечает 423 с моментом окончания блокировки входа
+func writeAccountLocked(w http.ResponseWriter, lockedUntil time.Time) {
 	w.Header().Set("Content-Type", "application/json")
-	if len(withdrawals) == 0 {
-		w.WriteHeader(http.StatusNoContent)
+	w.WriteHeader(http.StatusLocked)
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(model.AccountLockedRes{LockedUntil: lockedUntil}); err != nil {
+		logger.Log.WithError(err).Error("Error in encoding account locked response to json")
+	}
+}
+
+// writePasswordViolations отвечает 400 со списком нарушенных паролем правил
+func writePasswordViolations(w http.ResponseWriter, violations []model.PasswordViolation) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	enc := json.NewEncoder(w)
+	err := enc.Encode(model.PasswordPolicyErrRes{
+		Error:      "Пароль не соответствует требованиям",
+		Violations: violations,
+	})
+	if err != nil {
+		logger.Log.WithError(err).Error("Error in encoding password policy response to json")
+	}
+}
+
+// readRefreshToken читает токен обновления из тела запроса или, если его там нет, из cookie
+func readRefreshToken(r *http.Request) string {
+	if strings.Contains(r.Header.Get("Content-Type"), "application/json") {
+		var req model.RefreshReq
+		if err := json.NewDecoder(r.Body).Decode(&req); err == nil && req.RefreshToken != "" {
+			return req.RefreshToken
+		}
+	}
+	if cookie, err := r.Cookie(middleware.RefreshCookieName); err == nil {
+		return cookie.Value
+	}
+	return ""
+}
+
+// SendEmailVerification отправляет на email пользователя письмо со ссылкой для его подтверждения
+func (h *UserHandler) SendEmailVerification(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user := appctx.GetCtxUser(ctx)
+	dbUser, err := h.storage.GetUserByID(ctx, user.ID)
+	if err != nil {
+		logger.Log.WithError(err).Error("failed to get user for email verification")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if dbUser.Email == "" {
+		http.Error(w, "Email не указан", http.StatusBadRequest)
+		return
+	}
+	if dbUser.EmailVerified {
+		http.Error(w, "Email уже подтвержден", http.StatusConflict)
+		return
+	}
+
+	token, tokenHash, err := utils.GenerateVerificationToken()
+	if err != nil {
+		logger.Log.WithError(err).Error("failed to send email verification")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
+	err = h.storage.CreateEmailVerification(ctx, user.ID, dbUser.Email, tokenHash, time.Now().Add(emailVerificationTTL))
+	if err != nil {
+		logger.Log.WithError(err).Error("failed to send email verification")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	body := fmt.Sprintf(
+		"Для подтверждения email перейдите по ссылке: %s\nСсылка действительна %s.",
+		h.emailVerificationLink(token), emailVerificationTTL,
+	)
+	if err = h.mailer.Send(ctx, dbUser.Email, "Подтверждение email", body); err != nil {
+		logger.Log.WithError(err).Error("failed to send email verification")
+		http.Error(w, "Не удалось отправить письмо", http.StatusBadGateway)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// ConfirmEmail подтверждает email пользователя токеном из письма
+func (h *UserHandler) ConfirmEmail(w http.ResponseWriter, r *http.Request) {
+	contentType := r.Header.Get("Content-Type")
+	if !strings.Contains(contentType, "application/json") {
+		http.Error(w, "Некорректный Content-Type", http.StatusBadRequest)
+		return
+	}
+	var req model.EmailConfirmReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Token == "" {
+		http.Error(w, "Не передан токен подтверждения", http.StatusBadRequest)
+		return
+	}
+
+	if err := h.storage.ConfirmEmail(r.Context(), utils.HashVerificationToken(req.Token)); err != nil {
+		if errors.Is(err, storage.ErrInvalidVerificationToken) {
+			http.Error(w, "Токен подтверждения недействителен или истек", http.StatusBadRequest)
+			return
+		}
+		logger.Log.WithError(err).Error("failed to confirm email")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// emailVerificationLink возвращает ссылку подтверждения email, а без адреса страницы - сам токен
+func (h *UserHandler) emailVerificationLink(token string) string {
+	if h.emailVerificationURL == "" {
+		return token
+	}
+	link, err := url.Parse(h.emailVerificationURL)
+	if err != nil {
+		return token
+	}
+	q := link.Query()
+	q.Set("token", token)
+	link.RawQuery = q.Encode()
+	return link.String()
+}
+
+// isValidEmail проверяет, что строка - email без отображаемого имени
+func isValidEmail(email string) bool {
+	addr, err := mail.ParseAddress(email)
+	return err == nil && addr.Address == email
+}
+
+// CreateNewOrder загружает номер заказа, переданный текстом (text/plain) или в JSON вида {"order": "<номер>"}
+func (h *UserHandler) CreateNewOrder(w http.ResponseWriter, r *http.Request) {
+	var orderNum string
+	contentType := r.Header.Get("Content-Type")
+	switch {
+	case strings.Contains(contentType, "text/plain"):
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			logger.Log.WithError(err).Error("failed to read request order num")
+			http.Error(w, "Не удалось прочитать номер заказа запросе", http.StatusInternalServerError)
+			return
+		}
+		orderNum = string(body)
+	case strings.Contains(contentType, "application/json"):
+		var req model.OrderReq
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			logger.Log.WithError(err).Debug("failed to decode create order req body")
+			http.Error(w, "Некорректный формат запроса, ожидается {\"order\": \"<номер>\"}", http.StatusBadRequest)
+			return
+		}
+		orderNum = req.Number
+	default:
+		http.Error(w, "Некорректный Content-Type, ожидается text/plain или application/json", http.StatusBadRequest)
+		return
+	}
+	// Пустая строка проходит проверку алгоритмом Луна, поэтому проверяется отдельно
+	if strings.TrimSpace(orderNum) == "" || !utils.IsValidOrderNum(orderNum) {
+		http.Error(w, "Некорректный номер заказа", http.StatusUnprocessableEntity)
+		return
+	}
+	user := appctx.GetCtxUser(r.Context())
+	order, err := h.storage.CreateOrder(r.Context(), user.ID, orderNum)
+	if err != nil {
+		if errors.Is(err, storage.ErrOrderNumUsed) {
+			logger.Log.WithError(err).Debug()
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		if errors.Is(err, storage.ErrOrderNumCreated) {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		logger.Log.WithError(err).Error("failed to create new order")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	// Клиенту сразу отдается созданный заказ и адрес, по которому можно следить за его обработкой
+	w.Header().Set("Location", "/api/user/orders/"+url.PathEscape(order.Number))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	enc := json.NewEncoder(w)
+	if err = enc.Encode(order); err != nil {
+		logger.Log.WithError(err).Error("Error in encoding created order response to json")
+	}
+}
+
+// Максимальное количество заказов на странице
+const maxOrdersLimit = 1000
+
+// Максимальное количество списаний на странице
+const maxWithdrawalsLimit = 1000
+
+// Количество месяцев в статистике пользователя по умолчанию и максимальное
+const (
+	defaultStatsMonths = 12
+	maxStatsMonths     = 120
+)
+
+// Максимальное количество номеров заказов в пакетной загрузке
+const maxBatchOrders = 1000
+
+// CreateOrdersBatch загружает пакет номеров заказов в одной транзакции и возвращает результат
+// по каждому номеру в порядке их передачи
+func (h *UserHandler) CreateOrdersBatch(w http.ResponseWriter, r *http.Request) {
+	contentType := r.Header.Get("Content-Type")
+	if !strings.Contains(contentType, "application/json") {
+		http.Error(w, "Некорректный Content-Type", http.StatusBadRequest)
+		return
+	}
+	var orderNums []string
+	if err := json.NewDecoder(r.Body).Decode(&orderNums); err != nil {
+		http.Error(w, "Ожидается JSON-массив номеров заказов", http.StatusBadRequest)
+		return
+	}
+	if len(orderNums) == 0 || len(orderNums) > maxBatchOrders {
+		http.Error(w, fmt.Sprintf("Количество заказов должно быть от 1 до %d", maxBatchOrders), http.StatusBadRequest)
+		return
+	}
+
+	results := make([]model.BatchOrderResult, len(orderNums))
+	validNums := make([]string, 0, len(orderNums))
+	for i, orderNum := range orderNums {
+		results[i] = model.BatchOrderResult{Number: orderNum, Result: model.BatchOrderInvalid}
+		if utils.IsValidOrderNum(orderNum) {
+			validNums = append(validNums, orderNum)
+		}
+	}
+	if len(validNums) > 0 {
+		user := appctx.GetCtxUser(r.Context())
+		created, err := h.storage.CreateOrders(r.Context(), user.ID, validNums)
+		if err != nil {
+			logger.Log.WithError(err).Error("failed to create orders batch")
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		for i := range results {
+			if result, ok := created[results[i].Number]; ok {
+				results[i].Result = result
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(results); err != nil {
+		logger.Log.WithError(err).Error("Error in encoding orders batch response to json")
+	}
+}
+
+// GetOrders отдает заказы пользователя JSON-массивом, кодируя их по одному по мере чтения из БД,
+// чтобы не держать в памяти весь список. Параметры status (через запятую), from и to отбирают заказы
+// по статусу и дате загрузки, sort и order задают сортировку, limit и offset - страницу. Общее
+// количество подходящих заказов передается в заголовке X-Total-Count. Заказы, перенесенные в архив,
+// отдаются через GetArchivedOrders.
+func (h *UserHandler) GetOrders(w http.ResponseWriter, r *http.Request) {
+	user := appctx.GetCtxUser(r.Context())
+
+	query, err := parseOrdersQuery(r)
+	if err != nil {
+		http.Error(w, "Некорректные параметры запроса: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	summary, err := h.storage.GetUserOrdersSummary(r.Context(), user.ID, query)
+	if err != nil {
+		logger.Log.WithError(err).Error("failed to count user orders")
+		http.Error(w, "Не удалось получить заказы", http.StatusInternalServerError)
+		return
+	}
+	// Любое изменение заказов меняет время последнего изменения, а удаление - количество,
+	// поэтому клиент, опрашивающий список, получает тело ответа только при изменениях
+	etag := ordersETag(summary, query)
+	w.Header().Set("ETag", etag)
+	w.Header().Set("X-Total-Count", strconv.Itoa(summary.Count))
+	if etagMatch(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	enc := json.NewEncoder(w)
+	count := 0
+	err = h.storage.StreamUserOrders(r.Context(), user.ID, query, func(order model.Order) error {
+		if count == 0 {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusOK)
+			if _, err := io.WriteString(w, "["); err != nil {
+				return err
+			}
+		} else if _, err := io.WriteString(w, ","); err != nil {
+			return err
+		}
+		count++
+		return enc.Encode(order)
+	})
+	if err != nil {
+		logger.Log.WithError(err).Error("failed to read user orders")
+		// Если часть ответа уже отправлена, статус изменить нельзя
+		if count == 0 {
+			http.Error(w, "Не удалось получить заказы", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	if count == 0 {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if _, err = io.WriteString(w, "]\n"); err != nil {
+		logger.Log.WithError(err).Error("Error in encoding user orders response to json")
+	}
+}
+
+// GetArchivedOrders возвращает страницу заказов пользователя, перенесенных в архив, в порядке загрузки.
+// Параметры limit и offset задают страницу, общее количество заказов в архиве передается в заголовке
+// X-Total-Count.
+func (h *UserHandler) GetArchivedOrders(w http.ResponseWriter, r *http.Request) {
+	user := appctx.GetCtxUser(r.Context())
+	limit, offset, err := parsePage(r.URL.Query(), maxOrdersLimit)
+	if err != nil {
+		http.Error(w, "Некорректные параметры запроса: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	total, err := h.storage.CountArchivedOrders(r.Context(), user.ID)
+	if err != nil {
+		logger.Log.WithError(err).Error("failed to count archived orders")
+		http.Error(w, "Не удалось получить заказы", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("X-Total-Count", strconv.Itoa(total))
+
+	orders, err := h.storage.GetArchivedOrders(r.Context(), user.ID, limit, offset)
+	if err != nil {
+		logger.Log.WithError(err).Error("failed to read archived orders")
+		http.Error(w, "Не удалось получить заказы", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if len(orders) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	enc := json.NewEncoder(w)
+	if err = enc.Encode(orders); err != nil {
+		logger.Log.WithError(err).Error("Error in encoding archived orders response to json")
+	}
+}
+
+// ordersETag возвращает слабый ETag списка заказов по их количеству, времени последнего изменения
+// и параметрам выборки, чтобы разные страницы, сортировки и фильтры одного списка не совпадали.
+// Статусы сортируются, поэтому порядок их перечисления в запросе на ETag не влияет.
+func ordersETag(summary *model.OrdersSummary, query model.OrdersQuery) string {
+	statuses := slices.Clone(query.Statuses)
+	slices.Sort(statuses)
+	statuses = slices.Compact(statuses)
+	h := fnv.New64a()
+	fmt.Fprintf(h, "%d|%d|%v|%s|%d|%d|%s|%t",
+		query.Limit, query.Offset, statuses, query.NumberPrefix,
+		query.From.UnixMicro(), query.To.UnixMicro(), query.Sort.Field, query.Sort.Desc,
+	)
+	return fmt.Sprintf(`W/"%d-%d-%x"`, summary.Count, summary.LastUpdate.UnixMicro(), h.Sum64())
+}
+
+// etagMatch сообщает, совпадает ли один из ETag в заголовке If-None-Match с etag.
+// Слабые и сильные ETag сравниваются без учета префикса W/.
+func etagMatch(ifNoneMatch, etag string) bool {
+	if ifNoneMatch == "" {
+		return false
+	}
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// GetOrder возвращает заказ пользователя по номеру. Чужие заказы не отдаются.
+func (h *UserHandler) GetOrder(w http.ResponseWriter, r *http.Request) {
+	user := appctx.GetCtxUser(r.Context())
+	order, err := h.storage.GetOrderByNum(r.Context(), chi.URLParam(r, "number"))
+	if err != nil {
+		if errors.Is(err, storage.ErrNoOrder) {
+			http.Error(w, "Заказ не найден", http.StatusNotFound)
+			return
+		}
+		logger.Log.WithError(err).Error("failed to get user order")
+		http.Error(w, "Не удалось получить заказ", http.StatusInternalServerError)
+		return
+	}
+	if order.UserID != user.ID {
+		http.Error(w, "Заказ загружен другим пользователем", http.StatusForbidden)
+		return
+	}
+	history, err := h.storage.GetOrderStatusHistory(r.Context(), order.ID)
+	if err != nil {
+		logger.Log.WithError(err).Error("failed to get order status history")
+		http.Error(w, "Не удалось получить заказ", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	if err = enc.Encode(model.NewOrderDetails(*order, history)); err != nil {
+		logger.Log.WithError(err).Error("Error in encoding user order response to json")
+	}
+}
+
+// CancelOrder отменяет загрузку заказа пользователя, пока заказ не передан в систему начислений
+func (h *UserHandler) CancelOrder(w http.ResponseWriter, r *http.Request) {
+	user := appctx.GetCtxUser(r.Context())
+	err := h.storage.CancelOrder(r.Context(), user.ID, chi.URLParam(r, "number"))
+	if err != nil {
+		switch {
+		case errors.Is(err, storage.ErrNoOrder):
+			http.Error(w, "Заказ не найден", http.StatusNotFound)
+		case errors.Is(err, storage.ErrOrderNumUsed):
+			http.Error(w, "Заказ загружен другим пользователем", http.StatusForbidden)
+		case errors.Is(err, storage.ErrOrderNotNew):
+			http.Error(w, "Обработка заказа уже началась", http.StatusConflict)
+		default:
+			logger.Log.WithError(err).Error("failed to cancel user order")
+			http.Error(w, "Не удалось отменить заказ", http.StatusInternalServerError)
+		}
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// RetryOrder возвращает заказ в статусе INVALID в очередь обработки, например если система
+// начислений временно не могла его обработать. Количество повторов ограничено.
+func (h *UserHandler) RetryOrder(w http.ResponseWriter, r *http.Request) {
+	user := appctx.GetCtxUser(r.Context())
+	err := h.storage.RetryOrder(r.Context(), user.ID, chi.URLParam(r, "number"), h.orderMaxRetries)
+	if err != nil {
+		switch {
+		case errors.Is(err, storage.ErrNoOrder):
+			http.Error(w, "Заказ не найден", http.StatusNotFound)
+		case errors.Is(err, storage.ErrOrderNumUsed):
+			http.Error(w, "Заказ загружен другим пользователем", http.StatusForbidden)
+		case errors.Is(err, storage.ErrOrderNotInvalid):
+			http.Error(w, "Повторно обработать можно только заказ в статусе INVALID", http.StatusConflict)
+		case errors.Is(err, storage.ErrOrderRetryLimit):
+			http.Error(w, "Исчерпано количество повторных обработок заказа", http.StatusUnprocessableEntity)
+		default:
+			logger.Log.WithError(err).Error("failed to retry user order")
+			http.Error(w, "Не удалось отправить заказ на повторную обработку", http.StatusInternalServerError)
+		}
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// parseOrdersQuery разбирает параметры выборки заказов из строки запроса
+func parseOrdersQuery(r *http.Request) (model.OrdersQuery, error) {
+	var query model.OrdersQuery
+	params := r.URL.Query()
+	var err error
+	if query.Limit, query.Offset, err = parsePage(params, maxOrdersLimit); err != nil {
+		return query, err
+	}
+	if statuses := params.Get("status"); statuses != "" {
+		for _, s := range strings.Split(statuses, ",") {
+			status := model.OrderStatus(strings.ToUpper(strings.TrimSpace(s)))
+			if !status.IsValid() {
+				return query, fmt.Errorf("неизвестный статус заказа %q", s)
+			}
+			query.Statuses = append(query.Statuses, status)
+		}
+	}
+	if prefix := params.Get("number_prefix"); prefix != "" {
+		if strings.Trim(prefix, "0123456789") != "" {
+			return query, errors.New("параметр number_prefix должен содержать только цифры")
+		}
+		query.NumberPrefix = prefix
+	}
+	if query.From, query.To, err = parsePeriod(params); err != nil {
+		return query, err
+	}
+	query.Sort, err = parseSort(params, model.SortOrdersUploadedAt, model.SortOrdersAccrual)
+	return query, err
+}
+
+// parseWithdrawalsQuery разбирает параметры выборки списаний из строки запроса
+func parseWithdrawalsQuery(r *http.Request) (model.WithdrawalsQuery, error) {
+	var query model.WithdrawalsQuery
+	params := r.URL.Query()
+	var err error
+	if query.Limit, query.Offset, err = parsePage(params, maxWithdrawalsLimit); err != nil {
+		return query, err
+	}
+	if query.From, query.To, err = parsePeriod(params); err != nil {
+		return query, err
+	}
+	query.Sort, err = parseSort(params, model.SortWithdrawalsProcessedAt, model.SortWithdrawalsSum)
+	return query, err
+}
+
+// parsePage разбирает параметры страницы limit (от 1 до maxLimit) и offset
+func parsePage(params url.Values, maxLimit int) (limit, offset int, err error) {
+	if value := params.Get("limit"); value != "" {
+		if limit, err = strconv.Atoi(value); err != nil || limit < 1 || limit > maxLimit {
+			return 0, 0, fmt.Errorf("параметр limit должен быть от 1 до %d", maxLimit)
+		}
+	}
+	if value := params.Get("offset"); value != "" {
+		if offset, err = strconv.Atoi(value); err != nil || offset < 0 {
+			return 0, 0, errors.New("параметр offset должен быть неотрицательным числом")
+		}
+	}
+	return limit, offset, nil
+}
+
+// parsePeriod разбирает границы периода from (включительно) и to (не включительно)
+func parsePeriod(params url.Values) (from, to time.Time, err error) {
+	if from, err = parseDateParam(params.Get("from"), false); err != nil {
+		return from, to, errors.New("некорректный формат параметра from")
+	}
+	if to, err = parseDateParam(params.Get("to"), true); err != nil {
+		return from, to, errors.New("некорректный формат параметра to")
+	}
+	if !from.IsZero() && !to.IsZero() && !from.Before(to) {
+		return from, to, errors.New("параметр from должен быть раньше to")
+	}
+	return from, to, nil
+}
+
+// parseSort разбирает параметры сортировки sort (одно из fields) и order (asc или desc)
+func parseSort(params url.Values, fields ...string) (model.Sort, error) {
+	var sort model.Sort
+	if field := params.Get("sort"); field != "" {
+		for _, f := range fields {
+			if f == field {
+				sort.Field = field
+			}
+		}
+		if sort.Field == "" {
+			return sort, fmt.Errorf("параметр sort должен быть одним из: %s", strings.Join(fields, ", "))
+		}
+	}
+	switch params.Get("order") {
+	case "", "asc":
+	case "desc":
+		sort.Desc = true
+	default:
+		return sort, errors.New("параметр order должен быть asc или desc")
+	}
+	return sort, nil
+}
+
+// parseDateParam разбирает дату в формате RFC3339 или YYYY-MM-DD. Дата без времени в качестве
+// конца диапазона (end) включает весь день. Пустое значение - нулевое время.
+func parseDateParam(value string, end bool) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	t, err := time.ParseInLocation(time.DateOnly, value, time.Local)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if end {
+		t = t.AddDate(0, 0, 1)
+	}
+	return t, nil
+}
+
+func (h *UserHandler) GetBalance(w http.ResponseWriter, r *http.Request) {
+	user := appctx.GetCtxUser(r.Context())
+
+	var balance *model.Balance
+	var err error
+	at := time.Now()
+	// Параметр at позволяет восстановить баланс на момент времени по журналу событий
+	if atParam := r.URL.Query().Get("at"); atParam != "" {
+		var parseErr error
+		at, parseErr = time.Parse(time.RFC3339, atParam)
+		if parseErr != nil {
+			http.Error(w, "Некорректный формат даты", http.StatusBadRequest)
+			return
+		}
+		balance, err = h.storage.GetUserBalanceAt(r.Context(), user.ID, at)
+	} else {
+		balance, err = h.storage.GetUserBalance(r.Context(), user.ID)
+	}
+	if err != nil {
+		logger.Log.WithError(err).Error("failed to read user balance")
+		http.Error(w, "Не удалось получить баланс пользователя", http.StatusInternalServerError)
+		return
+	}
+	if h.currency.Enabled() {
+		rates, ratesErr := h.loadCurrencyRates(r.Context())
+		if ratesErr != nil {
+			logger.Log.WithError(ratesErr).Error("failed to read currency rates")
+			http.Error(w, "Не удалось получить баланс пользователя", http.StatusInternalServerError)
+			return
+		}
+		balance.Converted = rates.convertBalance(*balance, at)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	if err = enc.Encode(balance); err != nil {
+		logger.Log.WithError(err).Error("Error in encoding user balance response to json")
+	}
+}
+
+// CancelWithdrawal отменяет списание в статусе PENDING и возвращает баллы на баланс пользователя
+func (h *UserHandler) CancelWithdrawal(w http.ResponseWriter, r *http.Request) {
+	withdrawalID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "Некорректный id списания", http.StatusBadRequest)
+		return
+	}
+	user := appctx.GetCtxUser(r.Context())
+	withdrawn, err := h.storage.CancelWithdrawal(r.Context(), user.ID, withdrawalID)
+	if err != nil {
+		switch {
+		case errors.Is(err, storage.ErrNoWithdrawal):
+			http.Error(w, "Списание не найдено", http.StatusNotFound)
+		case errors.Is(err, storage.ErrWithdrawalFinal):
+			http.Error(w, "Списание уже нельзя отменить", http.StatusConflict)
+		default:
+			logger.Log.WithError(err).Error("failed to cancel user withdrawal")
+			http.Error(w, "Не удалось отменить списание", http.StatusInternalServerError)
+		}
+		return
+	}
+	h.publishBalanceChange(user.ID, model.BalanceEventWithdrawalCanceled, withdrawn.Number, withdrawn.Sum)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GetTier возвращает уровень пользователя в программе лояльности и прогресс до следующего уровня
+func (h *UserHandler) GetTier(w http.ResponseWriter, r *http.Request) {
+	user := appctx.GetCtxUser(r.Context())
+	lifetime, err := h.storage.GetLifetimeAccrual(r.Context(), user.ID)
+	if err != nil {
+		logger.Log.WithError(err).Error("failed to read user lifetime accrual")
+		http.Error(w, "Не удалось получить уровень пользователя", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	if err = enc.Encode(h.loyaltyTiers.Info(lifetime)); err != nil {
+		logger.Log.WithError(err).Error("Error in encoding user tier response to json")
+	}
+}
+
+// GetBalanceHistory возвращает начисления и списания пользователя в хронологическом порядке
+// с остатком баланса после каждой операции
+func (h *UserHandler) GetBalanceHistory(w http.ResponseWriter, r *http.Request) {
+	user := appctx.GetCtxUser(r.Context())
+	history, err := h.storage.GetBalanceHistory(r.Context(), user.ID)
+	if err != nil {
+		logger.Log.WithError(err).Error("failed to read user balance history")
+		http.Error(w, "Не удалось получить историю баланса", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if len(history) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	enc := json.NewEncoder(w)
+	if err = enc.Encode(history); err != nil {
+		logger.Log.WithError(err).Error("Error in encoding user balance history response to json")
+	}
+}
+
+// GetStats возвращает итоги пользователя по месяцам: количество заказов, суммы начислений и списаний.
+// Параметр months задает количество последних месяцев, включая текущий.
+func (h *UserHandler) GetStats(w http.ResponseWriter, r *http.Request) {
+	months := defaultStatsMonths
+	if value := r.URL.Query().Get("months"); value != "" {
+		var err error
+		if months, err = strconv.Atoi(value); err != nil || months < 1 || months > maxStatsMonths {
+			http.Error(w, fmt.Sprintf("Параметр months должен быть от 1 до %d", maxStatsMonths), http.StatusBadRequest)
+			return
+		}
+	}
+	now := time.Now()
+	since := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, now.Location()).AddDate(0, 1-months, 0)
+
+	user := appctx.GetCtxUser(r.Context())
+	stats, err := h.storage.GetMonthlyStats(r.Context(), user.ID, since)
+	if err != nil {
+		logger.Log.WithError(err).Error("failed to read user monthly stats")
+		http.Error(w, "Не удалось получить статистику", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if len(stats) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	enc := json.NewEncoder(w)
+	if err = enc.Encode(stats); err != nil {
+		logger.Log.WithError(err).Error("Error in encoding user stats response to json")
+	}
+}
+
+// GetStatement возвращает PDF-выписку по счету пользователя за месяц, заданный параметром month (YYYY-MM)
+func (h *UserHandler) GetStatement(w http.ResponseWriter, r *http.Request) {
+	month := r.URL.Query().Get("month")
+	from, err := time.ParseInLocation("2006-01", month, time.Local)
+	if err != nil {
+		http.Error(w, "Некорректный месяц, ожидается формат YYYY-MM", http.StatusBadRequest)
+		return
+	}
+	to := from.AddDate(0, 1, 0)
+
+	user := appctx.GetCtxUser(r.Context())
+	st, err := h.storage.GetStatement(r.Context(), user.ID, from, to)
+	if err != nil {
+		logger.Log.WithError(err).Error("failed to read user statement")
+		http.Error(w, "Не удалось сформировать выписку", http.StatusInternalServerError)
+		return
+	}
+	var buf bytes.Buffer
+	if err = statement.WritePDF(&buf, user.Login, *st); err != nil {
+		logger.Log.WithError(err).Error("failed to render user statement")
+		http.Error(w, "Не удалось сформировать выписку", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/pdf")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="statement-%s.pdf"`, month))
+	w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+	if _, err = buf.WriteTo(w); err != nil {
+		logger.Log.WithError(err).Error("failed to write user statement response")
+	}
+}
+
+// Максимальная длина заголовка Idempotency-Key
+const maxIdempotencyKeyLen = 255
+
+func (h *UserHandler) Withdraw(w http.ResponseWriter, r *http.Request) {
+	contentType := r.Header.Get("Content-Type")
+	if !strings.Contains(contentType, "application/json") {
+		http.Error(w, "Некорректный Content-Type", http.StatusBadRequest)
+		return
+	}
+
+	var reqWithdraw model.Withdrawn
+	dec := json.NewDecoder(r.Body)
+	if err := dec.Decode(&reqWithdraw); err != nil {
+		logger.Log.WithError(err).Error("failed to decode withdraw req body")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	if reqWithdraw.Number == "" || !utils.IsValidOrderNum(reqWithdraw.Number) {
+		http.Error(w, "Некорректный номер заказа", http.StatusUnprocessableEntity)
+		return
+	}
+	if reqWithdraw.Sum <= 0 {
+		http.Error(w, "Некорректная сумма для списания", http.StatusBadRequest)
+		return
+	}
+	if reqWithdraw.Sum < h.minWithdrawSum {
+		http.Error(w, "Сумма списания меньше минимальной ("+h.minWithdrawSum.String()+")", http.StatusUnprocessableEntity)
+		return
+	}
+	// Повтор запроса с тем же ключом возвращает результат исходного списания
+	idempotencyKey := r.Header.Get("Idempotency-Key")
+	if len(idempotencyKey) > maxIdempotencyKeyLen {
+		http.Error(w, "Слишком длинный ключ идемпотентности", http.StatusBadRequest)
+		return
+	}
+
+	user := appctx.GetCtxUser(r.Context())
+	if h.stepUp.Enabled() && reqWithdraw.Sum > h.stepUp.WithdrawThreshold && !user.Elevated() {
+		http.Error(w, "Для списания этой суммы подтвердите пароль (POST /api/user/reauth)", http.StatusForbidden)
+		return
+	}
+	err := h.storage.Withdraw(r.Context(), user.ID, reqWithdraw.Sum, reqWithdraw.Number, idempotencyKey)
+	if err != nil {
+		if errors.Is(err, storage.ErrIdempotencyKeyUsed) {
+			http.Error(w, "Ключ идемпотентности уже использован для другого списания", http.StatusUnprocessableEntity)
+			return
+		}
+		if errors.Is(err, storage.ErrWithdrawBelowMin) {
+			http.Error(w, "Сумма списания меньше минимальной", http.StatusUnprocessableEntity)
+			return
+		}
+		if errors.Is(err, storage.ErrWithdrawLimit) {
+			logger.Log.WithError(err).Debug()
+			http.Error(w, "Превышен лимит списаний за сутки или месяц", http.StatusTooManyRequests)
+			return
+		}
+		if errors.Is(err, storage.ErrInsufficientFunds) {
+			logger.Log.WithError(err).Debug()
+			http.Error(w, "Недостаточно средств на счету", http.StatusPaymentRequired)
+			return
+		}
+		if errors.Is(err, storage.ErrOrderNumUsed) {
+			logger.Log.WithError(err).Debug()
+			http.Error(w, "Номер заказа уже был использован", http.StatusConflict)
+			return
+		}
+		logger.Log.WithError(err).Error("failed to withdraw")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	h.publishBalanceChange(user.ID, model.BalanceEventWithdrawal, reqWithdraw.Number, -reqWithdraw.Sum)
+	w.WriteHeader(http.StatusOK)
+}
+
+// Transfer переводит баллы с баланса пользователя другому пользователю по логину
+func (h *UserHandler) Transfer(w http.ResponseWriter, r *http.Request) {
+	contentType := r.Header.Get("Content-Type")
+	if !strings.Contains(contentType, "application/json") {
+		http.Error(w, "Некорректный Content-Type", http.StatusBadRequest)
+		return
+	}
+
+	var req model.TransferReq
+	dec := json.NewDecoder(r.Body)
+	if err := dec.Decode(&req); err != nil {
+		logger.Log.WithError(err).Error("failed to decode transfer req body")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if req.Login == "" {
+		http.Error(w, "Не указан логин получателя", http.StatusBadRequest)
+		return
+	}
+	if req.Sum <= 0 {
+		http.Error(w, "Некорректная сумма для перевода", http.StatusBadRequest)
+		return
+	}
+
+	user := appctx.GetCtxUser(r.Context())
+	if h.stepUp.Enabled() && req.Sum > h.stepUp.WithdrawThreshold && !user.Elevated() {
+		http.Error(w, "Для перевода этой суммы подтвердите пароль (POST /api/user/reauth)", http.StatusForbidden)
+		return
+	}
+	transfer, err := h.storage.Transfer(r.Context(), user.ID, req.Login, req.Sum)
+	if err != nil {
+		if errors.Is(err, storage.ErrNoUser) {
+			http.Error(w, "Получатель не найден", http.StatusNotFound)
+			return
+		}
+		if errors.Is(err, storage.ErrSelfTransfer) {
+			http.Error(w, "Нельзя перевести баллы самому себе", http.StatusBadRequest)
+			return
+		}
+		if errors.Is(err, storage.ErrInsufficientFunds) {
+			logger.Log.WithError(err).Debug()
+			http.Error(w, "Недостаточно средств на счету", http.StatusPaymentRequired)
+			return
+		}
+		logger.Log.WithError(err).Error("failed to transfer")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	h.publishBalanceChange(user.ID, model.BalanceEventTransferOut, "", -transfer.Sum)
+	h.publishBalanceChange(transfer.CounterpartyID, model.BalanceEventTransferIn, "", transfer.Sum)
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	if err = enc.Encode(transfer); err != nil {
+		logger.Log.WithError(err).Error("Error in encoding transfer response to json")
+	}
+}
+
+// GetTransfers возвращает входящие и исходящие переводы пользователя
+func (h *UserHandler) GetTransfers(w http.ResponseWriter, r *http.Request) {
+	user := appctx.GetCtxUser(r.Context())
+	transfers, err := h.storage.GetTransfers(r.Context(), user.ID)
+	if err != nil {
+		logger.Log.WithError(err).Error("failed to read user transfers")
+		http.Error(w, "Не удалось получить информацию о переводах", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if len(transfers) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	enc := json.NewEncoder(w)
+	if err = enc.Encode(transfers); err != nil {
+		logger.Log.WithError(err).Error("Error in encoding user transfers response to json")
+	}
+}
+
+// GetWithdraws возвращает списания пользователя. Параметры from и to отбирают списания по дате,
+// sort и order задают сортировку, limit и offset - страницу. Общее количество подходящих списаний
+// передается в заголовке X-Total-Count.
+func (h *UserHandler) GetWithdraws(w http.ResponseWriter, r *http.Request) {
+	user := appctx.GetCtxUser(r.Context())
+	query, err := parseWithdrawalsQuery(r)
+	if err != nil {
+		http.Error(w, "Некорректные параметры запроса: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	total, err := h.storage.CountUserWithdrawals(r.Context(), user.ID, query)
+	if err != nil {
+		logger.Log.WithError(err).Error("failed to count user withdrawals")
+		http.Error(w, "Не удалось получить информацию о выводе средств", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("X-Total-Count", strconv.Itoa(total))
+
+	withdrawals, err := h.storage.GetWithdrawals(r.Context(), user.ID, query)
+	if err != nil {
+		logger.Log.WithError(err).Error("failed to read user withdrawals")
+		http.Error(w, "Не удалось получить информацию о выводе средств", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if len(withdrawals) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if h.currency.Enabled() {
+		rates, ratesErr := h.loadCurrencyRates(r.Context())
+		if ratesErr != nil {
+			logger.Log.WithError(ratesErr).Error("failed to read currency rates")
+			http.Error(w, "Не удалось получить информацию о выводе средств", http.StatusInternalServerError)
+			return
+		}
+		// Списание пересчитывается по курсу, действовавшему в момент списания
+		for i := range withdrawals {
+			withdrawals[i].Converted = rates.convert(withdrawals[i].Sum, withdrawals[i].CreatedAt)
+		}
+	}
 	enc := json.NewEncoder(w)
 	if err = enc.Encode(withdrawals); err != nil {
 		logger.Log.WithError(err).Error("Error in encoding user withdrawals response to json")
@@ -1,17 +1,36 @@
 package handlers
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"strings"
 	"testing"
 	"time"
 
+	"github.com/golang-jwt/jwt/v4"
 	"github.com/golang/mock/gomock"
+	"github.com/pinbrain/gophermart/internal/events"
 	"github.com/pinbrain/gophermart/internal/handlers/mocks"
+	"github.com/pinbrain/gophermart/internal/loyalty"
 	"github.com/pinbrain/gophermart/internal/middleware"
 	"github.com/pinbrain/gophermart/internal/model"
+	"github.com/pinbrain/gophermart/internal/passwordpolicy"
+	"github.com/pinbrain/gophermart/internal/ratelimit"
+	"github.com/pinbrain/gophermart/internal/revocation"
+	"github.com/pinbrain/gophermart/internal/session"
 	"github.com/pinbrain/gophermart/internal/storage"
 	"github.com/pinbrain/gophermart/internal/utils"
 	"github.com/stretchr/testify/assert"
@@ -23,7 +42,7 @@ func TestRegisterUser(t *testing.T) {
 	defer ctrl.Finish()
 
 	mockStorage := mocks.NewMockStorage(ctrl)
-	router := NewRouter(mockStorage)
+	router := NewRouter(mockStorage, RouterCfg{})
 
 	type want struct {
 		statusCode int
@@ -31,6 +50,7 @@ func TestRegisterUser(t *testing.T) {
 	type request struct {
 		body        string
 		contentType string
+		email       string
 	}
 	type storageRes struct {
 		userID int
@@ -104,6 +124,47 @@ func TestRegisterUser(t *testing.T) {
 				err:    storage.ErrLoginTaken,
 			},
 		},
+		{
+			name: "Корректный запрос с email",
+			request: request{
+				body:        `{"login":"testuser","password":"password123","email":"user@example.com"}`,
+				contentType: "application/json",
+				email:       "user@example.com",
+			},
+			want: want{
+				statusCode: http.StatusOK,
+			},
+			storageRes: &storageRes{
+				userID: 1,
+				err:    nil,
+			},
+		},
+		{
+			name: "Некорректный email",
+			request: request{
+				body:        `{"login":"testuser","password":"password123","email":"User <user@example.com>"}`,
+				contentType: "application/json",
+			},
+			want: want{
+				statusCode: http.StatusBadRequest,
+			},
+			storageRes: nil,
+		},
+		{
+			name: "Email уже занят",
+			request: request{
+				body:        `{"login":"testuser","password":"password123","email":"user@example.com"}`,
+				contentType: "application/json",
+				email:       "user@example.com",
+			},
+			want: want{
+				statusCode: http.StatusConflict,
+			},
+			storageRes: &storageRes{
+				userID: 0,
+				err:    storage.ErrEmailTaken,
+			},
+		},
 	}
 
 	for _, tt := range tests {
@@ -114,11 +175,17 @@ func TestRegisterUser(t *testing.T) {
 
 			if tt.storageRes != nil {
 				mockStorage.EXPECT().
-					CreateUser(gomock.Any(), "testuser", "password123").
+					CreateUser(gomock.Any(), "testuser", "password123", tt.request.email).
 					Times(1).
 					Return(tt.storageRes.userID, tt.storageRes.err)
 			} else {
-				mockStorage.EXPECT().CreateUser(gomock.Any(), "testuser", "password123").Times(0)
+				mockStorage.EXPECT().CreateUser(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Times(0)
+			}
+			if tt.want.statusCode == http.StatusOK {
+				mockStorage.EXPECT().
+					CreateRefreshToken(gomock.Any(), tt.storageRes.userID, gomock.Any(), gomock.Any()).
+					Return(nil).
+					Times(1)
 			}
 
 			router.ServeHTTP(w, req)
@@ -131,12 +198,80 @@ func TestRegisterUser(t *testing.T) {
 	}
 }
 
+func TestRegisterUserPasswordPolicy(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockStorage := mocks.NewMockStorage(ctrl)
+	policy, err := passwordpolicy.New(passwordpolicy.Cfg{
+		MinLength:       8,
+		RequiredClasses: []string{passwordpolicy.ClassUpper, passwordpolicy.ClassDigit},
+		DenyCommon:      true,
+	})
+	require.NoError(t, err)
+	router := NewRouter(mockStorage, RouterCfg{PasswordPolicy: policy})
+
+	tests := []struct {
+		name      string
+		password  string
+		wantRules []string
+	}{
+		{
+			name:      "Короткий пароль без заглавных букв и цифр",
+			password:  "abc",
+			wantRules: []string{passwordpolicy.RuleMinLength, passwordpolicy.RuleClass, passwordpolicy.RuleClass},
+		},
+		{
+			name:      "Распространенный пароль",
+			password:  "Password123",
+			wantRules: []string{passwordpolicy.RuleCommon},
+		},
+		{
+			name:      "Пароль соответствует политике",
+			password:  "Gopher2024mart",
+			wantRules: nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.wantRules == nil {
+				mockStorage.EXPECT().CreateUser(gomock.Any(), "testuser", tt.password, "").Return(1, nil).Times(1)
+				mockStorage.EXPECT().CreateRefreshToken(gomock.Any(), 1, gomock.Any(), gomock.Any()).Return(nil).Times(1)
+			}
+
+			body := `{"login":"testuser","password":"` + tt.password + `"}`
+			req := httptest.NewRequest(http.MethodPost, "/api/user/register", strings.NewReader(body))
+			req.Header.Set("Content-Type", "application/json")
+			w := httptest.NewRecorder()
+
+			router.ServeHTTP(w, req)
+
+			resp := w.Result()
+			defer resp.Body.Close()
+
+			if tt.wantRules == nil {
+				assert.Equal(t, http.StatusOK, resp.StatusCode)
+				return
+			}
+			assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+			var errRes model.PasswordPolicyErrRes
+			require.NoError(t, json.NewDecoder(resp.Body).Decode(&errRes))
+			rules := make([]string, 0, len(errRes.Violations))
+			for _, violation := range errRes.Violations {
+				rules = append(rules, violation.Rule)
+			}
+			assert.Equal(t, tt.wantRules, rules)
+		})
+	}
+}
+
 func TestLogin(t *testing.T) {
 	ctrl := gomock.NewController(t)
 	defer ctrl.Finish()
 
 	mockStorage := mocks.NewMockStorage(ctrl)
-	router := NewRouter(mockStorage)
+	router := NewRouter(mockStorage, RouterCfg{})
 
 	type want struct {
 		statusCode int
@@ -234,6 +369,12 @@ func TestLogin(t *testing.T) {
 			} else {
 				mockStorage.EXPECT().GetUserByLogin(gomock.Any(), "testuser").Times(0)
 			}
+			if tt.want.statusCode == http.StatusOK {
+				mockStorage.EXPECT().
+					CreateRefreshToken(gomock.Any(), tt.storageRes.userID, gomock.Any(), gomock.Any()).
+					Return(nil).
+					Times(1)
+			}
 
 			router.ServeHTTP(w, req)
 
@@ -241,301 +382,848 @@ func TestLogin(t *testing.T) {
 			defer resp.Body.Close()
 
 			assert.Equal(t, tt.want.statusCode, resp.StatusCode)
+
+			if tt.want.statusCode == http.StatusOK {
+				var authRes model.AuthRes
+				require.NoError(t, json.NewDecoder(resp.Body).Decode(&authRes))
+				claims, err := utils.GetJWTClaims(authRes.Token)
+				require.NoError(t, err)
+				assert.Equal(t, tt.storageRes.userID, claims.UserID)
+				assert.NotEmpty(t, authRes.RefreshToken)
+			}
 		})
 	}
 }
 
-func TestCreateNewOrder(t *testing.T) {
+func TestLoginLockout(t *testing.T) {
 	ctrl := gomock.NewController(t)
 	defer ctrl.Finish()
 
 	mockStorage := mocks.NewMockStorage(ctrl)
-	router := NewRouter(mockStorage)
+	router := NewRouter(mockStorage, RouterCfg{
+		LoginLockout: LoginLockoutCfg{MaxFailures: 3, Duration: time.Minute},
+	})
 
-	type want struct {
-		statusCode int
-	}
-	type request struct {
-		orderNum    string
-		contentType string
-		isAuth      bool
-	}
-	type storageRes struct {
-		orderID int
-		err     error
-	}
+	pwdHash, err := utils.GeneratePasswordHash("password123")
+	require.NoError(t, err)
+	lockedUntil := time.Now().Add(time.Minute).Truncate(time.Second)
 
 	tests := []struct {
-		name       string
-		request    request
-		want       want
-		storageRes *storageRes
+		name        string
+		password    string
+		lockedUntil time.Time
+		failedLock  *time.Time
+		statusCode  int
 	}{
 		{
-			name: "Успешный запрос",
-			request: request{
-				orderNum:    "6485485820226",
-				contentType: "text/plain",
-				isAuth:      true,
-			},
-			want: want{
-				statusCode: http.StatusAccepted,
-			},
-			storageRes: &storageRes{
-				orderID: 1,
-				err:     nil,
-			},
-		},
-		{
-			name: "Номер заказа уже был загружен пользователем",
-			request: request{
-				orderNum:    "6485485820226",
-				contentType: "text/plain",
-				isAuth:      true,
-			},
-			want: want{
-				statusCode: http.StatusOK,
-			},
-			storageRes: &storageRes{
-				orderID: 1,
-				err:     storage.ErrOrderNumCreated,
-			},
-		},
-		{
-			name: "Номер заказа уже был загружен другим пользователем",
-			request: request{
-				orderNum:    "6485485820226",
-				contentType: "text/plain",
-				isAuth:      true,
-			},
-			want: want{
-				statusCode: http.StatusConflict,
-			},
-			storageRes: &storageRes{
-				orderID: 1,
-				err:     storage.ErrOrderNumUsed,
-			},
+			name:       "Успешный вход сбрасывает счетчик",
+			password:   "password123",
+			statusCode: http.StatusOK,
 		},
 		{
-			name: "Неавторизованный запрос",
-			request: request{
-				orderNum:    "6485485820226",
-				contentType: "text/plain",
-				isAuth:      false,
-			},
-			want: want{
-				statusCode: http.StatusUnauthorized,
-			},
-			storageRes: nil,
+			name:       "Неверный пароль",
+			password:   "wrong",
+			failedLock: &time.Time{},
+			statusCode: http.StatusUnauthorized,
 		},
 		{
-			name: "Неверный формат запроса",
-			request: request{
-				orderNum:    "6485485820226",
-				contentType: "application/json",
-				isAuth:      true,
-			},
-			want: want{
-				statusCode: http.StatusBadRequest,
-			},
-			storageRes: nil,
+			name:       "Неверный пароль блокирует вход",
+			password:   "wrong",
+			failedLock: &lockedUntil,
+			statusCode: http.StatusLocked,
 		},
 		{
-			name: "Неверный формат номера заказа",
-			request: request{
-				orderNum:    "123456",
-				contentType: "text/plain",
-				isAuth:      true,
-			},
-			want: want{
-				statusCode: http.StatusUnprocessableEntity,
-			},
-			storageRes: nil,
+			name:        "Вход заблокирован",
+			password:    "password123",
+			lockedUntil: lockedUntil,
+			statusCode:  http.StatusLocked,
 		},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			req := httptest.NewRequest(http.MethodPost, "/api/user/orders", strings.NewReader(tt.request.orderNum))
-			req.Header.Set("Content-Type", tt.request.contentType)
-
-			if tt.request.isAuth {
-				jwtString, err := utils.BuildJWTSting(model.User{ID: 1, Login: "testuser"})
-				require.NoError(t, err)
-				req.AddCookie(&http.Cookie{Name: middleware.JWTCookieName, Value: jwtString})
-			}
-
-			w := httptest.NewRecorder()
-
-			if tt.storageRes != nil {
+			mockStorage.EXPECT().
+				GetUserByLogin(gomock.Any(), "testuser").
+				Return(&model.User{ID: 1, Login: "testuser", PasswordHash: pwdHash, LockedUntil: tt.lockedUntil}, nil).
+				Times(1)
+			if tt.failedLock != nil {
 				mockStorage.EXPECT().
-					CreateOrder(gomock.Any(), 1, tt.request.orderNum).
-					Return(tt.storageRes.orderID, tt.storageRes.err).
+					RegisterFailedLogin(gomock.Any(), 1, 3, time.Minute).
+					Return(*tt.failedLock, nil).
 					Times(1)
-			} else {
-				mockStorage.EXPECT().
-					CreateOrder(gomock.Any(), 1, tt.request.orderNum).Times(0)
+			}
+			if tt.statusCode == http.StatusOK {
+				mockStorage.EXPECT().ResetFailedLogins(gomock.Any(), 1).Return(nil).Times(1)
+				mockStorage.EXPECT().CreateRefreshToken(gomock.Any(), 1, gomock.Any(), gomock.Any()).Return(nil).Times(1)
 			}
 
+			body := `{"login":"testuser","password":"` + tt.password + `"}`
+			req := httptest.NewRequest(http.MethodPost, "/api/user/login", strings.NewReader(body))
+			req.Header.Set("Content-Type", "application/json")
+			w := httptest.NewRecorder()
+
 			router.ServeHTTP(w, req)
 
 			resp := w.Result()
 			defer resp.Body.Close()
 
-			assert.Equal(t, tt.want.statusCode, resp.StatusCode)
+			assert.Equal(t, tt.statusCode, resp.StatusCode)
+			if tt.statusCode == http.StatusLocked {
+				var lockedRes model.AccountLockedRes
+				require.NoError(t, json.NewDecoder(resp.Body).Decode(&lockedRes))
+				assert.True(t, lockedUntil.Equal(lockedRes.LockedUntil))
+			}
 		})
 	}
 }
 
-func TestGetOrders(t *testing.T) {
+func TestAuthAudit(t *testing.T) {
 	ctrl := gomock.NewController(t)
 	defer ctrl.Finish()
 
 	mockStorage := mocks.NewMockStorage(ctrl)
-	router := NewRouter(mockStorage)
+	mockAudit := mocks.NewMockAuthAuditLog(ctrl)
+	router := NewRouter(mockStorage, RouterCfg{AuthAudit: mockAudit})
 
-	type want struct {
-		statusCode int
-		body       string
+	pwdHash, err := utils.GeneratePasswordHash("password123")
+	require.NoError(t, err)
+	mockStorage.EXPECT().
+		GetUserByLogin(gomock.Any(), "testuser").
+		Return(&model.User{ID: 1, Login: "testuser", PasswordHash: pwdHash}, nil).
+		Times(2)
+	mockStorage.EXPECT().CreateRefreshToken(gomock.Any(), 1, gomock.Any(), gomock.Any()).Return(nil).Times(1)
+
+	var recorded []model.AuthEvent
+	mockAudit.EXPECT().
+		RecordAuthEvent(gomock.Any(), gomock.Any()).
+		DoAndReturn(func(_ context.Context, event model.AuthEvent) error {
+			recorded = append(recorded, event)
+			return nil
+		}).
+		Times(2)
+
+	for _, password := range []string{"wrong", "password123"} {
+		req := httptest.NewRequest(http.MethodPost, "/api/user/login",
+			strings.NewReader(`{"login":"testuser","password":"`+password+`"}`))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("User-Agent", "test-agent")
+		req.RemoteAddr = "10.0.0.1:12345"
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		w.Result().Body.Close()
 	}
-	type request struct {
-		isAuth bool
+
+	require.Len(t, recorded, 2)
+	assert.Equal(t, model.AuthEventLoginFailed, recorded[0].Type)
+	assert.Equal(t, model.AuthEventLogin, recorded[1].Type)
+	for _, event := range recorded {
+		assert.Equal(t, 1, event.UserID)
+		assert.Equal(t, "10.0.0.1", event.IP)
+		assert.Equal(t, "test-agent", event.UserAgent)
 	}
-	type storageRes struct {
-		orders []model.Order
-		err    error
+
+	createdAt := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	mockAudit.EXPECT().
+		GetAuthEvents(gomock.Any(), 1, securityEventsLimit).
+		Return([]model.AuthEvent{
+			{ID: 2, UserID: 1, Type: model.AuthEventLogin, IP: "10.0.0.1", UserAgent: "test-agent", CreatedAt: createdAt},
+		}, nil).
+		Times(1)
+
+	jwtString, err := utils.BuildJWTSting(model.User{ID: 1, Login: "testuser"})
+	require.NoError(t, err)
+	req := httptest.NewRequest(http.MethodGet, "/api/user/security-events", nil)
+	req.Header.Set("Authorization", "Bearer "+jwtString)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	resp := w.Result()
+	defer resp.Body.Close()
+
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	resBody, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.JSONEq(t, `[
+		{"type": "login", "ip": "10.0.0.1", "user_agent": "test-agent", "created_at": "2024-05-01T12:00:00Z"}
+	]`, string(resBody))
+}
+
+func TestSuspiciousLogin(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockStorage := mocks.NewMockStorage(ctrl)
+	mockMailer := mocks.NewMockMailer(ctrl)
+	mockNotifier := mocks.NewMockLoginNotifier(ctrl)
+
+	pwdHash, err := utils.GeneratePasswordHash("password123")
+	require.NoError(t, err)
+	dbUser := &model.User{ID: 1, Login: "testuser", PasswordHash: pwdHash}
+	mockStorage.EXPECT().GetUserByLogin(gomock.Any(), "testuser").Return(dbUser, nil).AnyTimes()
+	mockStorage.EXPECT().CreateRefreshToken(gomock.Any(), 1, gomock.Any(), gomock.Any()).Return(nil).Times(3)
+	mockStorage.EXPECT().
+		GetUserByID(gomock.Any(), 1).
+		Return(&model.User{ID: 1, Login: "testuser", Email: "user@example.com", EmailVerified: true}, nil).
+		AnyTimes()
+	device := model.LoginDevice{IP: "10.0.0.1", UserAgent: "test-agent", Network: "10.0.0.0/24"}
+
+	login := func(router http.Handler) *http.Response {
+		req := httptest.NewRequest(http.MethodPost, "/api/user/login",
+			strings.NewReader(`{"login":"testuser","password":"password123"}`))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("User-Agent", "test-agent")
+		req.RemoteAddr = "10.0.0.1:12345"
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w.Result()
 	}
 
+	t.Run("Известное устройство", func(t *testing.T) {
+		router := NewRouter(mockStorage, RouterCfg{
+			Mailer:          mockMailer,
+			SuspiciousLogin: SuspiciousLoginCfg{Enabled: true, Notifier: mockNotifier},
+		})
+		mockStorage.EXPECT().
+			CheckLoginDevice(gomock.Any(), 1, device).
+			Return(model.LoginDeviceCheck{HasHistory: true}, nil).
+			Times(1)
+		mockStorage.EXPECT().RememberLoginDevice(gomock.Any(), 1, device).Return(nil).Times(1)
+
+		resp := login(router)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	})
+
+	t.Run("Новое устройство с уведомлением", func(t *testing.T) {
+		router := NewRouter(mockStorage, RouterCfg{
+			Mailer:          mockMailer,
+			SuspiciousLogin: SuspiciousLoginCfg{Enabled: true, Notifier: mockNotifier},
+		})
+		mockStorage.EXPECT().
+			CheckLoginDevice(gomock.Any(), 1, device).
+			Return(model.LoginDeviceCheck{HasHistory: true, NewDevice: true, NewNetwork: true}, nil).
+			Times(1)
+		mockNotifier.EXPECT().
+			NotifySuspiciousLogin(gomock.Any(), gomock.Any()).
+			DoAndReturn(func(_ context.Context, event model.SuspiciousLoginEvent) error {
+				assert.Equal(t, 1, event.UserID)
+				assert.Equal(t, "10.0.0.1", event.IP)
+				assert.True(t, event.NewDevice)
+				return nil
+			}).
+			Times(1)
+		mockMailer.EXPECT().Send(gomock.Any(), "user@example.com", gomock.Any(), gomock.Any()).Return(nil).Times(1)
+		mockStorage.EXPECT().RememberLoginDevice(gomock.Any(), 1, device).Return(nil).Times(1)
+
+		resp := login(router)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	})
+
+	t.Run("Подтверждение входа с нового устройства", func(t *testing.T) {
+		router := NewRouter(mockStorage, RouterCfg{
+			Mailer:          mockMailer,
+			SuspiciousLogin: SuspiciousLoginCfg{Enabled: true, RequireVerification: true},
+		})
+		mockStorage.EXPECT().
+			CheckLoginDevice(gomock.Any(), 1, device).
+			Return(model.LoginDeviceCheck{HasHistory: true, NewDevice: true}, nil).
+			Times(1)
+		var tokenHash string
+		mockStorage.EXPECT().
+			CreateLoginVerification(gomock.Any(), 1, device, gomock.Any(), gomock.Any()).
+			DoAndReturn(func(_ context.Context, _ int, _ model.LoginDevice, hash string, _ time.Time) error {
+				tokenHash = hash
+				return nil
+			}).
+			Times(1)
+		var token string
+		mockMailer.EXPECT().
+			Send(gomock.Any(), "user@example.com", gomock.Any(), gomock.Any()).
+			DoAndReturn(func(_ context.Context, _, _, body string) error {
+				for _, field := range strings.Fields(body) {
+					if utils.HashVerificationToken(field) == tokenHash {
+						token = field
+					}
+				}
+				return nil
+			}).
+			Times(1)
+
+		resp := login(router)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusAccepted, resp.StatusCode)
+		assert.Empty(t, resp.Cookies())
+		require.NotEmpty(t, token)
+
+		mockStorage.EXPECT().
+			ConfirmLoginVerification(gomock.Any(), tokenHash).
+			Return(dbUser, &model.LoginDevice{IP: "10.0.0.1", UserAgent: "test-agent"}, nil).
+			Times(1)
+		mockStorage.EXPECT().RememberLoginDevice(gomock.Any(), 1, device).Return(nil).Times(1)
+
+		req := httptest.NewRequest(http.MethodPost, "/api/user/login/confirm",
+			strings.NewReader(`{"token":"`+token+`"}`))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		confirmResp := w.Result()
+		defer confirmResp.Body.Close()
+		assert.Equal(t, http.StatusOK, confirmResp.StatusCode)
+		assert.NotEmpty(t, confirmResp.Cookies())
+	})
+}
+
+func TestLoginUpgradesPasswordHash(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockStorage := mocks.NewMockStorage(ctrl)
+	router := NewRouter(mockStorage, RouterCfg{})
+
+	bcryptHash, err := utils.GeneratePasswordHash("password123")
+	require.NoError(t, err)
+	require.NoError(t, utils.ConfigurePasswordHashing(utils.PasswordHashArgon2id))
+	t.Cleanup(func() {
+		require.NoError(t, utils.ConfigurePasswordHashing(utils.PasswordHashBcrypt))
+	})
+	argon2Hash, err := utils.GeneratePasswordHash("password123")
+	require.NoError(t, err)
+
 	tests := []struct {
-		name       string
-		request    request
-		want       want
-		storageRes *storageRes
+		name        string
+		storedHash  string
+		wantUpgrade bool
 	}{
 		{
-			name: "Успешный запрос",
-			request: request{
-				isAuth: true,
-			},
-			want: want{
-				statusCode: http.StatusOK,
-				body: `
-					[
-						{
-									"number": "9278923470",
-									"status": "PROCESSED",
-									"accrual": 500,
-									"uploaded_at": "2020-12-10T15:15:45+03:00"
-							},
-							{
-									"number": "346436439",
-									"status": "INVALID",
-									"uploaded_at": "2020-12-09T16:09:53+03:00"
-							}
-					]
-				`,
-			},
-			storageRes: &storageRes{
-				err: nil,
-				orders: []model.Order{
-					{
-						ID:        1,
-						Number:    "9278923470",
-						Status:    model.OrderProcessed,
-						Accrual:   500,
-						CreatedAt: time.Date(2020, 12, 10, 15, 15, 45, 0, time.Local),
-					},
-					{
-						ID:        2,
-						Number:    "346436439",
-						Status:    model.OrderInvalid,
-						CreatedAt: time.Date(2020, 12, 9, 16, 9, 53, 0, time.Local),
-					},
-				},
-			},
+			name:        "Хэш bcrypt перехэшируется",
+			storedHash:  bcryptHash,
+			wantUpgrade: true,
 		},
 		{
-			name: "Нет данных",
-			request: request{
-				isAuth: true,
-			},
-			want: want{
-				statusCode: http.StatusNoContent,
-				body:       "",
-			},
-			storageRes: &storageRes{
-				err:    nil,
-				orders: []model.Order{},
-			},
+			name:        "Хэш argon2id не меняется",
+			storedHash:  argon2Hash,
+			wantUpgrade: false,
 		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockStorage.EXPECT().
+				GetUserByLogin(gomock.Any(), "testuser").
+				Return(&model.User{ID: 1, Login: "testuser", PasswordHash: tt.storedHash}, nil).
+				Times(1)
+			if tt.wantUpgrade {
+				mockStorage.EXPECT().
+					UpdatePasswordHash(gomock.Any(), 1, gomock.Any()).
+					DoAndReturn(func(_ context.Context, _ int, passwordHash string) error {
+						assert.True(t, strings.HasPrefix(passwordHash, "$argon2id$"))
+						assert.True(t, utils.ComparePwdAndHash("password123", passwordHash))
+						return nil
+					}).
+					Times(1)
+			} else {
+				mockStorage.EXPECT().UpdatePasswordHash(gomock.Any(), gomock.Any(), gomock.Any()).Times(0)
+			}
+			mockStorage.EXPECT().
+				CreateRefreshToken(gomock.Any(), 1, gomock.Any(), gomock.Any()).
+				Return(nil).
+				Times(1)
+
+			req := httptest.NewRequest(http.MethodPost, "/api/user/login",
+				strings.NewReader(`{"login":"testuser","password":"password123"}`))
+			req.Header.Set("Content-Type", "application/json")
+			w := httptest.NewRecorder()
+
+			router.ServeHTTP(w, req)
+
+			resp := w.Result()
+			defer resp.Body.Close()
+
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+		})
+	}
+}
+
+func TestLoginCookieAttributes(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockStorage := mocks.NewMockStorage(ctrl)
+	router := NewRouter(mockStorage, RouterCfg{})
+
+	require.NoError(t, middleware.ConfigureCookies(middleware.CookieCfg{
+		Secure:   true,
+		SameSite: http.SameSiteNoneMode,
+		Domain:   "gophermart.ru",
+		MaxAge:   15 * time.Minute,
+	}))
+	t.Cleanup(func() {
+		require.NoError(t, middleware.ConfigureCookies(middleware.CookieCfg{}))
+	})
+
+	pwdHash, err := utils.GeneratePasswordHash("password123")
+	require.NoError(t, err)
+	mockStorage.EXPECT().
+		GetUserByLogin(gomock.Any(), "testuser").
+		Return(&model.User{ID: 1, Login: "testuser", PasswordHash: pwdHash}, nil).
+		Times(1)
+	mockStorage.EXPECT().CreateRefreshToken(gomock.Any(), 1, gomock.Any(), gomock.Any()).Return(nil).Times(1)
+
+	req := httptest.NewRequest(http.MethodPost, "/api/user/login",
+		strings.NewReader(`{"login":"testuser","password":"password123"}`))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+
+	router.ServeHTTP(w, req)
+
+	resp := w.Result()
+	defer resp.Body.Close()
+
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	cookies := resp.Cookies()
+	require.Len(t, cookies, 2)
+	for _, cookie := range cookies {
+		assert.True(t, cookie.Secure)
+		assert.True(t, cookie.HttpOnly)
+		assert.Equal(t, http.SameSiteNoneMode, cookie.SameSite)
+		assert.Equal(t, "gophermart.ru", cookie.Domain)
+		switch cookie.Name {
+		case middleware.JWTCookieName:
+			assert.Equal(t, 15*60, cookie.MaxAge)
+		case middleware.RefreshCookieName:
+			assert.Equal(t, int(utils.RefreshTokenTTL().Seconds()), cookie.MaxAge)
+		default:
+			t.Errorf("unexpected cookie %s", cookie.Name)
+		}
+	}
+}
+
+func TestBearerAuth(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockStorage := mocks.NewMockStorage(ctrl)
+	router := NewRouter(mockStorage, RouterCfg{})
+
+	jwtString, err := utils.BuildJWTSting(model.User{ID: 1, Login: "testuser"})
+	require.NoError(t, err)
+
+	tests := []struct {
+		name       string
+		authHeader string
+		statusCode int
+	}{
 		{
-			name: "Неавторизованный запрос",
-			request: request{
-				isAuth: false,
-			},
-			want: want{
-				statusCode: http.StatusUnauthorized,
-				body:       "",
-			},
-			storageRes: nil,
+			name:       "Валидный токен",
+			authHeader: "Bearer " + jwtString,
+			statusCode: http.StatusOK,
+		},
+		{
+			name:       "Невалидный токен",
+			authHeader: "Bearer invalid",
+			statusCode: http.StatusUnauthorized,
+		},
+		{
+			name:       "Неподдерживаемая схема авторизации",
+			authHeader: "Basic dGVzdDp0ZXN0",
+			statusCode: http.StatusUnauthorized,
 		},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			req := httptest.NewRequest(http.MethodGet, "/api/user/orders", nil)
-
-			if tt.request.isAuth {
-				jwtString, err := utils.BuildJWTSting(model.User{ID: 1, Login: "testuser"})
-				require.NoError(t, err)
-				req.AddCookie(&http.Cookie{Name: middleware.JWTCookieName, Value: jwtString})
+			if tt.statusCode == http.StatusOK {
+				mockStorage.EXPECT().
+					GetUserBalance(gomock.Any(), 1).
+					Return(&model.Balance{Current: model.MoneyFromFloat(10), Withdrawn: model.MoneyFromFloat(0)}, nil).
+					Times(1)
 			}
 
+			req := httptest.NewRequest(http.MethodGet, "/api/user/balance", nil)
+			req.Header.Set("Authorization", tt.authHeader)
 			w := httptest.NewRecorder()
 
-			if tt.storageRes != nil {
+			router.ServeHTTP(w, req)
+
+			resp := w.Result()
+			defer resp.Body.Close()
+
+			assert.Equal(t, tt.statusCode, resp.StatusCode)
+		})
+	}
+}
+
+func TestJWTKeyRotation(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockStorage := mocks.NewMockStorage(ctrl)
+	router := NewRouter(mockStorage, RouterCfg{})
+
+	oldKey := utils.JWTKey{ID: "old", Secret: "old_secret"}
+	newKey := utils.JWTKey{ID: "new", Secret: "new_secret"}
+	t.Cleanup(func() {
+		require.NoError(t, utils.ConfigureJWT(utils.JWTCfg{
+			Keys: []utils.JWTKey{utils.DefaultJWTKey()}, TTL: time.Hour, RefreshTTL: time.Hour,
+		}))
+	})
+
+	require.NoError(t, utils.ConfigureJWT(utils.JWTCfg{Keys: []utils.JWTKey{oldKey}, TTL: time.Hour, RefreshTTL: time.Hour}))
+	jwtString, err := utils.BuildJWTSting(model.User{ID: 1, Login: "testuser"})
+	require.NoError(t, err)
+
+	tests := []struct {
+		name       string
+		keys       []utils.JWTKey
+		statusCode int
+	}{
+		{
+			name:       "Токен подписан предыдущим ключом",
+			keys:       []utils.JWTKey{newKey, oldKey},
+			statusCode: http.StatusOK,
+		},
+		{
+			name:       "Ключ токена удален",
+			keys:       []utils.JWTKey{newKey},
+			statusCode: http.StatusUnauthorized,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.NoError(t, utils.ConfigureJWT(utils.JWTCfg{Keys: tt.keys, TTL: time.Hour, RefreshTTL: time.Hour}))
+			if tt.statusCode == http.StatusOK {
 				mockStorage.EXPECT().
-					GetUserOrders(gomock.Any(), 1).
-					Return(tt.storageRes.orders, tt.storageRes.err).
+					GetUserBalance(gomock.Any(), 1).
+					Return(&model.Balance{Current: model.MoneyFromFloat(10), Withdrawn: model.MoneyFromFloat(0)}, nil).
 					Times(1)
-			} else {
+			}
+
+			req := httptest.NewRequest(http.MethodGet, "/api/user/balance", nil)
+			req.Header.Set("Authorization", "Bearer "+jwtString)
+			w := httptest.NewRecorder()
+
+			router.ServeHTTP(w, req)
+
+			resp := w.Result()
+			defer resp.Body.Close()
+
+			assert.Equal(t, tt.statusCode, resp.StatusCode)
+		})
+	}
+}
+
+func TestAsymmetricJWT(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockStorage := mocks.NewMockStorage(ctrl)
+	router := NewRouter(mockStorage, RouterCfg{})
+
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, utils.ConfigureJWT(utils.JWTCfg{
+			Keys: []utils.JWTKey{utils.DefaultJWTKey()}, TTL: time.Hour, RefreshTTL: time.Hour,
+		}))
+	})
+
+	// Токен, выпущенный до перехода на асимметричную подпись
+	require.NoError(t, utils.ConfigureJWT(utils.JWTCfg{
+		Keys: []utils.JWTKey{utils.DefaultJWTKey()}, TTL: time.Hour, RefreshTTL: time.Hour,
+	}))
+	hmacToken, err := utils.BuildJWTSting(model.User{ID: 1, Login: "testuser"})
+	require.NoError(t, err)
+
+	require.NoError(t, utils.ConfigureJWT(utils.JWTCfg{
+		Keys: []utils.JWTKey{
+			{ID: "ed", PrivateKey: edKey},
+			{ID: "rsa", PrivateKey: rsaKey},
+			utils.DefaultJWTKey(),
+		},
+		TTL:        time.Hour,
+		RefreshTTL: time.Hour,
+	}))
+	edToken, err := utils.BuildJWTSting(model.User{ID: 1, Login: "testuser"})
+	require.NoError(t, err)
+	// Подпись HMAC с открытым ключом в качестве секрета не должна приниматься
+	forged := jwt.NewWithClaims(jwt.SigningMethodHS256, utils.JWTClaims{UserID: 1, Login: "testuser"})
+	forged.Header["kid"] = "ed"
+	forgedToken, err := forged.SignedString([]byte(edKey.Public().(ed25519.PublicKey)))
+	require.NoError(t, err)
+
+	// Открытые ключи публикуются в JWKS, секрет HMAC - нет
+	req := httptest.NewRequest(http.MethodGet, "/.well-known/jwks.json", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	resp := w.Result()
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var jwks model.JWKS
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&jwks))
+	require.Len(t, jwks.Keys, 2)
+	assert.Equal(t, model.JWK{
+		Kty: "OKP", Kid: "ed", Use: "sig", Alg: "EdDSA", Crv: "Ed25519",
+		X: base64.RawURLEncoding.EncodeToString(edKey.Public().(ed25519.PublicKey)),
+	}, jwks.Keys[0])
+	assert.Equal(t, "RSA", jwks.Keys[1].Kty)
+	assert.Equal(t, "RS256", jwks.Keys[1].Alg)
+	assert.Equal(t, "AQAB", jwks.Keys[1].E)
+
+	tests := []struct {
+		name       string
+		token      string
+		statusCode int
+	}{
+		{
+			name:       "Токен подписан Ed25519",
+			token:      edToken,
+			statusCode: http.StatusOK,
+		},
+		{
+			name:       "Токен подписан прежним ключом HMAC",
+			token:      hmacToken,
+			statusCode: http.StatusOK,
+		},
+		{
+			name:       "Подмена алгоритма подписи",
+			token:      forgedToken,
+			statusCode: http.StatusUnauthorized,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.statusCode == http.StatusOK {
 				mockStorage.EXPECT().
-					GetUserOrders(gomock.Any(), 1).Times(0)
+					GetUserBalance(gomock.Any(), 1).
+					Return(&model.Balance{Current: model.MoneyFromFloat(10)}, nil).
+					Times(1)
 			}
 
+			req := httptest.NewRequest(http.MethodGet, "/api/user/balance", nil)
+			req.Header.Set("Authorization", "Bearer "+tt.token)
+			w := httptest.NewRecorder()
+
 			router.ServeHTTP(w, req)
 
 			resp := w.Result()
 			defer resp.Body.Close()
 
-			assert.Equal(t, tt.want.statusCode, resp.StatusCode)
+			assert.Equal(t, tt.statusCode, resp.StatusCode)
+		})
+	}
+}
 
-			if tt.want.body != "" {
-				resBody, readErr := io.ReadAll(resp.Body)
-				require.NoError(t, readErr)
-				assert.JSONEq(t, tt.want.body, string(resBody))
+func TestLogout(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockStorage := mocks.NewMockStorage(ctrl)
+	router := NewRouter(mockStorage, RouterCfg{UserAuth: middleware.UserAuthCfg{Revocations: revocation.NewMemoryStore()}})
+
+	jwtString, err := utils.BuildJWTSting(model.User{ID: 1, Login: "testuser"})
+	require.NoError(t, err)
+
+	mockStorage.EXPECT().
+		RevokeRefreshToken(gomock.Any(), utils.HashRefreshToken("refresh_token")).
+		Return(nil).
+		Times(1)
+
+	req := httptest.NewRequest(http.MethodPost, "/api/user/logout", nil)
+	req.AddCookie(&http.Cookie{Name: middleware.JWTCookieName, Value: jwtString})
+	req.AddCookie(&http.Cookie{Name: middleware.RefreshCookieName, Value: "refresh_token"})
+	w := httptest.NewRecorder()
+
+	router.ServeHTTP(w, req)
+
+	resp := w.Result()
+	defer resp.Body.Close()
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	cookies := resp.Cookies()
+	require.Len(t, cookies, 2)
+	for _, cookie := range cookies {
+		assert.Empty(t, cookie.Value)
+		assert.Negative(t, cookie.MaxAge)
+	}
+
+	// После выхода токен больше не принимается
+	req = httptest.NewRequest(http.MethodGet, "/api/user/balance", nil)
+	req.Header.Set("Authorization", "Bearer "+jwtString)
+	w = httptest.NewRecorder()
+
+	router.ServeHTTP(w, req)
+
+	revokedResp := w.Result()
+	defer revokedResp.Body.Close()
+
+	assert.Equal(t, http.StatusUnauthorized, revokedResp.StatusCode)
+}
+
+func TestGetProfile(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockStorage := mocks.NewMockStorage(ctrl)
+	router := NewRouter(mockStorage, RouterCfg{})
+
+	jwtString, err := utils.BuildJWTSting(model.User{ID: 1, Login: "testuser"})
+	require.NoError(t, err)
+
+	tests := []struct {
+		name       string
+		dbUser     *model.User
+		storageErr error
+		statusCode int
+		resBody    string
+	}{
+		{
+			name: "Пользователь с email",
+			dbUser: &model.User{
+				ID: 1, Login: "testuser", Email: "user@example.com", EmailVerified: true,
+				Role: model.RoleUser, CreatedAt: time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC),
+			},
+			statusCode: http.StatusOK,
+			resBody: `{"login": "testuser", "email": "user@example.com", "email_verified": true,
+				"role": "user", "registered_at": "2024-05-01T12:00:00Z"}`,
+		},
+		{
+			name: "Пользователь без email",
+			dbUser: &model.User{
+				ID: 1, Login: "testuser", Role: model.RoleUser, CreatedAt: time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC),
+			},
+			statusCode: http.StatusOK,
+			resBody:    `{"login": "testuser", "email_verified": false, "role": "user", "registered_at": "2024-05-01T12:00:00Z"}`,
+		},
+		{
+			name:       "Ошибка хранилища",
+			storageErr: errors.New("db error"),
+			statusCode: http.StatusInternalServerError,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockStorage.EXPECT().GetUserByID(gomock.Any(), 1).Return(tt.dbUser, tt.storageErr).Times(1)
+
+			req := httptest.NewRequest(http.MethodGet, "/api/user", nil)
+			req.Header.Set("Authorization", "Bearer "+jwtString)
+			w := httptest.NewRecorder()
+
+			router.ServeHTTP(w, req)
+
+			resp := w.Result()
+			defer resp.Body.Close()
+
+			assert.Equal(t, tt.statusCode, resp.StatusCode)
+			if tt.resBody != "" {
+				resBody, err := io.ReadAll(resp.Body)
+				require.NoError(t, err)
+				assert.JSONEq(t, tt.resBody, string(resBody))
 			}
 		})
 	}
 }
 
-func TestGetBalance(t *testing.T) {
+// tokenVersionsStub хранит версии токенов пользователей в памяти теста
+type tokenVersionsStub map[int]int
+
+func (s tokenVersionsStub) GetTokenVersion(_ context.Context, userID int) (int, error) {
+	return s[userID], nil
+}
+
+func TestChangePassword(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockStorage := mocks.NewMockStorage(ctrl)
+	tokenVersions := tokenVersionsStub{}
+	router := NewRouter(mockStorage, RouterCfg{
+		UserAuth: middleware.UserAuthCfg{TokenVersions: tokenVersions},
+	})
+
+	pwdHash, err := utils.GeneratePasswordHash("password123")
+	require.NoError(t, err)
+	mockStorage.EXPECT().
+		GetUserByLogin(gomock.Any(), "testuser").
+		Return(&model.User{ID: 1, Login: "testuser", PasswordHash: pwdHash}, nil).
+		AnyTimes()
+	oldToken, err := utils.BuildJWTSting(model.User{ID: 1, Login: "testuser"})
+	require.NoError(t, err)
+
+	changePassword := func(body string) *http.Response {
+		req := httptest.NewRequest(http.MethodPost, "/api/user/password", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+oldToken)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w.Result()
+	}
+
+	t.Run("Неверный текущий пароль", func(t *testing.T) {
+		resp := changePassword(`{"current_password":"wrong","new_password":"newpassword456"}`)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	})
+
+	t.Run("Не передан новый пароль", func(t *testing.T) {
+		resp := changePassword(`{"current_password":"password123"}`)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	})
+
+	t.Run("Пароль изменен, старый токен не действует", func(t *testing.T) {
+		mockStorage.EXPECT().
+			ChangePassword(gomock.Any(), 1, gomock.Any()).
+			DoAndReturn(func(_ context.Context, userID int, passwordHash string) (int, error) {
+				assert.True(t, utils.ComparePwdAndHash("newpassword456", passwordHash))
+				tokenVersions[userID] = 1
+				return 1, nil
+			}).
+			Times(1)
+		mockStorage.EXPECT().CreateRefreshToken(gomock.Any(), 1, gomock.Any(), gomock.Any()).Return(nil).Times(1)
+
+		resp := changePassword(`{"current_password":"password123","new_password":"newpassword456"}`)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		var authRes model.AuthRes
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&authRes))
+		claims, err := utils.GetJWTClaims(authRes.Token)
+		require.NoError(t, err)
+		assert.Equal(t, 1, claims.TokenVersion)
+
+		mockStorage.EXPECT().GetUserBalance(gomock.Any(), 1).Return(&model.Balance{}, nil).Times(1)
+		for token, statusCode := range map[string]int{oldToken: http.StatusUnauthorized, authRes.Token: http.StatusOK} {
+			req := httptest.NewRequest(http.MethodGet, "/api/user/balance", nil)
+			req.Header.Set("Authorization", "Bearer "+token)
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			balanceResp := w.Result()
+			balanceResp.Body.Close()
+			assert.Equal(t, statusCode, balanceResp.StatusCode)
+		}
+	})
+}
+
+func TestRefreshToken(t *testing.T) {
 	ctrl := gomock.NewController(t)
 	defer ctrl.Finish()
 
 	mockStorage := mocks.NewMockStorage(ctrl)
-	router := NewRouter(mockStorage)
+	router := NewRouter(mockStorage, RouterCfg{})
 
 	type want struct {
 		statusCode int
-		body       string
 	}
 	type request struct {
-		isAuth bool
+		body   string
+		cookie string
 	}
 	type storageRes struct {
-		balance *model.Balance
-		err     error
+		user *model.User
+		err  error
 	}
 
 	tests := []struct {
@@ -545,353 +1233,3535 @@ func TestGetBalance(t *testing.T) {
 		storageRes *storageRes
 	}{
 		{
-			name: "Успешный запрос",
+			name: "Токен в теле запроса",
 			request: request{
-				isAuth: true,
+				body: `{"refresh_token":"refresh_token"}`,
 			},
 			want: want{
 				statusCode: http.StatusOK,
-				body: `
-					{
-						"current": 500.5,
-						"withdrawn": 42
-					}
-				`,
 			},
 			storageRes: &storageRes{
-				err: nil,
-				balance: &model.Balance{
-					UserID:    1,
-					Current:   500.5,
-					Withdrawn: 42,
-				},
+				user: &model.User{ID: 1, Login: "testuser"},
+			},
+		},
+		{
+			name: "Токен в cookie",
+			request: request{
+				cookie: "refresh_token",
+			},
+			want: want{
+				statusCode: http.StatusOK,
 			},
+			storageRes: &storageRes{
+				user: &model.User{ID: 1, Login: "testuser"},
+			},
+		},
+		{
+			name: "Токен отозван или истек",
+			request: request{
+				body: `{"refresh_token":"refresh_token"}`,
+			},
+			want: want{
+				statusCode: http.StatusUnauthorized,
+			},
+			storageRes: &storageRes{
+				err: storage.ErrInvalidRefreshToken,
+			},
+		},
+		{
+			name:    "Токен не передан",
+			request: request{},
+			want: want{
+				statusCode: http.StatusBadRequest,
+			},
+			storageRes: nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/api/user/token/refresh", strings.NewReader(tt.request.body))
+			req.Header.Set("Content-Type", "application/json")
+			if tt.request.cookie != "" {
+				req.AddCookie(&http.Cookie{Name: middleware.RefreshCookieName, Value: tt.request.cookie})
+			}
+			w := httptest.NewRecorder()
+
+			if tt.storageRes != nil {
+				mockStorage.EXPECT().
+					RotateRefreshToken(gomock.Any(), utils.HashRefreshToken("refresh_token"), gomock.Any(), gomock.Any()).
+					Return(tt.storageRes.user, tt.storageRes.err).
+					Times(1)
+			} else {
+				mockStorage.EXPECT().RotateRefreshToken(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Times(0)
+			}
+
+			router.ServeHTTP(w, req)
+
+			resp := w.Result()
+			defer resp.Body.Close()
+
+			assert.Equal(t, tt.want.statusCode, resp.StatusCode)
+
+			if tt.want.statusCode == http.StatusOK {
+				var authRes model.AuthRes
+				require.NoError(t, json.NewDecoder(resp.Body).Decode(&authRes))
+				claims, err := utils.GetJWTClaims(authRes.Token)
+				require.NoError(t, err)
+				assert.Equal(t, tt.storageRes.user.ID, claims.UserID)
+				assert.NotEmpty(t, authRes.RefreshToken)
+				assert.NotEqual(t, "refresh_token", authRes.RefreshToken)
+			}
+		})
+	}
+}
+
+func TestSessionAuth(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockStorage := mocks.NewMockStorage(ctrl)
+	router := NewRouter(mockStorage, RouterCfg{
+		UserAuth: middleware.UserAuthCfg{Sessions: session.NewMemoryStore(), SessionTTL: time.Hour},
+	})
+
+	pwdHash, err := utils.GeneratePasswordHash("password123")
+	require.NoError(t, err)
+	mockStorage.EXPECT().
+		GetUserByLogin(gomock.Any(), "testuser").
+		Return(&model.User{ID: 1, Login: "testuser", PasswordHash: pwdHash}, nil).
+		Times(2)
+	mockStorage.EXPECT().CreateRefreshToken(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Times(0)
+
+	login := func() (string, *http.Cookie) {
+		req := httptest.NewRequest(http.MethodPost, "/api/user/login",
+			strings.NewReader(`{"login":"testuser","password":"password123"}`))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		resp := w.Result()
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+
+		var authRes model.AuthRes
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&authRes))
+		assert.Empty(t, authRes.RefreshToken)
+		var sessionCookie *http.Cookie
+		for _, cookie := range resp.Cookies() {
+			if cookie.Name == middleware.SessionCookieName {
+				sessionCookie = cookie
+			}
+		}
+		require.NotNil(t, sessionCookie)
+		assert.Equal(t, authRes.Token, sessionCookie.Value)
+		return authRes.Token, sessionCookie
+	}
+	getBalance := func(sessionCookie *http.Cookie) int {
+		req := httptest.NewRequest(http.MethodGet, "/api/user/balance", nil)
+		req.AddCookie(sessionCookie)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		resp := w.Result()
+		defer resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	_, firstCookie := login()
+	secondToken, secondCookie := login()
+
+	mockStorage.EXPECT().
+		GetUserBalance(gomock.Any(), 1).
+		Return(&model.Balance{Current: model.MoneyFromFloat(10)}, nil).
+		Times(2)
+	assert.Equal(t, http.StatusOK, getBalance(firstCookie))
+	assert.Equal(t, http.StatusOK, getBalance(secondCookie))
+
+	// Выход на всех устройствах завершает обе сессии
+	req := httptest.NewRequest(http.MethodPost, "/api/user/logout/all", nil)
+	req.Header.Set("Authorization", "Bearer "+secondToken)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	resp := w.Result()
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	assert.Equal(t, http.StatusUnauthorized, getBalance(firstCookie))
+	assert.Equal(t, http.StatusUnauthorized, getBalance(secondCookie))
+}
+
+func TestUserSessions(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockStorage := mocks.NewMockStorage(ctrl)
+	sessions := session.NewMemoryStore()
+	router := NewRouter(mockStorage, RouterCfg{
+		UserAuth: middleware.UserAuthCfg{Sessions: sessions, SessionTTL: time.Hour},
+	})
+
+	now := time.Now()
+	for _, s := range []model.Session{
+		{ID: "first", UserID: 1, Login: "testuser", IP: "10.0.0.1", UserAgent: "phone", CreatedAt: now.Add(-time.Hour)},
+		{ID: "second", UserID: 1, Login: "testuser", IP: "10.0.0.2", UserAgent: "laptop", CreatedAt: now},
+		{ID: "other", UserID: 2, Login: "otheruser", CreatedAt: now},
+	} {
+		s.LastSeenAt = s.CreatedAt
+		s.ExpiresAt = now.Add(time.Hour)
+		require.NoError(t, sessions.CreateSession(context.Background(), s))
+	}
+
+	doRequest := func(method, target string) *http.Response {
+		req := httptest.NewRequest(method, target, nil)
+		req.AddCookie(&http.Cookie{Name: middleware.SessionCookieName, Value: "second"})
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w.Result()
+	}
+
+	resp := doRequest(http.MethodGet, "/api/user/sessions")
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var list []model.Session
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&list))
+	require.Len(t, list, 2)
+	assert.Equal(t, session.HashID("second"), list[0].PublicID)
+	assert.True(t, list[0].Current)
+	assert.Equal(t, "laptop", list[0].UserAgent)
+	assert.Equal(t, session.HashID("first"), list[1].PublicID)
+	assert.False(t, list[1].Current)
+
+	// Чужую сессию завершить нельзя
+	resp = doRequest(http.MethodDelete, "/api/user/sessions/"+session.HashID("other"))
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	resp = doRequest(http.MethodDelete, "/api/user/sessions/"+session.HashID("first"))
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	_, err := sessions.GetSession(context.Background(), "first")
+	assert.ErrorIs(t, err, session.ErrNoSession)
+	_, err = sessions.GetSession(context.Background(), "other")
+	assert.NoError(t, err)
+}
+
+func TestSendEmailVerification(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockStorage := mocks.NewMockStorage(ctrl)
+	mockMailer := mocks.NewMockMailer(ctrl)
+	router := NewRouter(mockStorage, RouterCfg{
+		Mailer:               mockMailer,
+		EmailVerificationURL: "https://gophermart.ru/verify",
+	})
+
+	tests := []struct {
+		name       string
+		user       *model.User
+		mailerErr  error
+		wantStatus int
+	}{
+		{
+			name:       "Письмо отправлено",
+			user:       &model.User{ID: 1, Login: "testuser", Email: "user@example.com"},
+			wantStatus: http.StatusAccepted,
+		},
+		{
+			name:       "Email не указан",
+			user:       &model.User{ID: 1, Login: "testuser"},
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "Email уже подтвержден",
+			user:       &model.User{ID: 1, Login: "testuser", Email: "user@example.com", EmailVerified: true},
+			wantStatus: http.StatusConflict,
+		},
+		{
+			name:       "Ошибка отправки письма",
+			user:       &model.User{ID: 1, Login: "testuser", Email: "user@example.com"},
+			mailerErr:  errors.New("smtp is unavailable"),
+			wantStatus: http.StatusBadGateway,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockStorage.EXPECT().GetUserByID(gomock.Any(), 1).Return(tt.user, nil).Times(1)
+			if tt.user.Email != "" && !tt.user.EmailVerified {
+				var tokenHash string
+				mockStorage.EXPECT().
+					CreateEmailVerification(gomock.Any(), 1, tt.user.Email, gomock.Any(), gomock.Any()).
+					DoAndReturn(func(_ context.Context, _ int, _, hash string, _ time.Time) error {
+						tokenHash = hash
+						return nil
+					}).
+					Times(1)
+				mockMailer.EXPECT().
+					Send(gomock.Any(), tt.user.Email, gomock.Any(), gomock.Any()).
+					DoAndReturn(func(_ context.Context, _, _, body string) error {
+						// В письме ссылка с токеном, хэш которого сохранен в БД
+						_, link, found := strings.Cut(body, "https://gophermart.ru/verify?token=")
+						require.True(t, found)
+						token, _, _ := strings.Cut(link, "\n")
+						assert.Equal(t, tokenHash, utils.HashVerificationToken(token))
+						return tt.mailerErr
+					}).
+					Times(1)
+			}
+
+			jwtString, err := utils.BuildJWTSting(model.User{ID: 1, Login: "testuser"})
+			require.NoError(t, err)
+			req := httptest.NewRequest(http.MethodPost, "/api/user/email/verify/send", nil)
+			req.AddCookie(&http.Cookie{Name: middleware.JWTCookieName, Value: jwtString})
+			w := httptest.NewRecorder()
+
+			router.ServeHTTP(w, req)
+
+			resp := w.Result()
+			defer resp.Body.Close()
+
+			assert.Equal(t, tt.wantStatus, resp.StatusCode)
+		})
+	}
+}
+
+func TestConfirmEmail(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockStorage := mocks.NewMockStorage(ctrl)
+	router := NewRouter(mockStorage, RouterCfg{Mailer: mocks.NewMockMailer(ctrl)})
+
+	tests := []struct {
+		name       string
+		body       string
+		storageErr error
+		callsDB    bool
+		wantStatus int
+	}{
+		{
+			name:       "Email подтвержден",
+			body:       `{"token":"valid-token"}`,
+			callsDB:    true,
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "Токен недействителен",
+			body:       `{"token":"valid-token"}`,
+			storageErr: storage.ErrInvalidVerificationToken,
+			callsDB:    true,
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "Токен не передан",
+			body:       `{}`,
+			wantStatus: http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.callsDB {
+				mockStorage.EXPECT().
+					ConfirmEmail(gomock.Any(), utils.HashVerificationToken("valid-token")).
+					Return(tt.storageErr).
+					Times(1)
+			}
+
+			req := httptest.NewRequest(http.MethodPost, "/api/user/email/verify/confirm", strings.NewReader(tt.body))
+			req.Header.Set("Content-Type", "application/json")
+			w := httptest.NewRecorder()
+
+			router.ServeHTTP(w, req)
+
+			resp := w.Result()
+			defer resp.Body.Close()
+
+			assert.Equal(t, tt.wantStatus, resp.StatusCode)
+		})
+	}
+}
+
+func TestCreateNewOrder(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockStorage := mocks.NewMockStorage(ctrl)
+	router := NewRouter(mockStorage, RouterCfg{})
+
+	type want struct {
+		statusCode int
+		location   string
+		body       string
+	}
+	type request struct {
+		orderNum    string
+		contentType string
+		// Тело запроса, если отличается от номера заказа
+		body   string
+		isAuth bool
+	}
+	type storageRes struct {
+		order *model.Order
+		err   error
+	}
+
+	tests := []struct {
+		name       string
+		request    request
+		want       want
+		storageRes *storageRes
+	}{
+		{
+			name: "Успешный запрос",
+			request: request{
+				orderNum:    "6485485820226",
+				contentType: "text/plain",
+				isAuth:      true,
+			},
+			want: want{
+				statusCode: http.StatusAccepted,
+				location:   "/api/user/orders/6485485820226",
+				body:       `{"number": "6485485820226", "status": "NEW", "uploaded_at": "2024-05-10T12:00:00Z"}`,
+			},
+			storageRes: &storageRes{
+				order: &model.Order{
+					ID:        1,
+					UserID:    1,
+					Number:    "6485485820226",
+					Status:    model.OrderNew,
+					CreatedAt: time.Date(2024, 5, 10, 12, 0, 0, 0, time.UTC),
+				},
+				err: nil,
+			},
+		},
+		{
+			name: "Номер заказа уже был загружен пользователем",
+			request: request{
+				orderNum:    "6485485820226",
+				contentType: "text/plain",
+				isAuth:      true,
+			},
+			want: want{
+				statusCode: http.StatusOK,
+			},
+			storageRes: &storageRes{
+				err: storage.ErrOrderNumCreated,
+			},
+		},
+		{
+			name: "Номер заказа уже был загружен другим пользователем",
+			request: request{
+				orderNum:    "6485485820226",
+				contentType: "text/plain",
+				isAuth:      true,
+			},
+			want: want{
+				statusCode: http.StatusConflict,
+			},
+			storageRes: &storageRes{
+				err: storage.ErrOrderNumUsed,
+			},
+		},
+		{
+			name: "Неавторизованный запрос",
+			request: request{
+				orderNum:    "6485485820226",
+				contentType: "text/plain",
+				isAuth:      false,
+			},
+			want: want{
+				statusCode: http.StatusUnauthorized,
+			},
+			storageRes: nil,
+		},
+		{
+			name: "Неверный формат запроса",
+			request: request{
+				orderNum:    "6485485820226",
+				contentType: "application/json",
+				isAuth:      true,
+			},
+			want: want{
+				statusCode: http.StatusBadRequest,
+			},
+			storageRes: nil,
+		},
+		{
+			name: "Номер заказа в JSON",
+			request: request{
+				orderNum:    "6485485820226",
+				contentType: "application/json",
+				body:        `{"order": "6485485820226"}`,
+				isAuth:      true,
+			},
+			want: want{
+				statusCode: http.StatusAccepted,
+				location:   "/api/user/orders/6485485820226",
+				body:       `{"number": "6485485820226", "status": "NEW", "uploaded_at": "2024-05-10T12:00:00Z"}`,
+			},
+			storageRes: &storageRes{
+				order: &model.Order{
+					ID:        1,
+					UserID:    1,
+					Number:    "6485485820226",
+					Status:    model.OrderNew,
+					CreatedAt: time.Date(2024, 5, 10, 12, 0, 0, 0, time.UTC),
+				},
+				err: nil,
+			},
+		},
+		{
+			name: "Неверный номер заказа в JSON",
+			request: request{
+				orderNum:    "123456",
+				contentType: "application/json",
+				body:        `{"order": "123456"}`,
+				isAuth:      true,
+			},
+			want: want{
+				statusCode: http.StatusUnprocessableEntity,
+			},
+			storageRes: nil,
+		},
+		{
+			name: "Пустой JSON без номера заказа",
+			request: request{
+				contentType: "application/json",
+				body:        `{}`,
+				isAuth:      true,
+			},
+			want: want{
+				statusCode: http.StatusUnprocessableEntity,
+			},
+			storageRes: nil,
+		},
+		{
+			name: "Номер заказа из пробелов в JSON",
+			request: request{
+				orderNum:    "   ",
+				contentType: "application/json",
+				body:        `{"order": "   "}`,
+				isAuth:      true,
+			},
+			want: want{
+				statusCode: http.StatusUnprocessableEntity,
+			},
+			storageRes: nil,
+		},
+		{
+			name: "Неподдерживаемый Content-Type",
+			request: request{
+				orderNum:    "6485485820226",
+				contentType: "application/xml",
+				isAuth:      true,
+			},
+			want: want{
+				statusCode: http.StatusBadRequest,
+			},
+			storageRes: nil,
+		},
+		{
+			name: "Неверный формат номера заказа",
+			request: request{
+				orderNum:    "123456",
+				contentType: "text/plain",
+				isAuth:      true,
+			},
+			want: want{
+				statusCode: http.StatusUnprocessableEntity,
+			},
+			storageRes: nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := tt.request.body
+			if body == "" {
+				body = tt.request.orderNum
+			}
+			req := httptest.NewRequest(http.MethodPost, "/api/user/orders", strings.NewReader(body))
+			req.Header.Set("Content-Type", tt.request.contentType)
+
+			if tt.request.isAuth {
+				jwtString, err := utils.BuildJWTSting(model.User{ID: 1, Login: "testuser"})
+				require.NoError(t, err)
+				req.AddCookie(&http.Cookie{Name: middleware.JWTCookieName, Value: jwtString})
+			}
+
+			w := httptest.NewRecorder()
+
+			if tt.storageRes != nil {
+				mockStorage.EXPECT().
+					CreateOrder(gomock.Any(), 1, tt.request.orderNum).
+					Return(tt.storageRes.order, tt.storageRes.err).
+					Times(1)
+			} else {
+				mockStorage.EXPECT().
+					CreateOrder(gomock.Any(), 1, tt.request.orderNum).Times(0)
+			}
+
+			router.ServeHTTP(w, req)
+
+			resp := w.Result()
+			defer resp.Body.Close()
+
+			assert.Equal(t, tt.want.statusCode, resp.StatusCode)
+			assert.Equal(t, tt.want.location, resp.Header.Get("Location"))
+			if tt.want.body != "" {
+				respBody, err := io.ReadAll(resp.Body)
+				require.NoError(t, err)
+				assert.JSONEq(t, tt.want.body, string(respBody))
+			}
+		})
+	}
+}
+
+func TestCreateOrdersBatch(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockStorage := mocks.NewMockStorage(ctrl)
+	router := NewRouter(mockStorage, RouterCfg{})
+
+	jwtString, err := utils.BuildJWTSting(model.User{ID: 1, Login: "testuser"})
+	require.NoError(t, err)
+
+	tests := []struct {
+		name       string
+		body       string
+		validNums  []string
+		created    map[string]string
+		statusCode int
+		resBody    string
+	}{
+		{
+			name:      "Пакет заказов",
+			body:      `["6485485820226", "12345", "9278923470", "346436439"]`,
+			validNums: []string{"6485485820226", "9278923470", "346436439"},
+			created: map[string]string{
+				"6485485820226": model.BatchOrderAccepted,
+				"9278923470":    model.BatchOrderAlreadyUploaded,
+				"346436439":     model.BatchOrderConflict,
+			},
+			statusCode: http.StatusOK,
+			resBody: `[
+				{"number": "6485485820226", "result": "accepted"},
+				{"number": "12345", "result": "invalid"},
+				{"number": "9278923470", "result": "already_uploaded"},
+				{"number": "346436439", "result": "conflict"}
+			]`,
+		},
+		{
+			name:       "Только некорректные номера",
+			body:       `["12345"]`,
+			statusCode: http.StatusOK,
+			resBody:    `[{"number": "12345", "result": "invalid"}]`,
+		},
+		{
+			name:       "Пустой пакет",
+			body:       `[]`,
+			statusCode: http.StatusBadRequest,
+		},
+		{
+			name:       "Не массив",
+			body:       `{"number": "6485485820226"}`,
+			statusCode: http.StatusBadRequest,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.validNums != nil {
+				mockStorage.EXPECT().CreateOrders(gomock.Any(), 1, tt.validNums).Return(tt.created, nil).Times(1)
+			}
+
+			req := httptest.NewRequest(http.MethodPost, "/api/user/orders/batch", strings.NewReader(tt.body))
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("Authorization", "Bearer "+jwtString)
+			w := httptest.NewRecorder()
+
+			router.ServeHTTP(w, req)
+
+			resp := w.Result()
+			defer resp.Body.Close()
+
+			assert.Equal(t, tt.statusCode, resp.StatusCode)
+			if tt.resBody != "" {
+				resBody, err := io.ReadAll(resp.Body)
+				require.NoError(t, err)
+				assert.JSONEq(t, tt.resBody, string(resBody))
+			}
+		})
+	}
+}
+
+func TestCreateNewOrderCSRF(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockStorage := mocks.NewMockStorage(ctrl)
+	router := NewRouter(mockStorage, RouterCfg{CSRFProtection: true})
+
+	jwtString, err := utils.BuildJWTSting(model.User{ID: 1, Login: "testuser"})
+	require.NoError(t, err)
+
+	// Токен выдается в cookie и в теле ответа
+	req := httptest.NewRequest(http.MethodGet, "/api/user/csrf", nil)
+	req.AddCookie(&http.Cookie{Name: middleware.JWTCookieName, Value: jwtString})
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	resp := w.Result()
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var csrfRes model.CSRFTokenRes
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&csrfRes))
+	require.NotEmpty(t, csrfRes.Token)
+	var csrfCookie *http.Cookie
+	for _, cookie := range resp.Cookies() {
+		if cookie.Name == middleware.CSRFCookieName {
+			csrfCookie = cookie
+		}
+	}
+	require.NotNil(t, csrfCookie)
+	assert.Equal(t, csrfRes.Token, csrfCookie.Value)
+	assert.False(t, csrfCookie.HttpOnly)
+
+	tests := []struct {
+		name       string
+		bearer     bool
+		cookie     string
+		header     string
+		wantStatus int
+	}{
+		{
+			name:       "Cookie и заголовок совпадают",
+			cookie:     csrfRes.Token,
+			header:     csrfRes.Token,
+			wantStatus: http.StatusAccepted,
+		},
+		{
+			name:       "Нет заголовка",
+			cookie:     csrfRes.Token,
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:       "Заголовок не совпадает с cookie",
+			cookie:     csrfRes.Token,
+			header:     "forged",
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:       "Аутентификация по заголовку Authorization",
+			bearer:     true,
+			wantStatus: http.StatusAccepted,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.wantStatus == http.StatusAccepted {
+				mockStorage.EXPECT().CreateOrder(gomock.Any(), 1, "12345678903").Return(&model.Order{Number: "12345678903"}, nil).Times(1)
+			}
+
+			req := httptest.NewRequest(http.MethodPost, "/api/user/orders", strings.NewReader("12345678903"))
+			req.Header.Set("Content-Type", "text/plain")
+			if tt.bearer {
+				req.Header.Set("Authorization", "Bearer "+jwtString)
+			} else {
+				req.AddCookie(&http.Cookie{Name: middleware.JWTCookieName, Value: jwtString})
+			}
+			if tt.cookie != "" {
+				req.AddCookie(&http.Cookie{Name: middleware.CSRFCookieName, Value: tt.cookie})
+			}
+			if tt.header != "" {
+				req.Header.Set(middleware.CSRFHeaderName, tt.header)
+			}
+			w := httptest.NewRecorder()
+
+			router.ServeHTTP(w, req)
+
+			resp := w.Result()
+			defer resp.Body.Close()
+
+			assert.Equal(t, tt.wantStatus, resp.StatusCode)
+		})
+	}
+}
+
+func TestCreateNewOrderRateLimit(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockStorage := mocks.NewMockStorage(ctrl)
+	router := NewRouter(mockStorage, RouterCfg{OrderLimiter: ratelimit.NewMemoryLimiter(1, time.Minute)})
+
+	jwtString, err := utils.BuildJWTSting(model.User{ID: 1, Login: "testuser"})
+	require.NoError(t, err)
+
+	mockStorage.EXPECT().
+		CreateOrder(gomock.Any(), 1, "6485485820226").
+		Return(&model.Order{Number: "6485485820226"}, nil).
+		Times(1)
+
+	wantStatuses := []int{http.StatusAccepted, http.StatusTooManyRequests}
+	for _, wantStatus := range wantStatuses {
+		req := httptest.NewRequest(http.MethodPost, "/api/user/orders", strings.NewReader("6485485820226"))
+		req.Header.Set("Content-Type", "text/plain")
+		req.AddCookie(&http.Cookie{Name: middleware.JWTCookieName, Value: jwtString})
+		w := httptest.NewRecorder()
+
+		router.ServeHTTP(w, req)
+
+		resp := w.Result()
+		resp.Body.Close()
+
+		assert.Equal(t, wantStatus, resp.StatusCode)
+	}
+}
+
+func TestLoginRateLimit(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockStorage := mocks.NewMockStorage(ctrl)
+	router := NewRouter(mockStorage, RouterCfg{AuthLimiter: ratelimit.NewTokenBucketLimiter(0.01, 2)})
+
+	tests := []struct {
+		name          string
+		remoteAddr    string
+		statusCode    int
+		wantRemaining string
+	}{
+		{name: "Первый запрос", remoteAddr: "10.0.0.1:1000", statusCode: http.StatusBadRequest, wantRemaining: "1"},
+		{name: "Второй запрос", remoteAddr: "10.0.0.1:1001", statusCode: http.StatusBadRequest, wantRemaining: "0"},
+		{name: "Лимит исчерпан", remoteAddr: "10.0.0.1:1002", statusCode: http.StatusTooManyRequests, wantRemaining: "0"},
+		{name: "Другой IP", remoteAddr: "10.0.0.2:1000", statusCode: http.StatusBadRequest, wantRemaining: "1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/api/user/login", strings.NewReader(`{"login":"testuser"}`))
+			req.Header.Set("Content-Type", "application/json")
+			req.RemoteAddr = tt.remoteAddr
+			w := httptest.NewRecorder()
+
+			router.ServeHTTP(w, req)
+
+			resp := w.Result()
+			defer resp.Body.Close()
+
+			assert.Equal(t, tt.statusCode, resp.StatusCode)
+			assert.Equal(t, "2", resp.Header.Get("X-RateLimit-Limit"))
+			assert.Equal(t, tt.wantRemaining, resp.Header.Get("X-RateLimit-Remaining"))
+			assert.NotEmpty(t, resp.Header.Get("X-RateLimit-Reset"))
+			if tt.statusCode == http.StatusTooManyRequests {
+				assert.NotEmpty(t, resp.Header.Get("Retry-After"))
+			}
+		})
+	}
+}
+
+func TestGetOrders(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockStorage := mocks.NewMockStorage(ctrl)
+	router := NewRouter(mockStorage, RouterCfg{})
+
+	type want struct {
+		statusCode int
+		body       string
+	}
+	type request struct {
+		isAuth bool
+	}
+	type storageRes struct {
+		orders []model.Order
+		err    error
+	}
+
+	tests := []struct {
+		name       string
+		request    request
+		want       want
+		storageRes *storageRes
+	}{
+		{
+			name: "Успешный запрос",
+			request: request{
+				isAuth: true,
+			},
+			want: want{
+				statusCode: http.StatusOK,
+				body: `
+					[
+						{
+									"number": "9278923470",
+									"status": "PROCESSED",
+									"accrual": 500,
+									"uploaded_at": "2020-12-10T15:15:45+03:00"
+							},
+							{
+									"number": "346436439",
+									"status": "INVALID",
+									"uploaded_at": "2020-12-09T16:09:53+03:00"
+							}
+					]
+				`,
+			},
+			storageRes: &storageRes{
+				err: nil,
+				orders: []model.Order{
+					{
+						ID:        1,
+						Number:    "9278923470",
+						Status:    model.OrderProcessed,
+						Accrual:   model.MoneyFromFloat(500),
+						CreatedAt: time.Date(2020, 12, 10, 15, 15, 45, 0, time.Local),
+					},
+					{
+						ID:        2,
+						Number:    "346436439",
+						Status:    model.OrderInvalid,
+						CreatedAt: time.Date(2020, 12, 9, 16, 9, 53, 0, time.Local),
+					},
+				},
+			},
+		},
+		{
+			name: "Нет данных",
+			request: request{
+				isAuth: true,
+			},
+			want: want{
+				statusCode: http.StatusNoContent,
+				body:       "",
+			},
+			storageRes: &storageRes{
+				err:    nil,
+				orders: []model.Order{},
+			},
+		},
+		{
+			name: "Ошибка чтения заказов",
+			request: request{
+				isAuth: true,
+			},
+			want: want{
+				statusCode: http.StatusInternalServerError,
+				body:       "",
+			},
+			storageRes: &storageRes{
+				err:    errors.New("db error"),
+				orders: []model.Order{},
+			},
+		},
+		{
+			name: "Неавторизованный запрос",
+			request: request{
+				isAuth: false,
+			},
+			want: want{
+				statusCode: http.StatusUnauthorized,
+				body:       "",
+			},
+			storageRes: nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/api/user/orders", nil)
+
+			if tt.request.isAuth {
+				jwtString, err := utils.BuildJWTSting(model.User{ID: 1, Login: "testuser"})
+				require.NoError(t, err)
+				req.AddCookie(&http.Cookie{Name: middleware.JWTCookieName, Value: jwtString})
+			}
+
+			w := httptest.NewRecorder()
+
+			if tt.storageRes != nil {
+				mockStorage.EXPECT().
+					GetUserOrdersSummary(gomock.Any(), 1, model.OrdersQuery{}).
+					Return(&model.OrdersSummary{Count: len(tt.storageRes.orders)}, nil).
+					Times(1)
+				mockStorage.EXPECT().
+					StreamUserOrders(gomock.Any(), 1, model.OrdersQuery{}, gomock.Any()).
+					DoAndReturn(func(_ context.Context, _ int, _ model.OrdersQuery, fn func(model.Order) error) error {
+						for _, order := range tt.storageRes.orders {
+							if err := fn(order); err != nil {
+								return err
+							}
+						}
+						return tt.storageRes.err
+					}).
+					Times(1)
+			} else {
+				mockStorage.EXPECT().
+					StreamUserOrders(gomock.Any(), 1, gomock.Any(), gomock.Any()).Times(0)
+			}
+
+			router.ServeHTTP(w, req)
+
+			resp := w.Result()
+			defer resp.Body.Close()
+
+			assert.Equal(t, tt.want.statusCode, resp.StatusCode)
+
+			if tt.want.body != "" {
+				resBody, readErr := io.ReadAll(resp.Body)
+				require.NoError(t, readErr)
+				assert.JSONEq(t, tt.want.body, string(resBody))
+			}
+		})
+	}
+}
+
+func TestGetOrdersQuery(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockStorage := mocks.NewMockStorage(ctrl)
+	router := NewRouter(mockStorage, RouterCfg{})
+
+	jwtString, err := utils.BuildJWTSting(model.User{ID: 1, Login: "testuser"})
+	require.NoError(t, err)
+
+	tests := []struct {
+		name       string
+		rawQuery   string
+		query      *model.OrdersQuery
+		statusCode int
+	}{
+		{
+			name:       "Страница заказов",
+			rawQuery:   "limit=1&offset=1",
+			query:      &model.OrdersQuery{Limit: 1, Offset: 1},
+			statusCode: http.StatusOK,
+		},
+		{
+			name:     "Фильтр по статусу и датам",
+			rawQuery: "status=new,PROCESSED&from=2024-05-01&to=2024-05-31",
+			query: &model.OrdersQuery{
+				Statuses: []model.OrderStatus{model.OrderNew, model.OrderProcessed},
+				From:     time.Date(2024, 5, 1, 0, 0, 0, 0, time.Local),
+				To:       time.Date(2024, 6, 1, 0, 0, 0, 0, time.Local),
+			},
+			statusCode: http.StatusOK,
+		},
+		{
+			name:       "Сортировка по начислению",
+			rawQuery:   "sort=accrual&order=desc",
+			query:      &model.OrdersQuery{Sort: model.Sort{Field: model.SortOrdersAccrual, Desc: true}},
+			statusCode: http.StatusOK,
+		},
+		{
+			name:       "Поиск по началу номера",
+			rawQuery:   "number_prefix=9278",
+			query:      &model.OrdersQuery{NumberPrefix: "9278"},
+			statusCode: http.StatusOK,
+		},
+		{
+			name:       "Начало номера не из цифр",
+			rawQuery:   "number_prefix=92%25",
+			statusCode: http.StatusBadRequest,
+		},
+		{
+			name:       "Неизвестное поле сортировки",
+			rawQuery:   "sort=number",
+			statusCode: http.StatusBadRequest,
+		},
+		{
+			name:       "Неизвестный статус",
+			rawQuery:   "status=DONE",
+			statusCode: http.StatusBadRequest,
+		},
+		{
+			name:       "Некорректная дата",
+			rawQuery:   "from=01.05.2024",
+			statusCode: http.StatusBadRequest,
+		},
+		{
+			name:       "Начало диапазона позже конца",
+			rawQuery:   "from=2024-05-02T00:00:00Z&to=2024-05-01T00:00:00Z",
+			statusCode: http.StatusBadRequest,
+		},
+		{
+			name:       "Некорректный limit",
+			rawQuery:   "limit=0",
+			statusCode: http.StatusBadRequest,
+		},
+		{
+			name:       "Слишком большой limit",
+			rawQuery:   "limit=100000",
+			statusCode: http.StatusBadRequest,
+		},
+		{
+			name:       "Отрицательный offset",
+			rawQuery:   "offset=-1",
+			statusCode: http.StatusBadRequest,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.query != nil {
+				mockStorage.EXPECT().
+					GetUserOrdersSummary(gomock.Any(), 1, *tt.query).
+					Return(&model.OrdersSummary{Count: 2}, nil).
+					Times(1)
+				mockStorage.EXPECT().
+					StreamUserOrders(gomock.Any(), 1, *tt.query, gomock.Any()).
+					DoAndReturn(func(_ context.Context, _ int, _ model.OrdersQuery, fn func(model.Order) error) error {
+						return fn(model.Order{Number: "346436439", Status: model.OrderNew})
+					}).
+					Times(1)
+			}
+
+			req := httptest.NewRequest(http.MethodGet, "/api/user/orders?"+tt.rawQuery, nil)
+			req.Header.Set("Authorization", "Bearer "+jwtString)
+			w := httptest.NewRecorder()
+
+			router.ServeHTTP(w, req)
+
+			resp := w.Result()
+			defer resp.Body.Close()
+
+			assert.Equal(t, tt.statusCode, resp.StatusCode)
+			if tt.statusCode == http.StatusOK {
+				assert.Equal(t, "2", resp.Header.Get("X-Total-Count"))
+			}
+		})
+	}
+}
+
+func TestGetOrdersETag(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockStorage := mocks.NewMockStorage(ctrl)
+	router := NewRouter(mockStorage, RouterCfg{})
+
+	jwtString, err := utils.BuildJWTSting(model.User{ID: 1, Login: "testuser"})
+	require.NoError(t, err)
+
+	summary := &model.OrdersSummary{Count: 2, LastUpdate: time.Date(2024, 5, 10, 12, 0, 0, 0, time.UTC)}
+	etag := ordersETag(summary, model.OrdersQuery{})
+	secondPage := model.OrdersQuery{Limit: 1, Offset: 1}
+	statuses := model.OrdersQuery{Statuses: []model.OrderStatus{model.OrderNew, model.OrderProcessed}}
+
+	tests := []struct {
+		name        string
+		target      string
+		query       model.OrdersQuery
+		ifNoneMatch string
+		statusCode  int
+		etag        string
+	}{
+		{name: "Первый запрос", statusCode: http.StatusOK, etag: etag},
+		{name: "Список не изменился", ifNoneMatch: etag, statusCode: http.StatusNotModified, etag: etag},
+		{name: "Один из нескольких ETag", ifNoneMatch: `"other", ` + etag, statusCode: http.StatusNotModified, etag: etag},
+		{name: "Список изменился", ifNoneMatch: `W/"1-0"`, statusCode: http.StatusOK, etag: etag},
+		{
+			name:        "Другая страница с ETag первой",
+			target:      "?limit=1&offset=1",
+			query:       secondPage,
+			ifNoneMatch: etag,
+			statusCode:  http.StatusOK,
+			etag:        ordersETag(summary, secondPage),
+		},
+		{
+			name:        "Те же статусы в другом порядке",
+			target:      "?status=PROCESSED,NEW",
+			query:       model.OrdersQuery{Statuses: []model.OrderStatus{model.OrderProcessed, model.OrderNew}},
+			ifNoneMatch: ordersETag(summary, statuses),
+			statusCode:  http.StatusNotModified,
+			etag:        ordersETag(summary, statuses),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockStorage.EXPECT().GetUserOrdersSummary(gomock.Any(), 1, tt.query).Return(summary, nil).Times(1)
+			if tt.statusCode == http.StatusOK {
+				mockStorage.EXPECT().
+					StreamUserOrders(gomock.Any(), 1, tt.query, gomock.Any()).
+					DoAndReturn(func(_ context.Context, _ int, _ model.OrdersQuery, fn func(model.Order) error) error {
+						return fn(model.Order{Number: "9278923470", Status: model.OrderNew})
+					}).
+					Times(1)
+			}
+
+			req := httptest.NewRequest(http.MethodGet, "/api/user/orders"+tt.target, nil)
+			req.Header.Set("Authorization", "Bearer "+jwtString)
+			if tt.ifNoneMatch != "" {
+				req.Header.Set("If-None-Match", tt.ifNoneMatch)
+			}
+			w := httptest.NewRecorder()
+
+			router.ServeHTTP(w, req)
+
+			resp := w.Result()
+			defer resp.Body.Close()
+
+			assert.Equal(t, tt.statusCode, resp.StatusCode)
+			assert.Equal(t, tt.etag, resp.Header.Get("ETag"))
+		})
+	}
+}
+
+func TestGetOrder(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockStorage := mocks.NewMockStorage(ctrl)
+	router := NewRouter(mockStorage, RouterCfg{})
+
+	jwtString, err := utils.BuildJWTSting(model.User{ID: 1, Login: "testuser"})
+	require.NoError(t, err)
+
+	tests := []struct {
+		name       string
+		order      *model.Order
+		storageErr error
+		history    []model.OrderStatusChange
+		historyErr error
+		statusCode int
+		resBody    string
+	}{
+		{
+			name: "Заказ пользователя",
+			order: &model.Order{
+				ID: 1, UserID: 1, Number: "9278923470", Status: model.OrderProcessed, Accrual: model.MoneyFromFloat(500),
+				CreatedAt: time.Date(2020, 12, 10, 15, 15, 45, 0, time.UTC),
+				UpdatedAt: time.Date(2020, 12, 10, 15, 20, 0, 0, time.UTC),
+			},
+			history: []model.OrderStatusChange{
+				{
+					From: model.OrderNew, Status: model.OrderProcessing,
+					ChangedAt: time.Date(2020, 12, 10, 15, 16, 0, 0, time.UTC),
+				},
+				{
+					From: model.OrderProcessing, Status: model.OrderProcessed, Accrual: model.MoneyFromFloat(500),
+					ChangedAt: time.Date(2020, 12, 10, 15, 20, 0, 0, time.UTC),
+				},
+			},
+			statusCode: http.StatusOK,
+			resBody: `{"number": "9278923470", "status": "PROCESSED", "accrual": 500,
+				"uploaded_at": "2020-12-10T15:15:45Z", "updated_at": "2020-12-10T15:20:00Z",
+				"history": [
+					{"from": "NEW", "status": "PROCESSING", "changed_at": "2020-12-10T15:16:00Z"},
+					{"from": "PROCESSING", "status": "PROCESSED", "accrual": 500, "changed_at": "2020-12-10T15:20:00Z"}
+				]}`,
+		},
+		{
+			name: "Статус заказа не менялся",
+			order: &model.Order{
+				ID: 1, UserID: 1, Number: "9278923470", Status: model.OrderNew,
+				CreatedAt: time.Date(2020, 12, 10, 15, 15, 45, 0, time.UTC),
+				UpdatedAt: time.Date(2020, 12, 10, 15, 15, 45, 0, time.UTC),
+			},
+			history:    []model.OrderStatusChange{},
+			statusCode: http.StatusOK,
+			resBody: `{"number": "9278923470", "status": "NEW",
+				"uploaded_at": "2020-12-10T15:15:45Z", "updated_at": "2020-12-10T15:15:45Z", "history": []}`,
+		},
+		{
+			name:       "Ошибка чтения истории статусов",
+			order:      &model.Order{ID: 1, UserID: 1, Number: "9278923470", Status: model.OrderNew},
+			historyErr: errors.New("db error"),
+			statusCode: http.StatusInternalServerError,
+		},
+		{
+			name:       "Заказ другого пользователя",
+			order:      &model.Order{ID: 1, UserID: 2, Number: "9278923470", Status: model.OrderNew},
+			statusCode: http.StatusForbidden,
+		},
+		{
+			name:       "Заказ не найден",
+			storageErr: storage.ErrNoOrder,
+			statusCode: http.StatusNotFound,
+		},
+		{
+			name:       "Ошибка хранилища",
+			storageErr: errors.New("db error"),
+			statusCode: http.StatusInternalServerError,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockStorage.EXPECT().GetOrderByNum(gomock.Any(), "9278923470").Return(tt.order, tt.storageErr).Times(1)
+			if tt.history != nil || tt.historyErr != nil {
+				mockStorage.EXPECT().GetOrderStatusHistory(gomock.Any(), 1).Return(tt.history, tt.historyErr).Times(1)
+			}
+
+			req := httptest.NewRequest(http.MethodGet, "/api/user/orders/9278923470", nil)
+			req.Header.Set("Authorization", "Bearer "+jwtString)
+			w := httptest.NewRecorder()
+
+			router.ServeHTTP(w, req)
+
+			resp := w.Result()
+			defer resp.Body.Close()
+
+			assert.Equal(t, tt.statusCode, resp.StatusCode)
+			if tt.resBody != "" {
+				resBody, err := io.ReadAll(resp.Body)
+				require.NoError(t, err)
+				assert.JSONEq(t, tt.resBody, string(resBody))
+			}
+		})
+	}
+}
+
+func TestCancelOrder(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockStorage := mocks.NewMockStorage(ctrl)
+	router := NewRouter(mockStorage, RouterCfg{})
+
+	jwtString, err := utils.BuildJWTSting(model.User{ID: 1, Login: "testuser"})
+	require.NoError(t, err)
+
+	tests := []struct {
+		name       string
+		storageErr error
+		statusCode int
+	}{
+		{name: "Заказ отменен", statusCode: http.StatusNoContent},
+		{name: "Заказ не найден", storageErr: storage.ErrNoOrder, statusCode: http.StatusNotFound},
+		{name: "Заказ другого пользователя", storageErr: storage.ErrOrderNumUsed, statusCode: http.StatusForbidden},
+		{name: "Обработка уже началась", storageErr: storage.ErrOrderNotNew, statusCode: http.StatusConflict},
+		{name: "Ошибка хранилища", storageErr: errors.New("db error"), statusCode: http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockStorage.EXPECT().CancelOrder(gomock.Any(), 1, "9278923470").Return(tt.storageErr).Times(1)
+
+			req := httptest.NewRequest(http.MethodDelete, "/api/user/orders/9278923470", nil)
+			req.Header.Set("Authorization", "Bearer "+jwtString)
+			w := httptest.NewRecorder()
+
+			router.ServeHTTP(w, req)
+
+			resp := w.Result()
+			defer resp.Body.Close()
+
+			assert.Equal(t, tt.statusCode, resp.StatusCode)
+		})
+	}
+}
+
+func TestRetryOrder(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockStorage := mocks.NewMockStorage(ctrl)
+	router := NewRouter(mockStorage, RouterCfg{OrderMaxRetries: 3})
+
+	jwtString, err := utils.BuildJWTSting(model.User{ID: 1, Login: "testuser"})
+	require.NoError(t, err)
+
+	tests := []struct {
+		name       string
+		storageErr error
+		statusCode int
+	}{
+		{name: "Заказ отправлен на повторную обработку", statusCode: http.StatusAccepted},
+		{name: "Заказ не найден", storageErr: storage.ErrNoOrder, statusCode: http.StatusNotFound},
+		{name: "Заказ другого пользователя", storageErr: storage.ErrOrderNumUsed, statusCode: http.StatusForbidden},
+		{name: "Заказ не в статусе INVALID", storageErr: storage.ErrOrderNotInvalid, statusCode: http.StatusConflict},
+		{name: "Исчерпаны повторы", storageErr: storage.ErrOrderRetryLimit, statusCode: http.StatusUnprocessableEntity},
+		{name: "Ошибка хранилища", storageErr: errors.New("db error"), statusCode: http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockStorage.EXPECT().RetryOrder(gomock.Any(), 1, "9278923470", 3).Return(tt.storageErr).Times(1)
+
+			req := httptest.NewRequest(http.MethodPost, "/api/user/orders/9278923470/retry", nil)
+			req.Header.Set("Authorization", "Bearer "+jwtString)
+			w := httptest.NewRecorder()
+
+			router.ServeHTTP(w, req)
+
+			resp := w.Result()
+			defer resp.Body.Close()
+
+			assert.Equal(t, tt.statusCode, resp.StatusCode)
+		})
+	}
+
+	t.Run("Повтор недоступен", func(t *testing.T) {
+		router := NewRouter(mockStorage, RouterCfg{})
+		req := httptest.NewRequest(http.MethodPost, "/api/user/orders/9278923470/retry", nil)
+		req.Header.Set("Authorization", "Bearer "+jwtString)
+		w := httptest.NewRecorder()
+
+		router.ServeHTTP(w, req)
+
+		resp := w.Result()
+		defer resp.Body.Close()
+
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	})
+}
+
+func TestGetBalance(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockStorage := mocks.NewMockStorage(ctrl)
+	router := NewRouter(mockStorage, RouterCfg{})
+
+	type want struct {
+		statusCode int
+		body       string
+	}
+	type request struct {
+		isAuth bool
+	}
+	type storageRes struct {
+		balance *model.Balance
+		err     error
+	}
+
+	tests := []struct {
+		name       string
+		request    request
+		want       want
+		storageRes *storageRes
+	}{
+		{
+			name: "Успешный запрос",
+			request: request{
+				isAuth: true,
+			},
+			want: want{
+				statusCode: http.StatusOK,
+				body: `
+					{
+						"current": 500.5,
+						"withdrawn": 42
+					}
+				`,
+			},
+			storageRes: &storageRes{
+				err: nil,
+				balance: &model.Balance{
+					UserID:    1,
+					Current:   model.MoneyFromFloat(500.5),
+					Withdrawn: model.MoneyFromFloat(42),
+				},
+			},
+		},
+		{
+			name: "Неавторизованный запрос",
+			request: request{
+				isAuth: false,
+			},
+			want: want{
+				statusCode: http.StatusUnauthorized,
+				body:       "",
+			},
+			storageRes: nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/api/user/balance", nil)
+
+			if tt.request.isAuth {
+				jwtString, err := utils.BuildJWTSting(model.User{ID: 1, Login: "testuser"})
+				require.NoError(t, err)
+				req.AddCookie(&http.Cookie{Name: middleware.JWTCookieName, Value: jwtString})
+			}
+
+			w := httptest.NewRecorder()
+
+			if tt.storageRes != nil {
+				mockStorage.EXPECT().
+					GetUserBalance(gomock.Any(), 1).
+					Return(tt.storageRes.balance, tt.storageRes.err).
+					Times(1)
+			} else {
+				mockStorage.EXPECT().
+					GetUserBalance(gomock.Any(), 1).Times(0)
+			}
+
+			router.ServeHTTP(w, req)
+
+			resp := w.Result()
+			defer resp.Body.Close()
+
+			assert.Equal(t, tt.want.statusCode, resp.StatusCode)
+
+			if tt.want.body != "" {
+				resBody, readErr := io.ReadAll(resp.Body)
+				require.NoError(t, readErr)
+				assert.JSONEq(t, tt.want.body, string(resBody))
+			}
+		})
+	}
+}
+
+func TestGetBalanceAt(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockStorage := mocks.NewMockStorage(ctrl)
+	router := NewRouter(mockStorage, RouterCfg{})
+
+	type want struct {
+		statusCode int
+		body       string
+	}
+	type storageRes struct {
+		balance *model.Balance
+		err     error
+	}
+
+	tests := []struct {
+		name       string
+		at         string
+		want       want
+		storageRes *storageRes
+	}{
+		{
+			name: "Успешный запрос",
+			at:   "2020-12-10T15:15:45Z",
+			want: want{
+				statusCode: http.StatusOK,
+				body: `
+					{
+						"current": 100,
+						"withdrawn": 20
+					}
+				`,
+			},
+			storageRes: &storageRes{
+				err: nil,
+				balance: &model.Balance{
+					UserID:    1,
+					Current:   model.MoneyFromFloat(100),
+					Withdrawn: model.MoneyFromFloat(20),
+				},
+			},
+		},
+		{
+			name: "Некорректная дата",
+			at:   "2020-12-10",
+			want: want{
+				statusCode: http.StatusBadRequest,
+				body:       "",
+			},
+			storageRes: nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/api/user/balance?at="+tt.at, nil)
+
+			jwtString, err := utils.BuildJWTSting(model.User{ID: 1, Login: "testuser"})
+			require.NoError(t, err)
+			req.AddCookie(&http.Cookie{Name: middleware.JWTCookieName, Value: jwtString})
+
+			w := httptest.NewRecorder()
+
+			if tt.storageRes != nil {
+				mockStorage.EXPECT().
+					GetUserBalanceAt(gomock.Any(), 1, time.Date(2020, 12, 10, 15, 15, 45, 0, time.UTC)).
+					Return(tt.storageRes.balance, tt.storageRes.err).
+					Times(1)
+			} else {
+				mockStorage.EXPECT().
+					GetUserBalanceAt(gomock.Any(), 1, gomock.Any()).Times(0)
+			}
+			mockStorage.EXPECT().GetUserBalance(gomock.Any(), 1).Times(0)
+
+			router.ServeHTTP(w, req)
+
+			resp := w.Result()
+			defer resp.Body.Close()
+
+			assert.Equal(t, tt.want.statusCode, resp.StatusCode)
+
+			if tt.want.body != "" {
+				resBody, readErr := io.ReadAll(resp.Body)
+				require.NoError(t, readErr)
+				assert.JSONEq(t, tt.want.body, string(resBody))
+			}
+		})
+	}
+}
+
+func TestWithdraw(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockStorage := mocks.NewMockStorage(ctrl)
+	router := NewRouter(mockStorage, RouterCfg{})
+
+	type want struct {
+		statusCode int
+	}
+	type request struct {
+		body        string
+		contentType string
+		isAuth      bool
+	}
+	type storageRes struct {
+		err error
+	}
+	type storageReq struct {
+		Sum    model.Money
+		Number string
+	}
+
+	tests := []struct {
+		name       string
+		request    request
+		want       want
+		storageRes *storageRes
+		storageReq *storageReq
+	}{
+		{
+			name: "Успешный запрос",
+			request: request{
+				body:        `{"order":"6485485820226","sum":100}`,
+				contentType: "application/json",
+				isAuth:      true,
+			},
+			want: want{
+				statusCode: http.StatusOK,
+			},
+			storageRes: &storageRes{
+				err: nil,
+			},
+			storageReq: &storageReq{
+				Sum:    model.MoneyFromFloat(100),
+				Number: "6485485820226",
+			},
+		},
+		{
+			name: "Дробная сумма",
+			request: request{
+				body:        `{"order":"6485485820226","sum":100.07}`,
+				contentType: "application/json",
+				isAuth:      true,
+			},
+			want: want{
+				statusCode: http.StatusOK,
+			},
+			storageRes: &storageRes{
+				err: nil,
+			},
+			storageReq: &storageReq{
+				Sum:    model.Money(10007),
+				Number: "6485485820226",
+			},
+		},
+		{
+			name: "На счету недостаточно средств",
+			request: request{
+				body:        `{"order":"6485485820226","sum":100}`,
+				contentType: "application/json",
+				isAuth:      true,
+			},
+			want: want{
+				statusCode: http.StatusPaymentRequired,
+			},
+			storageRes: &storageRes{
+				err: storage.ErrInsufficientFunds,
+			},
+			storageReq: &storageReq{
+				Sum:    model.MoneyFromFloat(100),
+				Number: "6485485820226",
+			},
+		},
+		{
+			name: "Превышен лимит списаний",
+			request: request{
+				body:        `{"order":"6485485820226","sum":100}`,
+				contentType: "application/json",
+				isAuth:      true,
+			},
+			want: want{
+				statusCode: http.StatusTooManyRequests,
+			},
+			storageRes: &storageRes{
+				err: fmt.Errorf("%w: daily sum", storage.ErrWithdrawLimit),
+			},
+			storageReq: &storageReq{
+				Sum:    model.MoneyFromFloat(100),
+				Number: "6485485820226",
+			},
+		},
+		{
+			name: "Неверный номер заказа",
+			request: request{
+				body:        `{"order":"123456","sum":100}`,
+				contentType: "application/json",
+				isAuth:      true,
+			},
+			want: want{
+				statusCode: http.StatusUnprocessableEntity,
+			},
+			storageRes: nil,
+			storageReq: nil,
+		},
+		{
+			name: "Некорректная сумма для списания",
+			request: request{
+				body:        `{"order":"6485485820226","sum":-100}`,
+				contentType: "application/json",
+				isAuth:      true,
+			},
+			want: want{
+				statusCode: http.StatusBadRequest,
+			},
+			storageRes: nil,
+			storageReq: nil,
+		},
+		{
+			name: "Неавторизованный запрос",
+			request: request{
+				body:        `{"order":"6485485820226","sum":-100}`,
+				contentType: "application/json",
+				isAuth:      false,
+			},
+			want: want{
+				statusCode: http.StatusUnauthorized,
+			},
+			storageRes: nil,
+			storageReq: nil,
+		},
+		{
+			name: "Номер заказа уже был использован",
+			request: request{
+				body:        `{"order":"6485485820226","sum":100}`,
+				contentType: "application/json",
+				isAuth:      true,
+			},
+			want: want{
+				statusCode: http.StatusConflict,
+			},
+			storageRes: &storageRes{
+				err: storage.ErrOrderNumUsed,
+			},
+			storageReq: &storageReq{
+				Sum:    model.MoneyFromFloat(100),
+				Number: "6485485820226",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/api/user/balance/withdraw", strings.NewReader(tt.request.body))
+			req.Header.Set("Content-Type", tt.request.contentType)
+
+			if tt.request.isAuth {
+				jwtString, err := utils.BuildJWTSting(model.User{ID: 1, Login: "testuser"})
+				require.NoError(t, err)
+				req.AddCookie(&http.Cookie{Name: middleware.JWTCookieName, Value: jwtString})
+			}
+
+			w := httptest.NewRecorder()
+
+			if tt.storageRes != nil {
+				mockStorage.EXPECT().
+					Withdraw(gomock.Any(), 1, tt.storageReq.Sum, tt.storageReq.Number, "").
+					Return(tt.storageRes.err).
+					Times(1)
+			} else {
+				mockStorage.EXPECT().
+					Withdraw(gomock.Any(), 1, 1, "1", "").Times(0)
+			}
+
+			router.ServeHTTP(w, req)
+
+			resp := w.Result()
+			defer resp.Body.Close()
+
+			assert.Equal(t, tt.want.statusCode, resp.StatusCode)
+		})
+	}
+}
+
+func TestWithdrawIdempotencyKey(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockStorage := mocks.NewMockStorage(ctrl)
+	router := NewRouter(mockStorage, RouterCfg{})
+
+	jwtString, err := utils.BuildJWTSting(model.User{ID: 1, Login: "testuser"})
+	require.NoError(t, err)
+
+	tests := []struct {
+		name       string
+		key        string
+		callStore  bool
+		storageErr error
+		statusCode int
+	}{
+		{
+			name:       "Списание с ключом",
+			key:        "3f1c9a7e-retry",
+			callStore:  true,
+			statusCode: http.StatusOK,
+		},
+		{
+			name:       "Ключ использован для другого списания",
+			key:        "3f1c9a7e-retry",
+			callStore:  true,
+			storageErr: storage.ErrIdempotencyKeyUsed,
+			statusCode: http.StatusUnprocessableEntity,
+		},
+		{
+			name:       "Слишком длинный ключ",
+			key:        strings.Repeat("k", 256),
+			statusCode: http.StatusBadRequest,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.callStore {
+				mockStorage.EXPECT().
+					Withdraw(gomock.Any(), 1, model.MoneyFromFloat(100), "2377225624", tt.key).
+					Return(tt.storageErr).
+					Times(1)
+			}
+
+			req := httptest.NewRequest(http.MethodPost, "/api/user/balance/withdraw",
+				strings.NewReader(`{"order":"2377225624","sum":100}`))
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("Authorization", "Bearer "+jwtString)
+			req.Header.Set("Idempotency-Key", tt.key)
+			w := httptest.NewRecorder()
+
+			router.ServeHTTP(w, req)
+
+			resp := w.Result()
+			defer resp.Body.Close()
+
+			assert.Equal(t, tt.statusCode, resp.StatusCode)
+		})
+	}
+}
+
+func TestWithdrawStepUp(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockStorage := mocks.NewMockStorage(ctrl)
+	router := NewRouter(mockStorage, RouterCfg{
+		StepUp: StepUpCfg{WithdrawThreshold: model.MoneyFromFloat(500), TTL: 5 * time.Minute},
+	})
+
+	pwdHash, err := utils.GeneratePasswordHash("password123")
+	require.NoError(t, err)
+	mockStorage.EXPECT().
+		GetUserByLogin(gomock.Any(), "testuser").
+		Return(&model.User{ID: 1, Login: "testuser", PasswordHash: pwdHash}, nil).
+		AnyTimes()
+
+	jwtString, err := utils.BuildJWTSting(model.User{ID: 1, Login: "testuser"})
+	require.NoError(t, err)
+
+	withdraw := func(token string, sum string) int {
+		req := httptest.NewRequest(http.MethodPost, "/api/user/balance/withdraw",
+			strings.NewReader(`{"order":"2377225624","sum":`+sum+`}`))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		resp := w.Result()
+		defer resp.Body.Close()
+		return resp.StatusCode
+	}
+	reauth := func(password string) *http.Response {
+		req := httptest.NewRequest(http.MethodPost, "/api/user/reauth",
+			strings.NewReader(`{"password":"`+password+`"}`))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+jwtString)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w.Result()
+	}
+
+	// Небольшая сумма списывается без подтверждения
+	mockStorage.EXPECT().Withdraw(gomock.Any(), 1, model.MoneyFromFloat(100), "2377225624", "").Return(nil).Times(1)
+	assert.Equal(t, http.StatusOK, withdraw(jwtString, "100"))
+
+	// Крупная сумма требует подтверждения пароля
+	assert.Equal(t, http.StatusForbidden, withdraw(jwtString, "1000"))
+
+	resp := reauth("wrong")
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	resp = reauth("password123")
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var reauthRes model.ReauthRes
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&reauthRes))
+	require.NotEmpty(t, reauthRes.Token)
+	assert.WithinDuration(t, time.Now().Add(5*time.Minute), reauthRes.ElevatedUntil, time.Minute)
+
+	mockStorage.EXPECT().Withdraw(gomock.Any(), 1, model.MoneyFromFloat(1000), "2377225624", "").Return(nil).Times(1)
+	assert.Equal(t, http.StatusOK, withdraw(reauthRes.Token, "1000"))
+}
+
+func TestGetWithdraws(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockStorage := mocks.NewMockStorage(ctrl)
+	router := NewRouter(mockStorage, RouterCfg{})
+
+	type want struct {
+		statusCode int
+		body       string
+	}
+	type request struct {
+		isAuth bool
+	}
+	type storageRes struct {
+		withdraws []model.Withdrawn
+		err       error
+	}
+
+	tests := []struct {
+		name       string
+		request    request
+		want       want
+		storageRes *storageRes
+	}{
+		{
+			name: "Успешный запрос",
+			request: request{
+				isAuth: true,
+			},
+			want: want{
+				statusCode: http.StatusOK,
+				body: `
+					[
+							{
+									"id": 1,
+									"order": "2377225624",
+									"sum": 500,
+									"status": "DONE",
+									"processed_at": "2020-12-09T16:09:57+03:00"
+							}
+					]
+				`,
+			},
+			storageRes: &storageRes{
+				err: nil,
+				withdraws: []model.Withdrawn{
+					{
+						ID:        1,
+						UserID:    1,
+						Number:    "2377225624",
+						Sum:       model.MoneyFromFloat(500),
+						Status:    model.WithdrawalDone,
+						CreatedAt: time.Date(2020, 12, 9, 16, 9, 57, 0, time.Local),
+					},
+				},
+			},
+		},
+		{
+			name: "Нет данных",
+			request: request{
+				isAuth: true,
+			},
+			want: want{
+				statusCode: http.StatusNoContent,
+				body:       "",
+			},
+			storageRes: &storageRes{
+				err:       nil,
+				withdraws: []model.Withdrawn{},
+			},
+		},
+		{
+			name: "Неавторизованный запрос",
+			request: request{
+				isAuth: false,
+			},
+			want: want{
+				statusCode: http.StatusUnauthorized,
+				body:       "",
+			},
+			storageRes: nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/api/user/withdrawals", nil)
+
+			if tt.request.isAuth {
+				jwtString, err := utils.BuildJWTSting(model.User{ID: 1, Login: "testuser"})
+				require.NoError(t, err)
+				req.AddCookie(&http.Cookie{Name: middleware.JWTCookieName, Value: jwtString})
+			}
+
+			w := httptest.NewRecorder()
+
+			if tt.storageRes != nil {
+				mockStorage.EXPECT().
+					CountUserWithdrawals(gomock.Any(), 1, model.WithdrawalsQuery{}).
+					Return(len(tt.storageRes.withdraws), nil).
+					Times(1)
+				mockStorage.EXPECT().
+					GetWithdrawals(gomock.Any(), 1, model.WithdrawalsQuery{}).
+					Return(tt.storageRes.withdraws, tt.storageRes.err).
+					Times(1)
+			} else {
+				mockStorage.EXPECT().
+					GetWithdrawals(gomock.Any(), 1, gomock.Any()).Times(0)
+			}
+
+			router.ServeHTTP(w, req)
+
+			resp := w.Result()
+			defer resp.Body.Close()
+
+			assert.Equal(t, tt.want.statusCode, resp.StatusCode)
+
+			if tt.want.body != "" {
+				resBody, readErr := io.ReadAll(resp.Body)
+				require.NoError(t, readErr)
+				assert.JSONEq(t, tt.want.body, string(resBody))
+			}
+		})
+	}
+}
+
+func TestGetWithdrawsQuery(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockStorage := mocks.NewMockStorage(ctrl)
+	router := NewRouter(mockStorage, RouterCfg{})
+
+	jwtString, err := utils.BuildJWTSting(model.User{ID: 1, Login: "testuser"})
+	require.NoError(t, err)
+
+	tests := []struct {
+		name       string
+		rawQuery   string
+		query      *model.WithdrawalsQuery
+		statusCode int
+	}{
+		{
+			name:       "Страница списаний",
+			rawQuery:   "limit=10&offset=20",
+			query:      &model.WithdrawalsQuery{Limit: 10, Offset: 20},
+			statusCode: http.StatusOK,
+		},
+		{
+			name:     "Фильтр по датам",
+			rawQuery: "from=2024-05-01&to=2024-05-31",
+			query: &model.WithdrawalsQuery{
+				From: time.Date(2024, 5, 1, 0, 0, 0, 0, time.Local),
+				To:   time.Date(2024, 6, 1, 0, 0, 0, 0, time.Local),
+			},
+			statusCode: http.StatusOK,
+		},
+		{
+			name:       "Слишком большой limit",
+			rawQuery:   "limit=5000",
+			statusCode: http.StatusBadRequest,
+		},
+		{
+			name:       "Отрицательный offset",
+			rawQuery:   "offset=-1",
+			statusCode: http.StatusBadRequest,
+		},
+		{
+			name:       "Некорректный период",
+			rawQuery:   "from=2024-06-01&to=2024-05-01",
+			statusCode: http.StatusBadRequest,
+		},
+		{
+			name:       "Сортировка по сумме",
+			rawQuery:   "sort=sum&order=desc",
+			query:      &model.WithdrawalsQuery{Sort: model.Sort{Field: model.SortWithdrawalsSum, Desc: true}},
+			statusCode: http.StatusOK,
+		},
+		{
+			name:       "Сортировка по дате",
+			rawQuery:   "sort=processed_at",
+			query:      &model.WithdrawalsQuery{Sort: model.Sort{Field: model.SortWithdrawalsProcessedAt}},
+			statusCode: http.StatusOK,
+		},
+		{
+			name:       "Поле заказов для списаний",
+			rawQuery:   "sort=accrual",
+			statusCode: http.StatusBadRequest,
+		},
+		{
+			name:       "Некорректное направление",
+			rawQuery:   "order=up",
+			statusCode: http.StatusBadRequest,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.query != nil {
+				mockStorage.EXPECT().
+					CountUserWithdrawals(gomock.Any(), 1, *tt.query).
+					Return(25, nil).
+					Times(1)
+				mockStorage.EXPECT().
+					GetWithdrawals(gomock.Any(), 1, *tt.query).
+					Return([]model.Withdrawn{{Number: "2377225624", Sum: model.MoneyFromFloat(500)}}, nil).
+					Times(1)
+			}
+
+			req := httptest.NewRequest(http.MethodGet, "/api/user/withdrawals?"+tt.rawQuery, nil)
+			req.Header.Set("Authorization", "Bearer "+jwtString)
+			w := httptest.NewRecorder()
+
+			router.ServeHTTP(w, req)
+
+			resp := w.Result()
+			defer resp.Body.Close()
+
+			assert.Equal(t, tt.statusCode, resp.StatusCode)
+			if tt.statusCode == http.StatusOK {
+				assert.Equal(t, "25", resp.Header.Get("X-Total-Count"))
+			}
+		})
+	}
+}
+
+func TestGetBalanceHistory(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockStorage := mocks.NewMockStorage(ctrl)
+	router := NewRouter(mockStorage, RouterCfg{})
+
+	jwtString, err := utils.BuildJWTSting(model.User{ID: 1, Login: "testuser"})
+	require.NoError(t, err)
+
+	createdAt := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	history := []model.BalanceHistoryEntry{
+		{Type: model.BalanceEventAccrual, Number: "12345678903", Amount: model.MoneyFromFloat(500), Balance: model.MoneyFromFloat(500), CreatedAt: createdAt},
+		{Type: model.BalanceEventWithdrawal, Number: "2377225624", Amount: model.MoneyFromFloat(-200), Balance: model.MoneyFromFloat(300), CreatedAt: createdAt},
+	}
+
+	tests := []struct {
+		name       string
+		history    []model.BalanceHistoryEntry
+		storageErr error
+		statusCode int
+		wantBody   string
+	}{
+		{
+			name:       "История баланса",
+			history:    history,
+			statusCode: http.StatusOK,
+			wantBody: `[
+				{"type":"ACCRUAL","order":"12345678903","amount":500,"balance":500,"created_at":"2024-05-01T12:00:00Z"},
+				{"type":"WITHDRAWAL","order":"2377225624","amount":-200,"balance":300,"created_at":"2024-05-01T12:00:00Z"}
+			]`,
+		},
+		{
+			name:       "Пустая история",
+			history:    []model.BalanceHistoryEntry{},
+			statusCode: http.StatusNoContent,
+		},
+		{
+			name:       "Ошибка хранилища",
+			storageErr: errors.New("db error"),
+			statusCode: http.StatusInternalServerError,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockStorage.EXPECT().
+				GetBalanceHistory(gomock.Any(), 1).
+				Return(tt.history, tt.storageErr).
+				Times(1)
+
+			req := httptest.NewRequest(http.MethodGet, "/api/user/balance/history", nil)
+			req.Header.Set("Authorization", "Bearer "+jwtString)
+			w := httptest.NewRecorder()
+
+			router.ServeHTTP(w, req)
+
+			resp := w.Result()
+			defer resp.Body.Close()
+
+			assert.Equal(t, tt.statusCode, resp.StatusCode)
+			if tt.wantBody != "" {
+				body, err := io.ReadAll(resp.Body)
+				require.NoError(t, err)
+				assert.JSONEq(t, tt.wantBody, string(body))
+			}
+		})
+	}
+}
+
+func TestTransfer(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockStorage := mocks.NewMockStorage(ctrl)
+	router := NewRouter(mockStorage, RouterCfg{})
+
+	jwtString, err := utils.BuildJWTSting(model.User{ID: 1, Login: "testuser"})
+	require.NoError(t, err)
+
+	createdAt := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name        string
+		body        string
+		contentType string
+		callStorage bool
+		storageErr  error
+		statusCode  int
+		wantBody    string
+	}{
+		{
+			name:        "Успешный перевод",
+			body:        `{"login":"friend","sum":150}`,
+			contentType: "application/json",
+			callStorage: true,
+			statusCode:  http.StatusOK,
+			wantBody:    `{"id":7,"direction":"OUT","login":"friend","sum":150,"created_at":"2024-05-01T12:00:00Z"}`,
+		},
+		{
+			name:        "Получатель не найден",
+			body:        `{"login":"friend","sum":150}`,
+			contentType: "application/json",
+			callStorage: true,
+			storageErr:  storage.ErrNoUser,
+			statusCode:  http.StatusNotFound,
+		},
+		{
+			name:        "Перевод самому себе",
+			body:        `{"login":"friend","sum":150}`,
+			contentType: "application/json",
+			callStorage: true,
+			storageErr:  storage.ErrSelfTransfer,
+			statusCode:  http.StatusBadRequest,
+		},
+		{
+			name:        "Недостаточно средств",
+			body:        `{"login":"friend","sum":150}`,
+			contentType: "application/json",
+			callStorage: true,
+			storageErr:  storage.ErrInsufficientFunds,
+			statusCode:  http.StatusPaymentRequired,
+		},
+		{
+			name:        "Не указан получатель",
+			body:        `{"sum":150}`,
+			contentType: "application/json",
+			statusCode:  http.StatusBadRequest,
+		},
+		{
+			name:        "Некорректная сумма",
+			body:        `{"login":"friend","sum":-5}`,
+			contentType: "application/json",
+			statusCode:  http.StatusBadRequest,
+		},
+		{
+			name:        "Некорректный Content-Type",
+			body:        `{"login":"friend","sum":150}`,
+			contentType: "text/plain",
+			statusCode:  http.StatusBadRequest,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.callStorage {
+				var transfer *model.Transfer
+				if tt.storageErr == nil {
+					transfer = &model.Transfer{
+						ID: 7, Direction: model.TransferOut, Counterparty: "friend", Sum: model.MoneyFromFloat(150), CreatedAt: createdAt,
+					}
+				}
+				mockStorage.EXPECT().
+					Transfer(gomock.Any(), 1, "friend", model.MoneyFromFloat(150)).
+					Return(transfer, tt.storageErr).
+					Times(1)
+			}
+
+			req := httptest.NewRequest(http.MethodPost, "/api/user/balance/transfer", strings.NewReader(tt.body))
+			req.Header.Set("Content-Type", tt.contentType)
+			req.Header.Set("Authorization", "Bearer "+jwtString)
+			w := httptest.NewRecorder()
+
+			router.ServeHTTP(w, req)
+
+			resp := w.Result()
+			defer resp.Body.Close()
+
+			assert.Equal(t, tt.statusCode, resp.StatusCode)
+			if tt.wantBody != "" {
+				body, err := io.ReadAll(resp.Body)
+				require.NoError(t, err)
+				assert.JSONEq(t, tt.wantBody, string(body))
+			}
+		})
+	}
+}
+
+func TestGetTransfers(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockStorage := mocks.NewMockStorage(ctrl)
+	router := NewRouter(mockStorage, RouterCfg{})
+
+	jwtString, err := utils.BuildJWTSting(model.User{ID: 1, Login: "testuser"})
+	require.NoError(t, err)
+
+	createdAt := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name       string
+		transfers  []model.Transfer
+		storageErr error
+		statusCode int
+		wantBody   string
+	}{
+		{
+			name: "Список переводов",
+			transfers: []model.Transfer{
+				{ID: 2, Direction: model.TransferIn, Counterparty: "friend", Sum: model.MoneyFromFloat(50), CreatedAt: createdAt},
+				{ID: 1, Direction: model.TransferOut, Counterparty: "friend", Sum: model.MoneyFromFloat(150), CreatedAt: createdAt},
+			},
+			statusCode: http.StatusOK,
+			wantBody: `[
+				{"id":2,"direction":"IN","login":"friend","sum":50,"created_at":"2024-05-01T12:00:00Z"},
+				{"id":1,"direction":"OUT","login":"friend","sum":150,"created_at":"2024-05-01T12:00:00Z"}
+			]`,
+		},
+		{
+			name:       "Переводов нет",
+			transfers:  []model.Transfer{},
+			statusCode: http.StatusNoContent,
+		},
+		{
+			name:       "Ошибка хранилища",
+			storageErr: errors.New("db error"),
+			statusCode: http.StatusInternalServerError,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockStorage.EXPECT().
+				GetTransfers(gomock.Any(), 1).
+				Return(tt.transfers, tt.storageErr).
+				Times(1)
+
+			req := httptest.NewRequest(http.MethodGet, "/api/user/balance/transfers", nil)
+			req.Header.Set("Authorization", "Bearer "+jwtString)
+			w := httptest.NewRecorder()
+
+			router.ServeHTTP(w, req)
+
+			resp := w.Result()
+			defer resp.Body.Close()
+
+			assert.Equal(t, tt.statusCode, resp.StatusCode)
+			if tt.wantBody != "" {
+				body, err := io.ReadAll(resp.Body)
+				require.NoError(t, err)
+				assert.JSONEq(t, tt.wantBody, string(body))
+			}
+		})
+	}
+}
+
+func TestGetStatement(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockStorage := mocks.NewMockStorage(ctrl)
+	router := NewRouter(mockStorage, RouterCfg{})
+
+	jwtString, err := utils.BuildJWTSting(model.User{ID: 1, Login: "testuser"})
+	require.NoError(t, err)
+
+	from := time.Date(2024, 5, 1, 0, 0, 0, 0, time.Local)
+	to := time.Date(2024, 6, 1, 0, 0, 0, 0, time.Local)
+
+	tests := []struct {
+		name       string
+		month      string
+		statement  *model.Statement
+		storageErr error
+		statusCode int
+	}{
+		{
+			name:  "Выписка за месяц",
+			month: "2024-05",
+			statement: &model.Statement{
+				From: from, To: to, OpeningBalance: model.MoneyFromFloat(100), Credited: model.MoneyFromFloat(500), Debited: model.MoneyFromFloat(200), ClosingBalance: model.MoneyFromFloat(400),
+				Entries: []model.BalanceHistoryEntry{
+					{Type: model.BalanceEventAccrual, Number: "12345678903", Amount: model.MoneyFromFloat(500), Balance: model.MoneyFromFloat(600), CreatedAt: from},
+					{Type: model.BalanceEventWithdrawal, Number: "2377225624", Amount: model.MoneyFromFloat(-200), Balance: model.MoneyFromFloat(400), CreatedAt: from},
+				},
+			},
+			statusCode: http.StatusOK,
+		},
+		{
+			name:       "Некорректный месяц",
+			month:      "2024-13",
+			statusCode: http.StatusBadRequest,
+		},
+		{
+			name:       "Месяц не указан",
+			statusCode: http.StatusBadRequest,
+		},
+		{
+			name:       "Ошибка хранилища",
+			month:      "2024-05",
+			storageErr: errors.New("db error"),
+			statusCode: http.StatusInternalServerError,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.statement != nil || tt.storageErr != nil {
+				mockStorage.EXPECT().
+					GetStatement(gomock.Any(), 1, from, to).
+					Return(tt.statement, tt.storageErr).
+					Times(1)
+			}
+
+			req := httptest.NewRequest(http.MethodGet, "/api/user/statement?month="+tt.month, nil)
+			req.Header.Set("Authorization", "Bearer "+jwtString)
+			w := httptest.NewRecorder()
+
+			router.ServeHTTP(w, req)
+
+			resp := w.Result()
+			defer resp.Body.Close()
+
+			assert.Equal(t, tt.statusCode, resp.StatusCode)
+			if tt.statusCode == http.StatusOK {
+				assert.Equal(t, "application/pdf", resp.Header.Get("Content-Type"))
+				assert.Equal(t, `attachment; filename="statement-2024-05.pdf"`, resp.Header.Get("Content-Disposition"))
+				body, err := io.ReadAll(resp.Body)
+				require.NoError(t, err)
+				assert.True(t, bytes.HasPrefix(body, []byte("%PDF-")))
+				assert.Contains(t, string(body), "(User:    testuser) Tj")
+				assert.True(t, bytes.HasSuffix(body, []byte("%%EOF\n")))
+			}
+		})
+	}
+}
+
+func TestOrderEvents(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockStorage := mocks.NewMockStorage(ctrl)
+	hub := events.NewHub()
+	server := httptest.NewServer(NewRouter(mockStorage, RouterCfg{Events: hub}))
+	defer server.Close()
+
+	jwtString, err := utils.BuildJWTSting(model.User{ID: 1, Login: "testuser"})
+	require.NoError(t, err)
+
+	req, err := http.NewRequest(http.MethodGet, server.URL+"/api/user/orders/events", nil)
+	require.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer "+jwtString)
+	req.Header.Set("Accept", "text/event-stream")
+	resp, err := server.Client().Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+	// Событие по заказу другого пользователя не должно попасть в поток
+	updatedAt := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	hub.PublishOrderStatus(model.OrderStatusEvent{UserID: 2, Number: "2377225624", Status: model.OrderProcessing})
+	hub.PublishOrderStatus(model.OrderStatusEvent{
+		UserID: 1, Number: "12345678903", Status: model.OrderProcessed, Accrual: model.MoneyFromFloat(500), UpdatedAt: updatedAt,
+	})
+
+	reader := bufio.NewReader(resp.Body)
+	line, err := reader.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "event: order_status\n", line)
+	line, err = reader.ReadString('\n')
+	require.NoError(t, err)
+	data, ok := strings.CutPrefix(strings.TrimSpace(line), "data: ")
+	require.True(t, ok)
+	assert.JSONEq(t, `{"number":"12345678903","status":"PROCESSED","accrual":500,"updated_at":"2024-05-01T12:00:00Z"}`, data)
+
+	// Остановка сервиса завершает поток
+	hub.Close()
+	_, err = io.ReadAll(reader)
+	require.NoError(t, err)
+}
+
+// wsWriteFrame отправляет серверу маскированный фрейм WebSocket, как это делает клиент
+func wsWriteFrame(t *testing.T, conn net.Conn, opcode byte, payload []byte) {
+	t.Helper()
+	require.Less(t, len(payload), 126)
+	mask := []byte{1, 2, 3, 4}
+	frame := []byte{0x80 | opcode, 0x80 | byte(len(payload))}
+	frame = append(frame, mask...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+	_, err := conn.Write(frame)
+	require.NoError(t, err)
+}
+
+// wsReadFrame читает немаскированный фрейм сервера
+func wsReadFrame(t *testing.T, r *bufio.Reader) (byte, []byte) {
+	t.Helper()
+	header := make([]byte, 2)
+	_, err := io.ReadFull(r, header)
+	require.NoError(t, err)
+	length := int(header[1] & 0x7F)
+	if length == 126 {
+		ext := make([]byte, 2)
+		_, err = io.ReadFull(r, ext)
+		require.NoError(t, err)
+		length = int(ext[0])<<8 | int(ext[1])
+	}
+	payload := make([]byte, length)
+	_, err = io.ReadFull(r, payload)
+	require.NoError(t, err)
+	return header[0] & 0x0F, payload
+}
+
+func TestWebSocket(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockStorage := mocks.NewMockStorage(ctrl)
+	hub := events.NewHub()
+	router := NewRouter(mockStorage, RouterCfg{Events: hub})
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	jwtString, err := utils.BuildJWTSting(model.User{ID: 1, Login: "testuser"})
+	require.NoError(t, err)
+
+	t.Run("Запрос без заголовков WebSocket", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/api/user/ws", nil)
+		req.Header.Set("Authorization", "Bearer "+jwtString)
+		w := httptest.NewRecorder()
+
+		router.ServeHTTP(w, req)
+
+		resp := w.Result()
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	})
+
+	t.Run("Подписка на события", func(t *testing.T) {
+		conn, err := net.Dial("tcp", server.Listener.Addr().String())
+		require.NoError(t, err)
+		defer conn.Close()
+		require.NoError(t, conn.SetDeadline(time.Now().Add(5*time.Second)))
+
+		_, err = fmt.Fprintf(conn, "GET /api/user/ws HTTP/1.1\r\nHost: gophermart\r\n"+
+			"Authorization: Bearer %s\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n"+
+			"Sec-WebSocket-Version: 13\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n\r\n", jwtString)
+		require.NoError(t, err)
+		reader := bufio.NewReader(conn)
+		resp, err := http.ReadResponse(reader, nil)
+		require.NoError(t, err)
+		require.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode)
+		assert.Equal(t, "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=", resp.Header.Get("Sec-WebSocket-Accept"))
+
+		// Начисление по обработанному заказу приходит и как смена статуса, и как изменение баланса
+		updatedAt := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+		hub.PublishOrderStatus(model.OrderStatusEvent{
+			UserID: 1, Number: "12345678903", Status: model.OrderProcessed, Accrual: model.MoneyFromFloat(500), UpdatedAt: updatedAt,
+		})
+		_, payload := wsReadFrame(t, reader)
+		assert.JSONEq(t, `{"type":"order_status","order":{"number":"12345678903","status":"PROCESSED",
+			"accrual":500,"updated_at":"2024-05-01T12:00:00Z"}}`, string(payload))
+		_, payload = wsReadFrame(t, reader)
+		assert.JSONEq(t, `{"type":"balance","balance":{"type":"ACCRUAL","order":"12345678903",
+			"amount":500,"created_at":"2024-05-01T12:00:00Z"}}`, string(payload))
+
+		// Команды обрабатываются по порядку: ответ на некорректную команду означает, что отписка уже применена
+		wsWriteFrame(t, conn, 0x1, []byte(`{"action":"unsubscribe","topics":["order_status"]}`))
+		wsWriteFrame(t, conn, 0x1, []byte(`{"action":"mute"}`))
+		_, payload = wsReadFrame(t, reader)
+		assert.JSONEq(t, `{"error":"неизвестное действие \"mute\""}`, string(payload))
+
+		hub.PublishOrderStatus(model.OrderStatusEvent{UserID: 1, Number: "2377225624", Status: model.OrderProcessing})
+		hub.PublishBalanceChange(1, model.BalanceChangeEvent{
+			Type: model.BalanceEventWithdrawal, Number: "2377225624", Amount: model.MoneyFromFloat(-100), CreatedAt: updatedAt,
+		})
+		_, payload = wsReadFrame(t, reader)
+		assert.JSONEq(t, `{"type":"balance","balance":{"type":"WITHDRAWAL","order":"2377225624",
+			"amount":-100,"created_at":"2024-05-01T12:00:00Z"}}`, string(payload))
+
+		wsWriteFrame(t, conn, 0x8, []byte{0x03, 0xE8})
+		opcode, _ := wsReadFrame(t, reader)
+		assert.Equal(t, byte(0x8), opcode)
+	})
+}
+
+func TestCreateWebhook(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockStorage := mocks.NewMockStorage(ctrl)
+	router := NewRouter(mockStorage, RouterCfg{})
+
+	jwtString, err := utils.BuildJWTSting(model.User{ID: 1, Login: "testuser"})
+	require.NoError(t, err)
+
+	createdAt := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name        string
+		body        string
+		contentType string
+		wantEvents  []model.WebhookEventType
+		storageErr  error
+		statusCode  int
+	}{
+		{
+			name:        "Успешная регистрация",
+			body:        `{"url":"https://example.com/hook","events":["order.processed","balance.withdrawn","order.processed"]}`,
+			contentType: "application/json",
+			wantEvents:  []model.WebhookEventType{model.WebhookOrderProcessed, model.WebhookBalanceWithdrawn},
+			statusCode:  http.StatusCreated,
+		},
+		{
+			name:        "Ошибка хранилища",
+			body:        `{"url":"https://example.com/hook","events":["order.processed"]}`,
+			contentType: "application/json",
+			wantEvents:  []model.WebhookEventType{model.WebhookOrderProcessed},
+			storageErr:  errors.New("db error"),
+			statusCode:  http.StatusInternalServerError,
+		},
+		{
+			name:        "Некорректный адрес",
+			body:        `{"url":"ftp://example.com/hook","events":["order.processed"]}`,
+			contentType: "application/json",
+			statusCode:  http.StatusBadRequest,
+		},
+		{
+			name:        "Не указаны события",
+			body:        `{"url":"https://example.com/hook","events":[]}`,
+			contentType: "application/json",
+			statusCode:  http.StatusBadRequest,
+		},
+		{
+			name:        "Неизвестное событие",
+			body:        `{"url":"https://example.com/hook","events":["order.deleted"]}`,
+			contentType: "application/json",
+			statusCode:  http.StatusBadRequest,
+		},
+		{
+			name:        "Некорректный Content-Type",
+			body:        `{"url":"https://example.com/hook","events":["order.processed"]}`,
+			contentType: "text/plain",
+			statusCode:  http.StatusBadRequest,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.wantEvents != nil {
+				mockStorage.EXPECT().
+					CreateWebhook(gomock.Any(), 1, "https://example.com/hook", tt.wantEvents, gomock.Any()).
+					DoAndReturn(func(
+						_ context.Context, userID int, url string, events []model.WebhookEventType, secret string,
+					) (*model.Webhook, error) {
+						if tt.storageErr != nil {
+							return nil, tt.storageErr
+						}
+						return &model.Webhook{
+							ID: 3, UserID: userID, URL: url, Events: events, Secret: secret, CreatedAt: createdAt,
+						}, nil
+					}).
+					Times(1)
+			}
+
+			req := httptest.NewRequest(http.MethodPost, "/api/user/webhooks", strings.NewReader(tt.body))
+			req.Header.Set("Content-Type", tt.contentType)
+			req.Header.Set("Authorization", "Bearer "+jwtString)
+			w := httptest.NewRecorder()
+
+			router.ServeHTTP(w, req)
+
+			resp := w.Result()
+			defer resp.Body.Close()
+
+			assert.Equal(t, tt.statusCode, resp.StatusCode)
+			if tt.statusCode == http.StatusCreated {
+				var webhook model.Webhook
+				require.NoError(t, json.NewDecoder(resp.Body).Decode(&webhook))
+				assert.Equal(t, 3, webhook.ID)
+				assert.Equal(t, tt.wantEvents, webhook.Events)
+				assert.NotEmpty(t, webhook.Secret)
+			}
+		})
+	}
+}
+
+func TestGetWebhooks(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockStorage := mocks.NewMockStorage(ctrl)
+	router := NewRouter(mockStorage, RouterCfg{})
+
+	jwtString, err := utils.BuildJWTSting(model.User{ID: 1, Login: "testuser"})
+	require.NoError(t, err)
+
+	createdAt := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name       string
+		webhooks   []model.Webhook
+		storageErr error
+		statusCode int
+		wantBody   string
+	}{
+		{
+			name: "Список webhooks",
+			webhooks: []model.Webhook{
+				{ID: 3, URL: "https://example.com/hook", Events: []model.WebhookEventType{model.WebhookOrderProcessed}, CreatedAt: createdAt},
+			},
+			statusCode: http.StatusOK,
+			wantBody:   `[{"id":3,"url":"https://example.com/hook","events":["order.processed"],"created_at":"2024-05-01T12:00:00Z"}]`,
+		},
+		{
+			name:       "Webhooks нет",
+			webhooks:   []model.Webhook{},
+			statusCode: http.StatusNoContent,
+		},
+		{
+			name:       "Ошибка хранилища",
+			storageErr: errors.New("db error"),
+			statusCode: http.StatusInternalServerError,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockStorage.EXPECT().
+				GetWebhooks(gomock.Any(), 1).
+				Return(tt.webhooks, tt.storageErr).
+				Times(1)
+
+			req := httptest.NewRequest(http.MethodGet, "/api/user/webhooks", nil)
+			req.Header.Set("Authorization", "Bearer "+jwtString)
+			w := httptest.NewRecorder()
+
+			router.ServeHTTP(w, req)
+
+			resp := w.Result()
+			defer resp.Body.Close()
+
+			assert.Equal(t, tt.statusCode, resp.StatusCode)
+			if tt.wantBody != "" {
+				body, err := io.ReadAll(resp.Body)
+				require.NoError(t, err)
+				assert.JSONEq(t, tt.wantBody, string(body))
+			}
+		})
+	}
+}
+
+func TestDeleteWebhook(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockStorage := mocks.NewMockStorage(ctrl)
+	router := NewRouter(mockStorage, RouterCfg{})
+
+	jwtString, err := utils.BuildJWTSting(model.User{ID: 1, Login: "testuser"})
+	require.NoError(t, err)
+
+	tests := []struct {
+		name        string
+		id          string
+		callStorage bool
+		storageErr  error
+		statusCode  int
+	}{
+		{
+			name:        "Успешное удаление",
+			id:          "3",
+			callStorage: true,
+			statusCode:  http.StatusNoContent,
+		},
+		{
+			name:        "Webhook не найден",
+			id:          "3",
+			callStorage: true,
+			storageErr:  storage.ErrNoWebhook,
+			statusCode:  http.StatusNotFound,
+		},
+		{
+			name:        "Ошибка хранилища",
+			id:          "3",
+			callStorage: true,
+			storageErr:  errors.New("db error"),
+			statusCode:  http.StatusInternalServerError,
+		},
+		{
+			name:       "Некорректный id",
+			id:         "abc",
+			statusCode: http.StatusBadRequest,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.callStorage {
+				mockStorage.EXPECT().
+					DeleteWebhook(gomock.Any(), 1, 3).
+					Return(tt.storageErr).
+					Times(1)
+			}
+
+			req := httptest.NewRequest(http.MethodDelete, "/api/user/webhooks/"+tt.id, nil)
+			req.Header.Set("Authorization", "Bearer "+jwtString)
+			w := httptest.NewRecorder()
+
+			router.ServeHTTP(w, req)
+
+			resp := w.Result()
+			defer resp.Body.Close()
+
+			assert.Equal(t, tt.statusCode, resp.StatusCode)
+		})
+	}
+}
+
+func TestCurrencyConversion(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockStorage := mocks.NewMockStorage(ctrl)
+	router := NewRouter(mockStorage, RouterCfg{Currency: CurrencyCfg{Code: "RUB", DefaultRate: 1}})
+
+	jwtString, err := utils.BuildJWTSting(model.User{ID: 1, Login: "testuser"})
+	require.NoError(t, err)
+
+	rates := []model.CurrencyRate{
+		{Currency: "RUB", Rate: 1.5, EffectiveFrom: time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)},
+		{Currency: "RUB", Rate: 2, EffectiveFrom: time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)},
+	}
+
+	t.Run("Баланс по действующему курсу", func(t *testing.T) {
+		mockStorage.EXPECT().
+			GetUserBalance(gomock.Any(), 1).
+			Return(&model.Balance{Current: model.MoneyFromFloat(500.5), Withdrawn: model.MoneyFromFloat(42)}, nil).
+			Times(1)
+		mockStorage.EXPECT().GetCurrencyRates(gomock.Any(), "RUB").Return(rates, nil).Times(1)
+
+		req := httptest.NewRequest(http.MethodGet, "/api/user/balance", nil)
+		req.Header.Set("Authorization", "Bearer "+jwtString)
+		w := httptest.NewRecorder()
+
+		router.ServeHTTP(w, req)
+
+		resp := w.Result()
+		defer resp.Body.Close()
+
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		assert.JSONEq(t, `{
+			"current":500.5,
+			"withdrawn":42,
+			"converted":{"currency":"RUB","rate":2,"current":1001,"withdrawn":84}
+		}`, string(body))
+	})
+
+	t.Run("Списания по курсу на момент списания", func(t *testing.T) {
+		mockStorage.EXPECT().CountUserWithdrawals(gomock.Any(), 1, gomock.Any()).Return(3, nil).Times(1)
+		mockStorage.EXPECT().
+			GetWithdrawals(gomock.Any(), 1, gomock.Any()).
+			Return([]model.Withdrawn{
+				{Number: "2377225624", Sum: model.MoneyFromFloat(100), CreatedAt: time.Date(2024, 5, 10, 12, 0, 0, 0, time.UTC)},
+				{Number: "6485485820226", Sum: model.MoneyFromFloat(33.33), CreatedAt: time.Date(2024, 3, 10, 12, 0, 0, 0, time.UTC)},
+				{Number: "12345678903", Sum: model.MoneyFromFloat(10), CreatedAt: time.Date(2024, 1, 10, 12, 0, 0, 0, time.UTC)},
+			}, nil).
+			Times(1)
+		mockStorage.EXPECT().GetCurrencyRates(gomock.Any(), "RUB").Return(rates, nil).Times(1)
+
+		req := httptest.NewRequest(http.MethodGet, "/api/user/withdrawals", nil)
+		req.Header.Set("Authorization", "Bearer "+jwtString)
+		w := httptest.NewRecorder()
+
+		router.ServeHTTP(w, req)
+
+		resp := w.Result()
+		defer resp.Body.Close()
+
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		var withdrawals []struct {
+			Order     string                 `json:"order"`
+			Converted *model.ConvertedAmount `json:"converted"`
+		}
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&withdrawals))
+		require.Len(t, withdrawals, 3)
+		assert.Equal(t, &model.ConvertedAmount{Currency: "RUB", Rate: 2, Amount: model.MoneyFromFloat(200)}, withdrawals[0].Converted)
+		assert.Equal(t, &model.ConvertedAmount{Currency: "RUB", Rate: 1.5, Amount: model.MoneyFromFloat(50)}, withdrawals[1].Converted)
+		assert.Equal(t, &model.ConvertedAmount{Currency: "RUB", Rate: 1, Amount: model.MoneyFromFloat(10)}, withdrawals[2].Converted)
+	})
+}
+
+func TestWithdrawMinSum(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockStorage := mocks.NewMockStorage(ctrl)
+	router := NewRouter(mockStorage, RouterCfg{MinWithdrawSum: model.MoneyFromFloat(50)})
+
+	jwtString, err := utils.BuildJWTSting(model.User{ID: 1, Login: "testuser"})
+	require.NoError(t, err)
+
+	tests := []struct {
+		name       string
+		body       string
+		callStore  bool
+		storageErr error
+		statusCode int
+	}{
+		{
+			name:       "Сумма не меньше минимальной",
+			body:       `{"order":"2377225624","sum":50}`,
+			callStore:  true,
+			statusCode: http.StatusOK,
+		},
+		{
+			name:       "Сумма меньше минимальной",
+			body:       `{"order":"2377225624","sum":49.99}`,
+			statusCode: http.StatusUnprocessableEntity,
+		},
+		{
+			name:       "Хранилище отклонило сумму",
+			body:       `{"order":"2377225624","sum":50}`,
+			callStore:  true,
+			storageErr: storage.ErrWithdrawBelowMin,
+			statusCode: http.StatusUnprocessableEntity,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.callStore {
+				mockStorage.EXPECT().
+					Withdraw(gomock.Any(), 1, model.MoneyFromFloat(50), "2377225624", "").
+					Return(tt.storageErr).
+					Times(1)
+			}
+
+			req := httptest.NewRequest(http.MethodPost, "/api/user/balance/withdraw", strings.NewReader(tt.body))
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("Authorization", "Bearer "+jwtString)
+			w := httptest.NewRecorder()
+
+			router.ServeHTTP(w, req)
+
+			resp := w.Result()
+			defer resp.Body.Close()
+
+			assert.Equal(t, tt.statusCode, resp.StatusCode)
+		})
+	}
+}
+
+func TestGetTier(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	tiers, err := loyalty.NewTiers(loyalty.DefaultLevels(
+		model.MoneyFromFloat(1000), model.MoneyFromFloat(5000), 1.05, 1.1,
+	))
+	require.NoError(t, err)
+	mockStorage := mocks.NewMockStorage(ctrl)
+	router := NewRouter(mockStorage, RouterCfg{LoyaltyTiers: tiers})
+
+	jwtString, err := utils.BuildJWTSting(model.User{ID: 1, Login: "testuser"})
+	require.NoError(t, err)
+
+	tests := []struct {
+		name       string
+		lifetime   model.Money
+		storageErr error
+		statusCode int
+		body       string
+	}{
+		{
+			name:       "Базовый уровень",
+			lifetime:   model.MoneyFromFloat(250),
+			statusCode: http.StatusOK,
+			body: `{"tier": "BRONZE", "multiplier": 1, "lifetime_accrual": 250,
+				"next_tier": "SILVER", "next_threshold": 1000, "remaining": 750, "progress": 0.25}`,
+		},
+		{
+			name:       "Средний уровень",
+			lifetime:   model.MoneyFromFloat(2000),
+			statusCode: http.StatusOK,
+			body: `{"tier": "SILVER", "multiplier": 1.05, "lifetime_accrual": 2000,
+				"next_tier": "GOLD", "next_threshold": 5000, "remaining": 3000, "progress": 0.25}`,
+		},
+		{
+			name:       "Максимальный уровень",
+			lifetime:   model.MoneyFromFloat(7000),
+			statusCode: http.StatusOK,
+			body:       `{"tier": "GOLD", "multiplier": 1.1, "lifetime_accrual": 7000, "progress": 1}`,
+		},
+		{
+			name:       "Ошибка хранилища",
+			storageErr: errors.New("db error"),
+			statusCode: http.StatusInternalServerError,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockStorage.EXPECT().GetLifetimeAccrual(gomock.Any(), 1).Return(tt.lifetime, tt.storageErr).Times(1)
+
+			req := httptest.NewRequest(http.MethodGet, "/api/user/tier", nil)
+			req.Header.Set("Authorization", "Bearer "+jwtString)
+			w := httptest.NewRecorder()
+
+			router.ServeHTTP(w, req)
+
+			resp := w.Result()
+			defer resp.Body.Close()
+
+			assert.Equal(t, tt.statusCode, resp.StatusCode)
+			if tt.body != "" {
+				respBody, err := io.ReadAll(resp.Body)
+				require.NoError(t, err)
+				assert.JSONEq(t, tt.body, string(respBody))
+			}
+		})
+	}
+
+	t.Run("Уровни не подключены", func(t *testing.T) {
+		router := NewRouter(mockStorage, RouterCfg{})
+		req := httptest.NewRequest(http.MethodGet, "/api/user/tier", nil)
+		req.Header.Set("Authorization", "Bearer "+jwtString)
+		w := httptest.NewRecorder()
+
+		router.ServeHTTP(w, req)
+
+		resp := w.Result()
+		defer resp.Body.Close()
+
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	})
+}
+
+func TestCancelWithdrawal(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockStorage := mocks.NewMockStorage(ctrl)
+	router := NewRouter(mockStorage, RouterCfg{WithdrawCancelWindow: 15 * time.Minute})
+
+	jwtString, err := utils.BuildJWTSting(model.User{ID: 1, Login: "testuser"})
+	require.NoError(t, err)
+
+	tests := []struct {
+		name       string
+		storageErr error
+		statusCode int
+	}{
+		{name: "Списание отменено", statusCode: http.StatusNoContent},
+		{name: "Списание не найдено", storageErr: storage.ErrNoWithdrawal, statusCode: http.StatusNotFound},
+		{name: "Окно отмены истекло", storageErr: storage.ErrWithdrawalFinal, statusCode: http.StatusConflict},
+		{name: "Ошибка хранилища", storageErr: errors.New("db error"), statusCode: http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var withdrawn *model.Withdrawn
+			if tt.storageErr == nil {
+				withdrawn = &model.Withdrawn{ID: 7, UserID: 1, Number: "2377225624", Sum: model.MoneyFromFloat(100)}
+			}
+			mockStorage.EXPECT().CancelWithdrawal(gomock.Any(), 1, 7).Return(withdrawn, tt.storageErr).Times(1)
+
+			req := httptest.NewRequest(http.MethodDelete, "/api/user/withdrawals/7", nil)
+			req.Header.Set("Authorization", "Bearer "+jwtString)
+			w := httptest.NewRecorder()
+
+			router.ServeHTTP(w, req)
+
+			resp := w.Result()
+			defer resp.Body.Close()
+
+			assert.Equal(t, tt.statusCode, resp.StatusCode)
+		})
+	}
+
+	t.Run("Некорректный id", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodDelete, "/api/user/withdrawals/abc", nil)
+		req.Header.Set("Authorization", "Bearer "+jwtString)
+		w := httptest.NewRecorder()
+
+		router.ServeHTTP(w, req)
+
+		resp := w.Result()
+		defer resp.Body.Close()
+
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	})
+
+	t.Run("Отмена недоступна", func(t *testing.T) {
+		router := NewRouter(mockStorage, RouterCfg{})
+		req := httptest.NewRequest(http.MethodDelete, "/api/user/withdrawals/7", nil)
+		req.Header.Set("Authorization", "Bearer "+jwtString)
+		w := httptest.NewRecorder()
+
+		router.ServeHTTP(w, req)
+
+		resp := w.Result()
+		defer resp.Body.Close()
+
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	})
+}
+
+func TestHoldBalance(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockStorage := mocks.NewMockStorage(ctrl)
+	router := NewRouter(mockStorage, RouterCfg{HoldTTL: 30 * time.Minute})
+
+	jwtString, err := utils.BuildJWTSting(model.User{ID: 1, Login: "testuser"})
+	require.NoError(t, err)
+
+	hold := &model.Hold{
+		ID:        5,
+		UserID:    1,
+		Number:    "2377225624",
+		Sum:       model.MoneyFromFloat(150.5),
+		Status:    model.HoldActive,
+		ExpiresAt: time.Date(2024, 5, 10, 12, 30, 0, 0, time.UTC),
+		CreatedAt: time.Date(2024, 5, 10, 12, 0, 0, 0, time.UTC),
+	}
+
+	tests := []struct {
+		name       string
+		body       string
+		storageErr error
+		callStore  bool
+		statusCode int
+		respBody   string
+	}{
+		{
+			name:       "Баллы зарезервированы",
+			body:       `{"order": "2377225624", "sum": 150.5}`,
+			callStore:  true,
+			statusCode: http.StatusCreated,
+			respBody: `{"id": 5, "order": "2377225624", "sum": 150.5, "status": "HELD",
+				"expires_at": "2024-05-10T12:30:00Z", "created_at": "2024-05-10T12:00:00Z"}`,
+		},
+		{
+			name:       "Некорректный номер заказа",
+			body:       `{"order": "12345", "sum": 150.5}`,
+			statusCode: http.StatusUnprocessableEntity,
+		},
+		{
+			name:       "Некорректная сумма",
+			body:       `{"order": "2377225624", "sum": 0}`,
+			statusCode: http.StatusBadRequest,
+		},
+		{
+			name:       "Недостаточно средств",
+			body:       `{"order": "2377225624", "sum": 150.5}`,
+			callStore:  true,
+			storageErr: storage.ErrInsufficientFunds,
+			statusCode: http.StatusPaymentRequired,
+		},
+		{
+			name:       "Номер заказа уже использован",
+			body:       `{"order": "2377225624", "sum": 150.5}`,
+			callStore:  true,
+			storageErr: storage.ErrOrderNumUsed,
+			statusCode: http.StatusConflict,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.callStore {
+				var res *model.Hold
+				if tt.storageErr == nil {
+					res = hold
+				}
+				mockStorage.EXPECT().
+					HoldBalance(gomock.Any(), 1, "2377225624", model.MoneyFromFloat(150.5), 30*time.Minute).
+					Return(res, tt.storageErr).
+					Times(1)
+			}
+
+			req := httptest.NewRequest(http.MethodPost, "/api/user/balance/hold", strings.NewReader(tt.body))
+			req.Header.Set("Authorization", "Bearer "+jwtString)
+			req.Header.Set("Content-Type", "application/json")
+			w := httptest.NewRecorder()
+
+			router.ServeHTTP(w, req)
+
+			resp := w.Result()
+			defer resp.Body.Close()
+
+			assert.Equal(t, tt.statusCode, resp.StatusCode)
+			if tt.respBody != "" {
+				respBody, err := io.ReadAll(resp.Body)
+				require.NoError(t, err)
+				assert.JSONEq(t, tt.respBody, string(respBody))
+			}
+		})
+	}
+}
+
+func TestResolveHold(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockStorage := mocks.NewMockStorage(ctrl)
+	router := NewRouter(mockStorage, RouterCfg{HoldTTL: 30 * time.Minute})
+
+	jwtString, err := utils.BuildJWTSting(model.User{ID: 1, Login: "testuser"})
+	require.NoError(t, err)
+
+	tests := []struct {
+		name       string
+		path       string
+		body       string
+		storageErr error
+		callStore  bool
+		statusCode int
+	}{
+		{name: "Резерв списан", path: "capture", body: `{"id": 5}`, callStore: true, statusCode: http.StatusOK},
+		{name: "Резерв снят", path: "release", body: `{"id": 5}`, callStore: true, statusCode: http.StatusOK},
+		{
+			name: "Резерв не найден", path: "capture", body: `{"id": 5}`,
+			callStore: true, storageErr: storage.ErrNoHold, statusCode: http.StatusNotFound,
+		},
+		{
+			name: "Резерв истек", path: "capture", body: `{"id": 5}`,
+			callStore: true, storageErr: storage.ErrHoldNotActive, statusCode: http.StatusConflict,
+		},
+		{
+			name: "Ошибка хранилища", path: "release", body: `{"id": 5}`,
+			callStore: true, storageErr: errors.New("db error"), statusCode: http.StatusInternalServerError,
+		},
+		{name: "Некорректный id", path: "release", body: `{"id": "5"}`, statusCode: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.callStore {
+				var res *model.Hold
+				if tt.storageErr == nil {
+					res = &model.Hold{ID: 5, UserID: 1, Number: "2377225624", Sum: model.MoneyFromFloat(100)}
+				}
+				if tt.path == "capture" {
+					mockStorage.EXPECT().CaptureHold(gomock.Any(), 1, 5).Return(res, tt.storageErr).Times(1)
+				} else {
+					mockStorage.EXPECT().ReleaseHold(gomock.Any(), 1, 5).Return(res, tt.storageErr).Times(1)
+				}
+			}
+
+			req := httptest.NewRequest(http.MethodPost, "/api/user/balance/"+tt.path, strings.NewReader(tt.body))
+			req.Header.Set("Authorization", "Bearer "+jwtString)
+			req.Header.Set("Content-Type", "application/json")
+			w := httptest.NewRecorder()
+
+			router.ServeHTTP(w, req)
+
+			resp := w.Result()
+			defer resp.Body.Close()
+
+			assert.Equal(t, tt.statusCode, resp.StatusCode)
+		})
+	}
+}
+
+func TestGetStats(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockStorage := mocks.NewMockStorage(ctrl)
+	router := NewRouter(mockStorage, RouterCfg{})
+
+	jwtString, err := utils.BuildJWTSting(model.User{ID: 1, Login: "testuser"})
+	require.NoError(t, err)
+
+	now := time.Now()
+	monthStart := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, now.Location())
+	stats := []model.MonthlyStats{
+		{Month: "2024-05", Orders: 3, Accrued: model.MoneyFromFloat(729.98), Withdrawn: model.MoneyFromFloat(100)},
+		{Month: "2024-04", Orders: 1, Accrued: 0, Withdrawn: model.MoneyFromFloat(50.5)},
+	}
+
+	tests := []struct {
+		name       string
+		rawQuery   string
+		since      time.Time
+		stats      []model.MonthlyStats
+		storageErr error
+		callStore  bool
+		statusCode int
+		body       string
+	}{
+		{
+			name:       "Статистика за 12 месяцев",
+			since:      monthStart.AddDate(0, -11, 0),
+			stats:      stats,
+			callStore:  true,
+			statusCode: http.StatusOK,
+			body: `[
+				{"month": "2024-05", "orders": 3, "accrued": 729.98, "withdrawn": 100},
+				{"month": "2024-04", "orders": 1, "accrued": 0, "withdrawn": 50.5}
+			]`,
 		},
 		{
-			name: "Неавторизованный запрос",
-			request: request{
-				isAuth: false,
-			},
-			want: want{
-				statusCode: http.StatusUnauthorized,
-				body:       "",
-			},
-			storageRes: nil,
+			name:       "Статистика за текущий месяц",
+			rawQuery:   "months=1",
+			since:      monthStart,
+			stats:      []model.MonthlyStats{},
+			callStore:  true,
+			statusCode: http.StatusNoContent,
+		},
+		{
+			name:       "Некорректное количество месяцев",
+			rawQuery:   "months=0",
+			statusCode: http.StatusBadRequest,
+		},
+		{
+			name:       "Ошибка хранилища",
+			since:      monthStart.AddDate(0, -11, 0),
+			storageErr: errors.New("db error"),
+			callStore:  true,
+			statusCode: http.StatusInternalServerError,
 		},
 	}
-
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			req := httptest.NewRequest(http.MethodGet, "/api/user/balance", nil)
-
-			if tt.request.isAuth {
-				jwtString, err := utils.BuildJWTSting(model.User{ID: 1, Login: "testuser"})
-				require.NoError(t, err)
-				req.AddCookie(&http.Cookie{Name: middleware.JWTCookieName, Value: jwtString})
+			if tt.callStore {
+				mockStorage.EXPECT().GetMonthlyStats(gomock.Any(), 1, tt.since).Return(tt.stats, tt.storageErr).Times(1)
 			}
 
+			req := httptest.NewRequest(http.MethodGet, "/api/user/stats?"+tt.rawQuery, nil)
+			req.Header.Set("Authorization", "Bearer "+jwtString)
 			w := httptest.NewRecorder()
 
-			if tt.storageRes != nil {
-				mockStorage.EXPECT().
-					GetUserBalance(gomock.Any(), 1).
-					Return(tt.storageRes.balance, tt.storageRes.err).
-					Times(1)
-			} else {
-				mockStorage.EXPECT().
-					GetUserBalance(gomock.Any(), 1).Times(0)
-			}
-
 			router.ServeHTTP(w, req)
 
 			resp := w.Result()
 			defer resp.Body.Close()
 
-			assert.Equal(t, tt.want.statusCode, resp.StatusCode)
-
-			if tt.want.body != "" {
-				resBody, readErr := io.ReadAll(resp.Body)
-				require.NoError(t, readErr)
-				assert.JSONEq(t, tt.want.body, string(resBody))
+			assert.Equal(t, tt.statusCode, resp.StatusCode)
+			if tt.body != "" {
+				respBody, err := io.ReadAll(resp.Body)
+				require.NoError(t, err)
+				assert.JSONEq(t, tt.body, string(respBody))
 			}
 		})
 	}
 }
 
-func TestWithdraw(t *testing.T) {
+func TestGetArchivedOrders(t *testing.T) {
 	ctrl := gomock.NewController(t)
 	defer ctrl.Finish()
 
 	mockStorage := mocks.NewMockStorage(ctrl)
-	router := NewRouter(mockStorage)
+	router := NewRouter(mockStorage, RouterCfg{})
 
-	type want struct {
-		statusCode int
-	}
-	type request struct {
-		body        string
-		contentType string
-		isAuth      bool
-	}
-	type storageRes struct {
-		err error
-	}
-	type storageReq struct {
-		Sum    float64
-		Number string
+	jwtString, err := utils.BuildJWTSting(model.User{ID: 1, Login: "testuser"})
+	require.NoError(t, err)
+
+	uploadedAt := time.Date(2023, 1, 10, 12, 0, 0, 0, time.UTC)
+	orders := []model.Order{
+		{Number: "9278923470", Status: model.OrderProcessed, Accrual: model.MoneyFromFloat(500), CreatedAt: uploadedAt},
+		{Number: "12345678903", Status: model.OrderProcessed, CreatedAt: uploadedAt},
 	}
 
 	tests := []struct {
 		name       string
-		request    request
-		want       want
-		storageRes *storageRes
-		storageReq *storageReq
+		rawQuery   string
+		limit      int
+		offset     int
+		total      int
+		orders     []model.Order
+		countErr   error
+		getErr     error
+		callCount  bool
+		callGet    bool
+		statusCode int
+		totalCount string
+		body       string
 	}{
 		{
-			name: "Успешный запрос",
-			request: request{
-				body:        `{"order":"6485485820226","sum":100}`,
-				contentType: "application/json",
-				isAuth:      true,
-			},
-			want: want{
-				statusCode: http.StatusOK,
-			},
-			storageRes: &storageRes{
-				err: nil,
-			},
-			storageReq: &storageReq{
-				Sum:    100,
-				Number: "6485485820226",
-			},
-		},
-		{
-			name: "На счету недостаточно средств",
-			request: request{
-				body:        `{"order":"6485485820226","sum":100}`,
-				contentType: "application/json",
-				isAuth:      true,
-			},
-			want: want{
-				statusCode: http.StatusPaymentRequired,
-			},
-			storageRes: &storageRes{
-				err: storage.ErrInsufficientFunds,
-			},
-			storageReq: &storageReq{
-				Sum:    100,
-				Number: "6485485820226",
-			},
+			name:       "Заказы в архиве",
+			total:      2,
+			orders:     orders,
+			callCount:  true,
+			callGet:    true,
+			statusCode: http.StatusOK,
+			totalCount: "2",
+			body: `[
+				{"number": "9278923470", "status": "PROCESSED", "accrual": 500, "uploaded_at": "2023-01-10T12:00:00Z"},
+				{"number": "12345678903", "status": "PROCESSED", "uploaded_at": "2023-01-10T12:00:00Z"}
+			]`,
 		},
 		{
-			name: "Неверный номер заказа",
-			request: request{
-				body:        `{"order":"123456","sum":100}`,
-				contentType: "application/json",
-				isAuth:      true,
-			},
-			want: want{
-				statusCode: http.StatusUnprocessableEntity,
-			},
-			storageRes: nil,
-			storageReq: nil,
+			name:       "Страница за пределами архива",
+			rawQuery:   "limit=10&offset=20",
+			limit:      10,
+			offset:     20,
+			total:      2,
+			orders:     []model.Order{},
+			callCount:  true,
+			callGet:    true,
+			statusCode: http.StatusNoContent,
+			totalCount: "2",
 		},
 		{
-			name: "Некорректная сумма для списания",
-			request: request{
-				body:        `{"order":"6485485820226","sum":-100}`,
-				contentType: "application/json",
-				isAuth:      true,
-			},
-			want: want{
-				statusCode: http.StatusBadRequest,
-			},
-			storageRes: nil,
-			storageReq: nil,
+			name:       "Некорректный limit",
+			rawQuery:   "limit=0",
+			statusCode: http.StatusBadRequest,
 		},
 		{
-			name: "Неавторизованный запрос",
-			request: request{
-				body:        `{"order":"6485485820226","sum":-100}`,
-				contentType: "application/json",
-				isAuth:      false,
-			},
-			want: want{
-				statusCode: http.StatusUnauthorized,
-			},
-			storageRes: nil,
-			storageReq: nil,
+			name:       "Ошибка подсчета заказов",
+			countErr:   errors.New("db error"),
+			callCount:  true,
+			statusCode: http.StatusInternalServerError,
 		},
 		{
-			name: "Номер заказа уже был использован",
-			request: request{
-				body:        `{"order":"6485485820226","sum":100}`,
-				contentType: "application/json",
-				isAuth:      true,
-			},
-			want: want{
-				statusCode: http.StatusConflict,
-			},
-			storageRes: &storageRes{
-				err: storage.ErrOrderNumUsed,
-			},
-			storageReq: &storageReq{
-				Sum:    100,
-				Number: "6485485820226",
-			},
+			name:       "Ошибка чтения заказов",
+			total:      2,
+			getErr:     errors.New("db error"),
+			callCount:  true,
+			callGet:    true,
+			statusCode: http.StatusInternalServerError,
 		},
 	}
-
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			req := httptest.NewRequest(http.MethodPost, "/api/user/balance/withdraw", strings.NewReader(tt.request.body))
-			req.Header.Set("Content-Type", tt.request.contentType)
-
-			if tt.request.isAuth {
-				jwtString, err := utils.BuildJWTSting(model.User{ID: 1, Login: "testuser"})
-				require.NoError(t, err)
-				req.AddCookie(&http.Cookie{Name: middleware.JWTCookieName, Value: jwtString})
+			if tt.callCount {
+				mockStorage.EXPECT().CountArchivedOrders(gomock.Any(), 1).Return(tt.total, tt.countErr).Times(1)
 			}
-
-			w := httptest.NewRecorder()
-
-			if tt.storageRes != nil {
+			if tt.callGet {
 				mockStorage.EXPECT().
-					Withdraw(gomock.Any(), 1, tt.storageReq.Sum, tt.storageReq.Number).
-					Return(tt.storageRes.err).
+					GetArchivedOrders(gomock.Any(), 1, tt.limit, tt.offset).
+					Return(tt.orders, tt.getErr).
 					Times(1)
-			} else {
-				mockStorage.EXPECT().
-					Withdraw(gomock.Any(), 1, 1, "1").Times(0)
 			}
 
+			req := httptest.NewRequest(http.MethodGet, "/api/user/orders/archive?"+tt.rawQuery, nil)
+			req.Header.Set("Authorization", "Bearer "+jwtString)
+			w := httptest.NewRecorder()
+
 			router.ServeHTTP(w, req)
 
 			resp := w.Result()
 			defer resp.Body.Close()
 
-			assert.Equal(t, tt.want.statusCode, resp.StatusCode)
+			assert.Equal(t, tt.statusCode, resp.StatusCode)
+			if tt.totalCount != "" {
+				assert.Equal(t, tt.totalCount, resp.Header.Get("X-Total-Count"))
+			}
+			if tt.body != "" {
+				respBody, err := io.ReadAll(resp.Body)
+				require.NoError(t, err)
+				assert.JSONEq(t, tt.body, string(respBody))
+			}
 		})
 	}
 }
 
-func TestGetWithdraws(t *testing.T) {
+func TestGetBalanceGzip(t *testing.T) {
 	ctrl := gomock.NewController(t)
 	defer ctrl.Finish()
 
 	mockStorage := mocks.NewMockStorage(ctrl)
-	router := NewRouter(mockStorage)
 
-	type want struct {
-		statusCode int
-		body       string
-	}
-	type request struct {
-		isAuth bool
-	}
-	type storageRes struct {
-		withdraws []model.Withdrawn
-		err       error
-	}
+	jwtString, err := utils.BuildJWTSting(model.User{ID: 1, Login: "testuser"})
+	require.NoError(t, err)
 
 	tests := []struct {
-		name       string
-		request    request
-		want       want
-		storageRes *storageRes
+		name           string
+		cfg            middleware.CompressorCfg
+		acceptEncoding string
+		wantGzip       bool
 	}{
 		{
-			name: "Успешный запрос",
-			request: request{
-				isAuth: true,
-			},
-			want: want{
-				statusCode: http.StatusOK,
-				body: `
-					[
-							{
-									"order": "2377225624",
-									"sum": 500,
-									"processed_at": "2020-12-09T16:09:57+03:00"
-							}
-					]
-				`,
-			},
-			storageRes: &storageRes{
-				err: nil,
-				withdraws: []model.Withdrawn{
-					{
-						ID:        1,
-						UserID:    1,
-						Number:    "2377225624",
-						Sum:       500,
-						CreatedAt: time.Date(2020, 12, 9, 16, 9, 57, 0, time.Local),
-					},
-				},
-			},
+			name:           "Ответ сжимается",
+			cfg:            middleware.CompressorCfg{MinSize: 10, Level: gzip.BestSpeed, ContentTypes: []string{"application/json"}},
+			acceptEncoding: "gzip",
+			wantGzip:       true,
 		},
 		{
-			name: "Нет данных",
-			request: request{
-				isAuth: true,
-			},
-			want: want{
-				statusCode: http.StatusNoContent,
-				body:       "",
-			},
-			storageRes: &storageRes{
-				err:       nil,
-				withdraws: []model.Withdrawn{},
-			},
+			name:           "Ответ меньше минимального размера",
+			cfg:            middleware.CompressorCfg{MinSize: 1024, Level: gzip.BestSpeed, ContentTypes: []string{"application/json"}},
+			acceptEncoding: "gzip",
+			wantGzip:       false,
 		},
 		{
-			name: "Неавторизованный запрос",
-			request: request{
-				isAuth: false,
-			},
-			want: want{
-				statusCode: http.StatusUnauthorized,
-				body:       "",
-			},
-			storageRes: nil,
+			name:           "Тип содержимого не сжимается",
+			cfg:            middleware.CompressorCfg{MinSize: 10, Level: gzip.BestSpeed, ContentTypes: []string{"text/*"}},
+			acceptEncoding: "gzip",
+			wantGzip:       false,
+		},
+		{
+			name:           "Клиент не поддерживает сжатие",
+			cfg:            middleware.CompressorCfg{MinSize: 10, Level: gzip.BestSpeed, ContentTypes: []string{"application/json"}},
+			acceptEncoding: "",
+			wantGzip:       false,
 		},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			req := httptest.NewRequest(http.MethodGet, "/api/user/withdrawals", nil)
+			compressor, err := middleware.NewCompressor(tt.cfg)
+			require.NoError(t, err)
+			router := NewRouter(mockStorage, RouterCfg{Compressor: compressor})
 
-			if tt.request.isAuth {
-				jwtString, err := utils.BuildJWTSting(model.User{ID: 1, Login: "testuser"})
-				require.NoError(t, err)
-				req.AddCookie(&http.Cookie{Name: middleware.JWTCookieName, Value: jwtString})
-			}
+			mockStorage.EXPECT().
+				GetUserBalance(gomock.Any(), 1).
+				Return(&model.Balance{Current: model.MoneyFromFloat(500.5), Withdrawn: model.MoneyFromFloat(42)}, nil).
+				Times(1)
 
+			req := httptest.NewRequest(http.MethodGet, "/api/user/balance", nil)
+			req.Header.Set("Accept-Encoding", tt.acceptEncoding)
+			req.AddCookie(&http.Cookie{Name: middleware.JWTCookieName, Value: jwtString})
 			w := httptest.NewRecorder()
 
-			if tt.storageRes != nil {
-				mockStorage.EXPECT().
-					GetWithdrawals(gomock.Any(), 1).
-					Return(tt.storageRes.withdraws, tt.storageRes.err).
-					Times(1)
-			} else {
-				mockStorage.EXPECT().
-					GetWithdrawals(gomock.Any(), 1).Times(0)
-			}
-
 			router.ServeHTTP(w, req)
 
 			resp := w.Result()
 			defer resp.Body.Close()
 
-			assert.Equal(t, tt.want.statusCode, resp.StatusCode)
-
-			if tt.want.body != "" {
-				resBody, readErr := io.ReadAll(resp.Body)
-				require.NoError(t, readErr)
-				assert.JSONEq(t, tt.want.body, string(resBody))
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+			body := io.Reader(resp.Body)
+			if tt.wantGzip {
+				assert.Equal(t, "gzip", resp.Header.Get("Content-Encoding"))
+				gz, gzErr := gzip.NewReader(resp.Body)
+				require.NoError(t, gzErr)
+				defer gz.Close()
+				body = gz
+			} else {
+				assert.Empty(t, resp.Header.Get("Content-Encoding"))
 			}
+			resBody, err := io.ReadAll(body)
+			require.NoError(t, err)
+			assert.JSONEq(t, `{"current": 500.5, "withdrawn": 42}`, string(resBody))
 		})
 	}
 }
@@ -0,0 +1,125 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/pinbrain/gophermart/internal/appctx"
+	"github.com/pinbrain/gophermart/internal/logger"
+	"github.com/pinbrain/gophermart/internal/model"
+	"github.com/pinbrain/gophermart/internal/storage"
+	"github.com/pinbrain/gophermart/internal/utils"
+)
+
+func isValidWebhookURL(rawURL string) bool {
+	u, err := url.ParseRequestURI(rawURL)
+	if err != nil {
+		return false
+	}
+	return (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// CreateWebhook регистрирует адрес, на который отправляются события пользователя.
+// Ключ подписи событий возвращается только в ответе на этот запрос.
+func (h *UserHandler) CreateWebhook(w http.ResponseWriter, r *http.Request) {
+	contentType := r.Header.Get("Content-Type")
+	if !strings.Contains(contentType, "application/json") {
+		http.Error(w, "Некорректный Content-Type", http.StatusBadRequest)
+		return
+	}
+
+	var req model.WebhookReq
+	dec := json.NewDecoder(r.Body)
+	if err := dec.Decode(&req); err != nil {
+		logger.Log.WithError(err).Debug("failed to decode create webhook req body")
+		http.Error(w, "Некорректный формат запроса", http.StatusBadRequest)
+		return
+	}
+	if !isValidWebhookURL(req.URL) {
+		http.Error(w, "Некорректный адрес webhook", http.StatusBadRequest)
+		return
+	}
+	if len(req.Events) == 0 {
+		http.Error(w, "Не указаны типы событий", http.StatusBadRequest)
+		return
+	}
+	events := make([]model.WebhookEventType, 0, len(req.Events))
+	seen := make(map[model.WebhookEventType]bool, len(req.Events))
+	for _, event := range req.Events {
+		if !event.IsValid() {
+			http.Error(w, "Неизвестный тип события: "+string(event), http.StatusBadRequest)
+			return
+		}
+		if !seen[event] {
+			seen[event] = true
+			events = append(events, event)
+		}
+	}
+
+	secret, err := utils.GenerateWebhookSecret()
+	if err != nil {
+		logger.Log.WithError(err).Error("failed to generate webhook secret")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	user := appctx.GetCtxUser(r.Context())
+	webhook, err := h.storage.CreateWebhook(r.Context(), user.ID, req.URL, events, secret)
+	if err != nil {
+		logger.Log.WithError(err).Error("failed to create webhook")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	enc := json.NewEncoder(w)
+	if err = enc.Encode(webhook); err != nil {
+		logger.Log.WithError(err).Error("Error in encoding webhook response to json")
+	}
+}
+
+// GetWebhooks возвращает зарегистрированные webhooks пользователя
+func (h *UserHandler) GetWebhooks(w http.ResponseWriter, r *http.Request) {
+	user := appctx.GetCtxUser(r.Context())
+	webhooks, err := h.storage.GetWebhooks(r.Context(), user.ID)
+	if err != nil {
+		logger.Log.WithError(err).Error("failed to read user webhooks")
+		http.Error(w, "Не удалось получить webhooks", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if len(webhooks) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	enc := json.NewEncoder(w)
+	if err = enc.Encode(webhooks); err != nil {
+		logger.Log.WithError(err).Error("Error in encoding user webhooks response to json")
+	}
+}
+
+// DeleteWebhook удаляет webhook пользователя, недоставленные события на него больше не отправляются
+func (h *UserHandler) DeleteWebhook(w http.ResponseWriter, r *http.Request) {
+	webhookID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "Некорректный id webhook", http.StatusBadRequest)
+		return
+	}
+	user := appctx.GetCtxUser(r.Context())
+	if err = h.storage.DeleteWebhook(r.Context(), user.ID, webhookID); err != nil {
+		if errors.Is(err, storage.ErrNoWebhook) {
+			http.Error(w, "Webhook не найден", http.StatusNotFound)
+			return
+		}
+		logger.Log.WithError(err).Error("failed to delete webhook")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
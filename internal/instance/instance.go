@@ -0,0 +1,21 @@
+package instance
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"os"
+)
+
+// NewID возвращает идентификатор запущенного экземпляра сервиса в виде <hostname>-<случайный суффикс>,
+// чтобы различать несколько реплик, запущенных на одном хосте или из одного образа
+func NewID() string {
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		hostname = "gophermart"
+	}
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return hostname
+	}
+	return hostname + "-" + hex.EncodeToString(suffix)
+}
@@ -4,7 +4,21 @@ import "github.com/sirupsen/logrus"
 
 var Log = logrus.New()
 
-func Initialize(level string) error {
+// instanceHook добавляет идентификатор экземпляра сервиса в каждую запись лога
+type instanceHook struct {
+	instanceID string
+}
+
+func (h instanceHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (h instanceHook) Fire(entry *logrus.Entry) error {
+	entry.Data["instance"] = h.instanceID
+	return nil
+}
+
+func Initialize(level string, instanceID string) error {
 	var err error
 	logLvl := logrus.InfoLevel
 	if level != "" {
@@ -15,5 +29,8 @@ func Initialize(level string) error {
 	}
 	Log.SetLevel(logLvl)
 	Log.SetFormatter(&logrus.JSONFormatter{})
+	if instanceID != "" {
+		Log.AddHook(instanceHook{instanceID: instanceID})
+	}
 	return nil
 }
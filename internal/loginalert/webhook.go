@@ -0,0 +1,45 @@
+package loginalert
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/pinbrain/gophermart/internal/model"
+)
+
+const webhookTimeout = 5 * time.Second
+
+// Webhook отправляет уведомления о подозрительных входах POST-запросом с JSON на заданный адрес
+type Webhook struct {
+	url    string
+	client *http.Client
+}
+
+func NewWebhook(url string) *Webhook {
+	return &Webhook{url: url, client: &http.Client{Timeout: webhookTimeout}}
+}
+
+func (wh *Webhook) NotifySuspiciousLogin(ctx context.Context, event model.SuspiciousLoginEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to encode suspicious login event: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, wh.url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to build login alert webhook request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := wh.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send login alert webhook: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("login alert webhook returned status %d", resp.StatusCode)
+	}
+	return nil
+}
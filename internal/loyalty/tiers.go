@@ -0,0 +1,92 @@
+package loyalty
+
+import (
+	"errors"
+	"math"
+	"sort"
+
+	"github.com/pinbrain/gophermart/internal/model"
+)
+
+var ErrInvalidLevels = errors.New("invalid loyalty levels")
+
+// Level - уровень программы лояльности
+type Level struct {
+	Tier model.LoyaltyTier
+	// Сумма начислений за все время, начиная с которой действует уровень
+	Threshold model.Money
+	// Коэффициент, на который умножаются начисления по заказам пользователя этого уровня
+	Multiplier float64
+}
+
+// Tiers определяет уровень пользователя по сумме его начислений за все время.
+// Методы безопасно вызывать у nil, в этом случае у всех пользователей базовый уровень без повышения начислений.
+type Tiers struct {
+	// Уровни по возрастанию порога, у первого порог нулевой
+	levels []Level
+}
+
+func NewTiers(levels []Level) (*Tiers, error) {
+	if len(levels) == 0 {
+		return nil, ErrInvalidLevels
+	}
+	sorted := make([]Level, len(levels))
+	copy(sorted, levels)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Threshold < sorted[j].Threshold })
+	if sorted[0].Threshold != 0 {
+		return nil, ErrInvalidLevels
+	}
+	for i, level := range sorted {
+		if level.Multiplier < 1 || (i > 0 && level.Threshold == sorted[i-1].Threshold) {
+			return nil, ErrInvalidLevels
+		}
+	}
+	return &Tiers{levels: sorted}, nil
+}
+
+// DefaultLevels возвращает уровни BRONZE, SILVER и GOLD с заданными порогами и коэффициентами
+func DefaultLevels(silverThreshold, goldThreshold model.Money, silverMultiplier, goldMultiplier float64) []Level {
+	return []Level{
+		{Tier: model.TierBronze, Threshold: 0, Multiplier: 1},
+		{Tier: model.TierSilver, Threshold: silverThreshold, Multiplier: silverMultiplier},
+		{Tier: model.TierGold, Threshold: goldThreshold, Multiplier: goldMultiplier},
+	}
+}
+
+// index возвращает номер уровня пользователя с суммой начислений lifetime
+func (t *Tiers) index(lifetime model.Money) int {
+	i := sort.Search(len(t.levels), func(i int) bool { return t.levels[i].Threshold > lifetime })
+	return i - 1
+}
+
+// For возвращает уровень пользователя с суммой начислений за все время lifetime
+func (t *Tiers) For(lifetime model.Money) Level {
+	if t == nil {
+		return Level{Tier: model.TierBronze, Multiplier: 1}
+	}
+	return t.levels[t.index(lifetime)]
+}
+
+// Info возвращает уровень пользователя и его прогресс до следующего уровня
+func (t *Tiers) Info(lifetime model.Money) model.TierInfo {
+	level := t.For(lifetime)
+	info := model.TierInfo{
+		Tier:            level.Tier,
+		Multiplier:      level.Multiplier,
+		LifetimeAccrual: lifetime,
+		Progress:        1,
+	}
+	if t == nil {
+		return info
+	}
+	i := t.index(lifetime)
+	if i+1 < len(t.levels) {
+		next := t.levels[i+1]
+		info.NextTier = next.Tier
+		info.NextThreshold = next.Threshold
+		info.Remaining = next.Threshold - lifetime
+		progress := float64(lifetime-level.Threshold) / float64(next.Threshold-level.Threshold)
+		info.Progress = math.Round(progress*10000) / 10000
+	}
+	return info
+}
@@ -0,0 +1,24 @@
+package mailer
+
+import (
+	"context"
+
+	"github.com/pinbrain/gophermart/internal/logger"
+	"github.com/sirupsen/logrus"
+)
+
+// LogMailer не отправляет письма, а пишет их в лог. Используется, если SMTP не настроен.
+type LogMailer struct{}
+
+func NewLogMailer() *LogMailer {
+	return &LogMailer{}
+}
+
+func (m *LogMailer) Send(_ context.Context, to, subject, body string) error {
+	logger.Log.WithFields(logrus.Fields{
+		"to":      to,
+		"subject": subject,
+		"body":    body,
+	}).Info("Email is not sent, smtp is not configured")
+	return nil
+}
@@ -0,0 +1,59 @@
+package mailer
+
+import (
+	"context"
+	"fmt"
+	"mime"
+	"net"
+	"net/smtp"
+	"strings"
+)
+
+type SMTPCfg struct {
+	// Адрес SMTP-сервера вида host:port
+	Addr string
+	// Адрес отправителя
+	From string
+	// Учетные данные, пустое имя - без аутентификации
+	User     string
+	Password string
+}
+
+// SMTPMailer отправляет письма через SMTP-сервер
+type SMTPMailer struct {
+	cfg  SMTPCfg
+	auth smtp.Auth
+}
+
+func NewSMTPMailer(cfg SMTPCfg) (*SMTPMailer, error) {
+	host, _, err := net.SplitHostPort(cfg.Addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid smtp address: %w", err)
+	}
+	m := &SMTPMailer{cfg: cfg}
+	if cfg.User != "" {
+		m.auth = smtp.PlainAuth("", cfg.User, cfg.Password, host)
+	}
+	return m, nil
+}
+
+// Send отправляет текстовое письмо. net/smtp не поддерживает контекст, поэтому
+// отмена учитывается только до начала отправки.
+func (m *SMTPMailer) Send(ctx context.Context, to, subject, body string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	var msg strings.Builder
+	msg.WriteString("From: " + m.cfg.From + "\r\n")
+	msg.WriteString("To: " + to + "\r\n")
+	msg.WriteString("Subject: " + mime.QEncoding.Encode("utf-8", subject) + "\r\n")
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	msg.WriteString("\r\n")
+	msg.WriteString(body)
+
+	if err := smtp.SendMail(m.cfg.Addr, m.auth, m.cfg.From, []string{to}, []byte(msg.String())); err != nil {
+		return fmt.Errorf("failed to send email: %w", err)
+	}
+	return nil
+}
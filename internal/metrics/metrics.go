@@ -0,0 +1,28 @@
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	registry = prometheus.NewRegistry()
+	// Registerer регистрирует метрики сервиса с меткой экземпляра сервиса
+	Registerer prometheus.Registerer = registry
+)
+
+func Initialize(instanceID string) error {
+	Registerer = prometheus.WrapRegistererWith(prometheus.Labels{"instance_id": instanceID}, registry)
+	if err := Registerer.Register(collectors.NewGoCollector()); err != nil {
+		return err
+	}
+	return Registerer.Register(collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+}
+
+// Handler отдает метрики в формате Prometheus
+func Handler() http.Handler {
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+}
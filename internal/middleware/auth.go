@@ -1,28 +1,61 @@
 package middleware
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"net/http"
+	"strings"
+	"time"
 
 	"github.com/pinbrain/gophermart/internal/appctx"
+	"github.com/pinbrain/gophermart/internal/logger"
+	"github.com/pinbrain/gophermart/internal/revocation"
+	"github.com/pinbrain/gophermart/internal/session"
 	"github.com/pinbrain/gophermart/internal/utils"
 )
 
 const (
-	JWTCookieName = "gophermart_jwt"
+	JWTCookieName     = "gophermart_jwt"
+	SessionCookieName = "gophermart_session"
+	RefreshCookieName = "gophermart_refresh"
+	// Токен обновления отправляется браузером только в запросах обновления и выхода
+	refreshCookiePath = "/api/user"
+	// Состояние входа через внешнего провайдера нужно только обработчикам /api/user/oauth
+	OAuthCookieName = "gophermart_oauth"
+	oauthCookiePath = "/api/user/oauth"
+
+	// Как часто обновляется момент последнего запроса в рамках сессии
+	sessionTouchInterval = time.Minute
 )
 
-func newCookie(name, value string) *http.Cookie {
-	cookie := http.Cookie{
-		Name:     name,
-		Value:    value,
-		Path:     "/",
-		HttpOnly: true,
+// TokenVersions возвращает текущую версию токенов пользователя
+type TokenVersions interface {
+	GetTokenVersion(ctx context.Context, userID int) (int, error)
+}
+
+type UserAuthCfg struct {
+	// Список отозванных JWT, nil - отзыв токенов не проверяется
+	Revocations revocation.Store
+	// Версии токенов пользователей: JWT, выпущенные до смены пароля, не принимаются. nil - версия не проверяется.
+	TokenVersions TokenVersions
+	// Хранилище серверных сессий. Если задано, вместо JWT пользователь передает идентификатор сессии.
+	Sessions session.Store
+	// Срок действия серверной сессии
+	SessionTTL time.Duration
+}
+
+// CookieName возвращает имя cookie, в которой передается токен пользователя
+func (cfg UserAuthCfg) CookieName() string {
+	if cfg.Sessions != nil {
+		return SessionCookieName
 	}
-	return &cookie
+	return JWTCookieName
 }
 
 func SetJWTCookie(w http.ResponseWriter, value string) {
 	cookie := newCookie(JWTCookieName, value)
+	cookie.MaxAge = int(cookieCfg.MaxAge.Seconds())
 	http.SetCookie(w, cookie)
 }
 
@@ -32,25 +65,149 @@ func DeleteJWTCookie(w http.ResponseWriter) {
 	http.SetCookie(w, cookie)
 }
 
-func RequireUser(h http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		jwtCookie, err := r.Cookie(JWTCookieName)
+func SetSessionCookie(w http.ResponseWriter, value string, maxAge time.Duration) {
+	cookie := newCookie(SessionCookieName, value)
+	cookie.MaxAge = int(maxAge.Seconds())
+	http.SetCookie(w, cookie)
+}
+
+func DeleteSessionCookie(w http.ResponseWriter) {
+	cookie := newCookie(SessionCookieName, "")
+	cookie.MaxAge = -1
+	http.SetCookie(w, cookie)
+}
+
+func SetRefreshCookie(w http.ResponseWriter, value string, maxAge time.Duration) {
+	cookie := newCookie(RefreshCookieName, value)
+	cookie.Path = refreshCookiePath
+	cookie.MaxAge = int(maxAge.Seconds())
+	http.SetCookie(w, cookie)
+}
+
+func DeleteRefreshCookie(w http.ResponseWriter) {
+	cookie := newCookie(RefreshCookieName, "")
+	cookie.Path = refreshCookiePath
+	cookie.MaxAge = -1
+	http.SetCookie(w, cookie)
+}
+
+// SetOAuthCookie сохраняет состояние входа через внешнего провайдера до возврата пользователя от него
+func SetOAuthCookie(w http.ResponseWriter, value string, maxAge time.Duration) {
+	cookie := newCookie(OAuthCookieName, value)
+	cookie.Path = oauthCookiePath
+	cookie.MaxAge = int(maxAge.Seconds())
+	// Пользователь возвращается от провайдера переходом с другого сайта, при SameSite=Strict
+	// браузер не передал бы cookie
+	if cookie.SameSite == http.SameSiteStrictMode {
+		cookie.SameSite = http.SameSiteLaxMode
+	}
+	http.SetCookie(w, cookie)
+}
+
+func DeleteOAuthCookie(w http.ResponseWriter) {
+	cookie := newCookie(OAuthCookieName, "")
+	cookie.Path = oauthCookiePath
+	cookie.MaxAge = -1
+	http.SetCookie(w, cookie)
+}
+
+// UserToken возвращает токен пользователя из заголовка Authorization: Bearer <token> или, если
+// заголовка нет, из cookie cookieName. ok - false, если заголовок передан в неподдерживаемой схеме.
+func UserToken(r *http.Request, cookieName string) (token string, fromCookie bool, ok bool) {
+	if authHeader := r.Header.Get("Authorization"); authHeader != "" {
+		if !strings.HasPrefix(authHeader, bearerPrefix) {
+			return "", false, false
+		}
+		return strings.TrimPrefix(authHeader, bearerPrefix), false, true
+	}
+	cookie, err := r.Cookie(cookieName)
+	if err != nil {
+		return "", false, true
+	}
+	return cookie.Value, true, true
+}
+
+// RequireUser пропускает только запросы пользователя с действующей серверной сессией или,
+// если сессии не используются, с валидным и не отозванным JWT (см. UserToken)
+func RequireUser(cfg UserAuthCfg) func(http.Handler) http.Handler {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			token, fromCookie, ok := UserToken(r, cfg.CookieName())
+			if !ok || token == "" {
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+			var ctxUser *appctx.CtxUser
+			var err error
+			if cfg.Sessions != nil {
+				ctxUser, err = sessionUser(r.Context(), cfg.Sessions, token)
+			} else {
+				ctxUser, err = jwtUser(r.Context(), cfg, token)
+			}
+			if err != nil {
+				if !errors.Is(err, errUnauthorized) {
+					logger.Log.WithError(err).Error("failed to authenticate user")
+					http.Error(w, "Internal server error", http.StatusInternalServerError)
+					return
+				}
+				if fromCookie && cfg.Sessions != nil {
+					DeleteSessionCookie(w)
+				} else if fromCookie {
+					DeleteJWTCookie(w)
+				}
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+			r = r.WithContext(appctx.CtxWithUser(r.Context(), ctxUser))
+			h.ServeHTTP(w, r)
+		})
+	}
+}
+
+var errUnauthorized = errors.New("unauthorized")
+
+func jwtUser(ctx context.Context, cfg UserAuthCfg, jwtString string) (*appctx.CtxUser, error) {
+	jwtClaims, err := utils.GetJWTClaims(jwtString)
+	if err != nil {
+		return nil, errUnauthorized
+	}
+	if cfg.TokenVersions != nil {
+		tokenVersion, err := cfg.TokenVersions.GetTokenVersion(ctx, jwtClaims.UserID)
 		if err != nil {
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
-			return
+			return nil, fmt.Errorf("failed to check jwt version: %w", err)
 		}
-		jwtClaims, err := utils.GetJWTClaims(jwtCookie.Value)
+		if tokenVersion != jwtClaims.TokenVersion {
+			return nil, errUnauthorized
+		}
+	}
+	if cfg.Revocations != nil {
+		revoked, err := cfg.Revocations.IsTokenRevoked(ctx, jwtClaims.ID)
 		if err != nil {
-			DeleteJWTCookie(w)
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
-			return
+			return nil, fmt.Errorf("failed to check jwt revocation: %w", err)
 		}
-		ctx := r.Context()
-		ctx = appctx.CtxWithUser(ctx, &appctx.CtxUser{
-			ID:    jwtClaims.UserID,
-			Login: jwtClaims.Login,
-		})
-		r = r.WithContext(ctx)
-		h.ServeHTTP(w, r)
-	})
+		if revoked {
+			return nil, errUnauthorized
+		}
+	}
+	ctxUser := &appctx.CtxUser{ID: jwtClaims.UserID, Login: jwtClaims.Login}
+	if jwtClaims.ElevatedUntil != nil {
+		ctxUser.ElevatedUntil = jwtClaims.ElevatedUntil.Time
+	}
+	return ctxUser, nil
+}
+
+func sessionUser(ctx context.Context, sessions session.Store, sessionID string) (*appctx.CtxUser, error) {
+	s, err := sessions.GetSession(ctx, sessionID)
+	if err != nil {
+		if errors.Is(err, session.ErrNoSession) {
+			return nil, errUnauthorized
+		}
+		return nil, err
+	}
+	if now := time.Now(); now.Sub(s.LastSeenAt) > sessionTouchInterval {
+		if err = sessions.TouchSession(ctx, sessionID, now); err != nil {
+			logger.Log.WithError(err).Error("failed to touch user session")
+		}
+	}
+	return &appctx.CtxUser{ID: s.UserID, Login: s.Login, SessionID: sessionID, ElevatedUntil: s.ElevatedUntil}, nil
 }
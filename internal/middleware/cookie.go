@@ -0,0 +1,64 @@
+package middleware
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+type CookieCfg struct {
+	// Передавать cookie только по HTTPS. Включается, если TLS завершается на балансировщике.
+	Secure bool
+	// Атрибут SameSite, http.SameSiteDefaultMode - атрибут не передается
+	SameSite http.SameSite
+	// Домен cookie, например .example.com для фронтендов на поддоменах. Пустой - только текущий хост.
+	Domain string
+	// Время жизни cookie с JWT, 0 - cookie удаляется при закрытии браузера. Время жизни cookie
+	// сессии и токена обновления совпадает со сроком их действия.
+	MaxAge time.Duration
+}
+
+var cookieCfg CookieCfg
+
+// ConfigureCookies задает атрибуты cookie с токенами пользователей, вызывается при запуске сервиса
+func ConfigureCookies(cfg CookieCfg) error {
+	if cfg.SameSite == http.SameSiteNoneMode && !cfg.Secure {
+		return errors.New("samesite=none cookies must be secure")
+	}
+	if cfg.MaxAge < 0 {
+		return errors.New("cookie max age must not be negative")
+	}
+	cookieCfg = cfg
+	return nil
+}
+
+// ParseSameSite разбирает значение атрибута SameSite: lax, strict, none или пустую строку
+func ParseSameSite(value string) (http.SameSite, error) {
+	switch strings.ToLower(value) {
+	case "":
+		return http.SameSiteDefaultMode, nil
+	case "lax":
+		return http.SameSiteLaxMode, nil
+	case "strict":
+		return http.SameSiteStrictMode, nil
+	case "none":
+		return http.SameSiteNoneMode, nil
+	default:
+		return 0, fmt.Errorf("unknown samesite value %q", value)
+	}
+}
+
+func newCookie(name, value string) *http.Cookie {
+	cookie := http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     "/",
+		Domain:   cookieCfg.Domain,
+		Secure:   cookieCfg.Secure,
+		HttpOnly: true,
+		SameSite: cookieCfg.SameSite,
+	}
+	return &cookie
+}
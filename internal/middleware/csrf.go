@@ -0,0 +1,64 @@
+package middleware
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+)
+
+const (
+	CSRFCookieName = "gophermart_csrf"
+	CSRFHeaderName = "X-CSRF-Token"
+
+	csrfTokenSize = 32
+)
+
+// NewCSRFToken генерирует случайный CSRF-токен
+func NewCSRFToken() (string, error) {
+	b := make([]byte, csrfTokenSize)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate csrf token: %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// SetCSRFCookie сохраняет CSRF-токен в cookie, доступной скриптам фронтенда: они передают
+// ее значение в заголовке X-CSRF-Token
+func SetCSRFCookie(w http.ResponseWriter, token string) {
+	cookie := newCookie(CSRFCookieName, token)
+	cookie.HttpOnly = false
+	http.SetCookie(w, cookie)
+}
+
+// RequireCSRFToken защищает изменяющие запросы с аутентификацией по cookie от CSRF по схеме
+// double-submit: значение заголовка X-CSRF-Token должно совпадать с cookie gophermart_csrf.
+// Сторонний сайт может заставить браузер отправить cookie, но не может прочитать ее и передать
+// в заголовке. Запросы с заголовком Authorization не проверяются, браузер не подставляет его сам.
+func RequireCSRFToken(enabled bool) func(http.Handler) http.Handler {
+	return func(h http.Handler) http.Handler {
+		if !enabled {
+			return h
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.Method {
+			case http.MethodGet, http.MethodHead, http.MethodOptions:
+				h.ServeHTTP(w, r)
+				return
+			}
+			if r.Header.Get("Authorization") != "" {
+				h.ServeHTTP(w, r)
+				return
+			}
+			cookie, err := r.Cookie(CSRFCookieName)
+			header := r.Header.Get(CSRFHeaderName)
+			if err != nil || cookie.Value == "" || header == "" ||
+				subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(header)) != 1 {
+				http.Error(w, "Некорректный CSRF-токен", http.StatusForbidden)
+				return
+			}
+			h.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,24 @@
+package middleware
+
+import (
+	"net/http"
+
+	"github.com/pinbrain/gophermart/internal/faults"
+)
+
+// FaultInjection вносит искусственные задержки и ошибки в обработку запросов.
+// При injector == nil сбои не вносятся.
+func FaultInjection(injector *faults.Injector) func(http.Handler) http.Handler {
+	return func(h http.Handler) http.Handler {
+		if injector == nil {
+			return h
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if err := injector.Inject(r.Context()); err != nil {
+				http.Error(w, "Injected fault", http.StatusServiceUnavailable)
+				return
+			}
+			h.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,199 @@
+package middleware
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/pinbrain/gophermart/internal/logger"
+)
+
+type CompressorCfg struct {
+	// Минимальный размер ответа в байтах, начиная с которого он сжимается
+	MinSize int
+	// Уровень сжатия gzip (от gzip.HuffmanOnly до gzip.BestCompression)
+	Level int
+	// Сжимаемые типы содержимого, допускается маска вида text/*
+	ContentTypes []string
+}
+
+// Compressor сжимает ответы gzip, если клиент это поддерживает, а ответ подходит по размеру и типу.
+// Методы безопасно вызывать у nil, в этом случае ответы не сжимаются.
+type Compressor struct {
+	cfg     CompressorCfg
+	writers sync.Pool
+}
+
+func NewCompressor(cfg CompressorCfg) (*Compressor, error) {
+	if _, err := gzip.NewWriterLevel(io.Discard, cfg.Level); err != nil {
+		return nil, fmt.Errorf("invalid gzip compression level: %w", err)
+	}
+	contentTypes := make([]string, 0, len(cfg.ContentTypes))
+	for _, contentType := range cfg.ContentTypes {
+		if contentType = strings.TrimSpace(contentType); contentType != "" {
+			contentTypes = append(contentTypes, contentType)
+		}
+	}
+	cfg.ContentTypes = contentTypes
+	c := &Compressor{cfg: cfg}
+	c.writers.New = func() any {
+		// Уровень проверен выше, ошибки быть не может
+		gz, _ := gzip.NewWriterLevel(io.Discard, cfg.Level)
+		return gz
+	}
+	return c, nil
+}
+
+func (c *Compressor) compressible(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, allowed := range c.cfg.ContentTypes {
+		if allowed == mediaType {
+			return true
+		}
+		if prefix, ok := strings.CutSuffix(allowed, "/*"); ok && strings.HasPrefix(mediaType, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// Handler сжимает ответы обработчика
+func (c *Compressor) Handler(h http.Handler) http.Handler {
+	if c == nil {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+			h.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Add("Vary", "Accept-Encoding")
+		cw := &compressWriter{ResponseWriter: w, compressor: c}
+		defer cw.close()
+		h.ServeHTTP(cw, r)
+	})
+}
+
+// compressWriter накапливает начало ответа, пока не станет ясно, нужно ли его сжимать
+type compressWriter struct {
+	http.ResponseWriter
+	compressor *Compressor
+
+	status  int
+	buf     []byte
+	decided bool
+	gz      *gzip.Writer
+}
+
+func (cw *compressWriter) WriteHeader(statusCode int) {
+	if cw.decided || cw.status != 0 {
+		return
+	}
+	cw.status = statusCode
+	// У ответов без тела сжимать нечего
+	if statusCode < http.StatusOK || statusCode == http.StatusNoContent || statusCode == http.StatusNotModified {
+		cw.decide()
+	}
+}
+
+func (cw *compressWriter) Write(b []byte) (int, error) {
+	if !cw.decided {
+		cw.buf = append(cw.buf, b...)
+		if len(cw.buf) < cw.compressor.cfg.MinSize {
+			return len(b), nil
+		}
+		if err := cw.decide(); err != nil {
+			return 0, err
+		}
+		return len(b), nil
+	}
+	if cw.gz != nil {
+		return cw.gz.Write(b)
+	}
+	return cw.ResponseWriter.Write(b)
+}
+
+// Unwrap позволяет http.ResponseController добраться до исходного ResponseWriter (например, для Hijack)
+func (cw *compressWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
+
+// Flush отправляет клиенту уже записанную часть ответа
+func (cw *compressWriter) Flush() {
+	if !cw.decided {
+		if err := cw.decide(); err != nil {
+			return
+		}
+	}
+	if cw.gz != nil {
+		if err := cw.gz.Flush(); err != nil {
+			return
+		}
+	}
+	if f, ok := cw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// decide выбирает, сжимать ли ответ, отправляет заголовки и накопленную часть тела
+func (cw *compressWriter) decide() error {
+	cw.decided = true
+	header := cw.Header()
+	if cw.status == 0 {
+		cw.status = http.StatusOK
+	}
+	if header.Get("Content-Type") == "" && len(cw.buf) > 0 {
+		header.Set("Content-Type", http.DetectContentType(cw.buf))
+	}
+
+	if header.Get("Content-Encoding") == "" &&
+		len(cw.buf) > 0 && len(cw.buf) >= cw.compressor.cfg.MinSize &&
+		cw.compressor.compressible(header.Get("Content-Type")) {
+		header.Set("Content-Encoding", "gzip")
+		header.Del("Content-Length")
+		cw.gz = cw.compressor.writers.Get().(*gzip.Writer)
+		cw.gz.Reset(cw.ResponseWriter)
+	}
+
+	cw.ResponseWriter.WriteHeader(cw.status)
+	buf := cw.buf
+	cw.buf = nil
+	if len(buf) == 0 {
+		return nil
+	}
+	var err error
+	if cw.gz != nil {
+		_, err = cw.gz.Write(buf)
+	} else {
+		_, err = cw.ResponseWriter.Write(buf)
+	}
+	return err
+}
+
+func (cw *compressWriter) close() {
+	if !cw.decided {
+		// Обработчик ничего не записал, ответ отправит сервер
+		if cw.status == 0 && len(cw.buf) == 0 {
+			return
+		}
+		if err := cw.decide(); err != nil {
+			logger.Log.WithError(err).Error("failed to write response")
+			return
+		}
+	}
+	if cw.gz == nil {
+		return
+	}
+	if err := cw.gz.Close(); err != nil {
+		logger.Log.WithError(err).Error("failed to finish gzip response")
+	}
+	cw.compressor.writers.Put(cw.gz)
+	cw.gz = nil
+}
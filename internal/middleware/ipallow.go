@@ -0,0 +1,118 @@
+package middleware
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+type IPAllowlistCfg struct {
+	// Подсети (или отдельные адреса), из которых разрешен доступ
+	Allowed []string
+	// Подсети прокси и балансировщиков, которым доверяется заголовок X-Forwarded-For.
+	// Без них заголовок игнорируется, иначе клиент мог бы подставить в него любой адрес.
+	TrustedProxies []string
+}
+
+// IPAllowlist пропускает к группе маршрутов только запросы из разрешенных подсетей.
+// Методы безопасно вызывать у nil, в этом случае доступ не ограничивается.
+type IPAllowlist struct {
+	allowed        []netip.Prefix
+	trustedProxies []netip.Prefix
+}
+
+func NewIPAllowlist(cfg IPAllowlistCfg) (*IPAllowlist, error) {
+	allowed, err := ParsePrefixes(cfg.Allowed)
+	if err != nil {
+		return nil, fmt.Errorf("invalid allowed subnets: %w", err)
+	}
+	trustedProxies, err := ParsePrefixes(cfg.TrustedProxies)
+	if err != nil {
+		return nil, fmt.Errorf("invalid trusted proxies: %w", err)
+	}
+	return &IPAllowlist{allowed: allowed, trustedProxies: trustedProxies}, nil
+}
+
+// ParsePrefixes разбирает список подсетей в нотации CIDR, отдельный адрес считается подсетью из одного адреса
+func ParsePrefixes(list []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(list))
+	for _, s := range list {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if !strings.Contains(s, "/") {
+			addr, err := netip.ParseAddr(s)
+			if err != nil {
+				return nil, err
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+func containsAddr(prefixes []netip.Prefix, addr netip.Addr) bool {
+	for _, prefix := range prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientAddr возвращает адрес клиента. Если запрос пришел от доверенного прокси, адрес берется
+// из X-Forwarded-For: справа налево пропускаются доверенные прокси, первый прочий адрес - клиент.
+func (a *IPAllowlist) clientAddr(r *http.Request) (netip.Addr, bool) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	addr = addr.Unmap()
+	if !containsAddr(a.trustedProxies, addr) {
+		return addr, true
+	}
+
+	var hops []string
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(header, ",")...)
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+		if err != nil {
+			return netip.Addr{}, false
+		}
+		addr = hop.Unmap()
+		if !containsAddr(a.trustedProxies, addr) {
+			return addr, true
+		}
+	}
+	return addr, true
+}
+
+// Handler пропускает только запросы из разрешенных подсетей
+func (a *IPAllowlist) Handler(h http.Handler) http.Handler {
+	if a == nil {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		addr, ok := a.clientAddr(r)
+		if !ok || !containsAddr(a.allowed, addr) {
+			http.Error(w, "Доступ запрещен", http.StatusForbidden)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,117 @@
+package middleware
+
+import (
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// Количество последних запросов, по которым считается p99 времени ответа
+	latencyWindowSize = 1000
+	// Как часто пересчитывается p99
+	latencyRecalcInterval = time.Second
+)
+
+type LoadShedderCfg struct {
+	// Максимальное количество одновременно обрабатываемых запросов (0 - не ограничено)
+	MaxInFlight int64
+	// Максимальное p99 времени ответа (0 - не ограничено)
+	MaxP99 time.Duration
+	// Значение заголовка Retry-After для отброшенных запросов
+	RetryAfter time.Duration
+}
+
+// LoadShedder отслеживает нагрузку на сервис и при перегрузке отбрасывает низкоприоритетные запросы.
+// Методы безопасно вызывать у nil, в этом случае запросы не отбрасываются.
+type LoadShedder struct {
+	cfg LoadShedderCfg
+
+	inFlight atomic.Int64
+
+	mu          sync.Mutex
+	latencies   []time.Duration
+	nextLatency int
+	p99         time.Duration
+	p99CalcAt   time.Time
+}
+
+func NewLoadShedder(cfg LoadShedderCfg) *LoadShedder {
+	return &LoadShedder{
+		cfg:       cfg,
+		latencies: make([]time.Duration, 0, latencyWindowSize),
+	}
+}
+
+func (ls *LoadShedder) observe(latency time.Duration) {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	if len(ls.latencies) < latencyWindowSize {
+		ls.latencies = append(ls.latencies, latency)
+		return
+	}
+	ls.latencies[ls.nextLatency] = latency
+	ls.nextLatency = (ls.nextLatency + 1) % latencyWindowSize
+}
+
+func (ls *LoadShedder) currentP99() time.Duration {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	if time.Since(ls.p99CalcAt) < latencyRecalcInterval || len(ls.latencies) == 0 {
+		return ls.p99
+	}
+	sorted := make([]time.Duration, len(ls.latencies))
+	copy(sorted, ls.latencies)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	ls.p99 = sorted[int(math.Ceil(float64(len(sorted))*0.99))-1]
+	ls.p99CalcAt = time.Now()
+	return ls.p99
+}
+
+func (ls *LoadShedder) overloaded() bool {
+	if ls.cfg.MaxInFlight > 0 && ls.inFlight.Load() > ls.cfg.MaxInFlight {
+		return true
+	}
+	return ls.cfg.MaxP99 > 0 && ls.currentP99() > ls.cfg.MaxP99
+}
+
+// Track учитывает запрос в статистике нагрузки, должен применяться ко всем запросам
+func (ls *LoadShedder) Track(h http.Handler) http.Handler {
+	if ls == nil {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Потоки событий и WebSocket открыты долго и исказили бы статистику времени ответа
+		if r.Header.Get("Accept") == "text/event-stream" || strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+			h.ServeHTTP(w, r)
+			return
+		}
+		start := time.Now()
+		ls.inFlight.Add(1)
+		defer func() {
+			ls.inFlight.Add(-1)
+			ls.observe(time.Since(start))
+		}()
+		h.ServeHTTP(w, r)
+	})
+}
+
+// Shed отбрасывает низкоприоритетные запросы, пока сервис перегружен
+func (ls *LoadShedder) Shed(h http.Handler) http.Handler {
+	if ls == nil {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ls.overloaded() {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(ls.cfg.RetryAfter.Seconds()))))
+			http.Error(w, "Сервис перегружен, повторите запрос позже", http.StatusServiceUnavailable)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,102 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadShedderShed(t *testing.T) {
+	tests := []struct {
+		name     string
+		cfg      LoadShedderCfg
+		inFlight int64
+		// Время ответа предыдущих запросов
+		latency    time.Duration
+		wantStatus int
+		wantRetry  string
+	}{
+		{
+			name:       "Без порогов",
+			inFlight:   100,
+			latency:    time.Second,
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "Количество запросов в пределах порога",
+			cfg:        LoadShedderCfg{MaxInFlight: 2},
+			inFlight:   2,
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "Превышено количество запросов",
+			cfg:        LoadShedderCfg{MaxInFlight: 2, RetryAfter: 1500 * time.Millisecond},
+			inFlight:   3,
+			wantStatus: http.StatusServiceUnavailable,
+			wantRetry:  "2",
+		},
+		{
+			name:       "p99 в пределах порога",
+			cfg:        LoadShedderCfg{MaxP99: 100 * time.Millisecond},
+			latency:    50 * time.Millisecond,
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "Превышено p99",
+			cfg:        LoadShedderCfg{MaxP99: 100 * time.Millisecond, RetryAfter: time.Second},
+			latency:    200 * time.Millisecond,
+			wantStatus: http.StatusServiceUnavailable,
+			wantRetry:  "1",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ls := NewLoadShedder(tt.cfg)
+			ls.inFlight.Store(tt.inFlight)
+			for i := 0; i < 100 && tt.latency > 0; i++ {
+				ls.observe(tt.latency)
+			}
+			handler := ls.Shed(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			}))
+
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/user/orders", nil))
+			assert.Equal(t, tt.wantStatus, rec.Code)
+			assert.Equal(t, tt.wantRetry, rec.Header().Get("Retry-After"))
+		})
+	}
+}
+
+func TestLoadShedderTrack(t *testing.T) {
+	ls := NewLoadShedder(LoadShedderCfg{MaxInFlight: 1})
+	var inFlight int64
+	handler := ls.Track(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		inFlight = ls.inFlight.Load()
+	}))
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/api/user/balance", nil))
+	assert.Equal(t, int64(1), inFlight)
+	assert.Zero(t, ls.inFlight.Load())
+	assert.Len(t, ls.latencies, 1)
+
+	// Поток событий не учитывается в статистике нагрузки
+	req := httptest.NewRequest(http.MethodGet, "/api/user/events", nil)
+	req.Header.Set("Accept", "text/event-stream")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	assert.Zero(t, inFlight)
+	assert.Len(t, ls.latencies, 1)
+}
+
+func TestLoadShedderNil(t *testing.T) {
+	var ls *LoadShedder
+	handler := ls.Track(ls.Shed(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})))
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/user/orders", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+}
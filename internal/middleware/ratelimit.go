@@ -0,0 +1,74 @@
+package middleware
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/pinbrain/gophermart/internal/appctx"
+	"github.com/pinbrain/gophermart/internal/logger"
+	"github.com/pinbrain/gophermart/internal/ratelimit"
+)
+
+// RateLimitUser ограничивает частоту запросов авторизованного пользователя.
+// Должен применяться после RequireUser. При limiter == nil ограничение не действует.
+func RateLimitUser(limiter ratelimit.Limiter) func(http.Handler) http.Handler {
+	return rateLimit(limiter, func(r *http.Request) string {
+		user := appctx.GetCtxUser(r.Context())
+		if user == nil {
+			return ""
+		}
+		return strconv.Itoa(user.ID)
+	})
+}
+
+// RateLimitIP ограничивает частоту запросов с одного IP-адреса, например, попыток входа.
+// За прокси-сервером ограничение действует на адрес прокси. При limiter == nil ограничение не действует.
+func RateLimitIP(limiter ratelimit.Limiter) func(http.Handler) http.Handler {
+	return rateLimit(limiter, func(r *http.Request) string {
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			return r.RemoteAddr
+		}
+		return host
+	})
+}
+
+// rateLimit проверяет лимит по ключу запроса и сообщает о его состоянии в заголовках X-RateLimit-*.
+// Запросы с пустым ключом не ограничиваются.
+func rateLimit(limiter ratelimit.Limiter, key func(r *http.Request) string) func(http.Handler) http.Handler {
+	return func(h http.Handler) http.Handler {
+		if limiter == nil {
+			return h
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			k := key(r)
+			if k == "" {
+				h.ServeHTTP(w, r)
+				return
+			}
+			res, err := limiter.Allow(r.Context(), k)
+			if err != nil {
+				// Недоступность хранилища счетчиков не должна блокировать работу пользователей
+				logger.Log.WithError(err).Error("failed to check rate limit")
+				h.ServeHTTP(w, r)
+				return
+			}
+			w.Header().Set("X-RateLimit-Limit", strconv.Itoa(res.Limit))
+			w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(res.Remaining))
+			w.Header().Set("X-RateLimit-Reset", ceilSeconds(res.Reset))
+			if !res.Allowed {
+				w.Header().Set("Retry-After", ceilSeconds(res.RetryAfter))
+				http.Error(w, "Слишком много запросов", http.StatusTooManyRequests)
+				return
+			}
+			h.ServeHTTP(w, r)
+		})
+	}
+}
+
+func ceilSeconds(d time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(d.Seconds())))
+}
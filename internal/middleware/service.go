@@ -0,0 +1,78 @@
+package middleware
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/pinbrain/gophermart/internal/logger"
+	"github.com/pinbrain/gophermart/internal/utils"
+)
+
+const (
+	bearerPrefix = "Bearer "
+)
+
+type ServiceAuthCfg struct {
+	// Статический токен доступа ко всему внутреннему API, пустой - не принимается
+	Token string
+	// Ключ подписи сервисных JWT, пустой - сервисные JWT не принимаются
+	JWTKey string
+	// Запросы, подписанные секретом ключа API. Ключу доступно все внутреннее API, как статическому токену.
+	Signed SignedRequestsCfg
+}
+
+// Enabled сообщает, настроен ли хотя бы один способ авторизации сервисов
+func (cfg ServiceAuthCfg) Enabled() bool {
+	return cfg.Token != "" || cfg.JWTKey != "" || cfg.Signed.Enabled()
+}
+
+// RequireServiceScope пропускает только запросы с заголовком Authorization: Bearer <token>,
+// где token - статический токен сервиса или сервисный JWT с областью доступа scope,
+// а также запросы с заголовком X-Signature, подписанные ключом API (см. RequestSignature)
+func RequireServiceScope(cfg ServiceAuthCfg, scope string) func(http.Handler) http.Handler {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get(SignatureHeader) != "" && cfg.Signed.Enabled() {
+				err := verifySignedRequest(r, cfg.Signed)
+				switch {
+				case err == nil:
+					h.ServeHTTP(w, r)
+				case errors.Is(err, errInvalidSignature):
+					http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				case errors.Is(err, errBodyTooLarge):
+					http.Error(w, "Слишком большой запрос", http.StatusRequestEntityTooLarge)
+				default:
+					logger.Log.WithError(err).Error("failed to verify signed request")
+					http.Error(w, "Internal server error", http.StatusInternalServerError)
+				}
+				return
+			}
+			authHeader := r.Header.Get("Authorization")
+			if !strings.HasPrefix(authHeader, bearerPrefix) {
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+			reqToken := strings.TrimPrefix(authHeader, bearerPrefix)
+			if cfg.Token != "" && subtle.ConstantTimeCompare([]byte(reqToken), []byte(cfg.Token)) == 1 {
+				h.ServeHTTP(w, r)
+				return
+			}
+			if cfg.JWTKey == "" {
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+			claims, err := utils.GetServiceJWTClaims(reqToken, cfg.JWTKey)
+			if err != nil {
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+			if !claims.HasScope(scope) {
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				return
+			}
+			h.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,126 @@
+package middleware
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pinbrain/gophermart/internal/nonce"
+)
+
+// Заголовки подписанного запроса
+const (
+	APIKeyHeader    = "X-API-Key"
+	TimestampHeader = "X-Timestamp"
+	NonceHeader     = "X-Nonce"
+	SignatureHeader = "X-Signature"
+)
+
+// Максимальный размер тела подписанного запроса, тело читается целиком для проверки подписи
+const maxSignedBodySize = 1 << 20
+
+type SignedRequestsCfg struct {
+	// Секреты подписи запросов по идентификаторам ключей API, пустой - подписанные запросы не принимаются
+	Keys map[string]string
+	// Допустимое расхождение времени подписи запроса и времени сервера
+	Window time.Duration
+	// Использованные nonce, хранятся в течение двух окон
+	Nonces nonce.Store
+}
+
+// Enabled сообщает, принимаются ли подписанные запросы
+func (cfg SignedRequestsCfg) Enabled() bool {
+	return len(cfg.Keys) > 0 && cfg.Window > 0 && cfg.Nonces != nil
+}
+
+// ParseAPIKeys разбирает ключи API в формате id1:secret1,id2:secret2
+func ParseAPIKeys(s string) (map[string]string, error) {
+	keys := make(map[string]string)
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		id, secret, ok := strings.Cut(pair, ":")
+		if !ok || id == "" || secret == "" {
+			return nil, fmt.Errorf("invalid api key %q: expected id:secret", pair)
+		}
+		if _, exists := keys[id]; exists {
+			return nil, fmt.Errorf("duplicate api key id %q", id)
+		}
+		keys[id] = secret
+	}
+	return keys, nil
+}
+
+// RequestSignature вычисляет подпись запроса: HMAC-SHA256 секретом ключа от строки
+// METHOD\nREQUEST_URI\nTIMESTAMP\nNONCE\nhex(sha256(body)) в шестнадцатеричном виде
+func RequestSignature(secret, method, requestURI, timestamp, nonce string, body []byte) string {
+	bodyHash := sha256.Sum256(body)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strings.Join([]string{
+		method, requestURI, timestamp, nonce, hex.EncodeToString(bodyHash[:]),
+	}, "\n")))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+var (
+	errInvalidSignature = errors.New("invalid request signature")
+	errBodyTooLarge     = errors.New("signed request body is too large")
+)
+
+// verifySignedRequest проверяет подпись запроса, время подписи и одноразовость nonce.
+// Тело запроса читается и подменяется копией, чтобы его мог прочитать обработчик.
+func verifySignedRequest(r *http.Request, cfg SignedRequestsCfg) error {
+	secret, ok := cfg.Keys[r.Header.Get(APIKeyHeader)]
+	if !ok {
+		return errInvalidSignature
+	}
+	timestamp, reqNonce := r.Header.Get(TimestampHeader), r.Header.Get(NonceHeader)
+	if reqNonce == "" {
+		return errInvalidSignature
+	}
+	unixTime, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return errInvalidSignature
+	}
+	if skew := time.Since(time.Unix(unixTime, 0)); skew > cfg.Window || skew < -cfg.Window {
+		return errInvalidSignature
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxSignedBodySize+1))
+	if err != nil {
+		return fmt.Errorf("failed to read signed request body: %w", err)
+	}
+	if len(body) > maxSignedBodySize {
+		return errBodyTooLarge
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+
+	signature, err := hex.DecodeString(r.Header.Get(SignatureHeader))
+	if err != nil {
+		return errInvalidSignature
+	}
+	expected, _ := hex.DecodeString(RequestSignature(secret, r.Method, r.URL.RequestURI(), timestamp, reqNonce, body))
+	if !hmac.Equal(signature, expected) {
+		return errInvalidSignature
+	}
+
+	// Подпись проверена до учета nonce, иначе чужие запросы могли бы расходовать nonce клиента
+	fresh, err := cfg.Nonces.Use(r.Context(), r.Header.Get(APIKeyHeader)+":"+reqNonce, 2*cfg.Window)
+	if err != nil {
+		return err
+	}
+	if !fresh {
+		return errInvalidSignature
+	}
+	return nil
+}
@@ -15,6 +15,29 @@ const (
 	OrderAccProcessed  OrderAccrualStatus = "PROCESSED"
 )
 
+// IsValid проверяет, что статус является одним из статусов системы начислений
+func (s OrderAccrualStatus) IsValid() bool {
+	switch s {
+	case OrderAccRegistered, OrderAccProcessing, OrderAccInvalid, OrderAccProcessed:
+		return true
+	}
+	return false
+}
+
+// OrderStatus возвращает внутренний статус заказа, соответствующий статусу системы начислений
+func (s OrderAccrualStatus) OrderStatus() OrderStatus {
+	switch s {
+	case OrderAccProcessed:
+		return OrderProcessed
+	case OrderAccInvalid:
+		return OrderInvalid
+	case OrderAccRegistered:
+		// Заказ зарегистрирован, но расчет начисления еще не начат
+		return OrderNew
+	}
+	return OrderProcessing
+}
+
 type OrderStatus string
 
 // Возможные статусы обработки заказов в системе (внутренние)
@@ -23,6 +46,28 @@ const (
 	OrderProcessing OrderStatus = "PROCESSING"
 	OrderInvalid    OrderStatus = "INVALID"
 	OrderProcessed  OrderStatus = "PROCESSED"
+	// Статус заказа слишком много раз подряд не удалось получить из системы начислений.
+	// Агент такой заказ больше не опрашивает, в обработку он возвращается администратором.
+	OrderStalled OrderStatus = "STALLED"
+)
+
+// IsValid проверяет, что статус является одним из внутренних статусов заказа
+func (s OrderStatus) IsValid() bool {
+	switch s {
+	case OrderNew, OrderProcessing, OrderInvalid, OrderProcessed, OrderStalled:
+		return true
+	}
+	return false
+}
+
+// IsFinal проверяет, что обработка заказа завершена и его статус больше не изменится
+func (s OrderStatus) IsFinal() bool {
+	return s == OrderProcessed || s == OrderInvalid
+}
+
+// Роли пользователей
+const (
+	RoleUser = "user"
 )
 
 type User struct {
@@ -30,17 +75,37 @@ type User struct {
 	Login        string `json:"login"`
 	PasswordHash string `json:"-"`
 	Password     string `json:"password"`
+	Email        string `json:"email,omitempty"`
+	// Email подтвержден пользователем
+	EmailVerified bool `json:"-"`
+	// Момент, до которого вход пользователя заблокирован после неудачных попыток
+	LockedUntil time.Time `json:"-"`
+	// Версия токенов пользователя, JWT с другой версией не принимаются
+	TokenVersion int       `json:"-"`
+	Role         string    `json:"-"`
+	CreatedAt    time.Time `json:"-"`
+}
+
+// UserProfile - данные текущего пользователя
+type UserProfile struct {
+	Login         string    `json:"login"`
+	Email         string    `json:"email,omitempty"`
+	EmailVerified bool      `json:"email_verified"`
+	Role          string    `json:"role"`
+	RegisteredAt  time.Time `json:"registered_at"`
 }
 
 // Заказ для начисления бонусных баллов
 type Order struct {
-	ID        int         `json:"-"`
-	UserID    int         `json:"-"`
-	Number    string      `json:"number"`
-	Status    OrderStatus `json:"status"`
-	Accrual   float64     `json:"accrual,omitempty"`
-	CreatedAt time.Time   `json:"uploaded_at"`
-	UpdatedAt time.Time   `json:"-"`
+	ID      int         `json:"-"`
+	UserID  int         `json:"-"`
+	Number  string      `json:"number"`
+	Status  OrderStatus `json:"status"`
+	Accrual Money       `json:"accrual,omitempty"`
+	// Причина установки статуса, если статус выставлен не по ответу системы начислений
+	StatusReason string    `json:"status_reason,omitempty"`
+	CreatedAt    time.Time `json:"uploaded_at"`
+	UpdatedAt    time.Time `json:"-"`
 }
 
 func (o Order) MarshalJSON() ([]byte, error) {
@@ -57,13 +122,123 @@ func (o Order) MarshalJSON() ([]byte, error) {
 	return json.Marshal(aliasValue)
 }
 
+// Результаты загрузки номера заказа в пакете
+const (
+	BatchOrderAccepted        = "accepted"
+	BatchOrderAlreadyUploaded = "already_uploaded"
+	BatchOrderConflict        = "conflict"
+	BatchOrderInvalid         = "invalid"
+)
+
+// BatchOrderResult - результат загрузки одного номера заказа в пакете
+type BatchOrderResult struct {
+	Number string `json:"number"`
+	Result string `json:"result"`
+}
+
+// OrderStatusChange - изменение статуса заказа
+type OrderStatusChange struct {
+	From    OrderStatus `json:"from"`
+	Status  OrderStatus `json:"status"`
+	Accrual Money       `json:"accrual,omitempty"`
+	// Причина установки статуса, если статус выставлен не по ответу системы начислений
+	Reason    string    `json:"reason,omitempty"`
+	ChangedAt time.Time `json:"changed_at"`
+}
+
+// OrderDetails - заказ вместе с моментом последнего изменения статуса и историей статусов
+type OrderDetails struct {
+	Number       string              `json:"number"`
+	Status       OrderStatus         `json:"status"`
+	Accrual      Money               `json:"accrual,omitempty"`
+	StatusReason string              `json:"status_reason,omitempty"`
+	UploadedAt   string              `json:"uploaded_at"`
+	UpdatedAt    string              `json:"updated_at"`
+	History      []OrderStatusChange `json:"history"`
+}
+
+func NewOrderDetails(o Order, history []OrderStatusChange) OrderDetails {
+	return OrderDetails{
+		Number:       o.Number,
+		Status:       o.Status,
+		Accrual:      o.Accrual,
+		StatusReason: o.StatusReason,
+		UploadedAt:   o.CreatedAt.Format(time.RFC3339),
+		UpdatedAt:    o.UpdatedAt.Format(time.RFC3339),
+		History:      history,
+	}
+}
+
+// Поля, по которым сортируются списки заказов и списаний
+const (
+	SortOrdersUploadedAt       = "uploaded_at"
+	SortOrdersAccrual          = "accrual"
+	SortWithdrawalsProcessedAt = "processed_at"
+	SortWithdrawalsSum         = "sum"
+)
+
+// Sort - порядок сортировки списка. Пустое поле - в порядке добавления записей.
+type Sort struct {
+	Field string
+	Desc  bool
+}
+
+// OrdersQuery - параметры выборки заказов пользователя
+type OrdersQuery struct {
+	// Максимальное количество заказов (0 - без ограничения)
+	Limit int
+	// Сколько заказов пропустить от начала выборки
+	Offset int
+	// Статусы заказов, пустой - любые
+	Statuses []OrderStatus
+	// Начало номера заказа, пустое - любой номер
+	NumberPrefix string
+	// Заказы, загруженные не раньше From и раньше To. Нулевое значение - без ограничения.
+	From time.Time
+	To   time.Time
+	Sort Sort
+}
+
+// OrdersSummary - сводка по заказам пользователя, подходящим под условия выборки
+type OrdersSummary struct {
+	// Количество заказов без учета ограничения и смещения
+	Count int
+	// Время последнего изменения среди этих заказов, нулевое - заказов нет
+	LastUpdate time.Time
+}
+
+// WithdrawalsQuery - параметры выборки списаний пользователя
+type WithdrawalsQuery struct {
+	// Максимальное количество списаний (0 - без ограничения)
+	Limit int
+	// Сколько списаний пропустить от начала выборки
+	Offset int
+	// Списания, выполненные не раньше From и раньше To. Нулевое значение - без ограничения.
+	From time.Time
+	To   time.Time
+	Sort Sort
+}
+
 // Заказы для списания бонусных баллов
+type WithdrawalStatus string
+
+// Статусы списания
+const (
+	WithdrawalPending  WithdrawalStatus = "PENDING"
+	WithdrawalDone     WithdrawalStatus = "DONE"
+	WithdrawalCanceled WithdrawalStatus = "CANCELED"
+)
+
 type Withdrawn struct {
-	ID        int       `json:"-"`
-	UserID    int       `json:"-"`
-	Number    string    `json:"order"`
-	Sum       float64   `json:"sum"`
-	CreatedAt time.Time `json:"processed_at"`
+	ID        int              `json:"id"`
+	UserID    int              `json:"-"`
+	Number    string           `json:"order"`
+	Sum       Money            `json:"sum"`
+	Status    WithdrawalStatus `json:"status,omitempty"`
+	CreatedAt time.Time        `json:"processed_at"`
+	// До этого момента списание в статусе PENDING можно отменить
+	CancelableUntil *time.Time       `json:"cancelable_until,omitempty"`
+	Converted       *ConvertedAmount `json:"converted,omitempty"`
 }
 
 func (w Withdrawn) MarshalJSON() ([]byte, error) {
@@ -80,16 +255,491 @@ func (w Withdrawn) MarshalJSON() ([]byte, error) {
 	return json.Marshal(aliasValue)
 }
 
+type WebhookEventType string
+
+// Типы событий, отправляемых на webhooks
+const (
+	WebhookOrderProcessed          WebhookEventType = "order.processed"
+	WebhookBalanceWithdrawn        WebhookEventType = "balance.withdrawn"
+	WebhookBalanceWithdrawCanceled WebhookEventType = "balance.withdraw_canceled"
+
+	// Изменение статуса заказа публикуется только в брокер сообщений, подписка webhook на него недоступна
+	EventOrderStatusChanged WebhookEventType = "order.status_changed"
+)
+
+func (t WebhookEventType) IsValid() bool {
+	return t == WebhookOrderProcessed || t == WebhookBalanceWithdrawn || t == WebhookBalanceWithdrawCanceled
+}
+
+// Адрес, на который пользователь получает уведомления о событиях.
+// Ключ подписи отдается только при регистрации.
+type Webhook struct {
+	ID        int                `json:"id"`
+	UserID    int                `json:"-"`
+	URL       string             `json:"url"`
+	Events    []WebhookEventType `json:"events"`
+	Secret    string             `json:"secret,omitempty"`
+	CreatedAt time.Time          `json:"created_at"`
+}
+
+// WebhookReq - запрос на регистрацию webhook
+type WebhookReq struct {
+	URL    string             `json:"url"`
+	Events []WebhookEventType `json:"events"`
+}
+
+type WebhookDeliveryStatus string
+
+// Статусы доставки события на webhook
+const (
+	WebhookDeliveryPending   WebhookDeliveryStatus = "PENDING"
+	WebhookDeliveryDelivered WebhookDeliveryStatus = "DELIVERED"
+	WebhookDeliveryFailed    WebhookDeliveryStatus = "FAILED"
+)
+
+// Событие, ожидающее доставки на webhook
+type WebhookDelivery struct {
+	ID        int64
+	URL       string
+	Secret    string
+	Event     WebhookEventType
+	Payload   json.RawMessage
+	Attempts  int
+	CreatedAt time.Time
+}
+
+// Событие из outbox, записанное в одной транзакции с изменением данных и ожидающее публикации
+type OutboxEvent struct {
+	ID        int64
+	UserID    int
+	Event     WebhookEventType
+	Payload   json.RawMessage
+	CreatedAt time.Time
+}
+
+// Сообщение о событии, публикуемое в брокер сообщений
+type BrokerMessage struct {
+	ID        int64            `json:"id"`
+	Event     WebhookEventType `json:"event"`
+	UserID    int              `json:"user_id"`
+	CreatedAt time.Time        `json:"created_at"`
+	Data      json.RawMessage  `json:"data"`
+}
+
+// Тело запроса, отправляемого на webhook
+type WebhookMessage struct {
+	ID        int64            `json:"id"`
+	Event     WebhookEventType `json:"event"`
+	CreatedAt time.Time        `json:"created_at"`
+	Data      json.RawMessage  `json:"data"`
+}
+
+// TransferReq - запрос на перевод баллов другому пользователю
+type TransferReq struct {
+	Login string `json:"login"`
+	Sum   Money  `json:"sum"`
+}
+
+type TransferDirection string
+
+// Направление перевода относительно пользователя
+const (
+	TransferIn  TransferDirection = "IN"
+	TransferOut TransferDirection = "OUT"
+)
+
+// Перевод баллов между пользователями
+type Transfer struct {
+	ID             int               `json:"id"`
+	Direction      TransferDirection `json:"direction"`
+	Counterparty   string            `json:"login"`
+	CounterpartyID int               `json:"-"`
+	Sum            Money             `json:"sum"`
+	CreatedAt      time.Time         `json:"created_at"`
+}
+
+// OrderReq - запрос на загрузку номера заказа в формате JSON
+type OrderReq struct {
+	Number string `json:"order"`
+}
+
+// HoldReq - запрос на резервирование баллов в счет заказа
+type HoldReq struct {
+	Number string `json:"order"`
+	Sum    Money  `json:"sum"`
+}
+
+// HoldActionReq - запрос на списание или снятие резерва
+type HoldActionReq struct {
+	ID int `json:"id"`
+}
+
+type HoldStatus string
+
+// Статусы резерва баллов
+const (
+	HoldActive   HoldStatus = "HELD"
+	HoldCaptured HoldStatus = "CAPTURED"
+	HoldReleased HoldStatus = "RELEASED"
+	HoldExpired  HoldStatus = "EXPIRED"
+)
+
+// Резерв баллов: баллы уже недоступны для других операций, но списываются только после
+// подтверждения покупки, а при ее отмене или истечении срока резерва возвращаются на баланс
+type Hold struct {
+	ID        int        `json:"id"`
+	UserID    int        `json:"-"`
+	Number    string     `json:"order"`
+	Sum       Money      `json:"sum"`
+	Status    HoldStatus `json:"status"`
+	ExpiresAt time.Time  `json:"expires_at"`
+	CreatedAt time.Time  `json:"created_at"`
+}
+
 // Текущий баланс пользователя
+// AuthRes - ответ на успешную регистрацию или аутентификацию
+type AuthRes struct {
+	Token        string `json:"token"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+// Session - серверная сессия пользователя
+type Session struct {
+	ID string `json:"-"`
+	// Публичный идентификатор сессии - хэш идентификатора из cookie, по нему сессию можно завершить
+	PublicID   string    `json:"id"`
+	Current    bool      `json:"current"`
+	UserID     int       `json:"-"`
+	Login      string    `json:"-"`
+	IP         string    `json:"ip"`
+	UserAgent  string    `json:"user_agent"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastSeenAt time.Time `json:"last_seen_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	// До какого момента сессия подтверждена повторным вводом пароля
+	ElevatedUntil time.Time `json:"-"`
+}
+
+// AccountLockedRes - ответ на попытку входа в заблокированную учетную запись
+type AccountLockedRes struct {
+	LockedUntil time.Time `json:"locked_until"`
+}
+
+// ExternalIdentity - учетная запись пользователя во внешнем провайдере (OIDC)
+type ExternalIdentity struct {
+	Issuer            string
+	Subject           string
+	Email             string
+	EmailVerified     bool
+	PreferredUsername string
+}
+
+// ChangePasswordReq - запрос на смену пароля
+type ChangePasswordReq struct {
+	CurrentPassword string `json:"current_password"`
+	NewPassword     string `json:"new_password"`
+}
+
+// ReauthReq - запрос на подтверждение входа повторным вводом пароля
+type ReauthReq struct {
+	Password string `json:"password"`
+}
+
+// ReauthRes - результат подтверждения входа. Token - новый JWT с признаком подтверждения,
+// пустой при аутентификации по серверной сессии.
+type ReauthRes struct {
+	Token         string    `json:"token,omitempty"`
+	ElevatedUntil time.Time `json:"elevated_until"`
+}
+
+// JWKS - набор открытых ключей проверки JWT пользователей (RFC 7517)
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// JWK - открытый ключ RSA (kty RSA) или Ed25519 (kty OKP)
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+}
+
+// Типы событий аутентификации
+const (
+	AuthEventRegister       = "register"
+	AuthEventLogin          = "login"
+	AuthEventLoginFailed    = "login_failed"
+	AuthEventLogout         = "logout"
+	AuthEventLogoutAll      = "logout_all"
+	AuthEventTokenRefresh   = "token_refresh"
+	AuthEventPasswordChange = "password_change"
+)
+
+// AuthEvent - событие аутентификации пользователя в журнале безопасности
+type AuthEvent struct {
+	ID        int64     `json:"-"`
+	UserID    int       `json:"-"`
+	Type      string    `json:"type"`
+	IP        string    `json:"ip"`
+	UserAgent string    `json:"user_agent"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// LoginDevice - устройство, с которого пользователь входит в сервис
+type LoginDevice struct {
+	IP        string
+	UserAgent string
+	// Подсеть клиента, грубое приближение его местоположения
+	Network string
+}
+
+// LoginDeviceCheck - результат сравнения устройства с устройствами прошлых входов пользователя
+type LoginDeviceCheck struct {
+	// Пользователь уже входил в сервис
+	HasHistory bool
+	NewDevice  bool
+	NewNetwork bool
+}
+
+// Suspicious сообщает, что вход выполняется с нового устройства или из новой подсети.
+// Первый вход пользователя подозрительным не считается.
+func (c LoginDeviceCheck) Suspicious() bool {
+	return c.HasHistory && (c.NewDevice || c.NewNetwork)
+}
+
+// SuspiciousLoginEvent - уведомление о входе с нового устройства или из новой подсети
+type SuspiciousLoginEvent struct {
+	UserID     int       `json:"user_id"`
+	Login      string    `json:"login"`
+	IP         string    `json:"ip"`
+	UserAgent  string    `json:"user_agent"`
+	NewDevice  bool      `json:"new_device"`
+	NewNetwork bool      `json:"new_network"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// LoginVerificationRes - ответ на вход, который нужно подтвердить кодом из письма
+type LoginVerificationRes struct {
+	VerificationRequired bool `json:"verification_required"`
+}
+
+// LoginConfirmReq - запрос на подтверждение входа кодом из письма
+type LoginConfirmReq struct {
+	Token string `json:"token"`
+}
+
+// CSRFTokenRes - CSRF-токен, который передается в заголовке X-CSRF-Token изменяющих запросов
+type CSRFTokenRes struct {
+	Token string `json:"token"`
+}
+
+// EmailConfirmReq - запрос на подтверждение email токеном из письма
+type EmailConfirmReq struct {
+	Token string `json:"token"`
+}
+
+// PasswordViolation - нарушенное паролем правило политики стойкости паролей
+type PasswordViolation struct {
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
+
+// PasswordPolicyErrRes - ответ на попытку установить пароль, не соответствующий политике
+type PasswordPolicyErrRes struct {
+	Error      string              `json:"error"`
+	Violations []PasswordViolation `json:"violations"`
+}
+
+// RefreshReq - запрос на обновление сессии, токен также может быть передан в cookie
+type RefreshReq struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+type LoyaltyTier string
+
+// Уровни программы лояльности
+const (
+	TierBronze LoyaltyTier = "BRONZE"
+	TierSilver LoyaltyTier = "SILVER"
+	TierGold   LoyaltyTier = "GOLD"
+)
+
+// TierInfo - уровень пользователя в программе лояльности и прогресс до следующего уровня
+type TierInfo struct {
+	Tier            LoyaltyTier `json:"tier"`
+	Multiplier      float64     `json:"multiplier"`
+	LifetimeAccrual Money       `json:"lifetime_accrual"`
+	// Следующий уровень, пусто - пользователь на максимальном уровне
+	NextTier      LoyaltyTier `json:"next_tier,omitempty"`
+	NextThreshold Money       `json:"next_threshold,omitempty"`
+	// Сколько баллов осталось начислить до следующего уровня
+	Remaining Money `json:"remaining,omitempty"`
+	// Доля пройденного пути от порога текущего уровня до следующего, от 0 до 1
+	Progress float64 `json:"progress"`
+}
+
 type Balance struct {
-	UserID    int     `json:"-"`
-	Current   float64 `json:"current"`
-	Withdrawn float64 `json:"withdrawn"`
+	UserID    int               `json:"-"`
+	Current   Money             `json:"current"`
+	Withdrawn Money             `json:"withdrawn"`
+	Converted *ConvertedBalance `json:"converted,omitempty"`
+}
+
+// ConvertedBalance - баланс пользователя в валюте по действующему курсу
+type ConvertedBalance struct {
+	Currency  string  `json:"currency"`
+	Rate      float64 `json:"rate"`
+	Current   Money   `json:"current"`
+	Withdrawn Money   `json:"withdrawn"`
+}
+
+// CurrencyRate - стоимость одного балла в валюте, действующая начиная с EffectiveFrom
+type CurrencyRate struct {
+	Currency      string    `json:"currency"`
+	Rate          float64   `json:"rate"`
+	EffectiveFrom time.Time `json:"effective_from"`
+}
+
+// ConvertedAmount - сумма баллов в валюте по курсу, действовавшему на момент операции
+type ConvertedAmount struct {
+	Currency string  `json:"currency"`
+	Rate     float64 `json:"rate"`
+	Amount   Money   `json:"amount"`
 }
 
 // Ответ от сервиса accrual
+// Событие изменения статуса заказа пользователя
+type OrderStatusEvent struct {
+	UserID    int         `json:"-"`
+	Number    string      `json:"number"`
+	Status    OrderStatus `json:"status"`
+	Accrual   Money       `json:"accrual,omitempty"`
+	UpdatedAt time.Time   `json:"updated_at"`
+}
+
+// Изменение баланса пользователя
+type BalanceChangeEvent struct {
+	Type      BalanceEventType `json:"type"`
+	Number    string           `json:"order,omitempty"`
+	Amount    Money            `json:"amount"`
+	CreatedAt time.Time        `json:"created_at"`
+}
+
+type UserEventType string
+
+// Типы событий, на которые может подписаться пользователь
+const (
+	UserEventOrderStatus UserEventType = "order_status"
+	UserEventBalance     UserEventType = "balance"
+)
+
+// Событие, адресованное пользователю
+type UserEvent struct {
+	UserID  int                 `json:"-"`
+	Type    UserEventType       `json:"type"`
+	Order   *OrderStatusEvent   `json:"order,omitempty"`
+	Balance *BalanceChangeEvent `json:"balance,omitempty"`
+}
+
+// WSCommand - команда клиента в канале уведомлений WebSocket: подписка (subscribe)
+// или отписка (unsubscribe) от событий указанных типов
+type WSCommand struct {
+	Action string          `json:"action"`
+	Topics []UserEventType `json:"topics"`
+}
+
 type AccrualResultRes struct {
 	Order   string             `json:"order"`
 	Status  OrderAccrualStatus `json:"status"`
-	Accrual float64            `json:"accrual"`
+	Accrual Money              `json:"accrual"`
+}
+
+type BalanceEventType string
+
+// Типы событий изменения баланса
+const (
+	BalanceEventOpening     BalanceEventType = "OPENING"
+	BalanceEventAccrual     BalanceEventType = "ACCRUAL"
+	BalanceEventWithdrawal  BalanceEventType = "WITHDRAWAL"
+	BalanceEventTransferIn  BalanceEventType = "TRANSFER_IN"
+	BalanceEventTransferOut BalanceEventType = "TRANSFER_OUT"
+	// Возврат баллов при отмене списания
+	BalanceEventWithdrawalCanceled BalanceEventType = "WITHDRAWAL_CANCELED"
+	// Резервирование баллов, списание резерва и возврат зарезервированных баллов на баланс
+	BalanceEventHold        BalanceEventType = "HOLD"
+	BalanceEventHoldCapture BalanceEventType = "HOLD_CAPTURE"
+	BalanceEventHoldRelease BalanceEventType = "HOLD_RELEASE"
+)
+
+// Событие изменения баланса пользователя
+type BalanceEvent struct {
+	ID             int64            `json:"-"`
+	UserID         int              `json:"-"`
+	Type           BalanceEventType `json:"type"`
+	Number         string           `json:"order,omitempty"`
+	CurrentDelta   Money            `json:"current_delta"`
+	WithdrawnDelta Money            `json:"withdrawn_delta"`
+	CreatedAt      time.Time        `json:"created_at"`
+}
+
+// Запись истории баланса пользователя: начисление или списание с остатком после операции
+type BalanceHistoryEntry struct {
+	Type      BalanceEventType `json:"type"`
+	Number    string           `json:"order,omitempty"`
+	Amount    Money            `json:"amount"`
+	Balance   Money            `json:"balance"`
+	CreatedAt time.Time        `json:"created_at"`
+}
+
+// Выписка по счету пользователя за период [From, To)
+type Statement struct {
+	From           time.Time
+	To             time.Time
+	OpeningBalance Money
+	ClosingBalance Money
+	// Сумма поступлений (начисления и входящие переводы) и списаний (вывод и исходящие переводы) за период
+	Credited Money
+	Debited  Money
+	Entries  []BalanceHistoryEntry
+}
+
+// Итоги пользователя за календарный месяц
+type MonthlyStats struct {
+	// Месяц в формате YYYY-MM
+	Month string `json:"month"`
+	// Количество загруженных заказов
+	Orders int `json:"orders"`
+	// Сумма начислений по заказам, загруженным в этом месяце
+	Accrued Money `json:"accrued"`
+	// Сумма списаний, кроме отмененных
+	Withdrawn Money `json:"withdrawn"`
+}
+
+// Количество заказов, ожидающих расчета начислений
+type OrderBacklog struct {
+	New        int `json:"new"`
+	Processing int `json:"processing"`
+	// Заказы, обработка которых остановлена после неудачных запросов к системе начислений
+	Stalled int `json:"stalled"`
+	// Время загрузки самого старого заказа в статусе NEW или PROCESSING, nil - таких заказов нет
+	OldestAt *time.Time `json:"-"`
+}
+
+// Состояние агента расчета начислений
+type AgentStatus struct {
+	// Запущены ли воркеры агента в этом экземпляре сервиса
+	Running bool         `json:"running"`
+	Workers int          `json:"workers"`
+	Backlog OrderBacklog `json:"backlog"`
+	// Время последнего успешного ответа системы начислений
+	LastContactAt *time.Time `json:"last_contact_at,omitempty"`
+	// Время окончания ограничения частоты запросов после ответа 429, если оно еще действует
+	RateLimitedUntil *time.Time `json:"rate_limited_until,omitempty"`
+	// Состояние автоматического выключателя запросов: closed, half-open или open
+	Circuit string `json:"circuit"`
 }
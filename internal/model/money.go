@@ -0,0 +1,170 @@
+package model
+
+import (
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Количество минимальных единиц (сотых долей) в одном балле
+const moneyScale = 100
+
+var ErrInvalidMoney = errors.New("invalid money amount")
+
+// Money - сумма баллов в сотых долях балла. Хранится целым числом, чтобы сложение и сравнение сумм
+// не накапливали ошибку округления. В JSON представляется обычным числом (например, 729.98),
+// в БД - столбцом NUMERIC.
+type Money int64
+
+// MoneyFromFloat переводит сумму в баллах в Money с округлением до сотых
+func MoneyFromFloat(f float64) Money {
+	return Money(math.Round(f * moneyScale))
+}
+
+// ParseMoney разбирает десятичную запись суммы в баллах. Знаки после сотых округляются.
+func ParseMoney(s string) (Money, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0, ErrInvalidMoney
+	}
+	// Экспоненциальная запись встречается только у чисел из JSON, точность float64 для нее достаточна
+	if strings.ContainsAny(s, "eE") {
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil || math.IsNaN(f) || math.IsInf(f, 0) || math.Abs(f) > math.MaxInt64/moneyScale {
+			return 0, ErrInvalidMoney
+		}
+		return MoneyFromFloat(f), nil
+	}
+
+	negative := false
+	switch s[0] {
+	case '-':
+		negative = true
+		s = s[1:]
+	case '+':
+		s = s[1:]
+	}
+	whole, frac, _ := strings.Cut(s, ".")
+	if whole == "" && frac == "" {
+		return 0, ErrInvalidMoney
+	}
+	if whole == "" {
+		whole = "0"
+	}
+	// ParseInt принимает знак, поэтому повторный знак после снятого выше нужно отклонить явно
+	if strings.TrimLeft(whole, "0123456789") != "" {
+		return 0, ErrInvalidMoney
+	}
+	units, err := strconv.ParseInt(whole, 10, 64)
+	if err != nil || units > math.MaxInt64/moneyScale-1 {
+		return 0, ErrInvalidMoney
+	}
+	var cents int64
+	for i, c := range frac {
+		if c < '0' || c > '9' {
+			return 0, ErrInvalidMoney
+		}
+		switch {
+		case i < 2:
+			cents = cents*10 + int64(c-'0')
+		case i == 2 && c >= '5':
+			cents++
+		}
+	}
+	for i := len(frac); i < 2; i++ {
+		cents *= 10
+	}
+	m := Money(units*moneyScale + cents)
+	if negative {
+		m = -m
+	}
+	return m, nil
+}
+
+// Mul умножает сумму на коэффициент k (например, курс валюты) с округлением до сотых
+func (m Money) Mul(k float64) Money {
+	return Money(math.Round(float64(m) * k))
+}
+
+// Float64 возвращает сумму в баллах
+func (m Money) Float64() float64 {
+	return float64(m) / moneyScale
+}
+
+// format возвращает десятичную запись суммы. При trim незначащие нули после запятой отбрасываются.
+func (m Money) format(trim bool) string {
+	sign := ""
+	abs := uint64(m)
+	if m < 0 {
+		sign = "-"
+		abs = uint64(-m)
+	}
+	units, cents := abs/moneyScale, abs%moneyScale
+	switch {
+	case !trim:
+		return fmt.Sprintf("%s%d.%02d", sign, units, cents)
+	case cents == 0:
+		return fmt.Sprintf("%s%d", sign, units)
+	case cents%10 == 0:
+		return fmt.Sprintf("%s%d.%d", sign, units, cents/10)
+	default:
+		return fmt.Sprintf("%s%d.%02d", sign, units, cents)
+	}
+}
+
+// String возвращает сумму с двумя знаками после запятой, например 729.90
+func (m Money) String() string {
+	return m.format(false)
+}
+
+func (m Money) MarshalJSON() ([]byte, error) {
+	return []byte(m.format(true)), nil
+}
+
+func (m *Money) UnmarshalJSON(data []byte) error {
+	s := string(data)
+	if s == "null" {
+		return nil
+	}
+	// Сумма в кавычках не принимается, как и раньше для float64
+	if strings.HasPrefix(s, `"`) {
+		return fmt.Errorf("%w: %s", ErrInvalidMoney, s)
+	}
+	value, err := ParseMoney(s)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalidMoney, s)
+	}
+	*m = value
+	return nil
+}
+
+// Value передает сумму в БД десятичной строкой, чтобы NUMERIC получил ее без потери точности
+func (m Money) Value() (driver.Value, error) {
+	return m.String(), nil
+}
+
+// Scan читает сумму из столбца NUMERIC
+func (m *Money) Scan(src any) error {
+	switch v := src.(type) {
+	case nil:
+		*m = 0
+	case string:
+		value, err := ParseMoney(v)
+		if err != nil {
+			return fmt.Errorf("failed to scan money %q: %w", v, err)
+		}
+		*m = value
+	case []byte:
+		return m.Scan(string(v))
+	case float64:
+		*m = MoneyFromFloat(v)
+	case int64:
+		*m = Money(v * moneyScale)
+	default:
+		return fmt.Errorf("failed to scan money: unsupported type %T", src)
+	}
+	return nil
+}
@@ -0,0 +1,173 @@
+package model
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseMoney(t *testing.T) {
+	tests := []struct {
+		name    string
+		s       string
+		want    Money
+		wantErr bool
+	}{
+		{name: "Сумма с копейками", s: "729.98", want: 72998},
+		{name: "Целая сумма", s: "10", want: 1000},
+		{name: "Один знак после запятой", s: "0.5", want: 50},
+		{name: "Без целой части", s: ".5", want: 50},
+		{name: "Без дробной части", s: "5.", want: 500},
+		{name: "Пробелы вокруг", s: " 42.1 ", want: 4210},
+		{name: "Отрицательная сумма", s: "-5.50", want: -550},
+		{name: "Явный плюс", s: "+5.50", want: 550},
+		{name: "Округление вниз по третьему знаку", s: "1.004", want: 100},
+		{name: "Округление вверх по третьему знаку", s: "1.005", want: 101},
+		{name: "Округление с переносом в целую часть", s: "0.995", want: 100},
+		{name: "Знаки после третьего не учитываются", s: "1.00499", want: 100},
+		{name: "Округление отрицательной суммы", s: "-1.005", want: -101},
+		{name: "Экспоненциальная запись", s: "7.2998e2", want: 72998},
+		{name: "Экспонента с заглавной буквой", s: "1.5E1", want: 1500},
+		{name: "Отрицательная экспонента", s: "5e-1", want: 50},
+		{name: "Максимальная сумма", s: "92233720368547757.99", want: 9223372036854775799},
+		{name: "Два знака", s: "+-5.50", wantErr: true},
+		{name: "Два минуса", s: "--5", wantErr: true},
+		{name: "Знак после минуса", s: "-+5", wantErr: true},
+		{name: "Знак в дробной части", s: "5.-5", wantErr: true},
+		{name: "Пустая строка", s: "", wantErr: true},
+		{name: "Только точка", s: ".", wantErr: true},
+		{name: "Только знак", s: "-", wantErr: true},
+		{name: "Буквы", s: "abc", wantErr: true},
+		{name: "Буквы в дробной части", s: "1.2a", wantErr: true},
+		{name: "Разделитель разрядов", s: "1 000", wantErr: true},
+		{name: "Две точки", s: "1.2.3", wantErr: true},
+		{name: "NaN", s: "NaN", wantErr: true},
+		{name: "Переполнение", s: "92233720368547758", wantErr: true},
+		{name: "Переполнение в экспоненциальной записи", s: "1e30", wantErr: true},
+		{name: "Неполная экспонента", s: "1e", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseMoney(tt.s)
+			if tt.wantErr {
+				assert.ErrorIs(t, err, ErrInvalidMoney)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestMoneyMarshalJSON(t *testing.T) {
+	tests := []struct {
+		name  string
+		money Money
+		want  string
+	}{
+		{name: "Сумма с копейками", money: 72998, want: "729.98"},
+		{name: "Незначащий ноль отбрасывается", money: 72990, want: "729.9"},
+		{name: "Целая сумма", money: 1000, want: "10"},
+		{name: "Меньше балла", money: 5, want: "0.05"},
+		{name: "Отрицательная сумма", money: -550, want: "-5.5"},
+		{name: "Ноль", money: 0, want: "0"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := json.Marshal(tt.money)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, string(data))
+		})
+	}
+}
+
+func TestMoneyUnmarshalJSON(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		want    Money
+		wantErr bool
+	}{
+		{name: "Число", data: `{"sum": 729.98}`, want: 72998},
+		{name: "Целое число", data: `{"sum": 10}`, want: 1000},
+		{name: "Экспоненциальная запись", data: `{"sum": 1e2}`, want: 10000},
+		{name: "Округление до сотых", data: `{"sum": 0.005}`, want: 1},
+		{name: "null не меняет сумму", data: `{"sum": null}`, want: 42},
+		{name: "Сумма в кавычках", data: `{"sum": "729.98"}`, wantErr: true},
+		{name: "Переполнение", data: `{"sum": 1e30}`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := struct {
+				Sum Money `json:"sum"`
+			}{Sum: 42}
+			err := json.Unmarshal([]byte(tt.data), &v)
+			if tt.wantErr {
+				assert.ErrorIs(t, err, ErrInvalidMoney)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, v.Sum)
+		})
+	}
+}
+
+func TestMoneyValue(t *testing.T) {
+	tests := []struct {
+		name  string
+		money Money
+		want  string
+	}{
+		{name: "Сумма с копейками", money: 72990, want: "729.90"},
+		{name: "Целая сумма", money: 1000, want: "10.00"},
+		{name: "Отрицательная сумма меньше балла", money: -5, want: "-0.05"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v, err := tt.money.Value()
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, v)
+		})
+	}
+}
+
+func TestMoneyScan(t *testing.T) {
+	tests := []struct {
+		name    string
+		src     any
+		want    Money
+		wantErr bool
+	}{
+		{name: "NULL", src: nil, want: 0},
+		{name: "Строка NUMERIC", src: "729.98", want: 72998},
+		{name: "Байты NUMERIC", src: []byte("729.90"), want: 72990},
+		{name: "Число с плавающей точкой", src: 729.98, want: 72998},
+		{name: "Целое число", src: int64(5), want: 500},
+		{name: "Некорректная строка", src: "+-5.50", wantErr: true},
+		{name: "Неподдерживаемый тип", src: true, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := Money(42)
+			err := m.Scan(tt.src)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, m)
+		})
+	}
+}
+
+func TestMoneyValueScanRoundTrip(t *testing.T) {
+	for _, money := range []Money{0, 1, -1, 72998, -72998, 9223372036854775799} {
+		v, err := money.Value()
+		require.NoError(t, err)
+		var got Money
+		require.NoError(t, got.Scan(v))
+		assert.Equal(t, money, got)
+	}
+}
@@ -0,0 +1,36 @@
+package nonce
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// MemoryStore хранит nonce в памяти процесса, повтор запроса обнаруживается в пределах одного экземпляра сервиса
+type MemoryStore struct {
+	mu   sync.Mutex
+	used map[string]time.Time
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{used: make(map[string]time.Time)}
+}
+
+func (ms *MemoryStore) Use(_ context.Context, nonce string, ttl time.Duration) (bool, error) {
+	now := time.Now()
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	if expiresAt, ok := ms.used[nonce]; ok && now.Before(expiresAt) {
+		return false, nil
+	}
+	// Заодно удаляем истекшие nonce, чтобы карта не росла бесконечно
+	for k, v := range ms.used {
+		if !now.Before(v) {
+			delete(ms.used, k)
+		}
+	}
+	ms.used[nonce] = now.Add(ttl)
+	return true, nil
+}
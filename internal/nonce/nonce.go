@@ -0,0 +1,13 @@
+package nonce
+
+import (
+	"context"
+	"time"
+)
+
+// Store запоминает одноразовые значения (nonce) подписанных запросов, чтобы повторно
+// отправленный запрос можно было отклонить
+type Store interface {
+	// Use отмечает nonce использованным на ttl. Возвращает false, если nonce уже использовался.
+	Use(ctx context.Context, nonce string, ttl time.Duration) (bool, error)
+}
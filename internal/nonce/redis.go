@@ -0,0 +1,28 @@
+package nonce
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const nonceKeyPrefix = "nonce:"
+
+// RedisStore хранит nonce в Redis, повтор запроса обнаруживается сразу для всех экземпляров сервиса
+type RedisStore struct {
+	client *redis.Client
+}
+
+func NewRedisStore(client *redis.Client) *RedisStore {
+	return &RedisStore{client: client}
+}
+
+func (rs *RedisStore) Use(ctx context.Context, nonce string, ttl time.Duration) (bool, error) {
+	ok, err := rs.client.SetNX(ctx, nonceKeyPrefix+nonce, 1, ttl).Result()
+	if err != nil {
+		return false, fmt.Errorf("failed to save request nonce: %w", err)
+	}
+	return ok, nil
+}
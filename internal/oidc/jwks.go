@@ -0,0 +1,171 @@
+package oidc
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// Минимальный интервал между загрузками ключей: токен с неизвестным kid не должен приводить к запросу
+// к провайдеру на каждый вход
+const jwksRefreshInterval = time.Minute
+
+// Алгоритмы подписи ID-токенов, которые принимает провайдер. Симметричные алгоритмы и none
+// не принимаются: ключ HMAC - секрет клиента, а не ключ провайдера.
+var signingMethods = []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512"}
+
+// keySet - открытые ключи провайдера из документа JWKS (jwks_uri), которыми подписаны ID-токены.
+// Ключи загружаются при первом использовании и повторно, если токен подписан неизвестным ключом,
+// например, после смены ключей провайдером.
+type keySet struct {
+	uri  string
+	load func(ctx context.Context, uri string, v any) error
+
+	mu       sync.Mutex
+	keys     map[string]any
+	loadedAt time.Time
+}
+
+type jwkSet struct {
+	Keys []jwk `json:"keys"`
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	// Параметры ключа RSA
+	N string `json:"n"`
+	E string `json:"e"`
+	// Параметры ключа на эллиптической кривой
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// keyFunc возвращает функцию, которая находит ключ проверки подписи токена по его заголовку kid.
+// Токен без kid проверяется единственным ключом провайдера.
+func (ks *keySet) keyFunc(ctx context.Context) jwt.Keyfunc {
+	return func(token *jwt.Token) (any, error) {
+		kid, _ := token.Header["kid"].(string)
+		ks.mu.Lock()
+		defer ks.mu.Unlock()
+
+		key, err := ks.lookup(kid)
+		if err == nil || time.Since(ks.loadedAt) < jwksRefreshInterval {
+			return key, err
+		}
+		if err = ks.refresh(ctx); err != nil {
+			return nil, err
+		}
+		return ks.lookup(kid)
+	}
+}
+
+func (ks *keySet) lookup(kid string) (any, error) {
+	if kid == "" && len(ks.keys) == 1 {
+		for _, key := range ks.keys {
+			return key, nil
+		}
+	}
+	if key, ok := ks.keys[kid]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+func (ks *keySet) refresh(ctx context.Context) error {
+	ks.loadedAt = time.Now()
+	var set jwkSet
+	if err := ks.load(ctx, ks.uri, &set); err != nil {
+		return fmt.Errorf("failed to load oidc signing keys: %w", err)
+	}
+	keys := make(map[string]any, len(set.Keys))
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			// Ключ неподдерживаемого типа не мешает использовать остальные ключи
+			continue
+		}
+		keys[k.Kid] = key
+	}
+	ks.keys = keys
+	return nil
+}
+
+// publicKey возвращает открытый ключ RSA или ECDSA, описанный JWK
+func (k jwk) publicKey() (any, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		if !e.IsInt64() || e.Int64() < 3 || e.Int64() > 1<<31-1 {
+			return nil, errors.New("invalid rsa exponent")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("ec point is not on curve")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) == 0 {
+		return nil, errors.New("empty key parameter")
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+// getJSON загружает JSON-документ провайдера
+func (p *Provider) getJSON(ctx context.Context, uri string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, uri, nil)
+	if err != nil {
+		return err
+	}
+	return p.doJSON(req, v)
+}
@@ -0,0 +1,224 @@
+package oidc
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/pinbrain/gophermart/internal/model"
+)
+
+const (
+	discoveryPath = "/.well-known/openid-configuration"
+	httpTimeout   = 10 * time.Second
+	// Максимальный размер ответа провайдера
+	maxResponseSize = 1 << 20
+)
+
+var ErrInvalidIDToken = errors.New("invalid id token")
+
+type Cfg struct {
+	// Издатель (issuer) провайдера, по нему загружается документ discovery
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	// Адрес обработчика /api/user/oauth/callback, зарегистрированный у провайдера
+	RedirectURL string
+	// Запрашиваемые scope, openid добавляется всегда
+	Scopes []string
+	// Разрешить издателя и адреса провайдера по http. Только для разработки с локальным провайдером:
+	// по http ключи провайдера и токены можно подменить.
+	AllowHTTP bool
+}
+
+// Provider выполняет вход через провайдера OpenID Connect по схеме authorization code с PKCE
+type Provider struct {
+	cfg    Cfg
+	client *http.Client
+
+	authEndpoint  string
+	tokenEndpoint string
+	keys          *keySet
+}
+
+type discoveryDoc struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// NewProvider загружает документ discovery провайдера и проверяет, что он выдан для заданного issuer.
+// Издатель и адреса из документа должны использовать https, если не задан cfg.AllowHTTP.
+func NewProvider(ctx context.Context, cfg Cfg) (*Provider, error) {
+	cfg.Issuer = strings.TrimSuffix(cfg.Issuer, "/")
+	p := &Provider{cfg: cfg, client: &http.Client{Timeout: httpTimeout}}
+	if err := p.checkScheme("issuer", cfg.Issuer); err != nil {
+		return nil, err
+	}
+
+	var doc discoveryDoc
+	if err := p.getJSON(ctx, cfg.Issuer+discoveryPath, &doc); err != nil {
+		return nil, fmt.Errorf("failed to load oidc discovery document: %w", err)
+	}
+	if strings.TrimSuffix(doc.Issuer, "/") != cfg.Issuer {
+		return nil, fmt.Errorf("oidc issuer mismatch: expected %q, got %q", cfg.Issuer, doc.Issuer)
+	}
+	if doc.AuthorizationEndpoint == "" || doc.TokenEndpoint == "" || doc.JWKSURI == "" {
+		return nil, errors.New("oidc discovery document has no authorization, token or jwks endpoint")
+	}
+	endpoints := []struct{ name, url string }{
+		{"authorization endpoint", doc.AuthorizationEndpoint},
+		{"token endpoint", doc.TokenEndpoint},
+		{"jwks uri", doc.JWKSURI},
+	}
+	for _, endpoint := range endpoints {
+		if err := p.checkScheme(endpoint.name, endpoint.url); err != nil {
+			return nil, err
+		}
+	}
+	p.authEndpoint = doc.AuthorizationEndpoint
+	p.tokenEndpoint = doc.TokenEndpoint
+	p.keys = &keySet{uri: doc.JWKSURI, load: p.getJSON}
+	return p, nil
+}
+
+// checkScheme проверяет, что адрес провайдера использует https, или http, если он разрешен
+func (p *Provider) checkScheme(name, rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return fmt.Errorf("invalid oidc %s: %w", name, err)
+	}
+	if u.Scheme == "https" || (u.Scheme == "http" && p.cfg.AllowHTTP) {
+		return nil
+	}
+	return fmt.Errorf("oidc %s must use https: %q", name, rawURL)
+}
+
+// AuthCodeURL возвращает адрес страницы входа провайдера
+func (p *Provider) AuthCodeURL(state, nonce, codeVerifier string) string {
+	scopes := []string{"openid"}
+	for _, scope := range p.cfg.Scopes {
+		if scope != "" && scope != "openid" {
+			scopes = append(scopes, scope)
+		}
+	}
+	challenge := sha256.Sum256([]byte(codeVerifier))
+	q := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {p.cfg.ClientID},
+		"redirect_uri":          {p.cfg.RedirectURL},
+		"scope":                 {strings.Join(scopes, " ")},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	sep := "?"
+	if strings.Contains(p.authEndpoint, "?") {
+		sep = "&"
+	}
+	return p.authEndpoint + sep + q.Encode()
+}
+
+type tokenRes struct {
+	IDToken          string `json:"id_token"`
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+type idTokenClaims struct {
+	jwt.RegisteredClaims
+	Nonce             string `json:"nonce"`
+	Email             string `json:"email"`
+	EmailVerified     bool   `json:"email_verified"`
+	PreferredUsername string `json:"preferred_username"`
+}
+
+// Exchange обменивает код авторизации на ID-токен и возвращает учетную запись пользователя.
+// У ID-токена проверяются подпись ключом провайдера из jwks_uri, издатель, получатель, срок действия и nonce.
+func (p *Provider) Exchange(ctx context.Context, code, codeVerifier, nonce string) (*model.ExternalIdentity, error) {
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.cfg.RedirectURL},
+		"code_verifier": {codeVerifier},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.tokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, fmt.Errorf("failed to build oidc token request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(url.QueryEscape(p.cfg.ClientID), url.QueryEscape(p.cfg.ClientSecret))
+
+	var res tokenRes
+	if err = p.doJSON(req, &res); err != nil && res.Error == "" {
+		return nil, fmt.Errorf("failed to exchange oidc code: %w", err)
+	}
+	if res.Error != "" {
+		return nil, fmt.Errorf("oidc provider rejected code: %s %s", res.Error, res.ErrorDescription)
+	}
+
+	var claims idTokenClaims
+	parser := jwt.NewParser(jwt.WithValidMethods(signingMethods))
+	if _, err = parser.ParseWithClaims(res.IDToken, &claims, p.keys.keyFunc(ctx)); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidIDToken, err)
+	}
+	if err = p.validateClaims(&claims, nonce); err != nil {
+		return nil, err
+	}
+	return &model.ExternalIdentity{
+		Issuer:            p.cfg.Issuer,
+		Subject:           claims.Subject,
+		Email:             claims.Email,
+		EmailVerified:     claims.EmailVerified,
+		PreferredUsername: claims.PreferredUsername,
+	}, nil
+}
+
+func (p *Provider) validateClaims(claims *idTokenClaims, nonce string) error {
+	now := time.Now()
+	switch {
+	case strings.TrimSuffix(claims.Issuer, "/") != p.cfg.Issuer:
+		return fmt.Errorf("%w: unexpected issuer %q", ErrInvalidIDToken, claims.Issuer)
+	case !claims.VerifyAudience(p.cfg.ClientID, true):
+		return fmt.Errorf("%w: unexpected audience", ErrInvalidIDToken)
+	case !claims.VerifyExpiresAt(now, true):
+		return fmt.Errorf("%w: token is expired", ErrInvalidIDToken)
+	case claims.Subject == "":
+		return fmt.Errorf("%w: no subject", ErrInvalidIDToken)
+	case claims.Nonce != nonce:
+		return fmt.Errorf("%w: nonce mismatch", ErrInvalidIDToken)
+	}
+	return nil
+}
+
+// doJSON выполняет запрос и разбирает JSON-ответ. При ошибочном статусе тело тоже разбирается,
+// чтобы вызывающий мог получить описание ошибки провайдера.
+func (p *Provider) doJSON(req *http.Request, v any) error {
+	req.Header.Set("Accept", "application/json")
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxResponseSize))
+	if err != nil {
+		return err
+	}
+	decodeErr := json.Unmarshal(body, v)
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+	return decodeErr
+}
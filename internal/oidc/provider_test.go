@@ -0,0 +1,235 @@
+package oidc
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeIdP - провайдер OpenID Connect, который на обмен кода возвращает заданный ID-токен
+type fakeIdP struct {
+	server  *httptest.Server
+	keys    []jwk
+	idToken string
+}
+
+func newFakeIdP(t *testing.T) *fakeIdP {
+	t.Helper()
+	idp := &fakeIdP{}
+	mux := http.NewServeMux()
+	mux.HandleFunc(discoveryPath, func(w http.ResponseWriter, _ *http.Request) {
+		_ = json.NewEncoder(w).Encode(discoveryDoc{
+			Issuer:                idp.server.URL,
+			AuthorizationEndpoint: idp.server.URL + "/authorize",
+			TokenEndpoint:         idp.server.URL + "/token",
+			JWKSURI:               idp.server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, _ *http.Request) {
+		_ = json.NewEncoder(w).Encode(jwkSet{Keys: idp.keys})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, _ *http.Request) {
+		_ = json.NewEncoder(w).Encode(tokenRes{IDToken: idp.idToken})
+	})
+	idp.server = httptest.NewServer(mux)
+	t.Cleanup(idp.server.Close)
+	return idp
+}
+
+func rsaJWK(kid string, key *rsa.PublicKey) jwk {
+	return jwk{
+		Kty: "RSA",
+		Kid: kid,
+		Use: "sig",
+		N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+		E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+	}
+}
+
+func ecJWK(kid string, key *ecdsa.PublicKey) jwk {
+	return jwk{
+		Kty: "EC",
+		Kid: kid,
+		Crv: "P-256",
+		X:   base64.RawURLEncoding.EncodeToString(key.X.Bytes()),
+		Y:   base64.RawURLEncoding.EncodeToString(key.Y.Bytes()),
+	}
+}
+
+func signToken(t *testing.T, method jwt.SigningMethod, kid string, key any, claims idTokenClaims) string {
+	t.Helper()
+	token := jwt.NewWithClaims(method, claims)
+	if kid != "" {
+		token.Header["kid"] = kid
+	}
+	signed, err := token.SignedString(key)
+	require.NoError(t, err)
+	return signed
+}
+
+func TestNewProviderRequiresHTTPS(t *testing.T) {
+	idp := newFakeIdP(t)
+	ctx := context.Background()
+
+	_, err := NewProvider(ctx, Cfg{Issuer: idp.server.URL, ClientID: "client"})
+	assert.ErrorContains(t, err, "must use https")
+
+	_, err = NewProvider(ctx, Cfg{Issuer: idp.server.URL, ClientID: "client", AllowHTTP: true})
+	assert.NoError(t, err)
+}
+
+func TestExchange(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	idp := newFakeIdP(t)
+	idp.keys = []jwk{rsaJWK("rsa", &rsaKey.PublicKey), ecJWK("ec", &ecKey.PublicKey)}
+	provider, err := NewProvider(context.Background(), Cfg{Issuer: idp.server.URL, ClientID: "client", AllowHTTP: true})
+	require.NoError(t, err)
+
+	validClaims := func() idTokenClaims {
+		return idTokenClaims{
+			RegisteredClaims: jwt.RegisteredClaims{
+				Issuer:    idp.server.URL,
+				Subject:   "42",
+				Audience:  jwt.ClaimStrings{"client"},
+				ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Minute)),
+			},
+			Nonce:         "nonce",
+			Email:         "user@example.com",
+			EmailVerified: true,
+		}
+	}
+
+	tests := []struct {
+		name    string
+		token   func() string
+		wantErr bool
+	}{
+		{
+			name:  "Токен подписан ключом RSA провайдера",
+			token: func() string { return signToken(t, jwt.SigningMethodRS256, "rsa", rsaKey, validClaims()) },
+		},
+		{
+			name:  "Токен подписан ключом ECDSA провайдера",
+			token: func() string { return signToken(t, jwt.SigningMethodES256, "ec", ecKey, validClaims()) },
+		},
+		{
+			name:    "Токен подписан чужим ключом",
+			token:   func() string { return signToken(t, jwt.SigningMethodRS256, "rsa", otherKey, validClaims()) },
+			wantErr: true,
+		},
+		{
+			name:    "Неизвестный ключ",
+			token:   func() string { return signToken(t, jwt.SigningMethodRS256, "rotated", otherKey, validClaims()) },
+			wantErr: true,
+		},
+		{
+			name: "Токен без подписи",
+			token: func() string {
+				return signToken(t, jwt.SigningMethodNone, "rsa", jwt.UnsafeAllowNoneSignatureType, validClaims())
+			},
+			wantErr: true,
+		},
+		{
+			name: "Подпись HMAC открытым ключом",
+			token: func() string {
+				return signToken(t, jwt.SigningMethodHS256, "rsa", rsaKey.PublicKey.N.Bytes(), validClaims())
+			},
+			wantErr: true,
+		},
+		{
+			name: "Чужой получатель",
+			token: func() string {
+				claims := validClaims()
+				claims.Audience = jwt.ClaimStrings{"other"}
+				return signToken(t, jwt.SigningMethodRS256, "rsa", rsaKey, claims)
+			},
+			wantErr: true,
+		},
+		{
+			name: "Истекший токен",
+			token: func() string {
+				claims := validClaims()
+				claims.ExpiresAt = jwt.NewNumericDate(time.Now().Add(-time.Minute))
+				return signToken(t, jwt.SigningMethodRS256, "rsa", rsaKey, claims)
+			},
+			wantErr: true,
+		},
+		{
+			name: "Другой nonce",
+			token: func() string {
+				claims := validClaims()
+				claims.Nonce = "replayed"
+				return signToken(t, jwt.SigningMethodRS256, "rsa", rsaKey, claims)
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			idp.idToken = tt.token()
+			identity, err := provider.Exchange(context.Background(), "code", "verifier", "nonce")
+			if tt.wantErr {
+				assert.ErrorIs(t, err, ErrInvalidIDToken)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, "42", identity.Subject)
+			assert.Equal(t, "user@example.com", identity.Email)
+			assert.True(t, identity.EmailVerified)
+		})
+	}
+}
+
+func TestExchangeKeyRotation(t *testing.T) {
+	oldKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	newKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	idp := newFakeIdP(t)
+	idp.keys = []jwk{rsaJWK("old", &oldKey.PublicKey)}
+	provider, err := NewProvider(context.Background(), Cfg{Issuer: idp.server.URL, ClientID: "client", AllowHTTP: true})
+	require.NoError(t, err)
+	claims := idTokenClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    idp.server.URL,
+			Subject:   "42",
+			Audience:  jwt.ClaimStrings{"client"},
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Minute)),
+		},
+		Nonce: "nonce",
+	}
+
+	idp.idToken = signToken(t, jwt.SigningMethodRS256, "old", oldKey, claims)
+	_, err = provider.Exchange(context.Background(), "code", "verifier", "nonce")
+	require.NoError(t, err)
+
+	// Провайдер сменил ключ: новый ключ загружается не чаще jwksRefreshInterval
+	idp.keys = []jwk{rsaJWK("new", &newKey.PublicKey)}
+	idp.idToken = signToken(t, jwt.SigningMethodRS256, "new", newKey, claims)
+	_, err = provider.Exchange(context.Background(), "code", "verifier", "nonce")
+	assert.ErrorIs(t, err, ErrInvalidIDToken)
+
+	provider.keys.loadedAt = time.Now().Add(-jwksRefreshInterval)
+	_, err = provider.Exchange(context.Background(), "code", "verifier", "nonce")
+	assert.NoError(t, err)
+}
@@ -0,0 +1,103 @@
+package outbox
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/pinbrain/gophermart/internal/logger"
+	"github.com/pinbrain/gophermart/internal/model"
+)
+
+const (
+	// Сколько событий публикуется за один проход
+	batchSize = 100
+	// На это время событие закрепляется за экземпляром сервиса. Если публикация не удалась,
+	// событие публикуется повторно по истечении этого времени.
+	publishLease = 30 * time.Second
+)
+
+type Storage interface {
+	ClaimOutboxEvents(ctx context.Context, limit int, leaseUntil time.Time) ([]model.OutboxEvent, error)
+	CompleteOutboxEvent(ctx context.Context, eventID int64) error
+}
+
+// Publisher доставляет событие получателям. Событие может быть опубликовано повторно, если сбой
+// произошел после публикации, поэтому получатель должен отбрасывать повторы по ID события.
+type Publisher interface {
+	Publish(ctx context.Context, event model.OutboxEvent) error
+}
+
+// Relay периодически публикует события outbox в порядке записи и отмечает опубликованными.
+// Событие считается опубликованным, когда его приняли все получатели.
+type Relay struct {
+	storage    Storage
+	interval   time.Duration
+	publishers []Publisher
+
+	ctx       context.Context
+	ctxCancel context.CancelFunc
+	wg        sync.WaitGroup
+}
+
+// NewRelay создает задачу публикации событий outbox, которая запускается раз в interval
+func NewRelay(storage Storage, interval time.Duration, publishers ...Publisher) *Relay {
+	return &Relay{
+		storage:    storage,
+		interval:   interval,
+		publishers: publishers,
+		wg:         sync.WaitGroup{},
+	}
+}
+
+func (r *Relay) publish(event model.OutboxEvent) {
+	eventLogger := logger.Log.WithField("outboxEventID", event.ID).WithField("event", event.Event)
+	for _, publisher := range r.publishers {
+		if err := publisher.Publish(r.ctx, event); err != nil {
+			eventLogger.WithError(err).Warn("Failed to publish outbox event, will retry")
+			return
+		}
+	}
+	if err := r.storage.CompleteOutboxEvent(r.ctx, event.ID); err != nil {
+		eventLogger.WithError(err).Error("failed to complete outbox event")
+	}
+}
+
+func (r *Relay) relay() {
+	defer r.wg.Done()
+	for {
+		select {
+		case <-r.ctx.Done():
+			logger.Log.Debug("Outbox relay stopped")
+			return
+		case <-time.After(r.interval):
+			events, err := r.storage.ClaimOutboxEvents(r.ctx, batchSize, time.Now().Add(publishLease))
+			if err != nil {
+				logger.Log.WithError(err).Error("failed to claim outbox events")
+				continue
+			}
+			for _, event := range events {
+				if r.ctx.Err() != nil {
+					break
+				}
+				r.publish(event)
+			}
+		}
+	}
+}
+
+func (r *Relay) Start() {
+	r.ctx, r.ctxCancel = context.WithCancel(context.Background())
+
+	r.wg.Add(1)
+	go r.relay()
+}
+
+func (r *Relay) Stop() {
+	if err := r.ctx.Err(); err != nil {
+		logger.Log.Debug("Outbox relay already stopped")
+		return
+	}
+	r.ctxCancel()
+	r.wg.Wait()
+}
@@ -0,0 +1,125 @@
+package passwordpolicy
+
+import (
+	"bufio"
+	_ "embed"
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/pinbrain/gophermart/internal/model"
+)
+
+// Классы символов, наличие которых в пароле может требовать политика
+const (
+	ClassLower   = "lower"
+	ClassUpper   = "upper"
+	ClassDigit   = "digit"
+	ClassSpecial = "special"
+)
+
+// Правила политики, указываемые в ответе при нарушении
+const (
+	RuleMinLength = "min_length"
+	RuleClass     = "character_class"
+	RuleCommon    = "common_password"
+)
+
+//go:embed common.txt
+var commonPasswordsList string
+
+var classNames = map[string]string{
+	ClassLower:   "строчную букву",
+	ClassUpper:   "заглавную букву",
+	ClassDigit:   "цифру",
+	ClassSpecial: "специальный символ",
+}
+
+type Cfg struct {
+	// Минимальная длина пароля в символах
+	MinLength int
+	// Классы символов, каждый из которых должен присутствовать в пароле
+	RequiredClasses []string
+	// Запретить распространенные пароли
+	DenyCommon bool
+}
+
+// Policy проверяет стойкость паролей. Методы безопасно вызывать у nil, в этом случае
+// допускается любой пароль.
+type Policy struct {
+	cfg    Cfg
+	common map[string]struct{}
+}
+
+func New(cfg Cfg) (*Policy, error) {
+	for _, class := range cfg.RequiredClasses {
+		if _, ok := classNames[class]; !ok {
+			return nil, fmt.Errorf("unknown password character class %q", class)
+		}
+	}
+	p := &Policy{cfg: cfg}
+	if cfg.DenyCommon {
+		p.common = make(map[string]struct{})
+		scanner := bufio.NewScanner(strings.NewReader(commonPasswordsList))
+		for scanner.Scan() {
+			if line := strings.TrimSpace(scanner.Text()); line != "" {
+				p.common[line] = struct{}{}
+			}
+		}
+	}
+	return p, nil
+}
+
+// Validate возвращает нарушенные паролем правила, пустой результат - пароль допустим
+func (p *Policy) Validate(password string) []model.PasswordViolation {
+	if p == nil {
+		return nil
+	}
+	var violations []model.PasswordViolation
+	if utf8.RuneCountInString(password) < p.cfg.MinLength {
+		violations = append(violations, model.PasswordViolation{
+			Rule:    RuleMinLength,
+			Message: fmt.Sprintf("Пароль должен содержать не менее %d символов", p.cfg.MinLength),
+		})
+	}
+	for _, class := range p.cfg.RequiredClasses {
+		if !containsClass(password, class) {
+			violations = append(violations, model.PasswordViolation{
+				Rule:    RuleClass,
+				Message: "Пароль должен содержать " + classNames[class],
+			})
+		}
+	}
+	if _, ok := p.common[strings.ToLower(password)]; ok {
+		violations = append(violations, model.PasswordViolation{
+			Rule:    RuleCommon,
+			Message: "Пароль слишком распространен",
+		})
+	}
+	return violations
+}
+
+func containsClass(password, class string) bool {
+	for _, r := range password {
+		switch class {
+		case ClassLower:
+			if unicode.IsLower(r) {
+				return true
+			}
+		case ClassUpper:
+			if unicode.IsUpper(r) {
+				return true
+			}
+		case ClassDigit:
+			if unicode.IsDigit(r) {
+				return true
+			}
+		case ClassSpecial:
+			if !unicode.IsLetter(r) && !unicode.IsDigit(r) && !unicode.IsSpace(r) {
+				return true
+			}
+		}
+	}
+	return false
+}
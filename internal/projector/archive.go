@@ -0,0 +1,82 @@
+package projector
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/pinbrain/gophermart/internal/logger"
+)
+
+// Количество заказов, переносимых в архив за один запрос
+const archiveBatchSize = 500
+
+type ArchiveStorage interface {
+	ArchiveOrders(ctx context.Context, olderThan time.Time, limit int) (int, error)
+}
+
+// OrderArchiver периодически переносит в архив обработанные заказы старше заданного возраста
+type OrderArchiver struct {
+	storage  ArchiveStorage
+	age      time.Duration
+	interval time.Duration
+
+	ctx       context.Context
+	ctxCancel context.CancelFunc
+	wg        sync.WaitGroup
+}
+
+// NewOrderArchiver создает задачу архивации заказов, статус которых не менялся дольше age.
+// Задача запускается раз в interval.
+func NewOrderArchiver(storage ArchiveStorage, age, interval time.Duration) *OrderArchiver {
+	return &OrderArchiver{
+		storage:  storage,
+		age:      age,
+		interval: interval,
+		wg:       sync.WaitGroup{},
+	}
+}
+
+func (oa *OrderArchiver) archive() {
+	defer oa.wg.Done()
+	for {
+		select {
+		case <-oa.ctx.Done():
+			logger.Log.Debug("Order archiver stopped")
+			return
+		case <-time.After(oa.interval):
+			olderThan := time.Now().Add(-oa.age)
+			total := 0
+			for {
+				archived, err := oa.storage.ArchiveOrders(oa.ctx, olderThan, archiveBatchSize)
+				total += archived
+				if err != nil {
+					logger.Log.WithError(err).Error("failed to archive orders")
+					break
+				}
+				if archived < archiveBatchSize {
+					break
+				}
+			}
+			if total > 0 {
+				logger.Log.Debugf("Archived %d orders", total)
+			}
+		}
+	}
+}
+
+func (oa *OrderArchiver) Start() {
+	oa.ctx, oa.ctxCancel = context.WithCancel(context.Background())
+
+	oa.wg.Add(1)
+	go oa.archive()
+}
+
+func (oa *OrderArchiver) Stop() {
+	if err := oa.ctx.Err(); err != nil {
+		logger.Log.Debug("Order archiver already stopped")
+		return
+	}
+	oa.ctxCancel()
+	oa.wg.Wait()
+}
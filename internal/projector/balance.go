@@ -0,0 +1,83 @@
+package projector
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/pinbrain/gophermart/internal/logger"
+)
+
+const (
+	// Интервал проверки наличия событий, не учтенных в балансах
+	projectInterval = time.Second
+	// Количество балансов, обновляемых за одну транзакцию
+	projectBatchSize = 100
+)
+
+type Storage interface {
+	ProjectBalances(ctx context.Context, limit int) (int, error)
+	ReplayBalances(ctx context.Context) error
+}
+
+// BalanceProjector поддерживает таблицу балансов в актуальном состоянии по журналу событий
+type BalanceProjector struct {
+	storage Storage
+
+	ctx       context.Context
+	ctxCancel context.CancelFunc
+	wg        sync.WaitGroup
+}
+
+func NewBalanceProjector(storage Storage) *BalanceProjector {
+	return &BalanceProjector{
+		storage: storage,
+		wg:      sync.WaitGroup{},
+	}
+}
+
+// Replay пересчитывает все балансы с начала журнала событий
+func (bp *BalanceProjector) Replay(ctx context.Context) error {
+	return bp.storage.ReplayBalances(ctx)
+}
+
+func (bp *BalanceProjector) project() {
+	defer bp.wg.Done()
+	for {
+		select {
+		case <-bp.ctx.Done():
+			logger.Log.Debug("Balance projector stopped")
+			return
+		case <-time.After(projectInterval):
+			for {
+				projected, err := bp.storage.ProjectBalances(bp.ctx, projectBatchSize)
+				if err != nil {
+					logger.Log.WithError(err).Error("failed to project balances")
+					break
+				}
+				if projected > 0 {
+					logger.Log.Debugf("Projected %d balances", projected)
+				}
+				if projected < projectBatchSize {
+					break
+				}
+			}
+		}
+	}
+}
+
+func (bp *BalanceProjector) Start() {
+	bp.ctx, bp.ctxCancel = context.WithCancel(context.Background())
+
+	bp.wg.Add(1)
+	go bp.project()
+}
+
+func (bp *BalanceProjector) Stop() {
+	if err := bp.ctx.Err(); err != nil {
+		logger.Log.Debug("Balance projector already stopped")
+		return
+	}
+	bp.ctxCancel()
+	bp.wg.Wait()
+}
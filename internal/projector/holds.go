@@ -0,0 +1,95 @@
+package projector
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/pinbrain/gophermart/internal/logger"
+	"github.com/pinbrain/gophermart/internal/model"
+)
+
+// Количество резервов, снимаемых за один проход
+const releaseBatchSize = 100
+
+type HoldStorage interface {
+	ReleaseExpiredHolds(ctx context.Context, limit int) ([]model.Hold, error)
+}
+
+// BalancePublisher сообщает пользователю об изменении его баланса
+type BalancePublisher interface {
+	PublishBalanceChange(userID int, event model.BalanceChangeEvent)
+}
+
+// HoldReleaser периодически снимает истекшие резервы баллов и возвращает баллы на балансы пользователей
+type HoldReleaser struct {
+	storage   HoldStorage
+	publisher BalancePublisher
+	interval  time.Duration
+
+	ctx       context.Context
+	ctxCancel context.CancelFunc
+	wg        sync.WaitGroup
+}
+
+// NewHoldReleaser создает задачу снятия резервов, запускаемую раз в interval.
+// publisher может быть nil, тогда пользователи не уведомляются о возврате баллов.
+func NewHoldReleaser(storage HoldStorage, publisher BalancePublisher, interval time.Duration) *HoldReleaser {
+	return &HoldReleaser{
+		storage:   storage,
+		publisher: publisher,
+		interval:  interval,
+		wg:        sync.WaitGroup{},
+	}
+}
+
+func (hr *HoldReleaser) release() {
+	defer hr.wg.Done()
+	for {
+		select {
+		case <-hr.ctx.Done():
+			logger.Log.Debug("Hold releaser stopped")
+			return
+		case <-time.After(hr.interval):
+			for {
+				released, err := hr.storage.ReleaseExpiredHolds(hr.ctx, releaseBatchSize)
+				for _, hold := range released {
+					if hr.publisher != nil {
+						hr.publisher.PublishBalanceChange(hold.UserID, model.BalanceChangeEvent{
+							Type:      model.BalanceEventHoldRelease,
+							Number:    hold.Number,
+							Amount:    hold.Sum,
+							CreatedAt: time.Now(),
+						})
+					}
+				}
+				if len(released) > 0 {
+					logger.Log.Debugf("Released %d expired holds", len(released))
+				}
+				if err != nil {
+					logger.Log.WithError(err).Error("failed to release expired holds")
+					break
+				}
+				if len(released) < releaseBatchSize {
+					break
+				}
+			}
+		}
+	}
+}
+
+func (hr *HoldReleaser) Start() {
+	hr.ctx, hr.ctxCancel = context.WithCancel(context.Background())
+
+	hr.wg.Add(1)
+	go hr.release()
+}
+
+func (hr *HoldReleaser) Stop() {
+	if err := hr.ctx.Err(); err != nil {
+		logger.Log.Debug("Hold releaser already stopped")
+		return
+	}
+	hr.ctxCancel()
+	hr.wg.Wait()
+}
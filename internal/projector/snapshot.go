@@ -0,0 +1,69 @@
+package projector
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/pinbrain/gophermart/internal/logger"
+)
+
+type SnapshotStorage interface {
+	SnapshotBalances(ctx context.Context, before time.Time) (int, error)
+}
+
+// BalanceSnapshotter периодически сохраняет снимки балансов и переносит
+// учтенные в них события в архив, чтобы журнал событий не рос бесконечно
+type BalanceSnapshotter struct {
+	storage   SnapshotStorage
+	interval  time.Duration
+	retention time.Duration
+
+	ctx       context.Context
+	ctxCancel context.CancelFunc
+	wg        sync.WaitGroup
+}
+
+// NewBalanceSnapshotter создает задачу снимков: раз в interval в снимки попадают события старше retention
+func NewBalanceSnapshotter(storage SnapshotStorage, interval, retention time.Duration) *BalanceSnapshotter {
+	return &BalanceSnapshotter{
+		storage:   storage,
+		interval:  interval,
+		retention: retention,
+		wg:        sync.WaitGroup{},
+	}
+}
+
+func (bs *BalanceSnapshotter) snapshot() {
+	defer bs.wg.Done()
+	for {
+		select {
+		case <-bs.ctx.Done():
+			logger.Log.Debug("Balance snapshotter stopped")
+			return
+		case <-time.After(bs.interval):
+			snapshots, err := bs.storage.SnapshotBalances(bs.ctx, time.Now().Add(-bs.retention))
+			if err != nil {
+				logger.Log.WithError(err).Error("failed to snapshot balances")
+				continue
+			}
+			logger.Log.Debugf("Updated %d balance snapshots", snapshots)
+		}
+	}
+}
+
+func (bs *BalanceSnapshotter) Start() {
+	bs.ctx, bs.ctxCancel = context.WithCancel(context.Background())
+
+	bs.wg.Add(1)
+	go bs.snapshot()
+}
+
+func (bs *BalanceSnapshotter) Stop() {
+	if err := bs.ctx.Err(); err != nil {
+		logger.Log.Debug("Balance snapshotter already stopped")
+		return
+	}
+	bs.ctxCancel()
+	bs.wg.Wait()
+}
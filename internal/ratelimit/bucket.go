@@ -0,0 +1,76 @@
+package ratelimit
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+)
+
+type bucket struct {
+	tokens    float64
+	updatedAt time.Time
+}
+
+// TokenBucketLimiter ограничивает запросы алгоритмом token bucket: ключу доступно burst запросов подряд,
+// после чего запросы разрешаются со средней частотой rps. Корзины хранятся в памяти процесса.
+type TokenBucketLimiter struct {
+	rps   float64
+	burst int
+
+	mu      sync.Mutex
+	buckets map[string]*bucket
+}
+
+func NewTokenBucketLimiter(rps float64, burst int) *TokenBucketLimiter {
+	return &TokenBucketLimiter{
+		rps:     rps,
+		burst:   burst,
+		buckets: make(map[string]*bucket),
+	}
+}
+
+func (tl *TokenBucketLimiter) Allow(_ context.Context, key string) (Result, error) {
+	now := time.Now()
+
+	tl.mu.Lock()
+	defer tl.mu.Unlock()
+
+	b, ok := tl.buckets[key]
+	if !ok {
+		// Заодно удаляем заполнившиеся корзины, они ничем не отличаются от новых
+		for k, v := range tl.buckets {
+			if tl.refill(v, now) >= float64(tl.burst) {
+				delete(tl.buckets, k)
+			}
+		}
+		b = &bucket{tokens: float64(tl.burst), updatedAt: now}
+		tl.buckets[key] = b
+	}
+	b.tokens = tl.refill(b, now)
+	b.updatedAt = now
+	allowed := b.tokens >= 1
+	if allowed {
+		b.tokens--
+	}
+
+	return newBucketResult(allowed, b.tokens, tl.rps, tl.burst), nil
+}
+
+// refill возвращает количество токенов в корзине на момент now
+func (tl *TokenBucketLimiter) refill(b *bucket, now time.Time) float64 {
+	return math.Min(float64(tl.burst), b.tokens+now.Sub(b.updatedAt).Seconds()*tl.rps)
+}
+
+func newBucketResult(allowed bool, tokens, rps float64, burst int) Result {
+	res := Result{
+		Allowed:   allowed,
+		Limit:     burst,
+		Remaining: int(tokens),
+		Reset:     time.Duration((float64(burst) - tokens) / rps * float64(time.Second)),
+	}
+	if !allowed {
+		res.RetryAfter = time.Duration((1 - tokens) / rps * float64(time.Second))
+	}
+	return res
+}
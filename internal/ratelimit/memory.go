@@ -0,0 +1,52 @@
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+type window struct {
+	count   int
+	resetAt time.Time
+}
+
+// MemoryLimiter считает запросы в фиксированном окне и хранит счетчики в памяти процесса,
+// лимиты действуют в пределах одного экземпляра сервиса
+type MemoryLimiter struct {
+	limit  int
+	window time.Duration
+
+	mu      sync.Mutex
+	windows map[string]*window
+}
+
+func NewMemoryLimiter(limit int, windowDuration time.Duration) *MemoryLimiter {
+	return &MemoryLimiter{
+		limit:   limit,
+		window:  windowDuration,
+		windows: make(map[string]*window),
+	}
+}
+
+func (ml *MemoryLimiter) Allow(_ context.Context, key string) (Result, error) {
+	now := time.Now()
+
+	ml.mu.Lock()
+	defer ml.mu.Unlock()
+
+	w, ok := ml.windows[key]
+	if !ok || !now.Before(w.resetAt) {
+		// Заодно удаляем истекшие окна, чтобы карта не росла бесконечно
+		for k, v := range ml.windows {
+			if !now.Before(v.resetAt) {
+				delete(ml.windows, k)
+			}
+		}
+		w = &window{resetAt: now.Add(ml.window)}
+		ml.windows[key] = w
+	}
+	w.count++
+
+	return newResult(w.count, ml.limit, w.resetAt.Sub(now)), nil
+}
@@ -0,0 +1,38 @@
+package ratelimit
+
+import (
+	"context"
+	"time"
+)
+
+// Result результат проверки лимита запросов
+type Result struct {
+	Allowed bool
+	// Максимальное количество запросов в окне
+	Limit int
+	// Оставшееся количество запросов в текущем окне
+	Remaining int
+	// Через сколько можно повторить отклоненный запрос
+	RetryAfter time.Duration
+	// Время до полного восстановления лимита
+	Reset time.Duration
+}
+
+// Limiter ограничивает количество запросов по ключу
+type Limiter interface {
+	Allow(ctx context.Context, key string) (Result, error)
+}
+
+func newResult(count, limit int, ttl time.Duration) Result {
+	remaining := limit - count
+	if remaining < 0 {
+		remaining = 0
+	}
+	return Result{
+		Allowed:    count <= limit,
+		Limit:      limit,
+		Remaining:  remaining,
+		RetryAfter: ttl,
+		Reset:      ttl,
+	}
+}
@@ -0,0 +1,48 @@
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Скрипт атомарно увеличивает счетчик окна и возвращает его значение вместе с оставшимся временем жизни окна
+var incrScript = redis.NewScript(`
+local count = redis.call('INCR', KEYS[1])
+if count == 1 then
+	redis.call('PEXPIRE', KEYS[1], ARGV[1])
+end
+return {count, redis.call('PTTL', KEYS[1])}
+`)
+
+// RedisLimiter считает запросы в фиксированном окне и хранит счетчики в Redis,
+// лимиты действуют сразу для всех экземпляров сервиса
+type RedisLimiter struct {
+	client *redis.Client
+	prefix string
+	limit  int
+	window time.Duration
+}
+
+func NewRedisLimiter(client *redis.Client, prefix string, limit int, window time.Duration) *RedisLimiter {
+	return &RedisLimiter{
+		client: client,
+		prefix: prefix,
+		limit:  limit,
+		window: window,
+	}
+}
+
+func (rl *RedisLimiter) Allow(ctx context.Context, key string) (Result, error) {
+	res, err := incrScript.Run(ctx, rl.client, []string{rl.prefix + ":" + key}, rl.window.Milliseconds()).Int64Slice()
+	if err != nil {
+		return Result{}, fmt.Errorf("failed to increment rate limit counter: %w", err)
+	}
+	count, ttl := res[0], time.Duration(res[1])*time.Millisecond
+	if ttl < 0 {
+		ttl = rl.window
+	}
+	return newResult(int(count), rl.limit, ttl), nil
+}
@@ -0,0 +1,67 @@
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Скрипт атомарно пополняет корзину по прошедшему времени, забирает из нее токен, если он есть,
+// и возвращает признак разрешения запроса вместе с оставшимся количеством токенов
+var bucketScript = redis.NewScript(`
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+local state = redis.call('HMGET', KEYS[1], 'tokens', 'ts')
+local tokens = tonumber(state[1]) or burst
+local ts = tonumber(state[2]) or now
+tokens = math.min(burst, tokens + math.max(0, now - ts) * rate)
+local allowed = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	allowed = 1
+end
+redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'ts', tostring(now))
+redis.call('PEXPIRE', KEYS[1], math.ceil((burst - tokens) / rate) + 1)
+return {allowed, tostring(tokens)}
+`)
+
+// RedisTokenBucketLimiter - TokenBucketLimiter с корзинами в Redis, лимиты действуют сразу
+// для всех экземпляров сервиса
+type RedisTokenBucketLimiter struct {
+	client *redis.Client
+	prefix string
+	rps    float64
+	burst  int
+}
+
+func NewRedisTokenBucketLimiter(client *redis.Client, prefix string, rps float64, burst int) *RedisTokenBucketLimiter {
+	return &RedisTokenBucketLimiter{
+		client: client,
+		prefix: prefix,
+		rps:    rps,
+		burst:  burst,
+	}
+}
+
+func (rl *RedisTokenBucketLimiter) Allow(ctx context.Context, key string) (Result, error) {
+	res, err := bucketScript.Run(ctx, rl.client, []string{rl.prefix + ":" + key},
+		rl.rps/1000, rl.burst, time.Now().UnixMilli(),
+	).Slice()
+	if err != nil {
+		return Result{}, fmt.Errorf("failed to take rate limit token: %w", err)
+	}
+	if len(res) != 2 {
+		return Result{}, fmt.Errorf("unexpected rate limit script result: %v", res)
+	}
+	allowed, _ := res[0].(int64)
+	tokensStr, _ := res[1].(string)
+	tokens, err := strconv.ParseFloat(tokensStr, 64)
+	if err != nil {
+		return Result{}, fmt.Errorf("failed to parse rate limit tokens: %w", err)
+	}
+	return newBucketResult(allowed == 1, tokens, rl.rps, rl.burst), nil
+}
@@ -0,0 +1,41 @@
+package revocation
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// MemoryStore хранит отозванные токены в памяти процесса, отзыв действует в пределах одного экземпляра сервиса
+type MemoryStore struct {
+	mu      sync.Mutex
+	revoked map[string]time.Time
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{revoked: make(map[string]time.Time)}
+}
+
+func (ms *MemoryStore) RevokeToken(_ context.Context, jti string, expiresAt time.Time) error {
+	now := time.Now()
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	// Заодно удаляем истекшие токены, чтобы карта не росла бесконечно
+	for k, v := range ms.revoked {
+		if !now.Before(v) {
+			delete(ms.revoked, k)
+		}
+	}
+	ms.revoked[jti] = expiresAt
+	return nil
+}
+
+func (ms *MemoryStore) IsTokenRevoked(_ context.Context, jti string) (bool, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	expiresAt, ok := ms.revoked[jti]
+	return ok && time.Now().Before(expiresAt), nil
+}
@@ -0,0 +1,12 @@
+package revocation
+
+import (
+	"context"
+	"time"
+)
+
+// Store хранит идентификаторы (jti) отозванных токенов пользователей до окончания их срока действия
+type Store interface {
+	RevokeToken(ctx context.Context, jti string, expiresAt time.Time) error
+	IsTokenRevoked(ctx context.Context, jti string) (bool, error)
+}
@@ -0,0 +1,57 @@
+// Package service содержит операции, объединяющие несколько изменений хранилища в одну транзакцию
+package service
+
+import (
+	"context"
+
+	"github.com/pinbrain/gophermart/internal/model"
+	"github.com/pinbrain/gophermart/internal/storage"
+)
+
+type OrderStorage interface {
+	storage.TxManager
+	LockOrder(ctx context.Context, orderID int) (*model.Order, error)
+	CreditAccrual(ctx context.Context, userID int, orderNum string, accrual model.Money) (model.Money, error)
+	SetOrderStatus(ctx context.Context, order *model.Order, status model.OrderStatus, accrual *model.Money) error
+}
+
+// Orders - операции с заказами, затрагивающие баланс пользователя
+type Orders struct {
+	storage OrderStorage
+}
+
+func NewOrders(storage OrderStorage) *Orders {
+	return &Orders{storage: storage}
+}
+
+// UpdateOrderStatus устанавливает статус заказа и начисляет баллы по нему в одной транзакции: если
+// статус не удалось сохранить, начисление откатывается. Баллы начисляются только при переходе заказа
+// в PROCESSED, возвращается фактически начисленная сумма. Заказ в окончательном статусе не меняется,
+// чтобы повторный запрос того же результата, например, вторым воркером, не начислил баллы дважды,
+// в этом случае возвращается ранее начисленная сумма.
+func (o *Orders) UpdateOrderStatus(
+	ctx context.Context, orderID int, status model.OrderStatus, accrual model.Money,
+) (model.Money, error) {
+	err := o.storage.WithinTransaction(ctx, func(ctx context.Context) error {
+		order, err := o.storage.LockOrder(ctx, orderID)
+		if err != nil {
+			return err
+		}
+		if order.Status.IsFinal() {
+			accrual = order.Accrual
+			return nil
+		}
+		var credited *model.Money
+		if accrual > 0 && status == model.OrderProcessed {
+			if accrual, err = o.storage.CreditAccrual(ctx, order.UserID, order.Number, accrual); err != nil {
+				return err
+			}
+			credited = &accrual
+		}
+		return o.storage.SetOrderStatus(ctx, order, status, credited)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return accrual, nil
+}
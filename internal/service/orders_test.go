@@ -0,0 +1,149 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/pinbrain/gophermart/internal/model"
+	"github.com/pinbrain/gophermart/internal/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var errSetStatus = errors.New("set status failed")
+
+// txStorage хранит заказы и балансы в памяти. WithinTransaction восстанавливает состояние
+// на момент начала транзакции, если fn вернула ошибку.
+type txStorage struct {
+	orders   map[int]model.Order
+	balances map[int]model.Money
+
+	failSetStatus bool
+}
+
+func (s *txStorage) WithinTransaction(ctx context.Context, fn func(ctx context.Context) error) error {
+	orders := make(map[int]model.Order, len(s.orders))
+	for id, order := range s.orders {
+		orders[id] = order
+	}
+	balances := make(map[int]model.Money, len(s.balances))
+	for id, balance := range s.balances {
+		balances[id] = balance
+	}
+	if err := fn(ctx); err != nil {
+		s.orders, s.balances = orders, balances
+		return err
+	}
+	return nil
+}
+
+func (s *txStorage) LockOrder(_ context.Context, orderID int) (*model.Order, error) {
+	order, ok := s.orders[orderID]
+	if !ok {
+		return nil, storage.ErrNoOrder
+	}
+	return &order, nil
+}
+
+func (s *txStorage) CreditAccrual(_ context.Context, userID int, _ string, accrual model.Money) (model.Money, error) {
+	s.balances[userID] += accrual
+	return accrual, nil
+}
+
+func (s *txStorage) SetOrderStatus(
+	_ context.Context, order *model.Order, status model.OrderStatus, accrual *model.Money,
+) error {
+	updated := *order
+	updated.Status = status
+	if accrual != nil {
+		updated.Accrual = *accrual
+	}
+	s.orders[order.ID] = updated
+	// Ошибка после записи, например, при сохранении истории статусов
+	if s.failSetStatus {
+		return errSetStatus
+	}
+	return nil
+}
+
+func TestUpdateOrderStatus(t *testing.T) {
+	tests := []struct {
+		name          string
+		order         model.Order
+		status        model.OrderStatus
+		accrual       model.Money
+		failSetStatus bool
+		wantErr       error
+		wantCredited  model.Money
+		wantOrder     model.Order
+		wantBalance   model.Money
+	}{
+		{
+			name:         "Начисление по обработанному заказу",
+			order:        model.Order{ID: 1, UserID: 10, Number: "12345678903", Status: model.OrderProcessing},
+			status:       model.OrderProcessed,
+			accrual:      500,
+			wantCredited: 500,
+			wantOrder: model.Order{
+				ID: 1, UserID: 10, Number: "12345678903", Status: model.OrderProcessed, Accrual: 500,
+			},
+			wantBalance: 600,
+		},
+		{
+			name:          "Ошибка сохранения статуса откатывает начисление и статус",
+			order:         model.Order{ID: 1, UserID: 10, Number: "12345678903", Status: model.OrderProcessing},
+			status:        model.OrderProcessed,
+			accrual:       500,
+			failSetStatus: true,
+			wantErr:       errSetStatus,
+			wantOrder:     model.Order{ID: 1, UserID: 10, Number: "12345678903", Status: model.OrderProcessing},
+			wantBalance:   100,
+		},
+		{
+			name: "Заказ в окончательном статусе не меняется",
+			order: model.Order{
+				ID: 1, UserID: 10, Number: "12345678903", Status: model.OrderProcessed, Accrual: 300,
+			},
+			status:       model.OrderProcessed,
+			accrual:      500,
+			wantCredited: 300,
+			wantOrder: model.Order{
+				ID: 1, UserID: 10, Number: "12345678903", Status: model.OrderProcessed, Accrual: 300,
+			},
+			wantBalance: 100,
+		},
+		{
+			name:         "Без начисления при переходе в PROCESSING",
+			order:        model.Order{ID: 1, UserID: 10, Number: "12345678903", Status: model.OrderNew},
+			status:       model.OrderProcessing,
+			wantCredited: 0,
+			wantOrder:    model.Order{ID: 1, UserID: 10, Number: "12345678903", Status: model.OrderProcessing},
+			wantBalance:  100,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			st := &txStorage{
+				orders:        map[int]model.Order{tt.order.ID: tt.order},
+				balances:      map[int]model.Money{tt.order.UserID: 100},
+				failSetStatus: tt.failSetStatus,
+			}
+			credited, err := NewOrders(st).UpdateOrderStatus(context.Background(), tt.order.ID, tt.status, tt.accrual)
+			if tt.wantErr != nil {
+				require.ErrorIs(t, err, tt.wantErr)
+			} else {
+				require.NoError(t, err)
+				assert.Equal(t, tt.wantCredited, credited)
+			}
+			assert.Equal(t, tt.wantOrder, st.orders[tt.order.ID])
+			assert.Equal(t, tt.wantBalance, st.balances[tt.order.UserID])
+		})
+	}
+}
+
+func TestUpdateOrderStatusNoOrder(t *testing.T) {
+	st := &txStorage{orders: map[int]model.Order{}, balances: map[int]model.Money{}}
+	_, err := NewOrders(st).UpdateOrderStatus(context.Background(), 1, model.OrderProcessed, 500)
+	assert.ErrorIs(t, err, storage.ErrNoOrder)
+}
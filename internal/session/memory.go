@@ -0,0 +1,127 @@
+package session
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pinbrain/gophermart/internal/model"
+)
+
+// MemoryStore хранит сессии в памяти процесса, сессии действуют в пределах одного экземпляра сервиса
+// и теряются при его перезапуске
+type MemoryStore struct {
+	mu       sync.Mutex
+	sessions map[string]model.Session
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{sessions: make(map[string]model.Session)}
+}
+
+func (ms *MemoryStore) CreateSession(_ context.Context, s model.Session) error {
+	now := time.Now()
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	// Заодно удаляем истекшие сессии, чтобы карта не росла бесконечно
+	for k, v := range ms.sessions {
+		if !now.Before(v.ExpiresAt) {
+			delete(ms.sessions, k)
+		}
+	}
+	ms.sessions[HashID(s.ID)] = s
+	return nil
+}
+
+func (ms *MemoryStore) GetSession(_ context.Context, id string) (*model.Session, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	s, ok := ms.sessions[HashID(id)]
+	if !ok || !time.Now().Before(s.ExpiresAt) {
+		return nil, ErrNoSession
+	}
+	return &s, nil
+}
+
+func (ms *MemoryStore) TouchSession(_ context.Context, id string, lastSeenAt time.Time) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	hash := HashID(id)
+	if s, ok := ms.sessions[hash]; ok {
+		s.LastSeenAt = lastSeenAt
+		ms.sessions[hash] = s
+	}
+	return nil
+}
+
+func (ms *MemoryStore) ElevateSession(_ context.Context, id string, until time.Time) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	hash := HashID(id)
+	s, ok := ms.sessions[hash]
+	if !ok {
+		return ErrNoSession
+	}
+	s.ElevatedUntil = until
+	ms.sessions[hash] = s
+	return nil
+}
+
+func (ms *MemoryStore) DeleteSession(_ context.Context, id string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	delete(ms.sessions, HashID(id))
+	return nil
+}
+
+func (ms *MemoryStore) DeleteUserSessions(_ context.Context, userID int) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	for k, v := range ms.sessions {
+		if v.UserID == userID {
+			delete(ms.sessions, k)
+		}
+	}
+	return nil
+}
+
+func (ms *MemoryStore) ListUserSessions(_ context.Context, userID int) ([]model.Session, error) {
+	now := time.Now()
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	sessions := []model.Session{}
+	for hash, s := range ms.sessions {
+		if s.UserID != userID || !now.Before(s.ExpiresAt) {
+			continue
+		}
+		s.ID = ""
+		s.PublicID = hash
+		sessions = append(sessions, s)
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].CreatedAt.After(sessions[j].CreatedAt)
+	})
+	return sessions, nil
+}
+
+func (ms *MemoryStore) DeleteUserSession(_ context.Context, userID int, publicID string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	s, ok := ms.sessions[publicID]
+	if !ok || s.UserID != userID {
+		return ErrNoSession
+	}
+	delete(ms.sessions, publicID)
+	return nil
+}
@@ -0,0 +1,262 @@
+package session
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/pinbrain/gophermart/internal/model"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	sessionKeyPrefix      = "session:"
+	userSessionsKeyPrefix = "user_sessions:"
+)
+
+// redisSession - представление сессии в Redis
+type redisSession struct {
+	UserID     int       `json:"user_id"`
+	Login      string    `json:"login"`
+	IP         string    `json:"ip"`
+	UserAgent  string    `json:"user_agent"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastSeenAt time.Time `json:"last_seen_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	// До какого момента сессия подтверждена повторным вводом пароля
+	ElevatedUntil time.Time `json:"elevated_until,omitempty"`
+}
+
+// RedisStore хранит сессии в Redis, время жизни ключей совпадает со сроком действия сессий
+type RedisStore struct {
+	client *redis.Client
+}
+
+func NewRedisStore(client *redis.Client) *RedisStore {
+	return &RedisStore{client: client}
+}
+
+func sessionKey(hash string) string {
+	return sessionKeyPrefix + hash
+}
+
+func userSessionsKey(userID int) string {
+	return userSessionsKeyPrefix + strconv.Itoa(userID)
+}
+
+func (rs *RedisStore) CreateSession(ctx context.Context, s model.Session) error {
+	data, err := json.Marshal(redisSession{
+		UserID:     s.UserID,
+		Login:      s.Login,
+		IP:         s.IP,
+		UserAgent:  s.UserAgent,
+		CreatedAt:  s.CreatedAt,
+		LastSeenAt: s.LastSeenAt,
+		ExpiresAt:  s.ExpiresAt,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to encode session: %w", err)
+	}
+	hash := HashID(s.ID)
+	_, err = rs.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, sessionKey(hash), data, time.Until(s.ExpiresAt))
+		pipe.SAdd(ctx, userSessionsKey(s.UserID), hash)
+		// Срок действия у всех сессий одинаковый, поэтому индекс сессий пользователя
+		// живет до истечения последней созданной из них
+		pipe.Expire(ctx, userSessionsKey(s.UserID), time.Until(s.ExpiresAt))
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create session: %w", err)
+	}
+	return nil
+}
+
+func (rs *RedisStore) getSession(ctx context.Context, hash string) (*redisSession, error) {
+	data, err := rs.client.Get(ctx, sessionKey(hash)).Bytes()
+	if err != nil {
+		if errors.Is(err, redis.Nil) {
+			return nil, ErrNoSession
+		}
+		return nil, fmt.Errorf("failed to get session: %w", err)
+	}
+	var rsess redisSession
+	if err = json.Unmarshal(data, &rsess); err != nil {
+		return nil, fmt.Errorf("failed to decode session: %w", err)
+	}
+	return &rsess, nil
+}
+
+func (rs *RedisStore) GetSession(ctx context.Context, id string) (*model.Session, error) {
+	rsess, err := rs.getSession(ctx, HashID(id))
+	if err != nil {
+		return nil, err
+	}
+	return &model.Session{
+		ID:         id,
+		UserID:     rsess.UserID,
+		Login:      rsess.Login,
+		IP:         rsess.IP,
+		UserAgent:  rsess.UserAgent,
+		CreatedAt:  rsess.CreatedAt,
+		LastSeenAt: rsess.LastSeenAt,
+		ExpiresAt:  rsess.ExpiresAt,
+
+		ElevatedUntil: rsess.ElevatedUntil,
+	}, nil
+}
+
+func (rs *RedisStore) TouchSession(ctx context.Context, id string, lastSeenAt time.Time) error {
+	err := rs.updateSession(ctx, id, func(rsess *redisSession) {
+		rsess.LastSeenAt = lastSeenAt
+	})
+	if err != nil {
+		return fmt.Errorf("failed to touch session: %w", err)
+	}
+	return nil
+}
+
+func (rs *RedisStore) ElevateSession(ctx context.Context, id string, until time.Time) error {
+	err := rs.updateSession(ctx, id, func(rsess *redisSession) {
+		rsess.ElevatedUntil = until
+	})
+	if err != nil {
+		return fmt.Errorf("failed to elevate session: %w", err)
+	}
+	return nil
+}
+
+// updateSession изменяет сессию, сохраняя время жизни ключа. Сессия, истекшая во время
+// изменения, не восстанавливается.
+func (rs *RedisStore) updateSession(ctx context.Context, id string, update func(*redisSession)) error {
+	hash := HashID(id)
+	rsess, err := rs.getSession(ctx, hash)
+	if err != nil {
+		return err
+	}
+	update(rsess)
+	data, err := json.Marshal(rsess)
+	if err != nil {
+		return fmt.Errorf("failed to encode session: %w", err)
+	}
+	if err = rs.client.SetArgs(ctx, sessionKey(hash), data, redis.SetArgs{KeepTTL: true, Mode: "XX"}).Err(); err != nil &&
+		!errors.Is(err, redis.Nil) {
+		return err
+	}
+	return nil
+}
+
+func (rs *RedisStore) DeleteSession(ctx context.Context, id string) error {
+	hash := HashID(id)
+	rsess, err := rs.getSession(ctx, hash)
+	if err != nil {
+		if errors.Is(err, ErrNoSession) {
+			return nil
+		}
+		return err
+	}
+	_, err = rs.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, sessionKey(hash))
+		pipe.SRem(ctx, userSessionsKey(rsess.UserID), hash)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete session: %w", err)
+	}
+	return nil
+}
+
+func (rs *RedisStore) DeleteUserSessions(ctx context.Context, userID int) error {
+	hashes, err := rs.client.SMembers(ctx, userSessionsKey(userID)).Result()
+	if err != nil {
+		return fmt.Errorf("failed to get user sessions: %w", err)
+	}
+	keys := make([]string, 0, len(hashes)+1)
+	for _, hash := range hashes {
+		keys = append(keys, sessionKey(hash))
+	}
+	keys = append(keys, userSessionsKey(userID))
+	if err = rs.client.Del(ctx, keys...).Err(); err != nil {
+		return fmt.Errorf("failed to delete user sessions: %w", err)
+	}
+	return nil
+}
+
+func (rs *RedisStore) ListUserSessions(ctx context.Context, userID int) ([]model.Session, error) {
+	hashes, err := rs.client.SMembers(ctx, userSessionsKey(userID)).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get user sessions: %w", err)
+	}
+	sessions := []model.Session{}
+	if len(hashes) == 0 {
+		return sessions, nil
+	}
+	keys := make([]string, 0, len(hashes))
+	for _, hash := range hashes {
+		keys = append(keys, sessionKey(hash))
+	}
+	values, err := rs.client.MGet(ctx, keys...).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get user sessions: %w", err)
+	}
+
+	expired := []any{}
+	for i, value := range values {
+		data, ok := value.(string)
+		if !ok {
+			// Ключ сессии истек, а индекс сессий пользователя еще нет
+			expired = append(expired, hashes[i])
+			continue
+		}
+		var rsess redisSession
+		if err = json.Unmarshal([]byte(data), &rsess); err != nil {
+			return nil, fmt.Errorf("failed to decode session: %w", err)
+		}
+		sessions = append(sessions, model.Session{
+			PublicID:   hashes[i],
+			UserID:     rsess.UserID,
+			Login:      rsess.Login,
+			IP:         rsess.IP,
+			UserAgent:  rsess.UserAgent,
+			CreatedAt:  rsess.CreatedAt,
+			LastSeenAt: rsess.LastSeenAt,
+			ExpiresAt:  rsess.ExpiresAt,
+		})
+	}
+	if len(expired) > 0 {
+		if err = rs.client.SRem(ctx, userSessionsKey(userID), expired...).Err(); err != nil {
+			return nil, fmt.Errorf("failed to clean up user sessions: %w", err)
+		}
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].CreatedAt.After(sessions[j].CreatedAt)
+	})
+	return sessions, nil
+}
+
+func (rs *RedisStore) DeleteUserSession(ctx context.Context, userID int, publicID string) error {
+	isMember, err := rs.client.SIsMember(ctx, userSessionsKey(userID), publicID).Result()
+	if err != nil {
+		return fmt.Errorf("failed to delete session: %w", err)
+	}
+	if !isMember {
+		return ErrNoSession
+	}
+	var deleted *redis.IntCmd
+	_, err = rs.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		deleted = pipe.Del(ctx, sessionKey(publicID))
+		pipe.SRem(ctx, userSessionsKey(userID), publicID)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete session: %w", err)
+	}
+	if deleted.Val() == 0 {
+		return ErrNoSession
+	}
+	return nil
+}
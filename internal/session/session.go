@@ -0,0 +1,50 @@
+package session
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/pinbrain/gophermart/internal/model"
+)
+
+const idSize = 32
+
+var ErrNoSession = errors.New("session not found or expired")
+
+// Store хранит сессии пользователей на стороне сервера. Идентификатор сессии передается клиенту
+// в cookie, а в хранилище попадает только его хэш.
+type Store interface {
+	CreateSession(ctx context.Context, s model.Session) error
+	// GetSession возвращает действующую сессию или ErrNoSession
+	GetSession(ctx context.Context, id string) (*model.Session, error)
+	TouchSession(ctx context.Context, id string, lastSeenAt time.Time) error
+	// ElevateSession отмечает, что пользователь подтвердил вход в сессии повторным вводом пароля
+	ElevateSession(ctx context.Context, id string, until time.Time) error
+	DeleteSession(ctx context.Context, id string) error
+	DeleteUserSessions(ctx context.Context, userID int) error
+	// ListUserSessions возвращает действующие сессии пользователя с заполненным PublicID, но без ID
+	ListUserSessions(ctx context.Context, userID int) ([]model.Session, error)
+	// DeleteUserSession завершает сессию пользователя по публичному идентификатору или возвращает ErrNoSession
+	DeleteUserSession(ctx context.Context, userID int, publicID string) error
+}
+
+// NewID генерирует случайный идентификатор сессии
+func NewID() (string, error) {
+	b := make([]byte, idSize)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate session id: %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// HashID возвращает хэш идентификатора сессии, под которым она хранится
+func HashID(id string) string {
+	sum := sha256.Sum256([]byte(id))
+	return hex.EncodeToString(sum[:])
+}
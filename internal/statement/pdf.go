@@ -0,0 +1,153 @@
+package statement
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/pinbrain/gophermart/internal/model"
+)
+
+// Параметры страницы A4 в пунктах
+const (
+	pageWidth    = 595
+	pageHeight   = 842
+	marginLeft   = 50
+	marginTop    = 50
+	fontSize     = 10
+	lineHeight   = 14
+	linesPerPage = (pageHeight - 2*marginTop) / lineHeight
+)
+
+var eventTitles = map[model.BalanceEventType]string{
+	model.BalanceEventOpening:            "Opening",
+	model.BalanceEventAccrual:            "Accrual",
+	model.BalanceEventWithdrawal:         "Withdrawal",
+	model.BalanceEventTransferIn:         "Transfer in",
+	model.BalanceEventTransferOut:        "Transfer out",
+	model.BalanceEventWithdrawalCanceled: "Withdrawal canceled",
+	model.BalanceEventHold:               "Hold",
+	model.BalanceEventHoldCapture:        "Hold captured",
+	model.BalanceEventHoldRelease:        "Hold released",
+}
+
+// WritePDF записывает в w выписку st по счету пользователя с логином login в формате PDF.
+// Документ использует стандартный шрифт Courier, в котором нет кириллицы, поэтому текст
+// выписки на английском, а символы вне ASCII заменяются на '?'.
+func WritePDF(w io.Writer, login string, st model.Statement) error {
+	lines := statementLines(login, st)
+	var pages [][]string
+	for len(lines) > linesPerPage {
+		pages = append(pages, lines[:linesPerPage])
+		lines = lines[linesPerPage:]
+	}
+	pages = append(pages, lines)
+
+	doc := &document{}
+	doc.write("%PDF-1.4\n")
+	// Объекты 1-3 - каталог, дерево страниц и шрифт, далее по два объекта на страницу: страница и ее содержимое
+	kids := make([]string, 0, len(pages))
+	for i := range pages {
+		kids = append(kids, fmt.Sprintf("%d 0 R", 4+2*i))
+	}
+	doc.object("<< /Type /Catalog /Pages 2 0 R >>")
+	doc.object(fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(pages)))
+	doc.object("<< /Type /Font /Subtype /Type1 /BaseFont /Courier /Encoding /WinAnsiEncoding >>")
+	for i, page := range pages {
+		doc.object(fmt.Sprintf(
+			"<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %d %d] /Resources << /Font << /F1 3 0 R >> >> /Contents %d 0 R >>",
+			pageWidth, pageHeight, 5+2*i,
+		))
+		content := pageContent(page)
+		doc.object(fmt.Sprintf("<< /Length %d >>\nstream\n%s\nendstream", len(content), content))
+	}
+	doc.finish()
+
+	_, err := w.Write(doc.buf.Bytes())
+	return err
+}
+
+func statementLines(login string, st model.Statement) []string {
+	lines := []string{
+		"Gophermart account statement",
+		"",
+		"User:    " + login,
+		fmt.Sprintf("Period:  %s - %s", st.From.Format(time.DateOnly), st.To.AddDate(0, 0, -1).Format(time.DateOnly)),
+		"",
+		fmt.Sprintf("Opening balance: %12s", st.OpeningBalance),
+		fmt.Sprintf("Credited:        %12s", st.Credited),
+		fmt.Sprintf("Debited:         %12s", st.Debited),
+		fmt.Sprintf("Closing balance: %12s", st.ClosingBalance),
+		"",
+	}
+	if len(st.Entries) == 0 {
+		return append(lines, "No operations in the period")
+	}
+	lines = append(lines,
+		fmt.Sprintf("%-16s  %-12s  %-20s  %10s  %10s", "Date", "Operation", "Order", "Amount", "Balance"),
+		strings.Repeat("-", 74),
+	)
+	for _, entry := range st.Entries {
+		title, ok := eventTitles[entry.Type]
+		if !ok {
+			title = string(entry.Type)
+		}
+		lines = append(lines, fmt.Sprintf("%-16s  %-12s  %-20s  %10s  %10s",
+			entry.CreatedAt.Local().Format("2006-01-02 15:04"), title, entry.Number, entry.Amount, entry.Balance,
+		))
+	}
+	return lines
+}
+
+func pageContent(lines []string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "BT\n/F1 %d Tf\n%d TL\n%d %d Td\n", fontSize, lineHeight, marginLeft, pageHeight-marginTop)
+	for _, line := range lines {
+		fmt.Fprintf(&b, "(%s) Tj T*\n", escapeText(line))
+	}
+	b.WriteString("ET")
+	return b.String()
+}
+
+// escapeText экранирует строку для литерала PDF и заменяет символы, которых нет в шрифте
+func escapeText(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch {
+		case r == '(' || r == ')' || r == '\\':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r < 0x20 || r > 0x7e:
+			b.WriteByte('?')
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// document накапливает объекты PDF и их смещения для таблицы перекрестных ссылок
+type document struct {
+	buf     bytes.Buffer
+	offsets []int
+}
+
+func (d *document) write(s string) {
+	d.buf.WriteString(s)
+}
+
+func (d *document) object(body string) {
+	d.offsets = append(d.offsets, d.buf.Len())
+	fmt.Fprintf(&d.buf, "%d 0 obj\n%s\nendobj\n", len(d.offsets), body)
+}
+
+func (d *document) finish() {
+	xref := d.buf.Len()
+	fmt.Fprintf(&d.buf, "xref\n0 %d\n0000000000 65535 f \n", len(d.offsets)+1)
+	for _, offset := range d.offsets {
+		fmt.Fprintf(&d.buf, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(&d.buf, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(d.offsets)+1, xref)
+}
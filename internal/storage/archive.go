@@ -0,0 +1,97 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/pinbrain/gophermart/internal/model"
+)
+
+// ArchiveOrders переносит в архив не более limit обработанных заказов, статус которых не менялся
+// с момента olderThan, и возвращает количество перенесенных заказов
+
+func (st *DBStorage) ArchiveOrders(ctx context.Context, olderThan time.Time, limit int) (int, error) {
+	tx, err := st.begin(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("failed to archive orders: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	rows, err := tx.Query(ctx, `
+		SELECT id FROM orders
+		WHERE status = ? AND updated_at < ?
+		ORDER BY id
+		LIMIT ?`+st.db.dialect.forUpdateSkipLocked,
+		model.OrderProcessed, olderThan, limit,
+	)
+	if err != nil {
+		return 0, fmt.Errorf("failed to archive orders: %w", err)
+	}
+	orderIDs, err := collectIDs(rows)
+	if err != nil {
+		return 0, fmt.Errorf("failed to archive orders: %w", err)
+	}
+	if len(orderIDs) == 0 {
+		return 0, nil
+	}
+	placeholders, idArgs := inArgs(orderIDs)
+	_, err = tx.Exec(ctx, `
+		INSERT INTO orders_archive (id, user_id, number, status, accrual, status_reason, created_at, updated_at)
+		SELECT id, user_id, number, status, accrual, status_reason, created_at, updated_at
+		FROM orders WHERE id IN (`+placeholders+`)`,
+		idArgs...,
+	)
+	if err != nil {
+		return 0, fmt.Errorf("failed to archive orders: %w", err)
+	}
+	if _, err = tx.Exec(ctx, `DELETE FROM orders WHERE id IN (`+placeholders+`)`, idArgs...); err != nil {
+		return 0, fmt.Errorf("failed to archive orders: %w", err)
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return 0, fmt.Errorf("failed to archive orders: %w", err)
+	}
+	return len(orderIDs), nil
+}
+
+// CountArchivedOrders возвращает количество заказов пользователя в архиве
+func (st *DBStorage) CountArchivedOrders(ctx context.Context, userID int) (int, error) {
+	var count int
+	err := st.conn(ctx).QueryRow(ctx, `SELECT COUNT(*) FROM orders_archive WHERE user_id = ?`, userID).Scan(&count)
+	if err != nil {
+		return 0, fmt.Errorf("failed to count archived orders: %w", err)
+	}
+	return count, nil
+}
+
+// GetArchivedOrders возвращает страницу заказов пользователя из архива в порядке загрузки.
+// Нулевой limit означает выборку без ограничения.
+func (st *DBStorage) GetArchivedOrders(ctx context.Context, userID, limit, offset int) ([]model.Order, error) {
+	if limit <= 0 {
+		limit = noLimit
+	}
+	rows, err := st.conn(ctx).Query(ctx, `
+		SELECT
+			id,
+			user_id,
+			number,
+			status,
+			COALESCE(accrual, 0),
+			COALESCE(status_reason, ''),
+			created_at,
+			updated_at
+		FROM orders_archive WHERE user_id = ?
+		ORDER BY id
+		LIMIT ? OFFSET ?`,
+		userID, limit, offset,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to select archived orders: %w", err)
+	}
+	orders, err := collectOrders(rows)
+	if err != nil {
+		return nil, fmt.Errorf("failed to select archived orders: %w", err)
+	}
+	return orders, nil
+}
@@ -0,0 +1,50 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/pinbrain/gophermart/internal/model"
+)
+
+// RecordAuthEvent сохраняет событие аутентификации пользователя
+
+func (st *DBStorage) RecordAuthEvent(ctx context.Context, event model.AuthEvent) error {
+	_, err := st.conn(ctx).Exec(ctx, `
+		INSERT INTO auth_events (user_id, type, ip, user_agent, created_at)
+		VALUES (?, ?, ?, ?, ?)`,
+		event.UserID, event.Type, event.IP, event.UserAgent, event.CreatedAt,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to record auth event: %w", err)
+	}
+	return nil
+}
+
+// GetAuthEvents возвращает последние limit событий аутентификации пользователя, начиная с самых новых
+func (st *DBStorage) GetAuthEvents(ctx context.Context, userID, limit int) ([]model.AuthEvent, error) {
+	rows, err := st.conn(ctx).Query(ctx, `
+		SELECT id, type, ip, user_agent, created_at FROM auth_events
+		WHERE user_id = ?
+		ORDER BY created_at DESC, id DESC
+		LIMIT ?`,
+		userID, limit,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get auth events: %w", err)
+	}
+	defer rows.Close()
+
+	events := []model.AuthEvent{}
+	for rows.Next() {
+		event := model.AuthEvent{UserID: userID}
+		if err = rows.Scan(&event.ID, &event.Type, &event.IP, &event.UserAgent, &event.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to read auth event: %w", err)
+		}
+		events = append(events, event)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to get auth events: %w", err)
+	}
+	return events, nil
+}
@@ -0,0 +1,256 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pinbrain/gophermart/internal/model"
+)
+
+var ErrInvalidRefreshToken = errors.New("refresh token is invalid, expired or revoked")
+
+// CreateRefreshToken сохраняет хэш выданного пользователю токена обновления
+func (st *DBStorage) CreateRefreshToken(ctx context.Context, userID int, tokenHash string, expiresAt time.Time) error {
+	_, err := st.conn(ctx).Exec(ctx, `
+		INSERT INTO refresh_tokens (user_id, token_hash, expires_at, created_at)
+		VALUES (?, ?, ?, ?)`,
+		userID, tokenHash, expiresAt, sqlNow(),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to create refresh token: %w", err)
+	}
+	return nil
+}
+
+// RotateRefreshToken отзывает действующий токен обновления oldHash и сохраняет вместо него newHash.
+// Возвращает пользователя, которому принадлежит токен.
+func (st *DBStorage) RotateRefreshToken(
+	ctx context.Context, oldHash, newHash string, expiresAt time.Time,
+) (*model.User, error) {
+	tx, err := st.begin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to rotate refresh token: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	// Токен отзывается одним UPDATE, поэтому из параллельных обновлений по одному токену успешно только одно
+	now := sqlNow()
+	res, err := tx.Exec(ctx, `
+		UPDATE refresh_tokens SET revoked_at = ?
+		WHERE token_hash = ? AND revoked_at IS NULL AND expires_at > ?`,
+		now, oldHash, now,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to rotate refresh token: %w", err)
+	}
+	if revoked, err := res.RowsAffected(); err != nil || revoked == 0 {
+		if err != nil {
+			return nil, fmt.Errorf("failed to rotate refresh token: %w", err)
+		}
+		return nil, ErrInvalidRefreshToken
+	}
+	var user model.User
+	err = tx.QueryRow(ctx, `
+		SELECT u.id, u.login, u.token_version
+		FROM refresh_tokens rt JOIN users u ON u.id = rt.user_id
+		WHERE rt.token_hash = ?`,
+		oldHash,
+	).Scan(&user.ID, &user.Login, &user.TokenVersion)
+	if err != nil {
+		return nil, fmt.Errorf("failed to rotate refresh token: %w", err)
+	}
+	_, err = tx.Exec(ctx, `
+		INSERT INTO refresh_tokens (user_id, token_hash, expires_at, created_at)
+		VALUES (?, ?, ?, ?)`,
+		user.ID, newHash, expiresAt, now,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to rotate refresh token: %w", err)
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return nil, fmt.Errorf("failed to rotate refresh token: %w", err)
+	}
+	return &user, nil
+}
+
+// RevokeRefreshToken отзывает токен обновления, отсутствие токена ошибкой не считается
+func (st *DBStorage) RevokeRefreshToken(ctx context.Context, tokenHash string) error {
+	_, err := st.conn(ctx).Exec(ctx, `
+		UPDATE refresh_tokens SET revoked_at = ?
+		WHERE token_hash = ? AND revoked_at IS NULL`,
+		sqlNow(), tokenHash,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to revoke refresh token: %w", err)
+	}
+	return nil
+}
+
+// RevokeToken добавляет JWT в список отозванных, заодно удаляя из списка истекшие токены
+func (st *DBStorage) RevokeToken(ctx context.Context, jti string, expiresAt time.Time) error {
+	tx, err := st.begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to revoke token: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err = tx.Exec(ctx, `DELETE FROM revoked_tokens WHERE expires_at < ?`, sqlNow()); err != nil {
+		return fmt.Errorf("failed to revoke token: %w", err)
+	}
+	_, err = tx.Exec(ctx, `
+		INSERT INTO revoked_tokens (jti, expires_at) VALUES (?, ?) `+st.db.dialect.upsert([]string{"jti"}),
+		jti, expiresAt,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to revoke token: %w", err)
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return fmt.Errorf("failed to revoke token: %w", err)
+	}
+	return nil
+}
+
+// IsTokenRevoked проверяет, отозван ли JWT
+func (st *DBStorage) IsTokenRevoked(ctx context.Context, jti string) (bool, error) {
+	var revoked bool
+	err := st.conn(ctx).QueryRow(ctx, `
+		SELECT EXISTS (SELECT 1 FROM revoked_tokens WHERE jti = ? AND expires_at >= ?)`,
+		jti, sqlNow(),
+	).Scan(&revoked)
+	if err != nil {
+		return false, fmt.Errorf("failed to check token revocation: %w", err)
+	}
+	return revoked, nil
+}
+
+// RegisterFailedLogin учитывает неудачную попытку входа и после maxFailures попыток подряд
+// блокирует вход на lockFor. Возвращает момент окончания блокировки (нулевой, если вход не заблокирован).
+func (st *DBStorage) RegisterFailedLogin(
+	ctx context.Context, userID, maxFailures int, lockFor time.Duration,
+) (time.Time, error) {
+	tx, err := st.begin(ctx)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to register failed login: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	// locked_until вычисляется раньше failed_logins: MySQL подставляет в следующие выражения SET уже новые значения
+	res, err := tx.Exec(ctx, `
+		UPDATE users SET
+			locked_until = CASE WHEN failed_logins + 1 >= ? THEN ? ELSE locked_until END,
+			failed_logins = CASE WHEN failed_logins + 1 >= ? THEN 0 ELSE failed_logins + 1 END
+		WHERE id = ?`,
+		maxFailures, sqlNow().Add(lockFor), maxFailures, userID,
+	)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to register failed login: %w", err)
+	}
+	if updated, err := res.RowsAffected(); err != nil || updated == 0 {
+		if err != nil {
+			return time.Time{}, fmt.Errorf("failed to register failed login: %w", err)
+		}
+		return time.Time{}, ErrNoUser
+	}
+	var lockedUntil *time.Time
+	if err = tx.QueryRow(ctx, `SELECT locked_until FROM users WHERE id = ?`, userID).Scan(&lockedUntil); err != nil {
+		return time.Time{}, fmt.Errorf("failed to register failed login: %w", err)
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return time.Time{}, fmt.Errorf("failed to register failed login: %w", err)
+	}
+	if lockedUntil == nil || !lockedUntil.After(time.Now()) {
+		return time.Time{}, nil
+	}
+	return *lockedUntil, nil
+}
+
+// ResetFailedLogins сбрасывает счетчик неудачных попыток входа после успешного входа
+func (st *DBStorage) ResetFailedLogins(ctx context.Context, userID int) error {
+	_, err := st.conn(ctx).Exec(ctx, `
+		UPDATE users SET failed_logins = 0, locked_until = NULL
+		WHERE id = ? AND (failed_logins > 0 OR locked_until IS NOT NULL)`,
+		userID,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to reset failed logins: %w", err)
+	}
+	return nil
+}
+
+// UnlockUser снимает блокировку входа пользователя и сбрасывает счетчик неудачных попыток
+func (st *DBStorage) UnlockUser(ctx context.Context, login string) error {
+	res, err := st.conn(ctx).Exec(ctx, `
+		UPDATE users SET failed_logins = 0, locked_until = NULL WHERE login = ?`,
+		strings.ToLower(login),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to unlock user: %w", err)
+	}
+	if updated, err := res.RowsAffected(); err != nil || updated == 0 {
+		if err != nil {
+			return fmt.Errorf("failed to unlock user: %w", err)
+		}
+		return ErrNoUser
+	}
+	return nil
+}
+
+var ErrInvalidVerificationToken = errors.New("email verification token is invalid or expired")
+
+// CreateEmailVerification сохраняет хэш токена подтверждения email пользователя
+func (st *DBStorage) CreateEmailVerification(
+	ctx context.Context, userID int, email, tokenHash string, expiresAt time.Time,
+) error {
+	_, err := st.conn(ctx).Exec(ctx, `
+		INSERT INTO email_verifications (token_hash, user_id, email, expires_at, created_at)
+		VALUES (?, ?, ?, ?, ?)`,
+		tokenHash, userID, email, expiresAt, sqlNow(),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to create email verification: %w", err)
+	}
+	return nil
+}
+
+// ConfirmEmail подтверждает email пользователя по токену. Токен недействителен, если истек
+// или пользователь с момента его выпуска сменил email.
+func (st *DBStorage) ConfirmEmail(ctx context.Context, tokenHash string) error {
+	tx, err := st.begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to confirm email: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	now := sqlNow()
+	var userID int
+	err = tx.QueryRow(ctx, `
+		SELECT u.id
+		FROM email_verifications ev JOIN users u ON u.id = ev.user_id AND u.email = ev.email
+		WHERE ev.token_hash = ? AND ev.expires_at > ?`+st.db.dialect.forUpdate,
+		tokenHash, now,
+	).Scan(&userID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrInvalidVerificationToken
+		}
+		return fmt.Errorf("failed to confirm email: %w", err)
+	}
+	if _, err = tx.Exec(ctx, `UPDATE users SET email_verified_at = ? WHERE id = ?`, now, userID); err != nil {
+		return fmt.Errorf("failed to confirm email: %w", err)
+	}
+	if _, err = tx.Exec(ctx, `DELETE FROM email_verifications WHERE user_id = ?`, userID); err != nil {
+		return fmt.Errorf("failed to confirm email: %w", err)
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return fmt.Errorf("failed to confirm email: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,430 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/pinbrain/gophermart/internal/model"
+)
+
+// Баланс пользователя = проекция в таблице balances + события, еще не учтенные в проекции.
+// В обычном режиме проекция обновляется в той же транзакции, что и событие, поэтому
+// неучтенных событий нет. В режиме event sourcing проекцию обновляет отдельный воркер.
+
+// lockBalance блокирует строку баланса пользователя до конца транзакции.
+// Все события по пользователю добавляются под этой блокировкой, поэтому их id
+// фиксируются строго по возрастанию и проекция не может пропустить событие.
+func (st *DBStorage) lockBalance(ctx context.Context, tx sqlQuerier, userID int) error {
+	_, err := tx.Exec(ctx, `SELECT 1 FROM balances WHERE user_id = ?`+st.db.dialect.forUpdate, userID)
+	return err
+}
+
+func selectBalance(ctx context.Context, tx sqlQuerier, userID int) (*model.Balance, error) {
+	var balance model.Balance
+	err := tx.QueryRow(ctx, `
+		SELECT
+			b.current + COALESCE(SUM(e.current_delta), 0),
+			b.withdrawn + COALESCE(SUM(e.withdrawn_delta), 0)
+		FROM balances b
+		LEFT JOIN balance_events e ON e.user_id = b.user_id AND e.id > b.last_event_id
+		WHERE b.user_id = ?
+		GROUP BY b.user_id, b.current, b.withdrawn`,
+		userID,
+	).Scan(&balance.Current, &balance.Withdrawn)
+	if err != nil {
+		return nil, err
+	}
+	balance.UserID = userID
+	return &balance, nil
+}
+
+// appendBalanceEvent записывает событие изменения баланса в журнал.
+// Вызывающий должен предварительно заблокировать баланс пользователя через lockBalance.
+func (st *DBStorage) appendBalanceEvent(ctx context.Context, tx sqlQuerier, event model.BalanceEvent) error {
+	eventID, err := tx.insert(ctx, `
+		INSERT INTO balance_events (user_id, type, number, current_delta, withdrawn_delta, created_at)
+		VALUES (?, ?, ?, ?, ?, ?)`,
+		event.UserID, event.Type, event.Number, event.CurrentDelta, event.WithdrawnDelta, sqlNow(),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to append balance event: %w", err)
+	}
+	if st.eventSourcedBalance {
+		return nil
+	}
+	_, err = tx.Exec(ctx, `
+		UPDATE balances
+		SET current = current + ?, withdrawn = withdrawn + ?, last_event_id = ?
+		WHERE user_id = ?`,
+		event.CurrentDelta, event.WithdrawnDelta, eventID, event.UserID,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to update balance: %w", err)
+	}
+	return nil
+}
+
+// ProjectBalances переносит в таблицу balances еще не учтенные события не более чем
+// limit пользователей и возвращает количество обновленных балансов
+func (st *DBStorage) ProjectBalances(ctx context.Context, limit int) (int, error) {
+	tx, err := st.begin(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("failed to project balances: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	rows, err := tx.Query(ctx, `
+		SELECT b.user_id FROM balances b
+		WHERE EXISTS (
+			SELECT 1 FROM balance_events e WHERE e.user_id = b.user_id AND e.id > b.last_event_id
+		)
+		ORDER BY b.user_id
+		LIMIT ?`+st.db.dialect.forUpdateSkipLocked,
+		limit,
+	)
+	if err != nil {
+		return 0, fmt.Errorf("failed to select balances to project: %w", err)
+	}
+	userIDs, err := collectIDs(rows)
+	if err != nil {
+		return 0, fmt.Errorf("failed to select balances to project: %w", err)
+	}
+	if len(userIDs) == 0 {
+		return 0, nil
+	}
+
+	// last_event_id обновляется последним, чтобы подзапросы остальных столбцов видели прежнее значение
+	placeholders, idArgs := inArgs(userIDs)
+	_, err = tx.Exec(ctx, `
+		UPDATE balances
+		SET
+			current = current + (
+				SELECT COALESCE(SUM(e.current_delta), 0) FROM balance_events e
+				WHERE e.user_id = balances.user_id AND e.id > balances.last_event_id
+			),
+			withdrawn = withdrawn + (
+				SELECT COALESCE(SUM(e.withdrawn_delta), 0) FROM balance_events e
+				WHERE e.user_id = balances.user_id AND e.id > balances.last_event_id
+			),
+			last_event_id = (
+				SELECT COALESCE(MAX(e.id), balances.last_event_id) FROM balance_events e
+				WHERE e.user_id = balances.user_id AND e.id > balances.last_event_id
+			)
+		WHERE user_id IN (`+placeholders+`)`,
+		idArgs...,
+	)
+	if err != nil {
+		return 0, fmt.Errorf("failed to project balances: %w", err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return 0, fmt.Errorf("failed to project balances: %w", err)
+	}
+	return len(userIDs), nil
+}
+
+// ReplayBalances полностью пересчитывает проекцию балансов по снимкам и журналу событий
+func (st *DBStorage) ReplayBalances(ctx context.Context) error {
+	tx, err := st.begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to replay balances: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	// Блокировка не дает добавить новые события, пока проекция пересчитывается
+	if _, err = tx.Exec(ctx, `SELECT 1 FROM balances`+st.db.dialect.forUpdate); err != nil {
+		return fmt.Errorf("failed to replay balances: %w", err)
+	}
+	_, err = tx.Exec(ctx, `
+		UPDATE balances
+		SET
+			current = COALESCE((SELECT s.current FROM balance_snapshots s WHERE s.user_id = balances.user_id), 0) +
+				COALESCE((
+					SELECT SUM(e.current_delta) FROM balance_events e
+					WHERE e.user_id = balances.user_id AND e.id > COALESCE(
+						(SELECT s.last_event_id FROM balance_snapshots s WHERE s.user_id = balances.user_id), 0
+					)
+				), 0),
+			withdrawn = COALESCE((SELECT s.withdrawn FROM balance_snapshots s WHERE s.user_id = balances.user_id), 0) +
+				COALESCE((
+					SELECT SUM(e.withdrawn_delta) FROM balance_events e
+					WHERE e.user_id = balances.user_id AND e.id > COALESCE(
+						(SELECT s.last_event_id FROM balance_snapshots s WHERE s.user_id = balances.user_id), 0
+					)
+				), 0),
+			last_event_id = COALESCE(
+				(
+					SELECT MAX(e.id) FROM balance_events e
+					WHERE e.user_id = balances.user_id AND e.id > COALESCE(
+						(SELECT s.last_event_id FROM balance_snapshots s WHERE s.user_id = balances.user_id), 0
+					)
+				),
+				(SELECT s.last_event_id FROM balance_snapshots s WHERE s.user_id = balances.user_id),
+				0
+			)`,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to replay balances: %w", err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("failed to replay balances: %w", err)
+	}
+	return nil
+}
+
+// SnapshotBalances сохраняет снимки балансов по событиям, созданным до before и уже учтенным
+// в проекции, после чего переносит учтенные в снимках события в архив.
+// Возвращает количество обновленных снимков.
+func (st *DBStorage) SnapshotBalances(ctx context.Context, before time.Time) (int, error) {
+	tx, err := st.begin(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("failed to snapshot balances: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	// Граница снимка - последнее событие пользователя старше before, уже учтенное в проекции
+	rows, err := tx.Query(ctx, `
+		SELECT e.user_id, MAX(e.id)
+		FROM balance_events e
+		JOIN balances b ON b.user_id = e.user_id
+		WHERE e.created_at < ? AND e.id <= b.last_event_id
+		GROUP BY e.user_id`,
+		before,
+	)
+	if err != nil {
+		return 0, fmt.Errorf("failed to snapshot balances: %w", err)
+	}
+	horizon := make(map[int]int64)
+	for rows.Next() {
+		var userID int
+		var lastEventID int64
+		if err = rows.Scan(&userID, &lastEventID); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("failed to snapshot balances: %w", err)
+		}
+		horizon[userID] = lastEventID
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, fmt.Errorf("failed to snapshot balances: %w", err)
+	}
+
+	now := sqlNow()
+	updated := 0
+	for userID, lastEventID := range horizon {
+		var snapshot model.Balance
+		var snapshotEventID int64
+		err = tx.QueryRow(ctx, `
+			SELECT current, withdrawn, last_event_id FROM balance_snapshots WHERE user_id = ?`, userID,
+		).Scan(&snapshot.Current, &snapshot.Withdrawn, &snapshotEventID)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return 0, fmt.Errorf("failed to snapshot balances: %w", err)
+		}
+		var events int
+		var delta model.Balance
+		err = tx.QueryRow(ctx, `
+			SELECT COUNT(*), COALESCE(SUM(current_delta), 0), COALESCE(SUM(withdrawn_delta), 0)
+			FROM balance_events WHERE user_id = ? AND id <= ? AND id > ?`,
+			userID, lastEventID, snapshotEventID,
+		).Scan(&events, &delta.Current, &delta.Withdrawn)
+		if err != nil {
+			return 0, fmt.Errorf("failed to snapshot balances: %w", err)
+		}
+		if events == 0 {
+			continue
+		}
+		_, err = tx.Exec(ctx, `
+			INSERT INTO balance_snapshots (user_id, last_event_id, current, withdrawn, created_at)
+			VALUES (?, ?, ?, ?, ?) `+
+			st.db.dialect.upsert([]string{"user_id"}, "last_event_id", "current", "withdrawn", "created_at"),
+			userID, lastEventID, snapshot.Current+delta.Current, snapshot.Withdrawn+delta.Withdrawn, now,
+		)
+		if err != nil {
+			return 0, fmt.Errorf("failed to snapshot balances: %w", err)
+		}
+		updated++
+	}
+
+	_, err = tx.Exec(ctx, `
+		INSERT INTO balance_events_archive (id, user_id, type, number, current_delta, withdrawn_delta, created_at)
+		SELECT e.id, e.user_id, e.type, e.number, e.current_delta, e.withdrawn_delta, e.created_at
+		FROM balance_events e
+		JOIN balance_snapshots s ON s.user_id = e.user_id
+		WHERE e.id <= s.last_event_id`,
+	)
+	if err != nil {
+		return 0, fmt.Errorf("failed to archive balance events: %w", err)
+	}
+	_, err = tx.Exec(ctx, `
+		DELETE FROM balance_events
+		WHERE id <= (SELECT s.last_event_id FROM balance_snapshots s WHERE s.user_id = balance_events.user_id)`,
+	)
+	if err != nil {
+		return 0, fmt.Errorf("failed to archive balance events: %w", err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return 0, fmt.Errorf("failed to snapshot balances: %w", err)
+	}
+	return updated, nil
+}
+
+// GetUserBalanceAt восстанавливает баланс пользователя на указанный момент времени по журналу событий,
+// включая архивные события
+func (st *DBStorage) GetUserBalanceAt(ctx context.Context, userID int, at time.Time) (*model.Balance, error) {
+	row := st.conn(ctx).QueryRow(ctx, `
+		SELECT COALESCE(SUM(current_delta), 0), COALESCE(SUM(withdrawn_delta), 0)
+		FROM (
+			SELECT current_delta, withdrawn_delta FROM balance_events
+			WHERE user_id = ? AND created_at <= ?
+			UNION ALL
+			SELECT current_delta, withdrawn_delta FROM balance_events_archive
+			WHERE user_id = ? AND created_at <= ?
+		) e`,
+		userID, at, userID, at,
+	)
+	var balance model.Balance
+	if err := row.Scan(&balance.Current, &balance.Withdrawn); err != nil {
+		return nil, fmt.Errorf("failed to get user balance at %s: %w", at, err)
+	}
+	balance.UserID = userID
+	return &balance, nil
+}
+
+// GetBalanceHistory возвращает историю изменений баланса пользователя в хронологическом порядке
+// вместе с остатком после каждой операции, включая архивные события
+func (st *DBStorage) GetBalanceHistory(ctx context.Context, userID int) ([]model.BalanceHistoryEntry, error) {
+	rows, err := st.conn(ctx).Query(ctx, `
+		SELECT type, COALESCE(number, ''), current_delta,
+			SUM(current_delta) OVER (ORDER BY id), created_at
+		FROM (
+			SELECT id, type, number, current_delta, created_at FROM balance_events
+			WHERE user_id = ?
+			UNION ALL
+			SELECT id, type, number, current_delta, created_at FROM balance_events_archive
+			WHERE user_id = ?
+		) e
+		ORDER BY id`,
+		userID, userID,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get user balance history: %w", err)
+	}
+	defer rows.Close()
+
+	history := []model.BalanceHistoryEntry{}
+	for rows.Next() {
+		var entry model.BalanceHistoryEntry
+		if err = rows.Scan(&entry.Type, &entry.Number, &entry.Amount, &entry.Balance, &entry.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan user balance history: %w", err)
+		}
+		history = append(history, entry)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to get user balance history: %w", err)
+	}
+	return history, nil
+}
+
+// GetStatement формирует выписку по счету пользователя за период [from, to):
+// остаток на начало, операции периода с остатком после каждой из них и остаток на конец
+func (st *DBStorage) GetStatement(ctx context.Context, userID int, from, to time.Time) (*model.Statement, error) {
+	rows, err := st.conn(ctx).Query(ctx, `
+		SELECT type, number, amount, balance, created_at
+		FROM (
+			SELECT id, type, COALESCE(number, '') AS number, current_delta AS amount,
+				SUM(current_delta) OVER (ORDER BY id) AS balance, created_at
+			FROM (
+				SELECT id, type, number, current_delta, created_at FROM balance_events
+				WHERE user_id = ? AND created_at < ?
+				UNION ALL
+				SELECT id, type, number, current_delta, created_at FROM balance_events_archive
+				WHERE user_id = ? AND created_at < ?
+			) e
+		) h
+		WHERE created_at >= ?
+		ORDER BY id`,
+		userID, to, userID, to, from,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get user statement: %w", err)
+	}
+	defer rows.Close()
+
+	statement := model.Statement{From: from, To: to, Entries: []model.BalanceHistoryEntry{}}
+	for rows.Next() {
+		var entry model.BalanceHistoryEntry
+		if err = rows.Scan(&entry.Type, &entry.Number, &entry.Amount, &entry.Balance, &entry.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan user statement: %w", err)
+		}
+		statement.Entries = append(statement.Entries, entry)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to get user statement: %w", err)
+	}
+
+	opening, err := st.GetUserBalanceAt(ctx, userID, from.Add(-time.Microsecond))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get user statement: %w", err)
+	}
+	statement.OpeningBalance = opening.Current
+	statement.ClosingBalance = opening.Current
+	for _, entry := range statement.Entries {
+		if entry.Amount > 0 {
+			statement.Credited += entry.Amount
+		} else {
+			statement.Debited -= entry.Amount
+		}
+		statement.ClosingBalance = entry.Balance
+	}
+	return &statement, nil
+}
+
+// GetMonthlyStats возвращает итоги пользователя по месяцам, начиная с месяца since: количество заказов
+// и сумму начислений по ним (с учетом заказов в архиве), сумму списаний. Месяцы без заказов и списаний
+// не возвращаются.
+func (st *DBStorage) GetMonthlyStats(ctx context.Context, userID int, since time.Time) ([]model.MonthlyStats, error) {
+	month := st.db.dialect.month("created_at")
+	rows, err := st.conn(ctx).Query(ctx, `
+		SELECT month, SUM(orders), SUM(accrued), SUM(withdrawn)
+		FROM (
+			SELECT `+month+` AS month, COUNT(*) AS orders,
+				COALESCE(SUM(accrual), 0) AS accrued, 0 AS withdrawn
+			FROM (
+				SELECT created_at, accrual FROM orders WHERE user_id = ? AND created_at >= ?
+				UNION ALL
+				SELECT created_at, accrual FROM orders_archive WHERE user_id = ? AND created_at >= ?
+			) o
+			GROUP BY 1
+			UNION ALL
+			SELECT `+month+`, 0, 0, SUM(sum)
+			FROM withdrawals
+			WHERE user_id = ? AND created_at >= ? AND status <> 'CANCELED'
+			GROUP BY 1
+		) m
+		GROUP BY month
+		ORDER BY month DESC`,
+		userID, since, userID, since, userID, since,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get user monthly stats: %w", err)
+	}
+	defer rows.Close()
+
+	stats := []model.MonthlyStats{}
+	for rows.Next() {
+		var entry model.MonthlyStats
+		if err = rows.Scan(&entry.Month, &entry.Orders, &entry.Accrued, &entry.Withdrawn); err != nil {
+			return nil, fmt.Errorf("failed to scan user monthly stats: %w", err)
+		}
+		stats = append(stats, entry)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to get user monthly stats: %w", err)
+	}
+	return stats, nil
+}
@@ -0,0 +1,48 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/pinbrain/gophermart/internal/model"
+)
+
+// SetCurrencyRate сохраняет курс валюты, действующий с rate.EffectiveFrom.
+// Курс с тем же моментом начала действия заменяется.
+
+func (st *DBStorage) SetCurrencyRate(ctx context.Context, rate model.CurrencyRate) error {
+	_, err := st.conn(ctx).Exec(ctx, `
+		INSERT INTO currency_rates (currency, rate, effective_from, created_at) VALUES (?, ?, ?, ?) `+
+		st.db.dialect.upsert([]string{"currency", "effective_from"}, "rate", "created_at"),
+		rate.Currency, rate.Rate, rate.EffectiveFrom, sqlNow(),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to save currency rate: %w", err)
+	}
+	return nil
+}
+
+// GetCurrencyRates возвращает все курсы валюты в порядке начала их действия
+func (st *DBStorage) GetCurrencyRates(ctx context.Context, currency string) ([]model.CurrencyRate, error) {
+	rows, err := st.conn(ctx).Query(ctx, `
+		SELECT currency, rate, effective_from FROM currency_rates WHERE currency = ? ORDER BY effective_from`,
+		currency,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to select currency rates: %w", err)
+	}
+	defer rows.Close()
+
+	rates := []model.CurrencyRate{}
+	for rows.Next() {
+		var rate model.CurrencyRate
+		if err = rows.Scan(&rate.Currency, &rate.Rate, &rate.EffectiveFrom); err != nil {
+			return nil, fmt.Errorf("failed to read data from db currency rate row: %w", err)
+		}
+		rates = append(rates, rate)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to select currency rates: %w", err)
+	}
+	return rates, nil
+}
@@ -2,36 +2,149 @@ package storage
 
 import (
 	"context"
+	"database/sql"
+	"errors"
 	"fmt"
+	"math"
+	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/jackc/pgx/v5/pgxpool"
-	_ "github.com/jackc/pgx/v5/stdlib"
+	"github.com/jackc/pgx/v5/stdlib"
 	"github.com/pinbrain/gophermart/internal/logger"
-	"github.com/pinbrain/gophermart/internal/storage/migrations"
 
 	"github.com/pressly/goose/v3"
 )
 
+var ErrUnknownMigrateCommand = errors.New("unknown migrate command")
+
+// Команды управления миграциями
+const (
+	// Применить все новые миграции
+	MigrateUp = "up"
+	// Откатить последнюю примененную миграцию
+	MigrateDown = "down"
+	// Вывести список миграций и время их применения
+	MigrateStatus = "status"
+	// Вывести текущую версию схемы
+	MigrateVersion = "version"
+)
+
+// Ограничение выборки, означающее его отсутствие: в отличие от PostgreSQL, LIMIT NULL
+// поддерживают не все СУБД
+const noLimit = math.MaxInt64
+
+// DB - подключение к БД хранилища. Запросы пишутся один раз для всех СУБД с плейсхолдерами ?,
+// особенности СУБД описывает dialect.
 type DB struct {
+	sqlConn
+	sqlDB *sql.DB
+	// Пул pgx, через который работает sqlDB. Есть только у PostgreSQL и нужен для LISTEN.
 	pool *pgxpool.Pool
+	// Реплика для запросов на чтение, nil - чтение выполняется на основной БД
+	replica     *sql.DB
+	replicaPool *pgxpool.Pool
+	// Время в наносекундах Unix, до которого реплика считается недоступной
+	replicaDownUntil atomic.Int64
 }
 
-func newDB(ctx context.Context, dsn string) (*DB, error) {
-	if err := runMigrations(dsn); err != nil {
-		return nil, err
+// PoolCfg - параметры пула соединений. Нулевые значения не меняют параметры из DSN или значения
+// по умолчанию драйвера.
+type PoolCfg struct {
+	MaxConns int32
+	// Минимальное количество соединений и период проверки соединений поддерживает только пул pgx
+	MinConns          int32
+	MaxConnLifetime   time.Duration
+	MaxConnIdleTime   time.Duration
+	HealthCheckPeriod time.Duration
+}
+
+func (pc PoolCfg) apply(poolCfg *pgxpool.Config) {
+	if pc.MaxConns > 0 {
+		poolCfg.MaxConns = pc.MaxConns
 	}
-	pool, err := initPool(ctx, dsn)
+	if pc.MinConns > 0 {
+		poolCfg.MinConns = pc.MinConns
+	}
+	if pc.MaxConnLifetime > 0 {
+		poolCfg.MaxConnLifetime = pc.MaxConnLifetime
+	}
+	if pc.MaxConnIdleTime > 0 {
+		poolCfg.MaxConnIdleTime = pc.MaxConnIdleTime
+	}
+	if pc.HealthCheckPeriod > 0 {
+		poolCfg.HealthCheckPeriod = pc.HealthCheckPeriod
+	}
+}
+
+// applyDB применяет параметры к пулу database/sql, через который работают SQLite и MySQL
+func (pc PoolCfg) applyDB(db *sql.DB) {
+	if pc.MaxConns > 0 {
+		db.SetMaxOpenConns(int(pc.MaxConns))
+	}
+	if pc.MaxConnLifetime > 0 {
+		db.SetConnMaxLifetime(pc.MaxConnLifetime)
+	}
+	if pc.MaxConnIdleTime > 0 {
+		db.SetConnMaxIdleTime(pc.MaxConnIdleTime)
+	}
+}
+
+// newDB подключается к БД, выбранной по схеме DSN, и, если задан readDSN, к реплике. Если migrate
+// установлен, предварительно применяет новые миграции. Миграции выполняются только на основной БД.
+func newDB(ctx context.Context, dsn, readDSN string, cfg PoolCfg, migrate bool) (*DB, error) {
+	driver, err := DriverFromDSN(dsn)
 	if err != nil {
-		return nil, fmt.Errorf("failed to initialize a db connection: %w", err)
+		return nil, err
+	}
+	dialect := dialects[driver]
+	if dsn, err = dialect.dsn(dsn); err != nil {
+		return nil, err
+	}
+	if readDSN != "" {
+		if readDSN, err = replicaDSN(driver, readDSN); err != nil {
+			return nil, err
+		}
+	}
+	if migrate {
+		if err = runMigrations(dialect, dsn, MigrateUp); err != nil {
+			return nil, err
+		}
 	}
-	return &DB{pool: pool}, err
+
+	db := &DB{sqlConn: sqlConn{dialect: dialect}}
+	if driver == DriverPostgres {
+		if db.pool, err = initPool(ctx, dsn, cfg); err != nil {
+			return nil, fmt.Errorf("failed to initialize a db connection: %w", err)
+		}
+		db.sqlDB = stdlib.OpenDBFromPool(db.pool)
+	} else {
+		if db.sqlDB, err = sql.Open(dialect.driver, dsn); err != nil {
+			return nil, fmt.Errorf("failed to initialize a db connection: %w", err)
+		}
+		cfg.applyDB(db.sqlDB)
+		if err = db.sqlDB.PingContext(ctx); err != nil {
+			db.sqlDB.Close()
+			return nil, fmt.Errorf("failed to ping the DB: %w", err)
+		}
+	}
+	db.q = db.sqlDB
+	if readDSN != "" {
+		if err = db.openReplica(ctx, driver, readDSN, cfg); err != nil {
+			db.close()
+			return nil, fmt.Errorf("failed to initialize a read replica connection: %w", err)
+		}
+	}
+	return db, nil
 }
 
-func initPool(ctx context.Context, dsn string) (*pgxpool.Pool, error) {
+func initPool(ctx context.Context, dsn string, cfg PoolCfg) (*pgxpool.Pool, error) {
 	poolCfg, err := pgxpool.ParseConfig(dsn)
 	if err != nil {
 		return nil, fmt.Errorf("failed to parse the DNS: %w", err)
 	}
+	cfg.apply(poolCfg)
 	pool, err := pgxpool.NewWithConfig(ctx, poolCfg)
 	if err != nil {
 		return nil, fmt.Errorf("failed to initialize a connection pool: %w", err)
@@ -42,24 +155,235 @@ func initPool(ctx context.Context, dsn string) (*pgxpool.Pool, error) {
 	return pool, nil
 }
 
-func runMigrations(dsn string) error {
-	goose.SetBaseFS(migrations.FS)
+func (db *DB) close() {
+	db.sqlDB.Close()
+	if db.pool != nil {
+		db.pool.Close()
+	}
+	if db.replica != nil {
+		db.replica.Close()
+	}
+	if db.replicaPool != nil {
+		db.replicaPool.Close()
+	}
+}
+
+// IsValidMigrateCommand проверяет, что команда управления миграциями поддерживается
+func IsValidMigrateCommand(command string) bool {
+	switch command {
+	case MigrateUp, MigrateDown, MigrateStatus, MigrateVersion:
+		return true
+	}
+	return false
+}
+
+// Migrate выполняет команду управления миграциями БД, выбранной по схеме DSN. Команды status и version
+// выводят результат в лог.
+func Migrate(dsn, command string) error {
+	if !IsValidMigrateCommand(command) {
+		return fmt.Errorf("%w %q", ErrUnknownMigrateCommand, command)
+	}
+	driver, err := DriverFromDSN(dsn)
+	if err != nil {
+		return err
+	}
+	dialect := dialects[driver]
+	if dsn, err = dialect.dsn(dsn); err != nil {
+		return err
+	}
+	return runMigrations(dialect, dsn, command)
+}
+
+func runMigrations(dialect *sqlDialect, dsn, command string) error {
+	goose.SetBaseFS(dialect.migrations)
 	goose.SetLogger(logger.Log)
-	if err := goose.SetDialect("postgres"); err != nil {
+	if err := goose.SetDialect(dialect.gooseDialect); err != nil {
+		return err
+	}
+	sqlDB, err := sql.Open(dialect.driver, dsn)
+	if err != nil {
 		return err
 	}
-	sqlDB, err := goose.OpenDBWithDriver("postgres", dsn)
 	defer func() {
 		if err := sqlDB.Close(); err != nil {
 			logger.Log.WithField("err", err).Error("failed to close db connection while migration")
 		}
-
 	}()
+	switch command {
+	case MigrateDown:
+		return goose.Down(sqlDB, dialect.migrationsDir)
+	case MigrateStatus:
+		return goose.Status(sqlDB, dialect.migrationsDir)
+	case MigrateVersion:
+		return goose.Version(sqlDB, dialect.migrationsDir)
+	}
+	return goose.Up(sqlDB, dialect.migrationsDir)
+}
+
+// begin начинает транзакцию метода хранилища
+func (db *DB) begin(ctx context.Context) (*sqlTx, error) {
+	tx, err := db.sqlDB.BeginTx(ctx, db.dialect.txOptions)
 	if err != nil {
+		return nil, err
+	}
+	return &sqlTx{sqlConn: sqlConn{q: tx, dialect: db.dialect}, tx: tx}, nil
+}
+
+// sqlExecer - запросы database/sql, общие для пула соединений и транзакции
+type sqlExecer interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// sqlQuerier - запросы хранилища, общие для пула соединений и транзакции
+type sqlQuerier interface {
+	Exec(ctx context.Context, query string, args ...any) (sql.Result, error)
+	Query(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRow(ctx context.Context, query string, args ...any) *sql.Row
+	insert(ctx context.Context, query string, args ...any) (int64, error)
+}
+
+// sqlConn выполняет запросы хранилища: подставляет вместо ? плейсхолдеры СУБД и передает моменты
+// времени в UTC. SQLite хранит время текстом вместе с часовым поясом и сравнивает его как строки,
+// поэтому все моменты должны быть записаны в одном поясе.
+type sqlConn struct {
+	q       sqlExecer
+	dialect *sqlDialect
+}
+
+func (c sqlConn) Exec(ctx context.Context, query string, args ...any) (sql.Result, error) {
+	return c.q.ExecContext(ctx, c.dialect.rebind(query), utcArgs(args)...)
+}
+
+func (c sqlConn) Query(ctx context.Context, query string, args ...any) (*sql.Rows, error) {
+	return c.q.QueryContext(ctx, c.dialect.rebind(query), utcArgs(args)...)
+}
+
+func (c sqlConn) QueryRow(ctx context.Context, query string, args ...any) *sql.Row {
+	return c.q.QueryRowContext(ctx, c.dialect.rebind(query), utcArgs(args)...)
+}
+
+// insert выполняет INSERT в таблицу с автоинкрементным столбцом id и возвращает id добавленной строки
+func (c sqlConn) insert(ctx context.Context, query string, args ...any) (int64, error) {
+	var id int64
+	if c.dialect.returningID {
+		err := c.QueryRow(ctx, query+" RETURNING id", args...).Scan(&id)
+		return id, err
+	}
+	res, err := c.Exec(ctx, query, args...)
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+func utcArgs(args []any) []any {
+	for i, arg := range args {
+		switch v := arg.(type) {
+		case time.Time:
+			args[i] = v.UTC()
+		case *time.Time:
+			if v != nil {
+				args[i] = v.UTC()
+			}
+		}
+	}
+	return args
+}
+
+// sqlTx - транзакция метода хранилища или точка сохранения в транзакции WithinTransaction
+type sqlTx struct {
+	sqlConn
+	tx *sql.Tx
+	// Имя точки сохранения, пустое - отдельная транзакция
+	savepointName string
+	done          bool
+}
+
+// Commit фиксирует транзакцию или освобождает точку сохранения: ее изменения фиксируются вместе
+// с внешней транзакцией
+func (tx *sqlTx) Commit(ctx context.Context) error {
+	tx.done = true
+	if tx.savepointName == "" {
+		return tx.tx.Commit()
+	}
+	_, err := tx.tx.ExecContext(ctx, "RELEASE SAVEPOINT "+tx.savepointName)
+	return err
+}
+
+// Rollback откатывает транзакцию или изменения после точки сохранения. После Commit ничего не делает,
+// поэтому вызывается в defer сразу после begin.
+func (tx *sqlTx) Rollback(ctx context.Context) {
+	if tx.done {
+		return
+	}
+	tx.done = true
+	if tx.savepointName == "" {
+		_ = tx.tx.Rollback()
+		return
+	}
+	// Точка сохранения откатывается и при отмененном контексте, иначе внешняя транзакция
+	// зафиксирует изменения метода, завершившегося ошибкой
+	ctx = context.WithoutCancel(ctx)
+	_, _ = tx.tx.ExecContext(ctx, "ROLLBACK TO SAVEPOINT "+tx.savepointName)
+	_, _ = tx.tx.ExecContext(ctx, "RELEASE SAVEPOINT "+tx.savepointName)
+}
+
+// savepoint выполняет fn в точке сохранения: если fn вернула ошибку, изменения fn откатываются,
+// а транзакция продолжается. В PostgreSQL ошибка запроса иначе прерывает всю транзакцию.
+func (tx *sqlTx) savepoint(ctx context.Context, fn func() error) error {
+	if _, err := tx.tx.ExecContext(ctx, "SAVEPOINT try_exec"); err != nil {
 		return err
 	}
-	if err := goose.Up(sqlDB, "."); err != nil {
+	if err := fn(); err != nil {
+		if _, rbErr := tx.tx.ExecContext(ctx, "ROLLBACK TO SAVEPOINT try_exec"); rbErr != nil {
+			return rbErr
+		}
 		return err
 	}
-	return nil
+	_, err := tx.tx.ExecContext(ctx, "RELEASE SAVEPOINT try_exec")
+	return err
+}
+
+// inArgs возвращает плейсхолдеры условия IN для values и соответствующие им аргументы запроса
+func inArgs[T any](values []T) (string, []any) {
+	args := make([]any, 0, len(values))
+	for _, v := range values {
+		args = append(args, v)
+	}
+	return strings.TrimSuffix(strings.Repeat("?, ", len(values)), ", "), args
+}
+
+// Форматы, в которых SQLite возвращает время из выражений без объявленного типа
+var sqlTimeLayouts = []string{
+	"2006-01-02 15:04:05.999999999-07:00",
+	"2006-01-02T15:04:05.999999999Z07:00",
+	"2006-01-02 15:04:05.999999999",
+}
+
+// sqlTime читает момент времени из результата выражения (MIN, MAX, CASE). Тип такого результата
+// SQLite не сообщает драйверу, и время возвращается текстом. NULL читается как нулевое время.
+type sqlTime time.Time
+
+func (t *sqlTime) Scan(src any) error {
+	switch v := src.(type) {
+	case nil:
+		*t = sqlTime{}
+		return nil
+	case time.Time:
+		*t = sqlTime(v)
+		return nil
+	case []byte:
+		return t.Scan(string(v))
+	case string:
+		for _, layout := range sqlTimeLayouts {
+			if parsed, err := time.Parse(layout, v); err == nil {
+				*t = sqlTime(parsed)
+				return nil
+			}
+		}
+		return fmt.Errorf("cannot parse %q as time", v)
+	}
+	return fmt.Errorf("cannot scan %T as time", src)
 }
@@ -0,0 +1,107 @@
+package storage
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/pinbrain/gophermart/internal/model"
+)
+
+var ErrInvalidLoginVerification = errors.New("login verification token is invalid or expired")
+
+func deviceHash(userAgent string) string {
+	sum := sha256.Sum256([]byte(userAgent))
+	return hex.EncodeToString(sum[:])
+}
+
+// CheckLoginDevice проверяет, входил ли пользователь раньше с этого устройства и из этой подсети
+func (st *DBStorage) CheckLoginDevice(ctx context.Context, userID int, device model.LoginDevice) (model.LoginDeviceCheck, error) {
+	var check model.LoginDeviceCheck
+	var total, sameDevice, sameNetwork int
+	err := st.conn(ctx).QueryRow(ctx, `
+		SELECT
+			COUNT(*),
+			COALESCE(SUM(CASE WHEN device_hash = ? THEN 1 ELSE 0 END), 0),
+			COALESCE(SUM(CASE WHEN network = ? THEN 1 ELSE 0 END), 0)
+		FROM login_devices WHERE user_id = ?`,
+		deviceHash(device.UserAgent), device.Network, userID,
+	).Scan(&total, &sameDevice, &sameNetwork)
+	if err != nil {
+		return check, fmt.Errorf("failed to check login device: %w", err)
+	}
+	check.HasHistory = total > 0
+	check.NewDevice = sameDevice == 0
+	check.NewNetwork = sameNetwork == 0
+	return check, nil
+}
+
+// RememberLoginDevice запоминает устройство и подсеть, из которых вошел пользователь
+func (st *DBStorage) RememberLoginDevice(ctx context.Context, userID int, device model.LoginDevice) error {
+	now := sqlNow()
+	_, err := st.conn(ctx).Exec(ctx, `
+		INSERT INTO login_devices (user_id, device_hash, network, first_seen_at, last_seen_at) VALUES (?, ?, ?, ?, ?) `+
+		st.db.dialect.upsert([]string{"user_id", "device_hash", "network"}, "last_seen_at"),
+		userID, deviceHash(device.UserAgent), device.Network, now, now,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to remember login device: %w", err)
+	}
+	return nil
+}
+
+// CreateLoginVerification сохраняет хэш токена подтверждения входа с нового устройства
+func (st *DBStorage) CreateLoginVerification(
+	ctx context.Context, userID int, device model.LoginDevice, tokenHash string, expiresAt time.Time,
+) error {
+	_, err := st.conn(ctx).Exec(ctx, `
+		INSERT INTO login_verifications (token_hash, user_id, ip, user_agent, expires_at)
+		VALUES (?, ?, ?, ?, ?)`,
+		tokenHash, userID, device.IP, device.UserAgent, expiresAt,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to create login verification: %w", err)
+	}
+	return nil
+}
+
+// ConfirmLoginVerification погашает токен подтверждения входа и возвращает пользователя
+// и устройство, с которого выполнялся вход
+func (st *DBStorage) ConfirmLoginVerification(ctx context.Context, tokenHash string) (*model.User, *model.LoginDevice, error) {
+	tx, err := st.begin(ctx)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to confirm login verification: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	var user model.User
+	var device model.LoginDevice
+	var valid bool
+	err = tx.QueryRow(ctx, `
+		SELECT u.id, u.login, u.token_version, lv.ip, lv.user_agent, lv.expires_at > ?
+		FROM login_verifications lv JOIN users u ON u.id = lv.user_id
+		WHERE lv.token_hash = ?`+st.db.dialect.forUpdate,
+		sqlNow(), tokenHash,
+	).Scan(&user.ID, &user.Login, &user.TokenVersion, &device.IP, &device.UserAgent, &valid)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil, ErrInvalidLoginVerification
+		}
+		return nil, nil, fmt.Errorf("failed to confirm login verification: %w", err)
+	}
+	if _, err = tx.Exec(ctx, `DELETE FROM login_verifications WHERE token_hash = ?`, tokenHash); err != nil {
+		return nil, nil, fmt.Errorf("failed to confirm login verification: %w", err)
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return nil, nil, fmt.Errorf("failed to confirm login verification: %w", err)
+	}
+	if !valid {
+		return nil, nil, ErrInvalidLoginVerification
+	}
+	return &user, &device, nil
+}
@@ -0,0 +1,139 @@
+package storage
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"io/fs"
+	"strconv"
+	"strings"
+)
+
+var ErrUnsupportedDriver = errors.New("unsupported database driver")
+
+// Driver - СУБД хранилища
+type Driver string
+
+const (
+	DriverPostgres Driver = "postgres"
+	DriverSQLite   Driver = "sqlite"
+	DriverMySQL    Driver = "mysql"
+)
+
+// dialects - особенности поддерживаемых СУБД
+var dialects = map[Driver]*sqlDialect{
+	DriverPostgres: &postgresDialect,
+	DriverSQLite:   &sqliteDialect,
+	DriverMySQL:    &mysqlDialect,
+}
+
+// DriverFromDSN определяет СУБД по схеме DSN: postgres:// и postgresql:// - PostgreSQL, sqlite:// - SQLite,
+// mysql:// и mariadb:// - MySQL или MariaDB. DSN в формате ключ=значение схемы не имеет и относится к PostgreSQL.
+func DriverFromDSN(dsn string) (Driver, error) {
+	scheme, _, found := strings.Cut(dsn, "://")
+	if !found {
+		return DriverPostgres, nil
+	}
+	switch scheme {
+	case "postgres", "postgresql":
+		return DriverPostgres, nil
+	case "sqlite":
+		return DriverSQLite, nil
+	case "mysql", "mariadb":
+		return DriverMySQL, nil
+	}
+	return "", fmt.Errorf("%w %q", ErrUnsupportedDriver, scheme)
+}
+
+// sqlDialect - особенности СУБД, с которой хранилище работает через database/sql
+type sqlDialect struct {
+	// Имя драйвера database/sql
+	driver string
+	// Диалект goose и миграции схемы в каталоге migrationsDir
+	gooseDialect  string
+	migrations    fs.FS
+	migrationsDir string
+	// dsn преобразует DATABASE_URI в DSN драйвера
+	dsn func(uri string) (string, error)
+	// Плейсхолдеры $1, $2, ... вместо ?
+	numberedParams bool
+	// id добавленной строки возвращается через INSERT ... RETURNING id, а не LastInsertId
+	returningID bool
+	// Параметры транзакций, nil - параметры СУБД по умолчанию
+	txOptions *sql.TxOptions
+	// Окончания SELECT, блокирующие выбранные строки до конца транзакции. Пустые, если СУБД
+	// блокирует всю БД на время пишущей транзакции.
+	forUpdate           string
+	forUpdateSkipLocked string
+	// uniqueViolation проверяет, что запрос нарушил ограничение уникальности, и возвращает его описание
+	// с именем ограничения или столбцов
+	uniqueViolation func(err error) (string, bool)
+	// upsert возвращает окончание INSERT на случай конфликта по столбцам conflict: обновить столбцы
+	// update значениями вставляемой строки, а если update не заданы - пропустить строку
+	upsert func(conflict []string, update ...string) string
+	// month возвращает выражение, приводящее момент времени column к месяцу в формате 'YYYY-MM'
+	month func(column string) string
+}
+
+// rebind заменяет плейсхолдеры ? в запросе на плейсхолдеры СУБД. Знаки ? внутри строковых
+// литералов не заменяются.
+func (d *sqlDialect) rebind(query string) string {
+	if !d.numberedParams || !strings.Contains(query, "?") {
+		return query
+	}
+	var b strings.Builder
+	b.Grow(len(query) + 8)
+	n, quoted := 0, false
+	for _, c := range query {
+		switch {
+		case c == '\'':
+			quoted = !quoted
+		case c == '?' && !quoted:
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+// onConflictUpsert - окончание INSERT ... ON CONFLICT, общее для PostgreSQL и SQLite
+func onConflictUpsert(conflict []string, update ...string) string {
+	target := strings.Join(conflict, ", ")
+	if len(update) == 0 {
+		return fmt.Sprintf("ON CONFLICT (%s) DO NOTHING", target)
+	}
+	set := make([]string, 0, len(update))
+	for _, column := range update {
+		set = append(set, fmt.Sprintf("%s = excluded.%s", column, column))
+	}
+	return fmt.Sprintf("ON CONFLICT (%s) DO UPDATE SET %s", target, strings.Join(set, ", "))
+}
+
+// isUniqueViolation проверяет, что запрос нарушил ограничение уникальности
+func (st *DBStorage) isUniqueViolation(err error) bool {
+	_, ok := st.db.dialect.uniqueViolation(err)
+	return ok
+}
+
+// uniqueViolationErr переводит нарушение ограничения уникальности в ошибку хранилища. Ограничение
+// определяется по имени ограничения или столбцов, которые СУБД сообщает в ошибке. Для других ошибок
+// и ограничений возвращает nil.
+func (st *DBStorage) uniqueViolationErr(err error) error {
+	key, ok := st.db.dialect.uniqueViolation(err)
+	if !ok {
+		return nil
+	}
+	switch {
+	case strings.Contains(key, "idempotency_key"):
+		return ErrIdempotencyKeyUsed
+	case strings.Contains(key, "email"):
+		return ErrEmailTaken
+	case strings.Contains(key, "login"):
+		return ErrLoginTaken
+	case strings.Contains(key, "number"):
+		return ErrOrderNumUsed
+	}
+	return nil
+}
@@ -0,0 +1,269 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/pinbrain/gophermart/internal/model"
+)
+
+var (
+	ErrNoHold        = errors.New("hold not found in db")
+	ErrHoldNotActive = errors.New("hold is already captured, released or expired")
+)
+
+// HoldBalance резервирует sum баллов пользователя в счет заказа на время ttl. Зарезервированные баллы
+// сразу уходят из текущего баланса и списываются через CaptureHold или возвращаются через ReleaseHold.
+// К резерву применяются те же ограничения, что и к списанию.
+func (st *DBStorage) HoldBalance(
+	ctx context.Context, userID int, order string, sum model.Money, ttl time.Duration,
+) (*model.Hold, error) {
+	if sum < st.minWithdrawSum {
+		return nil, ErrWithdrawBelowMin
+	}
+	tx, err := st.begin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to hold balance: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	if err = st.lockBalance(ctx, tx, userID); err != nil {
+		return nil, fmt.Errorf("failed to hold balance: %w", err)
+	}
+	if err = st.checkWithdrawLimits(ctx, tx, userID, sum); err != nil {
+		return nil, err
+	}
+	var withdrawn bool
+	err = tx.QueryRow(ctx, `
+		SELECT EXISTS (SELECT 1 FROM withdrawals WHERE number = ? AND status <> 'CANCELED')`,
+		order,
+	).Scan(&withdrawn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to hold balance: %w", err)
+	}
+	if withdrawn {
+		return nil, ErrOrderNumUsed
+	}
+	balance, err := selectBalance(ctx, tx, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to hold balance: %w", err)
+	}
+	if balance.Current < sum {
+		return nil, ErrInsufficientFunds
+	}
+
+	now := sqlNow()
+	hold := model.Hold{
+		UserID:    userID,
+		Number:    order,
+		Sum:       sum,
+		Status:    model.HoldActive,
+		ExpiresAt: now.Add(ttl),
+		CreatedAt: now,
+	}
+	holdID, err := tx.insert(ctx, `
+		INSERT INTO balance_holds (user_id, number, sum, expires_at, created_at) VALUES (?, ?, ?, ?, ?)`,
+		userID, order, sum, hold.ExpiresAt, hold.CreatedAt,
+	)
+	if err != nil {
+		if st.isUniqueViolation(err) {
+			return nil, ErrOrderNumUsed
+		}
+		return nil, fmt.Errorf("failed to hold balance: %w", err)
+	}
+	hold.ID = int(holdID)
+	err = st.appendBalanceEvent(ctx, tx, model.BalanceEvent{
+		UserID:       userID,
+		Type:         model.BalanceEventHold,
+		Number:       order,
+		CurrentDelta: -sum,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to hold balance: %w", err)
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return nil, fmt.Errorf("failed to hold balance: %w", err)
+	}
+	return &hold, nil
+}
+
+// selectActiveHold блокирует резерв пользователя и возвращает его, если резерв еще не списан и не снят.
+// Вызывающий должен предварительно заблокировать баланс пользователя через lockBalance.
+func (st *DBStorage) selectActiveHold(ctx context.Context, tx sqlQuerier, userID, holdID int) (*model.Hold, bool, error) {
+	hold := model.Hold{ID: holdID, UserID: userID}
+	var expired bool
+	err := tx.QueryRow(ctx, `
+		SELECT number, sum, status, expires_at, created_at, expires_at <= ?
+		FROM balance_holds WHERE id = ? AND user_id = ?`+st.db.dialect.forUpdate,
+		sqlNow(), holdID, userID,
+	).Scan(&hold.Number, &hold.Sum, &hold.Status, &hold.ExpiresAt, &hold.CreatedAt, &expired)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, false, ErrNoHold
+		}
+		return nil, false, err
+	}
+	if hold.Status != model.HoldActive {
+		return nil, false, ErrHoldNotActive
+	}
+	return &hold, expired, nil
+}
+
+// CaptureHold списывает зарезервированные баллы: резерв превращается в обычное списание по заказу.
+// Истекший резерв списать нельзя.
+func (st *DBStorage) CaptureHold(ctx context.Context, userID, holdID int) (*model.Hold, error) {
+	tx, err := st.begin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to capture hold: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	if err = st.lockBalance(ctx, tx, userID); err != nil {
+		return nil, fmt.Errorf("failed to capture hold: %w", err)
+	}
+	hold, expired, err := st.selectActiveHold(ctx, tx, userID, holdID)
+	if err != nil {
+		if errors.Is(err, ErrNoHold) || errors.Is(err, ErrHoldNotActive) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("failed to capture hold: %w", err)
+	}
+	if expired {
+		return nil, ErrHoldNotActive
+	}
+
+	now := sqlNow()
+	_, err = tx.Exec(ctx, `
+		UPDATE balance_holds SET status = ?, resolved_at = ? WHERE id = ?`,
+		model.HoldCaptured, now, holdID,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to capture hold: %w", err)
+	}
+	hold.Status = model.HoldCaptured
+	_, err = tx.Exec(ctx, `
+		INSERT INTO withdrawals (user_id, number, sum, status, created_at) VALUES (?, ?, ?, ?, ?)`,
+		userID, hold.Number, hold.Sum, model.WithdrawalDone, now,
+	)
+	if err != nil {
+		if st.isUniqueViolation(err) {
+			return nil, ErrOrderNumUsed
+		}
+		return nil, fmt.Errorf("failed to capture hold: %w", err)
+	}
+	// Текущий баланс уменьшен при резервировании, здесь растет только сумма списанных баллов
+	err = st.appendBalanceEvent(ctx, tx, model.BalanceEvent{
+		UserID:         userID,
+		Type:           model.BalanceEventHoldCapture,
+		Number:         hold.Number,
+		WithdrawnDelta: hold.Sum,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to capture hold: %w", err)
+	}
+	err = appendOutboxEvent(ctx, tx, userID, model.WebhookBalanceWithdrawn, map[string]any{
+		"order": hold.Number,
+		"sum":   hold.Sum,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to capture hold: %w", err)
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return nil, fmt.Errorf("failed to capture hold: %w", err)
+	}
+	return hold, nil
+}
+
+// ReleaseHold снимает резерв и возвращает зарезервированные баллы на баланс пользователя
+func (st *DBStorage) ReleaseHold(ctx context.Context, userID, holdID int) (*model.Hold, error) {
+	return st.releaseHold(ctx, userID, holdID, model.HoldReleased)
+}
+
+func (st *DBStorage) releaseHold(ctx context.Context, userID, holdID int, status model.HoldStatus) (*model.Hold, error) {
+	tx, err := st.begin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to release hold: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	if err = st.lockBalance(ctx, tx, userID); err != nil {
+		return nil, fmt.Errorf("failed to release hold: %w", err)
+	}
+	hold, _, err := st.selectActiveHold(ctx, tx, userID, holdID)
+	if err != nil {
+		if errors.Is(err, ErrNoHold) || errors.Is(err, ErrHoldNotActive) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("failed to release hold: %w", err)
+	}
+
+	_, err = tx.Exec(ctx, `
+		UPDATE balance_holds SET status = ?, resolved_at = ? WHERE id = ?`,
+		status, sqlNow(), holdID,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to release hold: %w", err)
+	}
+	hold.Status = status
+	err = st.appendBalanceEvent(ctx, tx, model.BalanceEvent{
+		UserID:       userID,
+		Type:         model.BalanceEventHoldRelease,
+		Number:       hold.Number,
+		CurrentDelta: hold.Sum,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to release hold: %w", err)
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return nil, fmt.Errorf("failed to release hold: %w", err)
+	}
+	return hold, nil
+}
+
+// ReleaseExpiredHolds снимает не более limit истекших резервов и возвращает их.
+// Каждый резерв снимается в отдельной транзакции под блокировкой баланса своего пользователя.
+func (st *DBStorage) ReleaseExpiredHolds(ctx context.Context, limit int) ([]model.Hold, error) {
+	rows, err := st.conn(ctx).Query(ctx, `
+		SELECT id, user_id FROM balance_holds
+		WHERE status = 'HELD' AND expires_at <= ?
+		ORDER BY expires_at
+		LIMIT ?`,
+		sqlNow(), limit,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to select expired holds: %w", err)
+	}
+	var expired []model.Hold
+	for rows.Next() {
+		var hold model.Hold
+		if err = rows.Scan(&hold.ID, &hold.UserID); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to select expired holds: %w", err)
+		}
+		expired = append(expired, hold)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to select expired holds: %w", err)
+	}
+
+	released := make([]model.Hold, 0, len(expired))
+	for _, hold := range expired {
+		res, err := st.releaseHold(ctx, hold.UserID, hold.ID, model.HoldExpired)
+		if err != nil {
+			// Резерв мог быть списан или снят пользователем после выборки
+			if errors.Is(err, ErrHoldNotActive) || errors.Is(err, ErrNoHold) {
+				continue
+			}
+			return released, err
+		}
+		released = append(released, *res)
+	}
+	return released, nil
+}
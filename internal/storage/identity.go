@@ -0,0 +1,120 @@
+package storage
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pinbrain/gophermart/internal/model"
+)
+
+// LoginWithIdentity возвращает пользователя, привязанного к учетной записи внешнего провайдера.
+// Если привязки нет и linkByEmail установлен, учетная запись привязывается к пользователю с тем же
+// подтвержденным email, если его подтвердил и провайдер. Иначе создается новый пользователь без пароля.
+func (st *DBStorage) LoginWithIdentity(
+	ctx context.Context, identity model.ExternalIdentity, linkByEmail bool,
+) (*model.User, error) {
+	tx, err := st.begin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to login with identity: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	var user model.User
+	err = tx.QueryRow(ctx, `
+		SELECT u.id, u.login, u.token_version FROM user_identities ui JOIN users u ON u.id = ui.user_id
+		WHERE ui.issuer = ? AND ui.subject = ?`,
+		identity.Issuer, identity.Subject,
+	).Scan(&user.ID, &user.Login, &user.TokenVersion)
+	if err == nil {
+		return &user, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("failed to login with identity: %w", err)
+	}
+
+	email := strings.ToLower(identity.Email)
+	if linkByEmail && identity.EmailVerified && email != "" {
+		err = tx.QueryRow(ctx, `
+			SELECT id, login, token_version FROM users WHERE email = ? AND email_verified_at IS NOT NULL`, email,
+		).Scan(&user.ID, &user.Login, &user.TokenVersion)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("failed to login with identity: %w", err)
+		}
+	}
+	if user.ID == 0 {
+		if err = st.createIdentityUser(ctx, tx, identity, &user); err != nil {
+			return nil, fmt.Errorf("failed to login with identity: %w", err)
+		}
+	}
+
+	_, err = tx.Exec(ctx, `
+		INSERT INTO user_identities (issuer, subject, user_id, created_at) VALUES (?, ?, ?, ?)`,
+		identity.Issuer, identity.Subject, user.ID, sqlNow(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to link identity: %w", err)
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return nil, fmt.Errorf("failed to login with identity: %w", err)
+	}
+	return &user, nil
+}
+
+// createIdentityUser создает пользователя без пароля. Логин берется из preferred_username провайдера,
+// а если он занят - строится по идентификатору учетной записи у провайдера.
+func (st *DBStorage) createIdentityUser(
+	ctx context.Context, tx *sqlTx, identity model.ExternalIdentity, user *model.User,
+) error {
+	sum := sha256.Sum256([]byte(identity.Issuer + " " + identity.Subject))
+	fallbackLogin := "oidc_" + hex.EncodeToString(sum[:6])
+	logins := []string{fallbackLogin}
+	if identity.PreferredUsername != "" {
+		logins = []string{strings.ToLower(identity.PreferredUsername), fallbackLogin}
+	}
+	email := strings.ToLower(identity.Email)
+	if email != "" {
+		// Занятый другим пользователем email не сохраняется, пользователь сможет указать его позже
+		var emailTaken bool
+		err := tx.QueryRow(ctx, `SELECT EXISTS (SELECT 1 FROM users WHERE email = ?)`, email).Scan(&emailTaken)
+		if err != nil {
+			return err
+		}
+		if emailTaken {
+			email = ""
+		}
+	}
+	now := sqlNow()
+	var emailVerifiedAt *time.Time
+	if email != "" && identity.EmailVerified {
+		emailVerifiedAt = &now
+	}
+
+	for _, login := range logins {
+		var userID int64
+		err := tx.savepoint(ctx, func() (err error) {
+			userID, err = tx.insert(ctx, `
+				INSERT INTO users (login, password_hash, email, email_verified_at, created_at)
+				VALUES (?, '', NULLIF(?, ''), ?, ?)`,
+				login, email, emailVerifiedAt, now,
+			)
+			return err
+		})
+		if errors.Is(st.uniqueViolationErr(err), ErrLoginTaken) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		user.ID, user.Login = int(userID), login
+		_, err = tx.Exec(ctx, `INSERT INTO balances (user_id) VALUES (?)`, user.ID)
+		return err
+	}
+	return ErrLoginTaken
+}
@@ -0,0 +1,34 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE balance_events (
+  id BIGSERIAL PRIMARY KEY,
+  user_id INT NOT NULL REFERENCES users (id),
+  type VARCHAR(20) NOT NULL,
+  number VARCHAR,
+  current_delta FLOAT NOT NULL DEFAULT 0,
+  withdrawn_delta FLOAT NOT NULL DEFAULT 0,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+CREATE INDEX balance_events_user_id_idx ON balance_events (user_id, id);
+COMMENT ON COLUMN balance_events.user_id IS 'Id пользователя, баланс которого изменился';
+COMMENT ON COLUMN balance_events.type IS 'Тип изменения баланса';
+COMMENT ON COLUMN balance_events.number IS 'Номер заказа, по которому изменился баланс';
+COMMENT ON COLUMN balance_events.current_delta IS 'Изменение текущего баланса';
+COMMENT ON COLUMN balance_events.withdrawn_delta IS 'Изменение суммы списанных баллов';
+COMMENT ON COLUMN balance_events.created_at IS 'Timestamp создания записи';
+
+ALTER TABLE balances ADD COLUMN last_event_id BIGINT NOT NULL DEFAULT 0;
+COMMENT ON COLUMN balances.last_event_id IS 'Id последнего события, учтенного в балансе';
+
+-- Текущие балансы переносятся в журнал как начальные события
+INSERT INTO balance_events (user_id, type, current_delta, withdrawn_delta)
+SELECT user_id, 'OPENING', current, withdrawn FROM balances;
+UPDATE balances b SET last_event_id = e.id
+FROM balance_events e WHERE e.user_id = b.user_id;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE balances DROP COLUMN last_event_id;
+DROP TABLE balance_events;
+-- +goose StatementEnd
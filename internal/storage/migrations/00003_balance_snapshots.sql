@@ -0,0 +1,35 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE balance_snapshots (
+  user_id INT PRIMARY KEY REFERENCES users (id),
+  last_event_id BIGINT NOT NULL,
+  current FLOAT NOT NULL,
+  withdrawn FLOAT NOT NULL,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+COMMENT ON COLUMN balance_snapshots.user_id IS 'Id пользователя';
+COMMENT ON COLUMN balance_snapshots.last_event_id IS 'Id последнего события, учтенного в снимке';
+COMMENT ON COLUMN balance_snapshots.current IS 'Текущий баланс на момент снимка';
+COMMENT ON COLUMN balance_snapshots.withdrawn IS 'Сумма списанных баллов на момент снимка';
+COMMENT ON COLUMN balance_snapshots.created_at IS 'Timestamp создания снимка';
+
+CREATE TABLE balance_events_archive (
+  id BIGINT PRIMARY KEY,
+  user_id INT NOT NULL REFERENCES users (id),
+  type VARCHAR(20) NOT NULL,
+  number VARCHAR,
+  current_delta FLOAT NOT NULL,
+  withdrawn_delta FLOAT NOT NULL,
+  created_at TIMESTAMPTZ NOT NULL
+);
+CREATE INDEX balance_events_archive_user_id_idx ON balance_events_archive (user_id, created_at);
+COMMENT ON TABLE balance_events_archive IS 'События изменения баланса, учтенные в снимках';
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+INSERT INTO balance_events (id, user_id, type, number, current_delta, withdrawn_delta, created_at)
+SELECT id, user_id, type, number, current_delta, withdrawn_delta, created_at FROM balance_events_archive;
+DROP TABLE balance_events_archive;
+DROP TABLE balance_snapshots;
+-- +goose StatementEnd
@@ -0,0 +1,10 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE orders ADD COLUMN status_reason VARCHAR;
+COMMENT ON COLUMN orders.status_reason IS 'Причина установки статуса заказа';
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE orders DROP COLUMN status_reason;
+-- +goose StatementEnd
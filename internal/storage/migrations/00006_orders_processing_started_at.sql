@@ -0,0 +1,10 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE orders ADD COLUMN processing_started_at TIMESTAMPTZ;
+COMMENT ON COLUMN orders.processing_started_at IS 'Timestamp передачи заказа воркеру агента начислений';
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE orders DROP COLUMN processing_started_at;
+-- +goose StatementEnd
@@ -0,0 +1,15 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE agent_state (
+  id BOOLEAN PRIMARY KEY DEFAULT TRUE CHECK (id),
+  rate_limit_until TIMESTAMPTZ
+);
+COMMENT ON TABLE agent_state IS 'Состояние агента начислений, сохраняемое между перезапусками';
+COMMENT ON COLUMN agent_state.rate_limit_until IS 'Момент окончания ограничения запросов к системе начислений';
+INSERT INTO agent_state DEFAULT VALUES;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE agent_state;
+-- +goose StatementEnd
@@ -0,0 +1,15 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE revoked_tokens (
+  jti VARCHAR(64) PRIMARY KEY,
+  expires_at TIMESTAMPTZ NOT NULL
+);
+COMMENT ON TABLE revoked_tokens IS 'Отозванные до истечения срока действия JWT пользователей';
+COMMENT ON COLUMN revoked_tokens.jti IS 'Идентификатор токена';
+COMMENT ON COLUMN revoked_tokens.expires_at IS 'Срок действия токена, после которого запись не нужна';
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE revoked_tokens;
+-- +goose StatementEnd
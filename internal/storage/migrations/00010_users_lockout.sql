@@ -0,0 +1,13 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE users ADD COLUMN failed_logins INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE users ADD COLUMN locked_until TIMESTAMPTZ;
+COMMENT ON COLUMN users.failed_logins IS 'Количество неудачных попыток входа подряд';
+COMMENT ON COLUMN users.locked_until IS 'Момент, до которого вход пользователя заблокирован';
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE users DROP COLUMN locked_until;
+ALTER TABLE users DROP COLUMN failed_logins;
+-- +goose StatementEnd
@@ -0,0 +1,21 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE sessions (
+  id_hash VARCHAR(64) PRIMARY KEY,
+  user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  ip VARCHAR NOT NULL DEFAULT '',
+  user_agent VARCHAR NOT NULL DEFAULT '',
+  created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  last_seen_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  expires_at TIMESTAMPTZ NOT NULL
+);
+COMMENT ON TABLE sessions IS 'Серверные сессии пользователей';
+COMMENT ON COLUMN sessions.id_hash IS 'SHA-256 идентификатора сессии, сам идентификатор не хранится';
+COMMENT ON COLUMN sessions.last_seen_at IS 'Момент последнего запроса в рамках сессии';
+CREATE INDEX sessions_user_id_idx ON sessions (user_id);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE sessions;
+-- +goose StatementEnd
@@ -0,0 +1,28 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE users ADD COLUMN email VARCHAR;
+ALTER TABLE users ADD COLUMN email_verified_at TIMESTAMPTZ;
+ALTER TABLE users ADD CONSTRAINT users_email_key UNIQUE (email);
+COMMENT ON COLUMN users.email IS 'Email пользователя';
+COMMENT ON COLUMN users.email_verified_at IS 'Момент подтверждения email, NULL - email не подтвержден';
+
+CREATE TABLE email_verifications (
+  token_hash VARCHAR(64) PRIMARY KEY,
+  user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  email VARCHAR NOT NULL,
+  expires_at TIMESTAMPTZ NOT NULL,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+COMMENT ON TABLE email_verifications IS 'Токены подтверждения email';
+COMMENT ON COLUMN email_verifications.token_hash IS 'SHA-256 токена, сам токен не хранится';
+COMMENT ON COLUMN email_verifications.email IS 'Подтверждаемый email, токен недействителен после смены email';
+CREATE INDEX email_verifications_user_id_idx ON email_verifications (user_id);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE email_verifications;
+ALTER TABLE users DROP CONSTRAINT users_email_key;
+ALTER TABLE users DROP COLUMN email_verified_at;
+ALTER TABLE users DROP COLUMN email;
+-- +goose StatementEnd
@@ -0,0 +1,19 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE user_identities (
+  issuer VARCHAR NOT NULL,
+  subject VARCHAR NOT NULL,
+  user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  PRIMARY KEY (issuer, subject)
+);
+COMMENT ON TABLE user_identities IS 'Учетные записи пользователей во внешних провайдерах (OIDC)';
+COMMENT ON COLUMN user_identities.issuer IS 'Издатель (issuer) провайдера';
+COMMENT ON COLUMN user_identities.subject IS 'Идентификатор пользователя у провайдера (sub)';
+CREATE INDEX user_identities_user_id_idx ON user_identities (user_id);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE user_identities;
+-- +goose StatementEnd
@@ -0,0 +1,10 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE sessions ADD COLUMN elevated_until TIMESTAMPTZ;
+COMMENT ON COLUMN sessions.elevated_until IS 'До какого момента сессия подтверждена повторным вводом пароля';
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE sessions DROP COLUMN elevated_until;
+-- +goose StatementEnd
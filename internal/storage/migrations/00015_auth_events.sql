@@ -0,0 +1,21 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE auth_events (
+  id BIGSERIAL PRIMARY KEY,
+  user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  type VARCHAR(32) NOT NULL,
+  ip VARCHAR NOT NULL DEFAULT '',
+  user_agent VARCHAR NOT NULL DEFAULT '',
+  created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+COMMENT ON TABLE auth_events IS 'Журнал событий аутентификации пользователей';
+COMMENT ON COLUMN auth_events.type IS 'Тип события: register, login, login_failed, logout, token_refresh, password_change и т.д.';
+COMMENT ON COLUMN auth_events.ip IS 'IP-адрес клиента';
+COMMENT ON COLUMN auth_events.user_agent IS 'User-Agent клиента';
+CREATE INDEX auth_events_user_id_created_at_idx ON auth_events (user_id, created_at DESC);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE auth_events;
+-- +goose StatementEnd
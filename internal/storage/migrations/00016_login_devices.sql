@@ -0,0 +1,29 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE login_devices (
+  user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  device_hash VARCHAR(64) NOT NULL,
+  network VARCHAR NOT NULL,
+  first_seen_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  last_seen_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  PRIMARY KEY (user_id, device_hash, network)
+);
+COMMENT ON TABLE login_devices IS 'Устройства и сети, из которых пользователь входил в сервис';
+COMMENT ON COLUMN login_devices.device_hash IS 'SHA-256 User-Agent клиента';
+COMMENT ON COLUMN login_devices.network IS 'Подсеть клиента (/24 для IPv4, /48 для IPv6)';
+
+CREATE TABLE login_verifications (
+  token_hash VARCHAR(64) PRIMARY KEY,
+  user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  ip VARCHAR NOT NULL,
+  user_agent VARCHAR NOT NULL,
+  expires_at TIMESTAMPTZ NOT NULL
+);
+COMMENT ON TABLE login_verifications IS 'Ожидающие подтверждения по email входы с новых устройств';
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE login_verifications;
+DROP TABLE login_devices;
+-- +goose StatementEnd
@@ -0,0 +1,10 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE users ADD COLUMN token_version INTEGER NOT NULL DEFAULT 0;
+COMMENT ON COLUMN users.token_version IS 'Версия токенов пользователя, увеличивается при смене пароля, чтобы выданные ранее JWT перестали действовать';
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE users DROP COLUMN token_version;
+-- +goose StatementEnd
@@ -0,0 +1,14 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE users ADD COLUMN role VARCHAR(20) NOT NULL DEFAULT 'user';
+-- Для существующих пользователей дата регистрации неизвестна, им проставляется момент миграции
+ALTER TABLE users ADD COLUMN created_at TIMESTAMPTZ NOT NULL DEFAULT NOW();
+COMMENT ON COLUMN users.role IS 'Роль пользователя';
+COMMENT ON COLUMN users.created_at IS 'Timestamp регистрации пользователя';
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE users DROP COLUMN created_at;
+ALTER TABLE users DROP COLUMN role;
+-- +goose StatementEnd
@@ -0,0 +1,13 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE withdrawals ADD COLUMN idempotency_key VARCHAR;
+CREATE UNIQUE INDEX withdrawals_idempotency_key_idx ON withdrawals (user_id, idempotency_key)
+WHERE idempotency_key IS NOT NULL;
+COMMENT ON COLUMN withdrawals.idempotency_key IS 'Ключ идемпотентности запроса списания, переданный клиентом';
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP INDEX withdrawals_idempotency_key_idx;
+ALTER TABLE withdrawals DROP COLUMN idempotency_key;
+-- +goose StatementEnd
@@ -0,0 +1,22 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE transfers (
+  id SERIAL PRIMARY KEY,
+  from_user_id INT NOT NULL REFERENCES users (id),
+  to_user_id INT NOT NULL REFERENCES users (id),
+  sum FLOAT NOT NULL,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+CREATE INDEX transfers_from_user_id_idx ON transfers (from_user_id);
+CREATE INDEX transfers_to_user_id_idx ON transfers (to_user_id);
+COMMENT ON TABLE transfers IS 'Переводы баллов между пользователями';
+COMMENT ON COLUMN transfers.from_user_id IS 'Id пользователя-отправителя';
+COMMENT ON COLUMN transfers.to_user_id IS 'Id пользователя-получателя';
+COMMENT ON COLUMN transfers.sum IS 'Сумма переведенных баллов';
+COMMENT ON COLUMN transfers.created_at IS 'Timestamp создания записи';
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE transfers;
+-- +goose StatementEnd
@@ -0,0 +1,43 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE webhooks (
+  id SERIAL PRIMARY KEY,
+  user_id INT NOT NULL REFERENCES users (id),
+  url VARCHAR NOT NULL,
+  events VARCHAR[] NOT NULL,
+  secret VARCHAR NOT NULL,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+CREATE INDEX webhooks_user_id_idx ON webhooks (user_id);
+COMMENT ON TABLE webhooks IS 'Адреса, на которые пользователи получают уведомления о событиях';
+COMMENT ON COLUMN webhooks.url IS 'Адрес, на который отправляются события';
+COMMENT ON COLUMN webhooks.events IS 'Типы событий, на которые подписан адрес';
+COMMENT ON COLUMN webhooks.secret IS 'Ключ подписи HMAC-SHA256 тела запроса';
+
+CREATE TABLE webhook_deliveries (
+  id BIGSERIAL PRIMARY KEY,
+  webhook_id INT NOT NULL REFERENCES webhooks (id) ON DELETE CASCADE,
+  event VARCHAR(50) NOT NULL,
+  payload JSONB NOT NULL,
+  status VARCHAR(10) NOT NULL DEFAULT 'PENDING',
+  attempts INT NOT NULL DEFAULT 0,
+  next_attempt_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  last_error VARCHAR,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  delivered_at TIMESTAMPTZ
+);
+CREATE INDEX webhook_deliveries_pending_idx ON webhook_deliveries (next_attempt_at) WHERE status = 'PENDING';
+COMMENT ON TABLE webhook_deliveries IS 'Очередь доставки событий на webhooks';
+COMMENT ON COLUMN webhook_deliveries.event IS 'Тип события';
+COMMENT ON COLUMN webhook_deliveries.payload IS 'Данные события';
+COMMENT ON COLUMN webhook_deliveries.status IS 'Статус доставки: PENDING, DELIVERED или FAILED';
+COMMENT ON COLUMN webhook_deliveries.attempts IS 'Количество неудачных попыток доставки';
+COMMENT ON COLUMN webhook_deliveries.next_attempt_at IS 'Время следующей попытки доставки';
+COMMENT ON COLUMN webhook_deliveries.last_error IS 'Ошибка последней попытки доставки';
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE webhook_deliveries;
+DROP TABLE webhooks;
+-- +goose StatementEnd
@@ -0,0 +1,29 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE orders ALTER COLUMN accrual TYPE NUMERIC(14, 2) USING ROUND(accrual::numeric, 2);
+ALTER TABLE withdrawals ALTER COLUMN sum TYPE NUMERIC(14, 2) USING ROUND(sum::numeric, 2);
+ALTER TABLE transfers ALTER COLUMN sum TYPE NUMERIC(14, 2) USING ROUND(sum::numeric, 2);
+ALTER TABLE balances
+  ALTER COLUMN current TYPE NUMERIC(14, 2) USING ROUND(current::numeric, 2),
+  ALTER COLUMN withdrawn TYPE NUMERIC(14, 2) USING ROUND(withdrawn::numeric, 2);
+ALTER TABLE balance_events
+  ALTER COLUMN current_delta TYPE NUMERIC(14, 2) USING ROUND(current_delta::numeric, 2),
+  ALTER COLUMN withdrawn_delta TYPE NUMERIC(14, 2) USING ROUND(withdrawn_delta::numeric, 2);
+ALTER TABLE balance_events_archive
+  ALTER COLUMN current_delta TYPE NUMERIC(14, 2) USING ROUND(current_delta::numeric, 2),
+  ALTER COLUMN withdrawn_delta TYPE NUMERIC(14, 2) USING ROUND(withdrawn_delta::numeric, 2);
+ALTER TABLE balance_snapshots
+  ALTER COLUMN current TYPE NUMERIC(14, 2) USING ROUND(current::numeric, 2),
+  ALTER COLUMN withdrawn TYPE NUMERIC(14, 2) USING ROUND(withdrawn::numeric, 2);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE orders ALTER COLUMN accrual TYPE FLOAT;
+ALTER TABLE withdrawals ALTER COLUMN sum TYPE FLOAT;
+ALTER TABLE transfers ALTER COLUMN sum TYPE FLOAT;
+ALTER TABLE balances ALTER COLUMN current TYPE FLOAT, ALTER COLUMN withdrawn TYPE FLOAT;
+ALTER TABLE balance_events ALTER COLUMN current_delta TYPE FLOAT, ALTER COLUMN withdrawn_delta TYPE FLOAT;
+ALTER TABLE balance_events_archive ALTER COLUMN current_delta TYPE FLOAT, ALTER COLUMN withdrawn_delta TYPE FLOAT;
+ALTER TABLE balance_snapshots ALTER COLUMN current TYPE FLOAT, ALTER COLUMN withdrawn TYPE FLOAT;
+-- +goose StatementEnd
@@ -0,0 +1,21 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE currency_rates (
+  id SERIAL PRIMARY KEY,
+  currency VARCHAR(3) NOT NULL,
+  rate NUMERIC(18, 6) NOT NULL,
+  effective_from TIMESTAMPTZ NOT NULL,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  UNIQUE (currency, effective_from)
+);
+COMMENT ON TABLE currency_rates IS 'Курсы пересчета баллов в валюты';
+COMMENT ON COLUMN currency_rates.currency IS 'Код валюты ISO 4217';
+COMMENT ON COLUMN currency_rates.rate IS 'Стоимость одного балла в валюте';
+COMMENT ON COLUMN currency_rates.effective_from IS 'Момент, с которого действует курс';
+COMMENT ON COLUMN currency_rates.created_at IS 'Timestamp создания записи';
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE currency_rates;
+-- +goose StatementEnd
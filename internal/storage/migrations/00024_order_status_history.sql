@@ -0,0 +1,28 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE order_status_history (
+  id BIGSERIAL PRIMARY KEY,
+  order_id INT NOT NULL REFERENCES orders (id) ON DELETE CASCADE,
+  from_status VARCHAR(10) NOT NULL,
+  status VARCHAR(10) NOT NULL,
+  accrual NUMERIC(14, 2),
+  reason VARCHAR,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+CREATE INDEX order_status_history_order_id_idx ON order_status_history (order_id, id);
+COMMENT ON TABLE order_status_history IS 'История изменения статусов заказов';
+COMMENT ON COLUMN order_status_history.from_status IS 'Статус заказа до изменения';
+COMMENT ON COLUMN order_status_history.status IS 'Статус заказа после изменения';
+COMMENT ON COLUMN order_status_history.accrual IS 'Сумма начисленных баллов, установленная при изменении';
+COMMENT ON COLUMN order_status_history.reason IS 'Причина установки статуса, если статус выставлен не по ответу системы начислений';
+COMMENT ON COLUMN order_status_history.created_at IS 'Timestamp изменения статуса';
+
+-- Для уже обработанных заказов известен только момент последнего изменения статуса
+INSERT INTO order_status_history (order_id, from_status, status, accrual, reason, created_at)
+SELECT id, 'NEW', status, accrual, status_reason, updated_at FROM orders WHERE status <> 'NEW';
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE order_status_history;
+-- +goose StatementEnd
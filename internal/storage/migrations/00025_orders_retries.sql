@@ -0,0 +1,13 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE orders ADD COLUMN retry_count INT NOT NULL DEFAULT 0;
+ALTER TABLE orders ADD COLUMN retried_at TIMESTAMPTZ;
+COMMENT ON COLUMN orders.retry_count IS 'Сколько раз пользователь запрашивал повторную обработку заказа';
+COMMENT ON COLUMN orders.retried_at IS 'Timestamp последнего запроса повторной обработки заказа';
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE orders DROP COLUMN retried_at;
+ALTER TABLE orders DROP COLUMN retry_count;
+-- +goose StatementEnd
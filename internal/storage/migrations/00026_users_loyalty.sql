@@ -0,0 +1,19 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE users ADD COLUMN lifetime_accrual NUMERIC(14, 2) NOT NULL DEFAULT 0;
+ALTER TABLE users ADD COLUMN tier VARCHAR(10) NOT NULL DEFAULT 'BRONZE';
+COMMENT ON COLUMN users.lifetime_accrual IS 'Сумма начисленных пользователю баллов за все время';
+COMMENT ON COLUMN users.tier IS 'Уровень пользователя в программе лояльности';
+
+UPDATE users u SET lifetime_accrual = o.total
+FROM (
+  SELECT user_id, SUM(accrual) AS total FROM orders WHERE accrual IS NOT NULL GROUP BY user_id
+) o
+WHERE o.user_id = u.id;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE users DROP COLUMN tier;
+ALTER TABLE users DROP COLUMN lifetime_accrual;
+-- +goose StatementEnd
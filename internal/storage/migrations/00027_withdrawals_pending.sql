@@ -0,0 +1,23 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE withdrawals ADD COLUMN status VARCHAR(10) NOT NULL DEFAULT 'DONE';
+ALTER TABLE withdrawals ADD COLUMN cancelable_until TIMESTAMPTZ;
+ALTER TABLE withdrawals ADD COLUMN canceled_at TIMESTAMPTZ;
+COMMENT ON COLUMN withdrawals.status IS 'Статус списания: PENDING - можно отменить до cancelable_until, DONE - завершено, CANCELED - отменено';
+COMMENT ON COLUMN withdrawals.cancelable_until IS 'Timestamp, до которого пользователь может отменить списание';
+COMMENT ON COLUMN withdrawals.canceled_at IS 'Timestamp отмены списания';
+
+-- Номер заказа отмененного списания можно использовать повторно
+ALTER TABLE withdrawals DROP CONSTRAINT withdrawals_number_key;
+CREATE UNIQUE INDEX withdrawals_number_idx ON withdrawals (number) WHERE status <> 'CANCELED';
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DELETE FROM withdrawals WHERE status = 'CANCELED';
+DROP INDEX withdrawals_number_idx;
+ALTER TABLE withdrawals ADD CONSTRAINT withdrawals_number_key UNIQUE (number);
+ALTER TABLE withdrawals DROP COLUMN canceled_at;
+ALTER TABLE withdrawals DROP COLUMN cancelable_until;
+ALTER TABLE withdrawals DROP COLUMN status;
+-- +goose StatementEnd
@@ -0,0 +1,29 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE balance_holds (
+  id SERIAL PRIMARY KEY,
+  user_id INT NOT NULL REFERENCES users (id),
+  number VARCHAR NOT NULL,
+  sum NUMERIC(14, 2) NOT NULL,
+  status VARCHAR(10) NOT NULL DEFAULT 'HELD',
+  expires_at TIMESTAMPTZ NOT NULL,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  resolved_at TIMESTAMPTZ
+);
+CREATE INDEX balance_holds_user_id_idx ON balance_holds (user_id);
+CREATE INDEX balance_holds_expires_at_idx ON balance_holds (expires_at) WHERE status = 'HELD';
+CREATE UNIQUE INDEX balance_holds_number_idx ON balance_holds (number) WHERE status = 'HELD';
+COMMENT ON TABLE balance_holds IS 'Резервы баллов в счет заказов, списываемые после подтверждения покупки';
+COMMENT ON COLUMN balance_holds.user_id IS 'Id пользователя, баллы которого зарезервированы';
+COMMENT ON COLUMN balance_holds.number IS 'Номер заказа';
+COMMENT ON COLUMN balance_holds.sum IS 'Сумма зарезервированных баллов';
+COMMENT ON COLUMN balance_holds.status IS 'Статус резерва: HELD, CAPTURED, RELEASED или EXPIRED';
+COMMENT ON COLUMN balance_holds.expires_at IS 'Timestamp, после которого резерв снимается автоматически';
+COMMENT ON COLUMN balance_holds.created_at IS 'Timestamp создания записи';
+COMMENT ON COLUMN balance_holds.resolved_at IS 'Timestamp списания или снятия резерва';
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE balance_holds;
+-- +goose StatementEnd
@@ -0,0 +1,10 @@
+-- +goose Up
+-- +goose StatementBegin
+-- Индекс с varchar_pattern_ops используется для поиска по префиксу номера (LIKE 'prefix%') при любой локали БД
+CREATE INDEX orders_user_id_number_prefix_idx ON orders (user_id, number varchar_pattern_ops);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP INDEX orders_user_id_number_prefix_idx;
+-- +goose StatementEnd
@@ -0,0 +1,31 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE orders_archive (
+  id INT PRIMARY KEY,
+  user_id INT NOT NULL REFERENCES users (id),
+  number VARCHAR UNIQUE NOT NULL,
+  status VARCHAR(10) NOT NULL,
+  accrual NUMERIC(14, 2),
+  status_reason VARCHAR,
+  created_at TIMESTAMPTZ NOT NULL,
+  updated_at TIMESTAMPTZ NOT NULL,
+  archived_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+CREATE INDEX orders_archive_user_id_idx ON orders_archive (user_id, id);
+COMMENT ON TABLE orders_archive IS 'Обработанные заказы, перенесенные из orders по истечении срока хранения';
+COMMENT ON COLUMN orders_archive.id IS 'Id заказа в таблице orders, сохраняется для истории статусов';
+COMMENT ON COLUMN orders_archive.archived_at IS 'Timestamp переноса заказа в архив';
+
+-- История статусов остается у заказа и после переноса в архив
+ALTER TABLE order_status_history DROP CONSTRAINT order_status_history_order_id_fkey;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+INSERT INTO orders (id, user_id, number, status, accrual, status_reason, created_at, updated_at)
+SELECT id, user_id, number, status, accrual, status_reason, created_at, updated_at FROM orders_archive;
+DROP TABLE orders_archive;
+DELETE FROM order_status_history h WHERE NOT EXISTS (SELECT 1 FROM orders o WHERE o.id = h.order_id);
+ALTER TABLE order_status_history
+  ADD CONSTRAINT order_status_history_order_id_fkey FOREIGN KEY (order_id) REFERENCES orders (id) ON DELETE CASCADE;
+-- +goose StatementEnd
@@ -0,0 +1,11 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE orders ADD COLUMN fetch_failures INT NOT NULL DEFAULT 0;
+COMMENT ON COLUMN orders.fetch_failures IS 'Количество неудачных подряд запросов статуса заказа в системе начислений';
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+UPDATE orders SET status = 'NEW' WHERE status = 'STALLED';
+ALTER TABLE orders DROP COLUMN fetch_failures;
+-- +goose StatementEnd
@@ -0,0 +1,22 @@
+-- +goose Up
+-- +goose StatementBegin
+-- Агент начислений подписывается на канал orders_new и забирает заказы сразу после загрузки или
+-- возврата в очередь обработки, не дожидаясь очередного опроса
+CREATE FUNCTION notify_new_order() RETURNS trigger AS $$
+BEGIN
+  PERFORM pg_notify('orders_new', NEW.id::text);
+  RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER orders_new_notify
+AFTER INSERT OR UPDATE OF status ON orders
+FOR EACH ROW WHEN (NEW.status = 'NEW')
+EXECUTE FUNCTION notify_new_order();
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TRIGGER orders_new_notify ON orders;
+DROP FUNCTION notify_new_order();
+-- +goose StatementEnd
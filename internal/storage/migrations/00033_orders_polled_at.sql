@@ -0,0 +1,28 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE orders ADD COLUMN polled_at TIMESTAMPTZ;
+COMMENT ON COLUMN orders.polled_at IS 'Timestamp последнего получения статуса заказа из системы начислений';
+
+-- Заказы, зарегистрированные системой начислений, остаются в статусе NEW, поэтому уведомление
+-- отправляется только при загрузке заказа и при возврате в NEW из другого статуса
+DROP TRIGGER orders_new_notify ON orders;
+CREATE TRIGGER orders_new_notify
+AFTER INSERT ON orders
+FOR EACH ROW WHEN (NEW.status = 'NEW')
+EXECUTE FUNCTION notify_new_order();
+CREATE TRIGGER orders_requeued_notify
+AFTER UPDATE OF status ON orders
+FOR EACH ROW WHEN (NEW.status = 'NEW' AND OLD.status IS DISTINCT FROM NEW.status)
+EXECUTE FUNCTION notify_new_order();
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TRIGGER orders_requeued_notify ON orders;
+DROP TRIGGER orders_new_notify ON orders;
+CREATE TRIGGER orders_new_notify
+AFTER INSERT OR UPDATE OF status ON orders
+FOR EACH ROW WHEN (NEW.status = 'NEW')
+EXECUTE FUNCTION notify_new_order();
+ALTER TABLE orders DROP COLUMN polled_at;
+-- +goose StatementEnd
@@ -0,0 +1,28 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE outbox_events (
+  id BIGSERIAL PRIMARY KEY,
+  user_id INT NOT NULL REFERENCES users (id),
+  event VARCHAR(50) NOT NULL,
+  payload JSONB NOT NULL,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  next_attempt_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  published_at TIMESTAMPTZ
+);
+CREATE INDEX outbox_events_pending_idx ON outbox_events (next_attempt_at) WHERE published_at IS NULL;
+COMMENT ON TABLE outbox_events IS 'События, записанные в одной транзакции с изменением данных и ожидающие публикации';
+COMMENT ON COLUMN outbox_events.event IS 'Тип события';
+COMMENT ON COLUMN outbox_events.payload IS 'Данные события';
+COMMENT ON COLUMN outbox_events.next_attempt_at IS 'Время, до которого событие закреплено за публикующим его экземпляром сервиса';
+COMMENT ON COLUMN outbox_events.published_at IS 'Timestamp публикации события';
+
+ALTER TABLE webhook_deliveries ADD COLUMN outbox_event_id BIGINT;
+CREATE UNIQUE INDEX webhook_deliveries_outbox_event_idx ON webhook_deliveries (webhook_id, outbox_event_id);
+COMMENT ON COLUMN webhook_deliveries.outbox_event_id IS 'Id события outbox, из которого создана доставка';
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE webhook_deliveries DROP COLUMN outbox_event_id;
+DROP TABLE outbox_events;
+-- +goose StatementEnd
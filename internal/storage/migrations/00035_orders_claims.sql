@@ -0,0 +1,12 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE orders ADD COLUMN claimed_by VARCHAR;
+COMMENT ON COLUMN orders.claimed_by IS 'Идентификатор экземпляра агента начислений, за которым закреплен заказ';
+COMMENT ON COLUMN orders.processing_started_at IS 'Timestamp передачи заказа воркеру агента начислений или последнего продления закрепления заказа за агентом';
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE orders DROP COLUMN claimed_by;
+COMMENT ON COLUMN orders.processing_started_at IS 'Timestamp передачи заказа воркеру агента начислений';
+-- +goose StatementEnd
@@ -0,0 +1,10 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE order_status_history ADD COLUMN processing_id VARCHAR;
+COMMENT ON COLUMN order_status_history.processing_id IS 'Идентификатор попытки обработки заказа агентом начислений, в которой изменился статус';
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE order_status_history DROP COLUMN processing_id;
+-- +goose StatementEnd
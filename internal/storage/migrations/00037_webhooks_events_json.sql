@@ -0,0 +1,16 @@
+-- +goose Up
+-- +goose StatementBegin
+-- Типы событий хранятся JSON-массивом, как и в SQLite, в которой нет массивов
+ALTER TABLE webhooks ALTER COLUMN events TYPE JSONB USING to_jsonb(events);
+COMMENT ON COLUMN webhooks.events IS 'JSON-массив типов событий, на которые подписан адрес';
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE webhooks ADD COLUMN events_array VARCHAR[];
+UPDATE webhooks SET events_array = ARRAY(SELECT jsonb_array_elements_text(events));
+ALTER TABLE webhooks DROP COLUMN events;
+ALTER TABLE webhooks RENAME COLUMN events_array TO events;
+ALTER TABLE webhooks ALTER COLUMN events SET NOT NULL;
+COMMENT ON COLUMN webhooks.events IS 'Типы событий, на которые подписан адрес';
+-- +goose StatementEnd
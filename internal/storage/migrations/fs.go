@@ -2,5 +2,17 @@ package migrations
 
 import "embed"
 
+// FS - миграции схемы PostgreSQL
+//
 //go:embed *.sql
 var FS embed.FS
+
+// SQLiteFS - миграции схемы SQLite, каталог sqlite
+//
+//go:embed sqlite/*.sql
+var SQLiteFS embed.FS
+
+// MySQLFS - миграции схемы MySQL и MariaDB, каталог mysql
+//
+//go:embed mysql/*.sql
+var MySQLFS embed.FS
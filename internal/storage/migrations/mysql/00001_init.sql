@@ -0,0 +1,324 @@
+-- Схема MySQL и MariaDB соответствует схеме PostgreSQL после всех миграций каталога migrations.
+-- Моменты времени хранятся в UTC в столбцах DATETIME(6), суммы баллов - в столбцах DECIMAL.
+-- Массивы и JSONB хранятся как JSON в тексте. Строки сравниваются с учетом регистра, как в PostgreSQL.
+-- Частичных индексов нет: уникальность номеров заказов у действующих списаний и резервов проверяется
+-- по вычисляемым столбцам, которые равны NULL у остальных строк, а прочие индексы построены по всем строкам.
+-- Изменения схемы PostgreSQL повторяются здесь следующими миграциями: совпадение таблиц, столбцов
+-- и ограничений уникальности проверяет TestMySQLSchemaMatchesPostgres.
+
+-- +goose Up
+CREATE TABLE users (
+  id BIGINT AUTO_INCREMENT PRIMARY KEY,
+  login VARCHAR(255) NOT NULL,
+  password_hash VARCHAR(255) NOT NULL,
+  failed_logins INT NOT NULL DEFAULT 0,
+  locked_until DATETIME(6),
+  email VARCHAR(255),
+  email_verified_at DATETIME(6),
+  token_version INT NOT NULL DEFAULT 0,
+  role VARCHAR(20) NOT NULL DEFAULT 'user',
+  created_at DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6),
+  lifetime_accrual DECIMAL(14, 2) NOT NULL DEFAULT 0,
+  tier VARCHAR(10) NOT NULL DEFAULT 'BRONZE',
+  UNIQUE KEY users_login_key (login),
+  UNIQUE KEY users_email_key (email)
+) ENGINE = InnoDB DEFAULT CHARSET = utf8mb4 COLLATE = utf8mb4_bin;
+
+CREATE TABLE orders (
+  id BIGINT AUTO_INCREMENT PRIMARY KEY,
+  user_id BIGINT NOT NULL,
+  number VARCHAR(255) NOT NULL,
+  status VARCHAR(10) NOT NULL,
+  accrual DECIMAL(14, 2),
+  created_at DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6),
+  updated_at DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6),
+  status_reason TEXT,
+  retry_count INT NOT NULL DEFAULT 0,
+  retried_at DATETIME(6),
+  fetch_failures INT NOT NULL DEFAULT 0,
+  polled_at DATETIME(6),
+  claimed_by VARCHAR(255),
+  processing_started_at DATETIME(6),
+  UNIQUE KEY orders_number_key (number),
+  KEY orders_to_process_idx (status),
+  KEY orders_user_id_number_idx (user_id, number),
+  CONSTRAINT orders_user_id_fkey FOREIGN KEY (user_id) REFERENCES users (id)
+) ENGINE = InnoDB DEFAULT CHARSET = utf8mb4 COLLATE = utf8mb4_bin;
+
+CREATE TABLE orders_archive (
+  id BIGINT PRIMARY KEY,
+  user_id BIGINT NOT NULL,
+  number VARCHAR(255) NOT NULL,
+  status VARCHAR(10) NOT NULL,
+  accrual DECIMAL(14, 2),
+  status_reason TEXT,
+  created_at DATETIME(6) NOT NULL,
+  updated_at DATETIME(6) NOT NULL,
+  archived_at DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6),
+  UNIQUE KEY orders_archive_number_key (number),
+  KEY orders_archive_user_id_idx (user_id, id),
+  CONSTRAINT orders_archive_user_id_fkey FOREIGN KEY (user_id) REFERENCES users (id)
+) ENGINE = InnoDB DEFAULT CHARSET = utf8mb4 COLLATE = utf8mb4_bin;
+
+-- История статусов остается у заказа и после переноса в архив, поэтому внешнего ключа на orders нет
+CREATE TABLE order_status_history (
+  id BIGINT AUTO_INCREMENT PRIMARY KEY,
+  order_id BIGINT NOT NULL,
+  from_status VARCHAR(10) NOT NULL,
+  status VARCHAR(10) NOT NULL,
+  accrual DECIMAL(14, 2),
+  reason TEXT,
+  created_at DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6),
+  processing_id VARCHAR(255),
+  KEY order_status_history_order_id_idx (order_id, id)
+) ENGINE = InnoDB DEFAULT CHARSET = utf8mb4 COLLATE = utf8mb4_bin;
+
+-- Номер заказа отмененного списания можно использовать повторно
+CREATE TABLE withdrawals (
+  id BIGINT AUTO_INCREMENT PRIMARY KEY,
+  user_id BIGINT NOT NULL,
+  number VARCHAR(255) NOT NULL,
+  sum DECIMAL(14, 2) NOT NULL,
+  created_at DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6),
+  idempotency_key VARCHAR(255),
+  status VARCHAR(10) NOT NULL DEFAULT 'DONE',
+  cancelable_until DATETIME(6),
+  canceled_at DATETIME(6),
+  active_number VARCHAR(255) AS (CASE WHEN status <> 'CANCELED' THEN number END) STORED,
+  UNIQUE KEY withdrawals_idempotency_key_idx (user_id, idempotency_key),
+  UNIQUE KEY withdrawals_number_idx (active_number),
+  CONSTRAINT withdrawals_user_id_fkey FOREIGN KEY (user_id) REFERENCES users (id)
+) ENGINE = InnoDB DEFAULT CHARSET = utf8mb4 COLLATE = utf8mb4_bin;
+
+CREATE TABLE balances (
+  user_id BIGINT NOT NULL,
+  current DECIMAL(14, 2) NOT NULL DEFAULT 0,
+  withdrawn DECIMAL(14, 2) NOT NULL DEFAULT 0,
+  last_event_id BIGINT NOT NULL DEFAULT 0,
+  UNIQUE KEY balances_user_id_key (user_id),
+  CONSTRAINT balances_user_id_fkey FOREIGN KEY (user_id) REFERENCES users (id)
+) ENGINE = InnoDB DEFAULT CHARSET = utf8mb4 COLLATE = utf8mb4_bin;
+
+CREATE TABLE balance_events (
+  id BIGINT AUTO_INCREMENT PRIMARY KEY,
+  user_id BIGINT NOT NULL,
+  type VARCHAR(20) NOT NULL,
+  number VARCHAR(255),
+  current_delta DECIMAL(14, 2) NOT NULL DEFAULT 0,
+  withdrawn_delta DECIMAL(14, 2) NOT NULL DEFAULT 0,
+  created_at DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6),
+  KEY balance_events_user_id_idx (user_id, id),
+  CONSTRAINT balance_events_user_id_fkey FOREIGN KEY (user_id) REFERENCES users (id)
+) ENGINE = InnoDB DEFAULT CHARSET = utf8mb4 COLLATE = utf8mb4_bin;
+
+CREATE TABLE balance_snapshots (
+  user_id BIGINT PRIMARY KEY,
+  last_event_id BIGINT NOT NULL,
+  current DECIMAL(14, 2) NOT NULL,
+  withdrawn DECIMAL(14, 2) NOT NULL,
+  created_at DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6),
+  CONSTRAINT balance_snapshots_user_id_fkey FOREIGN KEY (user_id) REFERENCES users (id)
+) ENGINE = InnoDB DEFAULT CHARSET = utf8mb4 COLLATE = utf8mb4_bin;
+
+CREATE TABLE balance_events_archive (
+  id BIGINT PRIMARY KEY,
+  user_id BIGINT NOT NULL,
+  type VARCHAR(20) NOT NULL,
+  number VARCHAR(255),
+  current_delta DECIMAL(14, 2) NOT NULL,
+  withdrawn_delta DECIMAL(14, 2) NOT NULL,
+  created_at DATETIME(6) NOT NULL,
+  KEY balance_events_archive_user_id_idx (user_id, created_at),
+  CONSTRAINT balance_events_archive_user_id_fkey FOREIGN KEY (user_id) REFERENCES users (id)
+) ENGINE = InnoDB DEFAULT CHARSET = utf8mb4 COLLATE = utf8mb4_bin;
+
+CREATE TABLE balance_holds (
+  id BIGINT AUTO_INCREMENT PRIMARY KEY,
+  user_id BIGINT NOT NULL,
+  number VARCHAR(255) NOT NULL,
+  sum DECIMAL(14, 2) NOT NULL,
+  status VARCHAR(10) NOT NULL DEFAULT 'HELD',
+  expires_at DATETIME(6) NOT NULL,
+  created_at DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6),
+  resolved_at DATETIME(6),
+  held_number VARCHAR(255) AS (CASE WHEN status = 'HELD' THEN number END) STORED,
+  KEY balance_holds_user_id_idx (user_id),
+  KEY balance_holds_expires_at_idx (status, expires_at),
+  UNIQUE KEY balance_holds_number_idx (held_number),
+  CONSTRAINT balance_holds_user_id_fkey FOREIGN KEY (user_id) REFERENCES users (id)
+) ENGINE = InnoDB DEFAULT CHARSET = utf8mb4 COLLATE = utf8mb4_bin;
+
+CREATE TABLE transfers (
+  id BIGINT AUTO_INCREMENT PRIMARY KEY,
+  from_user_id BIGINT NOT NULL,
+  to_user_id BIGINT NOT NULL,
+  sum DECIMAL(14, 2) NOT NULL,
+  created_at DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6),
+  KEY transfers_from_user_id_idx (from_user_id),
+  KEY transfers_to_user_id_idx (to_user_id),
+  CONSTRAINT transfers_from_user_id_fkey FOREIGN KEY (from_user_id) REFERENCES users (id),
+  CONSTRAINT transfers_to_user_id_fkey FOREIGN KEY (to_user_id) REFERENCES users (id)
+) ENGINE = InnoDB DEFAULT CHARSET = utf8mb4 COLLATE = utf8mb4_bin;
+
+-- Единственная строка с состоянием агента начислений
+CREATE TABLE agent_state (
+  id INT PRIMARY KEY DEFAULT 1 CHECK (id = 1),
+  rate_limit_until DATETIME(6)
+) ENGINE = InnoDB DEFAULT CHARSET = utf8mb4 COLLATE = utf8mb4_bin;
+INSERT INTO agent_state (id) VALUES (1);
+
+CREATE TABLE refresh_tokens (
+  id BIGINT AUTO_INCREMENT PRIMARY KEY,
+  user_id BIGINT NOT NULL,
+  token_hash VARCHAR(64) NOT NULL,
+  expires_at DATETIME(6) NOT NULL,
+  revoked_at DATETIME(6),
+  created_at DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6),
+  UNIQUE KEY refresh_tokens_token_hash_key (token_hash),
+  KEY refresh_tokens_user_id_idx (user_id),
+  CONSTRAINT refresh_tokens_user_id_fkey FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+) ENGINE = InnoDB DEFAULT CHARSET = utf8mb4 COLLATE = utf8mb4_bin;
+
+CREATE TABLE revoked_tokens (
+  jti VARCHAR(64) PRIMARY KEY,
+  expires_at DATETIME(6) NOT NULL
+) ENGINE = InnoDB DEFAULT CHARSET = utf8mb4 COLLATE = utf8mb4_bin;
+
+CREATE TABLE sessions (
+  id_hash VARCHAR(64) PRIMARY KEY,
+  user_id BIGINT NOT NULL,
+  ip VARCHAR(255) NOT NULL DEFAULT '',
+  user_agent VARCHAR(1024) NOT NULL DEFAULT '',
+  created_at DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6),
+  last_seen_at DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6),
+  expires_at DATETIME(6) NOT NULL,
+  elevated_until DATETIME(6),
+  KEY sessions_user_id_idx (user_id),
+  CONSTRAINT sessions_user_id_fkey FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+) ENGINE = InnoDB DEFAULT CHARSET = utf8mb4 COLLATE = utf8mb4_bin;
+
+CREATE TABLE email_verifications (
+  token_hash VARCHAR(64) PRIMARY KEY,
+  user_id BIGINT NOT NULL,
+  email VARCHAR(255) NOT NULL,
+  expires_at DATETIME(6) NOT NULL,
+  created_at DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6),
+  KEY email_verifications_user_id_idx (user_id),
+  CONSTRAINT email_verifications_user_id_fkey FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+) ENGINE = InnoDB DEFAULT CHARSET = utf8mb4 COLLATE = utf8mb4_bin;
+
+CREATE TABLE user_identities (
+  issuer VARCHAR(255) NOT NULL,
+  subject VARCHAR(255) NOT NULL,
+  user_id BIGINT NOT NULL,
+  created_at DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6),
+  PRIMARY KEY (issuer, subject),
+  KEY user_identities_user_id_idx (user_id),
+  CONSTRAINT user_identities_user_id_fkey FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+) ENGINE = InnoDB DEFAULT CHARSET = utf8mb4 COLLATE = utf8mb4_bin;
+
+CREATE TABLE auth_events (
+  id BIGINT AUTO_INCREMENT PRIMARY KEY,
+  user_id BIGINT NOT NULL,
+  type VARCHAR(32) NOT NULL,
+  ip VARCHAR(255) NOT NULL DEFAULT '',
+  user_agent VARCHAR(1024) NOT NULL DEFAULT '',
+  created_at DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6),
+  KEY auth_events_user_id_created_at_idx (user_id, created_at DESC),
+  CONSTRAINT auth_events_user_id_fkey FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+) ENGINE = InnoDB DEFAULT CHARSET = utf8mb4 COLLATE = utf8mb4_bin;
+
+CREATE TABLE login_devices (
+  user_id BIGINT NOT NULL,
+  device_hash VARCHAR(64) NOT NULL,
+  network VARCHAR(64) NOT NULL,
+  first_seen_at DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6),
+  last_seen_at DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6),
+  PRIMARY KEY (user_id, device_hash, network),
+  CONSTRAINT login_devices_user_id_fkey FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+) ENGINE = InnoDB DEFAULT CHARSET = utf8mb4 COLLATE = utf8mb4_bin;
+
+CREATE TABLE login_verifications (
+  token_hash VARCHAR(64) PRIMARY KEY,
+  user_id BIGINT NOT NULL,
+  ip VARCHAR(255) NOT NULL,
+  user_agent VARCHAR(1024) NOT NULL,
+  expires_at DATETIME(6) NOT NULL,
+  CONSTRAINT login_verifications_user_id_fkey FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+) ENGINE = InnoDB DEFAULT CHARSET = utf8mb4 COLLATE = utf8mb4_bin;
+
+-- events - JSON-массив типов событий, на которые подписан webhook
+CREATE TABLE webhooks (
+  id BIGINT AUTO_INCREMENT PRIMARY KEY,
+  user_id BIGINT NOT NULL,
+  url VARCHAR(2048) NOT NULL,
+  events TEXT NOT NULL,
+  secret VARCHAR(255) NOT NULL,
+  created_at DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6),
+  KEY webhooks_user_id_idx (user_id),
+  CONSTRAINT webhooks_user_id_fkey FOREIGN KEY (user_id) REFERENCES users (id)
+) ENGINE = InnoDB DEFAULT CHARSET = utf8mb4 COLLATE = utf8mb4_bin;
+
+CREATE TABLE webhook_deliveries (
+  id BIGINT AUTO_INCREMENT PRIMARY KEY,
+  webhook_id BIGINT NOT NULL,
+  event VARCHAR(50) NOT NULL,
+  payload TEXT NOT NULL,
+  status VARCHAR(10) NOT NULL DEFAULT 'PENDING',
+  attempts INT NOT NULL DEFAULT 0,
+  next_attempt_at DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6),
+  last_error TEXT,
+  created_at DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6),
+  delivered_at DATETIME(6),
+  outbox_event_id BIGINT,
+  KEY webhook_deliveries_pending_idx (status, next_attempt_at),
+  UNIQUE KEY webhook_deliveries_outbox_event_idx (webhook_id, outbox_event_id),
+  CONSTRAINT webhook_deliveries_webhook_id_fkey FOREIGN KEY (webhook_id) REFERENCES webhooks (id) ON DELETE CASCADE
+) ENGINE = InnoDB DEFAULT CHARSET = utf8mb4 COLLATE = utf8mb4_bin;
+
+CREATE TABLE outbox_events (
+  id BIGINT AUTO_INCREMENT PRIMARY KEY,
+  user_id BIGINT NOT NULL,
+  event VARCHAR(50) NOT NULL,
+  payload TEXT NOT NULL,
+  created_at DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6),
+  next_attempt_at DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6),
+  published_at DATETIME(6),
+  KEY outbox_events_pending_idx (published_at, next_attempt_at),
+  CONSTRAINT outbox_events_user_id_fkey FOREIGN KEY (user_id) REFERENCES users (id)
+) ENGINE = InnoDB DEFAULT CHARSET = utf8mb4 COLLATE = utf8mb4_bin;
+
+CREATE TABLE currency_rates (
+  id BIGINT AUTO_INCREMENT PRIMARY KEY,
+  currency VARCHAR(3) NOT NULL,
+  rate DECIMAL(18, 6) NOT NULL,
+  effective_from DATETIME(6) NOT NULL,
+  created_at DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6),
+  UNIQUE KEY currency_rates_currency_effective_from_key (currency, effective_from)
+) ENGINE = InnoDB DEFAULT CHARSET = utf8mb4 COLLATE = utf8mb4_bin;
+
+-- +goose Down
+DROP TABLE currency_rates;
+DROP TABLE outbox_events;
+DROP TABLE webhook_deliveries;
+DROP TABLE webhooks;
+DROP TABLE login_verifications;
+DROP TABLE login_devices;
+DROP TABLE auth_events;
+DROP TABLE user_identities;
+DROP TABLE email_verifications;
+DROP TABLE sessions;
+DROP TABLE revoked_tokens;
+DROP TABLE refresh_tokens;
+DROP TABLE agent_state;
+DROP TABLE transfers;
+DROP TABLE balance_holds;
+DROP TABLE balance_events_archive;
+DROP TABLE balance_snapshots;
+DROP TABLE balance_events;
+DROP TABLE balances;
+DROP TABLE withdrawals;
+DROP TABLE order_status_history;
+DROP TABLE orders_archive;
+DROP TABLE orders;
+DROP TABLE users;
@@ -0,0 +1,300 @@
+-- Схема SQLite соответствует схеме PostgreSQL после всех миграций каталога migrations.
+-- Моменты времени хранятся в UTC в виде текста 'YYYY-MM-DD HH:MM:SS.SSS+00:00', поэтому сравниваются
+-- как строки. Суммы баллов хранятся в столбцах NUMERIC. Массивы и JSONB хранятся как JSON в тексте.
+-- Изменения схемы PostgreSQL повторяются здесь следующими миграциями: совпадение таблиц, столбцов
+-- и ограничений уникальности проверяет TestSQLiteSchemaMatchesPostgres.
+
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE users (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  login VARCHAR NOT NULL UNIQUE,
+  password_hash VARCHAR NOT NULL,
+  failed_logins INTEGER NOT NULL DEFAULT 0,
+  locked_until DATETIME,
+  email VARCHAR,
+  email_verified_at DATETIME,
+  token_version INTEGER NOT NULL DEFAULT 0,
+  role VARCHAR(20) NOT NULL DEFAULT 'user',
+  created_at DATETIME NOT NULL DEFAULT (strftime('%Y-%m-%d %H:%M:%f+00:00', 'now')),
+  lifetime_accrual NUMERIC(14, 2) NOT NULL DEFAULT 0,
+  tier VARCHAR(10) NOT NULL DEFAULT 'BRONZE',
+  CONSTRAINT users_email_key UNIQUE (email)
+);
+
+CREATE TABLE orders (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  user_id INTEGER NOT NULL REFERENCES users (id),
+  number VARCHAR NOT NULL UNIQUE,
+  status VARCHAR(10) NOT NULL,
+  accrual NUMERIC(14, 2),
+  created_at DATETIME NOT NULL DEFAULT (strftime('%Y-%m-%d %H:%M:%f+00:00', 'now')),
+  updated_at DATETIME NOT NULL DEFAULT (strftime('%Y-%m-%d %H:%M:%f+00:00', 'now')),
+  status_reason VARCHAR,
+  retry_count INTEGER NOT NULL DEFAULT 0,
+  retried_at DATETIME,
+  fetch_failures INTEGER NOT NULL DEFAULT 0,
+  polled_at DATETIME,
+  processing_started_at DATETIME,
+  claimed_by VARCHAR
+);
+CREATE INDEX orders_to_process_idx ON orders (status) WHERE status IN ('NEW', 'PROCESSING');
+CREATE INDEX orders_user_id_number_idx ON orders (user_id, number);
+
+CREATE TABLE orders_archive (
+  id INTEGER PRIMARY KEY,
+  user_id INTEGER NOT NULL REFERENCES users (id),
+  number VARCHAR NOT NULL UNIQUE,
+  status VARCHAR(10) NOT NULL,
+  accrual NUMERIC(14, 2),
+  status_reason VARCHAR,
+  created_at DATETIME NOT NULL,
+  updated_at DATETIME NOT NULL,
+  archived_at DATETIME NOT NULL DEFAULT (strftime('%Y-%m-%d %H:%M:%f+00:00', 'now'))
+);
+CREATE INDEX orders_archive_user_id_idx ON orders_archive (user_id, id);
+
+-- История статусов остается у заказа и после переноса в архив, поэтому внешнего ключа на orders нет
+CREATE TABLE order_status_history (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  order_id INTEGER NOT NULL,
+  from_status VARCHAR(10) NOT NULL,
+  status VARCHAR(10) NOT NULL,
+  accrual NUMERIC(14, 2),
+  reason VARCHAR,
+  created_at DATETIME NOT NULL DEFAULT (strftime('%Y-%m-%d %H:%M:%f+00:00', 'now')),
+  processing_id VARCHAR
+);
+CREATE INDEX order_status_history_order_id_idx ON order_status_history (order_id, id);
+
+CREATE TABLE withdrawals (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  user_id INTEGER NOT NULL REFERENCES users (id),
+  number VARCHAR NOT NULL,
+  sum NUMERIC(14, 2) NOT NULL,
+  created_at DATETIME NOT NULL DEFAULT (strftime('%Y-%m-%d %H:%M:%f+00:00', 'now')),
+  idempotency_key VARCHAR,
+  status VARCHAR(10) NOT NULL DEFAULT 'DONE',
+  cancelable_until DATETIME,
+  canceled_at DATETIME
+);
+CREATE UNIQUE INDEX withdrawals_idempotency_key_idx ON withdrawals (user_id, idempotency_key)
+WHERE idempotency_key IS NOT NULL;
+-- Номер заказа отмененного списания можно использовать повторно
+CREATE UNIQUE INDEX withdrawals_number_idx ON withdrawals (number) WHERE status <> 'CANCELED';
+
+CREATE TABLE balances (
+  user_id INTEGER NOT NULL UNIQUE REFERENCES users (id),
+  current NUMERIC(14, 2) NOT NULL DEFAULT 0,
+  withdrawn NUMERIC(14, 2) NOT NULL DEFAULT 0,
+  last_event_id INTEGER NOT NULL DEFAULT 0
+);
+
+CREATE TABLE balance_events (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  user_id INTEGER NOT NULL REFERENCES users (id),
+  type VARCHAR(20) NOT NULL,
+  number VARCHAR,
+  current_delta NUMERIC(14, 2) NOT NULL DEFAULT 0,
+  withdrawn_delta NUMERIC(14, 2) NOT NULL DEFAULT 0,
+  created_at DATETIME NOT NULL DEFAULT (strftime('%Y-%m-%d %H:%M:%f+00:00', 'now'))
+);
+CREATE INDEX balance_events_user_id_idx ON balance_events (user_id, id);
+
+CREATE TABLE balance_snapshots (
+  user_id INTEGER PRIMARY KEY REFERENCES users (id),
+  last_event_id INTEGER NOT NULL,
+  current NUMERIC(14, 2) NOT NULL,
+  withdrawn NUMERIC(14, 2) NOT NULL,
+  created_at DATETIME NOT NULL DEFAULT (strftime('%Y-%m-%d %H:%M:%f+00:00', 'now'))
+);
+
+CREATE TABLE balance_events_archive (
+  id INTEGER PRIMARY KEY,
+  user_id INTEGER NOT NULL REFERENCES users (id),
+  type VARCHAR(20) NOT NULL,
+  number VARCHAR,
+  current_delta NUMERIC(14, 2) NOT NULL,
+  withdrawn_delta NUMERIC(14, 2) NOT NULL,
+  created_at DATETIME NOT NULL
+);
+CREATE INDEX balance_events_archive_user_id_idx ON balance_events_archive (user_id, created_at);
+
+CREATE TABLE balance_holds (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  user_id INTEGER NOT NULL REFERENCES users (id),
+  number VARCHAR NOT NULL,
+  sum NUMERIC(14, 2) NOT NULL,
+  status VARCHAR(10) NOT NULL DEFAULT 'HELD',
+  expires_at DATETIME NOT NULL,
+  created_at DATETIME NOT NULL DEFAULT (strftime('%Y-%m-%d %H:%M:%f+00:00', 'now')),
+  resolved_at DATETIME
+);
+CREATE INDEX balance_holds_user_id_idx ON balance_holds (user_id);
+CREATE INDEX balance_holds_expires_at_idx ON balance_holds (expires_at) WHERE status = 'HELD';
+CREATE UNIQUE INDEX balance_holds_number_idx ON balance_holds (number) WHERE status = 'HELD';
+
+CREATE TABLE transfers (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  from_user_id INTEGER NOT NULL REFERENCES users (id),
+  to_user_id INTEGER NOT NULL REFERENCES users (id),
+  sum NUMERIC(14, 2) NOT NULL,
+  created_at DATETIME NOT NULL DEFAULT (strftime('%Y-%m-%d %H:%M:%f+00:00', 'now'))
+);
+CREATE INDEX transfers_from_user_id_idx ON transfers (from_user_id);
+CREATE INDEX transfers_to_user_id_idx ON transfers (to_user_id);
+
+-- Единственная строка с состоянием агента начислений
+CREATE TABLE agent_state (
+  id INTEGER PRIMARY KEY DEFAULT 1 CHECK (id = 1),
+  rate_limit_until DATETIME
+);
+INSERT INTO agent_state DEFAULT VALUES;
+
+CREATE TABLE refresh_tokens (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  user_id INTEGER NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+  token_hash VARCHAR(64) NOT NULL UNIQUE,
+  expires_at DATETIME NOT NULL,
+  revoked_at DATETIME,
+  created_at DATETIME NOT NULL DEFAULT (strftime('%Y-%m-%d %H:%M:%f+00:00', 'now'))
+);
+CREATE INDEX refresh_tokens_user_id_idx ON refresh_tokens (user_id);
+
+CREATE TABLE revoked_tokens (
+  jti VARCHAR(64) PRIMARY KEY,
+  expires_at DATETIME NOT NULL
+);
+
+CREATE TABLE sessions (
+  id_hash VARCHAR(64) PRIMARY KEY,
+  user_id INTEGER NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+  ip VARCHAR NOT NULL DEFAULT '',
+  user_agent VARCHAR NOT NULL DEFAULT '',
+  created_at DATETIME NOT NULL DEFAULT (strftime('%Y-%m-%d %H:%M:%f+00:00', 'now')),
+  last_seen_at DATETIME NOT NULL DEFAULT (strftime('%Y-%m-%d %H:%M:%f+00:00', 'now')),
+  expires_at DATETIME NOT NULL,
+  elevated_until DATETIME
+);
+CREATE INDEX sessions_user_id_idx ON sessions (user_id);
+
+CREATE TABLE email_verifications (
+  token_hash VARCHAR(64) PRIMARY KEY,
+  user_id INTEGER NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+  email VARCHAR NOT NULL,
+  expires_at DATETIME NOT NULL,
+  created_at DATETIME NOT NULL DEFAULT (strftime('%Y-%m-%d %H:%M:%f+00:00', 'now'))
+);
+CREATE INDEX email_verifications_user_id_idx ON email_verifications (user_id);
+
+CREATE TABLE user_identities (
+  issuer VARCHAR NOT NULL,
+  subject VARCHAR NOT NULL,
+  user_id INTEGER NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+  created_at DATETIME NOT NULL DEFAULT (strftime('%Y-%m-%d %H:%M:%f+00:00', 'now')),
+  PRIMARY KEY (issuer, subject)
+);
+CREATE INDEX user_identities_user_id_idx ON user_identities (user_id);
+
+CREATE TABLE auth_events (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  user_id INTEGER NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+  type VARCHAR(32) NOT NULL,
+  ip VARCHAR NOT NULL DEFAULT '',
+  user_agent VARCHAR NOT NULL DEFAULT '',
+  created_at DATETIME NOT NULL DEFAULT (strftime('%Y-%m-%d %H:%M:%f+00:00', 'now'))
+);
+CREATE INDEX auth_events_user_id_created_at_idx ON auth_events (user_id, created_at DESC);
+
+CREATE TABLE login_devices (
+  user_id INTEGER NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+  device_hash VARCHAR(64) NOT NULL,
+  network VARCHAR NOT NULL,
+  first_seen_at DATETIME NOT NULL DEFAULT (strftime('%Y-%m-%d %H:%M:%f+00:00', 'now')),
+  last_seen_at DATETIME NOT NULL DEFAULT (strftime('%Y-%m-%d %H:%M:%f+00:00', 'now')),
+  PRIMARY KEY (user_id, device_hash, network)
+);
+
+CREATE TABLE login_verifications (
+  token_hash VARCHAR(64) PRIMARY KEY,
+  user_id INTEGER NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+  ip VARCHAR NOT NULL,
+  user_agent VARCHAR NOT NULL,
+  expires_at DATETIME NOT NULL
+);
+
+-- events - JSON-массив типов событий, на которые подписан webhook
+CREATE TABLE webhooks (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  user_id INTEGER NOT NULL REFERENCES users (id),
+  url VARCHAR NOT NULL,
+  events TEXT NOT NULL,
+  secret VARCHAR NOT NULL,
+  created_at DATETIME NOT NULL DEFAULT (strftime('%Y-%m-%d %H:%M:%f+00:00', 'now'))
+);
+CREATE INDEX webhooks_user_id_idx ON webhooks (user_id);
+
+CREATE TABLE webhook_deliveries (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  webhook_id INTEGER NOT NULL REFERENCES webhooks (id) ON DELETE CASCADE,
+  event VARCHAR(50) NOT NULL,
+  payload TEXT NOT NULL,
+  status VARCHAR(10) NOT NULL DEFAULT 'PENDING',
+  attempts INTEGER NOT NULL DEFAULT 0,
+  next_attempt_at DATETIME NOT NULL DEFAULT (strftime('%Y-%m-%d %H:%M:%f+00:00', 'now')),
+  last_error VARCHAR,
+  created_at DATETIME NOT NULL DEFAULT (strftime('%Y-%m-%d %H:%M:%f+00:00', 'now')),
+  delivered_at DATETIME,
+  outbox_event_id INTEGER
+);
+CREATE INDEX webhook_deliveries_pending_idx ON webhook_deliveries (next_attempt_at) WHERE status = 'PENDING';
+CREATE UNIQUE INDEX webhook_deliveries_outbox_event_idx ON webhook_deliveries (webhook_id, outbox_event_id);
+
+CREATE TABLE outbox_events (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  user_id INTEGER NOT NULL REFERENCES users (id),
+  event VARCHAR(50) NOT NULL,
+  payload TEXT NOT NULL,
+  created_at DATETIME NOT NULL DEFAULT (strftime('%Y-%m-%d %H:%M:%f+00:00', 'now')),
+  next_attempt_at DATETIME NOT NULL DEFAULT (strftime('%Y-%m-%d %H:%M:%f+00:00', 'now')),
+  published_at DATETIME
+);
+CREATE INDEX outbox_events_pending_idx ON outbox_events (next_attempt_at) WHERE published_at IS NULL;
+
+CREATE TABLE currency_rates (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  currency VARCHAR(3) NOT NULL,
+  rate NUMERIC(18, 6) NOT NULL,
+  effective_from DATETIME NOT NULL,
+  created_at DATETIME NOT NULL DEFAULT (strftime('%Y-%m-%d %H:%M:%f+00:00', 'now')),
+  UNIQUE (currency, effective_from)
+);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE currency_rates;
+DROP TABLE outbox_events;
+DROP TABLE webhook_deliveries;
+DROP TABLE webhooks;
+DROP TABLE login_verifications;
+DROP TABLE login_devices;
+DROP TABLE auth_events;
+DROP TABLE user_identities;
+DROP TABLE email_verifications;
+DROP TABLE sessions;
+DROP TABLE revoked_tokens;
+DROP TABLE refresh_tokens;
+DROP TABLE agent_state;
+DROP TABLE transfers;
+DROP TABLE balance_holds;
+DROP TABLE balance_events_archive;
+DROP TABLE balance_snapshots;
+DROP TABLE balance_events;
+DROP TABLE balances;
+DROP TABLE withdrawals;
+DROP TABLE order_status_history;
+DROP TABLE orders_archive;
+DROP TABLE orders;
+DROP TABLE users;
+-- +goose StatementEnd
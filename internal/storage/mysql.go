@@ -0,0 +1,91 @@
+package storage
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/pinbrain/gophermart/internal/storage/migrations"
+)
+
+// Код ошибки MySQL при нарушении уникального ключа (ER_DUP_ENTRY)
+const mysqlDuplicateEntry = 1062
+
+// mysqlDialect - MySQL 8.0+ и MariaDB 10.6+: обеим нужны оконные функции и FOR UPDATE SKIP LOCKED
+var mysqlDialect = sqlDialect{
+	driver:        "mysql",
+	gooseDialect:  "mysql",
+	migrations:    migrations.MySQLFS,
+	migrationsDir: "mysql",
+	dsn:           mysqlDSN,
+	// Как в PostgreSQL, запрос видит строки, зафиксированные к его началу, а не к началу транзакции
+	txOptions:           &sql.TxOptions{Isolation: sql.LevelReadCommitted},
+	forUpdate:           " FOR UPDATE",
+	forUpdateSkipLocked: " FOR UPDATE SKIP LOCKED",
+	uniqueViolation:     mysqlUniqueViolation,
+	upsert:              mysqlUpsert,
+	month: func(column string) string {
+		return fmt.Sprintf("DATE_FORMAT(%s, '%%Y-%%m')", column)
+	},
+}
+
+// mysqlDSN преобразует адрес mysql://пользователь:пароль@хост:порт/бд?параметры (или mariadb://...)
+// в DSN драйвера. Параметры адреса передаются драйверу, а параметры, от которых зависит работа
+// хранилища, задаются всегда:
+//   - DATETIME читается в time.Time, а время сессии и драйвера - UTC;
+//   - UPDATE возвращает количество найденных, а не измененных строк, как PostgreSQL.
+func mysqlDSN(uri string) (string, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse the DSN: %w", err)
+	}
+	dbName := strings.TrimPrefix(u.Path, "/")
+	if u.Host == "" || dbName == "" {
+		return "", fmt.Errorf("%w: mysql host and database name are required", ErrUnsupportedDriver)
+	}
+	cfg, err := mysql.ParseDSN("tcp(" + u.Host + ")/" + dbName + "?" + u.RawQuery)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse the DSN: %w", err)
+	}
+	cfg.User = u.User.Username()
+	cfg.Passwd, _ = u.User.Password()
+	cfg.ParseTime = true
+	cfg.Loc = time.UTC
+	cfg.ClientFoundRows = true
+	if cfg.Params == nil {
+		cfg.Params = make(map[string]string)
+	}
+	cfg.Params["time_zone"] = "'+00:00'"
+	return cfg.FormatDSN(), nil
+}
+
+func mysqlUniqueViolation(err error) (string, bool) {
+	var mysqlErr *mysql.MySQLError
+	if !errors.As(err, &mysqlErr) || mysqlErr.Number != mysqlDuplicateEntry {
+		return "", false
+	}
+	// Сообщение содержит значение и имя ключа: Duplicate entry 'alice' for key 'users.users_login_key'.
+	// Возвращается только имя ключа, чтобы значение не совпало с именем другого ключа.
+	_, key, found := strings.Cut(mysqlErr.Message, " for key '")
+	if !found {
+		return mysqlErr.Message, true
+	}
+	return strings.TrimSuffix(key, "'"), true
+}
+
+// mysqlUpsert срабатывает при конфликте по любому уникальному ключу, а не только по conflict:
+// в MySQL нельзя указать ключ конфликта. Строка пропускается присваиванием столбцу его же значения.
+func mysqlUpsert(conflict []string, update ...string) string {
+	if len(update) == 0 {
+		return fmt.Sprintf("ON DUPLICATE KEY UPDATE %s = %s", conflict[0], conflict[0])
+	}
+	set := make([]string, 0, len(update))
+	for _, column := range update {
+		set = append(set, fmt.Sprintf("%s = VALUES(%s)", column, column))
+	}
+	return "ON DUPLICATE KEY UPDATE " + strings.Join(set, ", ")
+}
@@ -0,0 +1,194 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"testing"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/pinbrain/gophermart/internal/storage/migrations"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMySQLDSN(t *testing.T) {
+	tests := []struct {
+		name       string
+		uri        string
+		wantUser   string
+		wantPasswd string
+		wantAddr   string
+		wantParams map[string]string
+		wantErr    bool
+	}{
+		{
+			name:       "Адрес с паролем",
+			uri:        "mysql://gophermart:p%40ss@db:3307/gophermart",
+			wantUser:   "gophermart",
+			wantPasswd: "p@ss",
+			wantAddr:   "db:3307",
+		},
+		{
+			name:     "Порт по умолчанию",
+			uri:      "mariadb://gophermart@db/gophermart",
+			wantUser: "gophermart",
+			wantAddr: "db:3306",
+		},
+		{
+			name:       "Дополнительные параметры",
+			uri:        "mysql://gophermart@db/gophermart?parseTime=false&loc=Local&charset=utf8mb4",
+			wantUser:   "gophermart",
+			wantAddr:   "db:3306",
+			wantParams: map[string]string{"charset": "utf8mb4"},
+		},
+		{name: "Без имени БД", uri: "mysql://gophermart@db/", wantErr: true},
+		{name: "Без хоста", uri: "mysql:///gophermart", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dsn, err := mysqlDSN(tt.uri)
+			if tt.wantErr {
+				assert.ErrorIs(t, err, ErrUnsupportedDriver)
+				return
+			}
+			require.NoError(t, err)
+			cfg, err := mysql.ParseDSN(dsn)
+			require.NoError(t, err)
+			assert.Equal(t, tt.wantUser, cfg.User)
+			assert.Equal(t, tt.wantPasswd, cfg.Passwd)
+			assert.Equal(t, "tcp", cfg.Net)
+			assert.Equal(t, tt.wantAddr, cfg.Addr)
+			assert.Equal(t, "gophermart", cfg.DBName)
+			// Параметры, от которых зависит работа хранилища, не переопределяются адресом
+			assert.True(t, cfg.ParseTime)
+			assert.Equal(t, time.UTC, cfg.Loc)
+			assert.True(t, cfg.ClientFoundRows)
+			assert.Equal(t, "'+00:00'", cfg.Params["time_zone"])
+			for key, value := range tt.wantParams {
+				assert.Equal(t, value, cfg.Params[key])
+			}
+		})
+	}
+}
+
+func TestMySQLUniqueViolation(t *testing.T) {
+	tests := []struct {
+		name    string
+		err     error
+		wantKey string
+		wantOK  bool
+	}{
+		{
+			name:    "Ключ с именем таблицы",
+			err:     &mysql.MySQLError{Number: 1062, Message: "Duplicate entry 'alice' for key 'users.users_login_key'"},
+			wantKey: "users.users_login_key",
+			wantOK:  true,
+		},
+		{
+			name:    "Значение совпадает с именем другого ключа",
+			err:     &mysql.MySQLError{Number: 1062, Message: "Duplicate entry 'email' for key 'users_login_key'"},
+			wantKey: "users_login_key",
+			wantOK:  true,
+		},
+		{
+			name: "Ошибка обернута",
+			err: fmt.Errorf("failed to withdraw: %w", &mysql.MySQLError{
+				Number: 1062, Message: "Duplicate entry '2377225624' for key 'withdrawals.withdrawals_number_idx'",
+			}),
+			wantKey: "withdrawals.withdrawals_number_idx",
+			wantOK:  true,
+		},
+		{
+			name: "Другая ошибка MySQL",
+			err:  &mysql.MySQLError{Number: 1452, Message: "Cannot add or update a child row"},
+		},
+		{name: "Ошибка не MySQL", err: errors.New("connection refused")},
+		{name: "Нет ошибки"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key, ok := mysqlUniqueViolation(tt.err)
+			assert.Equal(t, tt.wantOK, ok)
+			assert.Equal(t, tt.wantKey, key)
+		})
+	}
+}
+
+func TestMySQLDuplicateKeyTranslation(t *testing.T) {
+	tests := []struct {
+		name    string
+		key     string
+		wantErr error
+	}{
+		{name: "Логин занят", key: "users.users_login_key", wantErr: ErrLoginTaken},
+		{name: "Email занят", key: "users.users_email_key", wantErr: ErrEmailTaken},
+		{name: "Номер заказа загружен", key: "orders.orders_number_key", wantErr: ErrOrderNumUsed},
+		{name: "Номер заказа в архиве", key: "orders_archive.orders_archive_number_key", wantErr: ErrOrderNumUsed},
+		{name: "Номер заказа списан", key: "withdrawals.withdrawals_number_idx", wantErr: ErrOrderNumUsed},
+		{name: "Номер заказа зарезервирован", key: "balance_holds.balance_holds_number_idx", wantErr: ErrOrderNumUsed},
+		{
+			name:    "Ключ идемпотентности использован",
+			key:     "withdrawals.withdrawals_idempotency_key_idx",
+			wantErr: ErrIdempotencyKeyUsed,
+		},
+		{name: "Ключ MariaDB без имени таблицы", key: "users_login_key", wantErr: ErrLoginTaken},
+		{name: "Другое ограничение", key: "currency_rates.currency_rates_currency_effective_from_key"},
+	}
+	st := &DBStorage{db: &DB{sqlConn: sqlConn{dialect: &mysqlDialect}}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Значение дубликата совпадает с именем другого ключа и не должно влиять на результат
+			err := fmt.Errorf("failed to insert: %w", &mysql.MySQLError{
+				Number:  mysqlDuplicateEntry,
+				Message: fmt.Sprintf("Duplicate entry 'email-number-login' for key '%s'", tt.key),
+			})
+			assert.Equal(t, tt.wantErr, st.uniqueViolationErr(err))
+		})
+	}
+}
+
+// Ограничения, нарушение которых хранилище переводит в свои ошибки, должны быть в схеме MySQL
+// под проверенными в TestMySQLDuplicateKeyTranslation именами
+func TestMySQLTranslatedKeysExist(t *testing.T) {
+	schema, err := fs.ReadFile(migrations.MySQLFS, "mysql/00001_init.sql")
+	require.NoError(t, err)
+	for _, key := range []string{
+		"users_login_key",
+		"users_email_key",
+		"orders_number_key",
+		"orders_archive_number_key",
+		"withdrawals_number_idx",
+		"balance_holds_number_idx",
+		"withdrawals_idempotency_key_idx",
+	} {
+		assert.Contains(t, string(schema), "UNIQUE KEY "+key+" (")
+	}
+}
+
+func TestMySQLUpsert(t *testing.T) {
+	tests := []struct {
+		name     string
+		conflict []string
+		update   []string
+		want     string
+	}{
+		{
+			name:     "Обновление столбцов",
+			conflict: []string{"currency", "effective_from"},
+			update:   []string{"rate", "created_at"},
+			want:     "ON DUPLICATE KEY UPDATE rate = VALUES(rate), created_at = VALUES(created_at)",
+		},
+		{
+			name:     "Пропуск строки",
+			conflict: []string{"webhook_id", "outbox_event_id"},
+			want:     "ON DUPLICATE KEY UPDATE webhook_id = webhook_id",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, mysqlUpsert(tt.conflict, tt.update...))
+		})
+	}
+}
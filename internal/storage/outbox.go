@@ -0,0 +1,130 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/pinbrain/gophermart/internal/model"
+)
+
+// appendOutboxEvent записывает событие в outbox. Вызывается в транзакции, изменяющей данные,
+// поэтому событие публикуется только после фиксации изменений и не теряется при сбое публикации.
+
+func appendOutboxEvent(
+	ctx context.Context, tx sqlQuerier, userID int, event model.WebhookEventType, payload any,
+) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("failed to append outbox event: %w", err)
+	}
+	now := sqlNow()
+	_, err = tx.Exec(ctx, `
+		INSERT INTO outbox_events (user_id, event, payload, created_at, next_attempt_at) VALUES (?, ?, ?, ?, ?)`,
+		userID, string(event), string(data), now, now,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to append outbox event: %w", err)
+	}
+	return nil
+}
+
+// ClaimOutboxEvents выбирает не более limit неопубликованных событий в порядке записи и закрепляет их
+// до leaseUntil, чтобы другие экземпляры сервиса не опубликовали их одновременно
+func (st *DBStorage) ClaimOutboxEvents(ctx context.Context, limit int, leaseUntil time.Time) ([]model.OutboxEvent, error) {
+	tx, err := st.begin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to claim outbox events: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	rows, err := tx.Query(ctx, `
+		SELECT id FROM outbox_events
+		WHERE published_at IS NULL AND next_attempt_at <= ?
+		ORDER BY id
+		LIMIT ?`+st.db.dialect.forUpdateSkipLocked,
+		sqlNow(), limit,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to claim outbox events: %w", err)
+	}
+	eventIDs, err := collectIDs(rows)
+	if err != nil {
+		return nil, fmt.Errorf("failed to claim outbox events: %w", err)
+	}
+	if len(eventIDs) == 0 {
+		return []model.OutboxEvent{}, nil
+	}
+	placeholders, idArgs := inArgs(eventIDs)
+	_, err = tx.Exec(ctx, `
+		UPDATE outbox_events SET next_attempt_at = ? WHERE id IN (`+placeholders+`)`,
+		append([]any{leaseUntil}, idArgs...)...,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to claim outbox events: %w", err)
+	}
+	rows, err = tx.Query(ctx, `
+		SELECT id, user_id, event, payload, created_at FROM outbox_events
+		WHERE id IN (`+placeholders+`)
+		ORDER BY id`,
+		idArgs...,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to claim outbox events: %w", err)
+	}
+	defer rows.Close()
+
+	events := []model.OutboxEvent{}
+	for rows.Next() {
+		var event model.OutboxEvent
+		var payload []byte
+		if err = rows.Scan(&event.ID, &event.UserID, &event.Event, &payload, &event.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to claim outbox events: %w", err)
+		}
+		event.Payload = payload
+		events = append(events, event)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to claim outbox events: %w", err)
+	}
+	rows.Close()
+
+	if err = tx.Commit(ctx); err != nil {
+		return nil, fmt.Errorf("failed to claim outbox events: %w", err)
+	}
+	return events, nil
+}
+
+// CompleteOutboxEvent отмечает событие опубликованным
+func (st *DBStorage) CompleteOutboxEvent(ctx context.Context, eventID int64) error {
+	_, err := st.conn(ctx).Exec(ctx, `UPDATE outbox_events SET published_at = ? WHERE id = ?`, sqlNow(), eventID)
+	if err != nil {
+		return fmt.Errorf("failed to complete outbox event: %w", err)
+	}
+	return nil
+}
+
+// EnqueueOutboxWebhookEvent ставит событие outbox в очередь доставки на все webhooks пользователя,
+// подписанные на него. Доставки, уже созданные из этого события, повторно не создаются.
+func (st *DBStorage) EnqueueOutboxWebhookEvent(ctx context.Context, event model.OutboxEvent) error {
+	webhooks, err := st.GetWebhooks(ctx, event.UserID)
+	if err != nil {
+		return fmt.Errorf("failed to enqueue outbox webhook event: %w", err)
+	}
+	for _, webhook := range webhooks {
+		if !slices.Contains(webhook.Events, event.Event) {
+			continue
+		}
+		_, err = st.conn(ctx).Exec(ctx, `
+			INSERT INTO webhook_deliveries (webhook_id, event, payload, outbox_event_id, next_attempt_at, created_at)
+			VALUES (?, ?, ?, ?, ?, ?) `+st.db.dialect.upsert([]string{"webhook_id", "outbox_event_id"}),
+			webhook.ID, string(event.Event), string(event.Payload), event.ID, sqlNow(), event.CreatedAt,
+		)
+		if err != nil {
+			return fmt.Errorf("failed to enqueue outbox webhook event: %w", err)
+		}
+	}
+	return nil
+}
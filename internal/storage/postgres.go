@@ -0,0 +1,36 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/jackc/pgerrcode"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/pinbrain/gophermart/internal/storage/migrations"
+)
+
+var postgresDialect = sqlDialect{
+	driver:              "pgx",
+	gooseDialect:        "postgres",
+	migrations:          migrations.FS,
+	migrationsDir:       ".",
+	dsn:                 func(uri string) (string, error) { return uri, nil },
+	numberedParams:      true,
+	returningID:         true,
+	forUpdate:           " FOR UPDATE",
+	forUpdateSkipLocked: " FOR UPDATE SKIP LOCKED",
+	uniqueViolation:     postgresUniqueViolation,
+	upsert:              onConflictUpsert,
+	month: func(column string) string {
+		return fmt.Sprintf("to_char(%s AT TIME ZONE 'UTC', 'YYYY-MM')", column)
+	},
+}
+
+// postgresUniqueViolation возвращает имя нарушенного ограничения, например users_email_key
+func postgresUniqueViolation(err error) (string, bool) {
+	var pgError *pgconn.PgError
+	if !errors.As(err, &pgError) || pgError.Code != pgerrcode.UniqueViolation {
+		return "", false
+	}
+	return pgError.ConstraintName, true
+}
@@ -0,0 +1,138 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/jackc/pgx/v5/stdlib"
+	"github.com/pinbrain/gophermart/internal/logger"
+)
+
+// Время, в течение которого после сбоя реплики запросы на чтение выполняются на основной БД
+const replicaRetryInterval = 10 * time.Second
+
+// replicaDSN проверяет, что реплика - та же СУБД, что и основная БД, и преобразует адрес реплики
+// в DSN драйвера. БД SQLite - локальный файл, реплика для нее не поддерживается.
+func replicaDSN(primary Driver, readDSN string) (string, error) {
+	if primary == DriverSQLite {
+		return "", fmt.Errorf("%w: read replica is not supported for %s", ErrUnsupportedDriver, primary)
+	}
+	driver, err := DriverFromDSN(readDSN)
+	if err != nil {
+		return "", err
+	}
+	if driver != primary {
+		return "", fmt.Errorf("%w: read replica must be %s, got %s", ErrUnsupportedDriver, primary, driver)
+	}
+	return dialects[driver].dsn(readDSN)
+}
+
+// openReplica открывает пул соединений с репликой. Недоступность реплики при запуске не мешает работе:
+// чтение выполняется на основной БД до ее восстановления.
+func (db *DB) openReplica(ctx context.Context, driver Driver, dsn string, cfg PoolCfg) error {
+	if driver == DriverPostgres {
+		poolCfg, err := pgxpool.ParseConfig(dsn)
+		if err != nil {
+			return fmt.Errorf("failed to parse the DNS: %w", err)
+		}
+		cfg.apply(poolCfg)
+		if db.replicaPool, err = pgxpool.NewWithConfig(ctx, poolCfg); err != nil {
+			return err
+		}
+		db.replica = stdlib.OpenDBFromPool(db.replicaPool)
+	} else {
+		var err error
+		if db.replica, err = sql.Open(db.dialect.driver, dsn); err != nil {
+			return err
+		}
+		cfg.applyDB(db.replica)
+	}
+	if err := db.replica.PingContext(ctx); err != nil {
+		db.replicaFailed(err)
+	}
+	return nil
+}
+
+// isUnavailable проверяет, что запрос не выполнен из-за недоступности сервера БД, а не из-за ошибки
+// в самом запросе или отмены контекста
+func isUnavailable(ctx context.Context, err error) bool {
+	if err == nil || ctx.Err() != nil {
+		return false
+	}
+	var connectErr *pgconn.ConnectError
+	var netErr net.Error
+	return errors.As(err, &connectErr) || errors.As(err, &netErr) || pgconn.SafeToRetry(err) ||
+		errors.Is(err, driver.ErrBadConn) || errors.Is(err, mysql.ErrInvalidConn)
+}
+
+// replicaAvailable сообщает, можно ли выполнять запросы на реплике
+func (db *DB) replicaAvailable() bool {
+	return db.replica != nil && time.Now().UnixNano() >= db.replicaDownUntil.Load()
+}
+
+// replicaFailed переключает чтение на основную БД на время replicaRetryInterval
+func (db *DB) replicaFailed(err error) {
+	now := time.Now()
+	if prev := db.replicaDownUntil.Swap(now.Add(replicaRetryInterval).UnixNano()); now.UnixNano() >= prev {
+		logger.Log.WithError(err).Warnf("Read replica is unavailable, reading from primary for %s", replicaRetryInterval)
+	}
+}
+
+// reader возвращает соединения для запросов на чтение: реплику, если она задана и доступна,
+// иначе пул основной БД
+func (db *DB) reader() sqlQuerier {
+	if !db.replicaAvailable() {
+		return db
+	}
+	return sqlConn{q: replicaExecer{db: db}, dialect: db.dialect}
+}
+
+// readConn возвращает транзакцию, начатую WithinTransaction, или соединения для запросов на чтение.
+// В транзакции чтение выполняется на основной БД, чтобы видеть изменения транзакции.
+func (st *DBStorage) readConn(ctx context.Context) sqlQuerier {
+	if tx, ok := ctx.Value(txCtxKey{}).(*sqlTx); ok {
+		return tx
+	}
+	return st.db.reader()
+}
+
+// replicaExecer выполняет запросы на реплике, а если реплика недоступна, повторяет их на основной БД
+type replicaExecer struct {
+	db *DB
+}
+
+func (r replicaExecer) ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error) {
+	res, err := r.db.replica.ExecContext(ctx, query, args...)
+	if isUnavailable(ctx, err) {
+		r.db.replicaFailed(err)
+		return r.db.sqlDB.ExecContext(ctx, query, args...)
+	}
+	return res, err
+}
+
+func (r replicaExecer) QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error) {
+	rows, err := r.db.replica.QueryContext(ctx, query, args...)
+	if isUnavailable(ctx, err) {
+		r.db.replicaFailed(err)
+		return r.db.sqlDB.QueryContext(ctx, query, args...)
+	}
+	return rows, err
+}
+
+// QueryRowContext выполняет запрос сразу, поэтому ошибка подключения к реплике известна до Scan
+func (r replicaExecer) QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row {
+	row := r.db.replica.QueryRowContext(ctx, query, args...)
+	if err := row.Err(); isUnavailable(ctx, err) {
+		r.db.replicaFailed(err)
+		return r.db.sqlDB.QueryRowContext(ctx, query, args...)
+	}
+	return row
+}
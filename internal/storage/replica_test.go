@@ -0,0 +1,62 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+
+	"github.com/pinbrain/gophermart/internal/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReplicaDSN(t *testing.T) {
+	tests := []struct {
+		name    string
+		primary Driver
+		readDSN string
+		// Адрес реплики, который должен остаться в DSN драйвера
+		wantHost string
+		wantErr  bool
+	}{
+		{name: "Реплика PostgreSQL", primary: DriverPostgres, readDSN: "postgres://replica/gophermart", wantHost: "replica"},
+		{name: "Реплика MySQL", primary: DriverMySQL, readDSN: "mysql://user@replica:3307/gophermart", wantHost: "replica:3307"},
+		{name: "Реплика другой СУБД", primary: DriverPostgres, readDSN: "mysql://replica/gophermart", wantErr: true},
+		{name: "Реплика SQLite", primary: DriverSQLite, readDSN: "sqlite:///var/lib/replica.db", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dsn, err := replicaDSN(tt.primary, tt.readDSN)
+			if tt.wantErr {
+				assert.ErrorIs(t, err, ErrUnsupportedDriver)
+				return
+			}
+			require.NoError(t, err)
+			assert.Contains(t, dsn, tt.wantHost)
+		})
+	}
+}
+
+func TestReplicaUnavailable(t *testing.T) {
+	st := newSQLiteStorage(t, StorageCfg{})
+	ctx := context.Background()
+	userID, err := st.CreateUser(ctx, "alice", "password", "")
+	require.NoError(t, err)
+	creditOrder(t, st, userID, "12345678903", 500)
+
+	// Реплика на закрытом порту: подключение к ней отклоняется
+	replica, err := sql.Open("mysql", "user@tcp(127.0.0.1:1)/gophermart")
+	require.NoError(t, err)
+	t.Cleanup(func() { replica.Close() })
+	st.db.replica = replica
+	require.True(t, st.db.replicaAvailable())
+
+	balance, err := st.GetUserBalance(ctx, userID)
+	require.NoError(t, err)
+	assert.Equal(t, model.Money(500), balance.Current)
+	assert.False(t, st.db.replicaAvailable(), "чтение переключается на основную БД")
+
+	summary, err := st.GetUserOrdersSummary(ctx, userID, model.OrdersQuery{})
+	require.NoError(t, err)
+	assert.Equal(t, 1, summary.Count)
+}
@@ -0,0 +1,280 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/pinbrain/gophermart/internal/storage/migrations"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// dbSchema - таблицы БД со столбцами, первичные ключи и ограничения уникальности в виде таблица(столбцы)
+type dbSchema struct {
+	tables      map[string][]string
+	primaryKeys []string
+	unique      []string
+}
+
+var (
+	reDollarQuoted  = regexp.MustCompile(`(?s)\$\$.*?\$\$`)
+	reCreateTable   = regexp.MustCompile(`(?is)^CREATE TABLE (?:IF NOT EXISTS )?(\w+)\s*\((.*)\)[^)]*$`)
+	reAlterTable    = regexp.MustCompile(`(?is)^ALTER TABLE (?:IF EXISTS )?(\w+)\s+(.*)$`)
+	reAddColumn     = regexp.MustCompile(`(?i)ADD COLUMN (?:IF NOT EXISTS )?(\w+)`)
+	reAddUnique     = regexp.MustCompile(`(?i)ADD CONSTRAINT (\w+) UNIQUE \(([^)]*)\)`)
+	reDropConstr    = regexp.MustCompile(`(?i)DROP CONSTRAINT (?:IF EXISTS )?(\w+)`)
+	reUniqueIndex   = regexp.MustCompile(`(?is)^CREATE UNIQUE INDEX (?:IF NOT EXISTS )?(\w+) ON (\w+)\s*\(([^)]*)\)`)
+	reDropIndex     = regexp.MustCompile(`(?i)^DROP INDEX (?:IF EXISTS )?(\w+)`)
+	reDropTable     = regexp.MustCompile(`(?i)^DROP TABLE (?:IF EXISTS )?(\w+)`)
+	reTableUnique   = regexp.MustCompile(`(?is)^(?:CONSTRAINT (\w+) )?UNIQUE (?:KEY (\w+) )?\s*\(([^)]*)\)`)
+	reTablePK       = regexp.MustCompile(`(?is)^PRIMARY KEY\s*\(([^)]*)\)`)
+	reInlineUnique  = regexp.MustCompile(`(?i)\bUNIQUE\b`)
+	reInlinePK      = regexp.MustCompile(`(?i)\bPRIMARY KEY\b`)
+	reConstraintDef = regexp.MustCompile(`(?i)^(PRIMARY KEY|UNIQUE|CONSTRAINT|FOREIGN KEY|CHECK|KEY)\b`)
+	// Вычисляемый столбец MySQL, который заменяет частичный индекс PostgreSQL: равен столбцу при условии
+	reGenerated = regexp.MustCompile(`(?i)\bAS \(CASE WHEN .* THEN (\w+) END\)`)
+)
+
+// postgresSchema строит схему, которая получается после применения миграций PostgreSQL
+func postgresSchema(t *testing.T) dbSchema {
+	t.Helper()
+	return migrationsSchema(t, migrations.FS, "*.sql")
+}
+
+// migrationsSchema строит схему, которая получается после применения миграций fsys. Разбираются
+// только встречающиеся в миграциях изменения таблиц: создание и удаление таблиц, добавление столбцов,
+// первичные ключи, уникальные ограничения и индексы. Уникальный ключ MySQL по вычисляемому столбцу
+// считается ключом по исходному столбцу.
+func migrationsSchema(t *testing.T, fsys fs.FS, pattern string) dbSchema {
+	t.Helper()
+	files, err := fs.Glob(fsys, pattern)
+	require.NoError(t, err)
+	require.NotEmpty(t, files)
+	sort.Strings(files)
+
+	tables := make(map[string][]string)
+	primaryKeys := make(map[string]string)
+	// Уникальные ограничения по имени, как их называет PostgreSQL
+	unique := make(map[string]string)
+	for _, file := range files {
+		data, err := fs.ReadFile(fsys, file)
+		require.NoError(t, err)
+		for _, stmt := range upStatements(string(data)) {
+			if m := reCreateTable.FindStringSubmatch(stmt); m != nil {
+				table := strings.ToLower(m[1])
+				tables[table] = nil
+				generated := make(map[string]string)
+				for _, def := range splitDefinitions(m[2]) {
+					if g := reGenerated.FindStringSubmatch(def); g != nil {
+						generated[strings.ToLower(strings.Fields(def)[0])] = strings.ToLower(g[1])
+					}
+				}
+				for _, def := range splitDefinitions(m[2]) {
+					if pk := reTablePK.FindStringSubmatch(def); pk != nil {
+						primaryKeys[table] = uniqueKey(table, splitColumns(pk[1]))
+						continue
+					}
+					if u := reTableUnique.FindStringSubmatch(def); u != nil {
+						columns := splitColumns(u[3])
+						for i, column := range columns {
+							if source, ok := generated[column]; ok {
+								columns[i] = source
+							}
+						}
+						name := u[1] + u[2]
+						if name == "" {
+							name = table + "_" + strings.Join(columns, "_") + "_key"
+						}
+						unique[strings.ToLower(name)] = uniqueKey(table, columns)
+						continue
+					}
+					column := strings.ToLower(strings.Fields(def)[0])
+					if _, ok := generated[column]; ok || reConstraintDef.MatchString(def) {
+						continue
+					}
+					tables[table] = append(tables[table], column)
+					if reInlinePK.MatchString(def) {
+						primaryKeys[table] = uniqueKey(table, []string{column})
+					} else if reInlineUnique.MatchString(def) {
+						unique[table+"_"+column+"_key"] = uniqueKey(table, []string{column})
+					}
+				}
+				continue
+			}
+			if m := reAlterTable.FindStringSubmatch(stmt); m != nil {
+				table := strings.ToLower(m[1])
+				for _, c := range reAddColumn.FindAllStringSubmatch(m[2], -1) {
+					tables[table] = append(tables[table], strings.ToLower(c[1]))
+				}
+				for _, c := range reAddUnique.FindAllStringSubmatch(m[2], -1) {
+					unique[strings.ToLower(c[1])] = uniqueKey(table, splitColumns(c[2]))
+				}
+				for _, c := range reDropConstr.FindAllStringSubmatch(m[2], -1) {
+					delete(unique, strings.ToLower(c[1]))
+				}
+				continue
+			}
+			if m := reUniqueIndex.FindStringSubmatch(stmt); m != nil {
+				unique[strings.ToLower(m[1])] = uniqueKey(strings.ToLower(m[2]), splitColumns(m[3]))
+				continue
+			}
+			if m := reDropIndex.FindStringSubmatch(stmt); m != nil {
+				delete(unique, strings.ToLower(m[1]))
+				continue
+			}
+			if m := reDropTable.FindStringSubmatch(stmt); m != nil {
+				delete(tables, strings.ToLower(m[1]))
+				delete(primaryKeys, strings.ToLower(m[1]))
+			}
+		}
+	}
+
+	schema := dbSchema{tables: tables}
+	for _, key := range primaryKeys {
+		schema.primaryKeys = append(schema.primaryKeys, key)
+	}
+	for _, key := range unique {
+		schema.unique = append(schema.unique, key)
+	}
+	for _, columns := range schema.tables {
+		sort.Strings(columns)
+	}
+	sort.Strings(schema.primaryKeys)
+	sort.Strings(schema.unique)
+	return schema
+}
+
+// upStatements возвращает запросы раздела Up миграции без комментариев и тел функций
+func upStatements(migration string) []string {
+	up, _, _ := strings.Cut(migration, "-- +goose Down")
+	up = reDollarQuoted.ReplaceAllString(up, "''")
+	var lines []string
+	for _, line := range strings.Split(up, "\n") {
+		line, _, _ = strings.Cut(line, "--")
+		lines = append(lines, line)
+	}
+	var stmts []string
+	for _, stmt := range strings.Split(strings.Join(lines, "\n"), ";") {
+		if stmt = strings.Join(strings.Fields(stmt), " "); stmt != "" {
+			stmts = append(stmts, stmt)
+		}
+	}
+	return stmts
+}
+
+// splitDefinitions разбивает тело CREATE TABLE на определения столбцов и ограничений
+func splitDefinitions(body string) []string {
+	var defs []string
+	depth, start := 0, 0
+	for i, c := range body {
+		switch c {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case ',':
+			if depth == 0 {
+				defs = append(defs, strings.TrimSpace(body[start:i]))
+				start = i + 1
+			}
+		}
+	}
+	return append(defs, strings.TrimSpace(body[start:]))
+}
+
+func splitColumns(list string) []string {
+	var columns []string
+	for _, column := range strings.Split(list, ",") {
+		columns = append(columns, strings.ToLower(strings.TrimSpace(column)))
+	}
+	return columns
+}
+
+func uniqueKey(table string, columns []string) string {
+	return fmt.Sprintf("%s(%s)", table, strings.Join(columns, ", "))
+}
+
+// sqliteSchema читает схему созданной миграциями БД SQLite
+func sqliteSchema(t *testing.T, st *DBStorage) dbSchema {
+	t.Helper()
+	ctx := context.Background()
+	rows, err := st.db.Query(ctx, `
+		SELECT name FROM sqlite_master
+		WHERE type = 'table' AND name NOT LIKE 'sqlite_%' AND name <> 'goose_db_version'`)
+	require.NoError(t, err)
+	tables := queryStrings(t, rows)
+
+	schema := dbSchema{tables: make(map[string][]string)}
+	for _, table := range tables {
+		rows, err = st.db.Query(ctx, `SELECT name FROM pragma_table_info(?) ORDER BY name`, table)
+		require.NoError(t, err)
+		schema.tables[table] = queryStrings(t, rows)
+
+		rows, err = st.db.Query(ctx, `SELECT name FROM pragma_table_info(?) WHERE pk > 0 ORDER BY pk`, table)
+		require.NoError(t, err)
+		if pk := queryStrings(t, rows); len(pk) > 0 {
+			schema.primaryKeys = append(schema.primaryKeys, uniqueKey(table, pk))
+		}
+
+		rows, err = st.db.Query(ctx, `SELECT name FROM pragma_index_list(?) WHERE "unique" AND origin <> 'pk'`, table)
+		require.NoError(t, err)
+		for _, index := range queryStrings(t, rows) {
+			rows, err = st.db.Query(ctx, `SELECT name FROM pragma_index_info(?) ORDER BY seqno`, index)
+			require.NoError(t, err)
+			schema.unique = append(schema.unique, uniqueKey(table, queryStrings(t, rows)))
+		}
+	}
+	sort.Strings(schema.primaryKeys)
+	sort.Strings(schema.unique)
+	return schema
+}
+
+func queryStrings(t *testing.T, rows interface {
+	Next() bool
+	Scan(dest ...any) error
+	Err() error
+	Close() error
+}) []string {
+	t.Helper()
+	defer rows.Close()
+	var values []string
+	for rows.Next() {
+		var value string
+		require.NoError(t, rows.Scan(&value))
+		values = append(values, strings.ToLower(value))
+	}
+	require.NoError(t, rows.Err())
+	return values
+}
+
+func TestSQLiteSchemaMatchesPostgres(t *testing.T) {
+	want := postgresSchema(t)
+	got := sqliteSchema(t, newSQLiteStorage(t, StorageCfg{}))
+
+	assertSchemaEqual(t, want, got)
+}
+
+func TestMySQLSchemaMatchesPostgres(t *testing.T) {
+	want := postgresSchema(t)
+	got := migrationsSchema(t, migrations.MySQLFS, "mysql/*.sql")
+
+	assertSchemaEqual(t, want, got)
+}
+
+func assertSchemaEqual(t *testing.T, want, got dbSchema) {
+	t.Helper()
+	require.NotEmpty(t, want.tables)
+	for table, columns := range want.tables {
+		assert.Equalf(t, columns, got.tables[table], "columns of table %s", table)
+	}
+	for table := range got.tables {
+		assert.Containsf(t, want.tables, table, "table %s is missing in postgres migrations", table)
+	}
+	assert.Equal(t, want.primaryKeys, got.primaryKeys, "primary keys")
+	assert.Equal(t, want.unique, got.unique, "unique constraints")
+}
@@ -0,0 +1,153 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/pinbrain/gophermart/internal/model"
+	"github.com/pinbrain/gophermart/internal/session"
+)
+
+// CreateSession сохраняет сессию пользователя, заодно удаляя истекшие сессии
+
+func (st *DBStorage) CreateSession(ctx context.Context, s model.Session) error {
+	tx, err := st.begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to create session: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err = tx.Exec(ctx, `DELETE FROM sessions WHERE expires_at < ?`, sqlNow()); err != nil {
+		return fmt.Errorf("failed to create session: %w", err)
+	}
+	_, err = tx.Exec(ctx, `
+		INSERT INTO sessions (id_hash, user_id, ip, user_agent, created_at, last_seen_at, expires_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		session.HashID(s.ID), s.UserID, s.IP, s.UserAgent, s.CreatedAt, s.LastSeenAt, s.ExpiresAt,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to create session: %w", err)
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return fmt.Errorf("failed to create session: %w", err)
+	}
+	return nil
+}
+
+// GetSession возвращает действующую сессию вместе с логином пользователя
+func (st *DBStorage) GetSession(ctx context.Context, id string) (*model.Session, error) {
+	s := model.Session{ID: id}
+	var elevatedUntil *time.Time
+	err := st.conn(ctx).QueryRow(ctx, `
+		SELECT s.user_id, u.login, s.ip, s.user_agent, s.created_at, s.last_seen_at, s.expires_at, s.elevated_until
+		FROM sessions s JOIN users u ON u.id = s.user_id
+		WHERE s.id_hash = ? AND s.expires_at > ?`,
+		session.HashID(id), sqlNow(),
+	).Scan(&s.UserID, &s.Login, &s.IP, &s.UserAgent, &s.CreatedAt, &s.LastSeenAt, &s.ExpiresAt, &elevatedUntil)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, session.ErrNoSession
+		}
+		return nil, fmt.Errorf("failed to get session: %w", err)
+	}
+	s.ElevatedUntil = epochIfNil(elevatedUntil)
+	return &s, nil
+}
+
+// TouchSession обновляет момент последнего запроса в рамках сессии
+func (st *DBStorage) TouchSession(ctx context.Context, id string, lastSeenAt time.Time) error {
+	_, err := st.conn(ctx).Exec(ctx, `
+		UPDATE sessions SET last_seen_at = ? WHERE id_hash = ?`,
+		lastSeenAt, session.HashID(id),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to touch session: %w", err)
+	}
+	return nil
+}
+
+// ElevateSession отмечает, что пользователь подтвердил вход в сессии повторным вводом пароля
+func (st *DBStorage) ElevateSession(ctx context.Context, id string, until time.Time) error {
+	res, err := st.conn(ctx).Exec(ctx, `
+		UPDATE sessions SET elevated_until = ? WHERE id_hash = ? AND expires_at > ?`,
+		until, session.HashID(id), sqlNow(),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to elevate session: %w", err)
+	}
+	if updated, err := res.RowsAffected(); err != nil || updated == 0 {
+		if err != nil {
+			return fmt.Errorf("failed to elevate session: %w", err)
+		}
+		return session.ErrNoSession
+	}
+	return nil
+}
+
+// DeleteSession завершает сессию, отсутствие сессии ошибкой не считается
+func (st *DBStorage) DeleteSession(ctx context.Context, id string) error {
+	_, err := st.conn(ctx).Exec(ctx, `DELETE FROM sessions WHERE id_hash = ?`, session.HashID(id))
+	if err != nil {
+		return fmt.Errorf("failed to delete session: %w", err)
+	}
+	return nil
+}
+
+// DeleteUserSessions завершает все сессии пользователя
+func (st *DBStorage) DeleteUserSessions(ctx context.Context, userID int) error {
+	_, err := st.conn(ctx).Exec(ctx, `DELETE FROM sessions WHERE user_id = ?`, userID)
+	if err != nil {
+		return fmt.Errorf("failed to delete user sessions: %w", err)
+	}
+	return nil
+}
+
+// ListUserSessions возвращает действующие сессии пользователя, начиная с самых новых
+func (st *DBStorage) ListUserSessions(ctx context.Context, userID int) ([]model.Session, error) {
+	rows, err := st.conn(ctx).Query(ctx, `
+		SELECT s.id_hash, u.login, s.ip, s.user_agent, s.created_at, s.last_seen_at, s.expires_at
+		FROM sessions s JOIN users u ON u.id = s.user_id
+		WHERE s.user_id = ? AND s.expires_at > ?
+		ORDER BY s.created_at DESC`,
+		userID, sqlNow(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get user sessions: %w", err)
+	}
+	defer rows.Close()
+
+	sessions := []model.Session{}
+	for rows.Next() {
+		s := model.Session{UserID: userID}
+		if err = rows.Scan(&s.PublicID, &s.Login, &s.IP, &s.UserAgent, &s.CreatedAt, &s.LastSeenAt, &s.ExpiresAt); err != nil {
+			return nil, fmt.Errorf("failed to read user session: %w", err)
+		}
+		sessions = append(sessions, s)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to get user sessions: %w", err)
+	}
+	return sessions, nil
+}
+
+// DeleteUserSession завершает сессию пользователя по ее публичному идентификатору
+func (st *DBStorage) DeleteUserSession(ctx context.Context, userID int, publicID string) error {
+	res, err := st.conn(ctx).Exec(ctx, `
+		DELETE FROM sessions WHERE id_hash = ? AND user_id = ? AND expires_at > ?`,
+		publicID, userID, sqlNow(),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to delete session: %w", err)
+	}
+	if deleted, err := res.RowsAffected(); err != nil || deleted == 0 {
+		if err != nil {
+			return fmt.Errorf("failed to delete session: %w", err)
+		}
+		return session.ErrNoSession
+	}
+	return nil
+}
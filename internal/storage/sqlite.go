@@ -0,0 +1,61 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/pinbrain/gophermart/internal/storage/migrations"
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+// Параметры подключения к SQLite:
+//   - внешние ключи проверяются, как в PostgreSQL;
+//   - при занятой БД запрос ждет до 5 секунд, а не завершается ошибкой сразу;
+//   - журнал WAL позволяет читать БД во время пишущей транзакции;
+//   - транзакция сразу захватывает блокировку записи (BEGIN IMMEDIATE), поэтому пишущие транзакции
+//     выполняются по одной и заменяют блокировку строк FOR UPDATE;
+//   - время записывается в формате, который SQLite сравнивает как строки.
+const sqliteParams = "_pragma=foreign_keys(1)&_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)" +
+	"&_txlock=immediate&_time_format=sqlite"
+
+var sqliteDialect = sqlDialect{
+	driver:          "sqlite",
+	gooseDialect:    "sqlite3",
+	migrations:      migrations.SQLiteFS,
+	migrationsDir:   "sqlite",
+	dsn:             sqliteDSN,
+	uniqueViolation: sqliteUniqueViolation,
+	upsert:          onConflictUpsert,
+	month: func(column string) string {
+		return fmt.Sprintf("strftime('%%Y-%%m', %s)", column)
+	},
+}
+
+// sqliteDSN преобразует адрес sqlite://путь_к_файлу?параметры в DSN драйвера. Путь указывается
+// относительно рабочего каталога (sqlite://gophermart.db) или от корня (sqlite:///var/lib/gophermart.db).
+// БД в памяти не поддерживается: каждое соединение пула получило бы отдельную БД.
+func sqliteDSN(uri string) (string, error) {
+	path, query, _ := strings.Cut(strings.TrimPrefix(uri, "sqlite://"), "?")
+	if path == "" || strings.Contains(path, ":memory:") || strings.Contains(query, "mode=memory") {
+		return "", fmt.Errorf("%w: sqlite database file path is required", ErrUnsupportedDriver)
+	}
+	dsn := "file:" + path + "?" + sqliteParams
+	if query != "" {
+		dsn += "&" + query
+	}
+	return dsn, nil
+}
+
+func sqliteUniqueViolation(err error) (string, bool) {
+	var sqliteErr *sqlite.Error
+	if !errors.As(err, &sqliteErr) {
+		return "", false
+	}
+	if code := sqliteErr.Code(); code != sqlite3.SQLITE_CONSTRAINT_UNIQUE && code != sqlite3.SQLITE_CONSTRAINT_PRIMARYKEY {
+		return "", false
+	}
+	// Сообщение содержит нарушенные столбцы: UNIQUE constraint failed: users.email
+	return sqliteErr.Error(), true
+}
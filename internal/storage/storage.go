@@ -2,83 +2,204 @@ package storage
 
 import (
 	"context"
+	"database/sql"
 	"errors"
 	"fmt"
 	"strings"
+	"sync/atomic"
+	"time"
 
-	"github.com/jackc/pgerrcode"
-	"github.com/jackc/pgx/v5"
-	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/pinbrain/gophermart/internal/appctx"
+	"github.com/pinbrain/gophermart/internal/loyalty"
 	"github.com/pinbrain/gophermart/internal/model"
 	"github.com/pinbrain/gophermart/internal/utils"
 )
 
 var (
-	ErrLoginTaken        = errors.New("login is already taken")
-	ErrNoUser            = errors.New("user not found in db")
-	ErrOrderNumUsed      = errors.New("order num is already registered by another user")
-	ErrOrderNumCreated   = errors.New("order num is already registered by user")
-	ErrInsufficientFunds = errors.New("insufficient funds in the account")
+	ErrLoginTaken         = errors.New("login is already taken")
+	ErrEmailTaken         = errors.New("email is already taken")
+	ErrNoUser             = errors.New("user not found in db")
+	ErrNoOrder            = errors.New("order not found in db")
+	ErrOrderNumUsed       = errors.New("order num is already registered by another user")
+	ErrOrderNumCreated    = errors.New("order num is already registered by user")
+	ErrOrderNotNew        = errors.New("order processing has already started")
+	ErrOrderNotInvalid    = errors.New("order is not invalid")
+	ErrOrderRetryLimit    = errors.New("order retry limit reached")
+	ErrOrderNotStalled    = errors.New("order is not stalled")
+	ErrInsufficientFunds  = errors.New("insufficient funds in the account")
+	ErrIdempotencyKeyUsed = errors.New("idempotency key is already used for another withdrawal")
+	ErrSelfTransfer       = errors.New("cannot transfer points to yourself")
+	ErrNoWebhook          = errors.New("webhook not found in db")
+	ErrWithdrawBelowMin   = errors.New("withdrawal sum is below the minimum")
+	ErrWithdrawLimit      = errors.New("withdrawal limit exceeded")
+	ErrNoWithdrawal       = errors.New("withdrawal not found in db")
+	ErrWithdrawalFinal    = errors.New("withdrawal can no longer be canceled")
 )
 
 type DBStorage struct {
 	db *DB
+	// Счетчик для имен точек сохранения вложенных транзакций
+	savepoints atomic.Int64
+
+	eventSourcedBalance  bool
+	minWithdrawSum       model.Money
+	withdrawLimits       WithdrawLimits
+	withdrawCancelWindow time.Duration
+	loyaltyTiers         *loyalty.Tiers
+}
+
+// WithdrawLimits - ограничения количества и суммы списаний пользователя за последние 24 часа
+// и за календарный месяц. Нулевое значение означает отсутствие ограничения.
+type WithdrawLimits struct {
+	DailyCount   int
+	DailySum     model.Money
+	MonthlyCount int
+	MonthlySum   model.Money
+}
+
+func (l WithdrawLimits) enabled() bool {
+	return l.DailyCount > 0 || l.DailySum > 0 || l.MonthlyCount > 0 || l.MonthlySum > 0
 }
 
 type StorageCfg struct {
 	DSN string
+	// Адрес реплики для запросов на чтение, пустой - чтение выполняется на основной БД
+	ReadDSN string
+	Pool    PoolCfg
+	// Не применять новые миграции при подключении, схемой управляет команда gophermart migrate
+	SkipMigrations bool
+	// Баланс изменяется только через журнал событий, проекцию обновляет отдельный воркер
+	EventSourcedBalance bool
+	// Минимальная сумма одного списания
+	MinWithdrawSum model.Money
+	// Ограничения списаний пользователя за сутки и месяц
+	WithdrawLimits WithdrawLimits
+	// Время, в течение которого пользователь может отменить списание, 0 - списания завершаются сразу
+	WithdrawCancelWindow time.Duration
+	// Уровни программы лояльности, nil - начисления не повышаются
+	LoyaltyTiers *loyalty.Tiers
 }
 
 func NewStorage(ctx context.Context, cfg StorageCfg) (*DBStorage, error) {
-	db, err := newDB(ctx, cfg.DSN)
+	db, err := newDB(ctx, cfg.DSN, cfg.ReadDSN, cfg.Pool, !cfg.SkipMigrations)
 	if err != nil {
 		return nil, err
 	}
-	storage := DBStorage{db: db}
+	storage := DBStorage{
+		db:                   db,
+		eventSourcedBalance:  cfg.EventSourcedBalance,
+		minWithdrawSum:       cfg.MinWithdrawSum,
+		withdrawLimits:       cfg.WithdrawLimits,
+		withdrawCancelWindow: cfg.WithdrawCancelWindow,
+		loyaltyTiers:         cfg.LoyaltyTiers,
+	}
 	return &storage, nil
 }
 
 func (st *DBStorage) Close() {
-	st.db.pool.Close()
+	st.db.close()
+}
+
+// sqlNow возвращает текущий момент с точностью до микросекунд, с которой время хранят PostgreSQL и MySQL.
+// Время передается в запросы из Go, так как функции текущего времени в СУБД различаются.
+func sqlNow() time.Time {
+	return time.Now().Truncate(time.Microsecond)
+}
+
+// epochIfNil возвращает t или начало эпохи Unix, если значение NULL, как COALESCE(t, 'epoch') в PostgreSQL
+func epochIfNil(t *time.Time) time.Time {
+	if t == nil {
+		return time.Unix(0, 0)
+	}
+	return *t
+}
+
+// collectOrders читает заказы из результата запроса со столбцами id, user_id, number, status, accrual,
+// status_reason, created_at, updated_at
+func collectOrders(rows *sql.Rows) ([]model.Order, error) {
+	defer rows.Close()
+	orders := []model.Order{}
+	for rows.Next() {
+		var order model.Order
+		if err := rows.Scan(
+			&order.ID,
+			&order.UserID,
+			&order.Number,
+			&order.Status,
+			&order.Accrual,
+			&order.StatusReason,
+			&order.CreatedAt,
+			&order.UpdatedAt,
+		); err != nil {
+			return nil, err
+		}
+		orders = append(orders, order)
+	}
+	return orders, rows.Err()
+}
+
+// collectIDs читает id из результата запроса с единственным столбцом
+func collectIDs(rows *sql.Rows) ([]int, error) {
+	defer rows.Close()
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
 }
 
-func (st *DBStorage) CreateUser(ctx context.Context, login, password string) (int, error) {
+// CreateUser создает пользователя с начальным балансом. Email необязателен, пустой email не сохраняется.
+func (st *DBStorage) CreateUser(ctx context.Context, login, password, email string) (int, error) {
 	login = strings.ToLower(login)
 	passwordHash, err := utils.GeneratePasswordHash(password)
 	if err != nil {
 		return 0, fmt.Errorf("failed to create new user: %w", err)
 	}
-	tx, err := st.db.pool.Begin(ctx)
+	tx, err := st.begin(ctx)
 	if err != nil {
 		return 0, fmt.Errorf("failed to create new user: %w", err)
 	}
 	defer tx.Rollback(ctx)
 
-	row := tx.QueryRow(ctx, `
-		INSERT INTO users (login, password_hash)
-		VALUES ($1, $2) RETURNING id;`, login, passwordHash,
+	userID, err := tx.insert(ctx, `
+		INSERT INTO users (login, password_hash, email, created_at)
+		VALUES (?, ?, NULLIF(?, ''), ?)`, login, passwordHash, strings.ToLower(email), sqlNow(),
 	)
-	var userID int
-	err = row.Scan(&userID)
 	if err != nil {
-		var pgError *pgconn.PgError
-		if errors.As(err, &pgError) {
-			if pgError.Code == pgerrcode.UniqueViolation {
-				return 0, ErrLoginTaken
-			}
+		if uniqueErr := st.uniqueViolationErr(err); uniqueErr != nil {
+			return 0, uniqueErr
 		}
 		return 0, fmt.Errorf("failed to create new user: %w", err)
 	}
-	_, err = tx.Exec(ctx, `
-		INSERT INTO balances (user_id) VALUES ($1);`, userID,
-	)
+	_, err = tx.Exec(ctx, `INSERT INTO balances (user_id) VALUES (?)`, userID)
 	if err != nil {
 		return 0, fmt.Errorf("failed to create new user: %w", err)
 	}
 	if err := tx.Commit(ctx); err != nil {
 		return 0, fmt.Errorf("failed to create new user: %w", err)
 	}
-	return userID, nil
+	return int(userID), nil
+}
+
+// GetUserByID возвращает пользователя без хэша пароля
+func (st *DBStorage) GetUserByID(ctx context.Context, userID int) (*model.User, error) {
+	user := model.User{ID: userID}
+	row := st.conn(ctx).QueryRow(ctx, `
+		SELECT login, COALESCE(email, ''), email_verified_at IS NOT NULL, token_version, role, created_at
+		FROM users WHERE id = ?`, userID,
+	)
+	err := row.Scan(&user.Login, &user.Email, &user.EmailVerified, &user.TokenVersion, &user.Role, &user.CreatedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNoUser
+		}
+		return nil, fmt.Errorf("failed to get user from db: %w", err)
+	}
+	return &user, nil
 }
 
 func (st *DBStorage) GetUserByLogin(ctx context.Context, login string) (*model.User, error) {
@@ -86,55 +207,302 @@ func (st *DBStorage) GetUserByLogin(ctx context.Context, login string) (*model.U
 	user := model.User{
 		Login: login,
 	}
-	row := st.db.pool.QueryRow(ctx, `
-		SELECT id, password_hash FROM users WHERE login = $1`, login,
+	var lockedUntil *time.Time
+	row := st.conn(ctx).QueryRow(ctx, `
+		SELECT id, password_hash, locked_until, token_version FROM users WHERE login = ?`, login,
 	)
-	if err := row.Scan(&user.ID, &user.PasswordHash); err != nil {
-		if errors.Is(err, pgx.ErrNoRows) {
+	if err := row.Scan(&user.ID, &user.PasswordHash, &lockedUntil, &user.TokenVersion); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
 			return nil, ErrNoUser
 		}
 		return nil, fmt.Errorf("failed to get user from db: %w", err)
 	}
+	user.LockedUntil = epochIfNil(lockedUntil)
 	return &user, nil
 }
 
-func (st *DBStorage) CreateOrder(ctx context.Context, userID int, orderNum string) (int, error) {
-	row := st.db.pool.QueryRow(ctx, `
-		INSERT INTO orders (user_id, number, status) VALUES ($1, $2, $3) RETURNING id`,
-		userID, orderNum, model.OrderNew,
+// UpdatePasswordHash заменяет хэш пароля пользователя, например, при переходе на другой алгоритм хэширования
+func (st *DBStorage) UpdatePasswordHash(ctx context.Context, userID int, passwordHash string) error {
+	_, err := st.conn(ctx).Exec(ctx, `
+		UPDATE users SET password_hash = ? WHERE id = ?`, passwordHash, userID,
 	)
-	var orderID int
-	err := row.Scan(&orderID)
-	if err != nil {
-		var pgError *pgconn.PgError
-		if errors.As(err, &pgError) {
-			if pgError.Code == pgerrcode.UniqueViolation {
-				order, err := st.GetOrderByNum(ctx, orderNum)
-				if err == nil {
-					if order.UserID == userID {
-						return orderID, ErrOrderNumCreated
-					}
-					return orderID, ErrOrderNumUsed
-				}
+	if err != nil {
+		return fmt.Errorf("failed to update user password hash: %w", err)
+	}
+	return nil
+}
+
+// ChangePassword заменяет пароль пользователя и увеличивает версию его токенов, чтобы выданные ранее
+// JWT перестали действовать, а также отзывает все токены обновления. Возвращает новую версию токенов.
+func (st *DBStorage) ChangePassword(ctx context.Context, userID int, passwordHash string) (int, error) {
+	tx, err := st.begin(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("failed to change user password: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	res, err := tx.Exec(ctx, `
+		UPDATE users SET password_hash = ?, token_version = token_version + 1 WHERE id = ?`,
+		passwordHash, userID,
+	)
+	if err != nil {
+		return 0, fmt.Errorf("failed to change user password: %w", err)
+	}
+	if updated, err := res.RowsAffected(); err != nil || updated == 0 {
+		if err != nil {
+			return 0, fmt.Errorf("failed to change user password: %w", err)
+		}
+		return 0, ErrNoUser
+	}
+	var tokenVersion int
+	err = tx.QueryRow(ctx, `SELECT token_version FROM users WHERE id = ?`, userID).Scan(&tokenVersion)
+	if err != nil {
+		return 0, fmt.Errorf("failed to change user password: %w", err)
+	}
+	_, err = tx.Exec(ctx, `
+		UPDATE refresh_tokens SET revoked_at = ?
+		WHERE user_id = ? AND revoked_at IS NULL`,
+		sqlNow(), userID,
+	)
+	if err != nil {
+		return 0, fmt.Errorf("failed to change user password: %w", err)
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return 0, fmt.Errorf("failed to change user password: %w", err)
+	}
+	return tokenVersion, nil
+}
+
+// GetTokenVersion возвращает текущую версию токенов пользователя
+func (st *DBStorage) GetTokenVersion(ctx context.Context, userID int) (int, error) {
+	var tokenVersion int
+	err := st.conn(ctx).QueryRow(ctx, `SELECT token_version FROM users WHERE id = ?`, userID).Scan(&tokenVersion)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, ErrNoUser
+		}
+		return 0, fmt.Errorf("failed to get user token version: %w", err)
+	}
+	return tokenVersion, nil
+}
+
+// CreateOrder загружает номер заказа пользователя и возвращает созданный заказ.
+// Номер заказа, перенесенного в архив, повторно не загружается.
+func (st *DBStorage) CreateOrder(ctx context.Context, userID int, orderNum string) (*model.Order, error) {
+	tx, err := st.begin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create new order: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	var archived bool
+	err = tx.QueryRow(ctx, `SELECT EXISTS (SELECT 1 FROM orders_archive WHERE number = ?)`, orderNum).Scan(&archived)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create new order: %w", err)
+	}
+	if !archived {
+		now := sqlNow()
+		order := model.Order{UserID: userID, Number: orderNum, Status: model.OrderNew, CreatedAt: now, UpdatedAt: now}
+		var orderID int64
+		orderID, err = tx.insert(ctx, `
+			INSERT INTO orders (user_id, number, status, created_at, updated_at) VALUES (?, ?, ?, ?, ?)`,
+			userID, orderNum, model.OrderNew, now, now,
+		)
+		if err == nil {
+			order.ID = int(orderID)
+			if err = tx.Commit(ctx); err != nil {
+				return nil, fmt.Errorf("failed to create new order: %w", err)
 			}
+			return &order, nil
+		}
+		if !st.isUniqueViolation(err) {
+			return nil, fmt.Errorf("failed to create new order: %w", err)
+		}
+	}
+	tx.Rollback(ctx)
+
+	existing, err := st.GetOrderByNum(ctx, orderNum)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create new order: %w", err)
+	}
+	if existing.UserID == userID {
+		return nil, ErrOrderNumCreated
+	}
+	return nil, ErrOrderNumUsed
+}
+
+// CreateOrders создает заказы пользователя в одной транзакции. Возвращает результат загрузки
+// по каждому номеру: новый заказ, заказ уже загружен этим пользователем или другим.
+func (st *DBStorage) CreateOrders(ctx context.Context, userID int, orderNums []string) (map[string]string, error) {
+	tx, err := st.begin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create orders: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	now := sqlNow()
+	results := make(map[string]string, len(orderNums))
+	for _, orderNum := range orderNums {
+		if _, ok := results[orderNum]; ok {
+			continue
+		}
+		var ownerID int
+		err = tx.QueryRow(ctx, `
+			SELECT user_id FROM orders WHERE number = ?
+			UNION ALL
+			SELECT user_id FROM orders_archive WHERE number = ?
+			LIMIT 1`,
+			orderNum, orderNum,
+		).Scan(&ownerID)
+		switch {
+		case err == nil && ownerID == userID:
+			results[orderNum] = model.BatchOrderAlreadyUploaded
+			continue
+		case err == nil:
+			results[orderNum] = model.BatchOrderConflict
+			continue
+		case !errors.Is(err, sql.ErrNoRows):
+			return nil, fmt.Errorf("failed to create orders: %w", err)
+		}
+
+		err = tx.savepoint(ctx, func() error {
+			_, err := tx.Exec(ctx, `
+				INSERT INTO orders (user_id, number, status, created_at, updated_at) VALUES (?, ?, ?, ?, ?)`,
+				userID, orderNum, model.OrderNew, now, now,
+			)
+			return err
+		})
+		switch {
+		case err == nil:
+			results[orderNum] = model.BatchOrderAccepted
+		case st.isUniqueViolation(err):
+			// Номер загружен параллельной транзакцией, которая еще не была видна запросу
+			results[orderNum] = model.BatchOrderConflict
+		default:
+			return nil, fmt.Errorf("failed to create orders: %w", err)
+		}
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return nil, fmt.Errorf("failed to create orders: %w", err)
+	}
+	return results, nil
+}
+
+// CancelOrder удаляет заказ пользователя, обработка которого еще не началась. Номер заказа
+// после этого можно загрузить повторно.
+func (st *DBStorage) CancelOrder(ctx context.Context, userID int, orderNum string) error {
+	tx, err := st.begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to cancel order: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	var orderID, ownerID int
+	var status model.OrderStatus
+	err = tx.QueryRow(ctx, `
+		SELECT id, user_id, status FROM orders WHERE number = ?`+st.db.dialect.forUpdate,
+		orderNum,
+	).Scan(&orderID, &ownerID, &status)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrNoOrder
+		}
+		return fmt.Errorf("failed to cancel order: %w", err)
+	}
+	if ownerID != userID {
+		return ErrOrderNumUsed
+	}
+	if status != model.OrderNew {
+		return ErrOrderNotNew
+	}
+	if _, err = tx.Exec(ctx, `DELETE FROM orders WHERE id = ?`, orderID); err != nil {
+		return fmt.Errorf("failed to cancel order: %w", err)
+	}
+	// История статусов не удаляется вместе с заказом, так как сохраняется и для заказов в архиве
+	if _, err = tx.Exec(ctx, `DELETE FROM order_status_history WHERE order_id = ?`, orderID); err != nil {
+		return fmt.Errorf("failed to cancel order: %w", err)
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return fmt.Errorf("failed to cancel order: %w", err)
+	}
+	return nil
+}
+
+// RetryOrder возвращает заказ пользователя в статусе INVALID в очередь обработки, если пользователь
+// запрашивал повторную обработку меньше maxRetries раз
+func (st *DBStorage) RetryOrder(ctx context.Context, userID int, orderNum string, maxRetries int) error {
+	tx, err := st.begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to retry order: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	var orderID, ownerID, retryCount int
+	var status model.OrderStatus
+	err = tx.QueryRow(ctx, `
+		SELECT id, user_id, status, retry_count FROM orders WHERE number = ?`+st.db.dialect.forUpdate,
+		orderNum,
+	).Scan(&orderID, &ownerID, &status, &retryCount)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrNoOrder
 		}
-		return 0, fmt.Errorf("failed to create new order: %w", err)
+		return fmt.Errorf("failed to retry order: %w", err)
+	}
+	if ownerID != userID {
+		return ErrOrderNumUsed
+	}
+	if status != model.OrderInvalid {
+		return ErrOrderNotInvalid
 	}
-	return orderID, nil
+	if retryCount >= maxRetries {
+		return ErrOrderRetryLimit
+	}
+	now := sqlNow()
+	_, err = tx.Exec(ctx, `
+		UPDATE orders
+		SET status = ?, status_reason = NULL, retry_count = retry_count + 1, retried_at = ?, updated_at = ?
+		WHERE id = ?`,
+		model.OrderNew, now, now, orderID,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to retry order: %w", err)
+	}
+	_, err = tx.Exec(ctx, `
+		INSERT INTO order_status_history (order_id, from_status, status, reason, created_at) VALUES (?, ?, ?, ?, ?)`,
+		orderID, status, model.OrderNew, "retry requested by user", now,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to record order status change: %w", err)
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return fmt.Errorf("failed to retry order: %w", err)
+	}
+	return nil
 }
 
+// GetOrderByNum возвращает заказ по номеру, в том числе перенесенный в архив
 func (st *DBStorage) GetOrderByNum(ctx context.Context, orderNum string) (*model.Order, error) {
-	row := st.db.pool.QueryRow(ctx, `
+	row := st.conn(ctx).QueryRow(ctx, `
 		SELECT
 			id,
 			user_id,
 			number,
 			status,
 			COALESCE(accrual, 0),
+			COALESCE(status_reason, ''),
 			created_at,
 			updated_at
-		FROM orders WHERE number = $1`,
-		orderNum,
+		FROM orders WHERE number = ?
+		UNION ALL
+		SELECT id, user_id, number, status, COALESCE(accrual, 0), COALESCE(status_reason, ''), created_at, updated_at
+		FROM orders_archive WHERE number = ?
+		LIMIT 1`,
+		orderNum, orderNum,
 	)
 	var order model.Order
 	err := row.Scan(
@@ -143,31 +511,123 @@ func (st *DBStorage) GetOrderByNum(ctx context.Context, orderNum string) (*model
 		&order.Number,
 		&order.Status,
 		&order.Accrual,
+		&order.StatusReason,
 		&order.CreatedAt,
 		&order.UpdatedAt,
 	)
 	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNoOrder
+		}
 		return nil, fmt.Errorf("failed to get order by number: %w", err)
 	}
 	return &order, nil
 }
 
-func (st *DBStorage) GetUserOrders(ctx context.Context, userID int) ([]model.Order, error) {
-	orders := []model.Order{}
-	rows, err := st.db.pool.Query(ctx, `
+// Допустимые поля сортировки и соответствующие им выражения ORDER BY. Пустое поле - порядок добавления.
+var (
+	ordersSortColumns = map[string]string{
+		"":                         "id",
+		model.SortOrdersUploadedAt: "created_at",
+		model.SortOrdersAccrual:    "COALESCE(accrual, 0)",
+	}
+	withdrawalsSortColumns = map[string]string{
+		"":                               "id",
+		model.SortWithdrawalsProcessedAt: "created_at",
+		model.SortWithdrawalsSum:         "sum",
+	}
+)
+
+// orderBy строит выражение ORDER BY по списку допустимых полей. При равенстве значений порядок
+// определяется id, чтобы страницы выборки не пересекались.
+func orderBy(columns map[string]string, sort model.Sort) (string, error) {
+	column, ok := columns[sort.Field]
+	if !ok {
+		return "", fmt.Errorf("unknown sort field %q", sort.Field)
+	}
+	direction := "ASC"
+	if sort.Desc {
+		direction = "DESC"
+	}
+	if column == "id" {
+		return "id " + direction, nil
+	}
+	return fmt.Sprintf("%s %s, id %s", column, direction, direction), nil
+}
+
+// userOrdersWhere возвращает условие выборки заказов пользователя и его аргументы
+func userOrdersWhere(userID int, query model.OrdersQuery) (string, []any) {
+	conds := []string{"user_id = ?"}
+	args := []any{userID}
+	if len(query.Statuses) > 0 {
+		placeholders, statuses := inArgs(query.Statuses)
+		args = append(args, statuses...)
+		conds = append(conds, "status IN ("+placeholders+")")
+	}
+	// Префикс состоит только из цифр, поэтому экранировать символы шаблона LIKE не нужно
+	if query.NumberPrefix != "" {
+		args = append(args, query.NumberPrefix+"%")
+		conds = append(conds, "number LIKE ?")
+	}
+	if !query.From.IsZero() {
+		args = append(args, query.From)
+		conds = append(conds, "created_at >= ?")
+	}
+	if !query.To.IsZero() {
+		args = append(args, query.To)
+		conds = append(conds, "created_at < ?")
+	}
+	return strings.Join(conds, " AND "), args
+}
+
+// GetUserOrdersSummary возвращает количество заказов пользователя, подходящих под условия выборки
+// без учета ограничения и смещения, и время последнего изменения среди них
+func (st *DBStorage) GetUserOrdersSummary(
+	ctx context.Context, userID int, query model.OrdersQuery,
+) (*model.OrdersSummary, error) {
+	where, args := userOrdersWhere(userID, query)
+	var summary model.OrdersSummary
+	var lastUpdate sqlTime
+	err := st.readConn(ctx).QueryRow(ctx, `SELECT COUNT(*), MAX(updated_at) FROM orders WHERE `+where, args...).
+		Scan(&summary.Count, &lastUpdate)
+	if err != nil {
+		return nil, fmt.Errorf("failed to count user orders: %w", err)
+	}
+	summary.LastUpdate = time.Time(lastUpdate)
+	return &summary, nil
+}
+
+// StreamUserOrders передает в fn заказы пользователя по мере их чтения из БД
+func (st *DBStorage) StreamUserOrders(
+	ctx context.Context, userID int, query model.OrdersQuery, fn func(model.Order) error,
+) error {
+	where, args := userOrdersWhere(userID, query)
+	order, err := orderBy(ordersSortColumns, query.Sort)
+	if err != nil {
+		return err
+	}
+	limit := noLimit
+	if query.Limit > 0 {
+		limit = query.Limit
+	}
+	args = append(args, limit, query.Offset)
+	rows, err := st.readConn(ctx).Query(ctx, fmt.Sprintf(`
 		SELECT
 			id,
 			user_id,
 			number,
 			status,
 			COALESCE(accrual, 0),
+			COALESCE(status_reason, ''),
 			created_at,
 			updated_at
-		FROM orders WHERE user_id = $1`,
-		userID,
+		FROM orders WHERE %s
+		ORDER BY %s
+		LIMIT ? OFFSET ?`, where, order),
+		args...,
 	)
 	if err != nil {
-		return nil, fmt.Errorf("failed to select user orders: %w", err)
+		return fmt.Errorf("failed to select user orders: %w", err)
 	}
 	defer rows.Close()
 
@@ -179,69 +639,113 @@ func (st *DBStorage) GetUserOrders(ctx context.Context, userID int) ([]model.Ord
 			&order.Number,
 			&order.Status,
 			&order.Accrual,
+			&order.StatusReason,
 			&order.CreatedAt,
 			&order.UpdatedAt,
 		); err != nil {
-			return nil, fmt.Errorf("failed to read data from db order row: %w", err)
+			return fmt.Errorf("failed to read data from db order row: %w", err)
+		}
+		if err = fn(order); err != nil {
+			return err
 		}
-		orders = append(orders, order)
 	}
 	if err = rows.Err(); err != nil {
-		return nil, fmt.Errorf("failed to select user orders: %w", err)
+		return fmt.Errorf("failed to select user orders: %w", err)
 	}
 
-	return orders, nil
+	return nil
 }
 
+// GetUserBalance возвращает баланс пользователя. Если задана реплика, баланс читается с нее и может
+// отставать от основной БД.
 func (st *DBStorage) GetUserBalance(ctx context.Context, userID int) (*model.Balance, error) {
-	row := st.db.pool.QueryRow(ctx, `
-		SELECT current, withdrawn FROM balances WHERE user_id = $1;`,
-		userID,
-	)
-	var balance model.Balance
-	if err := row.Scan(&balance.Current, &balance.Withdrawn); err != nil {
+	balance, err := selectBalance(ctx, st.readConn(ctx), userID)
+	if err != nil {
 		return nil, fmt.Errorf("failed to get user balance: %w", err)
 	}
-	balance.UserID = userID
-	return &balance, nil
+	return balance, nil
 }
 
-func (st *DBStorage) Withdraw(ctx context.Context, userID int, sum float64, order string) error {
-	tx, err := st.db.pool.Begin(ctx)
+// Withdraw списывает баллы пользователя в счет заказа. Если передан ключ идемпотентности и списание
+// с этим ключом уже выполнено, повторное списание не выполняется: для тех же заказа и суммы
+// возвращается успех, для других - ErrIdempotencyKeyUsed. Если задано окно отмены, списание
+// создается в статусе PENDING: баллы списываются сразу, но пользователь может вернуть их до конца окна.
+func (st *DBStorage) Withdraw(ctx context.Context, userID int, sum model.Money, order, idempotencyKey string) error {
+	if sum < st.minWithdrawSum {
+		return ErrWithdrawBelowMin
+	}
+	tx, err := st.begin(ctx)
 	if err != nil {
 		return fmt.Errorf("failed to withdraw: %w", err)
 	}
 	defer tx.Rollback(ctx)
 
-	row := tx.QueryRow(ctx, `
-		SELECT current FROM balances WHERE user_id = $1 FOR UPDATE;`,
-		userID,
-	)
-	var current float64
-	if err := row.Scan(&current); err != nil {
+	if err = st.lockBalance(ctx, tx, userID); err != nil {
 		return fmt.Errorf("failed to withdraw: %w", err)
 	}
-	if current < sum {
+	// Списания пользователя выполняются под блокировкой баланса, поэтому повтор с тем же ключом
+	// увидит результат первого запроса
+	if idempotencyKey != "" {
+		var prevOrder string
+		var prevSum model.Money
+		err = tx.QueryRow(ctx, `
+			SELECT number, sum FROM withdrawals WHERE user_id = ? AND idempotency_key = ?`,
+			userID, idempotencyKey,
+		).Scan(&prevOrder, &prevSum)
+		if err == nil {
+			if prevOrder != order || prevSum != sum {
+				return ErrIdempotencyKeyUsed
+			}
+			return nil
+		}
+		if !errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("failed to withdraw: %w", err)
+		}
+	}
+	if err = st.checkWithdrawLimits(ctx, tx, userID, sum); err != nil {
+		return err
+	}
+	balance, err := selectBalance(ctx, tx, userID)
+	if err != nil {
+		return fmt.Errorf("failed to withdraw: %w", err)
+	}
+	if balance.Current < sum {
 		return ErrInsufficientFunds
 	}
 
+	now := sqlNow()
+	status := model.WithdrawalDone
+	var cancelableUntil *time.Time
+	if st.withdrawCancelWindow > 0 {
+		status = model.WithdrawalPending
+		until := now.Add(st.withdrawCancelWindow)
+		cancelableUntil = &until
+	}
 	_, err = tx.Exec(ctx, `
-		INSERT INTO withdrawals (user_id, number, sum) VALUES ($1, $2, $3);`,
-		userID, order, sum,
+		INSERT INTO withdrawals (user_id, number, sum, idempotency_key, status, cancelable_until, created_at)
+		VALUES (?, ?, ?, NULLIF(?, ''), ?, ?, ?)`,
+		userID, order, sum, idempotencyKey, status, cancelableUntil, now,
 	)
 	if err != nil {
-		var pgError *pgconn.PgError
-		if errors.As(err, &pgError) {
-			if pgError.Code == pgerrcode.UniqueViolation {
-				return ErrOrderNumUsed
-			}
+		if uniqueErr := st.uniqueViolationErr(err); uniqueErr != nil {
+			return uniqueErr
 		}
 		return fmt.Errorf("failed to withdraw: %w", err)
 	}
-	_, err = tx.Exec(ctx, `
-		UPDATE balances SET current = current - $1, withdrawn = withdrawn + $1 WHERE user_id = $2`,
-		sum, userID,
-	)
+	err = st.appendBalanceEvent(ctx, tx, model.BalanceEvent{
+		UserID:         userID,
+		Type:           model.BalanceEventWithdrawal,
+		Number:         order,
+		CurrentDelta:   -sum,
+		WithdrawnDelta: sum,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to withdraw: %w", err)
+	}
+	err = appendOutboxEvent(ctx, tx, userID, model.WebhookBalanceWithdrawn, map[string]any{
+		"order": order,
+		"sum":   sum,
+	})
 	if err != nil {
 		return fmt.Errorf("failed to withdraw: %w", err)
 	}
@@ -252,23 +756,166 @@ func (st *DBStorage) Withdraw(ctx context.Context, userID int, sum float64, orde
 	return nil
 }
 
-func (st *DBStorage) GetWithdrawals(ctx context.Context, userID int) ([]model.Withdrawn, error) {
-	withdrawals := []model.Withdrawn{}
-	rows, err := st.db.pool.Query(ctx, `
+// CancelWithdrawal отменяет списание пользователя в статусе PENDING, окно отмены которого еще не истекло,
+// и возвращает списанные баллы на баланс. Возвращает отмененное списание.
+func (st *DBStorage) CancelWithdrawal(ctx context.Context, userID, withdrawalID int) (*model.Withdrawn, error) {
+	tx, err := st.begin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to cancel withdrawal: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	// Баланс блокируется до строки списания, как и при списании, чтобы не получить взаимную блокировку
+	if err = st.lockBalance(ctx, tx, userID); err != nil {
+		return nil, fmt.Errorf("failed to cancel withdrawal: %w", err)
+	}
+	now := sqlNow()
+	withdrawn := model.Withdrawn{ID: withdrawalID, UserID: userID}
+	var cancelable bool
+	err = tx.QueryRow(ctx, `
+		SELECT number, sum, status, created_at, status = 'PENDING' AND cancelable_until > ?
+		FROM withdrawals WHERE id = ? AND user_id = ?`+st.db.dialect.forUpdate,
+		now, withdrawalID, userID,
+	).Scan(&withdrawn.Number, &withdrawn.Sum, &withdrawn.Status, &withdrawn.CreatedAt, &cancelable)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNoWithdrawal
+		}
+		return nil, fmt.Errorf("failed to cancel withdrawal: %w", err)
+	}
+	if !cancelable {
+		return nil, ErrWithdrawalFinal
+	}
+
+	_, err = tx.Exec(ctx, `
+		UPDATE withdrawals SET status = ?, canceled_at = ? WHERE id = ?`,
+		model.WithdrawalCanceled, now, withdrawalID,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to cancel withdrawal: %w", err)
+	}
+	withdrawn.Status = model.WithdrawalCanceled
+	err = st.appendBalanceEvent(ctx, tx, model.BalanceEvent{
+		UserID:         userID,
+		Type:           model.BalanceEventWithdrawalCanceled,
+		Number:         withdrawn.Number,
+		CurrentDelta:   withdrawn.Sum,
+		WithdrawnDelta: -withdrawn.Sum,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to cancel withdrawal: %w", err)
+	}
+	err = appendOutboxEvent(ctx, tx, userID, model.WebhookBalanceWithdrawCanceled, map[string]any{
+		"order": withdrawn.Number,
+		"sum":   withdrawn.Sum,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to cancel withdrawal: %w", err)
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return nil, fmt.Errorf("failed to cancel withdrawal: %w", err)
+	}
+	return &withdrawn, nil
+}
+
+// checkWithdrawLimits проверяет, что списание sum не превысит ограничения пользователя.
+// Вызывается под блокировкой баланса, поэтому параллельные списания не обойдут ограничения.
+func (st *DBStorage) checkWithdrawLimits(ctx context.Context, tx sqlQuerier, userID int, sum model.Money) error {
+	limits := st.withdrawLimits
+	if !limits.enabled() {
+		return nil
+	}
+	now := time.Now()
+	dayStart := now.Add(-24 * time.Hour)
+	monthStart := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, now.Location())
+	since := dayStart
+	if monthStart.Before(since) {
+		since = monthStart
+	}
+
+	var dailyCount, monthlyCount int
+	var dailySum, monthlySum model.Money
+	err := tx.QueryRow(ctx, `
 		SELECT
-			id,
-			user_id,
-			number,
-			sum,
-			created_at
-		FROM withdrawals WHERE user_id = $1`,
-		userID,
+			COALESCE(SUM(CASE WHEN created_at > ? THEN 1 ELSE 0 END), 0),
+			COALESCE(SUM(CASE WHEN created_at > ? THEN sum ELSE 0 END), 0),
+			COALESCE(SUM(CASE WHEN created_at >= ? THEN 1 ELSE 0 END), 0),
+			COALESCE(SUM(CASE WHEN created_at >= ? THEN sum ELSE 0 END), 0)
+		FROM withdrawals
+		WHERE user_id = ? AND created_at >= ? AND status <> 'CANCELED'`,
+		dayStart, dayStart, monthStart, monthStart, userID, since,
+	).Scan(&dailyCount, &dailySum, &monthlyCount, &monthlySum)
+	if err != nil {
+		return fmt.Errorf("failed to check withdrawal limits: %w", err)
+	}
+
+	switch {
+	case limits.DailyCount > 0 && dailyCount+1 > limits.DailyCount:
+		return fmt.Errorf("%w: daily count", ErrWithdrawLimit)
+	case limits.DailySum > 0 && dailySum+sum > limits.DailySum:
+		return fmt.Errorf("%w: daily sum", ErrWithdrawLimit)
+	case limits.MonthlyCount > 0 && monthlyCount+1 > limits.MonthlyCount:
+		return fmt.Errorf("%w: monthly count", ErrWithdrawLimit)
+	case limits.MonthlySum > 0 && monthlySum+sum > limits.MonthlySum:
+		return fmt.Errorf("%w: monthly sum", ErrWithdrawLimit)
+	}
+	return nil
+}
+
+// userWithdrawalsWhere возвращает условие выборки списаний пользователя и его аргументы
+func userWithdrawalsWhere(userID int, query model.WithdrawalsQuery) (string, []any) {
+	conds := []string{"user_id = ?"}
+	args := []any{userID}
+	if !query.From.IsZero() {
+		args = append(args, query.From)
+		conds = append(conds, "created_at >= ?")
+	}
+	if !query.To.IsZero() {
+		args = append(args, query.To)
+		conds = append(conds, "created_at < ?")
+	}
+	return strings.Join(conds, " AND "), args
+}
+
+// CountUserWithdrawals возвращает количество списаний пользователя, подходящих под условия выборки
+// без учета ограничения и смещения
+func (st *DBStorage) CountUserWithdrawals(ctx context.Context, userID int, query model.WithdrawalsQuery) (int, error) {
+	where, args := userWithdrawalsWhere(userID, query)
+	var count int
+	if err := st.readConn(ctx).QueryRow(ctx, `SELECT COUNT(*) FROM withdrawals WHERE `+where, args...).Scan(&count); err != nil {
+		return 0, fmt.Errorf("failed to count user withdrawals: %w", err)
+	}
+	return count, nil
+}
+
+func (st *DBStorage) GetWithdrawals(
+	ctx context.Context, userID int, query model.WithdrawalsQuery,
+) ([]model.Withdrawn, error) {
+	where, args := userWithdrawalsWhere(userID, query)
+	order, err := orderBy(withdrawalsSortColumns, query.Sort)
+	if err != nil {
+		return nil, err
+	}
+	limit := noLimit
+	if query.Limit > 0 {
+		limit = query.Limit
+	}
+	args = append(args, limit, query.Offset)
+	withdrawals := []model.Withdrawn{}
+	rows, err := st.readConn(ctx).Query(ctx, fmt.Sprintf(`
+		SELECT id, user_id, number, sum, status, created_at, cancelable_until
+		FROM withdrawals WHERE %s
+		ORDER BY %s
+		LIMIT ? OFFSET ?`, where, order),
+		args...,
 	)
 	if err != nil {
 		return nil, fmt.Errorf("failed to select user withdrawals: %w", err)
 	}
 	defer rows.Close()
 
+	now := time.Now()
 	for rows.Next() {
 		var withdrawn model.Withdrawn
 		if err = rows.Scan(
@@ -276,10 +923,21 @@ func (st *DBStorage) GetWithdrawals(ctx context.Context, userID int) ([]model.Wi
 			&withdrawn.UserID,
 			&withdrawn.Number,
 			&withdrawn.Sum,
+			&withdrawn.Status,
 			&withdrawn.CreatedAt,
+			&withdrawn.CancelableUntil,
 		); err != nil {
 			return nil, fmt.Errorf("failed to read data from db withdrawn row: %w", err)
 		}
+		// Списание, окно отмены которого истекло, считается завершенным
+		if withdrawn.Status == model.WithdrawalPending {
+			if withdrawn.CancelableUntil == nil || !withdrawn.CancelableUntil.After(now) {
+				withdrawn.Status = model.WithdrawalDone
+			}
+		}
+		if withdrawn.Status != model.WithdrawalPending {
+			withdrawn.CancelableUntil = nil
+		}
 		withdrawals = append(withdrawals, withdrawn)
 	}
 	if err = rows.Err(); err != nil {
@@ -289,83 +947,591 @@ func (st *DBStorage) GetWithdrawals(ctx context.Context, userID int) ([]model.Wi
 	return withdrawals, nil
 }
 
-func (st *DBStorage) GetOrdersToProcess(ctx context.Context) ([]model.Order, error) {
-	orders := []model.Order{}
-	rows, err := st.db.pool.Query(ctx, `
+// Канал уведомлений о заказах, ожидающих отправки в систему начислений (см. миграцию orders_new_notify)
+const newOrdersChannel = "orders_new"
+
+// ListenNewOrders подписывается на уведомления о загруженных заказах и заказах, возвращенных в очередь
+// обработки, и вызывает fn на каждое уведомление. Подписка занимает отдельное соединение пула и
+// завершается с ошибкой при отмене ctx или потере соединения. Уведомления есть только в PostgreSQL.
+func (st *DBStorage) ListenNewOrders(ctx context.Context, fn func()) error {
+	if st.db.pool == nil {
+		return fmt.Errorf("%w: new orders notifications require postgres", ErrUnsupportedDriver)
+	}
+	conn, err := st.db.pool.Acquire(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to listen new orders: %w", err)
+	}
+	defer func() {
+		// Соединение возвращается в пул без подписки. Если соединение потеряно, пул его закроет.
+		unlistenCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_, _ = conn.Exec(unlistenCtx, "UNLISTEN "+newOrdersChannel)
+		conn.Release()
+	}()
+	if _, err = conn.Exec(ctx, "LISTEN "+newOrdersChannel); err != nil {
+		return fmt.Errorf("failed to listen new orders: %w", err)
+	}
+
+	for {
+		if _, err = conn.Conn().WaitForNotification(ctx); err != nil {
+			return fmt.Errorf("failed to wait for new orders notification: %w", err)
+		}
+		fn()
+	}
+}
+
+// FailOrderFetch записывает неудачный запрос статуса заказа и снимает отметку о том, что заказ взят
+// воркером в обработку. После maxFailures неудачных запросов подряд заказ переводится в статус STALLED
+// с указанной причиной и больше не опрашивается, 0 - без ограничения. Возвращает true, если заказ
+// переведен в STALLED.
+func (st *DBStorage) FailOrderFetch(ctx context.Context, orderID, maxFailures int, reason string) (bool, error) {
+	tx, err := st.begin(ctx)
+	if err != nil {
+		return false, fmt.Errorf("failed to record order fetch failure: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	_, err = tx.Exec(ctx, `
+		UPDATE orders SET fetch_failures = fetch_failures + 1, claimed_by = NULL, processing_started_at = NULL
+		WHERE id = ?`,
+		orderID,
+	)
+	if err != nil {
+		return false, fmt.Errorf("failed to record order fetch failure: %w", err)
+	}
+	var status model.OrderStatus
+	var failures int
+	err = tx.QueryRow(ctx, `SELECT status, fetch_failures FROM orders WHERE id = ?`, orderID).Scan(&status, &failures)
+	if err != nil {
+		return false, fmt.Errorf("failed to record order fetch failure: %w", err)
+	}
+	stalled := maxFailures > 0 && failures >= maxFailures && !status.IsFinal()
+	if stalled {
+		now := sqlNow()
+		_, err = tx.Exec(ctx, `
+			UPDATE orders SET status = ?, status_reason = ?, updated_at = ? WHERE id = ?`,
+			model.OrderStalled, reason, now, orderID,
+		)
+		if err != nil {
+			return false, fmt.Errorf("failed to stall order: %w", err)
+		}
+		_, err = tx.Exec(ctx, `
+			INSERT INTO order_status_history (order_id, from_status, status, reason, processing_id, created_at)
+			VALUES (?, ?, ?, ?, NULLIF(?, ''), ?)`,
+			orderID, status, model.OrderStalled, reason, appctx.GetProcessingID(ctx), now,
+		)
+		if err != nil {
+			return false, fmt.Errorf("failed to record order status change: %w", err)
+		}
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return false, fmt.Errorf("failed to record order fetch failure: %w", err)
+	}
+	return stalled, nil
+}
+
+// RequeueOrder возвращает заказ в статусе STALLED в очередь обработки со сброшенным счетчиком
+// неудачных запросов. Возраст заказа для ExpireOrders после этого считается от момента возврата.
+func (st *DBStorage) RequeueOrder(ctx context.Context, orderNum string) error {
+	tx, err := st.begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to requeue order: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	var orderID int
+	var status model.OrderStatus
+	err = tx.QueryRow(ctx, `SELECT id, status FROM orders WHERE number = ?`+st.db.dialect.forUpdate, orderNum).
+		Scan(&orderID, &status)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrNoOrder
+		}
+		return fmt.Errorf("failed to requeue order: %w", err)
+	}
+	if status != model.OrderStalled {
+		return ErrOrderNotStalled
+	}
+	now := sqlNow()
+	_, err = tx.Exec(ctx, `
+		UPDATE orders
+		SET status = ?, status_reason = NULL, fetch_failures = 0, retried_at = ?, updated_at = ?
+		WHERE id = ?`,
+		model.OrderNew, now, now, orderID,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to requeue order: %w", err)
+	}
+	_, err = tx.Exec(ctx, `
+		INSERT INTO order_status_history (order_id, from_status, status, reason, created_at) VALUES (?, ?, ?, ?, ?)`,
+		orderID, status, model.OrderNew, "requeued by administrator", now,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to record order status change: %w", err)
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return fmt.Errorf("failed to requeue order: %w", err)
+	}
+	return nil
+}
+
+// ClaimOrdersToProcess закрепляет за экземпляром агента claimedBy и возвращает не более limit заказов
+// в указанном статусе с id больше afterID, кроме закрепленных воркерами после inFlightAfter. Заказы
+// выбираются с SKIP LOCKED, поэтому несколько экземпляров сервиса, забирающих заказы одновременно,
+// получают разные заказы. Закрепление снимается при обновлении статуса или неудачном запросе к системе
+// начислений, продлевается агентом, пока заказ обрабатывается, и истекает, если агент перестал его
+// продлевать. Заказы, статус которых уже был получен из системы начислений после polledBefore, не выбираются.
+func (st *DBStorage) ClaimOrdersToProcess(
+	ctx context.Context, status model.OrderStatus, afterID, limit int, claimedBy string, inFlightAfter, polledBefore time.Time,
+) ([]model.Order, error) {
+	tx, err := st.begin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to claim orders for processing: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	rows, err := tx.Query(ctx, `
+		SELECT id FROM orders
+		WHERE status = ? AND id > ? AND (processing_started_at IS NULL OR processing_started_at < ?)
+			AND (polled_at IS NULL OR polled_at < ?)
+		ORDER BY id
+		LIMIT ?`+st.db.dialect.forUpdateSkipLocked,
+		status, afterID, inFlightAfter, polledBefore, limit,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to claim orders for processing: %w", err)
+	}
+	orderIDs, err := collectIDs(rows)
+	if err != nil {
+		return nil, fmt.Errorf("failed to claim orders for processing: %w", err)
+	}
+	if len(orderIDs) == 0 {
+		return []model.Order{}, nil
+	}
+	placeholders, idArgs := inArgs(orderIDs)
+	_, err = tx.Exec(ctx, `
+		UPDATE orders SET claimed_by = ?, processing_started_at = ? WHERE id IN (`+placeholders+`)`,
+		append([]any{claimedBy, sqlNow()}, idArgs...)...,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to claim orders for processing: %w", err)
+	}
+	rows, err = tx.Query(ctx, `
 		SELECT
 			id,
 			user_id,
 			number,
 			status,
 			COALESCE(accrual, 0),
+			COALESCE(status_reason, ''),
 			created_at,
 			updated_at
-		FROM orders WHERE status IN ($1, $2)`,
-		model.OrderNew, model.OrderProcessing,
+		FROM orders WHERE id IN (`+placeholders+`)
+		ORDER BY id`,
+		idArgs...,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to claim orders for processing: %w", err)
+	}
+	orders, err := collectOrders(rows)
+	if err != nil {
+		return nil, fmt.Errorf("failed to claim orders for processing: %w", err)
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return nil, fmt.Errorf("failed to claim orders for processing: %w", err)
+	}
+	return orders, nil
+}
+
+// GetOrdersToProcess возвращает не более limit заказов в указанном статусе с id больше afterID
+// в порядке загрузки, не закрепляя их. Заказы, статус которых уже был получен из системы начислений
+// после polledBefore, не выбираются.
+func (st *DBStorage) GetOrdersToProcess(
+	ctx context.Context, status model.OrderStatus, afterID, limit int, polledBefore time.Time,
+) ([]model.Order, error) {
+	rows, err := st.readConn(ctx).Query(ctx, `
+		SELECT
+			id,
+			user_id,
+			number,
+			status,
+			COALESCE(accrual, 0),
+			COALESCE(status_reason, ''),
+			created_at,
+			updated_at
+		FROM orders
+		WHERE status = ? AND id > ? AND (polled_at IS NULL OR polled_at < ?)
+		ORDER BY id
+		LIMIT ?`,
+		status, afterID, polledBefore, limit,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to select orders to process: %w", err)
+	}
+	orders, err := collectOrders(rows)
+	if err != nil {
+		return nil, fmt.Errorf("failed to select orders to process: %w", err)
+	}
+	return orders, nil
+}
+
+// ExtendOrderClaims продлевает закрепление заказов orderIDs за экземпляром агента claimedBy, отмечая их
+// взятыми в обработку сейчас. Заказы, закрепление которых уже снято или перешло к другому экземпляру,
+// не меняются.
+func (st *DBStorage) ExtendOrderClaims(ctx context.Context, claimedBy string, orderIDs []int) error {
+	if len(orderIDs) == 0 {
+		return nil
+	}
+	placeholders, idArgs := inArgs(orderIDs)
+	_, err := st.conn(ctx).Exec(ctx, `
+		UPDATE orders SET processing_started_at = ?
+		WHERE claimed_by = ? AND processing_started_at IS NOT NULL AND id IN (`+placeholders+`)`,
+		append([]any{sqlNow(), claimedBy}, idArgs...)...,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to extend order claims: %w", err)
+	}
+	return nil
+}
+
+// ReleaseOrderClaims снимает закрепление заказов orderIDs за экземпляром агента claimedBy, чтобы
+// их сразу могли забрать другие экземпляры
+func (st *DBStorage) ReleaseOrderClaims(ctx context.Context, claimedBy string, orderIDs []int) error {
+	if len(orderIDs) == 0 {
+		return nil
+	}
+	placeholders, idArgs := inArgs(orderIDs)
+	_, err := st.conn(ctx).Exec(ctx, `
+		UPDATE orders SET claimed_by = NULL, processing_started_at = NULL WHERE claimed_by = ? AND id IN (`+placeholders+`)`,
+		append([]any{claimedBy}, idArgs...)...,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to release order claims: %w", err)
+	}
+	return nil
+}
+
+// ExpireOrders переводит в статус INVALID с указанной причиной заказы, которые не удалось
+// обработать до olderThan, и возвращает их количество. Для заказов, отправленных на повторную
+// обработку, возраст считается от момента повтора.
+func (st *DBStorage) ExpireOrders(ctx context.Context, olderThan time.Time, reason string) (int, error) {
+	tx, err := st.begin(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("failed to expire orders: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	rows, err := tx.Query(ctx, `
+		SELECT id, status FROM orders
+		WHERE status IN (?, ?) AND COALESCE(retried_at, created_at) < ?`+st.db.dialect.forUpdate,
+		model.OrderNew, model.OrderProcessing, olderThan,
+	)
+	if err != nil {
+		return 0, fmt.Errorf("failed to expire orders: %w", err)
+	}
+	expired, err := collectOrderStatuses(rows)
+	if err != nil {
+		return 0, fmt.Errorf("failed to expire orders: %w", err)
+	}
+	if err = st.changeOrderStatuses(ctx, tx, expired, model.OrderInvalid, &reason, reason); err != nil {
+		return 0, fmt.Errorf("failed to expire orders: %w", err)
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return 0, fmt.Errorf("failed to expire orders: %w", err)
+	}
+	return len(expired), nil
+}
+
+// RequeueStuckOrders возвращает в статус NEW с указанной причиной заказы, статус PROCESSING которых
+// не менялся с момента stuckBefore, и возвращает их количество
+func (st *DBStorage) RequeueStuckOrders(ctx context.Context, stuckBefore time.Time, reason string) (int, error) {
+	tx, err := st.begin(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("failed to requeue stuck orders: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	rows, err := tx.Query(ctx, `
+		SELECT id, status FROM orders
+		WHERE status = ? AND updated_at < ?`+st.db.dialect.forUpdateSkipLocked,
+		model.OrderProcessing, stuckBefore,
+	)
+	if err != nil {
+		return 0, fmt.Errorf("failed to requeue stuck orders: %w", err)
+	}
+	stuck, err := collectOrderStatuses(rows)
+	if err != nil {
+		return 0, fmt.Errorf("failed to requeue stuck orders: %w", err)
+	}
+	if err = st.changeOrderStatuses(ctx, tx, stuck, model.OrderNew, nil, reason); err != nil {
+		return 0, fmt.Errorf("failed to requeue stuck orders: %w", err)
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return 0, fmt.Errorf("failed to requeue stuck orders: %w", err)
+	}
+	return len(stuck), nil
+}
+
+// collectOrderStatuses читает id и статусы заказов из результата запроса
+func collectOrderStatuses(rows *sql.Rows) (map[int]model.OrderStatus, error) {
+	defer rows.Close()
+	statuses := make(map[int]model.OrderStatus)
+	for rows.Next() {
+		var id int
+		var status model.OrderStatus
+		if err := rows.Scan(&id, &status); err != nil {
+			return nil, err
+		}
+		statuses[id] = status
+	}
+	return statuses, rows.Err()
+}
+
+// changeOrderStatuses переводит заказы в статус status, снимает их закрепление за агентом и записывает
+// изменения в историю с причиной reason. statusReason - новая причина статуса заказа, nil - не меняется.
+// Для заказов, возвращаемых в NEW, сбрасывается время последнего опроса системы начислений.
+func (st *DBStorage) changeOrderStatuses(
+	ctx context.Context, tx sqlQuerier, prev map[int]model.OrderStatus, status model.OrderStatus,
+	statusReason *string, reason string,
+) error {
+	if len(prev) == 0 {
+		return nil
+	}
+	orderIDs := make([]int, 0, len(prev))
+	for id := range prev {
+		orderIDs = append(orderIDs, id)
+	}
+	placeholders, idArgs := inArgs(orderIDs)
+	now := sqlNow()
+	set := "status = ?, claimed_by = NULL, processing_started_at = NULL, updated_at = ?"
+	args := []any{status, now}
+	if statusReason != nil {
+		set += ", status_reason = ?"
+		args = append(args, *statusReason)
+	}
+	if status == model.OrderNew {
+		set += ", polled_at = NULL"
+	}
+	_, err := tx.Exec(ctx, `UPDATE orders SET `+set+` WHERE id IN (`+placeholders+`)`, append(args, idArgs...)...)
+	if err != nil {
+		return err
+	}
+	for _, id := range orderIDs {
+		_, err = tx.Exec(ctx, `
+			INSERT INTO order_status_history (order_id, from_status, status, reason, created_at) VALUES (?, ?, ?, ?, ?)`,
+			id, prev[id], status, reason, now,
+		)
+		if err != nil {
+			return fmt.Errorf("failed to record order status change: %w", err)
+		}
+	}
+	return nil
+}
+
+// GetOrderStatusHistory возвращает изменения статуса заказа в хронологическом порядке
+func (st *DBStorage) GetOrderStatusHistory(ctx context.Context, orderID int) ([]model.OrderStatusChange, error) {
+	rows, err := st.conn(ctx).Query(ctx, `
+		SELECT from_status, status, COALESCE(accrual, 0), COALESCE(reason, ''), created_at
+		FROM order_status_history WHERE order_id = ? ORDER BY id`,
+		orderID,
 	)
 	if err != nil {
-		return nil, fmt.Errorf("failed to select orders for processing: %w", err)
+		return nil, fmt.Errorf("failed to select order status history: %w", err)
 	}
 	defer rows.Close()
 
+	history := []model.OrderStatusChange{}
 	for rows.Next() {
-		var order model.Order
-		if err = rows.Scan(
-			&order.ID,
-			&order.UserID,
-			&order.Number,
-			&order.Status,
-			&order.Accrual,
-			&order.CreatedAt,
-			&order.UpdatedAt,
-		); err != nil {
-			return nil, fmt.Errorf("failed to read data from db order row: %w", err)
+		var change model.OrderStatusChange
+		if err = rows.Scan(&change.From, &change.Status, &change.Accrual, &change.Reason, &change.ChangedAt); err != nil {
+			return nil, fmt.Errorf("failed to read data from db order status history row: %w", err)
 		}
-		orders = append(orders, order)
+		history = append(history, change)
 	}
 	if err = rows.Err(); err != nil {
-		return nil, fmt.Errorf("failed to select orders for processing: %w", err)
+		return nil, fmt.Errorf("failed to select order status history: %w", err)
 	}
-
-	return orders, nil
+	return history, nil
 }
 
-func (st *DBStorage) UpdateOrderStatus(ctx context.Context, orderID int, status model.OrderStatus, accrual float64) error {
-	tx, err := st.db.pool.Begin(ctx)
+// SaveRateLimitEnd сохраняет момент окончания ограничения запросов к системе начислений
+func (st *DBStorage) SaveRateLimitEnd(ctx context.Context, until time.Time) error {
+	_, err := st.conn(ctx).Exec(ctx, `UPDATE agent_state SET rate_limit_until = ?`, until)
 	if err != nil {
-		return fmt.Errorf("failed to withdraw: %w", err)
+		return fmt.Errorf("failed to save rate limit end: %w", err)
 	}
-	defer tx.Rollback(ctx)
+	return nil
+}
 
-	row := tx.QueryRow(ctx, `
-		SELECT user_id FROM orders WHERE id = $1;`,
-		orderID,
+// GetRateLimitEnd возвращает сохраненный момент окончания ограничения запросов к системе начислений
+func (st *DBStorage) GetRateLimitEnd(ctx context.Context) (time.Time, error) {
+	var until *time.Time
+	if err := st.conn(ctx).QueryRow(ctx, `SELECT rate_limit_until FROM agent_state`).Scan(&until); err != nil {
+		return time.Time{}, fmt.Errorf("failed to get rate limit end: %w", err)
+	}
+	if until == nil {
+		return time.Time{}, nil
+	}
+	return *until, nil
+}
+
+func (st *DBStorage) CountOrdersToProcess(ctx context.Context) (*model.OrderBacklog, error) {
+	row := st.conn(ctx).QueryRow(ctx, `
+		SELECT
+			COALESCE(SUM(CASE WHEN status = ? THEN 1 ELSE 0 END), 0),
+			COALESCE(SUM(CASE WHEN status = ? THEN 1 ELSE 0 END), 0),
+			COALESCE(SUM(CASE WHEN status = ? THEN 1 ELSE 0 END), 0),
+			MIN(CASE WHEN status IN (?, ?) THEN created_at END)
+		FROM orders WHERE status IN (?, ?, ?)`,
+		model.OrderNew, model.OrderProcessing, model.OrderStalled,
+		model.OrderNew, model.OrderProcessing,
+		model.OrderNew, model.OrderProcessing, model.OrderStalled,
 	)
-	var userID int
-	if err := row.Scan(&userID); err != nil {
-		return fmt.Errorf("there is no order with id = %d: %w", orderID, err)
+	var backlog model.OrderBacklog
+	var oldestAt sqlTime
+	if err := row.Scan(&backlog.New, &backlog.Processing, &backlog.Stalled, &oldestAt); err != nil {
+		return nil, fmt.Errorf("failed to count orders to process: %w", err)
+	}
+	if oldest := time.Time(oldestAt); !oldest.IsZero() {
+		backlog.OldestAt = &oldest
+	}
+	return &backlog, nil
+}
+
+// LockOrder возвращает заказ по id и блокирует его строку до конца транзакции. Вызывается
+// в WithinTransaction, иначе блокировка снимается сразу после запроса.
+func (st *DBStorage) LockOrder(ctx context.Context, orderID int) (*model.Order, error) {
+	order := model.Order{ID: orderID}
+	err := st.conn(ctx).QueryRow(ctx, `
+		SELECT user_id, number, status, COALESCE(accrual, 0) FROM orders WHERE id = ?`+st.db.dialect.forUpdate,
+		orderID,
+	).Scan(&order.UserID, &order.Number, &order.Status, &order.Accrual)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNoOrder
+		}
+		return nil, fmt.Errorf("failed to lock order: %w", err)
+	}
+	return &order, nil
+}
+
+// CreditAccrual начисляет пользователю баллы за заказ. Начисление умножается на коэффициент уровня
+// пользователя в программе лояльности, возвращается фактически начисленная сумма.
+func (st *DBStorage) CreditAccrual(
+	ctx context.Context, userID int, orderNum string, accrual model.Money,
+) (model.Money, error) {
+	tx := st.conn(ctx)
+	if err := st.lockBalance(ctx, tx, userID); err != nil {
+		return 0, fmt.Errorf("failed to credit accrual: %w", err)
+	}
+	accrual, err := st.applyLoyaltyTier(ctx, tx, userID, accrual)
+	if err != nil {
+		return 0, fmt.Errorf("failed to credit accrual: %w", err)
+	}
+	err = st.appendBalanceEvent(ctx, tx, model.BalanceEvent{
+		UserID:       userID,
+		Type:         model.BalanceEventAccrual,
+		Number:       orderNum,
+		CurrentDelta: accrual,
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to credit accrual: %w", err)
 	}
+	return accrual, nil
+}
 
-	var accrualToUpdate *float64
-	if accrual > 0 {
-		accrualToUpdate = &accrual
-		_, err = tx.Exec(ctx, `UPDATE balances SET current = current + $1 WHERE user_id = $2`,
-			accrual, userID,
+// SetOrderStatus устанавливает статус заказа, снимает его закрепление за агентом и записывает
+// изменение статуса в историю и outbox. accrual - начисленная по заказу сумма, nil - без начисления.
+// order - заказ до изменения, полученный LockOrder.
+func (st *DBStorage) SetOrderStatus(
+	ctx context.Context, order *model.Order, status model.OrderStatus, accrual *model.Money,
+) error {
+	tx := st.conn(ctx)
+	now := sqlNow()
+	// updated_at вычисляется раньше status: MySQL подставляет в следующие выражения SET уже новые значения
+	_, err := tx.Exec(ctx, `
+		UPDATE orders
+		SET updated_at = CASE WHEN status = ? THEN updated_at ELSE ? END, status = ?, accrual = ?,
+			status_reason = NULL, claimed_by = NULL, processing_started_at = NULL, fetch_failures = 0, polled_at = ?
+		WHERE id = ?`,
+		status, now, status, accrual, now, order.ID,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to update order status: %w", err)
+	}
+	if status != order.Status {
+		_, err = tx.Exec(ctx, `
+			INSERT INTO order_status_history (order_id, from_status, status, accrual, processing_id, created_at)
+			VALUES (?, ?, ?, ?, NULLIF(?, ''), ?)`,
+			order.ID, order.Status, status, accrual, appctx.GetProcessingID(ctx), now,
 		)
+		if err != nil {
+			return fmt.Errorf("failed to record order status change: %w", err)
+		}
+		err = appendOutboxEvent(ctx, tx, order.UserID, model.EventOrderStatusChanged, map[string]any{
+			"order":       order.Number,
+			"from_status": order.Status,
+			"status":      status,
+			"accrual":     accrual,
+		})
 		if err != nil {
 			return fmt.Errorf("failed to update order status: %w", err)
 		}
 	}
+	if status == model.OrderProcessed {
+		var credited model.Money
+		if accrual != nil {
+			credited = *accrual
+		}
+		err = appendOutboxEvent(ctx, tx, order.UserID, model.WebhookOrderProcessed, map[string]any{
+			"order":   order.Number,
+			"status":  status,
+			"accrual": credited,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to update order status: %w", err)
+		}
+	}
+	return nil
+}
+
+// applyLoyaltyTier умножает начисление на коэффициент текущего уровня пользователя, учитывает его
+// в сумме начислений за все время и пересчитывает уровень. Возвращает начисление с учетом коэффициента.
+func (st *DBStorage) applyLoyaltyTier(
+	ctx context.Context, tx sqlQuerier, userID int, accrual model.Money,
+) (model.Money, error) {
+	var lifetime model.Money
+	err := tx.QueryRow(ctx, `SELECT lifetime_accrual FROM users WHERE id = ?`+st.db.dialect.forUpdate, userID).
+		Scan(&lifetime)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read user lifetime accrual: %w", err)
+	}
+	accrual = accrual.Mul(st.loyaltyTiers.For(lifetime).Multiplier)
+	lifetime += accrual
 	_, err = tx.Exec(ctx, `
-		UPDATE orders SET status = $1, accrual = $2, updated_at = NOW() WHERE id = $3`,
-		status, accrualToUpdate, orderID,
+		UPDATE users SET lifetime_accrual = ?, tier = ? WHERE id = ?`,
+		lifetime, st.loyaltyTiers.For(lifetime).Tier, userID,
 	)
 	if err != nil {
-		return fmt.Errorf("failed to update order status: %w", err)
+		return 0, fmt.Errorf("failed to update user loyalty tier: %w", err)
 	}
+	return accrual, nil
+}
 
-	if err := tx.Commit(ctx); err != nil {
-		return fmt.Errorf("failed to update order status: %w", err)
+// GetLifetimeAccrual возвращает сумму начисленных пользователю баллов за все время
+func (st *DBStorage) GetLifetimeAccrual(ctx context.Context, userID int) (model.Money, error) {
+	var lifetime model.Money
+	err := st.conn(ctx).QueryRow(ctx, `SELECT lifetime_accrual FROM users WHERE id = ?`, userID).Scan(&lifetime)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, ErrNoUser
+		}
+		return 0, fmt.Errorf("failed to read user lifetime accrual: %w", err)
 	}
-	return nil
+	return lifetime, nil
 }
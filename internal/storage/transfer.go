@@ -0,0 +1,132 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/pinbrain/gophermart/internal/model"
+)
+
+// Transfer переводит sum баллов от пользователя fromUserID пользователю с логином toLogin.
+// Списание и начисление выполняются в одной транзакции под блокировкой обоих балансов.
+
+func (st *DBStorage) Transfer(ctx context.Context, fromUserID int, toLogin string, sum model.Money) (*model.Transfer, error) {
+	tx, err := st.begin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to transfer: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	var toUserID int
+	err = tx.QueryRow(ctx, `SELECT id FROM users WHERE login = ?`, toLogin).Scan(&toUserID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNoUser
+		}
+		return nil, fmt.Errorf("failed to transfer: %w", err)
+	}
+	if toUserID == fromUserID {
+		return nil, ErrSelfTransfer
+	}
+
+	// Балансы блокируются в порядке возрастания id, чтобы встречные переводы не приводили к взаимной блокировке
+	first, second := fromUserID, toUserID
+	if first > second {
+		first, second = second, first
+	}
+	if err = st.lockBalance(ctx, tx, first); err != nil {
+		return nil, fmt.Errorf("failed to transfer: %w", err)
+	}
+	if err = st.lockBalance(ctx, tx, second); err != nil {
+		return nil, fmt.Errorf("failed to transfer: %w", err)
+	}
+
+	balance, err := selectBalance(ctx, tx, fromUserID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to transfer: %w", err)
+	}
+	if balance.Current < sum {
+		return nil, ErrInsufficientFunds
+	}
+
+	transfer := model.Transfer{
+		Direction:      model.TransferOut,
+		Counterparty:   toLogin,
+		CounterpartyID: toUserID,
+		Sum:            sum,
+		CreatedAt:      sqlNow(),
+	}
+	transferID, err := tx.insert(ctx, `
+		INSERT INTO transfers (from_user_id, to_user_id, sum, created_at) VALUES (?, ?, ?, ?)`,
+		fromUserID, toUserID, sum, transfer.CreatedAt,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to transfer: %w", err)
+	}
+	transfer.ID = int(transferID)
+	err = st.appendBalanceEvent(ctx, tx, model.BalanceEvent{
+		UserID:       fromUserID,
+		Type:         model.BalanceEventTransferOut,
+		CurrentDelta: -sum,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to transfer: %w", err)
+	}
+	err = st.appendBalanceEvent(ctx, tx, model.BalanceEvent{
+		UserID:       toUserID,
+		Type:         model.BalanceEventTransferIn,
+		CurrentDelta: sum,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to transfer: %w", err)
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return nil, fmt.Errorf("failed to transfer: %w", err)
+	}
+	return &transfer, nil
+}
+
+// GetTransfers возвращает входящие и исходящие переводы пользователя, начиная с последних
+func (st *DBStorage) GetTransfers(ctx context.Context, userID int) ([]model.Transfer, error) {
+	rows, err := st.conn(ctx).Query(ctx, `
+		SELECT
+			t.id,
+			CASE WHEN t.from_user_id = ? THEN 'OUT' ELSE 'IN' END,
+			u.id,
+			u.login,
+			t.sum,
+			t.created_at
+		FROM transfers t
+		JOIN users u ON u.id = CASE WHEN t.from_user_id = ? THEN t.to_user_id ELSE t.from_user_id END
+		WHERE t.from_user_id = ? OR t.to_user_id = ?
+		ORDER BY t.created_at DESC, t.id DESC`,
+		userID, userID, userID, userID,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to select user transfers: %w", err)
+	}
+	defer rows.Close()
+
+	transfers := []model.Transfer{}
+	for rows.Next() {
+		var transfer model.Transfer
+		if err = rows.Scan(
+			&transfer.ID,
+			&transfer.Direction,
+			&transfer.CounterpartyID,
+			&transfer.Counterparty,
+			&transfer.Sum,
+			&transfer.CreatedAt,
+		); err != nil {
+			return nil, fmt.Errorf("failed to read data from db transfer row: %w", err)
+		}
+		transfers = append(transfers, transfer)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to select user transfers: %w", err)
+	}
+	return transfers, nil
+}
@@ -0,0 +1,56 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+)
+
+type txCtxKey struct{}
+
+// TxManager выполняет несколько операций хранилища в одной транзакции
+type TxManager interface {
+	WithinTransaction(ctx context.Context, fn func(ctx context.Context) error) error
+}
+
+// WithinTransaction выполняет fn в транзакции. Методы хранилища, вызванные в fn с переданным ей
+// контекстом, выполняются в этой транзакции. Транзакция откатывается, если fn вернула ошибку.
+// Вложенный вызов выполняет fn в точке сохранения внешней транзакции, поэтому ошибка fn откатывает
+// только ее изменения. Исключение - ListenNewOrders, которому нужно отдельное соединение.
+func (st *DBStorage) WithinTransaction(ctx context.Context, fn func(ctx context.Context) error) error {
+	tx, err := st.begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	if err = fn(context.WithValue(ctx, txCtxKey{}, tx)); err != nil {
+		return err
+	}
+	if err = tx.Commit(ctx); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
+
+// begin начинает транзакцию метода хранилища. Если метод вызван в WithinTransaction, вместо отдельной
+// транзакции создается точка сохранения в ее транзакции: Commit освобождает точку сохранения,
+// а изменения фиксируются вместе с внешней транзакцией.
+func (st *DBStorage) begin(ctx context.Context) (*sqlTx, error) {
+	outer, ok := ctx.Value(txCtxKey{}).(*sqlTx)
+	if !ok {
+		return st.db.begin(ctx)
+	}
+	name := fmt.Sprintf("sp_%d", st.savepoints.Add(1))
+	if _, err := outer.tx.ExecContext(ctx, "SAVEPOINT "+name); err != nil {
+		return nil, err
+	}
+	return &sqlTx{sqlConn: outer.sqlConn, tx: outer.tx, savepointName: name}, nil
+}
+
+// conn возвращает транзакцию, начатую WithinTransaction, или пул соединений, если метод вызван вне ее
+func (st *DBStorage) conn(ctx context.Context) sqlQuerier {
+	if tx, ok := ctx.Value(txCtxKey{}).(*sqlTx); ok {
+		return tx
+	}
+	return st.db
+}
@@ -0,0 +1,201 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/pinbrain/gophermart/internal/model"
+)
+
+func webhookEvents(events []string) []model.WebhookEventType {
+	res := make([]model.WebhookEventType, 0, len(events))
+	for _, event := range events {
+		res = append(res, model.WebhookEventType(event))
+	}
+	return res
+}
+
+// CreateWebhook регистрирует адрес, на который пользователь получает события указанных типов
+func (st *DBStorage) CreateWebhook(
+	ctx context.Context, userID int, url string, events []model.WebhookEventType, secret string,
+) (*model.Webhook, error) {
+	eventNames := make([]string, 0, len(events))
+	for _, event := range events {
+		eventNames = append(eventNames, string(event))
+	}
+	eventsJSON, err := json.Marshal(eventNames)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create webhook: %w", err)
+	}
+	webhook := model.Webhook{UserID: userID, URL: url, Events: events, Secret: secret, CreatedAt: sqlNow()}
+	webhookID, err := st.conn(ctx).insert(ctx, `
+		INSERT INTO webhooks (user_id, url, events, secret, created_at) VALUES (?, ?, ?, ?, ?)`,
+		userID, url, string(eventsJSON), secret, webhook.CreatedAt,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create webhook: %w", err)
+	}
+	webhook.ID = int(webhookID)
+	return &webhook, nil
+}
+
+// GetWebhooks возвращает webhooks пользователя без ключей подписи
+func (st *DBStorage) GetWebhooks(ctx context.Context, userID int) ([]model.Webhook, error) {
+	rows, err := st.conn(ctx).Query(ctx, `
+		SELECT id, user_id, url, events, created_at FROM webhooks WHERE user_id = ? ORDER BY id`,
+		userID,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to select user webhooks: %w", err)
+	}
+	defer rows.Close()
+
+	webhooks := []model.Webhook{}
+	for rows.Next() {
+		var webhook model.Webhook
+		var eventsJSON []byte
+		if err = rows.Scan(&webhook.ID, &webhook.UserID, &webhook.URL, &eventsJSON, &webhook.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to read data from db webhook row: %w", err)
+		}
+		var events []string
+		if err = json.Unmarshal(eventsJSON, &events); err != nil {
+			return nil, fmt.Errorf("failed to read data from db webhook row: %w", err)
+		}
+		webhook.Events = webhookEvents(events)
+		webhooks = append(webhooks, webhook)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to select user webhooks: %w", err)
+	}
+	return webhooks, nil
+}
+
+// DeleteWebhook удаляет webhook пользователя вместе с недоставленными событиями
+func (st *DBStorage) DeleteWebhook(ctx context.Context, userID, webhookID int) error {
+	res, err := st.conn(ctx).Exec(ctx, `DELETE FROM webhooks WHERE id = ? AND user_id = ?`, webhookID, userID)
+	if err != nil {
+		return fmt.Errorf("failed to delete webhook: %w", err)
+	}
+	if deleted, err := res.RowsAffected(); err != nil || deleted == 0 {
+		if err != nil {
+			return fmt.Errorf("failed to delete webhook: %w", err)
+		}
+		return ErrNoWebhook
+	}
+	return nil
+}
+
+// ClaimWebhookDeliveries выбирает не более limit событий, время доставки которых наступило, и откладывает
+// их следующую попытку до leaseUntil, чтобы другие экземпляры сервиса не отправили их одновременно
+func (st *DBStorage) ClaimWebhookDeliveries(
+	ctx context.Context, limit int, leaseUntil time.Time,
+) ([]model.WebhookDelivery, error) {
+	tx, err := st.begin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to claim webhook deliveries: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	rows, err := tx.Query(ctx, `
+		SELECT id FROM webhook_deliveries
+		WHERE status = 'PENDING' AND next_attempt_at <= ?
+		ORDER BY next_attempt_at
+		LIMIT ?`+st.db.dialect.forUpdateSkipLocked,
+		sqlNow(), limit,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to claim webhook deliveries: %w", err)
+	}
+	deliveryIDs, err := collectIDs(rows)
+	if err != nil {
+		return nil, fmt.Errorf("failed to claim webhook deliveries: %w", err)
+	}
+	if len(deliveryIDs) == 0 {
+		return []model.WebhookDelivery{}, nil
+	}
+	placeholders, idArgs := inArgs(deliveryIDs)
+	_, err = tx.Exec(ctx, `
+		UPDATE webhook_deliveries SET next_attempt_at = ? WHERE id IN (`+placeholders+`)`,
+		append([]any{leaseUntil}, idArgs...)...,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to claim webhook deliveries: %w", err)
+	}
+	rows, err = tx.Query(ctx, `
+		SELECT d.id, w.url, w.secret, d.event, d.payload, d.attempts, d.created_at
+		FROM webhook_deliveries d
+		JOIN webhooks w ON w.id = d.webhook_id
+		WHERE d.id IN (`+placeholders+`)
+		ORDER BY d.id`,
+		idArgs...,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to claim webhook deliveries: %w", err)
+	}
+	defer rows.Close()
+
+	deliveries := []model.WebhookDelivery{}
+	for rows.Next() {
+		var delivery model.WebhookDelivery
+		var payload []byte
+		if err = rows.Scan(
+			&delivery.ID,
+			&delivery.URL,
+			&delivery.Secret,
+			&delivery.Event,
+			&payload,
+			&delivery.Attempts,
+			&delivery.CreatedAt,
+		); err != nil {
+			return nil, fmt.Errorf("failed to read data from db webhook delivery row: %w", err)
+		}
+		delivery.Payload = payload
+		deliveries = append(deliveries, delivery)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to claim webhook deliveries: %w", err)
+	}
+	rows.Close()
+
+	if err = tx.Commit(ctx); err != nil {
+		return nil, fmt.Errorf("failed to claim webhook deliveries: %w", err)
+	}
+	return deliveries, nil
+}
+
+// CompleteWebhookDelivery отмечает событие доставленным
+func (st *DBStorage) CompleteWebhookDelivery(ctx context.Context, deliveryID int64) error {
+	_, err := st.conn(ctx).Exec(ctx, `
+		UPDATE webhook_deliveries SET status = 'DELIVERED', delivered_at = ?, last_error = NULL
+		WHERE id = ?`,
+		sqlNow(), deliveryID,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to complete webhook delivery: %w", err)
+	}
+	return nil
+}
+
+// FailWebhookDelivery записывает неудачную попытку доставки. Следующая попытка выполняется в nextAttemptAt,
+// нулевое значение означает, что попытки исчерпаны и событие больше не отправляется.
+func (st *DBStorage) FailWebhookDelivery(
+	ctx context.Context, deliveryID int64, nextAttemptAt time.Time, lastError string,
+) error {
+	status := model.WebhookDeliveryPending
+	if nextAttemptAt.IsZero() {
+		status = model.WebhookDeliveryFailed
+		nextAttemptAt = sqlNow()
+	}
+	_, err := st.conn(ctx).Exec(ctx, `
+		UPDATE webhook_deliveries
+		SET status = ?, attempts = attempts + 1, next_attempt_at = ?, last_error = ?
+		WHERE id = ?`,
+		status, nextAttemptAt, lastError, deliveryID,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to record webhook delivery failure: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,197 @@
+package utils
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/pinbrain/gophermart/internal/model"
+)
+
+// JWTKey - ключ подписи JWT пользователей. Идентификатор ключа передается в заголовке kid токена,
+// что позволяет проверять токены, подписанные предыдущими ключами.
+type JWTKey struct {
+	ID string
+	// Секрет HMAC (HS256)
+	Secret string
+	// Закрытый ключ RSA (RS256) или Ed25519 (EdDSA). Если задан, Secret не используется, а открытый
+	// ключ публикуется в JWKS, чтобы другие сервисы могли проверять токены без общего секрета.
+	PrivateKey crypto.Signer
+}
+
+// method возвращает алгоритм подписи токенов ключом
+func (k JWTKey) method() jwt.SigningMethod {
+	switch k.PrivateKey.(type) {
+	case *rsa.PrivateKey:
+		return jwt.SigningMethodRS256
+	case ed25519.PrivateKey:
+		return jwt.SigningMethodEdDSA
+	default:
+		return jwt.SigningMethodHS256
+	}
+}
+
+// signingKey возвращает ключ в виде, который ожидает jwt.SigningMethod.Sign
+func (k JWTKey) signingKey() interface{} {
+	if k.PrivateKey != nil {
+		return k.PrivateKey
+	}
+	return []byte(k.Secret)
+}
+
+// verificationKey возвращает ключ в виде, который ожидает jwt.SigningMethod.Verify
+func (k JWTKey) verificationKey() interface{} {
+	if k.PrivateKey != nil {
+		return k.PrivateKey.Public()
+	}
+	return []byte(k.Secret)
+}
+
+type JWTCfg struct {
+	// Ключи подписи, первым подписываются новые токены, остальные только проверяются
+	Keys []JWTKey
+	// Срок действия JWT пользователя
+	TTL time.Duration
+	// Срок действия токена обновления сессии
+	RefreshTTL time.Duration
+}
+
+var jwtCfg = JWTCfg{
+	Keys:       []JWTKey{DefaultJWTKey()},
+	TTL:        jwtExpires,
+	RefreshTTL: refreshTokenExpires,
+}
+
+// ConfigureJWT задает ключи и сроки действия токенов пользователей, вызывается при запуске сервиса
+func ConfigureJWT(cfg JWTCfg) error {
+	if len(cfg.Keys) == 0 {
+		return errors.New("no jwt keys")
+	}
+	ids := make(map[string]struct{}, len(cfg.Keys))
+	for _, key := range cfg.Keys {
+		if key.ID == "" || (key.Secret == "" && key.PrivateKey == nil) {
+			return errors.New("jwt key id and secret must not be empty")
+		}
+		if key.PrivateKey != nil && key.method() == jwt.SigningMethodHS256 {
+			return fmt.Errorf("unsupported jwt private key type %T", key.PrivateKey)
+		}
+		if _, ok := ids[key.ID]; ok {
+			return fmt.Errorf("duplicate jwt key id %q", key.ID)
+		}
+		ids[key.ID] = struct{}{}
+	}
+	if cfg.TTL <= 0 || cfg.RefreshTTL <= 0 {
+		return errors.New("jwt ttl must be positive")
+	}
+	jwtCfg = cfg
+	return nil
+}
+
+// DefaultJWTKey возвращает встроенный ключ подписи, небезопасный для использования в продакшене
+func DefaultJWTKey() JWTKey {
+	return JWTKey{ID: defaultJWTKeyID, Secret: jwtSecretKey}
+}
+
+// RefreshTokenTTL возвращает срок действия токена обновления сессии
+func RefreshTokenTTL() time.Duration {
+	return jwtCfg.RefreshTTL
+}
+
+// ParseJWTKeys разбирает список ключей вида kid1:secret1,kid2:secret2
+func ParseJWTKeys(s string) ([]JWTKey, error) {
+	var keys []JWTKey
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		id, secret, ok := strings.Cut(pair, ":")
+		if !ok || id == "" || secret == "" {
+			return nil, fmt.Errorf("invalid jwt key %q, expected kid:secret", id)
+		}
+		keys = append(keys, JWTKey{ID: id, Secret: secret})
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("no jwt keys")
+	}
+	return keys, nil
+}
+
+// ParseJWTPrivateKey разбирает закрытый ключ RSA или Ed25519 в формате PEM (PKCS#8 или PKCS#1)
+func ParseJWTPrivateKey(id string, pemData []byte) (JWTKey, error) {
+	block, _ := pem.Decode(pemData)
+	if block == nil {
+		return JWTKey{}, errors.New("no pem data in jwt private key")
+	}
+	var key interface{}
+	var err error
+	switch block.Type {
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	default:
+		return JWTKey{}, fmt.Errorf("unsupported pem block type %q", block.Type)
+	}
+	if err != nil {
+		return JWTKey{}, fmt.Errorf("failed to parse jwt private key: %w", err)
+	}
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		return JWTKey{ID: id, PrivateKey: k}, nil
+	case ed25519.PrivateKey:
+		return JWTKey{ID: id, PrivateKey: k}, nil
+	default:
+		return JWTKey{}, fmt.Errorf("unsupported jwt private key type %T", key)
+	}
+}
+
+// PublicJWKS возвращает открытые ключи асимметричных ключей подписи в формате JWK Set (RFC 7517).
+// Ключи HMAC не публикуются.
+func PublicJWKS() model.JWKS {
+	jwks := model.JWKS{Keys: []model.JWK{}}
+	for _, key := range jwtCfg.Keys {
+		jwk := model.JWK{Kid: key.ID, Use: "sig", Alg: key.method().Alg()}
+		switch pub := key.verificationKey().(type) {
+		case *rsa.PublicKey:
+			jwk.Kty = "RSA"
+			jwk.N = base64.RawURLEncoding.EncodeToString(pub.N.Bytes())
+			jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes())
+		case ed25519.PublicKey:
+			jwk.Kty = "OKP"
+			jwk.Crv = "Ed25519"
+			jwk.X = base64.RawURLEncoding.EncodeToString(pub)
+		default:
+			continue
+		}
+		jwks.Keys = append(jwks.Keys, jwk)
+	}
+	return jwks
+}
+
+func jwtSigningKey() JWTKey {
+	return jwtCfg.Keys[0]
+}
+
+// jwtVerificationKey возвращает ключ с идентификатором kid. Токены без kid, выпущенные
+// до появления ротации ключей, проверяются ключом по умолчанию.
+func jwtVerificationKey(kid string) (JWTKey, error) {
+	if kid == "" {
+		kid = defaultJWTKeyID
+	}
+	for _, key := range jwtCfg.Keys {
+		if key.ID == kid {
+			return key, nil
+		}
+	}
+	return JWTKey{}, fmt.Errorf("unknown jwt key id %q", kid)
+}
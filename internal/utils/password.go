@@ -0,0 +1,125 @@
+package utils
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Алгоритмы хэширования паролей
+const (
+	PasswordHashBcrypt   = "bcrypt"
+	PasswordHashArgon2id = "argon2id"
+)
+
+// Параметры argon2id, рекомендованные RFC 9106 для систем с ограниченной памятью
+const (
+	argon2Memory  = 64 * 1024
+	argon2Time    = 1
+	argon2Threads = 4
+	argon2KeyLen  = 32
+	argon2SaltLen = 16
+)
+
+var (
+	passwordHashAlgorithm = PasswordHashBcrypt
+
+	errInvalidArgon2Hash = errors.New("invalid argon2id hash")
+)
+
+// ConfigurePasswordHashing задает алгоритм хэширования новых паролей. Пароли, захэшированные
+// другим алгоритмом, продолжают проверяться и перехэшируются при входе пользователя.
+func ConfigurePasswordHashing(algorithm string) error {
+	switch algorithm {
+	case PasswordHashBcrypt, PasswordHashArgon2id:
+		passwordHashAlgorithm = algorithm
+		return nil
+	}
+	return fmt.Errorf("unknown password hash algorithm %q", algorithm)
+}
+
+func GeneratePasswordHash(password string) (string, error) {
+	if passwordHashAlgorithm == PasswordHashArgon2id {
+		return generateArgon2Hash(password)
+	}
+	hashedBytes, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", fmt.Errorf("failed to generate pwd hash: %w", err)
+	}
+	return string(hashedBytes), nil
+}
+
+func ComparePwdAndHash(password, hash string) bool {
+	if strings.HasPrefix(hash, "$argon2id$") {
+		return compareArgon2Hash(password, hash)
+	}
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
+
+// PasswordHashNeedsUpgrade проверяет, захэширован ли пароль не текущим алгоритмом или с устаревшими параметрами
+func PasswordHashNeedsUpgrade(hash string) bool {
+	if passwordHashAlgorithm != PasswordHashArgon2id {
+		return strings.HasPrefix(hash, "$argon2id$")
+	}
+	params, _, _, err := decodeArgon2Hash(hash)
+	if err != nil {
+		return true
+	}
+	return params != argon2Params{memory: argon2Memory, time: argon2Time, threads: argon2Threads}
+}
+
+type argon2Params struct {
+	memory  uint32
+	time    uint32
+	threads uint8
+}
+
+// generateArgon2Hash хэширует пароль argon2id и кодирует параметры, соль и хэш в формате PHC:
+// $argon2id$v=19$m=65536,t=1,p=4$<соль>$<хэш>
+func generateArgon2Hash(password string) (string, error) {
+	salt := make([]byte, argon2SaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", fmt.Errorf("failed to generate pwd hash: %w", err)
+	}
+	key := argon2.IDKey([]byte(password), salt, argon2Time, argon2Memory, argon2Threads, argon2KeyLen)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, argon2Memory, argon2Time, argon2Threads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key),
+	), nil
+}
+
+func decodeArgon2Hash(hash string) (params argon2Params, salt, key []byte, err error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[1] != PasswordHashArgon2id {
+		return params, nil, nil, errInvalidArgon2Hash
+	}
+	var version int
+	if _, err = fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return params, nil, nil, errInvalidArgon2Hash
+	}
+	if _, err = fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.memory, &params.time, &params.threads); err != nil {
+		return params, nil, nil, errInvalidArgon2Hash
+	}
+	if salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		return params, nil, nil, errInvalidArgon2Hash
+	}
+	if key, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil {
+		return params, nil, nil, errInvalidArgon2Hash
+	}
+	return params, salt, key, nil
+}
+
+func compareArgon2Hash(password, hash string) bool {
+	params, salt, key, err := decodeArgon2Hash(hash)
+	if err != nil {
+		return false
+	}
+	reqKey := argon2.IDKey([]byte(password), salt, params.time, params.memory, params.threads, uint32(len(key)))
+	return subtle.ConstantTimeCompare(key, reqKey) == 1
+}
@@ -1,6 +1,10 @@
 package utils
 
 import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"time"
@@ -8,58 +12,121 @@ import (
 
 	"github.com/golang-jwt/jwt/v4"
 	"github.com/pinbrain/gophermart/internal/model"
-	"golang.org/x/crypto/bcrypt"
 )
 
 const (
-	jwtExpires   = time.Hour * 3
-	jwtSecretKey = "some_secret_jwt_key"
+	// Значения по умолчанию, используются, если ключи и сроки действия токенов не заданы в конфигурации
+	jwtExpires          = time.Minute * 15
+	jwtSecretKey        = "some_secret_jwt_key"
+	defaultJWTKeyID     = "default"
+	refreshTokenExpires = time.Hour * 24 * 30
+
+	secretTokenSize = 32
+	tokenIDSize     = 16
+
+	// Издатель токенов для межсервисного взаимодействия
+	serviceJWTIssuer = "service"
+)
+
+// Области доступа сервисных токенов к внутреннему API
+const (
+	ScopeAccrualsWrite = "accruals:write"
+	ScopeAgentRead     = "agent:read"
+	ScopeUsersWrite    = "users:write"
+	ScopeRatesWrite    = "rates:write"
+	ScopeOrdersWrite   = "orders:write"
 )
 
 type JWTClaims struct {
 	jwt.RegisteredClaims
 	UserID int
 	Login  string
+	// До какого момента пользователь подтвердил вход повторным вводом пароля
+	ElevatedUntil *jwt.NumericDate `json:"elevated_until,omitempty"`
+	// Версия токенов пользователя на момент выпуска, меняется при смене пароля
+	TokenVersion int `json:"ver,omitempty"`
 }
 
-func GeneratePasswordHash(password string) (string, error) {
-	hashedBytes, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
-	if err != nil {
-		return "", fmt.Errorf("failed to generate pwd hash: %w", err)
-	}
-	return string(hashedBytes), nil
+// ServiceJWTClaims - данные токена сервиса, подписываемого отдельным ключом
+type ServiceJWTClaims struct {
+	jwt.RegisteredClaims
+	Scopes []string `json:"scopes"`
 }
 
-func ComparePwdAndHash(password, hash string) bool {
-	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+// HasScope проверяет, выдан ли токен на указанную область доступа
+func (c *ServiceJWTClaims) HasScope(scope string) bool {
+	for _, s := range c.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
 }
 
 func BuildJWTSting(user model.User) (string, error) {
+	return buildJWTString(user, time.Time{})
+}
+
+// BuildElevatedJWTString выпускает JWT пользователя, подтвердившего вход повторным вводом пароля.
+// Признак подтверждения действует до elevatedUntil, но не дольше срока действия токена.
+func BuildElevatedJWTString(user model.User, elevatedUntil time.Time) (string, error) {
+	return buildJWTString(user, elevatedUntil)
+}
+
+func buildJWTString(user model.User, elevatedUntil time.Time) (string, error) {
 	if user.ID == 0 || user.Login == "" {
 		return "", errors.New("not valid user data")
 	}
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, JWTClaims{
-		UserID: user.ID,
-		Login:  user.Login,
+	tokenID, err := newTokenID()
+	if err != nil {
+		return "", fmt.Errorf("failed to build jwt string: %w", err)
+	}
+	claims := JWTClaims{
+		UserID:       user.ID,
+		Login:        user.Login,
+		TokenVersion: user.TokenVersion,
 		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(time.Now().Add(jwtExpires)),
+			// Идентификатор токена нужен для его отзыва до истечения срока действия
+			ID:        tokenID,
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(jwtCfg.TTL)),
 		},
-	})
+	}
+	if !elevatedUntil.IsZero() {
+		claims.ElevatedUntil = jwt.NewNumericDate(elevatedUntil)
+	}
+	signingKey := jwtSigningKey()
+	token := jwt.NewWithClaims(signingKey.method(), claims)
+	token.Header["kid"] = signingKey.ID
 
-	tokenString, err := token.SignedString([]byte(jwtSecretKey))
+	tokenString, err := token.SignedString(signingKey.signingKey())
 	if err != nil {
 		return "", fmt.Errorf("failed to build jwt string: %w", err)
 	}
 	return tokenString, nil
 }
 
+func newTokenID() (string, error) {
+	b := make([]byte, tokenIDSize)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
 func GetJWTClaims(tokenString string) (*JWTClaims, error) {
 	claims := &JWTClaims{}
 	token, err := jwt.ParseWithClaims(tokenString, claims, func(t *jwt.Token) (interface{}, error) {
-		if _, ok := t.Method.(*jwt.SigningMethodHMAC); !ok {
+		kid, _ := t.Header["kid"].(string)
+		key, err := jwtVerificationKey(kid)
+		if err != nil {
+			return nil, err
+		}
+		// Алгоритм задается ключом, а не заголовком токена, иначе открытый ключ
+		// можно было бы использовать как секрет HMAC
+		if t.Method.Alg() != key.method().Alg() {
 			return nil, fmt.Errorf("unexpected signing method: %v", t.Header["alg"])
 		}
-		return []byte(jwtSecretKey), nil
+		return key.verificationKey(), nil
 	})
 	if err != nil {
 		return nil, fmt.Errorf("failed to parse jwt token: %w", err)
@@ -67,9 +134,108 @@ func GetJWTClaims(tokenString string) (*JWTClaims, error) {
 	if !token.Valid {
 		return nil, errors.New("invalid jwt token")
 	}
+	if claims.Issuer == serviceJWTIssuer {
+		return nil, errors.New("service jwt token used as user token")
+	}
 	return claims, nil
 }
 
+// BuildServiceJWTString выпускает токен сервиса subject с указанными областями доступа
+func BuildServiceJWTString(key, subject string, scopes []string, ttl time.Duration) (string, error) {
+	if key == "" || subject == "" {
+		return "", errors.New("not valid service token data")
+	}
+	claims := ServiceJWTClaims{
+		Scopes: scopes,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:   serviceJWTIssuer,
+			Subject:  subject,
+			IssuedAt: jwt.NewNumericDate(time.Now()),
+		},
+	}
+	if ttl > 0 {
+		claims.ExpiresAt = jwt.NewNumericDate(time.Now().Add(ttl))
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+
+	tokenString, err := token.SignedString([]byte(key))
+	if err != nil {
+		return "", fmt.Errorf("failed to build service jwt string: %w", err)
+	}
+	return tokenString, nil
+}
+
+func GetServiceJWTClaims(tokenString, key string) (*ServiceJWTClaims, error) {
+	claims := &ServiceJWTClaims{}
+	token, err := jwt.ParseWithClaims(tokenString, claims, func(t *jwt.Token) (interface{}, error) {
+		if _, ok := t.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("unexpected signing method: %v", t.Header["alg"])
+		}
+		return []byte(key), nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse service jwt token: %w", err)
+	}
+	if !token.Valid {
+		return nil, errors.New("invalid service jwt token")
+	}
+	if claims.Issuer != serviceJWTIssuer {
+		return nil, errors.New("not a service jwt token")
+	}
+	return claims, nil
+}
+
+// GenerateRefreshToken генерирует случайный токен обновления сессии и его хэш для хранения в БД
+func GenerateRefreshToken() (token, hash string, err error) {
+	token, err = generateSecretToken()
+	if err != nil {
+		return "", "", fmt.Errorf("failed to generate refresh token: %w", err)
+	}
+	return token, HashRefreshToken(token), nil
+}
+
+// HashRefreshToken возвращает хэш токена обновления, под которым он хранится в БД
+func HashRefreshToken(token string) string {
+	return hashSecretToken(token)
+}
+
+// GenerateVerificationToken генерирует одноразовый токен подтверждения, отправляемый пользователю
+// в письме, и его хэш для хранения в БД
+func GenerateVerificationToken() (token, hash string, err error) {
+	token, err = generateSecretToken()
+	if err != nil {
+		return "", "", fmt.Errorf("failed to generate verification token: %w", err)
+	}
+	return token, HashVerificationToken(token), nil
+}
+
+// HashVerificationToken возвращает хэш токена подтверждения, под которым он хранится в БД
+func HashVerificationToken(token string) string {
+	return hashSecretToken(token)
+}
+
+// GenerateWebhookSecret генерирует ключ подписи событий, отправляемых на webhook
+func GenerateWebhookSecret() (string, error) {
+	secret, err := generateSecretToken()
+	if err != nil {
+		return "", fmt.Errorf("failed to generate webhook secret: %w", err)
+	}
+	return secret, nil
+}
+
+func generateSecretToken() (string, error) {
+	b := make([]byte, secretTokenSize)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func hashSecretToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
 func IsValidOrderNum(orderNumber string) bool {
 	var sum int
 	double := false
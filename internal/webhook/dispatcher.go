@@ -0,0 +1,248 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pinbrain/gophermart/internal/logger"
+	"github.com/pinbrain/gophermart/internal/model"
+)
+
+// Заголовки запроса, отправляемого на webhook
+const (
+	HeaderID        = "X-Webhook-Id"
+	HeaderEvent     = "X-Webhook-Event"
+	HeaderTimestamp = "X-Webhook-Timestamp"
+	HeaderSignature = "X-Webhook-Signature"
+)
+
+const (
+	// Значения по умолчанию
+	defaultPollInterval = 5 * time.Second
+	defaultMaxAttempts  = 10
+	defaultBaseBackoff  = 10 * time.Second
+	defaultMaxBackoff   = 6 * time.Hour
+	// Сколько событий отправляется за один проход
+	batchSize = 20
+	// Таймаут запроса на webhook
+	requestTimeout = 10 * time.Second
+	// На это время событие закрепляется за экземпляром сервиса, пока он его отправляет
+	deliveryLease = time.Minute
+	// Сколько байт ответа webhook сохраняется в описании ошибки
+	maxErrorBody = 256
+)
+
+var errPrivateAddress = errors.New("webhook address resolves to a private network")
+
+type Storage interface {
+	ClaimWebhookDeliveries(ctx context.Context, limit int, leaseUntil time.Time) ([]model.WebhookDelivery, error)
+	CompleteWebhookDelivery(ctx context.Context, deliveryID int64) error
+	FailWebhookDelivery(ctx context.Context, deliveryID int64, nextAttemptAt time.Time, lastError string) error
+	EnqueueOutboxWebhookEvent(ctx context.Context, event model.OutboxEvent) error
+}
+
+type DispatcherCfg struct {
+	// Интервал проверки очереди доставки
+	PollInterval time.Duration
+	// Количество попыток доставки, после которого событие больше не отправляется
+	MaxAttempts int
+	// Задержка перед второй попыткой, далее удваивается с каждой попыткой до MaxBackoff
+	BaseBackoff time.Duration
+	MaxBackoff  time.Duration
+	// Разрешить отправку на адреса локальной и частных сетей. По умолчанию запрещено, чтобы
+	// пользователь не мог обращаться через сервис к внутренней инфраструктуре.
+	AllowPrivateNetworks bool
+}
+
+// Dispatcher периодически отправляет события из очереди доставки на webhooks пользователей
+// с подписью HMAC-SHA256 и повторяет неудачные попытки с экспоненциальной задержкой
+type Dispatcher struct {
+	storage Storage
+	cfg     DispatcherCfg
+	client  *http.Client
+
+	ctx       context.Context
+	ctxCancel context.CancelFunc
+	wg        sync.WaitGroup
+}
+
+func NewDispatcher(storage Storage, cfg DispatcherCfg) *Dispatcher {
+	if cfg.PollInterval <= 0 {
+		cfg.PollInterval = defaultPollInterval
+	}
+	if cfg.MaxAttempts <= 0 {
+		cfg.MaxAttempts = defaultMaxAttempts
+	}
+	if cfg.BaseBackoff <= 0 {
+		cfg.BaseBackoff = defaultBaseBackoff
+	}
+	if cfg.MaxBackoff < cfg.BaseBackoff {
+		cfg.MaxBackoff = defaultMaxBackoff
+	}
+	dialer := &net.Dialer{Timeout: requestTimeout}
+	if !cfg.AllowPrivateNetworks {
+		// Адрес проверяется после разрешения имени, поэтому DNS не позволит обойти ограничение
+		dialer.Control = func(_, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || isPrivateIP(ip) {
+				return errPrivateAddress
+			}
+			return nil
+		}
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = dialer.DialContext
+	transport.Proxy = nil
+	return &Dispatcher{
+		storage: storage,
+		cfg:     cfg,
+		client:  &http.Client{Timeout: requestTimeout, Transport: transport},
+		wg:      sync.WaitGroup{},
+	}
+}
+
+func isPrivateIP(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast()
+}
+
+// Sign возвращает подпись тела запроса: HMAC-SHA256 от строки "timestamp.body" в hex
+func Sign(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// backoff возвращает задержку перед следующей попыткой после attempts неудачных
+func (d *Dispatcher) backoff(attempts int) time.Duration {
+	delay := d.cfg.BaseBackoff
+	for i := 1; i < attempts; i++ {
+		delay *= 2
+		if delay >= d.cfg.MaxBackoff {
+			return d.cfg.MaxBackoff
+		}
+	}
+	return delay
+}
+
+func (d *Dispatcher) send(ctx context.Context, delivery model.WebhookDelivery) error {
+	body, err := json.Marshal(model.WebhookMessage{
+		ID:        delivery.ID,
+		Event:     delivery.Event,
+		CreatedAt: delivery.CreatedAt,
+		Data:      delivery.Payload,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to encode webhook message: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, delivery.URL, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to build webhook request: %w", err)
+	}
+	timestamp := time.Now().Unix()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(HeaderID, strconv.FormatInt(delivery.ID, 10))
+	req.Header.Set(HeaderEvent, string(delivery.Event))
+	req.Header.Set(HeaderTimestamp, strconv.FormatInt(timestamp, 10))
+	req.Header.Set(HeaderSignature, Sign(delivery.Secret, timestamp, body))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send webhook request: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		respBody, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrorBody))
+		return fmt.Errorf("webhook returned status %d: %s", resp.StatusCode, respBody)
+	}
+	return nil
+}
+
+func (d *Dispatcher) deliver(delivery model.WebhookDelivery) {
+	deliveryLogger := logger.Log.WithField("delivery_id", delivery.ID)
+	sendErr := d.send(d.ctx, delivery)
+	if sendErr == nil {
+		if err := d.storage.CompleteWebhookDelivery(d.ctx, delivery.ID); err != nil {
+			deliveryLogger.WithError(err).Error("failed to complete webhook delivery")
+		}
+		return
+	}
+
+	attempts := delivery.Attempts + 1
+	var nextAttemptAt time.Time
+	if attempts < d.cfg.MaxAttempts {
+		nextAttemptAt = time.Now().Add(d.backoff(attempts))
+		deliveryLogger.WithError(sendErr).Debug("Webhook delivery failed, will retry")
+	} else {
+		deliveryLogger.WithError(sendErr).Warn("Webhook delivery failed, attempts exhausted")
+	}
+	if err := d.storage.FailWebhookDelivery(d.ctx, delivery.ID, nextAttemptAt, sendErr.Error()); err != nil {
+		deliveryLogger.WithError(err).Error("failed to record webhook delivery failure")
+	}
+}
+
+func (d *Dispatcher) dispatch() {
+	defer d.wg.Done()
+	for {
+		select {
+		case <-d.ctx.Done():
+			logger.Log.Debug("Webhook dispatcher stopped")
+			return
+		case <-time.After(d.cfg.PollInterval):
+			deliveries, err := d.storage.ClaimWebhookDeliveries(d.ctx, batchSize, time.Now().Add(deliveryLease))
+			if err != nil {
+				logger.Log.WithError(err).Error("failed to claim webhook deliveries")
+				continue
+			}
+			var batch sync.WaitGroup
+			for _, delivery := range deliveries {
+				batch.Add(1)
+				go func(delivery model.WebhookDelivery) {
+					defer batch.Done()
+					d.deliver(delivery)
+				}(delivery)
+			}
+			batch.Wait()
+		}
+	}
+}
+
+// Publish ставит событие из outbox в очередь доставки на webhooks пользователя, подписанные на него.
+// Повторная публикация того же события не создает повторных доставок.
+func (d *Dispatcher) Publish(ctx context.Context, event model.OutboxEvent) error {
+	return d.storage.EnqueueOutboxWebhookEvent(ctx, event)
+}
+
+func (d *Dispatcher) Start() {
+	d.ctx, d.ctxCancel = context.WithCancel(context.Background())
+
+	d.wg.Add(1)
+	go d.dispatch()
+}
+
+func (d *Dispatcher) Stop() {
+	if err := d.ctx.Err(); err != nil {
+		logger.Log.Debug("Webhook dispatcher already stopped")
+		return
+	}
+	d.ctxCancel()
+	d.wg.Wait()
+}
@@ -0,0 +1,326 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pinbrain/gophermart/internal/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type failedDelivery struct {
+	id            int64
+	nextAttemptAt time.Time
+	lastError     string
+}
+
+// memoryStorage хранит очередь доставки в памяти. Неудачная доставка возвращается в очередь
+// к моменту следующей попытки, как в БД.
+type memoryStorage struct {
+	mu        sync.Mutex
+	queue     []model.WebhookDelivery
+	claimed   map[int64]model.WebhookDelivery
+	dueAt     map[int64]time.Time
+	completed []int64
+	failed    []failedDelivery
+}
+
+func newMemoryStorage(deliveries ...model.WebhookDelivery) *memoryStorage {
+	return &memoryStorage{
+		queue:   deliveries,
+		claimed: make(map[int64]model.WebhookDelivery),
+		dueAt:   make(map[int64]time.Time),
+	}
+}
+
+func (st *memoryStorage) ClaimWebhookDeliveries(
+	_ context.Context, limit int, _ time.Time,
+) ([]model.WebhookDelivery, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	var claimed, rest []model.WebhookDelivery
+	for _, delivery := range st.queue {
+		if len(claimed) < limit && !time.Now().Before(st.dueAt[delivery.ID]) {
+			claimed = append(claimed, delivery)
+			st.claimed[delivery.ID] = delivery
+		} else {
+			rest = append(rest, delivery)
+		}
+	}
+	st.queue = rest
+	return claimed, nil
+}
+
+func (st *memoryStorage) CompleteWebhookDelivery(_ context.Context, deliveryID int64) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.completed = append(st.completed, deliveryID)
+	return nil
+}
+
+func (st *memoryStorage) FailWebhookDelivery(
+	_ context.Context, deliveryID int64, nextAttemptAt time.Time, lastError string,
+) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.failed = append(st.failed, failedDelivery{id: deliveryID, nextAttemptAt: nextAttemptAt, lastError: lastError})
+	if nextAttemptAt.IsZero() {
+		return nil
+	}
+	delivery := st.claimed[deliveryID]
+	delivery.Attempts++
+	st.queue = append(st.queue, delivery)
+	st.dueAt[deliveryID] = nextAttemptAt
+	return nil
+}
+
+func (st *memoryStorage) EnqueueOutboxWebhookEvent(context.Context, model.OutboxEvent) error {
+	return nil
+}
+
+func (st *memoryStorage) results() ([]int64, []failedDelivery) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return append([]int64(nil), st.completed...), append([]failedDelivery(nil), st.failed...)
+}
+
+// webhookRequest - запрос, полученный webhook
+type webhookRequest struct {
+	header http.Header
+	body   []byte
+}
+
+// newWebhookServer возвращает webhook, который отвечает статусами из statuses по очереди, а после
+// них - 200 OK
+func newWebhookServer(t *testing.T, statuses ...int) (*httptest.Server, func() []webhookRequest) {
+	var mu sync.Mutex
+	var requests []webhookRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		assert.NoError(t, err)
+		mu.Lock()
+		requests = append(requests, webhookRequest{header: r.Header.Clone(), body: body})
+		status := http.StatusOK
+		if len(requests) <= len(statuses) {
+			status = statuses[len(requests)-1]
+		}
+		mu.Unlock()
+		w.WriteHeader(status)
+		_, _ = w.Write([]byte("webhook response"))
+	}))
+	t.Cleanup(server.Close)
+	return server, func() []webhookRequest {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]webhookRequest(nil), requests...)
+	}
+}
+
+func newDelivery(url string, attempts int) model.WebhookDelivery {
+	return model.WebhookDelivery{
+		ID:        1,
+		URL:       url,
+		Secret:    "secret",
+		Event:     model.WebhookOrderProcessed,
+		Payload:   json.RawMessage(`{"number":"12345678903"}`),
+		Attempts:  attempts,
+		CreatedAt: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+	}
+}
+
+func TestSign(t *testing.T) {
+	body := []byte(`{"id":1}`)
+	signature := Sign("secret", 1700000000, body)
+	assert.Equal(t, "3dd1b9aef568d75f6790a84bd2e5dfa1f44409eef3cbdbd3f10b837376100c11", signature)
+
+	// Подпись зависит от секрета, времени и тела запроса
+	assert.NotEqual(t, signature, Sign("other", 1700000000, body))
+	assert.NotEqual(t, signature, Sign("secret", 1700000001, body))
+	assert.NotEqual(t, signature, Sign("secret", 1700000000, []byte(`{"id":2}`)))
+}
+
+func TestBackoff(t *testing.T) {
+	capped := DispatcherCfg{BaseBackoff: 10 * time.Second, MaxBackoff: time.Minute}
+	tests := []struct {
+		name     string
+		cfg      DispatcherCfg
+		attempts int
+		want     time.Duration
+	}{
+		{name: "После первой попытки", cfg: capped, attempts: 1, want: 10 * time.Second},
+		{name: "Задержка удваивается", cfg: capped, attempts: 3, want: 40 * time.Second},
+		{name: "Задержка ограничена сверху", cfg: capped, attempts: 4, want: time.Minute},
+		{name: "Много попыток не переполняют задержку", cfg: capped, attempts: 1000, want: time.Minute},
+		{name: "Значения по умолчанию", attempts: 1, want: defaultBaseBackoff},
+		{name: "Ограничение по умолчанию", attempts: 1000, want: defaultMaxBackoff},
+		{
+			name:     "Ограничение меньше начальной задержки",
+			cfg:      DispatcherCfg{BaseBackoff: time.Hour, MaxBackoff: time.Minute},
+			attempts: 100,
+			want:     defaultMaxBackoff,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := NewDispatcher(newMemoryStorage(), tt.cfg)
+			assert.Equal(t, tt.want, d.backoff(tt.attempts))
+		})
+	}
+}
+
+func TestDeliver(t *testing.T) {
+	tests := []struct {
+		name     string
+		status   int
+		attempts int
+		// Доставка завершена
+		wantCompleted bool
+		// Следующая попытка запланирована
+		wantRetry bool
+	}{
+		{name: "Успешная доставка", status: http.StatusOK, wantCompleted: true},
+		{name: "Любой статус 2xx - успех", status: http.StatusNoContent, wantCompleted: true},
+		{name: "Ошибка webhook - повтор", status: http.StatusInternalServerError, attempts: 2, wantRetry: true},
+		{name: "Статус 3xx не считается доставкой", status: http.StatusNotModified, wantRetry: true},
+		{name: "Попытки исчерпаны", status: http.StatusBadGateway, attempts: 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, requests := newWebhookServer(t, tt.status)
+			st := newMemoryStorage()
+			d := NewDispatcher(st, DispatcherCfg{
+				MaxAttempts:          5,
+				BaseBackoff:          time.Minute,
+				MaxBackoff:           time.Hour,
+				AllowPrivateNetworks: true,
+			})
+			d.ctx = context.Background()
+			delivery := newDelivery(server.URL, tt.attempts)
+
+			d.deliver(delivery)
+
+			received := requests()
+			require.Len(t, received, 1)
+			header := received[0].header
+			assert.Equal(t, "1", header.Get(HeaderID))
+			assert.Equal(t, string(model.WebhookOrderProcessed), header.Get(HeaderEvent))
+			timestamp, err := strconv.ParseInt(header.Get(HeaderTimestamp), 10, 64)
+			require.NoError(t, err)
+			assert.Equal(t, Sign("secret", timestamp, received[0].body), header.Get(HeaderSignature))
+			var message model.WebhookMessage
+			require.NoError(t, json.Unmarshal(received[0].body, &message))
+			assert.JSONEq(t, string(delivery.Payload), string(message.Data))
+
+			completed, failed := st.results()
+			if tt.wantCompleted {
+				assert.Equal(t, []int64{1}, completed)
+				assert.Empty(t, failed)
+				return
+			}
+			assert.Empty(t, completed)
+			require.Len(t, failed, 1)
+			assert.Contains(t, failed[0].lastError, "webhook returned status "+strconv.Itoa(tt.status))
+			if !tt.wantRetry {
+				assert.True(t, failed[0].nextAttemptAt.IsZero())
+				return
+			}
+			assert.WithinDuration(t, time.Now().Add(d.backoff(tt.attempts+1)), failed[0].nextAttemptAt, time.Second)
+		})
+	}
+}
+
+func TestDispatcherRetries(t *testing.T) {
+	server, requests := newWebhookServer(t, http.StatusServiceUnavailable, http.StatusServiceUnavailable)
+	st := newMemoryStorage(newDelivery(server.URL, 0))
+	d := NewDispatcher(st, DispatcherCfg{
+		PollInterval:         10 * time.Millisecond,
+		MaxAttempts:          5,
+		BaseBackoff:          20 * time.Millisecond,
+		MaxBackoff:           time.Second,
+		AllowPrivateNetworks: true,
+	})
+	d.Start()
+	defer d.Stop()
+
+	require.Eventually(t, func() bool {
+		completed, _ := st.results()
+		return len(completed) == 1
+	}, 2*time.Second, 10*time.Millisecond)
+	_, failed := st.results()
+	require.Len(t, failed, 2)
+	assert.Len(t, requests(), 3)
+	// Вторая попытка запланирована с удвоенной задержкой
+	for _, f := range failed {
+		assert.False(t, f.nextAttemptAt.IsZero())
+	}
+	assert.Greater(t, failed[1].nextAttemptAt.Sub(failed[0].nextAttemptAt), d.backoff(1))
+}
+
+func TestPrivateNetworks(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		requests.Add(1)
+	}))
+	t.Cleanup(server.Close)
+	_, port, err := net.SplitHostPort(server.Listener.Addr().String())
+	require.NoError(t, err)
+
+	tests := []struct {
+		name    string
+		url     string
+		allow   bool
+		wantErr bool
+	}{
+		{name: "Адрес loopback запрещен", url: server.URL, wantErr: true},
+		{name: "Имя localhost запрещено", url: "http://localhost:" + port, wantErr: true},
+		{name: "Адрес loopback разрешен настройкой", url: server.URL, allow: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			requests.Store(0)
+			d := NewDispatcher(newMemoryStorage(), DispatcherCfg{AllowPrivateNetworks: tt.allow})
+			err := d.send(context.Background(), newDelivery(tt.url, 0))
+			if tt.wantErr {
+				assert.ErrorIs(t, err, errPrivateAddress)
+				assert.Zero(t, requests.Load())
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, int32(1), requests.Load())
+		})
+	}
+}
+
+func TestIsPrivateIP(t *testing.T) {
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{ip: "127.0.0.1", want: true},
+		{ip: "::1", want: true},
+		{ip: "10.1.2.3", want: true},
+		{ip: "172.16.0.1", want: true},
+		{ip: "192.168.1.1", want: true},
+		{ip: "169.254.169.254", want: true},
+		{ip: "fe80::1", want: true},
+		{ip: "fd00::1", want: true},
+		{ip: "0.0.0.0", want: true},
+		{ip: "8.8.8.8", want: false},
+		{ip: "2001:4860:4860::8888", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.ip, func(t *testing.T) {
+			assert.Equal(t, tt.want, isPrivateIP(net.ParseIP(tt.ip)))
+		})
+	}
+}
@@ -0,0 +1,256 @@
+package websocket
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// GUID из RFC 6455 для вычисления Sec-WebSocket-Accept
+const acceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// Коды операций фреймов
+const (
+	opContinuation = 0x0
+	opText         = 0x1
+	opBinary       = 0x2
+	opClose        = 0x8
+	opPing         = 0x9
+	opPong         = 0xA
+)
+
+// Коды закрытия соединения
+const (
+	CloseNormal       = 1000
+	CloseGoingAway    = 1001
+	CloseProtocolErr  = 1002
+	CloseTooLarge     = 1009
+	closeNoStatusSent = 1005
+)
+
+// Максимальный размер сообщения от клиента по умолчанию
+const defaultMaxMessageSize = 64 * 1024
+
+// Таймаут записи фрейма клиенту
+const writeTimeout = 10 * time.Second
+
+var (
+	ErrBadHandshake = errors.New("websocket: bad handshake")
+	// ErrClosed возвращается из ReadMessage, когда клиент закрыл соединение
+	ErrClosed = errors.New("websocket: connection closed")
+)
+
+// Conn - соединение WebSocket на стороне сервера. ReadMessage нужно вызывать из одной горутины,
+// методы записи безопасно вызывать конкурентно.
+type Conn struct {
+	conn           net.Conn
+	br             *bufio.Reader
+	maxMessageSize int
+
+	writeMu sync.Mutex
+	closed  bool
+}
+
+// Upgrade переводит HTTP-запрос на протокол WebSocket. При некорректном запросе
+// отвечает клиенту 400 и возвращает ErrBadHandshake.
+func Upgrade(w http.ResponseWriter, r *http.Request) (*Conn, error) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if r.Method != http.MethodGet ||
+		!headerContainsToken(r.Header, "Connection", "upgrade") ||
+		!headerContainsToken(r.Header, "Upgrade", "websocket") ||
+		r.Header.Get("Sec-WebSocket-Version") != "13" || key == "" {
+		http.Error(w, "Ожидается запрос на подключение WebSocket", http.StatusBadRequest)
+		return nil, ErrBadHandshake
+	}
+
+	netConn, rw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return nil, fmt.Errorf("websocket: failed to hijack connection: %w", err)
+	}
+	_, err = fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\n"+
+		"Upgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n\r\n", acceptKey(key))
+	if err == nil {
+		err = rw.Flush()
+	}
+	if err != nil {
+		netConn.Close()
+		return nil, fmt.Errorf("websocket: failed to write handshake: %w", err)
+	}
+	return &Conn{conn: netConn, br: rw.Reader, maxMessageSize: defaultMaxMessageSize}, nil
+}
+
+func acceptKey(key string) string {
+	h := sha1.New()
+	h.Write([]byte(key + acceptGUID))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+func headerContainsToken(header http.Header, name, token string) bool {
+	for _, value := range header.Values(name) {
+		for _, t := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ReadMessage возвращает следующее текстовое или бинарное сообщение клиента. Ping и закрытие
+// соединения обрабатываются внутри: на закрытие клиентом отвечает тем же и возвращает ErrClosed.
+func (c *Conn) ReadMessage() ([]byte, error) {
+	var message []byte
+	started := false
+	for {
+		fin, opcode, payload, err := c.readFrame()
+		if err != nil {
+			return nil, err
+		}
+		switch opcode {
+		case opPing:
+			if err = c.writeFrame(opPong, payload); err != nil {
+				return nil, err
+			}
+		case opPong:
+		case opClose:
+			code := closeNoStatusSent
+			if len(payload) >= 2 {
+				code = int(binary.BigEndian.Uint16(payload))
+			}
+			c.Close(code, "")
+			return nil, ErrClosed
+		case opText, opBinary, opContinuation:
+			if (opcode == opContinuation) != started {
+				c.Close(CloseProtocolErr, "unexpected continuation frame")
+				return nil, fmt.Errorf("websocket: unexpected frame opcode %d", opcode)
+			}
+			started = true
+			if len(message)+len(payload) > c.maxMessageSize {
+				c.Close(CloseTooLarge, "message too large")
+				return nil, fmt.Errorf("websocket: message exceeds %d bytes", c.maxMessageSize)
+			}
+			message = append(message, payload...)
+			if fin {
+				return message, nil
+			}
+		default:
+			c.Close(CloseProtocolErr, "unknown opcode")
+			return nil, fmt.Errorf("websocket: unknown frame opcode %d", opcode)
+		}
+	}
+}
+
+func (c *Conn) readFrame() (fin bool, opcode byte, payload []byte, err error) {
+	var header [2]byte
+	if _, err = io.ReadFull(c.br, header[:]); err != nil {
+		return false, 0, nil, err
+	}
+	fin = header[0]&0x80 != 0
+	opcode = header[0] & 0x0F
+	// Клиент обязан маскировать все фреймы
+	if header[1]&0x80 == 0 {
+		c.Close(CloseProtocolErr, "unmasked frame")
+		return false, 0, nil, errors.New("websocket: unmasked client frame")
+	}
+	length := uint64(header[1] & 0x7F)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err = io.ReadFull(c.br, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err = io.ReadFull(c.br, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+	if length > uint64(c.maxMessageSize) {
+		c.Close(CloseTooLarge, "message too large")
+		return false, 0, nil, fmt.Errorf("websocket: frame exceeds %d bytes", c.maxMessageSize)
+	}
+	var mask [4]byte
+	if _, err = io.ReadFull(c.br, mask[:]); err != nil {
+		return false, 0, nil, err
+	}
+	payload = make([]byte, length)
+	if _, err = io.ReadFull(c.br, payload); err != nil {
+		return false, 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return fin, opcode, payload, nil
+}
+
+// WriteText отправляет клиенту текстовое сообщение
+func (c *Conn) WriteText(data []byte) error {
+	return c.writeFrame(opText, data)
+}
+
+// Ping отправляет клиенту ping для проверки соединения
+func (c *Conn) Ping() error {
+	return c.writeFrame(opPing, nil)
+}
+
+func (c *Conn) writeFrame(opcode byte, payload []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if c.closed {
+		return ErrClosed
+	}
+	return c.writeFrameLocked(opcode, payload)
+}
+
+func (c *Conn) writeFrameLocked(opcode byte, payload []byte) error {
+	// Сервер отправляет сообщения одним фреймом без маски
+	frame := make([]byte, 0, len(payload)+10)
+	frame = append(frame, 0x80|opcode)
+	switch {
+	case len(payload) < 126:
+		frame = append(frame, byte(len(payload)))
+	case len(payload) <= 0xFFFF:
+		frame = append(frame, 126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(len(payload)))
+	default:
+		frame = append(frame, 127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(len(payload)))
+	}
+	frame = append(frame, payload...)
+	if err := c.conn.SetWriteDeadline(time.Now().Add(writeTimeout)); err != nil {
+		return err
+	}
+	_, err := c.conn.Write(frame)
+	return err
+}
+
+// Close отправляет клиенту фрейм закрытия с кодом code и закрывает соединение.
+// Повторные вызовы ничего не делают.
+func (c *Conn) Close(code int, reason string) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	var payload []byte
+	if code != closeNoStatusSent {
+		payload = binary.BigEndian.AppendUint16(nil, uint16(code))
+		payload = append(payload, reason...)
+	}
+	// Соединение закрывается в любом случае, ошибка отправки фрейма закрытия не важна
+	_ = c.writeFrameLocked(opClose, payload)
+	return c.conn.Close()
+}